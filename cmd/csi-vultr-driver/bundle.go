@@ -0,0 +1,94 @@
+/*
+Copyright 2020 Vultr.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vultr/vultr-csi/driver"
+)
+
+const supportBundleTimeout = 2 * time.Minute
+
+// runSupportBundle collects the state of the plugin running beside it into an archive
+// to attach to bug reports
+func runSupportBundle(args []string) error {
+	fs := flag.NewFlagSet("support-bundle", flag.ExitOnError)
+	endpoint := fs.String("endpoint", "unix:///var/lib/kubelet/plugins/"+driver.DefaultDriverName+"/csi.sock",
+		"CSI endpoint of the plugin, empty to skip its plugin info")
+	adminURL := fs.String("admin-url", "", "Base URL of the admin HTTP API of the plugin, empty to skip its volumes")
+	adminToken := fs.String("admin-token", os.Getenv("VULTR_CSI_ADMIN_TOKEN"), "Bearer token for the admin HTTP API")
+	metricsURL := fs.String("metrics-url", "", "Base URL the plugin serves its metrics on, empty to skip them")
+	apiRecordFile := fs.String("api-record-file", "", "API recording of the plugin, empty to skip it")
+	logFiles := fs.String("log-files", "", "Comma separated driver log files to include")
+	redact := fs.String("redact", "", "Comma separated values to redact on top of the API token and webhook secret")
+	output := fs.String("output", "", "File to write the archive to, - for stdout, vultr-csi-support-<time>.tar.gz when empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	opts := driver.SupportBundleOptions{
+		Version:       version,
+		Endpoint:      *endpoint,
+		AdminURL:      *adminURL,
+		AdminToken:    *adminToken,
+		MetricsURL:    *metricsURL,
+		APIRecordFile: *apiRecordFile,
+		LogFiles:      splitList(*logFiles),
+		Secrets:       append(splitList(*redact), os.Getenv("VULTR_API_KEY"), os.Getenv("VULTR_CSI_WEBHOOK_SECRET")),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), supportBundleTimeout)
+	defer cancel()
+
+	if *output == "-" {
+		return driver.WriteSupportBundle(ctx, os.Stdout, opts)
+	}
+
+	name := *output
+	if name == "" {
+		name = fmt.Sprintf("vultr-csi-support-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	}
+
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := driver.WriteSupportBundle(ctx, f, opts); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "wrote %s\n", name)
+	return nil
+}
+
+// splitList returns the non empty items of a comma separated list
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
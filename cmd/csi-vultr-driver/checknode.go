@@ -0,0 +1,81 @@
+/*
+Copyright 2020 Vultr.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vultr/vultr-csi/driver"
+)
+
+// runCheckNode checks that this node can stage volumes and prints a report of each check,
+// to attach to support tickets
+func runCheckNode(args []string) error {
+	fs := flag.NewFlagSet("check-node", flag.ExitOnError)
+	kubeletDir := fs.String("kubelet-dir", driver.DefaultKubeletDir, "Root directory of kubelet, holding the staging paths")
+	metadataURL := fs.String("metadata-url", "", "Base URL of the Vultr instance metadata service")
+	output := fs.String("output", "text", "Format of the report, text or json")
+	timeout := fs.Duration("timeout", time.Minute, "How long the checks may take")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("unknown output %q, must be text or json", *output)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	checks, err := driver.CheckNode(ctx, driver.NodeCheckOptions{
+		KubeletDir:  *kubeletDir,
+		MetadataURL: *metadataURL,
+	})
+	if err != nil {
+		return err
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(checks); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, check := range checks {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", strings.ToUpper(check.Result), check.Name, check.Detail)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	var failed int
+	for _, check := range checks {
+		if check.Result == driver.NodeCheckFail {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d node checks failed", failed, len(checks))
+	}
+	return nil
+}
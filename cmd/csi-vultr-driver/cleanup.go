@@ -0,0 +1,64 @@
+/*
+Copyright 2020 Vultr.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/vultr/vultr-csi/driver"
+)
+
+// runNodeCleanup unstages the volumes of the driver on this node, and detaches them with
+// a token, for the decommission of the node once its pods are gone
+func runNodeCleanup(args []string) error {
+	fs := flag.NewFlagSet("node-cleanup", flag.ExitOnError)
+	token := fs.String("token", os.Getenv("VULTR_API_KEY"), "Vultr API Token, required to detach the volumes")
+	apiURL := fs.String("vultr-api-url", os.Getenv("VULTR_API_URL"), "Base URL of the Vultr API, for an egress proxy or a mock API")
+	driverName := fs.String("driver-name", driver.DefaultDriverName, "Name of driver")
+	kubeletDir := fs.String("kubelet-dir", driver.DefaultKubeletDir, "Root directory of kubelet, holding the staging paths")
+	detach := fs.Bool("detach", false, "Detach the unstaged volumes from the node")
+	nodeID := fs.String("node-id", os.Getenv("VULTR_CSI_NODE_ID"), "Vultr instance ID of the node, discovered from the instance metadata when empty")
+	region := fs.String("region", os.Getenv("VULTR_CSI_REGION"), "Vultr region of the node, discovered from the instance metadata when empty")
+	metadataURL := fs.String("metadata-url", "", "Base URL of the Vultr instance metadata service")
+	timeout := fs.Duration("timeout", 2*time.Minute, "How long the cleanup of all volumes may take")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	d, err := driver.NewDriver("", *token, *driverName, version, "", *apiURL,
+		driver.WithInstanceIdentity(*nodeID, *region),
+		driver.WithMetadataURL(*metadataURL),
+		driver.WithKubeletDir(*kubeletDir, ""),
+	)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	volumes, err := d.CleanupNode(ctx, *kubeletDir, *detach)
+	if volumes != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if encErr := enc.Encode(volumes); encErr != nil && err == nil {
+			err = encErr
+		}
+	}
+	return err
+}
@@ -14,33 +14,386 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strconv"
 
 	"github.com/vultr/vultr-csi/driver"
 )
 
-var version string
+var (
+	version string
+	commit  string
+)
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "volumes" {
+		if err := runVolumes(os.Args[2:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "support-bundle" {
+		if err := runSupportBundle(os.Args[2:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "node-cleanup" {
+		if err := runNodeCleanup(os.Args[2:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check-node" {
+		if err := runCheckNode(os.Args[2:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
 
 	var (
-		endpoint   = flag.String("endpoint", "unix:///var/lib/kubelet/plugins/"+driver.DefaultDriverName+"/csi.sock", "CSI endpoint")
+		endpoint   = flag.String("endpoint", "", "CSI endpoint, the unix socket at the kubelet registration path when empty")
 		token      = flag.String("token", "", "Vultr API Token")
-		apiURL     = flag.String("api-url", "", "Vultr API URL")
+		apiURL     = flag.String("vultr-api-url", envString("VULTR_API_URL", ""), "Base URL of the Vultr API, for an egress proxy or a mock API")
 		driverName = flag.String("driver-name", driver.DefaultDriverName, "Name of driver")
 		userAgent  = flag.String("user-agent", "", "Custom user agent")
+		adminAddr  = flag.String("admin-addr", "", "Address to serve the admin HTTP API on, disabled when empty")
+		adminToken = flag.String("admin-token", os.Getenv("VULTR_CSI_ADMIN_TOKEN"), "Bearer token required by the admin HTTP API")
+
+		apiCA = flag.String("vultr-api-ca-bundle", envString("VULTR_API_CA_BUNDLE", ""),
+			"PEM file of CA certificates trusted for the Vultr API besides the system ones")
+
+		nodeID      = flag.String("node-id", os.Getenv("VULTR_CSI_NODE_ID"), "Vultr instance ID of the node, discovered from the instance metadata when empty")
+		region      = flag.String("region", os.Getenv("VULTR_CSI_REGION"), "Vultr region of the node, discovered from the instance metadata when empty")
+		metadataURL = flag.String("metadata-url", "", "Base URL of the Vultr instance metadata service")
+
+		regionKey = flag.String("topology-region-key", driver.DefaultTopologyRegionKey,
+			"Authoritative topology key of the region, region or topology.kubernetes.io/region, which volumes are accessible under")
+
+		volumeLabelPrefix    = flag.String("volume-label-prefix", "", "Prefix added to the label of created volumes")
+		volumeLabelMaxLength = flag.Int("volume-label-max-length", driver.DefaultVolumeLabelMaxLength, "Maximum length of created volume labels")
+		clusterID            = flag.String("cluster-id", "", "ID of the cluster, starting the labels of created volumes and tagging VFS volumes")
+
+		maxConcurrentStages = flag.Int("max-concurrent-stages", 0, "Maximum volumes the node formats and mounts at once, 0 is unlimited")
+		maxParallelCreates  = flag.Int("max-parallel-creates", driver.DefaultMaxParallelCreates,
+			"Maximum volumes the controller creates at once, 0 is unlimited")
+		maxQueuedCreates = flag.Int("max-queued-creates", driver.DefaultMaxQueuedCreates,
+			"Maximum volume creates waiting for the ones in progress before the next ones fail with Unavailable")
+		volumeStatsCacheTTL = flag.Duration("volume-stats-cache-ttl", driver.DefaultVolumeStatsCacheTTL,
+			"How long the node answers volume statistics from its last measurement of a volume, 0 measures on every call")
+
+		healthAddr  = flag.String("health-addr", "", "Address to serve the /healthz and /readyz HTTP probes on, disabled when empty")
+		metricsAddr = flag.String("metrics-addr", "", "Address to serve Prometheus metrics on, disabled when empty")
+
+		grpcMaxConcurrentStreams = flag.Uint("grpc-max-concurrent-streams", 0, "RPCs a client may run at once on its connection, 0 for no bound")
+		grpcKeepaliveTime        = flag.Duration("grpc-keepalive-time", 0,
+			"How long a connection stays idle before the server pings the client, 0 for the gRPC default of 2h")
+		grpcKeepaliveTimeout = flag.Duration("grpc-keepalive-timeout", 0,
+			"How long the server waits for a ping to be acknowledged before it closes the connection, 0 for the gRPC default of 20s")
+		grpcKeepaliveMinTime = flag.Duration("grpc-keepalive-min-time", 0,
+			"How often clients may ping the server before they are disconnected, 0 for the gRPC default of 5m")
+		grpcKeepalivePermitWithoutStream = flag.Bool("grpc-keepalive-permit-without-stream", false,
+			"Let clients ping connections without RPCs in flight")
+
+		socketMode = flag.String("socket-mode", "", "Octal mode of the unix socket of the endpoint, left as the umask gives when empty")
+		socketUID  = flag.Int("socket-uid", -1, "Owner uid of the unix socket of the endpoint, -1 leaves it unchanged")
+		socketGID  = flag.Int("socket-gid", -1, "Owner gid of the unix socket of the endpoint, -1 leaves it unchanged")
+
+		targetDirMode = flag.String("target-dir-mode", "0750", "Octal mode of the staging and target directories the node creates")
+		targetDirUID  = flag.Int("target-dir-uid", -1, "Owner uid of the staging and target directories, -1 leaves it unchanged")
+		targetDirGID  = flag.Int("target-dir-gid", -1, "Owner gid of the staging and target directories, -1 leaves it unchanged")
+
+		defaultFsType = flag.String("default-fstype", "ext4",
+			"Filesystem to format volumes with when neither the volume capability nor the StorageClass names one")
+
+		fsckOnStage = flag.Bool("fsck-on-stage", false, "Check existing filesystems before staging, unless the StorageClass sets fsck")
+
+		unstageForceUnmount = flag.Bool("unstage-force-unmount", false,
+			"Unmount the publish mounts still referencing a volume when unstaging it, rather than failing until they are unpublished")
+
+		maxVolumesPerNode = flag.Int("max-volumes-per-node", envInt("VULTR_CSI_MAX_VOLUMES_PER_NODE"),
+			"Volumes the node reports it can attach, 0 derives it from the instance plan")
+		blockDiskSlots = flag.Int("block-disk-slots", driver.DefaultBlockDiskSlots,
+			"Virtio disks an instance can have, shared by the local disks of its plan and block storage, to derive the volumes of the node from")
+		maxVFSVolumesPerNode = flag.Int("max-vfs-volumes-per-node", 0,
+			"VFS volumes the node counts besides the block storage it can attach, 0 counts them against the block storage")
+
+		maintenanceBackoff = flag.Duration("maintenance-backoff", driver.DefaultMaintenanceBackoff,
+			"How long to hold off the Vultr API after it reports maintenance, 0 disables")
+
+		apiRecordFile     = flag.String("api-record-file", "", "File to record sanitized Vultr API exchanges to for bug reports, disabled when empty")
+		apiRecordMaxBytes = flag.Int64("api-record-max-bytes", driver.DefaultAPIRecordMaxBytes, "Size the API recording grows to before it is rotated")
+
+		auditLog = flag.String("audit-log", "", "File to append a JSON line to for every provisioning, attach, detach and delete, - for stdout, disabled when empty")
+
+		nodeAttachVFS = flag.Bool("node-attach-vfs", false, "Attach vfs volumes from the node at stage, for a CSIDriver with attachRequired false")
+		disableVFS    = flag.Bool("disable-vfs", false, "Disable the vfs storage type, for Vultr accounts and regions without VFS")
+
+		ephemeralVolumes = flag.Bool("ephemeral-volumes", false,
+			"Provision the inline volumes of pods from the node, for a CSIDriver with the Ephemeral lifecycle mode")
+		nodeOnly = flag.Bool("node-only", false,
+			"Serve the node service alone, for a node plugin given a token for --node-attach-vfs or --ephemeral-volumes")
+
+		attachTimeout = flag.Duration("attach-timeout", driver.DefaultAttachTimeout, "How long publish waits for Vultr to report a volume attached")
+		detachTimeout = flag.Duration("detach-timeout", driver.DefaultDetachTimeout, "How long unpublish waits for Vultr to report a volume detached")
+		drainTimeout  = flag.Duration("drain-timeout", driver.DefaultDrainTimeout, "How long a stopping driver waits for in-flight RPCs to complete")
+
+		deviceWaitTimeout = flag.Duration("device-wait-timeout", driver.DefaultDeviceWaitTimeout,
+			"How long staging waits for the device of an attached volume to appear")
+		deviceRecheckTimeout = flag.Duration("device-recheck-timeout", driver.DefaultDeviceRecheckTimeout,
+			"How long the node keeps looking for a device after staging gave up waiting for it, 0 disables")
+
+		apiRateLimit  = flag.Duration("api-rate-limit", driver.DefaultAPIRateLimit, "Minimum pause between Vultr API requests")
+		apiRetryLimit = flag.Int("api-retry-limit", driver.DefaultAPIRetryLimit, "How many times a failed Vultr API request is retried")
+		apiTimeout    = flag.Duration("vultr-api-timeout", driver.DefaultAPITimeout,
+			"How long each Vultr API request may take, within the deadline of the RPC making it, 0 disables")
+
+		apiRequestRate = flag.Float64("api-request-rate", driver.DefaultAPIRequestRate,
+			"Vultr API requests per second the driver sends at most, shared by all calls, 0 lifts the limit")
+		apiRequestBurst = flag.Int("api-request-burst", driver.DefaultAPIRequestBurst,
+			"Vultr API requests the driver may send at once after being idle")
+		apiThrottleThreshold = flag.Duration("api-throttle-threshold", driver.DefaultAPIThrottleThreshold,
+			"How long the Vultr API throttles the driver before controller calls fail fast with Unavailable, 0 disables")
+		apiBreakerThreshold = flag.Int("api-breaker-threshold", driver.DefaultAPIBreakerThreshold,
+			"Vultr API requests in a row failing with a 5xx or no response before controller calls fail fast with Unavailable, 0 disables")
+		apiBreakerOpenTimeout = flag.Duration("api-breaker-open-timeout", driver.DefaultAPIBreakerOpenTimeout,
+			"How long controller calls fail fast once the Vultr API keeps failing before one probes it again")
+		apiBreakerMaxOpenTimeout = flag.Duration("api-breaker-max-open-timeout", driver.DefaultAPIBreakerMaxOpenTimeout,
+			"Bound of the open timeout, which doubles each time the probe fails")
+
+		preflightCheck = flag.Bool("preflight-check", true,
+			"Check on start that the API token of the controller is valid and may manage block storage, failing fast otherwise")
+
+		leaderElectionLeases = flag.String("leader-election-lease-names", "",
+			"Comma separated Leases the sidecars of the controller run their leader election under, "+
+				"so that replicas whose sidecars do not lead stand by")
+		leaderElectionNamespace = flag.String("leader-election-namespace", "",
+			"Namespace of the leader election Leases, that of the pod when empty")
+		allowMultiController = flag.Bool("allow-multi-controller", false,
+			"Let the controller start while another controller is active for the same cluster ID")
+
+		detachFromDeletedNodes = flag.Bool("detach-from-deleted-nodes", true,
+			"Detach a volume from the instance it is attached to when publishing it elsewhere and that instance no longer exists, "+
+				"rather than failing until it is detached by hand")
+		deleteForceDetach = flag.Bool("delete-force-detach", false,
+			"Force detach a volume DeleteVolume keeps finding attached, as after a node crashed, rather than refusing to delete it")
+		deleteForceDetachGrace = flag.Duration("delete-force-detach-grace", driver.DefaultDeleteForceDetachGrace,
+			"How long DeleteVolume keeps finding a volume attached before force detaching it")
+		forceDetachAfter = flag.Duration("force-detach-after", 0,
+			"How long ControllerUnpublishVolume keeps failing to detach a volume before forcing the detach by restarting the instance, 0 disables")
+
+		shutdownDetachInterval = flag.Duration("shutdown-detach-interval", 0,
+			"How often the controller looks for Kubernetes nodes tainted as shut down to detach their volumes, 0 disables")
+		gcInterval = flag.Duration("gc-interval", 0,
+			"How often the controller looks for volumes of the cluster no persistent volume references, 0 disables")
+		gcMode        = flag.String("gc-mode", driver.GCModeReport, "Whether orphaned volumes are only reported or deleted: report or delete")
+		gcGracePeriod = flag.Duration("gc-grace-period", driver.DefaultGCGracePeriod,
+			"How long a volume goes unreferenced by any persistent volume before it is reported or deleted")
+		volumeStatusInterval = flag.Duration("volume-status-interval", 0,
+			"How often to publish the status of each volume to an annotation of its claim, 0 disables")
+		resizeTolerance = flag.Float64("resize-tolerance", driver.DefaultResizeTolerance,
+			"Percentage of the capacity required an expanded filesystem may fall short of before the expansion fails")
+		usageEventThreshold = flag.Float64("usage-event-threshold", 0,
+			"Percentage of bytes or inodes used above which the node posts a Warning event on the claim of the volume, 0 disables")
+		nodeLabelsInterval = flag.Duration("node-labels-interval", 0,
+			"How often the node labels its Kubernetes Node with its volume limit and annotates it with its staged volumes, 0 disables")
+		ioStatsInterval = flag.Duration("volume-io-stats-interval", 0,
+			"How often the node exports the read and write counters of the device of each staged volume as metrics, 0 disables")
+		vfsMonitorInterval = flag.Duration("vfs-mount-monitor-interval", 0,
+			"How often the node probes the virtiofs mount of each staged vfs volume and mounts those found dead again, 0 disables")
+		kubeNodeName = flag.String("kube-node-name", envString("KUBE_NODE_NAME", ""),
+			"Name of the Kubernetes Node of the node plugin, its hostname when empty")
+		kubeletDir = flag.String("kubelet-dir", envString("KUBELET_DIR", driver.DefaultKubeletDir),
+			"Root directory of kubelet, its --root-dir, which the staging and target paths must be under, empty leaves them unchecked")
+		registrationPath = flag.String("kubelet-registration-path", "",
+			"Path kubelet reaches the socket of the node plugin at, plugins/<driver name>/csi.sock under --kubelet-dir when empty")
+		stagingCleanup = flag.Bool("staging-cleanup", true,
+			"Clean up the stale staging paths under --kubelet-dir as the node plugin starts")
+
+		webhookURL = flag.String("event-webhook-url", "",
+			"URL the controller POSTs a JSON event to when a volume is created, attached, expanded, snapshotted or deleted, or fails to be")
+		webhookSecret = flag.String("event-webhook-secret", os.Getenv("VULTR_CSI_WEBHOOK_SECRET"),
+			"Secret the events POSTed to the webhook are signed with using HMAC-SHA256")
+
+		tracingEndpoint = flag.String("otlp-endpoint", envString("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+			"OTLP/HTTP collector the trace spans of the RPCs and their Vultr API calls and mounts are sent to, tracing is off when empty")
+
+		blockStorageQuota = flag.Int("block-storage-quota-gb", 0,
+			"Block storage GB the Vultr account may provision in total, reported by GetCapacity, 0 when unknown")
+		namespaceMaxVolumeSize = flag.String("namespace-max-volume-size-gb", "",
+			"Maximum size of the volumes of each namespace as comma separated namespace=GB entries, * applying to the others")
+		allowedRegions = flag.String("allowed-regions", "",
+			"Comma separated regions volumes are only provisioned in, whatever StorageClasses and topology ask for, empty allows any")
+
+		dryRun = dryRunMode("false")
+
+		strictSpec = flag.Bool("strict-spec", false,
+			"Enforce the validations and error codes of the CSI spec rigorously, rejecting what the driver otherwise tolerates")
+
+		featureGates = flag.String("feature-gates", "",
+			"Comma separated Feature=bool pairs turning driver features on or off, such as Snapshots=true,RawBlock=false")
+
+		logLevel = flag.String("log-level", envString("VULTR_CSI_LOG_LEVEL", driver.DefaultLogLevel),
+			"Lowest level of the logs: trace, debug, info, warn or error")
+		logFormat = flag.String("log-format", envString("VULTR_CSI_LOG_FORMAT", driver.LogFormatText), "Format of the logs: text or json")
+
+		printVersion = flag.Bool("version", false, "Print the versions of the driver, govultr and the CSI spec and exit")
 	)
+	// --api-url predates --vultr-api-url and is still accepted
+	flag.StringVar(apiURL, "api-url", *apiURL, "Deprecated, use --vultr-api-url")
+	flag.Var(&dryRun, "dry-run", "Validate requests and log the Vultr API calls which change anything instead of sending them, "+
+		"or with simulate answer every call from an in-memory API, needing no token")
 	flag.Parse()
 
+	if *printVersion {
+		fmt.Println(driver.NewVersionInfo(version, commit))
+		return
+	}
+
+	dirMode, err := strconv.ParseUint(*targetDirMode, 8, 32)
+	if err != nil {
+		log.Fatalf("invalid target-dir-mode %q: %v", *targetDirMode, err)
+	}
+
+	var sockMode uint64
+	if *socketMode != "" {
+		if sockMode, err = strconv.ParseUint(*socketMode, 8, 32); err != nil {
+			log.Fatalf("invalid socket-mode %q: %v", *socketMode, err)
+		}
+	}
+
 	if version == "" {
 		log.Fatal("version must be defined at compilation")
 	}
 
-	d, err := driver.NewDriver(*endpoint, *token, *driverName, version, *userAgent, *apiURL)
+	d, err := driver.NewDriver(*endpoint, *token, *driverName, version, *userAgent, *apiURL,
+		driver.WithCommit(commit),
+		driver.WithAPICABundle(*apiCA),
+		driver.WithLogging(*logLevel, *logFormat),
+		driver.WithAdminServer(*adminAddr, *adminToken),
+		driver.WithInstanceIdentity(*nodeID, *region),
+		driver.WithTopologyRegionKey(*regionKey),
+		driver.WithMetadataURL(*metadataURL),
+		driver.WithVolumeLabel(*volumeLabelPrefix, *volumeLabelMaxLength),
+		driver.WithClusterID(*clusterID),
+		driver.WithLeaderElectionLeases(*leaderElectionLeases, *leaderElectionNamespace),
+		driver.WithAllowMultiController(*allowMultiController),
+		driver.WithMaxConcurrentStages(*maxConcurrentStages),
+		driver.WithMaxParallelCreates(*maxParallelCreates, *maxQueuedCreates),
+		driver.WithVolumeStatsCacheTTL(*volumeStatsCacheTTL),
+		driver.WithMetricsAddr(*metricsAddr),
+		driver.WithHealthAddr(*healthAddr),
+		driver.WithGRPCMaxConcurrentStreams(*grpcMaxConcurrentStreams),
+		driver.WithGRPCKeepalive(*grpcKeepaliveTime, *grpcKeepaliveTimeout, *grpcKeepaliveMinTime, *grpcKeepalivePermitWithoutStream),
+		driver.WithSocketPermissions(os.FileMode(sockMode), *socketUID, *socketGID),
+		driver.WithTargetDirectory(os.FileMode(dirMode), *targetDirUID, *targetDirGID),
+		driver.WithDefaultFsType(*defaultFsType),
+		driver.WithFsckOnStage(*fsckOnStage),
+		driver.WithMaxVolumesPerNode(*maxVolumesPerNode),
+		driver.WithVolumeSlots(*blockDiskSlots, *maxVFSVolumesPerNode),
+		driver.WithMaintenanceBackoff(*maintenanceBackoff),
+		driver.WithAPIRecording(*apiRecordFile, *apiRecordMaxBytes),
+		driver.WithAuditLog(*auditLog),
+		driver.WithDryRun(dryRun == "true"),
+		driver.WithSimulatedAPI(dryRun == "simulate"),
+		driver.WithStrictSpec(*strictSpec),
+		driver.WithFeatureGates(*featureGates),
+		driver.WithNodeAttachVFS(*nodeAttachVFS),
+		driver.WithEphemeralVolumes(*ephemeralVolumes),
+		driver.WithNodeOnly(*nodeOnly),
+		driver.WithUnstageForceUnmount(*unstageForceUnmount),
+		driver.WithVFS(!*disableVFS),
+		driver.WithAttachTimeouts(*attachTimeout, *detachTimeout),
+		driver.WithDrainTimeout(*drainTimeout),
+		driver.WithDeviceWaitTimeout(*deviceWaitTimeout),
+		driver.WithDeviceRecheckTimeout(*deviceRecheckTimeout),
+		driver.WithAPIPacing(*apiRateLimit, *apiRetryLimit),
+		driver.WithAPITimeout(*apiTimeout),
+		driver.WithAPIRequestLimit(*apiRequestRate, *apiRequestBurst),
+		driver.WithAPIThrottleThreshold(*apiThrottleThreshold),
+		driver.WithAPICircuitBreaker(*apiBreakerThreshold, *apiBreakerOpenTimeout, *apiBreakerMaxOpenTimeout),
+		driver.WithDetachFromDeletedNodes(*detachFromDeletedNodes),
+		driver.WithDeleteForceDetach(*deleteForceDetach, *deleteForceDetachGrace),
+		driver.WithForceDetachAfter(*forceDetachAfter),
+		driver.WithShutdownDetach(*shutdownDetachInterval),
+		driver.WithOrphanCollection(*gcInterval, *gcMode, *gcGracePeriod),
+		driver.WithVolumeStatus(*volumeStatusInterval),
+		driver.WithResizeTolerance(*resizeTolerance),
+		driver.WithUsageEvents(*usageEventThreshold),
+		driver.WithNodeLabels(*nodeLabelsInterval, *kubeNodeName),
+		driver.WithVolumeIOStats(*ioStatsInterval),
+		driver.WithVFSMountMonitor(*vfsMonitorInterval),
+		driver.WithKubeletDir(*kubeletDir, *registrationPath),
+		driver.WithStagingCleanup(*stagingCleanup),
+		driver.WithEventWebhook(*webhookURL, *webhookSecret),
+		driver.WithTracing(*tracingEndpoint),
+		driver.WithBlockStorageQuota(*blockStorageQuota),
+		driver.WithNamespaceMaxVolumeSize(*namespaceMaxVolumeSize),
+		driver.WithAllowedRegions(*allowedRegions),
+	)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	if *preflightCheck {
+		if err := d.CheckAPIAccess(context.Background()); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if err := d.ClaimControllerLease(context.Background()); err != nil {
+		log.Fatalln(err)
+	}
+
 	d.Run()
 }
+
+// envString returns the value of the environment variable, fallback when unset
+func envString(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envInt returns the integer value of the environment variable, 0 when unset
+func envInt(name string) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("invalid %s %q: %v", name, value, err)
+	}
+	return n
+}
+
+// dryRunMode is the --dry-run flag, which is true, false or simulate, and true when given
+// without a value
+type dryRunMode string
+
+func (m *dryRunMode) String() string { return string(*m) }
+
+func (m *dryRunMode) Set(value string) error {
+	switch value {
+	case "simulate":
+		*m = dryRunMode(value)
+		return nil
+	default:
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("must be true, false or simulate")
+		}
+		*m = dryRunMode(strconv.FormatBool(enabled))
+		return nil
+	}
+}
+
+// IsBoolFlag lets --dry-run be given without a value
+func (m *dryRunMode) IsBoolFlag() bool { return true }
@@ -0,0 +1,111 @@
+/*
+Copyright 2020 Vultr.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vultr/vultr-csi/driver"
+)
+
+const adminRequestTimeout = 30 * time.Second
+
+// runVolumes queries the admin API of the controller and node plugins given as
+// arguments and prints a single merged view of the driver-managed volumes
+func runVolumes(args []string) error {
+	fs := flag.NewFlagSet("volumes", flag.ExitOnError)
+	token := fs.String("admin-token", os.Getenv("VULTR_CSI_ADMIN_TOKEN"), "Bearer token for the admin HTTP API")
+	output := fs.String("output", "table", "Output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: volumes [-admin-token TOKEN] [-output table|json] URL [URL...]")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), adminRequestTimeout)
+	defer cancel()
+
+	var views [][]driver.AdminVolume
+	for _, u := range fs.Args() {
+		volumes, err := fetchAdminVolumes(ctx, u, *token)
+		if err != nil {
+			return fmt.Errorf("cannot query %s: %v", u, err)
+		}
+		views = append(views, volumes)
+	}
+
+	volumes := driver.MergeAdminVolumes(views...)
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(driver.AdminVolumesResponse{Volumes: volumes})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VOLUME ID\tLABEL\tSIZE\tSTATUS\tATTACHED TO\tSTAGED ON\tHEALTH")
+	for i := range volumes {
+		v := volumes[i]
+
+		var nodes []string
+		for j := range v.Nodes {
+			nodes = append(nodes, v.Nodes[j].NodeID)
+		}
+
+		health := "ok"
+		if v.Condition.Abnormal {
+			health = v.Condition.Message
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%dGB\t%s\t%s\t%s\t%s\n",
+			v.VolumeID, v.Label, v.SizeGB, v.Status, v.AttachedTo, strings.Join(nodes, ","), health)
+	}
+
+	return w.Flush()
+}
+
+func fetchAdminVolumes(ctx context.Context, baseURL, token string) ([]driver.AdminVolume, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+driver.AdminVolumesPath, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var body driver.AdminVolumesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	return body.Volumes, nil
+}
@@ -0,0 +1,323 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// AdminVolumesPath is the admin API path listing driver-managed volumes
+	AdminVolumesPath = "/v1/volumes"
+
+	// AdminQuarantinePath is the admin API path repairing or releasing quarantined volumes
+	AdminQuarantinePath = "/v1/quarantine"
+
+	adminReadTimeout = 10 * time.Second
+)
+
+// AdminVolumesResponse is the body returned by the admin volumes endpoint
+type AdminVolumesResponse struct {
+	Volumes []AdminVolume `json:"volumes"`
+}
+
+// AdminVolume is the operational view of a single volume
+type AdminVolume struct {
+	VolumeID   string               `json:"volume_id"`
+	Label      string               `json:"label,omitempty"`
+	SizeGB     int                  `json:"size_gb,omitempty"`
+	Status     string               `json:"status,omitempty"`
+	Region     string               `json:"region,omitempty"`
+	AttachedTo string               `json:"attached_to,omitempty"`
+	Nodes      []AdminVolumeNode    `json:"nodes,omitempty"`
+	Condition  AdminVolumeCondition `json:"condition"`
+}
+
+// AdminVolumeNode is a node's staging information for a volume
+type AdminVolumeNode struct {
+	NodeID      string    `json:"node_id"`
+	StagingPath string    `json:"staging_path"`
+	Device      string    `json:"device"`
+	FsType      string    `json:"fs_type"`
+	StagedAt    time.Time `json:"staged_at"`
+	Targets     []string  `json:"targets"`
+}
+
+// AdminVolumeCondition reports whether a volume looks healthy
+type AdminVolumeCondition struct {
+	Abnormal bool   `json:"abnormal"`
+	Message  string `json:"message,omitempty"`
+}
+
+// MergeAdminVolumes combines controller and node views of volumes into one entry per volume ID
+func MergeAdminVolumes(views ...[]AdminVolume) []AdminVolume {
+	merged := make(map[string]*AdminVolume)
+
+	for _, view := range views {
+		for i := range view {
+			v := view[i]
+			cur, ok := merged[v.VolumeID]
+			if !ok {
+				merged[v.VolumeID] = &v
+				continue
+			}
+
+			if v.Label != "" {
+				cur.Label, cur.SizeGB, cur.Status, cur.Region, cur.AttachedTo = v.Label, v.SizeGB, v.Status, v.Region, v.AttachedTo
+			}
+			cur.Nodes = append(cur.Nodes, v.Nodes...)
+
+			if v.Condition.Abnormal {
+				cur.Condition.Abnormal = true
+				if cur.Condition.Message != "" {
+					cur.Condition.Message += "; "
+				}
+				cur.Condition.Message += v.Condition.Message
+			}
+		}
+	}
+
+	volumes := make([]AdminVolume, 0, len(merged))
+	for _, v := range merged {
+		volumes = append(volumes, *v)
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].VolumeID < volumes[j].VolumeID
+	})
+
+	return volumes
+}
+
+// adminServer serves the authenticated admin HTTP API
+type adminServer struct {
+	driver     *VultrDriver
+	controller *VultrControllerServer
+	node       *VultrNodeServer
+}
+
+func newAdminServer(driver *VultrDriver, controller *VultrControllerServer, node *VultrNodeServer) *adminServer {
+	return &adminServer{driver: driver, controller: controller, node: node}
+}
+
+func (a *adminServer) serve() {
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdminVolumesPath, a.authorize(a.handleVolumes))
+	mux.HandleFunc(AdminQuarantinePath, a.authorize(a.handleQuarantine))
+
+	server := &http.Server{
+		Addr:              a.driver.adminAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: adminReadTimeout,
+	}
+
+	a.driver.log.WithFields(logrus.Fields{
+		"address": a.driver.adminAddr,
+	}).Info("Admin API: listening")
+
+	if err := server.ListenAndServe(); err != nil {
+		a.driver.log.Errorf("Admin API: failed to serve: %v", err)
+	}
+}
+
+func (a *adminServer) authorize(next http.HandlerFunc) http.HandlerFunc {
+	expected := []byte("Bearer " + a.driver.adminToken)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (a *adminServer) handleVolumes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var views [][]AdminVolume
+
+	if a.driver.isController && a.controller != nil {
+		volumes, err := a.controllerVolumes(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cannot list volumes: %v", err), http.StatusBadGateway)
+			return
+		}
+		views = append(views, volumes)
+	}
+
+	if a.node != nil {
+		views = append(views, a.nodeVolumes())
+	}
+
+	volumes := MergeAdminVolumes(views...)
+
+	if id := r.URL.Query().Get("volume_id"); id != "" {
+		filtered := volumes[:0]
+		for i := range volumes {
+			if volumes[i].VolumeID == id {
+				filtered = append(filtered, volumes[i])
+			}
+		}
+		volumes = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(AdminVolumesResponse{Volumes: volumes}); err != nil {
+		a.driver.log.Errorf("Admin API: failed to encode response: %v", err)
+	}
+}
+
+// handleQuarantine acts on a volume quarantined on this node, action=repair repairing
+// its filesystem at the next stage and action=release mounting it again as it is
+func (a *adminServer) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if a.node == nil {
+		http.Error(w, "volumes are only quarantined by node plugins", http.StatusNotFound)
+		return
+	}
+
+	id := r.URL.Query().Get("volume_id")
+	if id == "" {
+		http.Error(w, "volume_id must be provided", http.StatusBadRequest)
+		return
+	}
+
+	var found bool
+	switch action := r.URL.Query().Get("action"); action {
+	case "repair":
+		found = a.node.quarantine.repair(id)
+	case "release":
+		found = a.node.quarantine.release(id)
+	default:
+		http.Error(w, fmt.Sprintf("unknown action %q, expected repair or release", action), http.StatusBadRequest)
+		return
+	}
+
+	if !found {
+		http.Error(w, fmt.Sprintf("volume %s is not quarantined on node %s", id, a.driver.nodeID), http.StatusNotFound)
+		return
+	}
+
+	a.driver.log.WithFields(logrus.Fields{
+		"volume": id,
+		"action": r.URL.Query().Get("action"),
+	}).Warn("Admin API: quarantine updated")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// controllerVolumes returns the Vultr side view of the volumes
+func (a *adminServer) controllerVolumes(ctx context.Context) ([]AdminVolume, error) {
+	list, err := a.controller.backends.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.controller.orphans.prune(list)
+
+	volumes := make([]AdminVolume, 0, len(list))
+	for i := range list {
+		v := AdminVolume{
+			VolumeID:   list[i].ID,
+			Label:      list[i].Label,
+			SizeGB:     int(list[i].SizeBytes / giB),
+			Status:     list[i].Status,
+			Region:     list[i].Region,
+			AttachedTo: strings.Join(list[i].AttachedTo, ","),
+		}
+
+		if condition := a.controller.volumeCondition(&list[i]); condition.Abnormal {
+			v.Condition = AdminVolumeCondition{Abnormal: true, Message: condition.Message}
+		}
+
+		volumes = append(volumes, v)
+	}
+
+	return volumes, nil
+}
+
+// nodeVolumes returns the staging view of the volumes on this node
+func (a *adminServer) nodeVolumes() []AdminVolume {
+	staged := a.node.staged.list()
+	volumes := make([]AdminVolume, 0, len(staged))
+
+	for i := range staged {
+		s := staged[i]
+		v := AdminVolume{
+			VolumeID: s.VolumeID,
+			Nodes: []AdminVolumeNode{
+				{
+					NodeID:      a.driver.nodeID,
+					StagingPath: s.StagingPath,
+					Device:      s.Device,
+					FsType:      s.FsType,
+					StagedAt:    s.StagedAt,
+					Targets:     s.Targets,
+				},
+			},
+		}
+
+		var problems []string
+		if _, err := os.Stat(s.Device); err != nil {
+			problems = append(problems, fmt.Sprintf("device %s is not accessible on node %s", s.Device, a.driver.nodeID))
+		}
+
+		if a.driver.mounter != nil {
+			notMnt, err := a.driver.mounter.IsLikelyNotMountPoint(s.StagingPath)
+			if err != nil || notMnt {
+				problems = append(problems, fmt.Sprintf("staging path %s is not mounted on node %s", s.StagingPath, a.driver.nodeID))
+			}
+		}
+
+		if len(problems) > 0 {
+			v.Condition = AdminVolumeCondition{Abnormal: true, Message: strings.Join(problems, "; ")}
+		}
+
+		volumes = append(volumes, v)
+	}
+
+	for _, q := range a.node.quarantine.list() {
+		repair := ""
+		if q.Repair {
+			repair = ", repair requested"
+		}
+
+		volumes = append(volumes, AdminVolume{
+			VolumeID: q.VolumeID,
+			Condition: AdminVolumeCondition{
+				Abnormal: true,
+				Message: fmt.Sprintf("filesystem quarantined on node %s since %s%s: %s",
+					a.driver.nodeID, q.Since.Format(time.RFC3339), repair, q.Reason),
+			},
+		})
+	}
+
+	return volumes
+}
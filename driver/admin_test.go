@@ -0,0 +1,97 @@
+package driver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminVolumes(t *testing.T) {
+	controller := NewFakeVultrControllerServer("admin volumes")
+	controller.Driver.adminToken = "secret"
+
+	node := NewVultrNodeDriver(controller.Driver)
+	node.staged.stage("c56c7b6e-15c2-445e-9a5d-1063ab5828ec", "/staging", "/dev/does-not-exist", "ext4")
+	node.staged.publish("c56c7b6e-15c2-445e-9a5d-1063ab5828ec", "/target", false)
+
+	admin := newAdminServer(controller.Driver, controller, node)
+	handler := admin.authorize(admin.handleVolumes)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, AdminVolumesPath, http.NoBody))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, AdminVolumesPath, http.NoBody)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d got %d", http.StatusOK, rec.Code)
+	}
+
+	var res AdminVolumesResponse
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatalf("cannot decode response: %v", err)
+	}
+
+	if len(res.Volumes) != 2 {
+		t.Fatalf("expected 2 volumes got %d", len(res.Volumes))
+	}
+
+	staged := res.Volumes[1]
+	if staged.VolumeID != "c56c7b6e-15c2-445e-9a5d-1063ab5828ec" || staged.Label != "test-bs" {
+		t.Errorf("expected merged controller and node view, got %+v", staged)
+	}
+
+	if len(staged.Nodes) != 1 || len(staged.Nodes[0].Targets) != 1 {
+		t.Errorf("expected one staging node with one target, got %+v", staged.Nodes)
+	}
+
+	if !staged.Condition.Abnormal {
+		t.Errorf("expected missing device to be reported as abnormal")
+	}
+}
+
+func TestAdminQuarantine(t *testing.T) {
+	controller := NewFakeVultrControllerServer("admin quarantine")
+	controller.Driver.adminToken = "secret"
+
+	node := NewVultrNodeDriver(controller.Driver)
+	node.quarantine.add("vol-1", "filesystem on /dev/vdb has errors which could not be repaired")
+
+	admin := newAdminServer(controller.Driver, controller, node)
+	handler := admin.authorize(admin.handleQuarantine)
+
+	post := func(query string) int {
+		req := httptest.NewRequest(http.MethodPost, AdminQuarantinePath+query, http.NoBody)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	if volumes := admin.nodeVolumes(); len(volumes) != 1 || !volumes[0].Condition.Abnormal {
+		t.Errorf("expected the quarantined volume to be listed as abnormal, got %+v", volumes)
+	}
+
+	if code := post("?volume_id=vol-1&action=fix"); code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an unknown action, got %d", http.StatusBadRequest, code)
+	}
+
+	if code := post("?volume_id=vol-1&action=repair"); code != http.StatusNoContent {
+		t.Errorf("expected status %d got %d", http.StatusNoContent, code)
+	}
+	if q, _ := node.quarantine.get("vol-1"); !q.Repair {
+		t.Error("expected a repair to be requested")
+	}
+
+	if code := post("?volume_id=vol-1&action=release"); code != http.StatusNoContent {
+		t.Errorf("expected status %d got %d", http.StatusNoContent, code)
+	}
+	if code := post("?volume_id=vol-1&action=release"); code != http.StatusNotFound {
+		t.Errorf("expected status %d for a volume not quarantined, got %d", http.StatusNotFound, code)
+	}
+}
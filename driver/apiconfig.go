@@ -0,0 +1,78 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultAPIRateLimit is the minimum pause the Vultr client leaves between API requests
+	DefaultAPIRateLimit = 500 * time.Millisecond
+	// DefaultAPIRetryLimit is how many times the Vultr client retries a failed API request
+	DefaultAPIRetryLimit = 3
+)
+
+// apiConfigLabels are the settings exported by the api_config_info metric, in order
+var apiConfigLabels = []string{
+	"mode", "rate_limit", "retry_limit", "request_timeout", "request_rate", "request_burst", "throttle_threshold", "maintenance_backoff",
+	"attach_timeout", "detach_timeout", "dry_run", "api_recording", "api_url", "custom_ca",
+}
+
+var apiConfigInfo = metrics.newGauge("api_config_info",
+	"Resolved Vultr API pacing and transport configuration of the driver, always 1", apiConfigLabels...)
+
+// apiConfig returns the resolved API pacing and transport settings keyed by apiConfigLabels
+func (d *VultrDriver) apiConfig() map[string]string {
+	dryRun := strconv.FormatBool(d.dryRun)
+	if d.simulate {
+		dryRun = "simulate"
+	}
+
+	return map[string]string{
+		"mode":                d.mode(),
+		"rate_limit":          d.apiRateLimit.String(),
+		"retry_limit":         strconv.Itoa(d.apiRetryLimit),
+		"request_timeout":     d.apiTimeout.String(),
+		"request_rate":        strconv.FormatFloat(d.apiRequestRate, 'g', -1, 64),
+		"request_burst":       strconv.Itoa(d.apiRequestBurst),
+		"throttle_threshold":  d.apiThrottleThreshold.String(),
+		"maintenance_backoff": d.maintenanceBackoff.String(),
+		"attach_timeout":      d.attachTimeout.String(),
+		"detach_timeout":      d.detachTimeout.String(),
+		"dry_run":             dryRun,
+		"api_recording":       strconv.FormatBool(d.apiRecordPath != ""),
+		"api_url":             d.apiURL,
+		"custom_ca":           strconv.FormatBool(d.apiCABundle != ""),
+	}
+}
+
+// reportAPIConfig logs the resolved API configuration and exports it as api_config_info,
+// so operators can confirm their tuning flags took effect in each deployment
+func (d *VultrDriver) reportAPIConfig() {
+	config := d.apiConfig()
+
+	fields := make(logrus.Fields, len(config))
+	values := make([]string, len(apiConfigLabels))
+	for i, label := range apiConfigLabels {
+		fields[label] = config[label]
+		values[i] = config[label]
+	}
+
+	d.log.WithFields(fields).Info("Vultr API configuration")
+	apiConfigInfo.set(1, values...)
+}
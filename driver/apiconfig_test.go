@@ -0,0 +1,39 @@
+package driver
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestReportAPIConfig(t *testing.T) {
+	d := &VultrDriver{
+		log:                logrus.NewEntry(logrus.New()),
+		apiRateLimit:       250 * time.Millisecond,
+		apiRetryLimit:      5,
+		apiRequestRate:     2.5,
+		apiRequestBurst:    5,
+		maintenanceBackoff: DefaultMaintenanceBackoff,
+		attachTimeout:      DefaultAttachTimeout,
+		detachTimeout:      time.Minute,
+		dryRun:             true,
+		apiURL:             "https://api.vultr.com/",
+		apiCABundle:        "/etc/ssl/proxy-ca.pem",
+	}
+	d.reportAPIConfig()
+
+	var buf bytes.Buffer
+	if err := apiConfigInfo.write(&buf); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := `csi_vultr_api_config_info{mode="node",rate_limit="250ms",retry_limit="5",request_timeout="0s",request_rate="2.5",request_burst="5",` +
+		`throttle_threshold="0s",maintenance_backoff="5m0s",` +
+		`attach_timeout="30s",detach_timeout="1m0s",dry_run="true",api_recording="false",api_url="https://api.vultr.com/",custom_ca="true"} 1`
+	if !strings.Contains(buf.String(), expected+"\n") {
+		t.Errorf("expected output to contain %q, got:\n%s", expected, buf.String())
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// apiErrorReason and apiErrorDomain are the ErrorInfo of the RPC errors translated
+	// from an error of the Vultr API
+	apiErrorReason = "VULTR_API_ERROR"
+	apiErrorDomain = "api.vultr.com"
+)
+
+// quotaMessages are the words of the Vultr API errors refusing a request as it would go
+// over a limit of the account rather than because the request is wrong
+var quotaMessages = []string{"quota", "exceed", "maximum number", "reached", "insufficient"}
+
+// vultrAPIError is the payload of a failed Vultr API request, which govultr returns as
+// the text of its error
+type vultrAPIError struct {
+	Message string `json:"error"`
+	Status  int    `json:"status"`
+}
+
+// parseAPIError finds the Vultr API error payload in msg, wherever the handler or the
+// backend put it in its own message
+func parseAPIError(msg string) (vultrAPIError, bool) {
+	i := strings.Index(msg, `{"error"`)
+	if i < 0 {
+		return vultrAPIError{}, false
+	}
+
+	var apiErr vultrAPIError
+	if err := json.NewDecoder(strings.NewReader(msg[i:])).Decode(&apiErr); err != nil || apiErr.Status == 0 {
+		return vultrAPIError{}, false
+	}
+	return apiErr, true
+}
+
+// code returns the gRPC code telling the sidecars whether the request is worth retrying,
+// codes.Internal for the errors it does not recognize
+func (e vultrAPIError) code() codes.Code {
+	switch {
+	case e.Status == http.StatusNotFound:
+		return codes.NotFound
+	case e.Status == http.StatusConflict:
+		return codes.AlreadyExists
+	case e.Status == http.StatusTooManyRequests, e.Status >= http.StatusInternalServerError:
+		return codes.Unavailable
+	case e.Status >= http.StatusBadRequest && e.isQuota():
+		return codes.ResourceExhausted
+	}
+	return codes.Internal
+}
+
+func (e vultrAPIError) isQuota() bool {
+	msg := strings.ToLower(e.Message)
+	for _, word := range quotaMessages {
+		if strings.Contains(msg, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiErrorCode returns the code of the Vultr API error err carries, codes.Internal when
+// it carries none or one that is not recognized
+func apiErrorCode(err error) codes.Code {
+	if apiErr, ok := parseAPIError(err.Error()); ok {
+		return apiErr.code()
+	}
+	return codes.Internal
+}
+
+// apiErrorStatus returns err with the code of the Vultr API error in its message when it
+// is codes.Internal or codes.Unknown. Handlers report API failures as codes.Internal with
+// the error in the message, so the sidecars would otherwise retry a missing volume or an
+// exhausted quota as eagerly as an outage. The details the handler attached are kept, and
+// an ErrorInfo gives the HTTP status and message of the API error.
+func apiErrorStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	st := status.Convert(err)
+	if st.Code() != codes.Internal && st.Code() != codes.Unknown {
+		return err
+	}
+
+	apiErr, ok := parseAPIError(st.Message())
+	if !ok || apiErr.code() == codes.Internal {
+		return err
+	}
+
+	translated := st.Proto()
+	translated.Code = int32(apiErr.code())
+	withInfo, detailErr := status.FromProto(translated).WithDetails(&errdetails.ErrorInfo{
+		Reason: apiErrorReason,
+		Domain: apiErrorDomain,
+		Metadata: map[string]string{
+			"http_status": strconv.Itoa(apiErr.Status),
+			"error":       apiErr.Message,
+		},
+	})
+	if detailErr != nil {
+		return status.ErrorProto(translated)
+	}
+	return withInfo.Err()
+}
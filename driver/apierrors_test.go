@@ -0,0 +1,63 @@
+package driver
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAPIErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{"not found", status.Error(codes.Internal, `cannot delete volume, {"error":"Invalid block storage ID","status":404}`), codes.NotFound},
+		{"conflict", status.Error(codes.Internal, `{"error":"A block storage with this label exists","status":409}`), codes.AlreadyExists},
+		{"throttled", errors.New(`{"error":"Rate limit reached - please try your request again later.","status":429}`), codes.Unavailable},
+		{"outage", status.Error(codes.Internal, `cannot attach volume: {"error":"","status":503}`), codes.Unavailable},
+		{"quota", status.Error(codes.Internal, `{"error":"You have reached the maximum number of block storage volumes","status":400}`),
+			codes.ResourceExhausted},
+		{"bad request", status.Error(codes.Internal, `{"error":"Invalid size","status":400}`), codes.Internal},
+		{"no payload", status.Error(codes.Internal, "cannot attach volume"), codes.Internal},
+		{"truncated payload", status.Error(codes.Internal, `{"error":"Invalid block`), codes.Internal},
+		{"other code kept", status.Error(codes.FailedPrecondition, `{"error":"not found","status":404}`), codes.FailedPrecondition},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := status.Code(apiErrorStatus(test.err)); code != test.code {
+				t.Errorf("expected %v, got %v", test.code, code)
+			}
+		})
+	}
+}
+
+func TestAPIErrorStatusDetails(t *testing.T) {
+	st, err := status.New(codes.Internal, `cannot get volume: {"error":"Invalid block storage ID","status":404}`).
+		WithDetails(&errdetails.RequestInfo{RequestId: "abc123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	translated := status.Convert(apiErrorStatus(st.Err()))
+	if translated.Message() != st.Message() {
+		t.Errorf("expected the message to be kept, got %q", translated.Message())
+	}
+
+	details := translated.Details()
+	if len(details) != 2 {
+		t.Fatalf("expected the request info and the error info, got %v", details)
+	}
+	if _, ok := details[0].(*errdetails.RequestInfo); !ok {
+		t.Errorf("expected the details of the handler to be kept, got %v", details[0])
+	}
+	info, ok := details[1].(*errdetails.ErrorInfo)
+	if !ok || info.GetReason() != apiErrorReason || info.GetMetadata()["http_status"] != "404" ||
+		info.GetMetadata()["error"] != "Invalid block storage ID" {
+		t.Errorf("expected the API error in an ErrorInfo, got %v", details[1])
+	}
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sensitiveHeaders are the request headers whose values never reach a hook
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+var (
+	apiRequestsTotal = metrics.newCounter("api_requests_total",
+		"Number of Vultr API requests completed, by method and response code, 0 when no response came", "method", "code")
+	apiRequestDuration = metrics.newHistogram("api_request_duration_seconds",
+		"Time the Vultr API took to answer the requests of the driver", defaultDurationBuckets, "method")
+)
+
+// APIRequest is a completed Vultr API request, as told to an APIRequestHook
+type APIRequest struct {
+	Method string
+	Path   string
+	// StatusCode is the code of the response, 0 when the request got none, as when it
+	// timed out or its retries ran out
+	StatusCode int
+	// RequestID is the ID the Vultr API gave the request, empty when the response names none
+	RequestID string
+	// Duration is how long the Vultr API took to answer the attempt which got the
+	// response, without the time the request waited on the driver's rate limiting
+	Duration time.Duration
+	// Header holds the headers of the request, with credentials redacted
+	Header http.Header
+}
+
+// APIRequestHook is told of each Vultr API request the driver completed, after any
+// retries, so integrators can record the requests into their own tracing systems. ctx is
+// the context of the request, which carries the span of the RPC making it, if any. The
+// hooks are called in turn on the goroutine of the request and must not block.
+type APIRequestHook interface {
+	OnRequestCompleted(ctx context.Context, req APIRequest)
+}
+
+// WithAPIRequestHooks adds hooks told of every Vultr API request, after the default one
+// feeding the api_requests_total and api_request_duration_seconds metrics and the debug log
+func WithAPIRequestHooks(hooks ...APIRequestHook) Option {
+	return func(d *VultrDriver) {
+		d.apiHooks = append(d.apiHooks, hooks...)
+	}
+}
+
+// apiRequestMetrics is the default APIRequestHook
+type apiRequestMetrics struct {
+	log *logrus.Entry
+}
+
+// OnRequestCompleted implements APIRequestHook
+func (m apiRequestMetrics) OnRequestCompleted(ctx context.Context, req APIRequest) {
+	apiRequestsTotal.add(1, req.Method, strconv.Itoa(req.StatusCode))
+	if req.Duration > 0 {
+		apiRequestDuration.observe(req.Duration.Seconds(), req.Method)
+	}
+
+	log := requestLogger(ctx, m.log)
+	if !log.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"method":         req.Method,
+		"path":           req.Path,
+		"status":         req.StatusCode,
+		"api_request_id": req.RequestID,
+		"duration":       req.Duration.Round(time.Millisecond),
+		"headers":        req.Header,
+	}).Debug("Vultr API request completed")
+}
+
+// apiRequestCompleted is the request completion callback of the Vultr client, the only
+// one it takes, which hands the request to maintenance mode and then to the hooks
+func (d *VultrDriver) apiRequestCompleted(r *http.Request, resp *http.Response) {
+	d.maintenance.observe(r, resp)
+
+	req := APIRequest{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Header: redactHeaders(r.Header),
+	}
+	if resp != nil {
+		req.StatusCode = resp.StatusCode
+		req.RequestID = resp.Header.Get(vultrRequestIDHeader)
+		if body, ok := resp.Body.(*timedBody); ok {
+			req.Duration = body.timing.duration
+		}
+	}
+
+	for _, hook := range d.apiHooks {
+		d.callAPIHook(r.Context(), hook, req)
+	}
+}
+
+// callAPIHook calls the hook, so that a panicking hook loses its record rather than the
+// request the driver made
+func (d *VultrDriver) callAPIHook(ctx context.Context, hook APIRequestHook, req APIRequest) {
+	defer func() {
+		if p := recover(); p != nil {
+			d.log.Errorf("Vultr API request hook %T panicked: %v", hook, p)
+		}
+	}()
+	hook.OnRequestCompleted(ctx, req)
+}
+
+// redactHeaders returns a copy of the headers with the credentials in them replaced
+func redactHeaders(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, key := range sensitiveHeaders {
+		if _, ok := redacted[key]; ok {
+			redacted[key] = []string{redactedValue}
+		}
+	}
+	return redacted
+}
+
+type apiTimingKey struct{}
+
+// apiTiming is how long an attempt of a request took the Vultr API
+type apiTiming struct {
+	duration time.Duration
+}
+
+// apiTimingTransport gives each attempt of a request the apiTiming filled in by the
+// transport right before the network, and hands it to the completion callback on the
+// body of the response, the only part of the attempt the callback sees. It is the
+// outermost transport, as the transports in between hold the attempt back.
+type apiTimingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *apiTimingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timing := &apiTiming{}
+	resp, err := t.next.RoundTrip(req.WithContext(context.WithValue(req.Context(), apiTimingKey{}, timing)))
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = &timedBody{ReadCloser: resp.Body, timing: timing}
+	return resp, nil
+}
+
+// apiLatencyTransport times the attempts sent to the Vultr API
+type apiLatencyTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *apiLatencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if timing, ok := req.Context().Value(apiTimingKey{}).(*apiTiming); ok {
+		timing.duration = time.Since(start)
+	}
+	return resp, err
+}
+
+type timedBody struct {
+	io.ReadCloser
+	timing *apiTiming
+}
@@ -0,0 +1,90 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vultr/govultr/v3"
+)
+
+type recordingHook struct {
+	mu       sync.Mutex
+	requests []APIRequest
+}
+
+func (h *recordingHook) OnRequestCompleted(_ context.Context, req APIRequest) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.requests = append(h.requests, req)
+}
+
+type panickingHook struct{}
+
+func (panickingHook) OnRequestCompleted(context.Context, APIRequest) {
+	panic("broken hook")
+}
+
+func TestAPIRequestHooks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(vultrRequestIDHeader, "vultr-"+r.Method)
+		if r.URL.Path == "/v2/blocks/missing" {
+			http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"block":{"id":"vol-1"}}`)) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	hook := &recordingHook{}
+	log := logrus.NewEntry(logrus.New())
+	d := &VultrDriver{log: log}
+	WithAPIRequestHooks(panickingHook{}, hook)(d)
+
+	transport := &apiTimingTransport{next: &apiLatencyTransport{next: srv.Client().Transport}}
+	client := govultr.NewClient(&http.Client{Transport: transport})
+	if err := client.SetBaseURL(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	client.SetRetryLimit(0)
+	client.OnRequestCompleted(d.apiRequestCompleted)
+
+	if _, _, err := client.BlockStorage.Get(context.Background(), "vol-1"); err != nil { //nolint:bodyclose
+		t.Fatal(err)
+	}
+	if _, _, err := client.BlockStorage.Get(context.Background(), "missing"); err == nil { //nolint:bodyclose
+		t.Fatal("expected the missing volume to fail")
+	}
+
+	if len(hook.requests) != 2 {
+		t.Fatalf("expected the hook past the panicking one to see 2 requests, got %+v", hook.requests)
+	}
+	got := hook.requests[0]
+	if got.Method != http.MethodGet || got.Path != "/v2/blocks/vol-1" || got.StatusCode != http.StatusOK ||
+		got.RequestID != "vultr-GET" || got.Duration <= 0 {
+		t.Errorf("unexpected request %+v", got)
+	}
+	if got := hook.requests[1]; got.StatusCode != http.StatusNotFound || got.Path != "/v2/blocks/missing" {
+		t.Errorf("expected the failed request with its code, got %+v", got)
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret-token")
+	header.Set("User-Agent", "csi-vultr-driver")
+
+	redacted := redactHeaders(header)
+	if got := redacted.Get("Authorization"); got != redactedValue {
+		t.Errorf("expected Authorization to be redacted, got %q", got)
+	}
+	if got := redacted.Get("User-Agent"); got != "csi-vultr-driver" {
+		t.Errorf("expected User-Agent to be kept, got %q", got)
+	}
+	if got := header.Get("Authorization"); got != "Bearer secret-token" {
+		t.Errorf("expected the request headers to be left as they are, got %q", got)
+	}
+}
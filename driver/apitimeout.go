@@ -0,0 +1,125 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultAPITimeout bounds each Vultr API request, on top of the deadline of the RPC making it
+const DefaultAPITimeout = 30 * time.Second
+
+// WithAPITimeout bounds how long each Vultr API request may take, retries included
+// separately, so a hung request fails before the deadline of the RPC rather than holding
+// it until the sidecar gives up. 0 leaves requests bound by the RPC deadline only.
+func WithAPITimeout(timeout time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.apiTimeout = timeout
+	}
+}
+
+// timeoutTransport ends each request after timeout, failing it with an error wrapping
+// context.DeadlineExceeded. The deadline of the request context, the RPC's, still applies.
+type timeoutTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func newTimeoutTransport(next http.RoundTripper, timeout time.Duration) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if timeout <= 0 {
+		return next
+	}
+	return &timeoutTransport{next: next, timeout: timeout}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, t.timedOut(ctx, req, err)
+	}
+
+	// the body is read after RoundTrip returns, so the timeout lasts until it is closed
+	resp.Body = &timeoutBody{ReadCloser: resp.Body, transport: t, req: req, ctx: ctx, cancel: cancel}
+	return resp, nil
+}
+
+// timedOut returns err naming the timeout when it, rather than the request context, ended the request
+func (t *timeoutTransport) timedOut(ctx context.Context, req *http.Request, err error) error {
+	if ctx.Err() == nil || req.Context().Err() != nil {
+		return err
+	}
+	return fmt.Errorf("%s %s timed out after %v: %w", req.Method, req.URL.Path, t.timeout, context.DeadlineExceeded)
+}
+
+type timeoutBody struct {
+	io.ReadCloser
+	transport *timeoutTransport
+	req       *http.Request
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		err = b.transport.timedOut(b.ctx, b.req, err)
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// deadlineStatus returns err as codes.DeadlineExceeded when the RPC deadline passed or a
+// Vultr API request timed out. Handlers report API failures as codes.Internal with the
+// error in the message, so the sidecars would otherwise not see a deadline they can retry.
+func deadlineStatus(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	st, ok := status.FromError(err)
+	if ok && st.Code() != codes.Internal && st.Code() != codes.Unknown {
+		return err
+	}
+
+	exceeded := errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) ||
+		strings.Contains(st.Message(), context.DeadlineExceeded.Error())
+	if !exceeded {
+		return err
+	}
+
+	// the details the handler attached are kept along with the message
+	deadline := st.Proto()
+	deadline.Code = int32(codes.DeadlineExceeded)
+	return status.ErrorProto(deadline)
+}
@@ -0,0 +1,66 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTimeoutTransport(t *testing.T) {
+	release := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hang" {
+			<-release
+		}
+		w.Write([]byte(`{}`)) //nolint:errcheck
+	}))
+	defer api.Close()
+	defer close(release)
+
+	client := &http.Client{Transport: newTimeoutTransport(http.DefaultTransport, 50*time.Millisecond)}
+
+	resp, err := client.Get(api.URL + "/ok") //nolint:noctx
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	resp.Body.Close()
+
+	_, err = client.Get(api.URL + "/hang") //nolint:noctx,bodyclose
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the hung request to time out with DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestDeadlineStatus(t *testing.T) {
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		code codes.Code
+	}{
+		{"api timeout", context.Background(),
+			status.Error(codes.Internal, "cannot get volume: GET /v2/blocks timed out after 30s: context deadline exceeded"),
+			codes.DeadlineExceeded},
+		{"plain error", context.Background(), context.DeadlineExceeded, codes.DeadlineExceeded},
+		{"rpc deadline", expired, status.Error(codes.Internal, "cannot attach volume"), codes.DeadlineExceeded},
+		{"other code kept", expired, status.Error(codes.NotFound, "volume not found"), codes.NotFound},
+		{"other failure", context.Background(), status.Error(codes.Internal, "cannot attach volume"), codes.Internal},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := status.Code(deadlineStatus(test.ctx, test.err)); code != test.code {
+				t.Errorf("expected %v, got %v", test.code, code)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// WithAPICABundle trusts the CA certificates of the PEM file for the Vultr API besides
+// those of the system, as an egress proxy intercepting TLS or a mock API needs
+func WithAPICABundle(path string) Option {
+	return func(d *VultrDriver) {
+		d.apiCABundle = path
+	}
+}
+
+// newAPITransport returns the transport the Vultr API is reached with, which goes through
+// the proxy HTTPS_PROXY, HTTP_PROXY and NO_PROXY select and trusts the CA bundle when set
+func newAPITransport(caBundle string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+
+	if caBundle == "" {
+		return transport, nil
+	}
+
+	pem, err := os.ReadFile(caBundle)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s holds no PEM certificate", caBundle)
+	}
+
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return transport, nil
+}
+
+// apiProxy returns the proxy the environment sends the requests to the API URL through,
+// with any credentials redacted, empty when they go direct
+func apiProxy(transport *http.Transport, apiURL *url.URL) string {
+	proxy, err := transport.Proxy(&http.Request{URL: apiURL})
+	if err != nil || proxy == nil {
+		return ""
+	}
+	return proxy.Redacted()
+}
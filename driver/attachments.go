@@ -0,0 +1,207 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// attachConflictReason is the reason of the error info detailing a publish refused as the
+// volume is attached to another node
+const attachConflictReason = "VOLUME_ATTACHED_TO_OTHER_NODE"
+
+var staleAttachments = metrics.newCounter("stale_attachments_detached_total",
+	"Number of attachments to instances which no longer exist publishing detached, by result", "result")
+
+type attachmentKey struct {
+	volumeID string
+	nodeID   string
+}
+
+// attachmentTracker remembers when this controller attached volumes to nodes. The Vultr
+// API does not report when an attachment was made, so attachments made before the
+// controller started have no known age.
+type attachmentTracker struct {
+	now func() time.Time
+
+	mu    sync.Mutex
+	since map[attachmentKey]time.Time
+}
+
+func newAttachmentTracker() *attachmentTracker {
+	return &attachmentTracker{
+		now:   time.Now,
+		since: make(map[attachmentKey]time.Time),
+	}
+}
+
+func (a *attachmentTracker) attached(volumeID, nodeID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := attachmentKey{volumeID: volumeID, nodeID: nodeID}
+	if _, ok := a.since[key]; !ok {
+		a.since[key] = a.now()
+	}
+}
+
+func (a *attachmentTracker) detached(volumeID, nodeID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.since, attachmentKey{volumeID: volumeID, nodeID: nodeID})
+}
+
+// age returns how long the volume has been attached to the node, false when unknown
+func (a *attachmentTracker) age(volumeID, nodeID string) (time.Duration, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	since, ok := a.since[attachmentKey{volumeID: volumeID, nodeID: nodeID}]
+	if !ok {
+		return 0, false
+	}
+	return a.now().Sub(since), true
+}
+
+// resolveAttachConflict handles a single node volume attached to other nodes than nodeID.
+// Attachments to instances which no longer exist are detached when the driver is allowed
+// to, otherwise publishing fails with FailedPrecondition naming the nodes holding the
+// volume and for how long, so users can tell which workload to move.
+func (c *VultrControllerServer) resolveAttachConflict(ctx context.Context, backend storageBackend, vol *backendVolume, nodeID string) error {
+	log := requestLogger(ctx, c.Driver.log).WithField("volume_id", vol.ID)
+
+	// the volume found attached elsewhere is done detaching from the other nodes
+	c.detachesStuck.forgetDetached(vol.ID, vol.AttachedTo)
+
+	var holders, holderIDs []string
+	for _, other := range vol.AttachedTo {
+		if other == nodeID {
+			continue
+		}
+
+		instance, err := c.nodes.get(ctx, other)
+		switch {
+		case err == nil:
+			holders = append(holders, c.describeAttachment(vol.ID, other, fmt.Sprintf("%q", instance.Label)))
+			holderIDs = append(holderIDs, other)
+		case !isNotFoundError(err):
+			holders = append(holders, c.describeAttachment(vol.ID, other, "which cannot be looked up"))
+			holderIDs = append(holderIDs, other)
+		case !c.Driver.detachFromDeletedNodes:
+			holders = append(holders, c.describeAttachment(vol.ID, other, "which no longer exists"))
+			holderIDs = append(holderIDs, other)
+		default:
+			log.WithFields(logrus.Fields{
+				"node_id":        other,
+				"target_node_id": nodeID,
+			}).Warn("Controller Publish Volume: detaching volume from deleted node to attach it to the target node")
+			if err := c.detachFromDeletedNode(ctx, backend, vol.ID, other); err != nil {
+				staleAttachments.add(1, "failed")
+				return err
+			}
+			staleAttachments.add(1, "detached")
+		}
+	}
+
+	if len(holders) == 0 {
+		return nil
+	}
+
+	st := status.Newf(codes.FailedPrecondition,
+		"cannot attach volume %s to node %s because it is already attached to %s", vol.ID, nodeID, strings.Join(holders, ", "))
+
+	// the detail lets tooling tell the conflicting nodes without parsing the message
+	withInfo, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: attachConflictReason,
+		Domain: c.Driver.name,
+		Metadata: map[string]string{
+			"volume_id":         vol.ID,
+			"node_id":           nodeID,
+			"attached_node_ids": strings.Join(holderIDs, ","),
+		},
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return withInfo.Err()
+}
+
+// publishAlreadyAttached answers an attach Vultr refused as the volume is already
+// attached, which the volume read before attaching did not show, as when another attach
+// raced it. The publish succeeds when the attachment is to the node, and otherwise fails
+// the way a conflict seen up front does rather than with the error of the Vultr API.
+func (c *VultrControllerServer) publishAlreadyAttached(ctx context.Context, backend storageBackend, volumeID, nodeID string, volCtx, publishContext map[string]string) (*csi.ControllerPublishVolumeResponse, error) { //nolint:lll
+	vol, err := backend.Get(ctx, volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot get volume %s reported already attached: %v", volumeID, err)
+	}
+
+	switch {
+	case vol.isAttachedTo(nodeID):
+		return &csi.ControllerPublishVolumeResponse{PublishContext: c.publishContext(backend, vol, nodeID, volCtx)}, nil
+	case supportsMultiAttach(vol.StorageType):
+		// shared volumes attach to several nodes, only the node attaching them twice is refused
+		return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext}, nil
+	case len(vol.AttachedTo) == 0:
+		return nil, status.Errorf(codes.Aborted, "volume %s was reported already attached but is attached to no node", volumeID)
+	}
+
+	if err := c.resolveAttachConflict(ctx, backend, vol, nodeID); err != nil {
+		return nil, err
+	}
+	return nil, status.Errorf(codes.Aborted, "volume %s was detached from a deleted node, the attach to node %s is to be retried", volumeID, nodeID)
+}
+
+// describeAttachment names the node holding the volume and how long it has held it
+func (c *VultrControllerServer) describeAttachment(volumeID, nodeID, name string) string {
+	desc := fmt.Sprintf("node %s %s", nodeID, name)
+	if age, ok := c.attachments.age(volumeID, nodeID); ok {
+		return fmt.Sprintf("%s for %s", desc, age.Round(time.Second))
+	}
+	return desc
+}
+
+func (c *VultrControllerServer) detachFromDeletedNode(ctx context.Context, backend storageBackend, volumeID, nodeID string) error {
+	defer c.volumes.invalidate()
+
+	if err := backend.Detach(ctx, volumeID, nodeID); err != nil && !errors.Is(err, errNotAttached) {
+		if err := dryRunCheck("ControllerPublishVolume", err); err != nil {
+			return err
+		}
+		return status.Errorf(codes.Internal, "cannot detach volume %s from deleted node %s: %v", volumeID, nodeID, err)
+	}
+
+	if err := c.waitDetached(ctx, backend, volumeID, nodeID); err != nil {
+		return status.Errorf(codes.Internal, "volume %s is not detached from deleted node %s: %v", volumeID, nodeID, err)
+	}
+
+	c.attachments.detached(volumeID, nodeID)
+	c.detachesStuck.forget(volumeID + "/" + nodeID)
+	requestLogger(ctx, c.Driver.log).WithFields(logrus.Fields{
+		"volume_id": volumeID,
+		"node_id":   nodeID,
+	}).Info("Controller Publish Volume: detached from deleted node")
+	return nil
+}
@@ -0,0 +1,294 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// auditStdout is the --audit-log value writing the audit records to stdout
+	auditStdout = "-"
+
+	// auditAPIOperation is the operation of the records of Vultr API calls changing
+	// something outside of an audited RPC, such as those of the background loops
+	auditAPIOperation = "VultrAPI"
+
+	// vultrRequestIDHeader is the response header carrying the ID of a Vultr API request,
+	// when the API returns one
+	vultrRequestIDHeader = "X-Request-Id"
+)
+
+// auditedRPCs are the RPCs the audit log records whatever they do. The other RPCs are
+// recorded when they call the Vultr API to change something, as the node does to attach
+// vfs volumes or provision ephemeral volumes.
+var auditedRPCs = map[string]bool{
+	"CreateVolume":              true,
+	"DeleteVolume":              true,
+	"ControllerPublishVolume":   true,
+	"ControllerUnpublishVolume": true,
+	"ControllerExpandVolume":    true,
+	"CreateSnapshot":            true,
+	"DeleteSnapshot":            true,
+}
+
+var auditRecords = metrics.newCounter("audit_records_total",
+	"Number of records written to the audit log, by result", "result")
+
+// WithAuditLog appends a JSON line to path for every provisioning, attach, detach and
+// delete operation, with the Vultr API calls it made and its outcome. - writes the
+// records to stdout, and an empty path disables the audit log.
+func WithAuditLog(path string) Option {
+	return func(d *VultrDriver) {
+		d.auditLogPath = path
+	}
+}
+
+// auditRecord is a line of the audit log
+type auditRecord struct {
+	Time       time.Time      `json:"time"`
+	Operation  string         `json:"operation"`
+	RequestID  string         `json:"request_id,omitempty"`
+	VolumeID   string         `json:"volume_id,omitempty"`
+	VolumeName string         `json:"volume_name,omitempty"`
+	NodeID     string         `json:"node_id,omitempty"`
+	SnapshotID string         `json:"snapshot_id,omitempty"`
+	Code       string         `json:"code,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	DurationMS int64          `json:"duration_ms"`
+	APICalls   []auditAPICall `json:"api_calls,omitempty"`
+	// Actions are the remedies the operation escalated to, such as a forced detach
+	Actions []string `json:"actions,omitempty"`
+}
+
+// auditAPICall is a Vultr API call an operation made
+type auditAPICall struct {
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Status    int    `json:"status,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// changes reports whether the call changes something rather than reading it
+func (c auditAPICall) changes() bool {
+	return c.Method != http.MethodGet && c.Method != http.MethodHead
+}
+
+// auditLog writes the audit records as JSON lines to a file opened for appending, or to
+// stdout, apart from the driver logs. It records the operations of the RPCs it
+// intercepts, and the Vultr API calls they make through its transport. Writing is best
+// effort and never fails an operation.
+type auditLog struct {
+	now func() time.Time
+	log *logrus.Entry
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newAuditLog(auditPath string, log *logrus.Entry) (*auditLog, error) {
+	a := &auditLog{now: time.Now, log: log.WithField("component", "audit_log"), w: os.Stdout}
+	if auditPath == auditStdout {
+		return a, nil
+	}
+
+	f, err := os.OpenFile(auditPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a.w = f
+	return a, nil
+}
+
+// auditTrailKey keys the calls of the RPC being audited in its context
+type auditTrailKey struct{}
+
+// auditTrail collects the Vultr API calls of an RPC
+type auditTrail struct {
+	mu      sync.Mutex
+	calls   []auditAPICall
+	actions []string
+}
+
+func (t *auditTrail) add(call auditAPICall) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.calls = append(t.calls, call)
+}
+
+// auditAction records an action the RPC in ctx escalated to in its audit record, doing
+// nothing when the RPC is not audited
+func auditAction(ctx context.Context, action string) {
+	if t, ok := ctx.Value(auditTrailKey{}).(*auditTrail); ok {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		t.actions = append(t.actions, action)
+	}
+}
+
+// list returns the calls, and whether any of them changes something
+func (t *auditTrail) list() ([]auditAPICall, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	changed := false
+	for _, call := range t.calls {
+		changed = changed || call.changes()
+	}
+	return append([]auditAPICall(nil), t.calls...), changed
+}
+
+func (t *auditTrail) listActions() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]string(nil), t.actions...)
+}
+
+// intercept is a gRPC interceptor recording the RPCs which are audited or change something
+func (a *auditLog) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) { //nolint:lll
+	trail := &auditTrail{}
+	start := a.now()
+
+	resp, err := handler(context.WithValue(ctx, auditTrailKey{}, trail), req)
+
+	method := path.Base(info.FullMethod)
+	calls, changed := trail.list()
+	if !auditedRPCs[method] && !changed {
+		return resp, err
+	}
+
+	record := auditRecord{
+		Time:       start.UTC(),
+		Operation:  method,
+		RequestID:  callRequestID(ctx),
+		VolumeID:   requestVolumeID(req),
+		DurationMS: a.now().Sub(start).Milliseconds(),
+		APICalls:   calls,
+		Actions:    trail.listActions(),
+	}
+	switch r := req.(type) {
+	case *csi.CreateVolumeRequest:
+		record.VolumeName = r.GetName()
+	case *csi.ControllerPublishVolumeRequest:
+		record.NodeID = r.GetNodeId()
+	case *csi.ControllerUnpublishVolumeRequest:
+		record.NodeID = r.GetNodeId()
+	case *csi.CreateSnapshotRequest:
+		record.VolumeID = r.GetSourceVolumeId()
+	case *csi.DeleteSnapshotRequest:
+		record.SnapshotID = r.GetSnapshotId()
+	}
+	switch r := resp.(type) {
+	case *csi.CreateVolumeResponse:
+		record.VolumeID = r.GetVolume().GetVolumeId()
+	case *csi.CreateSnapshotResponse:
+		record.SnapshotID = r.GetSnapshot().GetSnapshotId()
+	}
+
+	st := status.Convert(err)
+	record.Code = st.Code().String()
+	if err != nil {
+		record.Error = st.Message()
+	}
+
+	a.write(&record)
+	return resp, err
+}
+
+// callRequestID returns the request ID GRPCLogger gave the RPC in ctx
+func callRequestID(ctx context.Context) string {
+	if logger, ok := ctx.Value(requestLoggerKey{}).(*logrus.Entry); ok {
+		if id, ok := logger.Data["GRPC.request_id"].(string); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+// transport returns an http.RoundTripper adding the Vultr API calls to the trail of the
+// RPC making them, and recording those changing something outside of an RPC
+func (a *auditLog) transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &auditTransport{audit: a, next: next}
+}
+
+type auditTransport struct {
+	audit *auditLog
+	next  http.RoundTripper
+}
+
+// RoundTrip performs the request and records the call
+func (t *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := t.audit.now()
+	resp, err := t.next.RoundTrip(req)
+
+	call := auditAPICall{Method: req.Method, Path: req.URL.Path}
+	if err != nil {
+		call.Error = err.Error()
+	} else {
+		call.Status = resp.StatusCode
+		call.RequestID = resp.Header.Get(vultrRequestIDHeader)
+	}
+
+	if trail, ok := req.Context().Value(auditTrailKey{}).(*auditTrail); ok {
+		trail.add(call)
+	} else if call.changes() {
+		t.audit.write(&auditRecord{
+			Time:       start.UTC(),
+			Operation:  auditAPIOperation,
+			DurationMS: t.audit.now().Sub(start).Milliseconds(),
+			APICalls:   []auditAPICall{call},
+		})
+	}
+
+	return resp, err
+}
+
+// write appends the record as a line
+func (a *auditLog) write(record *auditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		auditRecords.add(1, "failed")
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := a.w.Write(line); err != nil {
+		auditRecords.add(1, "failed")
+		a.log.Warnf("cannot write audit record of %s: %v", record.Operation, err)
+		return
+	}
+	auditRecords.add(1, "written")
+}
@@ -0,0 +1,162 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/vultr/govultr/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/vultr/vultr-csi/internal/fakevultr"
+)
+
+func TestAuditLog(t *testing.T) {
+	const nodeID = "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"
+
+	api := fakevultr.New()
+	api.AddInstance(nodeID, "ewr", "node", "vc2-1c-1gb")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(vultrRequestIDHeader, "vultr-"+r.Method)
+		api.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	var out bytes.Buffer
+	audit := &auditLog{now: time.Now, log: logrus.NewEntry(logrus.New()), w: &out}
+
+	client := govultr.NewClient(&http.Client{Transport: audit.transport(srv.Client().Transport)})
+	if err := client.SetBaseURL(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	client.SetRetryLimit(0)
+
+	records := func() []auditRecord {
+		t.Helper()
+		var list []auditRecord
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var record auditRecord
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("cannot parse audit line %q: %v", line, err)
+			}
+			list = append(list, record)
+		}
+		out.Reset()
+		return list
+	}
+	call := func(method string, req interface{}, handler grpc.UnaryHandler) error {
+		ctx := context.WithValue(context.Background(), requestLoggerKey{},
+			logrus.NewEntry(logrus.New()).WithField("GRPC.request_id", "rpc-1"))
+		_, err := audit.intercept(ctx, req, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/" + method}, handler)
+		return err
+	}
+
+	// volumes created outside of an RPC are audited as API calls
+	vol, _, err := client.BlockStorage.Create(context.Background(), &govultr.BlockStorageCreate{Region: "ewr", SizeGB: 10, Label: "data"}) //nolint:bodyclose
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := records()
+	if len(got) != 1 || got[0].Operation != auditAPIOperation || len(got[0].APICalls) != 1 ||
+		got[0].APICalls[0].Method != http.MethodPost || got[0].APICalls[0].RequestID != "vultr-POST" {
+		t.Fatalf("expected the create to be audited as an API call, got %+v", got)
+	}
+
+	if _, _, err := client.BlockStorage.Get(context.Background(), vol.ID); err != nil { //nolint:bodyclose
+		t.Fatal(err)
+	}
+	if got := records(); len(got) != 0 {
+		t.Errorf("expected reads outside of an RPC not to be audited, got %+v", got)
+	}
+
+	publish := &csi.ControllerPublishVolumeRequest{VolumeId: vol.ID, NodeId: nodeID}
+	if err := call("ControllerPublishVolume", publish, func(ctx context.Context, req interface{}) (interface{}, error) {
+		if _, _, err := client.BlockStorage.Get(ctx, vol.ID); err != nil { //nolint:bodyclose
+			return nil, err
+		}
+		return &csi.ControllerPublishVolumeResponse{}, client.BlockStorage.Attach(ctx, vol.ID, &govultr.BlockStorageAttach{InstanceID: nodeID})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got = records()
+	if len(got) != 1 {
+		t.Fatalf("expected a record of the publish, got %+v", got)
+	}
+	record := got[0]
+	if record.Operation != "ControllerPublishVolume" || record.RequestID != "rpc-1" || record.VolumeID != vol.ID ||
+		record.NodeID != nodeID || record.Code != codes.OK.String() || record.Error != "" {
+		t.Errorf("unexpected record of the publish %+v", record)
+	}
+	if len(record.APICalls) != 2 || record.APICalls[1].Method != http.MethodPost ||
+		record.APICalls[1].Path != "/v2/blocks/"+vol.ID+"/attach" || record.APICalls[1].RequestID != "vultr-POST" {
+		t.Errorf("expected the read and attach calls of the publish, got %+v", record.APICalls)
+	}
+
+	if err := call("DeleteVolume", &csi.DeleteVolumeRequest{VolumeId: vol.ID}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.FailedPrecondition, "volume is attached")
+	}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected the error of the handler, got %v", err)
+	}
+	got = records()
+	if len(got) != 1 || got[0].Code != codes.FailedPrecondition.String() || got[0].Error != "volume is attached" || len(got[0].APICalls) != 0 {
+		t.Errorf("expected the refused delete to be audited, got %+v", got)
+	}
+
+	unpublish := &csi.ControllerUnpublishVolumeRequest{VolumeId: vol.ID, NodeId: nodeID}
+	if err := call("ControllerUnpublishVolume", unpublish, func(ctx context.Context, req interface{}) (interface{}, error) {
+		auditAction(ctx, auditActionForceDetach)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got = records()
+	if len(got) != 1 || len(got[0].Actions) != 1 || got[0].Actions[0] != auditActionForceDetach {
+		t.Errorf("expected the forced detach among the actions of the unpublish, got %+v", got)
+	}
+
+	if err := call("ControllerGetVolume", &csi.ControllerGetVolumeRequest{VolumeId: vol.ID}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		_, _, err := client.BlockStorage.Get(ctx, vol.ID) //nolint:bodyclose
+		return &csi.ControllerGetVolumeResponse{}, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := records(); len(got) != 0 {
+		t.Errorf("expected RPCs which only read not to be audited, got %+v", got)
+	}
+}
+
+func TestNewAuditLogAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := os.WriteFile(path, []byte("{}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	audit, err := newAuditLog(path, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.write(&auditRecord{Operation: "DeleteVolume", VolumeID: "vol"})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || lines[0] != "{}" || !strings.Contains(lines[1], `"volume_id":"vol"`) {
+		t.Errorf("expected the record to be appended, got %q", data)
+	}
+}
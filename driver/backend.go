@@ -0,0 +1,324 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	// storageTypeParam is the StorageClass parameter selecting the backend
+	storageTypeParam = "storage_type"
+
+	storageTypeBlock = "block"
+
+	defaultStorageType = storageTypeBlock
+)
+
+var (
+	errVolumeNotFound   = errors.New("volume not found")
+	errInstanceLocked   = errors.New("instance is locked")
+	errAlreadyAttached  = errors.New("volume is already attached")
+	errNotAttached      = errors.New("volume is not attached")
+	errUnknownStorage   = errors.New("unknown storage type")
+	errInvalidParameter = errors.New("invalid parameter")
+	errUnknownParameter = errors.New("unsupported parameters")
+	errOutOfRange       = errors.New("capacity out of range")
+	errVolumeBusy       = errors.New("volume is busy")
+)
+
+// backendVolume is the storage agnostic view of a provisioned volume
+type backendVolume struct {
+	ID          string
+	Label       string
+	StorageType string
+	SizeBytes   int64
+	Status      string
+	Region      string
+	// AttachedTo lists the instances the volume is attached to
+	AttachedTo []string
+	// MountID identifies the volume to the node plugin once attached
+	MountID string
+	// BlockType is the block storage tier, empty for non block volumes
+	BlockType string
+	// Attachments details the attachments of storage identified per attachment, by instance
+	Attachments map[string]volumeAttachment
+}
+
+// volumeAttachment is the attachment of a volume to one instance
+type volumeAttachment struct {
+	// MountID overrides the MountID of the volume on this attachment
+	MountID string
+	// State is the lower cased state Vultr reports for the attachment
+	State string
+}
+
+// mountIDFor returns the ID the node identifies the volume by once attached to nodeID
+func (v *backendVolume) mountIDFor(nodeID string) string {
+	if a, ok := v.Attachments[nodeID]; ok {
+		return a.MountID
+	}
+	return v.MountID
+}
+
+// isAttachedTo returns true when the volume is attached to the given instance
+func (v *backendVolume) isAttachedTo(nodeID string) bool {
+	for _, id := range v.AttachedTo {
+		if id == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// backendVolumeFields returns what a volumes.Filter selects a volume by
+func backendVolumeFields(v *backendVolume) (label, storageType string) {
+	return v.Label, v.StorageType
+}
+
+// sizeLimits are the sizes a storage product can be provisioned at
+type sizeLimits struct {
+	name         string
+	defaultBytes int64
+	minBytes     int64
+	maxBytes     int64
+}
+
+// sizeBytes returns the size to provision for capRange: the default when no size is
+// required, otherwise the required bytes rounded up to the whole GB Vultr provisions in,
+// raised to the minimum. It fails with errOutOfRange when that size exceeds the limit
+// or the maximum.
+func (l sizeLimits) sizeBytes(capRange *csi.CapacityRange) (int64, error) {
+	required := capRange.GetRequiredBytes()
+	limit := capRange.GetLimitBytes()
+
+	size := l.defaultBytes
+	if required > 0 {
+		size = (required + giB - 1) / giB * giB
+	} else if limit > 0 && size > limit {
+		size = limit / giB * giB
+	}
+
+	if size < l.minBytes {
+		size = l.minBytes
+	}
+
+	if limit > 0 && size > limit {
+		return 0, fmt.Errorf("%w: %dGB exceeds the limit of %d bytes, %s", errOutOfRange, size/giB, limit, l.bounds())
+	}
+
+	if size > l.maxBytes {
+		return 0, fmt.Errorf("%w: %dGB exceeds the maximum, %s", errOutOfRange, size/giB, l.bounds())
+	}
+
+	return size, nil
+}
+
+// bounds describes the sizes of the product for the errors of capacity ranges it cannot satisfy
+func (l sizeLimits) bounds() string {
+	return fmt.Sprintf("%s is provisioned in whole GB from %dGB to %dGB", l.name, l.minBytes/giB, l.maxBytes/giB)
+}
+
+// capacityFits reports whether a volume of size bytes satisfies capRange
+func capacityFits(capRange *csi.CapacityRange, size int64) bool {
+	if size < capRange.GetRequiredBytes() {
+		return false
+	}
+
+	limit := capRange.GetLimitBytes()
+	return limit == 0 || size <= limit
+}
+
+// storageBackend is implemented by each Vultr storage product the controller can provision
+type storageBackend interface {
+	// Create provisions a volume with the given label sized for capRange
+	Create(ctx context.Context, name string, capRange *csi.CapacityRange, params map[string]string) (*backendVolume, error)
+	// Get returns the volume or errVolumeNotFound
+	Get(ctx context.Context, volumeID string) (*backendVolume, error)
+	// List returns every volume of this storage type on the account
+	List(ctx context.Context) ([]backendVolume, error)
+	// Delete removes the volume
+	Delete(ctx context.Context, volumeID string) error
+	// Attach attaches the volume to the instance
+	Attach(ctx context.Context, volumeID, nodeID string) error
+	// Detach detaches the volume from the instance
+	Detach(ctx context.Context, volumeID, nodeID string) error
+	// Expand grows the volume to satisfy capRange and returns the new size in bytes
+	Expand(ctx context.Context, vol *backendVolume, capRange *csi.CapacityRange) (int64, error)
+	// Limits returns the sizes a volume for params is provisioned at in the region, and
+	// false when the region does not offer it
+	Limits(ctx context.Context, region string, params map[string]string) (sizeLimits, bool, error)
+}
+
+// snapshotter is implemented by backends which support volume snapshots
+type snapshotter interface {
+	CreateSnapshot(ctx context.Context, volumeID, name string) (*csi.Snapshot, error)
+	DeleteSnapshot(ctx context.Context, snapshotID string) error
+}
+
+// modifier is implemented by backends whose volumes have attributes which can change in
+// place, the mutable parameters of a VolumeAttributesClass
+type modifier interface {
+	// Modify brings the volume to the normalized mutable parameters, failing with
+	// errInvalidParameter for those Vultr cannot change on the volume
+	Modify(ctx context.Context, vol *backendVolume, params map[string]string) error
+}
+
+// attachmentPublisher is implemented by backends whose attachments carry more than the
+// mount ID for the node to mount the volume with, passed on in the publish context
+type attachmentPublisher interface {
+	PublishContext(vol *backendVolume, nodeID string) map[string]string
+}
+
+// forceDetacher is implemented by backends which can detach a volume the instance does
+// not let go of, at the cost of restarting the instance
+type forceDetacher interface {
+	ForceDetach(ctx context.Context, volumeID, nodeID string) error
+}
+
+// backendRegistry holds the storage backends keyed by storage type
+type backendRegistry struct {
+	backends map[string]storageBackend
+	// disabled are the storage types turned off in this deployment
+	disabled map[string]bool
+}
+
+func newBackendRegistry(d *VultrDriver) *backendRegistry {
+	r := &backendRegistry{backends: make(map[string]storageBackend), disabled: make(map[string]bool)}
+	for storageType, b := range d.cloudProvider().Backends() {
+		r.register(storageType, b)
+	}
+	if d.vfsDisabled {
+		r.disabled[storageTypeVFS] = true
+	}
+
+	return r
+}
+
+func (r *backendRegistry) register(storageType string, b storageBackend) {
+	r.backends[storageType] = b
+}
+
+// forParameters returns the backend selected by the StorageClass parameters
+func (r *backendRegistry) forParameters(params map[string]string) (string, storageBackend, error) {
+	storageType := params[storageTypeParam]
+	if storageType == "" {
+		storageType = defaultStorageType
+	}
+
+	b, ok := r.backends[storageType]
+	if !ok && r.disabled[storageType] {
+		return "", nil, fmt.Errorf("%w %q, it is disabled in this deployment, supported storage types are %v",
+			errUnknownStorage, storageType, r.types())
+	}
+	if !ok {
+		return "", nil, fmt.Errorf("%w %q, supported storage types are %v", errUnknownStorage, storageType, r.types())
+	}
+
+	return storageType, b, nil
+}
+
+// types returns the registered storage types, default first
+func (r *backendRegistry) types() []string {
+	types := make([]string, 0, len(r.backends))
+	for t := range r.backends {
+		types = append(types, t)
+	}
+
+	sort.Slice(types, func(i, j int) bool {
+		if types[i] == defaultStorageType || types[j] == defaultStorageType {
+			return types[i] == defaultStorageType
+		}
+		return types[i] < types[j]
+	})
+
+	return types
+}
+
+// get looks the volume up in each backend and returns the one owning it
+func (r *backendRegistry) get(ctx context.Context, volumeID string) (storageBackend, *backendVolume, error) {
+	var lastErr error = errVolumeNotFound
+
+	for _, t := range r.types() {
+		b := r.backends[t]
+		vol, err := b.Get(ctx, volumeID)
+		if err == nil {
+			return b, vol, nil
+		}
+
+		if !errors.Is(err, errVolumeNotFound) {
+			lastErr = err
+		}
+	}
+
+	return nil, nil, lastErr
+}
+
+// find looks the volume up by listing each backend, returning errVolumeNotFound when absent
+func (r *backendRegistry) find(ctx context.Context, volumeID string) (storageBackend, *backendVolume, error) {
+	for _, t := range r.types() {
+		b := r.backends[t]
+		list, err := b.List(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for i := range list {
+			if list[i].ID == volumeID {
+				return b, &list[i], nil
+			}
+		}
+	}
+
+	return nil, nil, errVolumeNotFound
+}
+
+// supportsSnapshots reports whether any registered backend implements snapshots
+func (r *backendRegistry) supportsSnapshots() bool {
+	for _, b := range r.backends {
+		if _, ok := b.(snapshotter); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// supportsModify reports whether any registered backend can modify its volumes in place
+func (r *backendRegistry) supportsModify() bool {
+	for _, b := range r.backends {
+		if _, ok := b.(modifier); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the volumes of every backend
+func (r *backendRegistry) list(ctx context.Context) ([]backendVolume, error) {
+	var volumes []backendVolume
+	for _, t := range r.types() {
+		list, err := r.backends[t].List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, list...)
+	}
+
+	return volumes, nil
+}
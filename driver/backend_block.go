@@ -0,0 +1,293 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/vultr/govultr/v3"
+
+	"github.com/vultr/vultr-csi/internal/volumes"
+)
+
+// blockStorageRegionOption prefixes the block storage tier in the options of the
+// regions which offer it, such as block_storage_high_perf
+const blockStorageRegionOption = "block_storage_"
+
+var _ storageBackend = &blockBackend{}
+
+// blockBackend provisions Vultr Block Storage
+type blockBackend struct {
+	driver *VultrDriver
+}
+
+func newBlockBackend(d *VultrDriver) *blockBackend {
+	return &blockBackend{driver: d}
+}
+
+// Create provisions a new block storage volume
+func (b *blockBackend) Create(ctx context.Context, name string, capRange *csi.CapacityRange, params map[string]string) (*backendVolume, error) { //nolint:lll
+	blockType := params[blockTypeParam]
+	if blockType == "" {
+		return nil, fmt.Errorf("%w: volume parameter `block_type` is missing", errInvalidParameter)
+	}
+
+	size, err := blockSizeBytes(capRange, blockType)
+	if err != nil {
+		return nil, err
+	}
+
+	region := params[regionParam]
+	if region == "" {
+		region = b.driver.region
+	}
+
+	blockReq := &govultr.BlockStorageCreate{
+		Region:    region,
+		SizeGB:    int(size / giB),
+		Label:     name,
+		BlockType: blockType,
+	}
+
+	volume, _, err := b.driver.client.BlockStorage.Create(ctx, blockReq) //nolint:bodyclose
+	if err != nil {
+		return nil, err
+	}
+
+	vol := blockToBackendVolume(volume)
+	vol.SizeBytes = size
+	if vol.BlockType == "" {
+		vol.BlockType = blockType
+	}
+	if vol.Region == "" {
+		vol.Region = region
+	}
+
+	return vol, nil
+}
+
+// Get returns a single block storage volume
+func (b *blockBackend) Get(ctx context.Context, volumeID string) (*backendVolume, error) {
+	volume, _, err := b.driver.client.BlockStorage.Get(ctx, volumeID) //nolint:bodyclose
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, fmt.Errorf("%w: %v", errVolumeNotFound, err)
+		}
+		return nil, err
+	}
+
+	return blockToBackendVolume(volume), nil
+}
+
+// List returns all block storage volumes, following pagination
+func (b *blockBackend) List(ctx context.Context) ([]backendVolume, error) {
+	return volumes.All(ctx, func(ctx context.Context, options *govultr.ListOptions) ([]backendVolume, *govultr.Meta, error) {
+		list, meta, _, err := b.driver.client.BlockStorage.List(ctx, options) //nolint:bodyclose
+		if err != nil {
+			return nil, nil, err
+		}
+
+		page := make([]backendVolume, 0, len(list))
+		for i := range list {
+			page = append(page, *blockToBackendVolume(&list[i]))
+		}
+		return page, meta, nil
+	})
+}
+
+// Delete removes the block storage volume
+func (b *blockBackend) Delete(ctx context.Context, volumeID string) error {
+	return b.driver.client.BlockStorage.Delete(ctx, volumeID)
+}
+
+// Attach live attaches the block storage volume to the instance
+func (b *blockBackend) Attach(ctx context.Context, volumeID, nodeID string) error {
+	attach := &govultr.BlockStorageAttach{
+		InstanceID: nodeID,
+		Live:       govultr.BoolToBoolPtr(true),
+	}
+
+	err := b.driver.client.BlockStorage.Attach(ctx, volumeID, attach)
+	if err != nil {
+		// Desired node could still be spinning up
+		if strings.Contains(err.Error(), "Server is currently locked") {
+			return fmt.Errorf("%w: %v", errInstanceLocked, err)
+		}
+
+		if strings.Contains(err.Error(), "Block storage volume is already attached to a server") {
+			return fmt.Errorf("%w: %v", errAlreadyAttached, err)
+		}
+	}
+
+	return err
+}
+
+// Detach live detaches the block storage volume from whichever instance it is attached to
+func (b *blockBackend) Detach(ctx context.Context, volumeID, _ string) error {
+	return b.detach(ctx, volumeID, true)
+}
+
+// ForceDetach detaches the block storage volume without the cooperation of the instance,
+// which Vultr restarts to let go of it
+func (b *blockBackend) ForceDetach(ctx context.Context, volumeID, _ string) error {
+	return b.detach(ctx, volumeID, false)
+}
+
+func (b *blockBackend) detach(ctx context.Context, volumeID string, live bool) error {
+	detach := &govultr.BlockStorageDetach{
+		Live: govultr.BoolToBoolPtr(live),
+	}
+
+	err := b.driver.client.BlockStorage.Detach(ctx, volumeID, detach)
+	if err != nil && strings.Contains(err.Error(), "Block storage volume is not currently attached to a server") {
+		return fmt.Errorf("%w: %v", errNotAttached, err)
+	}
+
+	return err
+}
+
+// Expand resizes the block storage volume, rounding the requested capacity up to
+// the whole GB Vultr provisions in
+func (b *blockBackend) Expand(ctx context.Context, vol *backendVolume, capRange *csi.CapacityRange) (int64, error) {
+	expanded, err := blockSizeBytes(capRange, vol.BlockType)
+	if err != nil {
+		return 0, err
+	}
+
+	if vol.Status != "" && vol.Status != "active" {
+		return 0, fmt.Errorf("%w: volume %s is %s", errVolumeBusy, vol.ID, vol.Status)
+	}
+
+	blockReq := &govultr.BlockStorageUpdate{
+		SizeGB: int(expanded / giB),
+	}
+
+	if err := b.driver.client.BlockStorage.Update(ctx, vol.ID, blockReq); err != nil {
+		if isBusyError(err) {
+			return 0, fmt.Errorf("%w: %v", errVolumeBusy, err)
+		}
+		return 0, err
+	}
+
+	return expanded, nil
+}
+
+// Modify checks the block type of the parameters is that of the volume, Vultr having no
+// way to move block storage to another type in place
+func (b *blockBackend) Modify(_ context.Context, vol *backendVolume, params map[string]string) error {
+	if _, ok := params[vfsTagsParam]; ok {
+		return fmt.Errorf("%w: parameter %q only applies to vfs volumes", errInvalidParameter, vfsTagsParam)
+	}
+
+	// Vultr reports the type of every volume, an empty one is left unchecked
+	if blockType, ok := params[blockTypeParam]; ok && vol.BlockType != "" && blockType != vol.BlockType {
+		return fmt.Errorf("%w: volume %s is %s block storage, which cannot be changed to %s in place",
+			errInvalidParameter, vol.ID, vol.BlockType, blockType)
+	}
+	return nil
+}
+
+// Limits returns the sizes of the block storage tier, which the region offers when
+// it lists the tier among its options
+func (b *blockBackend) Limits(ctx context.Context, region string, params map[string]string) (sizeLimits, bool, error) { //nolint:lll
+	blockType := params[blockTypeParam]
+	if blockType == "" {
+		return sizeLimits{}, false, fmt.Errorf("%w: volume parameter `block_type` is missing", errInvalidParameter)
+	}
+
+	options, err := b.regionOptions(ctx, region)
+	if err != nil {
+		return sizeLimits{}, false, err
+	}
+
+	return blockLimits(blockType), options[blockStorageRegionOption+blockType], nil
+}
+
+// regionOptions returns the options of the region, none when Vultr does not know it
+func (b *blockBackend) regionOptions(ctx context.Context, region string) (map[string]bool, error) {
+	var options map[string]bool
+
+	err := volumes.Walk(ctx, &govultr.ListOptions{}, func(ctx context.Context, listOptions *govultr.ListOptions) ([]govultr.Region, *govultr.Meta, error) { //nolint:lll
+		regions, meta, _, err := b.driver.client.Region.List(ctx, listOptions) //nolint:bodyclose
+		return regions, meta, err
+	}, func(regions []govultr.Region) bool {
+		for i := range regions {
+			if regions[i].ID != region {
+				continue
+			}
+
+			options = make(map[string]bool, len(regions[i].Options))
+			for _, option := range regions[i].Options {
+				options[option] = true
+			}
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// blockSizeBytes returns the size to provision a volume of blockType at for capRange
+func blockSizeBytes(capRange *csi.CapacityRange, blockType string) (int64, error) {
+	return blockLimits(blockType).sizeBytes(capRange)
+}
+
+// blockLimits returns the sizes a volume of blockType is provisioned at
+func blockLimits(blockType string) sizeLimits {
+	limits := sizeLimits{name: blockType + " block storage",
+		defaultBytes: nvmeVolumeSizeInBytes, minBytes: nvmeMinVolumeSizeInBytes, maxBytes: nvmeMaxVolumeSizeInBytes}
+	if blockType == blockTypeHDD {
+		limits.defaultBytes, limits.minBytes, limits.maxBytes = hddDefaultVolumeSizeInBytes, hddMinVolumeSizeInBytes, hddMaxVolumeSizeInBytes
+	}
+
+	return limits
+}
+
+func blockToBackendVolume(bs *govultr.BlockStorage) *backendVolume {
+	vol := &backendVolume{
+		ID:          bs.ID,
+		Label:       bs.Label,
+		StorageType: storageTypeBlock,
+		SizeBytes:   int64(bs.SizeGB) * giB,
+		Status:      bs.Status,
+		Region:      bs.Region,
+		MountID:     bs.MountID,
+		BlockType:   bs.BlockType,
+	}
+
+	if bs.AttachedToInstance != "" {
+		vol.AttachedTo = []string{bs.AttachedToInstance}
+	}
+
+	return vol
+}
+
+// isBusyError reports whether the Vultr API rejected a change because the volume is
+// still processing an earlier one
+func isBusyError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "resizing") || strings.Contains(msg, "pending") || strings.Contains(msg, "in progress")
+}
+
+// isNotFoundError reports whether the Vultr API error describes a missing resource
+func isNotFoundError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, `"status":404`) || strings.Contains(msg, "not found") || strings.Contains(msg, "invalid block storage id")
+}
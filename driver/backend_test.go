@@ -0,0 +1,80 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestBackendRegistryForParameters(t *testing.T) {
+	controller := NewFakeVultrControllerServer("backend registry")
+
+	storageType, _, err := controller.backends.forParameters(map[string]string{})
+	if err != nil {
+		t.Fatalf("expected default backend, got error: %v", err)
+	}
+
+	if storageType != storageTypeBlock {
+		t.Errorf("expected default storage type %q got %q", storageTypeBlock, storageType)
+	}
+
+	if _, _, err := controller.backends.forParameters(map[string]string{storageTypeParam: "tape"}); !errors.Is(err, errUnknownStorage) {
+		t.Errorf("expected unknown storage error, got %v", err)
+	}
+}
+
+func TestBackendRegistryFind(t *testing.T) {
+	controller := NewFakeVultrControllerServer("backend find")
+
+	_, vol, err := controller.backends.find(context.Background(), "bda4f333-bfd7-477b-84c2-e4df0ec9e5bf")
+	if err != nil {
+		t.Fatalf("expected volume, got error: %v", err)
+	}
+
+	if vol.Label != "test-bs2" || vol.StorageType != storageTypeBlock {
+		t.Errorf("unexpected volume %+v", vol)
+	}
+
+	if _, _, err := controller.backends.find(context.Background(), "missing"); !errors.Is(err, errVolumeNotFound) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func TestBlockSizeBytes(t *testing.T) {
+	tests := []struct {
+		name      string
+		capRange  *csi.CapacityRange
+		blockType string
+		expected  int64
+		err       error
+	}{
+		{"whole GB", &csi.CapacityRange{RequiredBytes: 20 * giB}, blockTypeNvme, 20 * giB, nil},
+		{"rounded up", &csi.CapacityRange{RequiredBytes: 20*giB + 1}, blockTypeNvme, 21 * giB, nil},
+		{"rounding exceeds limit", &csi.CapacityRange{RequiredBytes: 20*giB + 1, LimitBytes: 20*giB + 512}, blockTypeNvme, 0, errOutOfRange},
+		{"over the tier maximum", &csi.CapacityRange{RequiredBytes: 11 * tiB}, blockTypeNvme, 0, errOutOfRange},
+		{"hdd maximum", &csi.CapacityRange{RequiredBytes: 11 * tiB}, blockTypeHDD, 11 * tiB, nil},
+		{"nvme default", nil, blockTypeNvme, nvmeVolumeSizeInBytes, nil},
+		{"hdd default", nil, blockTypeHDD, hddDefaultVolumeSizeInBytes, nil},
+		{"default capped by the limit", &csi.CapacityRange{LimitBytes: 5 * giB}, blockTypeNvme, 5 * giB, nil},
+		{"raised to the hdd minimum", &csi.CapacityRange{RequiredBytes: 10 * giB}, blockTypeHDD, hddMinVolumeSizeInBytes, nil},
+		{"hdd minimum exceeds the limit", &csi.CapacityRange{RequiredBytes: 10 * giB, LimitBytes: 20 * giB}, blockTypeHDD, 0, errOutOfRange},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := blockSizeBytes(tt.capRange, tt.blockType)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if limits := blockLimits(tt.blockType); err != nil && !strings.Contains(err.Error(), limits.bounds()) {
+				t.Errorf("expected the error to report the sizes of %s, got %v", limits.name, err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %d got %d", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/vultr/govultr/v3"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/vultr/vultr-csi/internal/volumes"
+)
+
+const (
+	storageTypeVFS = "vfs"
+
+	// vfsAttachmentListers is how many VFS volumes List lists the attachments of at once
+	vfsAttachmentListers = 8
+
+	// vfsTagsParam is the StorageClass parameter holding comma separated tags for VFS volumes
+	vfsTagsParam = "tags"
+
+	// vfsMountOptionsParam is the StorageClass parameter holding comma separated virtiofs
+	// options the node mounts VFS volumes with, before the mount flags of the capability
+	vfsMountOptionsParam = "vfs_mount_options"
+
+	vfsDiskTypeNvme = "nvme"
+
+	vfsAttachmentAttached = "attached"
+
+	// publish context keys describing the attachment of a VFS volume to the node
+	publishContextMountTag        = "mount_tag"
+	publishContextAttachmentState = "attachment_state"
+
+	vfsDefaultVolumeSizeInBytes int64 = 10 * giB
+	vfsMinVolumeSizeInBytes     int64 = 10 * giB
+	vfsMaxVolumeSizeInBytes     int64 = 10 * tiB
+)
+
+var vfsSizeLimits = sizeLimits{
+	name:         "vfs storage",
+	defaultBytes: vfsDefaultVolumeSizeInBytes,
+	minBytes:     vfsMinVolumeSizeInBytes,
+	maxBytes:     vfsMaxVolumeSizeInBytes,
+}
+
+var (
+	_ storageBackend      = &vfsBackend{}
+	_ attachmentPublisher = &vfsBackend{}
+)
+
+// vfsBackend provisions Vultr File System storage, shared filesystems the node mounts
+// over virtiofs with the mount tag of its attachment
+type vfsBackend struct {
+	driver *VultrDriver
+}
+
+func newVFSBackend(d *VultrDriver) *vfsBackend {
+	return &vfsBackend{driver: d}
+}
+
+// Create provisions a new VFS volume
+func (v *vfsBackend) Create(ctx context.Context, name string, capRange *csi.CapacityRange, params map[string]string) (*backendVolume, error) { //nolint:lll
+	size, err := vfsSizeLimits.sizeBytes(capRange)
+	if err != nil {
+		return nil, err
+	}
+
+	region := params[regionParam]
+	if region == "" {
+		region = v.driver.region
+	}
+
+	vfsReq := &vfsCreate{
+		Region:      region,
+		Label:       name,
+		StorageSize: vfsSize{SizeGB: int(size / giB)},
+		DiskType:    vfsDiskTypeNvme,
+		Tags:        append(splitTags(params[vfsTagsParam]), v.driver.metadataTags(params)...),
+	}
+
+	vfs, err := v.driver.vfs.Create(ctx, vfsReq)
+	if err != nil {
+		return nil, err
+	}
+
+	vol := vfsToBackendVolume(vfs, nil)
+	vol.SizeBytes = size
+	if vol.Region == "" {
+		vol.Region = region
+	}
+
+	return vol, nil
+}
+
+// Get returns a single VFS volume with its attachments
+func (v *vfsBackend) Get(ctx context.Context, volumeID string) (*backendVolume, error) {
+	vfs, err := v.driver.vfs.Get(ctx, volumeID)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, fmt.Errorf("%w: %v", errVolumeNotFound, err)
+		}
+		return nil, err
+	}
+
+	attachments, err := v.driver.vfs.ListAttachments(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	return vfsToBackendVolume(vfs, attachments), nil
+}
+
+// List returns all VFS volumes with their attachments, following pagination. Vultr lists
+// the attachments of one VFS volume at a time, so those of a page are listed concurrently,
+// vfsAttachmentListers at a time, rather than one after the other.
+func (v *vfsBackend) List(ctx context.Context) ([]backendVolume, error) {
+	return volumes.All(ctx, func(ctx context.Context, options *govultr.ListOptions) ([]backendVolume, *govultr.Meta, error) {
+		list, meta, err := v.driver.vfs.List(ctx, options)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		attachments := make([][]vfsAttachment, len(list))
+		eg, egCtx := errgroup.WithContext(ctx)
+		eg.SetLimit(vfsAttachmentListers)
+		for i := range list {
+			i := i
+			eg.Go(func() error {
+				var err error
+				attachments[i], err = v.driver.vfs.ListAttachments(egCtx, list[i].ID)
+				return err
+			})
+		}
+		if err := eg.Wait(); err != nil {
+			return nil, nil, err
+		}
+
+		page := make([]backendVolume, 0, len(list))
+		for i := range list {
+			page = append(page, *vfsToBackendVolume(&list[i], attachments[i]))
+		}
+		return page, meta, nil
+	})
+}
+
+// Delete removes the VFS volume
+func (v *vfsBackend) Delete(ctx context.Context, volumeID string) error {
+	return v.driver.vfs.Delete(ctx, volumeID)
+}
+
+// Attach attaches the VFS volume to the instance
+func (v *vfsBackend) Attach(ctx context.Context, volumeID, nodeID string) error {
+	_, err := v.driver.vfs.Attach(ctx, volumeID, nodeID)
+	if err != nil && strings.Contains(strings.ToLower(err.Error()), "already attached") {
+		return fmt.Errorf("%w: %v", errAlreadyAttached, err)
+	}
+
+	return err
+}
+
+// Detach detaches the VFS volume from the instance
+func (v *vfsBackend) Detach(ctx context.Context, volumeID, nodeID string) error {
+	err := v.driver.vfs.Detach(ctx, volumeID, nodeID)
+	if err != nil && (isNotFoundError(err) || strings.Contains(strings.ToLower(err.Error()), "not attached")) {
+		return fmt.Errorf("%w: %v", errNotAttached, err)
+	}
+
+	return err
+}
+
+// Expand resizes the VFS volume. The shared filesystem grows with it, so there is
+// nothing for the node to do.
+func (v *vfsBackend) Expand(ctx context.Context, vol *backendVolume, capRange *csi.CapacityRange) (int64, error) {
+	expanded, err := vfsSizeLimits.sizeBytes(capRange)
+	if err != nil {
+		return 0, err
+	}
+
+	if vol.Status != "" && vol.Status != "active" {
+		return 0, fmt.Errorf("%w: volume %s is %s", errVolumeBusy, vol.ID, vol.Status)
+	}
+
+	if err := v.driver.vfs.Update(ctx, vol.ID, &vfsUpdate{StorageSize: &vfsSize{SizeGB: int(expanded / giB)}}); err != nil {
+		if isBusyError(err) {
+			return 0, fmt.Errorf("%w: %v", errVolumeBusy, err)
+		}
+		return 0, err
+	}
+
+	return expanded, nil
+}
+
+// Modify replaces the tags of the VFS volume with those of the parameters, keeping the
+// tags identifying its cluster and Kubernetes objects
+func (v *vfsBackend) Modify(ctx context.Context, vol *backendVolume, params map[string]string) error {
+	if _, ok := params[blockTypeParam]; ok {
+		return fmt.Errorf("%w: parameter %q does not apply to vfs volumes", errInvalidParameter, blockTypeParam)
+	}
+
+	value, ok := params[vfsTagsParam]
+	if !ok {
+		return nil
+	}
+
+	vfs, err := v.driver.vfs.Get(ctx, vol.ID)
+	if err != nil {
+		return err
+	}
+
+	tags := splitTags(value)
+	for _, tag := range vfs.Tags {
+		if strings.HasPrefix(tag, metadataTagPrefix) {
+			tags = append(tags, tag)
+		}
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+
+	if slices.Equal(tags, vfs.Tags) {
+		return nil
+	}
+	return v.driver.vfs.Update(ctx, vol.ID, &vfsUpdate{Tags: &tags})
+}
+
+// Limits returns the sizes of VFS storage. The region options do not advertise VFS,
+// so every region is taken to offer it and provisioning is left to tell otherwise.
+func (v *vfsBackend) Limits(context.Context, string, map[string]string) (sizeLimits, bool, error) {
+	return vfsSizeLimits, true, nil
+}
+
+// PublishContext returns the mount tag and state of the attachment of the VFS volume to the node
+func (v *vfsBackend) PublishContext(vol *backendVolume, nodeID string) map[string]string {
+	a, ok := vol.Attachments[nodeID]
+	if !ok {
+		return nil
+	}
+
+	return vfsPublishInfo{MountTag: a.MountID, State: a.State}.publishContext()
+}
+
+// vfsPublishInfo is what the node mounts a VFS volume attached to it with
+type vfsPublishInfo struct {
+	MountTag string
+	State    string
+}
+
+func (i vfsPublishInfo) publishContext() map[string]string {
+	return map[string]string{
+		publishContextMountTag:        i.MountTag,
+		publishContextAttachmentState: i.State,
+	}
+}
+
+// vfsPublishInfoFrom reads the attachment of a VFS volume from the publish context,
+// reporting false when there is none. Controllers which predate the attachment keys only
+// passed the mount tag under mountIDKey, which is taken as an attachment in place.
+func vfsPublishInfoFrom(publishContext map[string]string, mountIDKey string) (vfsPublishInfo, bool, error) {
+	info := vfsPublishInfo{
+		MountTag: publishContext[publishContextMountTag],
+		State:    publishContext[publishContextAttachmentState],
+	}
+
+	if info.MountTag == "" {
+		tag, ok := publishContext[mountIDKey]
+		if !ok {
+			return vfsPublishInfo{}, false, nil
+		}
+		info = vfsPublishInfo{MountTag: tag, State: vfsAttachmentAttached}
+	}
+
+	if info.MountTag == "" {
+		return vfsPublishInfo{}, false, errors.New("the attachment has no mount tag")
+	}
+
+	if info.State != vfsAttachmentAttached {
+		return vfsPublishInfo{}, false, fmt.Errorf("the attachment with mount tag %s is %q", info.MountTag, info.State)
+	}
+
+	return info, true, nil
+}
+
+func vfsToBackendVolume(vfs *vfsStorage, attachments []vfsAttachment) *backendVolume {
+	vol := &backendVolume{
+		ID:          vfs.ID,
+		Label:       vfs.Label,
+		StorageType: storageTypeVFS,
+		SizeBytes:   int64(vfs.StorageSize.SizeGB) * giB,
+		Status:      vfs.Status,
+		Region:      vfs.Region,
+	}
+
+	for _, a := range attachments {
+		state := strings.ToLower(a.State)
+		if state == vfsAttachmentAttached {
+			vol.AttachedTo = append(vol.AttachedTo, a.TargetID)
+		}
+
+		if vol.Attachments == nil {
+			vol.Attachments = make(map[string]volumeAttachment)
+		}
+		vol.Attachments[a.TargetID] = volumeAttachment{MountID: string(a.MountTag), State: state}
+	}
+
+	return vol
+}
+
+// splitTags returns the non empty comma separated tags
+func splitTags(tags string) []string {
+	var split []string
+	for _, t := range strings.Split(tags, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			split = append(split, t)
+		}
+	}
+	return split
+}
+
+// checkVFSEnabled returns a FailedPrecondition error for rpc on a vfs volume while vfs is
+// disabled, which would otherwise fail further on with an error naming none of it
+func (d *VultrDriver) checkVFSEnabled(rpc, volumeID string, volCtx map[string]string) error {
+	if d.vfsDisabled && volCtx[volumeContextStorageType] == storageTypeVFS {
+		return status.Errorf(codes.FailedPrecondition, "%s volume %s is a vfs volume but vfs is disabled in this deployment", rpc, volumeID)
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+)
+
+func newFakeVFSControllerServer(testName string) (*VultrControllerServer, *fakeVFS) {
+	vfs := newFakeVFS()
+	d := &VultrDriver{
+		client:          newFakeClient(),
+		vfs:             vfs,
+		isController:    true,
+		log:             logrus.New().WithField("test", testName),
+		region:          "ewr",
+		publishVolumeID: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		attachTimeout:   DefaultAttachTimeout,
+		detachTimeout:   DefaultDetachTimeout,
+	}
+
+	return NewVultrControllerServer(d), vfs
+}
+
+func TestCreateVFSVolume(t *testing.T) {
+	controller, vfs := newFakeVFSControllerServer("create vfs volume")
+
+	res, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "vfs-test-name",
+		Parameters:    map[string]string{"storage_type": "vfs", "tags": "team-a, ci"},
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 5 * giB},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := &vfsCreate{
+		Region:      "ewr",
+		Label:       "vfs-test-name",
+		StorageSize: vfsSize{SizeGB: 10},
+		DiskType:    vfsDiskTypeNvme,
+		Tags:        []string{"team-a", "ci"},
+	}
+	if len(vfs.created) != 1 || !reflect.DeepEqual(vfs.created[0], expected) {
+		t.Errorf("expected %+v to be created, got %+v", expected, vfs.created)
+	}
+
+	if res.Volume.CapacityBytes != vfsMinVolumeSizeInBytes {
+		t.Errorf("expected the vfs minimum size, got %d", res.Volume.CapacityBytes)
+	}
+
+	if _, ok := res.Volume.VolumeContext[volumeContextFsType]; ok || res.Volume.VolumeContext[volumeContextStorageType] != storageTypeVFS {
+		t.Errorf("expected a vfs volume context without a filesystem, got %v", res.Volume.VolumeContext)
+	}
+}
+
+func TestPublishVFSVolume(t *testing.T) {
+	controller, vfs := newFakeVFSControllerServer("publish vfs volume")
+	vol, _ := vfs.Create(context.Background(), &vfsCreate{Region: "ewr", Label: "shared", StorageSize: vfsSize{SizeGB: 10}})
+
+	res, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: vol.ID,
+		NodeId:   "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if tag := res.PublishContext[controller.Driver.publishVolumeID]; tag != "1" {
+		t.Errorf("expected the attachment mount tag to be published, got %q", tag)
+	}
+
+	if attachment, ok, err := vfsPublishInfoFrom(res.PublishContext, "unused"); !ok || err != nil ||
+		attachment != (vfsPublishInfo{MountTag: "1", State: vfsAttachmentAttached}) {
+		t.Errorf("expected the attachment to be published, got %+v, %v, %v", attachment, ok, err)
+	}
+
+	expand, err := controller.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      vol.ID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * giB},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if expand.NodeExpansionRequired || expand.CapacityBytes != 20*giB {
+		t.Errorf("expected a 20GB expansion without node expansion, got %+v", expand)
+	}
+}
+
+func TestPublishVFSVolumeMultiNode(t *testing.T) {
+	controller, vfs := newFakeVFSControllerServer("publish vfs volume to several nodes")
+	vol, _ := vfs.Create(context.Background(), &vfsCreate{Region: "ewr", Label: "shared", StorageSize: vfsSize{SizeGB: 10}})
+
+	publish := func(nodeID string, mode csi.VolumeCapability_AccessMode_Mode) (*csi.ControllerPublishVolumeResponse, error) {
+		return controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+			VolumeId: vol.ID,
+			NodeId:   nodeID,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			},
+			VolumeContext: map[string]string{volumeContextStorageType: storageTypeVFS},
+		})
+	}
+
+	if _, err := publish("node-a", csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	res, err := publish("node-b", csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)
+	if err != nil {
+		t.Fatalf("expected the volume to be shared with a second node, got %v", err)
+	}
+
+	if tag := res.PublishContext[controller.Driver.publishVolumeID]; tag != "2" {
+		t.Errorf("expected the second attachment mount tag to be published, got %q", tag)
+	}
+
+	// a publish to another node still in progress does not abort this one, but holds off
+	// the operations on the whole volume
+	unlock, err := controller.locks.acquireAttachment(vol.ID, "node-d")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := publish("node-b", csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER); err != nil {
+		t.Errorf("expected a publish beside the one to another node, got %v", err)
+	}
+	if _, err := publish("node-c", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER); status.Code(err) != codes.Aborted {
+		t.Errorf("expected a single node publish beside the one to another node to fail with Aborted, got %v", err)
+	}
+	unlock()
+
+	if _, err := publish("node-c", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected a single node volume attached elsewhere to fail with FailedPrecondition, got %v", err)
+	}
+
+	if _, err := controller.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: vol.ID,
+		NodeId:   "node-c",
+	}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	attachments, _ := vfs.ListAttachments(context.Background(), vol.ID)
+	if len(attachments) != 2 {
+		t.Errorf("expected unpublishing a node without the volume to keep the other attachments, got %+v", attachments)
+	}
+}
+
+func TestMultiNodeCapability(t *testing.T) {
+	caps := func(mode csi.VolumeCapability_AccessMode_Mode) []*csi.VolumeCapability {
+		return []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			},
+		}
+	}
+
+	tests := []struct {
+		storageType string
+		mode        csi.VolumeCapability_AccessMode_Mode
+		valid       bool
+	}{
+		{storageTypeVFS, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, true},
+		{storageTypeVFS, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, true},
+		{storageTypeVFS, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, true},
+		{storageTypeVFS, csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER, false},
+		{storageTypeBlock, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, true},
+		{storageTypeBlock, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, false},
+		{storageTypeBlock, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, false},
+	}
+
+	for _, tt := range tests {
+		if valid := isValidCapability(caps(tt.mode), tt.storageType); valid != tt.valid {
+			t.Errorf("%s %s: expected valid %v, got %v", tt.storageType, tt.mode, tt.valid, valid)
+		}
+	}
+}
+
+func TestVFSMountTag(t *testing.T) {
+	var a vfsAttachment
+	if err := json.Unmarshal([]byte(`{"state":"ATTACHED","target_id":"node","mount_tag":7}`), &a); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if a.MountTag != "7" {
+		t.Errorf("expected mount tag 7, got %q", a.MountTag)
+	}
+}
+
+func TestVFSPublishInfoFrom(t *testing.T) {
+	tests := []struct {
+		name           string
+		publishContext map[string]string
+		expected       vfsPublishInfo
+		ok             bool
+		wantErr        bool
+	}{
+		{"attached", map[string]string{"mount_tag": "3", "attachment_state": "attached"},
+			vfsPublishInfo{MountTag: "3", State: vfsAttachmentAttached}, true, false},
+		{"older controller", map[string]string{"volume-id": "3"}, vfsPublishInfo{MountTag: "3", State: vfsAttachmentAttached}, true, false},
+		{"not published", nil, vfsPublishInfo{}, false, false},
+		{"pending", map[string]string{"mount_tag": "3", "attachment_state": "pending"}, vfsPublishInfo{}, false, true},
+		{"no mount tag", map[string]string{"volume-id": ""}, vfsPublishInfo{}, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attachment, ok, err := vfsPublishInfoFrom(tt.publishContext, "volume-id")
+			if attachment != tt.expected || ok != tt.ok || (err != nil) != tt.wantErr {
+				t.Errorf("expected %+v, %v, error %v, got %+v, %v, %v", tt.expected, tt.ok, tt.wantErr, attachment, ok, err)
+			}
+		})
+	}
+}
+
+func TestNodeAttachVFSVolume(t *testing.T) {
+	vfs := newFakeVFS()
+	vol, _ := vfs.Create(context.Background(), &vfsCreate{Region: "ewr", Label: "shared", StorageSize: vfsSize{SizeGB: 10}})
+
+	mounter := mount.NewFakeMounter(nil)
+	node := NewVultrNodeDriver(&VultrDriver{
+		client:        newFakeClient(),
+		vfs:           vfs,
+		isController:  true,
+		nodeID:        "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088",
+		nodeAttachVFS: true,
+		attachTimeout: DefaultAttachTimeout,
+		targetDirMode: mkDirMode,
+		log:           logrus.New().WithField("test", "node attach vfs volume"),
+		mounter:       &mount.SafeFormatAndMount{Interface: mounter},
+	})
+
+	staging := filepath.Join(t.TempDir(), "staging")
+	_, err := node.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          vol.ID,
+		StagingTargetPath: staging,
+		VolumeContext: map[string]string{
+			volumeContextStorageType:     storageTypeVFS,
+			volumeContextVFSMountOptions: "dax=always,ro",
+		},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"rw", "noatime"}}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if len(mounter.MountPoints) != 1 || mounter.MountPoints[0].Device != "1" || mounter.MountPoints[0].Type != fsTypeVirtiofs {
+		t.Errorf("expected the node's attachment to be mounted over virtiofs, got %+v", mounter.MountPoints)
+	}
+	// ro wins over the rw flag of the capability
+	if opts := mounter.MountPoints[0].Opts; !reflect.DeepEqual(opts, []string{"dax=always", "ro", "noatime"}) {
+		t.Errorf("expected the StorageClass options then the capability flags, got %v", opts)
+	}
+
+	if _, err := node.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          vol.ID,
+		StagingTargetPath: staging,
+	}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if attachments, _ := vfs.ListAttachments(context.Background(), vol.ID); len(attachments) != 0 {
+		t.Errorf("expected the node to detach the volume at unstage, got %+v", attachments)
+	}
+}
+
+func TestVFSDisabled(t *testing.T) {
+	controller := NewFakeVultrControllerServer("vfs disabled")
+	controller.Driver.vfs, controller.Driver.vfsDisabled = nil, true
+	controller = NewVultrControllerServer(controller.Driver)
+
+	mountCapability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	volCtx := map[string]string{volumeContextStorageType: storageTypeVFS}
+
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vfs-test-name",
+		Parameters:         map[string]string{"storage_type": "vfs"},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability},
+	})
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "disabled") {
+		t.Errorf("expected InvalidArgument naming vfs disabled, got %v", err)
+	}
+
+	_, err = controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		NodeId:           "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088",
+		VolumeCapability: mountCapability,
+		VolumeContext:    volCtx,
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition publishing a vfs volume, got %v", err)
+	}
+
+	node := newFakeMountNode(&fakeExec{})
+	node.Driver.vfsDisabled = true
+	_, err = node.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vfs",
+		StagingTargetPath: t.TempDir(),
+		VolumeCapability:  mountCapability,
+		VolumeContext:     volCtx,
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition staging a vfs volume, got %v", err)
+	}
+}
+
+// slowAttachmentsVFS lists attachments slowly, recording how many listings ran at once
+type slowAttachmentsVFS struct {
+	*fakeVFS
+
+	mu       sync.Mutex
+	inFlight int
+	most     int
+}
+
+func (s *slowAttachmentsVFS) ListAttachments(ctx context.Context, vfsID string) ([]vfsAttachment, error) {
+	s.mu.Lock()
+	s.inFlight++
+	s.most = max(s.most, s.inFlight)
+	s.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	s.mu.Lock()
+	s.inFlight--
+	s.mu.Unlock()
+	return s.fakeVFS.ListAttachments(ctx, vfsID)
+}
+
+func TestListVFSVolumes(t *testing.T) {
+	controller, vfs := newFakeVFSControllerServer("list vfs volumes")
+	slow := &slowAttachmentsVFS{fakeVFS: vfs}
+	controller.Driver.vfs = slow
+
+	for i := 0; i < 3*vfsAttachmentListers; i++ {
+		id := fmt.Sprintf("vfs-%d", i)
+		vfs.volumes[id] = &vfsStorage{ID: id, Region: "ewr", Status: "active", Label: id}
+		if _, err := vfs.Attach(context.Background(), id, fmt.Sprintf("node-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := controller.backends.backends[storageTypeVFS].List(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, vol := range list {
+		if !vol.isAttachedTo("node-" + strings.TrimPrefix(vol.ID, "vfs-")) {
+			t.Errorf("expected volume %s listed with its attachment, got %v", vol.ID, vol.AttachedTo)
+		}
+	}
+	if len(list) != 3*vfsAttachmentListers {
+		t.Errorf("expected %d volumes, got %d", 3*vfsAttachmentListers, len(list))
+	}
+
+	if slow.most < 2 || slow.most > vfsAttachmentListers {
+		t.Errorf("expected the attachments listed concurrently, at most %d at once, got %d", vfsAttachmentListers, slow.most)
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultAPIBreakerThreshold is how many Vultr API requests in a row fail with a 5xx
+	// or no response before the circuit breaker opens
+	DefaultAPIBreakerThreshold = 5
+	// DefaultAPIBreakerOpenTimeout is how long the circuit breaker first stays open
+	DefaultAPIBreakerOpenTimeout = 10 * time.Second
+	// DefaultAPIBreakerMaxOpenTimeout bounds how long the circuit breaker stays open as
+	// it keeps tripping
+	DefaultAPIBreakerMaxOpenTimeout = 5 * time.Minute
+)
+
+var (
+	apiCircuitOpen = metrics.newGauge("api_circuit_open",
+		"Whether the circuit breaker around the Vultr API is open")
+	apiCircuitTripsTotal = metrics.newCounter("api_circuit_trips_total",
+		"Number of times the circuit breaker around the Vultr API opened")
+)
+
+// apiCircuitBreaker fails controller RPCs fast with Unavailable once the Vultr API keeps
+// failing, beyond the retries of govultr. It opens after threshold requests in a row fail
+// with a 5xx or no response, and after a jittered timeout doubling each time it reopens
+// half-opens to let a single RPC probe the API. A probe reaching the API closes it, while
+// a failing one opens it again. The background loops of the driver are not held off and
+// close it as well once they get an answer.
+type apiCircuitBreaker struct {
+	threshold  int
+	openFor    time.Duration
+	maxOpenFor time.Duration
+	log        *logrus.Entry
+	now        func() time.Time
+	// jitter spreads the open timeouts of the controllers of several clusters
+	jitter func(time.Duration) time.Duration
+
+	mu       sync.Mutex
+	failures int
+	// trips counts the openings since the breaker was last closed
+	trips int
+	// openUntil is when the breaker half-opens, zero while closed
+	openUntil time.Time
+	// probeSince is when the RPC probing the half-open breaker was let through, zero without one
+	probeSince time.Time
+}
+
+// newAPICircuitBreaker returns a breaker opening after threshold failed requests in a
+// row, for openFor at first and at most maxOpenFor. A threshold of 0 disables it.
+func newAPICircuitBreaker(threshold int, openFor, maxOpenFor time.Duration, log *logrus.Entry) *apiCircuitBreaker {
+	return &apiCircuitBreaker{
+		threshold:  threshold,
+		openFor:    openFor,
+		maxOpenFor: maxOpenFor,
+		log:        log,
+		now:        time.Now,
+		jitter:     equalJitter,
+	}
+}
+
+// equalJitter returns a random duration between half of d and d
+func equalJitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1)) //nolint:gosec // no need for a secure source
+}
+
+// transport returns an http.RoundTripper reporting the outcome of each request, retries
+// included, to the breaker
+func (b *apiCircuitBreaker) transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &breakerTransport{next: next, breaker: b}
+}
+
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *apiCircuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	// a request abandoned by its caller tells nothing about the API
+	if err == nil || !errors.Is(err, context.Canceled) {
+		t.breaker.observe(resp, err)
+	}
+	return resp, err
+}
+
+// observe counts a request failing with a 5xx or no response, opening the breaker at the
+// threshold or when it was probing, and closes the breaker on any other response
+func (b *apiCircuitBreaker) observe(resp *http.Response, err error) {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if err == nil && resp.StatusCode < http.StatusInternalServerError {
+		if !b.openUntil.IsZero() {
+			b.log.WithField("trips", b.trips).Info("Vultr API answers again, closing the circuit breaker")
+			apiCircuitOpen.set(0)
+		}
+		b.failures, b.trips = 0, 0
+		b.openUntil, b.probeSince = time.Time{}, time.Time{}
+		return
+	}
+
+	b.failures++
+	switch {
+	case b.openUntil.IsZero() && b.failures >= b.threshold:
+	case !b.openUntil.IsZero() && !now.Before(b.openUntil):
+	default:
+		return
+	}
+
+	b.trips++
+	delay := b.openFor
+	for i := 1; i < b.trips && delay < b.maxOpenFor; i++ {
+		delay *= 2
+	}
+	if delay > b.maxOpenFor {
+		delay = b.maxOpenFor
+	}
+	delay = b.jitter(delay)
+
+	b.openUntil = now.Add(delay)
+	b.probeSince = time.Time{}
+	apiCircuitOpen.set(1)
+	apiCircuitTripsTotal.add(1)
+
+	fields := logrus.Fields{"failures": b.failures, "open_for": delay.String()}
+	if err != nil {
+		fields["error"] = err.Error()
+	} else {
+		fields["status"] = resp.StatusCode
+	}
+	b.log.WithFields(fields).Warn("Vultr API keeps failing, opening the circuit breaker")
+}
+
+// check returns a retryable Unavailable error for rpc while the breaker is open, and
+// while it is half-open but for the one RPC let through to probe the API
+func (b *apiCircuitBreaker) check(rpc string) error {
+	if b == nil || b.threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return nil
+	}
+
+	now := b.now()
+	if now.Before(b.openUntil) {
+		return status.Errorf(codes.Unavailable, "%s: Vultr API keeps failing, retry after %s",
+			rpc, b.openUntil.UTC().Format(time.RFC3339))
+	}
+
+	// a probe which never got an answer, as when its RPC failed before calling the API,
+	// gives way to another once the open timeout passed
+	if !b.probeSince.IsZero() && now.Sub(b.probeSince) < b.openFor {
+		return status.Errorf(codes.Unavailable, "%s: Vultr API keeps failing, probing whether it recovered", rpc)
+	}
+	b.probeSince = now
+	return nil
+}
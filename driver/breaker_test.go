@@ -0,0 +1,131 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAPICircuitBreaker(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newAPICircuitBreaker(3, 10*time.Second, 25*time.Second, logrus.NewEntry(logrus.New()))
+	b.now = func() time.Time { return now }
+	b.jitter = func(d time.Duration) time.Duration { return d }
+
+	failed := &http.Response{StatusCode: http.StatusBadGateway}
+	ok := &http.Response{StatusCode: http.StatusNotFound}
+
+	b.observe(failed, nil)
+	b.observe(nil, errors.New("connection reset"))
+	b.observe(ok, nil)
+	b.observe(failed, nil)
+	b.observe(failed, nil)
+	if err := b.check("CreateVolume"); err != nil {
+		t.Fatalf("expected an answer to reset the run of failures, got %v", err)
+	}
+
+	b.observe(failed, nil)
+	if err := b.check("CreateVolume"); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected Unavailable once the breaker opened, got %v", err)
+	}
+
+	for i, expected := range []time.Duration{20 * time.Second, 25 * time.Second} {
+		now = b.openUntil
+		if err := b.check("CreateVolume"); err != nil {
+			t.Fatalf("expected the half-open breaker to let a probe through, got %v", err)
+		}
+		if err := b.check("DeleteVolume"); status.Code(err) != codes.Unavailable {
+			t.Fatalf("expected Unavailable besides the probe, got %v", err)
+		}
+
+		b.observe(failed, nil)
+		if open := b.openUntil.Sub(now); open != expected {
+			t.Errorf("expected the failed probe %d to reopen the breaker for %v, got %v", i, expected, open)
+		}
+	}
+
+	now = b.openUntil.Add(-time.Second)
+	b.observe(ok, nil)
+	if err := b.check("CreateVolume"); err != nil {
+		t.Errorf("expected an answer to close the breaker, got %v", err)
+	}
+
+	b.observe(failed, nil)
+	if err := b.check("CreateVolume"); err != nil {
+		t.Errorf("expected a closed breaker to wait for the threshold again, got %v", err)
+	}
+}
+
+func TestAPICircuitBreakerStaleProbe(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newAPICircuitBreaker(1, 10*time.Second, time.Minute, logrus.NewEntry(logrus.New()))
+	b.now = func() time.Time { return now }
+	b.jitter = func(d time.Duration) time.Duration { return d }
+
+	b.observe(nil, errors.New("connection refused"))
+	now = b.openUntil
+	if err := b.check("CreateVolume"); err != nil {
+		t.Fatalf("expected a probe to be let through, got %v", err)
+	}
+
+	now = now.Add(10 * time.Second)
+	if err := b.check("CreateVolume"); err != nil {
+		t.Errorf("expected a probe which never got an answer to give way to another, got %v", err)
+	}
+}
+
+func TestAPICircuitBreakerDisabled(t *testing.T) {
+	b := newAPICircuitBreaker(0, 0, 0, logrus.NewEntry(logrus.New()))
+	for i := 0; i < 10; i++ {
+		b.observe(&http.Response{StatusCode: http.StatusServiceUnavailable}, nil)
+	}
+	if err := b.check("CreateVolume"); err != nil {
+		t.Errorf("expected a disabled breaker never to open, got %v", err)
+	}
+
+	var nilBreaker *apiCircuitBreaker
+	if err := nilBreaker.check("CreateVolume"); err != nil {
+		t.Errorf("expected no breaker to let every RPC through, got %v", err)
+	}
+}
+
+func TestAPICircuitBreakerTransport(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	b := newAPICircuitBreaker(2, time.Minute, time.Minute, logrus.NewEntry(logrus.New()))
+	client := &http.Client{Transport: b.transport(nil)}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if err := b.check("CreateVolume"); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected the 5xx responses to open the breaker, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, http.NoBody)
+	c := newAPICircuitBreaker(1, time.Minute, time.Minute, logrus.NewEntry(logrus.New()))
+	if _, err := c.transport(nil).RoundTrip(req); err == nil {
+		t.Fatal("expected the canceled request to fail")
+	}
+	if err := c.check("CreateVolume"); err != nil {
+		t.Errorf("expected a request canceled by its caller not to count as a failure, got %v", err)
+	}
+}
@@ -0,0 +1,321 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vultr/metadata"
+	"k8s.io/utils/exec"
+)
+
+// Results of a node check
+const (
+	NodeCheckPass = "pass"
+	// NodeCheckWarn is a check which found something that only some volumes need missing,
+	// or which passed only after a retry
+	NodeCheckWarn = "warn"
+	NodeCheckFail = "fail"
+)
+
+// NodeCheckOptions tells CheckNode where the node plugin finds its environment
+type NodeCheckOptions struct {
+	// KubeletDir is the root directory of kubelet, holding the staging paths
+	KubeletDir string
+
+	// MetadataURL is the base URL of the Vultr instance metadata service, the link local
+	// address when empty
+	MetadataURL string
+}
+
+// NodeCheck is a check of the environment of the node and its result
+type NodeCheck struct {
+	Name   string `json:"name"`
+	Result string `json:"result"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// nodeTool is a binary the node plugin runs, with the volumes which need it when the
+// others do not
+type nodeTool struct {
+	name      string
+	neededFor string
+}
+
+// nodeTools are the binaries the node plugin runs itself or through mount-utils
+var nodeTools = []nodeTool{
+	{name: "mount"},
+	{name: "umount"},
+	{name: "blkid"},
+	{name: "blockdev"},
+	{name: "udevadm"},
+	{name: "mkfs.ext4"},
+	{name: "resize2fs"},
+	{name: "dumpe2fs"},
+	{name: "tune2fs"},
+	{name: "e2fsck"},
+	{name: "mkfs.ext3", neededFor: "ext3 volumes"},
+	{name: "mkfs.xfs", neededFor: "xfs volumes"},
+	{name: "xfs_growfs", neededFor: "expanding xfs volumes"},
+	{name: "xfs_io", neededFor: "expanding xfs volumes"},
+	{name: "xfs_repair", neededFor: "checking xfs volumes"},
+	{name: "mkfs.btrfs", neededFor: "btrfs volumes"},
+	{name: "btrfs", neededFor: "expanding btrfs volumes"},
+	{name: "cryptsetup", neededFor: "encrypted volumes"},
+	{name: "fstrim", neededFor: "trimming expanded discard volumes"},
+	{name: "wipefs", neededFor: "wiping partitioned volumes"},
+}
+
+// CheckNode checks that the node can stage volumes, for the check-node command to report
+// in support tickets. It checks that udev links the disks by serial, that the binaries
+// the node plugin runs are installed, that the staging paths are writable and that the
+// instance metadata service answers. Only Linux nodes can be checked.
+func CheckNode(ctx context.Context, opts NodeCheckOptions) ([]NodeCheck, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("only Linux nodes can be checked, not %s", runtime.GOOS)
+	}
+
+	log := logrus.New()
+	log.SetOutput(os.Stderr)
+	return checkNode(ctx, opts, exec.New(), logrus.NewEntry(log)), nil
+}
+
+func checkNode(ctx context.Context, opts NodeCheckOptions, ex exec.Interface, log *logrus.Entry) []NodeCheck {
+	node := NewVultrNodeDriver(&VultrDriver{log: log, exec: ex})
+
+	return []NodeCheck{
+		checkDiskByID(),
+		node.checkDeviceLinks(ctx),
+		checkNodeTools(ex),
+		checkStagingDir(opts.KubeletDir),
+		checkMetadataService(opts.MetadataURL),
+	}
+}
+
+func checkDiskByID() NodeCheck {
+	check := NodeCheck{Name: "disk-by-id", Result: NodeCheckFail}
+
+	entries, err := os.ReadDir(diskPath)
+	if err != nil {
+		check.Detail = fmt.Sprintf("cannot list %s, the node plugin needs /dev of the host: %v", diskPath, err)
+		return check
+	}
+
+	var links int
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), diskPrefix) {
+			links++
+		}
+	}
+	check.Result = NodeCheckPass
+	check.Detail = fmt.Sprintf("%s lists %d virtio disks", diskPath, links)
+	return check
+}
+
+// checkDeviceLinks checks that udev linked each disk with a serial by it, as staging
+// looks for the device of a volume by that link, and that no link is left to a disk with
+// another serial. The disks are rescanned when a link is missing, as staging does.
+func (n *VultrNodeServer) checkDeviceLinks(ctx context.Context) NodeCheck {
+	check := NodeCheck{Name: "device-links", Result: NodeCheckFail}
+
+	disks, problems, err := deviceLinkProblems()
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+
+	rescanned := false
+	if len(problems) > 0 {
+		n.host.rescanDevices(ctx)
+		rescanned = true
+		if disks, problems, err = deviceLinkProblems(); err != nil {
+			check.Detail = err.Error()
+			return check
+		}
+	}
+
+	switch {
+	case len(problems) > 0:
+		check.Detail = strings.Join(problems, "; ")
+	case rescanned:
+		check.Result = NodeCheckWarn
+		check.Detail = fmt.Sprintf("%d disks linked by serial only after udev rescanned them", disks)
+	default:
+		check.Result = NodeCheckPass
+		check.Detail = fmt.Sprintf("%d disks linked by serial", disks)
+	}
+	return check
+}
+
+// deviceLinkProblems returns the number of disks with a serial, and the disks missing their
+// link or linked by another serial
+func deviceLinkProblems() (int, []string, error) {
+	entries, err := os.ReadDir(sysBlockPath)
+	if err != nil {
+		return 0, nil, fmt.Errorf("cannot list block devices: %w", err)
+	}
+
+	var (
+		disks    int
+		problems []string
+	)
+	for _, e := range entries {
+		serial, err := os.ReadFile(filepath.Join(sysBlockPath, e.Name(), "serial"))
+		if err != nil {
+			continue
+		}
+		s := strings.TrimSpace(string(serial))
+		if s == "" {
+			continue
+		}
+		disks++
+
+		link := filepath.Join(diskPath, diskPrefix+s)
+		if !sameFile(link, filepath.Join(devPath, e.Name())) {
+			problems = append(problems, fmt.Sprintf("%s with serial %s is not linked by %s", e.Name(), s, link))
+		}
+	}
+
+	links, err := os.ReadDir(diskPath)
+	if err != nil {
+		return disks, append(problems, fmt.Sprintf("cannot list %s: %v", diskPath, err)), nil
+	}
+	for _, l := range links {
+		// udev links the partitions of a disk after it too
+		id, ok := strings.CutPrefix(l.Name(), diskPrefix)
+		if !ok || strings.Contains(id, "-part") {
+			continue
+		}
+
+		device, err := filepath.EvalSymlinks(filepath.Join(diskPath, l.Name()))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s is a dangling link", l.Name()))
+			continue
+		}
+		serial, err := os.ReadFile(filepath.Join(sysBlockPath, filepath.Base(device), "serial"))
+		if err != nil {
+			continue
+		}
+		if s := strings.TrimSpace(string(serial)); s != "" && !serialMatches(s, id) {
+			problems = append(problems, fmt.Sprintf("%s links %s with serial %s", l.Name(), filepath.Base(device), s))
+		}
+	}
+
+	return disks, problems, nil
+}
+
+// sameFile reports whether both paths resolve to the same file
+func sameFile(a, b string) bool {
+	ra, err := filepath.EvalSymlinks(a)
+	if err != nil {
+		return false
+	}
+	rb, err := filepath.EvalSymlinks(b)
+	return err == nil && ra == rb
+}
+
+func checkNodeTools(ex exec.Interface) NodeCheck {
+	var missing, optional []string
+	for _, tool := range nodeTools {
+		if _, err := ex.LookPath(tool.name); err == nil {
+			continue
+		}
+		if tool.neededFor == "" {
+			missing = append(missing, tool.name)
+		} else {
+			optional = append(optional, fmt.Sprintf("%s (%s)", tool.name, tool.neededFor))
+		}
+	}
+
+	switch {
+	case len(missing) > 0:
+		return NodeCheck{Name: "binaries", Result: NodeCheckFail, Detail: "missing " + strings.Join(append(missing, optional...), ", ")}
+	case len(optional) > 0:
+		return NodeCheck{Name: "binaries", Result: NodeCheckWarn, Detail: "missing " + strings.Join(optional, ", ")}
+	}
+	return NodeCheck{Name: "binaries", Result: NodeCheckPass, Detail: fmt.Sprintf("all %d found", len(nodeTools))}
+}
+
+// checkStagingDir checks that the directory kubelet stages CSI volumes under is writable,
+// or the closest of its parents when kubelet did not create it yet
+func checkStagingDir(kubeletDir string) NodeCheck {
+	check := NodeCheck{Name: "staging-dir", Result: NodeCheckFail}
+
+	kubeletDir = filepath.Clean(kubeletDir)
+	csiDir := filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi")
+	dir := csiDir
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		} else if !errors.Is(err, os.ErrNotExist) {
+			check.Detail = fmt.Sprintf("cannot check %s: %v", dir, err)
+			return check
+		}
+		if dir == kubeletDir {
+			check.Detail = fmt.Sprintf("%s does not exist, is the kubelet directory mounted from the host?", kubeletDir)
+			return check
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	probe, err := os.MkdirTemp(dir, ".vultr-csi-check-")
+	if err != nil {
+		check.Detail = fmt.Sprintf("%s is not writable: %v", dir, err)
+		return check
+	}
+	if err := os.Remove(probe); err != nil {
+		check.Detail = fmt.Sprintf("cannot remove %s: %v", probe, err)
+		return check
+	}
+
+	check.Result = NodeCheckPass
+	check.Detail = dir + " is writable"
+	if dir != csiDir {
+		check.Detail += ", kubelet did not create " + csiDir + " yet"
+	}
+	return check
+}
+
+func checkMetadataService(metadataURL string) NodeCheck {
+	check := NodeCheck{Name: "metadata-service", Result: NodeCheckFail}
+
+	c := metadata.NewClient()
+	if metadataURL != "" {
+		if err := c.SetBaseURL(metadataURL); err != nil {
+			check.Detail = fmt.Sprintf("invalid metadata URL %q: %v", metadataURL, err)
+			return check
+		}
+	}
+
+	meta, err := c.Metadata()
+	if err != nil {
+		check.Detail = fmt.Sprintf("cannot get instance metadata, set the node ID and region to run without it: %v", err)
+		return check
+	}
+	if meta.InstanceV2ID == "" || meta.Region.RegionCode == "" {
+		check.Detail = "instance metadata holds no instance ID or region"
+		return check
+	}
+
+	check.Result = NodeCheckPass
+	check.Detail = fmt.Sprintf("instance %s in %s", meta.InstanceV2ID, meta.Region.RegionCode)
+	return check
+}
@@ -0,0 +1,124 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// missingToolsExec is fakeExec without some binaries installed
+type missingToolsExec struct {
+	*fakeExec
+	missing map[string]bool
+}
+
+func (e *missingToolsExec) LookPath(file string) (string, error) {
+	if e.missing[file] {
+		return "", errors.New("executable file not found in $PATH")
+	}
+	return e.fakeExec.LookPath(file)
+}
+
+func TestCheckNode(t *testing.T) {
+	dir := t.TempDir()
+	defer func(d, s, v string) { diskPath, sysBlockPath, devPath = d, s, v }(diskPath, sysBlockPath, devPath)
+	diskPath, sysBlockPath, devPath = filepath.Join(dir, "by-id"), filepath.Join(dir, "sys"), filepath.Join(dir, "dev")
+
+	for _, path := range []string{diskPath, devPath} {
+		if err := os.MkdirAll(path, mkDirMode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addDisk := func(name, serial string, linked bool) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(sysBlockPath, name), mkDirMode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(sysBlockPath, name, "serial"), []byte(serial+"\n"), mkFileMode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(devPath, name), nil, mkFileMode); err != nil {
+			t.Fatal(err)
+		}
+		if linked {
+			if err := os.Symlink(filepath.Join(devPath, name), filepath.Join(diskPath, diskPrefix+serial)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	addDisk("vda", "", false)
+	addDisk("vdb", "c56c7b6e15c2445e9a5d", true)
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"instance-v2-id":"245bb2fe-b55c-44a0-9a1e-ab80e4b5f088","region":{"regioncode":"EWR"}}`)) //nolint:errcheck
+	}))
+	defer api.Close()
+
+	kubeletDir := filepath.Join(dir, "kubelet")
+	if err := os.MkdirAll(kubeletDir, mkDirMode); err != nil {
+		t.Fatal(err)
+	}
+
+	ex := &missingToolsExec{fakeExec: &fakeExec{}, missing: map[string]bool{}}
+	run := func(opts NodeCheckOptions) map[string]NodeCheck {
+		t.Helper()
+		checks := map[string]NodeCheck{}
+		for _, check := range checkNode(context.Background(), opts, ex, logrus.NewEntry(logrus.New())) {
+			checks[check.Name] = check
+		}
+		return checks
+	}
+
+	checks := run(NodeCheckOptions{KubeletDir: kubeletDir, MetadataURL: api.URL})
+	for name, check := range checks {
+		if check.Result != NodeCheckPass {
+			t.Errorf("expected %s to pass, got %+v", name, check)
+		}
+	}
+	if detail := checks["staging-dir"].Detail; !strings.HasPrefix(detail, kubeletDir+" is writable") {
+		t.Errorf("expected the kubelet directory to be probed before kubelet creates the csi directory, got %q", detail)
+	}
+	if detail := checks["metadata-service"].Detail; !strings.Contains(detail, "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088") {
+		t.Errorf("expected the instance in the metadata detail, got %q", detail)
+	}
+
+	// a disk udev did not link, and a link left to a disk with another serial
+	addDisk("vdc", "2f6a8e31b0d74c0a9c1e", false)
+	if err := os.Symlink(filepath.Join(devPath, "vdb"), filepath.Join(diskPath, diskPrefix+"0d9e1c5a3b2f4e6a8c7d")); err != nil {
+		t.Fatal(err)
+	}
+	ex.missing["mkfs.xfs"] = true
+	api.Close()
+
+	checks = run(NodeCheckOptions{KubeletDir: filepath.Join(dir, "missing"), MetadataURL: api.URL})
+	expected := map[string]string{
+		"disk-by-id":       NodeCheckPass,
+		"device-links":     NodeCheckFail,
+		"binaries":         NodeCheckWarn,
+		"staging-dir":      NodeCheckFail,
+		"metadata-service": NodeCheckFail,
+	}
+	for name, result := range expected {
+		if checks[name].Result != result {
+			t.Errorf("expected %s to %s, got %+v", name, result, checks[name])
+		}
+	}
+	if detail := checks["device-links"].Detail; !strings.Contains(detail, "vdc with serial") || !strings.Contains(detail, "with serial c56c7b6e15c2445e9a5d") {
+		t.Errorf("expected the unlinked disk and the stale link, got %q", detail)
+	}
+	if fe := ex.fakeExec; fe.ran("udevadm") == nil {
+		t.Errorf("expected udev to rescan the disks when a link is missing")
+	}
+
+	ex.missing["blkid"] = true
+	if check := checkNodeTools(ex); check.Result != NodeCheckFail || !strings.Contains(check.Detail, "blkid") {
+		t.Errorf("expected a missing required binary to fail, got %+v", check)
+	}
+}
@@ -0,0 +1,270 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"k8s.io/mount-utils"
+)
+
+const (
+	// kubeletVolumeDataFile is the file kubelet writes beside the staging path of a CSI volume
+	kubeletVolumeDataFile = "vol_data.json"
+
+	// kubeletStagingDir is the directory of the staging path inside the volume directory
+	kubeletStagingDir = "globalmount"
+)
+
+// CleanedVolume is a staged volume CleanupNode found, and what became of it
+type CleanedVolume struct {
+	VolumeID    string `json:"volume_id"`
+	StagingPath string `json:"staging_path"`
+	Unstaged    bool   `json:"unstaged"`
+	Detached    bool   `json:"detached"`
+	Error       string `json:"error,omitempty"`
+}
+
+// kubeletVolumeData is the part of vol_data.json naming the volume of a staging path
+type kubeletVolumeData struct {
+	DriverName   string `json:"driverName"`
+	VolumeHandle string `json:"volumeHandle"`
+}
+
+// CleanupNode unstages the volumes of the driver kubelet staged on this node, found from
+// the volume directories under kubeletDir, and detaches them from the node when detach is
+// set, so that a node terminated without a drain does not leave its volumes attached
+// until Kubernetes gives up on it. A volume whose staged filesystem publish mounts still
+// reference, as a pod may still use it, is neither unstaged nor detached. It is meant for
+// the decommission of the node, once its pods are gone, and goes on with the other
+// volumes when one fails.
+func (d *VultrDriver) CleanupNode(ctx context.Context, kubeletDir string, detach bool) ([]CleanedVolume, error) {
+	if detach && !d.isController {
+		return nil, fmt.Errorf("an API token is required to detach the volumes of the node")
+	}
+
+	volumes, err := stagedKubeletVolumes(kubeletDir, d.name)
+	if err != nil {
+		return nil, err
+	}
+
+	node := NewVultrNodeDriver(d)
+	var controller *VultrControllerServer
+	if detach {
+		controller = NewVultrControllerServer(d)
+	}
+
+	var failed int
+	for i := range volumes {
+		vol := &volumes[i]
+		log := d.log.WithField("volume_id", vol.VolumeID)
+
+		if _, err := node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+			VolumeId:          vol.VolumeID,
+			StagingTargetPath: vol.StagingPath,
+		}); err != nil {
+			// a volume still mounted must not be detached from under its filesystem
+			log.Warnf("cannot unstage volume: %v", err)
+			vol.Error = err.Error()
+			failed++
+			continue
+		}
+		vol.Unstaged = true
+		log.Info("volume unstaged by node cleanup")
+
+		if controller == nil {
+			continue
+		}
+
+		if _, err := controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: vol.VolumeID,
+			NodeId:   d.nodeID,
+		}); err != nil {
+			log.Warnf("cannot detach volume: %v", err)
+			vol.Error = err.Error()
+			failed++
+			continue
+		}
+		vol.Detached = true
+		log.Info("volume detached by node cleanup")
+	}
+
+	if failed > 0 {
+		return volumes, fmt.Errorf("%d of %d staged volumes could not be cleaned up", failed, len(volumes))
+	}
+	return volumes, nil
+}
+
+// stagedKubeletVolumes returns the volumes of the driver with a staging path under
+// kubeletDir, sorted by volume ID. Kubernetes 1.24 and later name the volume directory
+// after a hash of the volume handle below the driver name, earlier releases after the
+// persistent volume below pv, and both write the driver and handle to vol_data.json.
+func stagedKubeletVolumes(kubeletDir, driverName string) ([]CleanedVolume, error) {
+	csiDir := filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi")
+
+	var volumes []CleanedVolume
+	for _, parent := range []string{filepath.Join(csiDir, driverName), filepath.Join(csiDir, "pv")} {
+		entries, err := os.ReadDir(parent)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			dir := filepath.Join(parent, entry.Name())
+
+			data, err := os.ReadFile(filepath.Join(dir, kubeletVolumeDataFile))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			var vol kubeletVolumeData
+			if err := json.Unmarshal(data, &vol); err != nil {
+				return nil, fmt.Errorf("cannot parse %s: %w", filepath.Join(dir, kubeletVolumeDataFile), err)
+			}
+			if vol.DriverName != driverName || vol.VolumeHandle == "" {
+				continue
+			}
+
+			volumes = append(volumes, CleanedVolume{VolumeID: vol.VolumeHandle, StagingPath: filepath.Join(dir, kubeletStagingDir)})
+		}
+	}
+
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].VolumeID < volumes[j].VolumeID })
+	return volumes, nil
+}
+
+// WithStagingCleanup has the node plugin clean up the staging paths of the driver under
+// the kubelet directory which a crash of the node left behind, as it starts
+func WithStagingCleanup(enabled bool) Option {
+	return func(d *VultrDriver) {
+		d.stagingCleanup = enabled
+	}
+}
+
+// stagingCleanup counts what cleanupStaleStaging did with the staging paths it found
+type stagingCleanup struct {
+	scanned   int
+	unmounted int
+	removed   int
+	symlinks  int
+	kept      int
+	failed    int
+}
+
+// cleanupStaleStaging goes through the staging paths of the driver under kubeletDir
+// before the node plugin serves, so that what a crashed node left behind does not fail
+// the next NodeStageVolume on the same path. Dead mounts, whose backing went away, are
+// unmounted, dangling symlinks and empty directories which are not mount points are
+// removed. Live mounts and directories holding files are left alone, kubelet unstages or
+// restages those itself.
+func (n *VultrNodeServer) cleanupStaleStaging(kubeletDir string) stagingCleanup {
+	var result stagingCleanup
+	log := n.Driver.log.WithField("kubelet_dir", kubeletDir)
+
+	volumes, err := stagedKubeletVolumes(kubeletDir, n.Driver.name)
+	if err != nil {
+		log.Warnf("cannot look for stale staging paths: %v", err)
+		return result
+	}
+
+	for i := range volumes {
+		path := volumes[i].StagingPath
+		vlog := log.WithFields(logrus.Fields{"volume_id": volumes[i].VolumeID, "staging_path": path})
+
+		info, err := os.Lstat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		result.scanned++
+
+		switch {
+		case err == nil && info.Mode()&os.ModeSymlink != 0:
+			if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				result.kept++
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				vlog.Warnf("cannot remove dangling staging symlink: %v", err)
+				result.failed++
+				continue
+			}
+			vlog.Info("removed dangling staging symlink")
+			result.symlinks++
+		case isDeadMount(err):
+			if err := mount.CleanupMountPoint(path, n.Driver.mounter, true); err != nil {
+				vlog.Warnf("cannot unmount dead staging mount: %v", err)
+				result.failed++
+				continue
+			}
+			vlog.Info("unmounted dead staging mount")
+			result.unmounted++
+		case err != nil:
+			vlog.Warnf("cannot check staging path: %v", err)
+			result.failed++
+		case !info.IsDir():
+			result.kept++
+		default:
+			notMounted, err := mount.IsNotMountPoint(n.Driver.mounter, path)
+			if err != nil {
+				vlog.Warnf("cannot check staging path: %v", err)
+				result.failed++
+				continue
+			}
+			if !notMounted {
+				result.kept++
+				continue
+			}
+			// os.Remove only removes an empty directory, whatever a stale mount wrote stays
+			if err := os.Remove(path); err != nil {
+				result.kept++
+				continue
+			}
+			vlog.Info("removed stale staging directory")
+			result.removed++
+		}
+	}
+
+	if result.scanned == 0 {
+		log.Debug("no staging paths to clean up")
+		return result
+	}
+
+	log.WithFields(logrus.Fields{
+		"scanned":   result.scanned,
+		"unmounted": result.unmounted,
+		"removed":   result.removed,
+		"symlinks":  result.symlinks,
+		"kept":      result.kept,
+		"failed":    result.failed,
+	}).Info("stale staging paths cleaned up")
+
+	return result
+}
@@ -0,0 +1,179 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vultr/govultr/v3"
+	"k8s.io/mount-utils"
+
+	"github.com/vultr/vultr-csi/internal/fakevultr"
+)
+
+// writeVolumeData lays out the volume directory kubelet makes for a staged CSI volume,
+// returning its staging path
+func writeVolumeData(t *testing.T, dir, driverName, handle string) string {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, kubeletStagingDir), mkDirMode); err != nil {
+		t.Fatal(err)
+	}
+	data := `{"driverName":"` + driverName + `","volumeHandle":"` + handle + `"}`
+	if err := os.WriteFile(filepath.Join(dir, kubeletVolumeDataFile), []byte(data), mkFileMode); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, kubeletStagingDir)
+}
+
+func TestCleanupNode(t *testing.T) {
+	const nodeID = "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"
+
+	api := fakevultr.New()
+	api.AddInstance(nodeID, "ewr", "node", "vc2-1c-1gb")
+
+	d := newPreflightDriver(t, api)
+	d.name, d.nodeID = DefaultDriverName, nodeID
+	d.attachTimeout, d.detachTimeout = DefaultAttachTimeout, DefaultDetachTimeout
+
+	ctx := context.Background()
+	vol, _, err := d.client.BlockStorage.Create(ctx, &govultr.BlockStorageCreate{Region: "ewr", SizeGB: 10, Label: "data"}) //nolint:bodyclose
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.client.BlockStorage.Attach(ctx, vol.ID, &govultr.BlockStorageAttach{InstanceID: nodeID}); err != nil {
+		t.Fatal(err)
+	}
+
+	kubeletDir := t.TempDir()
+	csiDir := filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi")
+	staging := writeVolumeData(t, filepath.Join(csiDir, DefaultDriverName, "0a1b2c"), DefaultDriverName, vol.ID)
+	legacy := writeVolumeData(t, filepath.Join(csiDir, "pv", "pvc-legacy"), DefaultDriverName, "legacy-volume")
+	foreign := writeVolumeData(t, filepath.Join(csiDir, "pv", "pvc-foreign"), "other.csi.io", "foreign-volume")
+
+	mounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "/dev/disk/by-id/virtio-" + vol.ID, Path: staging, Type: fsTypeExt4},
+		{Device: "/dev/vdc", Path: foreign, Type: fsTypeExt4},
+	})
+	d.mounter = &mount.SafeFormatAndMount{Interface: mounter}
+
+	volumes, err := d.CleanupNode(ctx, kubeletDir, true)
+	if err != nil {
+		t.Fatalf("CleanupNode: %v %+v", err, volumes)
+	}
+
+	if len(volumes) != 2 || volumes[0].VolumeID != vol.ID || volumes[1].VolumeID != "legacy-volume" || volumes[1].StagingPath != legacy {
+		t.Fatalf("expected the volumes of the driver from both layouts, got %+v", volumes)
+	}
+	for _, v := range volumes {
+		if !v.Unstaged || !v.Detached {
+			t.Errorf("expected %s to be unstaged and detached, got %+v", v.VolumeID, v)
+		}
+	}
+
+	if len(mounter.MountPoints) != 1 || mounter.MountPoints[0].Path != foreign {
+		t.Errorf("expected only the volume of the other driver to stay mounted, got %+v", mounter.MountPoints)
+	}
+
+	attached, _, err := d.client.BlockStorage.Get(ctx, vol.ID) //nolint:bodyclose
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attached.AttachedToInstance != "" {
+		t.Errorf("expected the volume to be detached, got it attached to %s", attached.AttachedToInstance)
+	}
+}
+
+func TestCleanupNodePublished(t *testing.T) {
+	const nodeID = "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"
+
+	api := fakevultr.New()
+	api.AddInstance(nodeID, "ewr", "node", "vc2-1c-1gb")
+
+	d := newPreflightDriver(t, api)
+	d.name, d.nodeID = DefaultDriverName, nodeID
+
+	ctx := context.Background()
+	vol, _, err := d.client.BlockStorage.Create(ctx, &govultr.BlockStorageCreate{Region: "ewr", SizeGB: 10, Label: "data"}) //nolint:bodyclose
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.client.BlockStorage.Attach(ctx, vol.ID, &govultr.BlockStorageAttach{InstanceID: nodeID}); err != nil {
+		t.Fatal(err)
+	}
+
+	kubeletDir := t.TempDir()
+	staging := writeVolumeData(t, filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi", DefaultDriverName, "0a1b2c"),
+		DefaultDriverName, vol.ID)
+	device := "/dev/disk/by-id/virtio-" + vol.ID
+	mounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: device, Path: staging, Type: fsTypeExt4},
+		{Device: device, Path: "/var/lib/kubelet/pods/web/volumes/kubernetes.io~csi/pvc-1/mount", Type: fsTypeExt4},
+	})
+	d.mounter = &mount.SafeFormatAndMount{Interface: mounter}
+
+	// a pod may still use the volume, which neither loses its mount nor is detached
+	volumes, err := d.CleanupNode(ctx, kubeletDir, true)
+	if err == nil || len(volumes) != 1 || volumes[0].Unstaged || volumes[0].Detached || volumes[0].Error == "" {
+		t.Fatalf("expected the published volume refused, got %v %+v", err, volumes)
+	}
+	if len(mounter.MountPoints) != 2 {
+		t.Errorf("expected the mounts left alone, got %+v", mounter.MountPoints)
+	}
+
+	attached, _, err := d.client.BlockStorage.Get(ctx, vol.ID) //nolint:bodyclose
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attached.AttachedToInstance != nodeID {
+		t.Errorf("expected the volume to stay attached, got it attached to %q", attached.AttachedToInstance)
+	}
+}
+
+func TestCleanupNodeWithoutToken(t *testing.T) {
+	d := &VultrDriver{name: DefaultDriverName}
+	if _, err := d.CleanupNode(context.Background(), t.TempDir(), true); err == nil {
+		t.Errorf("expected detaching without a token to be refused")
+	}
+}
+
+func TestCleanupStaleStaging(t *testing.T) {
+	kubeletDir := t.TempDir()
+	driverDir := filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi", DefaultDriverName)
+
+	empty := writeVolumeData(t, filepath.Join(driverDir, "empty"), DefaultDriverName, "vol-empty")
+	files := writeVolumeData(t, filepath.Join(driverDir, "files"), DefaultDriverName, "vol-files")
+	if err := os.WriteFile(filepath.Join(files, "data"), []byte("data"), mkFileMode); err != nil {
+		t.Fatal(err)
+	}
+	mounted := writeVolumeData(t, filepath.Join(driverDir, "mounted"), DefaultDriverName, "vol-mounted")
+	dangling := writeVolumeData(t, filepath.Join(driverDir, "dangling"), DefaultDriverName, "vol-dangling")
+	if err := os.Remove(dangling); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(kubeletDir, "gone"), dangling); err != nil {
+		t.Fatal(err)
+	}
+	unstaged := writeVolumeData(t, filepath.Join(driverDir, "unstaged"), DefaultDriverName, "vol-unstaged")
+	if err := os.Remove(unstaged); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &VultrDriver{name: DefaultDriverName, log: logrus.NewEntry(logrus.New())}
+	d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "/dev/vdb", Path: mounted, Type: fsTypeExt4},
+	})}
+
+	result := NewVultrNodeDriver(d).cleanupStaleStaging(kubeletDir)
+	expected := stagingCleanup{scanned: 4, removed: 1, symlinks: 1, kept: 2}
+	if result != expected {
+		t.Errorf("expected %+v, got %+v", expected, result)
+	}
+
+	for path, exists := range map[string]bool{empty: false, dangling: false, files: true, mounted: true} {
+		if _, err := os.Lstat(path); (err == nil) != exists {
+			t.Errorf("expected %s to exist %v, got %v", path, exists, err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+
+	"github.com/vultr/govultr/v3"
+	"github.com/vultr/vultr-csi/internal/volumes"
+)
+
+// cloudInstance is the provider agnostic view of an instance
+type cloudInstance struct {
+	ID     string
+	Label  string
+	Region string
+}
+
+// cloudProvider is the cloud the controller provisions volumes on, and the only way its
+// RPC handlers reach it. The volumes are created, attached, detached, resized and
+// snapshotted through the storage backend of each storage type, the instances through
+// the provider itself. errVolumeNotFound and the other backend errors are the contract
+// of the backends, and isNotFoundError recognizes the instances and VPCs which do not exist.
+type cloudProvider interface {
+	// Backends returns the storage backends keyed by storage type
+	Backends() map[string]storageBackend
+	// GetInstance returns the instance
+	GetInstance(ctx context.Context, instanceID string) (*cloudInstance, error)
+	// InstanceTagRegions returns the regions of the instances with the tag
+	InstanceTagRegions(ctx context.Context, tag string) (map[string]bool, error)
+	// VPCRegion returns the region of the VPC
+	VPCRegion(ctx context.Context, vpcID string) (string, error)
+}
+
+// cloudProvider returns the provider the driver was given, the Vultr API through govultr
+// by default
+func (d *VultrDriver) cloudProvider() cloudProvider {
+	if d.cloud != nil {
+		return d.cloud
+	}
+	return &govultrProvider{driver: d}
+}
+
+// govultrProvider is the cloud provider of the Vultr API v2 through govultr
+type govultrProvider struct {
+	driver *VultrDriver
+}
+
+var _ cloudProvider = &govultrProvider{}
+
+// Backends returns block storage, and vfs when the deployment did not turn it off
+func (p *govultrProvider) Backends() map[string]storageBackend {
+	backends := map[string]storageBackend{storageTypeBlock: newBlockBackend(p.driver)}
+	if p.driver.vfs != nil {
+		backends[storageTypeVFS] = newVFSBackend(p.driver)
+	}
+	return backends
+}
+
+// GetInstance returns the instance
+func (p *govultrProvider) GetInstance(ctx context.Context, instanceID string) (*cloudInstance, error) {
+	instance, _, err := p.driver.client.Instance.Get(ctx, instanceID) //nolint:bodyclose
+	if err != nil {
+		return nil, err
+	}
+
+	return &cloudInstance{ID: instance.ID, Label: instance.Label, Region: instance.Region}, nil
+}
+
+// InstanceTagRegions returns the regions of the instances with the tag, following pagination
+func (p *govultrProvider) InstanceTagRegions(ctx context.Context, tag string) (map[string]bool, error) {
+	regions := make(map[string]bool)
+
+	err := volumes.Walk(ctx, &govultr.ListOptions{Tag: tag}, func(ctx context.Context, listOptions *govultr.ListOptions) ([]govultr.Instance, *govultr.Meta, error) { //nolint:lll
+		instances, meta, _, err := p.driver.client.Instance.List(ctx, listOptions) //nolint:bodyclose
+		return instances, meta, err
+	}, func(instances []govultr.Instance) bool {
+		for i := range instances {
+			regions[instances[i].Region] = true
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return regions, nil
+}
+
+// VPCRegion returns the region of the VPC, which may be a VPC 2.0 network
+func (p *govultrProvider) VPCRegion(ctx context.Context, vpcID string) (string, error) {
+	vpc, _, err := p.driver.client.VPC.Get(ctx, vpcID) //nolint:bodyclose
+	if err == nil {
+		return vpc.Region, nil
+	}
+	if !isNotFoundError(err) {
+		return "", err
+	}
+
+	vpc2, _, err := p.driver.client.VPC2.Get(ctx, vpcID) //nolint:bodyclose
+	if err != nil {
+		return "", err
+	}
+	return vpc2.Region, nil
+}
@@ -0,0 +1,86 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeCloud is a cloud provider without a Vultr API behind it
+type fakeCloud struct {
+	backends   map[string]storageBackend
+	instances  map[string]cloudInstance
+	tagRegions map[string]map[string]bool
+}
+
+func (f *fakeCloud) Backends() map[string]storageBackend {
+	return f.backends
+}
+
+func (f *fakeCloud) GetInstance(_ context.Context, instanceID string) (*cloudInstance, error) {
+	instance, ok := f.instances[instanceID]
+	if !ok {
+		return nil, errors.New("instance not found")
+	}
+	return &instance, nil
+}
+
+func (f *fakeCloud) InstanceTagRegions(_ context.Context, tag string) (map[string]bool, error) {
+	return f.tagRegions[tag], nil
+}
+
+func (f *fakeCloud) VPCRegion(context.Context, string) (string, error) {
+	return "", errors.New("vpc not found")
+}
+
+func TestControllerCloudProvider(t *testing.T) {
+	backend := &listingBackend{release: make(chan struct{})}
+	close(backend.release)
+
+	// no govultr client: every call to the cloud has to go through the provider
+	controller := NewVultrControllerServer(&VultrDriver{
+		isController: true,
+		log:          logrus.NewEntry(logrus.New()),
+		region:       "ewr",
+		cloud: &fakeCloud{
+			backends:   map[string]storageBackend{storageTypeBlock: backend},
+			instances:  map[string]cloudInstance{"node-1": {ID: "node-1", Region: "ewr"}},
+			tagRegions: map[string]map[string]bool{"db": {"lax": true}},
+		},
+	})
+	ctx := context.Background()
+
+	res, err := controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId: "vol-1",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	if err != nil || res.Confirmed == nil {
+		t.Errorf("expected the capabilities of the volume of the provider to be confirmed, got %v, %v", res, err)
+	}
+
+	_, err = controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: "vol-1",
+		NodeId:   "node-2",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for an instance the provider does not know, got %v", err)
+	}
+
+	regions, err := controller.placementRegions(ctx, "CreateVolume", map[string]string{placementInstanceTagParam: "db"})
+	if err != nil || !reflect.DeepEqual(regions, map[string]bool{"lax": true}) {
+		t.Errorf("expected the regions of the provider, got %v, %v", regions, err)
+	}
+}
@@ -15,15 +15,23 @@ package driver
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/sirupsen/logrus"
-	"github.com/vultr/govultr/v3"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/vultr/vultr-csi/internal/volumes"
 )
 
 const (
@@ -50,24 +58,112 @@ const (
 
 	volumeStatusCheckRetries  = 15
 	volumeStatusCheckInterval = 1
+
+	// maxVolumeStatusCheckInterval caps the backoff between polls of a volume's status
+	maxVolumeStatusCheckInterval = 5 * time.Second
+
+	// volumeActiveTimeout is how long CreateVolume waits for a new volume to become active
+	volumeActiveTimeout = volumeStatusCheckRetries * volumeStatusCheckInterval * time.Second
+
+	// names of the controller loops reported in metrics
+	loopVolumeActive = "volume_active_wait"
+	loopAttach       = "attach_wait"
+
+	// topologyRegionKey is the topology segment holding the Vultr region
+	topologyRegionKey = "region"
+
+	// volume context keys describing how a volume was provisioned
+	volumeContextStorageType = "storage_type"
+	volumeContextBlockType   = "block_type"
+	volumeContextRegion      = "region"
+	volumeContextFsType      = "fs_type"
+	volumeContextSizeGB      = "size_gb"
+	volumeContextFsck        = "fsck"
+	volumeContextFsckRepair  = "fsck_repair"
+	volumeContextMkfsOptions = "mkfs_options"
+	volumeContextReserved    = "reserved_blocks_percentage"
+	volumeContextEncrypted   = "encrypted"
+
+	volumeContextWipePartitions = "wipe_partitions"
+
+	volumeContextMountOptions    = "mount_options"
+	volumeContextVFSMountOptions = "vfs_mount_options"
+
+	// the claim a volume was provisioned for, passed on in the publish context for the
+	// node to label the metrics of the volume with
+	volumeContextPVCName      = "pvc_name"
+	volumeContextPVCNamespace = "pvc_namespace"
+
+	// volumeLabelHashLength is the number of hex characters of the name hash kept when truncating labels
+	volumeLabelHashLength = 8
 )
 
 var (
 	supportedVolCapabilities = &csi.VolumeCapability_AccessMode{
 		Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
 	}
+
+	// multiNodeAccessModes are the access modes which share a volume between nodes,
+	// supported only by storage which can be attached to several instances at once
+	multiNodeAccessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:  true,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER: true,
+	}
 )
 
+var errWaitTimeout = errors.New("timed out waiting for volume")
+
 var _ csi.ControllerServer = &VultrControllerServer{}
 
 // VultrControllerServer is the struct type for the VultrDriver
 type VultrControllerServer struct {
 	Driver *VultrDriver
+
+	cloud    cloudProvider
+	backends *backendRegistry
+	watcher  *volumeWatcher
+	locks    *volumeLocks
+	orphans  *orphanTracker
+	// instances queues the attachments to each instance
+	instances *instanceQueues
+
+	attachments     *attachmentTracker
+	deletesAttached *attachedDeletes
+	detachesStuck   *stuckDetaches
+	volumes         *volumeCache
+	created         *createdVolumes
+	// nodes caches the instances of the nodes volumes are published to
+	nodes *instanceCache
+	// creates bounds the volumes provisioned at once
+	creates *createQueue
+	// apiKeys are the controllers acting with the Vultr API keys from CSI secrets
+	apiKeys *apiKeyControllers
 }
 
 // NewVultrControllerServer returns a VultrControllerServer
 func NewVultrControllerServer(driver *VultrDriver) *VultrControllerServer {
-	return &VultrControllerServer{Driver: driver}
+	cloud := driver.cloudProvider()
+	backends := newBackendRegistry(driver)
+
+	return &VultrControllerServer{
+		Driver:   driver,
+		cloud:    cloud,
+		backends: backends,
+		watcher:  newVolumeWatcher(driver.log, driver.tracer),
+		locks:    newVolumeLocks(),
+		orphans:  newOrphanTracker(),
+
+		instances: newInstanceQueues(),
+
+		attachments:     newAttachmentTracker(),
+		deletesAttached: newAttachedDeletes(),
+		detachesStuck:   newStuckDetaches(),
+		volumes:         newVolumeCache(backends, volumeCacheTTL),
+		created:         newCreatedVolumes(),
+		nodes:           newInstanceCache(cloud, instanceCacheTTL),
+		creates:         newCreateQueue(driver.maxParallelCreates, driver.maxQueuedCreates),
+		apiKeys:         newAPIKeyControllers(),
+	}
 }
 
 // CreateVolume provisions a new volume on behalf of the user
@@ -81,169 +177,333 @@ func (c *VultrControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume Volume Capabilities is missing")
 	}
 
-	if req.Parameters["block_type"] == "" {
-		return nil, status.Error(codes.InvalidArgument, "CreateVolume Volume parameter `block_type` is missing")
+	c, err := c.forSecrets("CreateVolume", req.Secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	// the name is the idempotency key of CreateVolume, the volume ID does not exist yet
+	unlock, err := c.locks.acquire(volName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	params, err := normalizeParameters(req.Parameters)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume %v", err)
+	}
+	if len(req.MutableParameters) > 0 {
+		if err := c.Driver.checkFeature("CreateVolume with mutable parameters", featureModifyVolume); err != nil {
+			return nil, err
+		}
+	}
+	if params, err = withMutableParameters(params, req.MutableParameters); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume %v", err)
+	}
+	if err := c.Driver.checkVolumeSizePolicy(req.CapacityRange, params); err != nil {
+		return nil, err
+	}
+
+	storageType, backend, err := c.backends.forParameters(params)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume %v", err)
+	}
+	if err := c.Driver.checkParameters("CreateVolume", storageType, params); err != nil {
+		return nil, err
 	}
 
 	// Validate
-	if !isValidCapability(req.VolumeCapabilities) {
+	if !isValidCapability(req.VolumeCapabilities, storageType) {
 		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume Volume capability is not compatible: %v", req)
 	}
+	if err := c.Driver.strictCapabilities("CreateVolume", req.VolumeCapabilities); err != nil {
+		return nil, err
+	}
+	if err := c.Driver.checkCapabilityFeatures("CreateVolume", req.VolumeCapabilities...); err != nil {
+		return nil, err
+	}
 
-	c.Driver.log.WithFields(logrus.Fields{
-		"volume-name":  volName,
-		"capabilities": req.VolumeCapabilities,
-	}).Info("Create Volume: called")
+	if storageType == storageTypeVFS {
+		for _, capability := range req.VolumeCapabilities {
+			if capability.GetBlock() != nil {
+				return nil, status.Error(codes.InvalidArgument, "CreateVolume vfs volumes are filesystems and cannot be raw block volumes")
+			}
+		}
 
-	// check that the volume doesnt already exist
-	listOptions := &govultr.ListOptions{}
-	var curVolume *govultr.BlockStorage
+		for _, key := range []string{fsTypeParam, mkfsOptionsParam, reservedBlocksParam, mountOptionsParam, wipePartitionsParam} {
+			if params[key] != "" {
+				return nil, status.Errorf(codes.InvalidArgument, "CreateVolume parameter %q does not apply to vfs volumes", key)
+			}
+		}
 
-	for {
-		volumes, meta, _, err := c.Driver.client.BlockStorage.List(ctx, listOptions) //nolint:bodyclose
-		if err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+		if params[encryptedParam] == "true" {
+			return nil, status.Error(codes.InvalidArgument, "CreateVolume vfs volumes are shared filesystems and cannot be encrypted on the node")
 		}
+	} else if params[vfsMountOptionsParam] != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume parameter %q only applies to vfs volumes", vfsMountOptionsParam)
+	}
 
-		for i := range volumes {
-			if volumes[i].Label == volName {
-				curVolume = &volumes[i]
-				break
+	// the StorageClass filesystem applies to capabilities which name none
+	fallbackFsType := c.Driver.defaultFsType
+	if fsType := params[fsTypeParam]; fsType != "" {
+		fallbackFsType = fsType
+		for _, capability := range req.VolumeCapabilities {
+			if requested := capability.GetMount().GetFsType(); requested != "" && !strings.EqualFold(requested, fsType) {
+				return nil, status.Errorf(codes.InvalidArgument,
+					"CreateVolume parameter %q asks for %s but the volume capability asks for %s", fsTypeParam, fsType, requested)
 			}
 		}
+	}
 
-		if curVolume != nil {
-			return &csi.CreateVolumeResponse{
-				Volume: &csi.Volume{
-					VolumeId:      curVolume.ID,
-					CapacityBytes: int64(curVolume.SizeGB) * giB,
-				},
-			}, nil
+	if params[reservedBlocksParam] != "" {
+		for _, capability := range req.VolumeCapabilities {
+			mnt := capability.GetMount()
+			if mnt == nil {
+				continue
+			}
+
+			if fsType, _ := resolveFsType(mnt.GetFsType(), fallbackFsType); !isExtFs(fsType) {
+				return nil, status.Errorf(codes.InvalidArgument,
+					"CreateVolume parameter %q only applies to ext filesystems, not %s", reservedBlocksParam, fsType)
+			}
 		}
+	}
 
-		if meta.Links.Next != "" {
-			listOptions.Cursor = meta.Links.Next
-			continue
+	if options := params[mountOptionsParam]; options != "" {
+		for _, capability := range req.VolumeCapabilities {
+			mnt := capability.GetMount()
+			if mnt == nil {
+				continue
+			}
+
+			fsType, _ := resolveFsType(mnt.GetFsType(), fallbackFsType)
+			if err := validateMountOptions(strings.Split(options, ","), fsType); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "CreateVolume parameter %q: %v", mountOptionsParam, err)
+			}
 		}
+	}
 
-		break
+	// the calls below reach the Vultr API, which a burst of claims would flood
+	release, err := c.creates.acquire(ctx, createClass(params))
+	if err != nil {
+		return nil, err
 	}
+	defer release()
 
-	// if applicable, create volume
-	size := getStorageBytes(req.CapacityRange, req.Parameters["block_type"])
+	placement, err := c.placementRegions(ctx, "CreateVolume", params)
+	if err != nil {
+		return nil, err
+	}
 
-	blockReq := &govultr.BlockStorageCreate{
-		Region:    c.Driver.region,
-		SizeGB:    int(size / giB),
-		Label:     volName,
-		BlockType: req.Parameters["block_type"],
+	region, err := provisioningRegion(req.AccessibilityRequirements, c.Driver.region, placement, c.Driver.allowedRegions,
+		c.Driver.topologyRegion)
+	if err != nil {
+		return nil, err
+	}
+	// the region is decided by topology, never by the StorageClass
+	params[regionParam] = region
+
+	label := c.Driver.newVolumeLabel(volName)
+
+	requestLogger(ctx, c.Driver.log).WithFields(logrus.Fields{
+		"volume_name":   volName,
+		"volume_label":  label,
+		"storage_type":  storageType,
+		"region":        region,
+		"capabilities":  req.VolumeCapabilities,
+		"pvc_name":      params[pvcNameParam],
+		"pvc_namespace": params[pvcNamespaceParam],
+	}).Info("Create Volume: resolved parameters")
+
+	if err := c.Driver.checkAPI("CreateVolume"); err != nil {
+		return nil, err
 	}
 
-	volume, _, err := c.Driver.client.BlockStorage.Create(ctx, blockReq) //nolint:bodyclose
+	// check that the volume doesnt already exist
+	existing, err := c.findVolumeByName(ctx, storageType, volName)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	// Check to see if volume is in active state
-	volReady := false
+	// the list can lag behind the volume a lost response of this name created
+	if id, ok := c.created.get(volName); ok && existing == nil {
+		vol, err := backend.Get(ctx, id)
+		switch {
+		case err == nil:
+			requestLogger(ctx, c.Driver.log).WithField("volume_id", id).Info("Create Volume: found the volume created for the name, not listed yet")
+			existing = vol
+		case errors.Is(err, errVolumeNotFound):
+			c.created.forget(id)
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
 
-	for i := 0; i < volumeStatusCheckRetries; i++ {
-		time.Sleep(volumeStatusCheckInterval * time.Second)
-		bs, _, err := c.Driver.client.BlockStorage.Get(ctx, volume.ID) //nolint:bodyclose
+	if existing != nil {
+		if existing.Region != "" && existing.Region != region {
+			return nil, status.Errorf(codes.AlreadyExists,
+				"CreateVolume volume %s already exists in region %s, not %s", existing.ID, existing.Region, region)
+		}
 
-		if err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+		// a retry after a timeout finds the volume it created, a reused name one of another size
+		if !capacityFits(req.CapacityRange, existing.SizeBytes) {
+			return nil, status.Errorf(codes.AlreadyExists,
+				"CreateVolume volume %s already exists with %d bytes, which does not fit the requested capacity %v",
+				existing.ID, existing.SizeBytes, req.CapacityRange)
 		}
 
-		if bs.Status == "active" {
-			volReady = true
-			break
+		return &csi.CreateVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId:           existing.ID,
+				CapacityBytes:      existing.SizeBytes,
+				VolumeContext:      provisionedVolumeContext(existing, req.VolumeCapabilities, params, fallbackFsType),
+				AccessibleTopology: c.Driver.volumeTopology(existing),
+			},
+		}, nil
+	}
+
+	// the cached volumes are stale once a change was attempted, whether or not it succeeded
+	defer c.volumes.invalidate()
+
+	// if applicable, create volume
+	volume, err := c.createVolume(ctx, backend, storageType, label, req, params)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		if errors.Is(err, errInvalidParameter) {
+			return nil, status.Errorf(codes.InvalidArgument, "CreateVolume %v", err)
+		}
+		if errors.Is(err, errOutOfRange) {
+			return nil, status.Errorf(codes.OutOfRange, "CreateVolume %v", err)
 		}
+		if err := dryRunCheck("CreateVolume", err); err != nil {
+			return nil, err
+		}
+		if err := c.Driver.checkAPI("CreateVolume"); err != nil {
+			return nil, err
+		}
+		return nil, status.Error(codes.Internal, err.Error())
 	}
+	c.created.put(volName, volume.ID)
 
-	if !volReady {
-		return nil, status.Errorf(codes.Internal, "volume is not active after %v seconds", volumeStatusCheckRetries)
+	// Check to see if volume is in active state
+	if err := c.watcher.wait(ctx, backend, volume.ID, loopVolumeActive, volumeActiveTimeout, func(vol *backendVolume) bool {
+		return vol.Status == "active"
+	}); err != nil {
+		if err := c.Driver.checkAPI("CreateVolume"); err != nil {
+			return nil, err
+		}
+		if errors.Is(err, errWaitTimeout) {
+			return nil, status.Errorf(codes.Internal, "volume is not active after %v", volumeActiveTimeout)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	res := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      volume.ID,
-			CapacityBytes: size,
-			AccessibleTopology: []*csi.Topology{
-				{
-					Segments: map[string]string{
-						"region": c.Driver.region,
-					},
-				},
-			},
+			VolumeId:           volume.ID,
+			CapacityBytes:      volume.SizeBytes,
+			VolumeContext:      provisionedVolumeContext(volume, req.VolumeCapabilities, params, fallbackFsType),
+			ContentSource:      req.VolumeContentSource,
+			AccessibleTopology: c.Driver.volumeTopology(volume),
 		},
 	}
 
-	c.Driver.log.WithFields(logrus.Fields{
-		"size":        size,
-		"volume-id":   volume.ID,
-		"volume-name": volume.Label,
-		"volume-size": volume.SizeGB,
+	requestLogger(ctx, c.Driver.log).WithFields(logrus.Fields{
+		"size":         volume.SizeBytes,
+		"volume_id":    volume.ID,
+		"volume_name":  volume.Label,
+		"storage_type": storageType,
 	}).Info("Create Volume: created volume")
 
 	return res, nil
 }
 
+// createVolume provisions the volume, refusing a content source in the request, as Vultr
+// provisions no storage type from a snapshot or a volume
+func (c *VultrControllerServer) createVolume(ctx context.Context, backend storageBackend, storageType, label string, req *csi.CreateVolumeRequest, params map[string]string) (*backendVolume, error) { //nolint:lll
+	source := req.GetVolumeContentSource()
+	if source == nil {
+		return backend.Create(ctx, label, req.CapacityRange, params)
+	}
+
+	if source.GetVolume() != nil {
+		if err := c.Driver.checkFeature("CreateVolume from a volume", featureCloning); err != nil {
+			return nil, err
+		}
+	} else if err := c.Driver.checkFeature("CreateVolume from a snapshot", featureSnapshots); err != nil {
+		return nil, err
+	}
+
+	return nil, status.Errorf(codes.InvalidArgument,
+		"CreateVolume volume content source is not supported for storage type %s, Vultr cannot create its volumes from a snapshot or another volume", //nolint:lll
+		storageType)
+}
+
 // DeleteVolume performs the volume deletion
 func (c *VultrControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "DeleteVolume VolumeID is missing")
 	}
 
-	c.Driver.log.WithFields(logrus.Fields{
-		"volume-id": req.VolumeId,
-	}).Info("Delete volume: called")
-
-	listOptions := &govultr.ListOptions{}
-	exists := false
-	for {
-		list, meta, _, err := c.Driver.client.BlockStorage.List(ctx, listOptions) //nolint:bodyclose
-		if err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
-		}
+	c, err := c.forSecrets("DeleteVolume", req.Secrets)
+	if err != nil {
+		return nil, err
+	}
 
-		for i := range list {
-			if list[i].ID == req.VolumeId {
-				exists = true
-				break
-			}
-		}
+	unlock, err := c.locks.acquire(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
-		if exists {
-			break
-		}
+	if err := c.Driver.checkAPI("DeleteVolume"); err != nil {
+		return nil, err
+	}
 
-		if meta.Links.Next != "" {
-			listOptions.Cursor = meta.Links.Next
-			continue
+	backend, volume, err := c.backends.find(ctx, req.VolumeId)
+	if err != nil {
+		if errors.Is(err, errVolumeNotFound) {
+			c.orphans.deleted(req.VolumeId)
+			c.created.forget(req.VolumeId)
+			return &csi.DeleteVolumeResponse{}, nil
 		}
-		return &csi.DeleteVolumeResponse{}, nil
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	// detach just to be safe
-	detach := &govultr.BlockStorageDetach{
-		Live: govultr.BoolToBoolPtr(true),
-	}
-	err := c.Driver.client.BlockStorage.Detach(ctx, req.VolumeId, detach)
-	if err != nil {
-		if !strings.Contains(err.Error(), "Block storage volume is not currently attached to a server") {
-			return nil, status.Errorf(codes.Internal, "cannot detach volume in delete, %v", err.Error())
+	defer c.volumes.invalidate()
+
+	if len(volume.AttachedTo) > 0 {
+		if err := c.detachForDelete(ctx, backend, volume); err != nil {
+			return nil, err
 		}
+	} else {
+		c.deletesAttached.forget(req.VolumeId)
 	}
 
-	err = c.Driver.client.BlockStorage.Delete(ctx, req.VolumeId)
-	if err != nil {
+	if err := backend.Delete(ctx, req.VolumeId); err != nil {
+		if err := dryRunCheck("DeleteVolume", err); err != nil {
+			return nil, err
+		}
+		if isAttachedError(err) {
+			return nil, status.Errorf(codes.FailedPrecondition, "DeleteVolume volume %s is attached, unpublish it first: %v", req.VolumeId, err)
+		}
+		// deleted since it was looked up, which DeleteVolume reports as a success
+		if apiErrorCode(err) == codes.NotFound {
+			c.orphans.deleted(req.VolumeId)
+			c.created.forget(req.VolumeId)
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+		c.orphans.failed(volume, err)
+		requestLogger(ctx, c.Driver.log).WithField("volume_label", volume.Label).Warnf("Delete Volume: volume is orphaned until deleted: %v", err)
 		return nil, status.Errorf(codes.Internal, "cannot delete volume, %v", err.Error())
 	}
+	c.orphans.deleted(req.VolumeId)
+	c.created.forget(req.VolumeId)
 
-	c.Driver.log.WithFields(logrus.Fields{
-		"volume-id": req.VolumeId,
-	}).Info("Delete Volume: deleted")
+	requestLogger(ctx, c.Driver.log).Info("Delete Volume: deleted")
 
 	return &csi.DeleteVolumeResponse{}, nil
 }
@@ -261,90 +521,154 @@ func (c *VultrControllerServer) ControllerPublishVolume(ctx context.Context, req
 	if req.VolumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume VolumeCapability is missing")
 	}
+	if err := c.Driver.checkCapabilityFeatures("ControllerPublishVolume", req.VolumeCapability); err != nil {
+		return nil, err
+	}
 
-	if req.Readonly {
-		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume read only is not currently supported")
+	c, err := c.forSecrets("ControllerPublishVolume", req.Secrets)
+	if err != nil {
+		return nil, err
 	}
 
-	volume, _, err := c.Driver.client.BlockStorage.Get(ctx, req.VolumeId) //nolint:bodyclose
+	unlock, err := c.lockPublish(req.VolumeId, req.NodeId, req.VolumeCapability, req.VolumeContext)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// publishing the volume to the node again ends any unpublish of it the attacher retried
+	c.detachesStuck.forget(req.VolumeId + "/" + req.NodeId)
+
+	if err := c.Driver.checkVFSEnabled("ControllerPublishVolume", req.VolumeId, req.VolumeContext); err != nil {
+		return nil, err
+	}
+
+	backend, volume, err := c.backends.get(ctx, req.VolumeId)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "cannot get volume: %v", err.Error())
 	}
 
-	if _, _, err = c.Driver.client.Instance.Get(ctx, req.NodeId); err != nil { //nolint:bodyclose
+	if err := c.Driver.strictNodeCapability("ControllerPublishVolume", req.VolumeCapability,
+		map[string]string{volumeContextStorageType: volume.StorageType}); err != nil {
+		return nil, err
+	}
+
+	if err := validatePublishedVolume("ControllerPublishVolume", volume, req.VolumeContext); err != nil {
+		return nil, err
+	}
+
+	// shared volumes are mounted read only by the node, block volumes have no read only attachment
+	if req.Readonly && !supportsMultiAttach(volume.StorageType) {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume read only is not currently supported")
+	}
+
+	instance, err := c.nodes.get(ctx, req.NodeId)
+	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "cannot get node: %v", err.Error())
 	}
 
+	publishContext := c.publishContext(backend, volume, req.NodeId, req.VolumeContext)
+
 	// node is already attached, do nothing
-	if volume.AttachedToInstance == req.NodeId {
+	if volume.isAttachedTo(req.NodeId) {
 		return &csi.ControllerPublishVolumeResponse{
-			PublishContext: map[string]string{
-				c.Driver.publishVolumeID: volume.MountID,
-			},
+			PublishContext: publishContext,
 		}, nil
 	}
 
-	// assuming its attached & to the wrong node
-	if volume.AttachedToInstance != "" {
-		return nil, status.Errorf(codes.FailedPrecondition,
-			"cannot attach volume to node because it is already attached to a different node ID: %v", volume.AttachedToInstance)
+	if err := validatePublishTopology(volume, req.VolumeContext, req.NodeId, instance.Region); err != nil {
+		return nil, err
 	}
 
-	c.Driver.log.WithFields(logrus.Fields{
-		"volume-id": req.VolumeId,
-		"node-id":   req.NodeId,
-	}).Info("Controller Publish Volume: called")
+	// assuming its attached & to the wrong node, which only shared volumes allow
+	if len(volume.AttachedTo) > 0 && !isMultiNodeCapability(volume.StorageType, req.VolumeCapability) {
+		if err := c.resolveAttachConflict(ctx, backend, volume, req.NodeId); err != nil {
+			return nil, err
+		}
+	}
 
-	attach := &govultr.BlockStorageAttach{
-		InstanceID: req.NodeId,
-		Live:       govultr.BoolToBoolPtr(true),
+	if err := c.Driver.checkAPI("ControllerPublishVolume"); err != nil {
+		return nil, err
 	}
-	err = c.Driver.client.BlockStorage.Attach(ctx, req.VolumeId, attach)
+
+	// the attachment holds up the others to the instance until the volume shows attached
+	release, err := c.instances.acquire(ctx, req.NodeId)
 	if err != nil {
-		// Desired node could still be spinning up
-		if strings.Contains(err.Error(), "Server is currently locked") {
+		return nil, err
+	}
+	defer release()
+
+	defer c.volumes.invalidate()
+
+	if err := backend.Attach(ctx, req.VolumeId, req.NodeId); err != nil {
+		if errors.Is(err, errInstanceLocked) {
 			return nil, status.Errorf(codes.Aborted, "cannot attach volume to node: %v", err.Error())
 		}
 
-		if strings.Contains(err.Error(), "Block storage volume is already attached to a server") {
-			return &csi.ControllerPublishVolumeResponse{
-				PublishContext: map[string]string{
-					c.Driver.publishVolumeID: volume.MountID,
-				},
-			}, nil
+		if errors.Is(err, errAlreadyAttached) {
+			return c.publishAlreadyAttached(ctx, backend, req.VolumeId, req.NodeId, req.VolumeContext, publishContext)
 		}
-	}
 
-	attachReady := false
-	for i := 0; i < volumeStatusCheckRetries; i++ {
-		time.Sleep(volumeStatusCheckInterval * time.Second)
-		bs, _, err := c.Driver.client.BlockStorage.Get(ctx, volume.ID) //nolint:bodyclose
-		if err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+		if err := dryRunCheck("ControllerPublishVolume", err); err != nil {
+			return nil, err
 		}
+	}
 
-		if bs.AttachedToInstance == req.NodeId {
-			attachReady = true
-			break
+	if err := c.watcher.wait(ctx, backend, volume.ID, loopAttach, c.Driver.attachTimeout, func(vol *backendVolume) bool {
+		// storage identified per attachment only knows its mount ID once attached
+		publishContext = c.publishContext(backend, vol, req.NodeId, req.VolumeContext)
+		return vol.isAttachedTo(req.NodeId)
+	}); err != nil {
+		if err := c.Driver.checkAPI("ControllerPublishVolume"); err != nil {
+			return nil, err
+		}
+		if errors.Is(err, errWaitTimeout) {
+			return nil, status.Errorf(codes.Internal, "volume is not attached to node after %v", c.Driver.attachTimeout)
 		}
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	if !attachReady {
-		return nil, status.Errorf(codes.Internal, "volume is not attached to node after %v seconds", volumeStatusCheckRetries)
-	}
+	c.attachments.attached(req.VolumeId, req.NodeId)
 
-	c.Driver.log.WithFields(logrus.Fields{
-		"volume-id": req.VolumeId,
-		"node-id":   req.NodeId,
-	}).Info("Controller Publish Volume: published")
+	requestLogger(ctx, c.Driver.log).WithField("node_id", req.NodeId).Info("Controller Publish Volume: published")
 
 	return &csi.ControllerPublishVolumeResponse{
-		PublishContext: map[string]string{
-			c.Driver.publishVolumeID: volume.MountID,
-		},
+		PublishContext: publishContext,
 	}, nil
 }
 
+// lockPublish locks the attachment of the volume to the node alone when its volume context
+// declares a shared volume published to several nodes, which ControllerPublishVolume then
+// checks against the volume, and the whole volume otherwise, as the attachment to this
+// node detaches it from the others
+func (c *VultrControllerServer) lockPublish(volumeID, nodeID string, capability *csi.VolumeCapability, volCtx map[string]string) (func(), error) { //nolint:lll
+	if isMultiNodeCapability(volCtx[volumeContextStorageType], capability) {
+		return c.locks.acquireAttachment(volumeID, nodeID)
+	}
+	return c.locks.acquire(volumeID)
+}
+
+// publishContext returns what the node needs to mount the volume attached to nodeID, and
+// the claim of the volume from its volume context
+func (c *VultrControllerServer) publishContext(backend storageBackend, vol *backendVolume, nodeID string, volCtx map[string]string) map[string]string { //nolint:lll
+	publishContext := map[string]string{
+		c.Driver.publishVolumeID: vol.mountIDFor(nodeID),
+	}
+
+	if name, namespace := volCtx[volumeContextPVCName], volCtx[volumeContextPVCNamespace]; name != "" && namespace != "" {
+		publishContext[volumeContextPVCName] = name
+		publishContext[volumeContextPVCNamespace] = namespace
+	}
+
+	if publisher, ok := backend.(attachmentPublisher); ok {
+		for k, v := range publisher.PublishContext(vol, nodeID) {
+			publishContext[k] = v
+		}
+	}
+
+	return publishContext
+}
+
 // ControllerUnpublishVolume performs the volume un-publish
 func (c *VultrControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) { //nolint:lll
 	if req.VolumeId == "" {
@@ -355,47 +679,131 @@ func (c *VultrControllerServer) ControllerUnpublishVolume(ctx context.Context, r
 		return nil, status.Error(codes.InvalidArgument, "ControllerUnpublishVolume Node ID is missing")
 	}
 
-	c.Driver.log.WithFields(logrus.Fields{
-		"volume-id": req.VolumeId,
-		"node-id":   req.NodeId,
-	}).Info("Controller Publish Unpublish: called")
+	c, err := c.forSecrets("ControllerUnpublishVolume", req.Secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	// the other nodes of a shared volume detach it meanwhile, and a volume attached to one
+	// node at a time is only attached to this one
+	unlock, err := c.locks.acquireAttachment(req.VolumeId, req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := c.Driver.checkAPI("ControllerUnpublishVolume"); err != nil {
+		return nil, err
+	}
 
-	volume, _, err := c.Driver.client.BlockStorage.Get(ctx, req.VolumeId) //nolint:bodyclose
+	backend, volume, err := c.backends.get(ctx, req.VolumeId)
 	if err != nil {
 		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
 
-	// node is already unattached, do nothing
-	if volume.AttachedToInstance == "" {
+	// node is already unattached, do nothing. Shared volumes stay attached to their other nodes.
+	if !volume.isAttachedTo(req.NodeId) {
+		c.detachesStuck.forget(req.VolumeId + "/" + req.NodeId)
 		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
 
-	if _, _, err = c.Driver.client.Instance.Get(ctx, req.NodeId); err != nil { //nolint:bodyclose
+	if _, err = c.nodes.get(ctx, req.NodeId); err != nil {
 		return nil, status.Errorf(codes.NotFound, "cannot get node: %v", err.Error())
 	}
-	detach := &govultr.BlockStorageDetach{
-		Live: govultr.BoolToBoolPtr(true),
-	}
 
-	err = c.Driver.client.BlockStorage.Detach(ctx, req.VolumeId, detach)
+	release, err := c.instances.acquire(ctx, req.NodeId)
 	if err != nil {
-		if strings.Contains(err.Error(), "Block storage volume is not currently attached to a server") {
+		return nil, err
+	}
+	defer release()
+
+	defer c.volumes.invalidate()
+
+	if err := c.detachForUnpublish(ctx, backend, req.VolumeId, req.NodeId); err != nil {
+		if errors.Is(err, errNotAttached) {
+			c.detachesStuck.forget(req.VolumeId + "/" + req.NodeId)
 			return &csi.ControllerUnpublishVolumeResponse{}, nil
 		}
+		if err := dryRunCheck("ControllerUnpublishVolume", err); err != nil {
+			return nil, err
+		}
 		return nil, status.Errorf(codes.Internal, "cannot detach volume: %v", err.Error())
 	}
 
-	c.Driver.log.WithFields(logrus.Fields{
-		"volume-id": req.VolumeId,
-		"node-id":   req.NodeId,
-	}).Info("Controller Unublish Volume: unpublished")
+	if err := c.waitDetached(ctx, backend, req.VolumeId, req.NodeId); err != nil {
+		if err := c.Driver.checkAPI("ControllerUnpublishVolume"); err != nil {
+			return nil, err
+		}
+		if errors.Is(err, errWaitTimeout) {
+			return nil, status.Errorf(codes.Internal, "volume is not detached from node after %v", c.Driver.detachTimeout)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	c.attachments.detached(req.VolumeId, req.NodeId)
+	c.detachesStuck.forget(req.VolumeId + "/" + req.NodeId)
+
+	requestLogger(ctx, c.Driver.log).WithField("node_id", req.NodeId).Info("Controller Unpublish Volume: unpublished")
 
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
-// ControllerModifyVolume is unimplemented
+// ControllerModifyVolume brings an existing volume to the mutable parameters of its
+// VolumeAttributesClass, refusing those Vultr cannot change in place
 func (c *VultrControllerServer) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) { //nolint:lll
-	return nil, status.Errorf(codes.Unimplemented, "method ControllerModifyVolume not implemented")
+	if err := c.Driver.checkFeature("ControllerModifyVolume", featureModifyVolume); err != nil {
+		return nil, err
+	}
+
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerModifyVolume Volume ID is missing")
+	}
+
+	params, err := normalizeMutableParameters(req.MutableParameters)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerModifyVolume %v", err)
+	}
+
+	c, err = c.forSecrets("ControllerModifyVolume", req.Secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := c.locks.acquire(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	backend, volume, err := c.backends.get(ctx, req.VolumeId)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "ControllerModifyVolume cannot get volume: %v", err)
+	}
+
+	m, ok := backend.(modifier)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerModifyVolume %s volumes cannot be modified", volume.StorageType)
+	}
+
+	if err := c.Driver.checkAPI("ControllerModifyVolume"); err != nil {
+		return nil, err
+	}
+
+	defer c.volumes.invalidate()
+
+	if err := m.Modify(ctx, volume, params); err != nil {
+		switch {
+		case errors.Is(err, errInvalidParameter):
+			return nil, status.Errorf(codes.InvalidArgument, "ControllerModifyVolume %v", err)
+		case isDryRunError(err):
+			return nil, dryRunCheck("ControllerModifyVolume", err)
+		}
+		return nil, status.Errorf(codes.Internal, "cannot modify volume %s: %v", req.VolumeId, err)
+	}
+
+	requestLogger(ctx, c.Driver.log).WithField("parameters", params).Info("Controller Modify Volume: modified")
+
+	return &csi.ControllerModifyVolumeResponse{}, nil
 }
 
 // ValidateVolumeCapabilities checks if requested capabilities are supported
@@ -408,69 +816,273 @@ func (c *VultrControllerServer) ValidateVolumeCapabilities(ctx context.Context,
 		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities Volume Capabilities is missing")
 	}
 
-	if _, _, err := c.Driver.client.BlockStorage.Get(ctx, req.VolumeId); err != nil { //nolint:bodyclose
+	c, err := c.forSecrets("ValidateVolumeCapabilities", req.Secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	_, volume, err := c.volumes.get(ctx, req.VolumeId)
+	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "cannot get volume: %v", err.Error())
 	}
 
+	if !isValidCapability(req.VolumeCapabilities, volume.StorageType) {
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Message: "requested volume capabilities are not supported",
+		}, nil
+	}
+
+	if err := c.validateCapabilityMountFlags(req, volume.StorageType); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Message: fmt.Sprintf("requested volume capabilities are not supported: %v", err),
+		}, nil
+	}
+
+	if err := c.Driver.checkCapabilityFeatures("ValidateVolumeCapabilities", req.VolumeCapabilities...); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Message: status.Convert(err).Message(),
+		}, nil
+	}
+
+	if c.Driver.strictSpec {
+		if mixedAccessTypes(req.VolumeCapabilities) {
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Message: "requested volume capabilities mix block and mount access types",
+			}, nil
+		}
+
+		params, err := normalizeParameters(req.GetParameters())
+		if err != nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+		}
+		if unknown := unknownParameters(params); len(unknown) > 0 {
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Message: fmt.Sprintf("unknown parameters %v", unknown),
+			}, nil
+		}
+	}
+
+	// both mount and raw block access types are supported
 	res := &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-			VolumeCapabilities: []*csi.VolumeCapability{
-				{
-					AccessMode: supportedVolCapabilities,
-				},
-			},
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.VolumeCapabilities,
+			Parameters:         req.GetParameters(),
 		},
 	}
 
 	return res, nil
 }
 
-// ListVolumes performs the list volume function
-func (c *VultrControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	// TODO setup paging
-	if req.StartingToken != "" {
-		_, err := strconv.Atoi(req.StartingToken)
-		if err != nil {
-			return nil, status.Errorf(codes.Aborted, "ListVolumes starting_token is invalid: %s", err)
-		}
+// validateCapabilityMountFlags checks the mount flags of the mount capabilities against
+// the filesystem the volume is mounted with, the one named by the capability, then the
+// one recorded at provisioning or set by the StorageClass, then the driver default
+func (c *VultrControllerServer) validateCapabilityMountFlags(req *csi.ValidateVolumeCapabilitiesRequest, storageType string) error {
+	fallback := req.GetVolumeContext()[volumeContextFsType]
+	if fallback == "" {
+		fallback = req.GetParameters()[fsTypeParam]
+	}
+	if fallback == "" {
+		fallback = c.Driver.defaultFsType
 	}
 
-	listOptions := &govultr.ListOptions{}
-	var entries []*csi.ListVolumesResponse_Entry
+	for _, capability := range req.VolumeCapabilities {
+		mnt := capability.GetMount()
+		if mnt == nil {
+			continue
+		}
 
-	for {
-		list, meta, _, err := c.Driver.client.BlockStorage.List(ctx, listOptions) //nolint:bodyclose
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "ListVolumes cannot retrieve list of volumes. %v", err.Error())
+		// vfs volumes are always mounted with virtiofs whatever the capability names
+		fsType := fsTypeVirtiofs
+		if storageType != storageTypeVFS {
+			var err error
+			if fsType, err = resolveFsType(mnt.GetFsType(), fallback); err != nil {
+				return err
+			}
 		}
-		for i := range list {
-			entries = append(entries, &csi.ListVolumesResponse_Entry{
-				Volume: &csi.Volume{
-					VolumeId:      list[i].ID,
-					CapacityBytes: int64(list[i].SizeGB) * giB,
-				},
-			})
+
+		if err := validateMountFlags(capability, fsType); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		if meta.Links.Next != "" {
-			listOptions.Cursor = meta.Links.Next
-			continue
+// listVolumesCursor prefixes the volume ID in the tokens of ListVolumes, telling the
+// tokens of the driver apart from any other string
+const listVolumesCursor = "after:"
+
+// ListVolumes returns the volumes created by this cluster, those labelled with its
+// volume label prefix, a page at a time in the order of their IDs. The token holds the ID
+// of the last volume of the page, and the next page starts after that ID, so volumes
+// created or deleted while paging shift no page and a volume deleted is never the cause
+// of another being listed twice or skipped. Only the account of the driver's token is
+// listed, as the request carries no secrets.
+func (c *VultrControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if req.MaxEntries < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "ListVolumes max_entries %d must not be negative", req.MaxEntries)
+	}
+
+	var after string
+	if req.StartingToken != "" {
+		cursor, err := base64.RawURLEncoding.DecodeString(req.StartingToken)
+		id, ok := strings.CutPrefix(string(cursor), listVolumesCursor)
+		if err != nil || !ok || id == "" {
+			return nil, status.Errorf(codes.Aborted, "ListVolumes starting_token %q is invalid", req.StartingToken)
 		}
-		break
+		after = id
+	}
+
+	all, err := c.volumes.list(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "ListVolumes cannot retrieve list of volumes. %v", err.Error())
+	}
+
+	c.orphans.prune(all)
+
+	list := volumes.Select(all, volumes.Filter{LabelPrefix: c.Driver.volumeLabelPrefix}, backendVolumeFields)
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	start := 0
+	if after != "" {
+		start = sort.Search(len(list), func(i int) bool { return list[i].ID > after })
+	}
+
+	end := len(list)
+	if req.MaxEntries > 0 && start+int(req.MaxEntries) < end {
+		end = start + int(req.MaxEntries)
+	}
+
+	var nextToken string
+	if end < len(list) {
+		nextToken = base64.RawURLEncoding.EncodeToString([]byte(listVolumesCursor + list[end-1].ID))
+	}
+	list = list[start:end]
+
+	var entries []*csi.ListVolumesResponse_Entry
+	for i := range list {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:           list[i].ID,
+				CapacityBytes:      list[i].SizeBytes,
+				AccessibleTopology: c.Driver.volumeTopology(&list[i]),
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: list[i].AttachedTo,
+				VolumeCondition:  c.reportedCondition(&list[i]),
+			},
+		})
 	}
 
 	res := &csi.ListVolumesResponse{
-		Entries: entries,
+		Entries:   entries,
+		NextToken: nextToken,
 	}
 
-	c.Driver.log.WithFields(logrus.Fields{
-		"volumes": entries,
+	requestLogger(ctx, c.Driver.log).WithFields(logrus.Fields{
+		"volumes":    entries,
+		"next_token": nextToken,
 	}).Info("List Volumes")
 	return res, nil
 }
 
-func (c *VultrControllerServer) GetCapacity(context.Context, *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// GetCapacity reports what a StorageClass can still provision in a region, so that the
+// scheduler tracking storage capacity keeps pods away from regions where provisioning
+// would fail. Nothing is available in a region which does not offer the storage, and
+// with a block storage quota only what the account's volumes leave of it.
+func (c *VultrControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) { //nolint:lll
+	params, err := normalizeParameters(req.Parameters)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "GetCapacity %v", err)
+	}
+	storageType, backend, err := c.backends.forParameters(params)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "GetCapacity %v", err)
+	}
+	if err := c.Driver.checkParameters("GetCapacity", storageType, params); err != nil {
+		return nil, err
+	}
+
+	// nothing can be provisioned with capabilities the storage does not support
+	if len(req.VolumeCapabilities) > 0 && !isValidCapability(req.VolumeCapabilities, storageType) {
+		return &csi.GetCapacityResponse{}, nil
+	}
+
+	region := c.Driver.topologyRegion(req.GetAccessibleTopology().GetSegments())
+	if region == "" {
+		region = c.Driver.region
+	}
+
+	if err := c.Driver.checkAPI("GetCapacity"); err != nil {
+		return nil, err
+	}
+
+	log := requestLogger(ctx, c.Driver.log).WithFields(logrus.Fields{
+		"storage_type": storageType,
+		"region":       region,
+	})
+
+	placement, err := c.placementRegions(ctx, "GetCapacity", params)
+	if status.Code(err) == codes.FailedPrecondition {
+		log.Infof("Get Capacity: %v", err)
+		return &csi.GetCapacityResponse{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if placement != nil && !placement[region] {
+		log.Info("Get Capacity: region is outside the placement regions")
+		return &csi.GetCapacityResponse{}, nil
+	}
+	if c.Driver.allowedRegions != nil && !c.Driver.allowedRegions[region] {
+		log.Info("Get Capacity: region is not allowed")
+		return &csi.GetCapacityResponse{}, nil
+	}
+
+	limits, offered, err := backend.Limits(ctx, region, params)
+	if err != nil {
+		if errors.Is(err, errInvalidParameter) {
+			return nil, status.Errorf(codes.InvalidArgument, "GetCapacity %v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "GetCapacity cannot retrieve the offer of region %s: %v", region, err)
+	}
+
+	if !offered {
+		log.Info("Get Capacity: region does not offer the storage")
+		return &csi.GetCapacityResponse{}, nil
+	}
+
+	available, maximum := limits.maxBytes, limits.maxBytes
+	if storageType == storageTypeBlock && c.Driver.blockStorageQuotaBytes > 0 {
+		blocks, err := c.volumes.query(ctx, volumes.Filter{StorageType: storageTypeBlock})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "GetCapacity cannot retrieve list of volumes. %v", err)
+		}
+
+		available = c.Driver.blockStorageQuotaBytes
+		for i := range blocks {
+			available -= blocks[i].SizeBytes
+		}
+
+		if available < limits.minBytes {
+			available = 0
+		}
+		if available < maximum {
+			maximum = available
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"available_bytes": available,
+		"maximum_bytes":   maximum,
+	}).Info("Get Capacity")
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+		MaximumVolumeSize: wrapperspb.Int64(maximum),
+		MinimumVolumeSize: wrapperspb.Int64(limits.minBytes),
+	}, nil
 }
 
 // ControllerGetCapabilities get capabilities of the controller
@@ -485,83 +1097,369 @@ func (c *VultrControllerServer) ControllerGetCapabilities(context.Context, *csi.
 		}
 	}
 
+	features := c.Driver.features
+
 	var capabilities []*csi.ControllerServiceCapability
 	for _, caps := range []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
-		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 	} {
 		capabilities = append(capabilities, capability(caps))
 	}
 
+	if features.enabled(featureExpansion) {
+		capabilities = append(capabilities, capability(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME))
+	}
+
+	if features.enabled(featureVolumeCondition) {
+		capabilities = append(capabilities, capability(csi.ControllerServiceCapability_RPC_VOLUME_CONDITION))
+	}
+
+	if c.backends.supportsSnapshots() && features.enabled(featureSnapshots) {
+		capabilities = append(capabilities, capability(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT))
+	}
+
+	if c.backends.supportsModify() && features.enabled(featureModifyVolume) {
+		capabilities = append(capabilities, capability(csi.ControllerServiceCapability_RPC_MODIFY_VOLUME))
+	}
+
 	resp := &csi.ControllerGetCapabilitiesResponse{
 		Capabilities: capabilities,
 	}
 
-	c.Driver.log.WithFields(logrus.Fields{
-		"response": resp,
-		"method":   "controller-get-capabilities",
-	})
-
 	return resp, nil
 }
 
-// CreateSnapshot provides snapshot creation
-func (c *VultrControllerServer) CreateSnapshot(context.Context, *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// CreateSnapshot provides snapshot creation for backends which support it
+func (c *VultrControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) { //nolint:lll
+	if err := c.Driver.checkFeature("CreateSnapshot", featureSnapshots); err != nil {
+		return nil, err
+	}
+
+	if req.SourceVolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Source Volume ID is missing")
+	}
+
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Name is missing")
+	}
+
+	c, err := c.forSecrets("CreateSnapshot", req.Secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	backend, _, err := c.volumes.get(ctx, req.SourceVolumeId)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "cannot get volume: %v", err.Error())
+	}
+
+	snap, ok := backend.(snapshotter)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "CreateSnapshot is not supported for this storage type")
+	}
+
+	snapshot, err := snap.CreateSnapshot(ctx, req.SourceVolumeId, req.Name)
+	if err != nil {
+		if err := dryRunCheck("CreateSnapshot", err); err != nil {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, "cannot create snapshot: %v", err.Error())
+	}
+
+	return &csi.CreateSnapshotResponse{Snapshot: snapshot}, nil
 }
 
 // DeleteSnapshot provides snapshot deletion
 func (c *VultrControllerServer) DeleteSnapshot(context.Context, *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if err := c.Driver.checkFeature("DeleteSnapshot", featureSnapshots); err != nil {
+		return nil, err
+	}
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
 // ListSnapshots provides the list snapshot
 func (c *VultrControllerServer) ListSnapshots(context.Context, *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if err := c.Driver.checkFeature("ListSnapshots", featureSnapshots); err != nil {
+		return nil, err
+	}
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
 // ControllerExpandVolume provides the expand volume
 func (c *VultrControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) { //nolint:lll
+	if err := c.Driver.checkFeature("ControllerExpandVolume", featureExpansion); err != nil {
+		return nil, err
+	}
+
 	volumeID := req.GetVolumeId()
 	if volumeID == "" {
 		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume volume id must be provided")
 	}
 
-	if _, _, err := c.Driver.client.BlockStorage.Get(ctx, volumeID); err != nil { //nolint:bodyclose
-		return nil, status.Errorf(codes.Internal, "ControllerExpandVolume could not retrieve existing volume: %v", err)
+	if req.CapacityRange == nil {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume capacity range must be provided")
 	}
 
-	currentBlock, _, err := c.Driver.client.BlockStorage.Get(ctx, req.GetVolumeId()) //nolint:bodyclose
+	c, err := c.forSecrets("ControllerExpandVolume", req.Secrets)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "%v", err)
+		return nil, err
 	}
 
-	expanded := getStorageBytes(req.CapacityRange, currentBlock.BlockType)
+	unlock, err := c.locks.acquire(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
-	c.Driver.log.WithFields(logrus.Fields{
-		"volume-id": req.VolumeId,
-		"size":      int(expanded / giB),
-	}).Info("Controller Expand Volume: called")
+	backend, volume, err := c.backends.get(ctx, volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "ControllerExpandVolume could not retrieve existing volume: %v", err)
+	}
 
-	blockReq := &govultr.BlockStorageUpdate{
-		SizeGB: int(expanded / giB),
+	// raw block volumes have no filesystem for the node to grow, and shared filesystems
+	// grow with the volume
+	nodeExpansionRequired := req.GetVolumeCapability().GetBlock() == nil && volume.StorageType != storageTypeVFS
+
+	log := requestLogger(ctx, c.Driver.log).WithFields(logrus.Fields{
+		"size":     int(req.CapacityRange.GetRequiredBytes() / giB),
+		"attached": len(volume.AttachedTo) > 0,
+	})
+	if err := c.Driver.checkAPI("ControllerExpandVolume"); err != nil {
+		return nil, err
+	}
+
+	if volume.SizeBytes >= req.CapacityRange.GetRequiredBytes() {
+		log.Info("Controller Expand Volume: volume is already at the requested size")
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: volume.SizeBytes, NodeExpansionRequired: nodeExpansionRequired}, nil
 	}
 
-	if err := c.Driver.client.BlockStorage.Update(ctx, volumeID, blockReq); err != nil {
+	defer c.volumes.invalidate()
+
+	expanded, err := backend.Expand(ctx, volume, req.CapacityRange)
+	if err != nil {
+		switch {
+		case errors.Is(err, errOutOfRange):
+			return nil, status.Errorf(codes.OutOfRange, "cannot resize volume %s: %v", req.GetVolumeId(), err)
+		case errors.Is(err, errVolumeBusy):
+			// the sidecar retries, by which time the earlier change has completed
+			return nil, status.Errorf(codes.Unavailable, "cannot resize volume %s yet: %v", req.GetVolumeId(), err)
+		case isDryRunError(err):
+			return nil, dryRunCheck("ControllerExpandVolume", err)
+		}
 		return nil, status.Errorf(codes.Internal, "cannot resize volume %s: %s", req.GetVolumeId(), err.Error())
 	}
 
-	return &csi.ControllerExpandVolumeResponse{CapacityBytes: expanded, NodeExpansionRequired: true}, nil
+	if len(volume.AttachedTo) == 0 && nodeExpansionRequired {
+		// The volume is detached so no node can grow the filesystem now. Reporting that
+		// node expansion is required leaves the resize pending with the CO, and the
+		// filesystem is grown when the volume is next staged.
+		log.Info("Controller Expand Volume: volume is detached, filesystem expansion pending until next stage")
+	}
+
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: expanded, NodeExpansionRequired: nodeExpansionRequired}, nil
 }
 
-// ControllerGetVolume This relates to being able to get health checks on a PV. We do not have this
-func (c *VultrControllerServer) ControllerGetVolume(ctx context.Context, request *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) { //nolint:lll
-	return nil, status.Error(codes.Unimplemented, "")
+// ControllerGetVolume This relates to being able to get health checks on a PV. We do not have this.
+// It carries no secrets, so it only sees the volumes of the account of the driver's token.
+func (c *VultrControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) { //nolint:lll
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerGetVolume Volume ID is missing")
+	}
+
+	if err := c.Driver.checkAPI("ControllerGetVolume"); err != nil {
+		return nil, err
+	}
+
+	_, volume, err := c.volumes.get(ctx, req.VolumeId)
+	if err != nil {
+		// the health monitor reports volumes deleted out-of-band from NotFound
+		if errors.Is(err, errVolumeNotFound) {
+			return nil, status.Errorf(codes.NotFound, "ControllerGetVolume volume %s does not exist: %v", req.VolumeId, err)
+		}
+		return nil, status.Errorf(codes.Internal, "ControllerGetVolume cannot get volume: %v", err)
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:           volume.ID,
+			CapacityBytes:      volume.SizeBytes,
+			AccessibleTopology: c.Driver.volumeTopology(volume),
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: volume.AttachedTo,
+			VolumeCondition:  c.reportedCondition(volume),
+		},
+	}, nil
+}
+
+// volumeCondition reports a volume as abnormal when the Vultr API does not have it active
+// or its deletion failed. The CO compares the published nodes with its attachments to
+// notice volumes detached out-of-band.
+func (c *VultrControllerServer) volumeCondition(vol *backendVolume) *csi.VolumeCondition {
+	var problems []string
+	if vol.Status != "active" {
+		problems = append(problems, fmt.Sprintf("volume status is %q", vol.Status))
+	}
+	if o := c.orphans.get(vol.ID); o != nil {
+		problems = append(problems, o.message())
+	}
+
+	if len(problems) > 0 {
+		return &csi.VolumeCondition{Abnormal: true, Message: strings.Join(problems, "; ")}
+	}
+
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+}
+
+// reportedCondition returns the condition of the volume the CO is told of, none when
+// the VolumeCondition feature is disabled
+func (c *VultrControllerServer) reportedCondition(vol *backendVolume) *csi.VolumeCondition {
+	if !c.Driver.features.enabled(featureVolumeCondition) {
+		return nil
+	}
+	return c.volumeCondition(vol)
 }
 
-func isValidCapability(caps []*csi.VolumeCapability) bool {
+// validatePublishTopology fails with FailedPrecondition when the node is outside the volume's
+// accessible topology, which happens when the topology constraints were bypassed at
+// scheduling or a PersistentVolume is reused by a pod scheduled in another region. Vultr
+// would otherwise only fail the attach after the controller waited on it. The region
+// Vultr reports for the volume is authoritative, the one recorded in the volume context
+// at creation covers volumes it reports none for.
+func validatePublishTopology(vol *backendVolume, volCtx map[string]string, nodeID, nodeRegion string) error {
+	region := vol.Region
+	if region == "" {
+		region = volCtx[volumeContextRegion]
+	}
+
+	if region == "" || nodeRegion == "" || strings.EqualFold(region, nodeRegion) {
+		return nil
+	}
+
+	return status.Errorf(codes.FailedPrecondition,
+		"volume %s is accessible from region %s only but node %s is in region %s, "+
+			"check the node affinity of the PersistentVolume or where the pod using it was scheduled",
+		vol.ID, region, nodeID, nodeRegion)
+}
+
+// provisioningRegion picks the region to create a volume in from the CO's topology
+// requirements: the first preferred region which is also requisite, then the driver's
+// own region when it is requisite, then the first requisite region. Without region
+// requirements the volume goes in the driver's region. Regions outside placement, when
+// it is not nil, are never picked. Nor are those outside the allowed regions of the
+// operator, when not nil, which fail the volume with InvalidArgument when no allowed
+// region satisfies the requirements.
+func provisioningRegion(req *csi.TopologyRequirement, driverRegion string, placement, allowed map[string]bool, regionOf func(map[string]string) string) (string, error) { //nolint:lll
+	region, err := pickRegion(req, driverRegion, placement, regionOf)
+	if err != nil || allowed == nil || allowed[region] {
+		return region, err
+	}
+
+	within := allowed
+	if placement != nil {
+		within = make(map[string]bool)
+		for r := range placement {
+			if allowed[r] {
+				within[r] = true
+			}
+		}
+	}
+	if allowedRegion, err := pickRegion(req, driverRegion, within, regionOf); err == nil {
+		return allowedRegion, nil
+	}
+	return "", status.Errorf(codes.InvalidArgument,
+		"CreateVolume region %s is not allowed, volumes are only provisioned in the regions %v", region, sortedRegions(allowed))
+}
+
+// pickRegion picks the region of provisioningRegion, regardless of the allowed regions
+func pickRegion(req *csi.TopologyRequirement, driverRegion string, placement map[string]bool, regionOf func(map[string]string) string) (string, error) { //nolint:lll
+	requisite := topologyRegions(req.GetRequisite(), regionOf)
+	allowed := func(region string) bool {
+		if placement != nil && !placement[region] {
+			return false
+		}
+		if len(requisite) == 0 {
+			return true
+		}
+		for _, r := range requisite {
+			if r == region {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, region := range topologyRegions(req.GetPreferred(), regionOf) {
+		if allowed(region) {
+			return region, nil
+		}
+	}
+
+	if driverRegion != "" && allowed(driverRegion) {
+		return driverRegion, nil
+	}
+
+	candidates := requisite
+	if len(candidates) == 0 {
+		candidates = sortedRegions(placement)
+	}
+	for _, region := range candidates {
+		if allowed(region) {
+			return region, nil
+		}
+	}
+
+	if placement != nil {
+		return "", status.Errorf(codes.ResourceExhausted,
+			"CreateVolume no region satisfies the topology requirements within the placement regions %v", sortedRegions(placement))
+	}
+	return "", status.Error(codes.ResourceExhausted, "CreateVolume no region satisfies the topology requirements")
+}
+
+// sortedRegions returns the regions of the set in order
+func sortedRegions(regions map[string]bool) []string {
+	sorted := make([]string, 0, len(regions))
+	for region := range regions {
+		sorted = append(sorted, region)
+	}
+	sort.Strings(sorted)
+
+	return sorted
+}
+
+// topologyRegions returns the regions regionOf finds in the topologies, in order and without duplicates
+func topologyRegions(topologies []*csi.Topology, regionOf func(map[string]string) string) []string {
+	var regions []string
+	seen := make(map[string]bool)
+
+	for _, t := range topologies {
+		region := regionOf(t.GetSegments())
+		if region == "" || seen[region] {
+			continue
+		}
+		seen[region] = true
+		regions = append(regions, region)
+	}
+
+	return regions
+}
+
+// supportsMultiAttach reports whether the storage type can be attached to several nodes at once
+func supportsMultiAttach(storageType string) bool {
+	return storageType == storageTypeVFS
+}
+
+// isMultiNodeCapability reports whether the capability shares a volume of the storage type between nodes
+func isMultiNodeCapability(storageType string, capability *csi.VolumeCapability) bool {
+	return supportsMultiAttach(storageType) && multiNodeAccessModes[capability.GetAccessMode().GetMode()]
+}
+
+func isValidCapability(caps []*csi.VolumeCapability, storageType string) bool {
 	for _, capacity := range caps {
 		if capacity == nil {
 			return false
@@ -572,7 +1470,7 @@ func isValidCapability(caps []*csi.VolumeCapability) bool {
 			return false
 		}
 
-		if accessMode.GetMode() != supportedVolCapabilities.GetMode() {
+		if accessMode.GetMode() != supportedVolCapabilities.GetMode() && !isMultiNodeCapability(storageType, capacity) {
 			return false
 		}
 
@@ -580,6 +1478,9 @@ func isValidCapability(caps []*csi.VolumeCapability) bool {
 		switch accessType.(type) {
 		case *csi.VolumeCapability_Block:
 		case *csi.VolumeCapability_Mount:
+			if _, err := resolveFsType(capacity.GetMount().GetFsType(), ""); err != nil {
+				return false
+			}
 		default:
 			return false
 		}
@@ -587,15 +1488,87 @@ func isValidCapability(caps []*csi.VolumeCapability) bool {
 	return true
 }
 
-// getStorageBytes returns storage size in bytes
-func getStorageBytes(capRange *csi.CapacityRange, blockType string) int64 {
-	// Default for HDD block is 40gb, NVME block is 1gb
-	if capRange == nil && blockType == blockTypeNvme {
-		return nvmeVolumeSizeInBytes
-	} else if capRange == nil && blockType == blockTypeHDD {
-		return hddDefaultVolumeSizeInBytes
+// provisionedVolumeContext records the resolved provisioning decisions so they can be
+// audited against what the StorageClass requested
+func provisionedVolumeContext(vol *backendVolume, caps []*csi.VolumeCapability, params map[string]string, fallbackFsType string) map[string]string { //nolint:lll
+	volCtx := map[string]string{
+		volumeContextStorageType: vol.StorageType,
+		volumeContextRegion:      vol.Region,
+		volumeContextSizeGB:      strconv.FormatInt(vol.SizeBytes/giB, 10),
+	}
+
+	if vol.BlockType != "" {
+		volCtx[volumeContextBlockType] = vol.BlockType
 	}
 
-	capacity := capRange.GetRequiredBytes()
-	return capacity
+	// passed on so the node plugin can apply them at stage
+	if fsck := params[fsckParam]; fsck != "" {
+		volCtx[volumeContextFsck] = fsck
+	}
+
+	if repair := params[fsckRepairParam]; repair != "" {
+		volCtx[volumeContextFsckRepair] = repair
+	}
+
+	if mkfsOptions := params[mkfsOptionsParam]; mkfsOptions != "" {
+		volCtx[volumeContextMkfsOptions] = mkfsOptions
+	}
+
+	if reserved := params[reservedBlocksParam]; reserved != "" {
+		volCtx[volumeContextReserved] = reserved
+	}
+
+	if params[encryptedParam] == "true" {
+		volCtx[volumeContextEncrypted] = "true"
+	}
+
+	if params[wipePartitionsParam] == "true" {
+		volCtx[volumeContextWipePartitions] = "true"
+	}
+
+	if options := params[mountOptionsParam]; options != "" {
+		volCtx[volumeContextMountOptions] = options
+	}
+
+	if options := params[vfsMountOptionsParam]; options != "" {
+		volCtx[volumeContextVFSMountOptions] = options
+	}
+
+	if name, namespace := params[pvcNameParam], params[pvcNamespaceParam]; name != "" && namespace != "" {
+		volCtx[volumeContextPVCName] = name
+		volCtx[volumeContextPVCNamespace] = namespace
+	}
+
+	for _, capability := range caps {
+		// vfs volumes are mounted over virtiofs whatever fsType the CO defaults to
+		if mnt := capability.GetMount(); mnt != nil && vol.StorageType != storageTypeVFS {
+			if fsType, err := resolveFsType(mnt.GetFsType(), fallbackFsType); err == nil {
+				volCtx[volumeContextFsType] = fsType
+			}
+			break
+		}
+	}
+
+	return volCtx
+}
+
+// volumeLabel returns the Vultr label for a CSI volume name. The configured prefix is
+// prepended and labels longer than the maximum are truncated with a hash of the full
+// label appended, so long names stay unique and retries map to the same label.
+func (d *VultrDriver) volumeLabel(name string) string {
+	label := d.volumeLabelPrefix + name
+
+	maxLength := d.volumeLabelMaxLength
+	if maxLength <= 0 {
+		maxLength = DefaultVolumeLabelMaxLength
+	}
+
+	if len(label) <= maxLength {
+		return label
+	}
+
+	sum := sha256.Sum256([]byte(label))
+	hash := hex.EncodeToString(sum[:])[:volumeLabelHashLength]
+
+	return label[:maxLength-volumeLabelHashLength-1] + "-" + hash
 }
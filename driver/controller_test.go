@@ -2,11 +2,21 @@ package driver
 
 import (
 	"context"
+	"errors"
+	"net/http"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/sirupsen/logrus"
+	"github.com/vultr/govultr/v3"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/vultr/vultr-csi/internal/fakevultr"
 )
 
 func NewFakeVultrControllerServer(testName string) *VultrControllerServer {
@@ -21,6 +31,8 @@ func NewFakeVultrControllerServer(testName string) *VultrControllerServer {
 		log:             log,
 		region:          "ewr",
 		publishVolumeID: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		attachTimeout:   DefaultAttachTimeout,
+		detachTimeout:   DefaultDetachTimeout,
 	}
 
 	return NewVultrControllerServer(d)
@@ -51,6 +63,13 @@ func TestCreateVolume(t *testing.T) {
 		Volume: &csi.Volume{
 			VolumeId:      "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
 			CapacityBytes: 10737418240,
+			VolumeContext: map[string]string{
+				"storage_type": "block",
+				"block_type":   "high_perf",
+				"region":       "ewr",
+				"fs_type":      "ext4",
+				"size_gb":      "10",
+			},
 			AccessibleTopology: []*csi.Topology{
 				{
 					Segments: map[string]string{
@@ -66,8 +85,226 @@ func TestCreateVolume(t *testing.T) {
 	}
 }
 
+func TestCreateVolumeSize(t *testing.T) {
+	api := fakevultr.New()
+	d := newPreflightDriver(t, api)
+	d.region, d.volumeLabelMaxLength = "ewr", DefaultVolumeLabelMaxLength
+	controller := NewVultrControllerServer(d)
+
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+
+	res, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "rounded",
+		Parameters:         map[string]string{"block_type": "high_perf"},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 17*giB + giB/2},
+		VolumeCapabilities: capabilities,
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+	if res.Volume.CapacityBytes != 18*giB {
+		t.Errorf("expected the capacity to be rounded up to 18GB, got %d", res.Volume.CapacityBytes)
+	}
+
+	vol, _, err := d.client.BlockStorage.Get(context.Background(), res.Volume.VolumeId) //nolint:bodyclose
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.SizeGB != 18 {
+		t.Errorf("expected an 18GB volume to be created, got %dGB", vol.SizeGB)
+	}
+
+	_, err = controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "too-small",
+		Parameters:         map[string]string{"block_type": "storage_opt"},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 10 * giB, LimitBytes: 20 * giB},
+		VolumeCapabilities: capabilities,
+	})
+	if status.Code(err) != codes.OutOfRange || !strings.Contains(err.Error(), "from 40GB to") {
+		t.Errorf("expected OutOfRange with the sizes of hdd block storage, got %v", err)
+	}
+}
+
+func TestCreateVolumeFsType(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create volume fs type")
+	controller.Driver.defaultFsType = fsTypeXFS
+
+	create := func(params map[string]string, fsType string) (*csi.CreateVolumeResponse, error) {
+		return controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:       "volume-test-name",
+			Parameters: params,
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				},
+			},
+		})
+	}
+
+	tests := []struct {
+		name     string
+		params   map[string]string
+		fsType   string
+		expected string
+		code     codes.Code
+	}{
+		{"driver default", map[string]string{"block_type": "high_perf"}, "", fsTypeXFS, codes.OK},
+		{"storage class", map[string]string{"block_type": "high_perf", "fsType": "ext4"}, "", fsTypeExt4, codes.OK},
+		{"capability", map[string]string{"block_type": "high_perf"}, "btrfs", fsTypeBtrfs, codes.OK},
+		{"matching capability", map[string]string{"block_type": "high_perf", "fsType": "ext4"}, "EXT4", fsTypeExt4, codes.OK},
+		{"conflicting capability", map[string]string{"block_type": "high_perf", "fsType": "ext4"}, "xfs", "", codes.InvalidArgument},
+		{"unsupported", map[string]string{"block_type": "high_perf", "fsType": "zfs"}, "", "", codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := create(tt.params, tt.fsType)
+			if status.Code(err) != tt.code {
+				t.Fatalf("expected %v, got %v", tt.code, err)
+			}
+			if err == nil && res.Volume.VolumeContext[volumeContextFsType] != tt.expected {
+				t.Errorf("expected fs_type %s, got %v", tt.expected, res.Volume.VolumeContext)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeMountOptions(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create volume mount options")
+	controller.Driver.defaultFsType = fsTypeXFS
+
+	tests := []struct {
+		name     string
+		params   map[string]string
+		fsType   string
+		expected string
+		code     codes.Code
+	}{
+		{"passed on", map[string]string{"block_type": "high_perf", "mountOptions": "discard, noatime"}, "", "discard,noatime", codes.OK},
+		{"of the default filesystem", map[string]string{"block_type": "high_perf", "mount_options": "nouuid"}, "", "nouuid", codes.OK},
+		{"of another filesystem", map[string]string{"block_type": "high_perf", "mount_options": "nouuid"}, fsTypeExt4, "", codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:       "volume-test-name",
+				Parameters: tt.params,
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: tt.fsType}},
+						AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+					},
+				},
+			})
+			if status.Code(err) != tt.code {
+				t.Fatalf("expected %v, got %v", tt.code, err)
+			}
+			if err == nil && res.Volume.VolumeContext[volumeContextMountOptions] != tt.expected {
+				t.Errorf("expected mount_options %s, got %v", tt.expected, res.Volume.VolumeContext)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeExisting(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create existing volume")
+
+	create := func(capRange *csi.CapacityRange) (*csi.CreateVolumeResponse, error) {
+		return controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:          "test-bs",
+			Parameters:    map[string]string{"block_type": "high_perf"},
+			CapacityRange: capRange,
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				},
+			},
+		})
+	}
+
+	res, err := create(&csi.CapacityRange{RequiredBytes: 10 * giB})
+	if err != nil {
+		t.Fatalf("expected the existing volume, got error %v", err)
+	}
+	if res.Volume.VolumeId != "c56c7b6e-15c2-445e-9a5d-1063ab5828ec" {
+		t.Errorf("expected the existing volume, got %s", res.Volume.VolumeId)
+	}
+
+	for _, capRange := range []*csi.CapacityRange{
+		{RequiredBytes: 20 * giB},
+		{RequiredBytes: 5 * giB, LimitBytes: 5 * giB},
+	} {
+		if _, err := create(capRange); status.Code(err) != codes.AlreadyExists {
+			t.Errorf("expected AlreadyExists for %v, got %v", capRange, err)
+		}
+	}
+}
+
+// unlistedBackend counts created volumes and lists none of them, as the API does shortly after a create
+type unlistedBackend struct {
+	storageBackend
+	creates int
+}
+
+func (b *unlistedBackend) Create(
+	ctx context.Context, name string, capRange *csi.CapacityRange, params map[string]string,
+) (*backendVolume, error) {
+	b.creates++
+	return b.storageBackend.Create(ctx, name, capRange, params)
+}
+
+func (b *unlistedBackend) List(ctx context.Context) ([]backendVolume, error) {
+	return nil, nil
+}
+
+func TestCreateVolumeDedupe(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create volume dedupe")
+	backend := &unlistedBackend{storageBackend: controller.backends.backends[storageTypeBlock]}
+	controller.backends.register(storageTypeBlock, backend)
+
+	req := &csi.CreateVolumeRequest{
+		Name:       "pvc-retried",
+		Parameters: map[string]string{"block_type": "high_perf"},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		res, err := controller.CreateVolume(context.Background(), req)
+		if err != nil {
+			t.Fatalf("got error, expected no error: %v", err)
+		}
+		if res.Volume.VolumeId != "c56c7b6e-15c2-445e-9a5d-1063ab5828ec" {
+			t.Errorf("expected the created volume, got %s", res.Volume.VolumeId)
+		}
+	}
+	if backend.creates != 1 {
+		t.Errorf("expected a retry not to create a second volume, got %d creates", backend.creates)
+	}
+
+	_, err := controller.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"})
+	if err != nil {
+		t.Fatalf("got error, expected no error: %v", err)
+	}
+	if _, err := controller.CreateVolume(context.Background(), req); err != nil || backend.creates != 2 {
+		t.Errorf("expected a new volume once the created one is deleted, got %d creates, %v", backend.creates, err)
+	}
+}
+
 func TestDeleteVolume(t *testing.T) {
 	controller := NewFakeVultrControllerServer("delete volume")
+	controller.Driver.deleteForceDetach = true
 
 	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec" //nolint:goconst
 	res, err := controller.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{
@@ -85,6 +322,37 @@ func TestDeleteVolume(t *testing.T) {
 	}
 }
 
+func TestDeleteVolumeAttached(t *testing.T) {
+	controller := NewFakeVultrControllerServer("delete attached volume")
+
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	req := &csi.DeleteVolumeRequest{VolumeId: volumeID}
+
+	_, err := controller.DeleteVolume(context.Background(), req)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition without force detach, got %v", err)
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	controller.deletesAttached.now = func() time.Time { return now }
+	controller.deletesAttached.forget(volumeID)
+	controller.Driver.deleteForceDetach = true
+	controller.Driver.deleteForceDetachGrace = time.Minute
+
+	_, err = controller.DeleteVolume(context.Background(), req)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition within the grace, got %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := controller.DeleteVolume(context.Background(), req); err != nil {
+		t.Fatalf("expected the volume force detached and deleted past the grace, got %v", err)
+	}
+	if _, ok := controller.deletesAttached.since[volumeID]; ok {
+		t.Error("expected the deleted volume to be forgotten")
+	}
+}
+
 func TestPublishVolume(t *testing.T) {
 	controller := NewFakeVultrControllerServer("delete volume")
 
@@ -119,6 +387,28 @@ func TestPublishVolume(t *testing.T) {
 	}
 }
 
+func TestPublishVolumeClaim(t *testing.T) {
+	controller := NewFakeVultrControllerServer("publish volume claim")
+
+	res, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		NodeId:   "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088",
+		VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: provisionedVolumeContext(&backendVolume{StorageType: storageTypeBlock, SizeBytes: 10 * giB}, nil,
+			map[string]string{pvcNameParam: "data", pvcNamespaceParam: "default"}, ""),
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if got := res.PublishContext; got[volumeContextPVCName] != "data" || got[volumeContextPVCNamespace] != "default" {
+		t.Errorf("expected the claim of the volume in the publish context, got %v", got)
+	}
+}
+
 func TestUnPublishVolume(t *testing.T) {
 	controller := NewFakeVultrControllerServer("delete volume")
 
@@ -140,3 +430,891 @@ func TestUnPublishVolume(t *testing.T) {
 		t.Errorf("expected %+v got %+v", res, expected)
 	}
 }
+
+// stuckBackend never lets go of a volume on a plain detach, counting the detaches and
+// the forced ones
+type stuckBackend struct {
+	storageBackend
+	detaches int
+	forced   int
+}
+
+func (b *stuckBackend) Detach(ctx context.Context, volumeID, nodeID string) error {
+	b.detaches++
+	return nil
+}
+
+func (b *stuckBackend) ForceDetach(ctx context.Context, volumeID, nodeID string) error {
+	b.forced++
+	return nil
+}
+
+func TestDetachForUnpublish(t *testing.T) {
+	controller := NewFakeVultrControllerServer("force stuck detach")
+	controller.Driver.events = newTestEventWebhook(t, "https://cmdb.example.com/events")
+	backend := &stuckBackend{}
+
+	const volumeID, nodeID = "c56c7b6e-15c2-445e-9a5d-1063ab5828ec", "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	controller.detachesStuck.now = func() time.Time { return now }
+	detach := func() {
+		t.Helper()
+		if err := controller.detachForUnpublish(context.Background(), backend, volumeID, nodeID); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	detach()
+	if backend.detaches != 1 || backend.forced != 0 {
+		t.Fatalf("expected a plain detach with force detaching disabled, got %d detaches, %d forced", backend.detaches, backend.forced)
+	}
+
+	controller.Driver.forceDetachAfter = 10 * time.Minute
+	detach()
+	now = now.Add(5 * time.Minute)
+	detach()
+	if backend.detaches != 3 || backend.forced != 0 {
+		t.Fatalf("expected plain detaches within the timeout, got %d detaches, %d forced", backend.detaches, backend.forced)
+	}
+
+	now = now.Add(5 * time.Minute)
+	detach()
+	if backend.forced != 1 {
+		t.Fatalf("expected the detach forced past the timeout, got %d forced", backend.forced)
+	}
+	select {
+	case event := <-controller.Driver.events.queue:
+		if event.Type != eventForceDetached || event.VolumeID != volumeID || event.NodeID != nodeID {
+			t.Errorf("expected an event of the forced detach, got %+v", event)
+		}
+	default:
+		t.Error("expected an event of the forced detach")
+	}
+
+	now = now.Add(5 * time.Minute)
+	detach()
+	if backend.detaches != 3 || backend.forced != 1 {
+		t.Errorf("expected the restarting instance to be waited for, got %d detaches, %d forced", backend.detaches, backend.forced)
+	}
+
+	now = now.Add(5 * time.Minute)
+	detach()
+	if backend.forced != 2 {
+		t.Errorf("expected the detach forced again once the timeout passed since, got %d forced", backend.forced)
+	}
+
+	controller.detachesStuck.forget(volumeID + "/" + nodeID)
+	detach()
+	if backend.detaches != 4 || backend.forced != 2 {
+		t.Errorf("expected a forgotten detach to start over, got %d detaches, %d forced", backend.detaches, backend.forced)
+	}
+
+	// the attacher gave up on the detach, the next one of the volume from the node starts over
+	now = now.Add(controller.Driver.forceDetachAfter + controller.Driver.detachTimeout + time.Minute)
+	detach()
+	if backend.detaches != 5 || backend.forced != 2 {
+		t.Errorf("expected a detach not retried to expire, got %d detaches, %d forced", backend.detaches, backend.forced)
+	}
+
+	controller.detachesStuck.forgetDetached(volumeID, []string{nodeID})
+	if _, ok := controller.detachesStuck.since[volumeID+"/"+nodeID]; !ok {
+		t.Error("expected the detach from a node still holding the volume to be kept")
+	}
+	controller.detachesStuck.forgetDetached(volumeID, nil)
+	if _, ok := controller.detachesStuck.since[volumeID+"/"+nodeID]; ok {
+		t.Error("expected the detach from a node no longer holding the volume to be forgotten")
+	}
+}
+
+func TestVolumeLabel(t *testing.T) {
+	d := &VultrDriver{volumeLabelPrefix: "prod-", volumeLabelMaxLength: 32}
+
+	short := d.volumeLabel("pvc-1")
+	if short != "prod-pvc-1" {
+		t.Errorf("expected prod-pvc-1 got %s", short)
+	}
+
+	long := d.volumeLabel("pvc-0b7f6c1e-8a0d-4c1e-9f43-2d7b6a5e1c90")
+	if len(long) != 32 {
+		t.Errorf("expected label truncated to 32 characters, got %d: %s", len(long), long)
+	}
+
+	if long != d.volumeLabel("pvc-0b7f6c1e-8a0d-4c1e-9f43-2d7b6a5e1c90") {
+		t.Errorf("expected truncation to be deterministic")
+	}
+
+	other := d.volumeLabel("pvc-0b7f6c1e-8a0d-4c1e-9f43-2d7b6a5e1c91")
+	if long == other {
+		t.Errorf("expected names sharing a prefix to produce distinct labels, both got %s", long)
+	}
+}
+
+func TestExpandVolume(t *testing.T) {
+	controller := NewFakeVultrControllerServer("expand volume")
+
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	res, err := controller.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volumeID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * giB},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	expected := &csi.ControllerExpandVolumeResponse{CapacityBytes: 20 * giB, NodeExpansionRequired: true}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %+v got %+v", expected, res)
+	}
+
+	res, err = controller.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volumeID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 5 * giB},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	expected = &csi.ControllerExpandVolumeResponse{CapacityBytes: 10 * giB, NodeExpansionRequired: false}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %+v got %+v", expected, res)
+	}
+
+	// a volume expanded while detached has its filesystem grown when it is next staged
+	if err := controller.Driver.client.BlockStorage.Detach(context.Background(), volumeID, &govultr.BlockStorageDetach{}); err != nil {
+		t.Fatal(err)
+	}
+	res, err = controller.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volumeID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 30 * giB},
+	})
+	if err != nil {
+		t.Fatalf("expected a detached volume to be expanded, got %v", err)
+	}
+
+	expected = &csi.ControllerExpandVolumeResponse{CapacityBytes: 30 * giB, NodeExpansionRequired: true}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %+v got %+v", expected, res)
+	}
+}
+
+func TestValidateVolumeCapabilitiesBlock(t *testing.T) {
+	controller := NewFakeVultrControllerServer("validate block")
+
+	caps := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+
+	res, err := controller.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		VolumeCapabilities: caps,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if res.Confirmed == nil || !reflect.DeepEqual(res.Confirmed.VolumeCapabilities, caps) {
+		t.Errorf("expected block capability to be confirmed, got %+v", res)
+	}
+
+	caps[0].AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+	res, err = controller.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		VolumeCapabilities: caps,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got error : %v", err)
+	}
+
+	if res.Confirmed != nil {
+		t.Errorf("expected multi node writer not to be confirmed")
+	}
+}
+
+func TestValidateVolumeCapabilitiesMountFlags(t *testing.T) {
+	controller := NewFakeVultrControllerServer("validate mount flags")
+	controller.Driver.defaultFsType = fsTypeExt4
+
+	tests := []struct {
+		name      string
+		fsType    string
+		volCtx    map[string]string
+		flags     []string
+		confirmed bool
+	}{
+		{"driver default", "", nil, []string{"noatime", "data=ordered"}, true},
+		{"capability", fsTypeXFS, nil, []string{"nouuid"}, true},
+		{"capability mismatch", fsTypeExt4, nil, []string{"nouuid"}, false},
+		{"volume context", "", map[string]string{volumeContextFsType: fsTypeXFS}, []string{"nouuid"}, true},
+		{"driver default mismatch", "", nil, []string{"nouuid"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := controller.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:      "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+				VolumeContext: tt.volCtx,
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{FsType: tt.fsType, MountFlags: tt.flags},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if confirmed := res.Confirmed != nil; confirmed != tt.confirmed {
+				t.Errorf("expected confirmed %t, got %+v", tt.confirmed, res)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeContentSourceUnsupported(t *testing.T) {
+	controller := NewFakeVultrControllerServer("create volume content source")
+
+	_, err := controller.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:       "volume-clone-name",
+		Parameters: map[string]string{"block_type": "high_perf"},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"},
+			},
+		},
+	})
+
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got: %v", err)
+	}
+}
+
+func TestValidatePublishTopology(t *testing.T) {
+	const nodeID = "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"
+
+	tests := []struct {
+		name       string
+		region     string
+		volCtx     map[string]string
+		nodeRegion string
+		code       codes.Code
+	}{
+		{"same region", "ewr", nil, "ewr", codes.OK},
+		{"other region", "ewr", nil, "lax", codes.FailedPrecondition},
+		{"region case", "ewr", nil, "EWR", codes.OK},
+		{"recorded region", "", map[string]string{volumeContextRegion: "ewr"}, "lax", codes.FailedPrecondition},
+		{"volume region authoritative", "lax", map[string]string{volumeContextRegion: "ewr"}, "lax", codes.OK},
+		{"unknown region", "", nil, "lax", codes.OK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vol := &backendVolume{ID: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec", Region: tt.region}
+
+			err := validatePublishTopology(vol, tt.volCtx, nodeID, tt.nodeRegion)
+			if status.Code(err) != tt.code {
+				t.Fatalf("expected %v, got %v", tt.code, err)
+			}
+
+			if err != nil && (!strings.Contains(err.Error(), "ewr") || !strings.Contains(err.Error(), tt.nodeRegion)) {
+				t.Errorf("expected error to name both regions, got %v", err)
+			}
+		})
+	}
+}
+
+func TestProvisioningRegion(t *testing.T) {
+	topology := func(regions ...string) []*csi.Topology {
+		var topologies []*csi.Topology
+		for _, r := range regions {
+			topologies = append(topologies, &csi.Topology{Segments: map[string]string{topologyRegionKey: r}})
+		}
+		return topologies
+	}
+
+	tests := []struct {
+		name     string
+		req      *csi.TopologyRequirement
+		expected string
+		code     codes.Code
+	}{
+		{"no requirements", nil, "ewr", codes.OK},
+		{"preferred", &csi.TopologyRequirement{Requisite: topology("lax", "ewr"), Preferred: topology("lax")}, "lax", codes.OK},
+		{"driver region when requisite", &csi.TopologyRequirement{Requisite: topology("lax", "ewr")}, "ewr", codes.OK},
+		{"first requisite", &csi.TopologyRequirement{Requisite: topology("lax", "ord")}, "lax", codes.OK},
+		{"preferred outside requisite", &csi.TopologyRequirement{Requisite: topology("ord"), Preferred: topology("lax")}, "ord", codes.OK},
+		{"placement", nil, "lax", codes.OK},
+		{"placement within requisite", &csi.TopologyRequirement{Requisite: topology("ewr", "ord", "lax")}, "lax", codes.OK},
+		{"placement outside requisite", &csi.TopologyRequirement{Requisite: topology("ewr")}, "", codes.ResourceExhausted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var placement map[string]bool
+			if strings.HasPrefix(tt.name, "placement") {
+				placement = map[string]bool{"lax": true, "sjc": true}
+			}
+
+			region, err := provisioningRegion(tt.req, "ewr", placement, nil, (&VultrDriver{}).topologyRegion)
+			if status.Code(err) != tt.code {
+				t.Fatalf("expected %v, got %v", tt.code, err)
+			}
+			if region != tt.expected {
+				t.Errorf("expected region %q got %q", tt.expected, region)
+			}
+		})
+	}
+
+	if _, err := provisioningRegion(nil, "", nil, nil, (&VultrDriver{}).topologyRegion); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted without any region, got %v", err)
+	}
+}
+
+func TestProvisioningRegionAllowed(t *testing.T) {
+	topology := func(regions ...string) []*csi.Topology {
+		var topologies []*csi.Topology
+		for _, r := range regions {
+			topologies = append(topologies, &csi.Topology{Segments: map[string]string{topologyRegionKey: r}})
+		}
+		return topologies
+	}
+	allowed := map[string]bool{"lax": true, "ord": true}
+
+	tests := []struct {
+		name      string
+		req       *csi.TopologyRequirement
+		placement map[string]bool
+		expected  string
+		code      codes.Code
+	}{
+		{"driver region not allowed", nil, nil, "lax", codes.OK},
+		{"allowed preferred", &csi.TopologyRequirement{Requisite: topology("ewr", "ord"), Preferred: topology("ord")}, nil, "ord", codes.OK},
+		{"allowed requisite", &csi.TopologyRequirement{Requisite: topology("ewr", "ord"), Preferred: topology("ewr")}, nil, "ord", codes.OK},
+		{"no allowed requisite", &csi.TopologyRequirement{Requisite: topology("ewr", "sjc")}, nil, "", codes.InvalidArgument},
+		{"allowed placement", nil, map[string]bool{"ewr": true, "ord": true}, "ord", codes.OK},
+		{"placement not allowed", nil, map[string]bool{"ewr": true, "sjc": true}, "", codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			region, err := provisioningRegion(tt.req, "ewr", tt.placement, allowed, (&VultrDriver{}).topologyRegion)
+			if status.Code(err) != tt.code {
+				t.Fatalf("expected %v, got %v", tt.code, err)
+			}
+			if region != tt.expected {
+				t.Errorf("expected region %q got %q", tt.expected, region)
+			}
+		})
+	}
+
+	if _, err := parseAllowedRegions("ewr,,lax"); err == nil {
+		t.Error("expected an empty region in the list to be refused")
+	}
+	regions, err := parseAllowedRegions(" EWR, lax ")
+	if err != nil || !reflect.DeepEqual(regions, map[string]bool{"ewr": true, "lax": true}) {
+		t.Errorf("expected the regions of the list, got %v, %v", regions, err)
+	}
+}
+
+func TestAllowedRegionsCapacityAndCreate(t *testing.T) {
+	controller := NewFakeVultrControllerServer("allowed regions")
+	controller.Driver.allowedRegions = map[string]bool{"lax": true}
+	params := map[string]string{blockTypeParam: blockTypeNvme}
+
+	res, err := controller.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: params})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.AvailableCapacity != 0 || res.GetMaximumVolumeSize().GetValue() != 0 {
+		t.Errorf("expected no capacity in a region which is not allowed, got %+v", res)
+	}
+
+	_, err = controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:       "not-allowed",
+		Parameters: params,
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{{Segments: map[string]string{topologyRegionKey: "ewr"}}},
+		},
+	})
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "lax") {
+		t.Errorf("expected a volume outside the allowed regions refused naming them, got %v", err)
+	}
+}
+
+// placementInstances lists the instances of a tag, and looks VPCs up
+type placementInstances struct {
+	govultr.InstanceService
+	tags map[string][]govultr.Instance
+}
+
+func (p *placementInstances) List(_ context.Context, options *govultr.ListOptions) ([]govultr.Instance, *govultr.Meta, *http.Response, error) { //nolint:lll
+	return p.tags[options.Tag], &govultr.Meta{Links: &govultr.Links{}}, nil, nil
+}
+
+type placementVPCs struct {
+	govultr.VPCService
+	regions map[string]string
+}
+
+func (p *placementVPCs) Get(_ context.Context, vpcID string) (*govultr.VPC, *http.Response, error) {
+	if region, ok := p.regions[vpcID]; ok {
+		return &govultr.VPC{ID: vpcID, Region: region}, nil, nil
+	}
+	return nil, nil, errors.New(`{"error":"Invalid VPC ID","status":404}`)
+}
+
+type placementVPC2s struct {
+	govultr.VPC2Service
+}
+
+func (p *placementVPC2s) Get(_ context.Context, vpcID string) (*govultr.VPC2, *http.Response, error) {
+	return nil, nil, errors.New(`{"error":"Invalid VPC ID","status":404}`)
+}
+
+func TestPlacementRegions(t *testing.T) {
+	controller := NewFakeVultrControllerServer("placement regions")
+	controller.Driver.client.Instance = &placementInstances{tags: map[string][]govultr.Instance{
+		"db": {{ID: "a", Region: "lax"}, {ID: "b", Region: "sjc"}},
+	}}
+	controller.Driver.client.VPC = &placementVPCs{regions: map[string]string{"vpc-lax": "lax", "vpc-ewr": "ewr"}}
+	controller.Driver.client.VPC2 = &placementVPC2s{}
+
+	tests := []struct {
+		name     string
+		params   map[string]string
+		expected map[string]bool
+		code     codes.Code
+	}{
+		{"no placement", map[string]string{}, nil, codes.OK},
+		{"instance tag", map[string]string{placementInstanceTagParam: "db"}, map[string]bool{"lax": true, "sjc": true}, codes.OK},
+		{"untagged", map[string]string{placementInstanceTagParam: "web"}, nil, codes.FailedPrecondition},
+		{"vpc", map[string]string{placementVPCParam: "vpc-lax"}, map[string]bool{"lax": true}, codes.OK},
+		{"unknown vpc", map[string]string{placementVPCParam: "vpc-gone"}, nil, codes.InvalidArgument},
+		{"vpc next to the tag", map[string]string{placementInstanceTagParam: "db", placementVPCParam: "vpc-lax"},
+			map[string]bool{"lax": true}, codes.OK},
+		{"vpc away from the tag", map[string]string{placementInstanceTagParam: "db", placementVPCParam: "vpc-ewr"},
+			nil, codes.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			regions, err := controller.placementRegions(context.Background(), "CreateVolume", tt.params)
+			if status.Code(err) != tt.code {
+				t.Fatalf("expected %v, got %v", tt.code, err)
+			}
+			if !reflect.DeepEqual(regions, tt.expected) {
+				t.Errorf("expected regions %v, got %v", tt.expected, regions)
+			}
+		})
+	}
+}
+
+func TestListVolumesStatus(t *testing.T) {
+	controller := NewFakeVultrControllerServer("list volumes status")
+
+	res, err := controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if len(res.Entries) == 0 {
+		t.Fatal("expected volumes to be listed")
+	}
+
+	var volStatus *csi.ListVolumesResponse_VolumeStatus
+	for _, e := range res.Entries {
+		if e.Volume.VolumeId == "c56c7b6e-15c2-445e-9a5d-1063ab5828ec" {
+			volStatus = e.Status
+		}
+	}
+	if !reflect.DeepEqual(volStatus.GetPublishedNodeIds(), []string{"245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"}) {
+		t.Errorf("expected the attached node to be published, got %v", volStatus.GetPublishedNodeIds())
+	}
+
+	if volStatus.GetVolumeCondition().GetAbnormal() {
+		t.Errorf("expected an active volume to be healthy, got %v", volStatus.GetVolumeCondition())
+	}
+}
+
+// deletedVolumeBackend lists the volumes of its backend but the deleted one
+type deletedVolumeBackend struct {
+	storageBackend
+	deleted string
+}
+
+func (b *deletedVolumeBackend) List(ctx context.Context) ([]backendVolume, error) {
+	list, err := b.storageBackend.List(ctx)
+	var kept []backendVolume
+	for _, vol := range list {
+		if vol.ID != b.deleted {
+			kept = append(kept, vol)
+		}
+	}
+	return kept, err
+}
+
+func TestListVolumesPagination(t *testing.T) {
+	controller := NewFakeVultrControllerServer("list volumes pagination")
+
+	var listed []string
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 2 {
+			t.Fatalf("expected 2 pages, got more after %v", listed)
+		}
+
+		res, err := controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 1, StartingToken: token})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		for _, e := range res.Entries {
+			listed = append(listed, e.Volume.VolumeId)
+		}
+
+		if token = res.NextToken; token == "" {
+			break
+		}
+	}
+
+	expected := []string{"bda4f333-bfd7-477b-84c2-e4df0ec9e5bf", "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"}
+	if !reflect.DeepEqual(listed, expected) {
+		t.Errorf("expected %v, got %v", expected, listed)
+	}
+
+	// the next page starts after the last volume listed, even once that volume is gone
+	first, err := controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 1})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	block := controller.backends.backends[storageTypeBlock]
+	controller.backends.register(storageTypeBlock, &deletedVolumeBackend{storageBackend: block, deleted: first.Entries[0].Volume.VolumeId})
+	controller.volumes.invalidate()
+	res, err := controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: first.NextToken})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(res.Entries) != 1 || res.Entries[0].Volume.VolumeId != expected[1] {
+		t.Errorf("expected the page after the deleted volume to hold %s, got %v", expected[1], res.Entries)
+	}
+	controller.backends.register(storageTypeBlock, block)
+	controller.volumes.invalidate()
+
+	for _, token := range []string{"x", "-1", "3", "invalid"} {
+		_, err := controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: token})
+		if status.Code(err) != codes.Aborted {
+			t.Errorf("expected Aborted for starting token %q, got %v", token, err)
+		}
+	}
+
+	controller.Driver.volumeLabelPrefix = "test-bs2"
+	res, err = controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(res.Entries) != 1 || res.Entries[0].Volume.VolumeId != "bda4f333-bfd7-477b-84c2-e4df0ec9e5bf" {
+		t.Errorf("expected only the volume with the label prefix, got %v", res.Entries)
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	controller, _ := newFakeVFSControllerServer("controller get volume")
+
+	res, err := controller.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{
+		VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if res.Volume.CapacityBytes != 10*giB || res.Status.GetVolumeCondition().GetAbnormal() {
+		t.Errorf("expected a healthy 10GB volume, got %+v", res)
+	}
+
+	controller.orphans.failed(&backendVolume{ID: res.Volume.VolumeId, StorageType: storageTypeBlock}, errInstanceLocked)
+	res, err = controller.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: res.Volume.VolumeId})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if !res.Status.GetVolumeCondition().GetAbnormal() {
+		t.Errorf("expected a volume which failed deletion to be abnormal, got %v", res.Status.GetVolumeCondition())
+	}
+
+	_, err = controller.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "vfs-deleted"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for a deleted volume, got %v", err)
+	}
+}
+
+// countingBackend counts the polls of a volume which never becomes ready
+type countingBackend struct {
+	storageBackend
+	gets int
+}
+
+func (b *countingBackend) Get(_ context.Context, volumeID string) (*backendVolume, error) {
+	b.gets++
+	return &backendVolume{ID: volumeID}, nil
+}
+
+func TestWaitForVolumeTimeout(t *testing.T) {
+	backend := &countingBackend{}
+	never := func(*backendVolume) bool { return false }
+	watcher := newVolumeWatcher(logrus.NewEntry(logrus.New()), nil)
+
+	err := watcher.wait(context.Background(), backend, "vol-1", loopAttach, 1500*time.Millisecond, never)
+	if !errors.Is(err, errWaitTimeout) {
+		t.Fatalf("expected errWaitTimeout, got %v", err)
+	}
+
+	// polled after 1s, then once more when the remaining half second runs out
+	if backend.gets != 2 {
+		t.Errorf("expected 2 polls, got %d", backend.gets)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := watcher.wait(ctx, backend, "vol-1", loopAttach, time.Minute, never); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the wait to end with its context, got %v", err)
+	}
+}
+
+// goneInstance is an instance API where one instance has been deleted
+type goneInstance struct {
+	govultr.InstanceService
+	gone string
+}
+
+func (g *goneInstance) Get(ctx context.Context, instanceID string) (*govultr.Instance, *http.Response, error) {
+	if instanceID == g.gone {
+		return nil, nil, errors.New(`{"error":"Invalid instance-id.","status":404}`)
+	}
+	return g.InstanceService.Get(ctx, instanceID)
+}
+
+func TestPublishVolumeAttachedElsewhere(t *testing.T) {
+	controller := NewFakeVultrControllerServer("publish attached elsewhere")
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	holder := "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"
+
+	controller.attachments.now = func() time.Time { return time.Unix(0, 0) }
+	controller.attachments.attached(volumeID, holder)
+	controller.attachments.now = func() time.Time { return time.Unix(90, 0) }
+
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		NodeId:   "other-node",
+		VolumeId: volumeID,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	})
+
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+
+	for _, want := range []string{holder, `"csi-test"`, "for 1m30s"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+
+	expectAttachConflictInfo(t, err, holder)
+}
+
+// expectAttachConflictInfo checks the error info detailing the node holding the volume
+func expectAttachConflictInfo(t *testing.T, err error, holder string) {
+	t.Helper()
+
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			if info.Reason != attachConflictReason || info.Metadata["attached_node_ids"] != holder {
+				t.Errorf("expected the conflict with node %s in the error info, got %+v", holder, info)
+			}
+			return
+		}
+	}
+	t.Errorf("expected an error info in the details of %v", err)
+}
+
+// racedAttach is block storage another attach gets to between the volume being read
+// and attached, which Vultr then refuses as already attached
+type racedAttach struct {
+	govultr.BlockStorageService
+	holder   string
+	attached bool
+}
+
+func (r *racedAttach) Get(ctx context.Context, blockID string) (*govultr.BlockStorage, *http.Response, error) {
+	bs, resp, err := r.BlockStorageService.Get(ctx, blockID)
+	if err == nil {
+		bs.AttachedToInstance = ""
+		if r.attached {
+			bs.AttachedToInstance = r.holder
+		}
+	}
+	return bs, resp, err
+}
+
+func (r *racedAttach) Attach(context.Context, string, *govultr.BlockStorageAttach) error {
+	r.attached = true
+	return errors.New(`{"error":"Block storage volume is already attached to a server","status":400}`)
+}
+
+func TestPublishVolumeAttachRaced(t *testing.T) {
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	holder := "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"
+
+	tests := []struct {
+		name   string
+		nodeID string
+		code   codes.Code
+	}{
+		{"attached to the node", holder, codes.OK},
+		{"attached to another node", "other-node", codes.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller := NewFakeVultrControllerServer("publish attach raced")
+			controller.Driver.client.BlockStorage = &racedAttach{BlockStorageService: controller.Driver.client.BlockStorage, holder: holder}
+
+			_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+				NodeId:   tt.nodeID,
+				VolumeId: volumeID,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				},
+			})
+			if status.Code(err) != tt.code {
+				t.Fatalf("expected %v, got %v", tt.code, err)
+			}
+			if tt.code == codes.OK {
+				return
+			}
+
+			if !strings.Contains(err.Error(), holder) || strings.Contains(err.Error(), "Block storage volume") {
+				t.Errorf("expected the conflicting node rather than the API error, got %v", err)
+			}
+			expectAttachConflictInfo(t, err, holder)
+		})
+	}
+}
+
+func TestResolveAttachConflictDeletedNode(t *testing.T) {
+	volumeID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	holder := "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"
+
+	for _, detach := range []bool{false, true} {
+		controller := NewFakeVultrControllerServer("resolve attach conflict")
+		controller.Driver.client.Instance = &goneInstance{InstanceService: controller.Driver.client.Instance, gone: holder}
+		controller.Driver.detachFromDeletedNodes = detach
+
+		backend, vol, err := controller.backends.get(context.Background(), volumeID)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		err = controller.resolveAttachConflict(context.Background(), backend, vol, "other-node")
+		detached := controller.Driver.client.BlockStorage.(*fakeBS).detached[volumeID]
+
+		if !detach {
+			if status.Code(err) != codes.FailedPrecondition || !strings.Contains(err.Error(), "no longer exists") {
+				t.Errorf("expected FailedPrecondition for the deleted node, got %v", err)
+			}
+			if detached {
+				t.Error("expected the volume to stay attached")
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+		if !detached {
+			t.Error("expected the volume to be detached from the deleted node")
+		}
+
+		staleAttachments.mu.Lock()
+		counted := staleAttachments.get([]string{"detached"}).value
+		staleAttachments.mu.Unlock()
+		if counted == 0 {
+			t.Error("expected the detached attachment to be counted")
+		}
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	tests := []struct {
+		name      string
+		params    map[string]string
+		region    string
+		quota     int64
+		available int64
+		maximum   int64
+		code      codes.Code
+	}{
+		{"nvme in the driver's region", map[string]string{blockTypeParam: blockTypeNvme}, "", 0,
+			nvmeMaxVolumeSizeInBytes, nvmeMaxVolumeSizeInBytes, codes.OK},
+		{"hdd in a topology region", map[string]string{blockTypeParam: blockTypeHDD}, "sao", 0,
+			hddMaxVolumeSizeInBytes, hddMaxVolumeSizeInBytes, codes.OK},
+		{"nvme not offered by the region", map[string]string{blockTypeParam: blockTypeNvme}, "sao", 0, 0, 0, codes.OK},
+		{"unknown region", map[string]string{blockTypeParam: blockTypeNvme}, "xyz", 0, 0, 0, codes.OK},
+		{"quota left by the account's volumes", map[string]string{blockTypeParam: blockTypeNvme}, "", 100 * giB,
+			70 * giB, 70 * giB, codes.OK},
+		{"quota used up", map[string]string{blockTypeParam: blockTypeNvme}, "", 30 * giB, 0, 0, codes.OK},
+		{"missing block type", nil, "", 0, 0, 0, codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller := NewFakeVultrControllerServer("get capacity")
+			controller.Driver.blockStorageQuotaBytes = tt.quota
+
+			req := &csi.GetCapacityRequest{Parameters: tt.params}
+			if tt.region != "" {
+				req.AccessibleTopology = &csi.Topology{Segments: map[string]string{topologyRegionKey: tt.region}}
+			}
+
+			res, err := controller.GetCapacity(context.Background(), req)
+			if status.Code(err) != tt.code {
+				t.Fatalf("expected %v, got %v", tt.code, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if res.AvailableCapacity != tt.available || res.GetMaximumVolumeSize().GetValue() != tt.maximum {
+				t.Errorf("expected %d bytes available up to %d per volume, got %d up to %d",
+					tt.available, tt.maximum, res.AvailableCapacity, res.GetMaximumVolumeSize().GetValue())
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	// DefaultMaxParallelCreates is how many CreateVolume calls reach the Vultr API at once
+	DefaultMaxParallelCreates = 8
+	// DefaultMaxQueuedCreates is how many CreateVolume calls wait for one of them
+	DefaultMaxQueuedCreates = 64
+
+	// createQueueRetryAfter is the backoff a refused CreateVolume is told to wait for each
+	// round of creates queued before it, up to createQueueMaxRetryAfter
+	createQueueRetryAfter    = 5 * time.Second
+	createQueueMaxRetryAfter = time.Minute
+)
+
+var (
+	createQueueWait = metrics.newHistogram("create_queue_wait_seconds",
+		"Time CreateVolume calls waited for a free create slot", defaultDurationBuckets)
+	createQueueRefused = metrics.newCounter("create_queue_refused_total",
+		"Number of CreateVolume calls refused with Unavailable as the create queue was full")
+)
+
+// WithMaxParallelCreates limits how many CreateVolume calls provision volumes at once,
+// and how many more wait their turn before the next ones fail with Unavailable. A
+// maxParallel of 0 is unlimited.
+func WithMaxParallelCreates(maxParallel, maxQueued int) Option {
+	return func(d *VultrDriver) {
+		d.maxParallelCreates = maxParallel
+		d.maxQueuedCreates = maxQueued
+	}
+}
+
+// createQueue bounds the CreateVolume calls provisioning at once. Scaling a StatefulSet
+// up creates all its claims together, whose creates, and the polling of the volumes until
+// they are active, would otherwise take the whole API rate limit from the other calls.
+// The waiting calls are let through in turns across their storage classes, so the claims
+// of one large StatefulSet do not hold up those of another class behind them.
+type createQueue struct {
+	limit     int
+	maxQueued int
+
+	mu      sync.Mutex
+	running int
+	queued  int
+	// classes are the calls waiting for each storage class, in arrival order
+	classes map[string][]*createTicket
+	// turns are the classes with calls waiting, the next one to be let through first
+	turns []string
+}
+
+type createTicket struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func newCreateQueue(limit, maxQueued int) *createQueue {
+	return &createQueue{limit: limit, maxQueued: maxQueued, classes: make(map[string][]*createTicket)}
+}
+
+// acquire waits for a create slot and returns the func freeing it, an Unavailable error
+// telling how long to back off when the queue is full, or an Aborted error when ctx ends
+// first
+func (q *createQueue) acquire(ctx context.Context, class string) (func(), error) {
+	if q == nil || q.limit <= 0 {
+		return func() {}, nil
+	}
+
+	q.mu.Lock()
+	if q.running < q.limit && q.queued == 0 {
+		q.running++
+		q.mu.Unlock()
+		return q.release, nil
+	}
+	if q.queued >= q.maxQueued {
+		retry := q.retryAfter()
+		q.mu.Unlock()
+		createQueueRefused.add(1)
+		return nil, createQueueFull(q.limit, retry)
+	}
+
+	ticket := &createTicket{ready: make(chan struct{})}
+	if len(q.classes[class]) == 0 {
+		q.turns = append(q.turns, class)
+	}
+	q.classes[class] = append(q.classes[class], ticket)
+	q.queued++
+	q.mu.Unlock()
+
+	start := time.Now()
+	select {
+	case <-ticket.ready:
+		createQueueWait.observe(time.Since(start).Seconds())
+		return q.release, nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if ticket.granted {
+		// the slot was handed over as ctx ended, and goes to the next call
+		q.running--
+		q.dispatch()
+	} else {
+		q.drop(class, ticket)
+	}
+	return nil, status.Errorf(codes.Aborted, "timed out waiting for one of %d parallel create slots: %v", q.limit, ctx.Err())
+}
+
+func (q *createQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.running--
+	q.dispatch()
+}
+
+// dispatch hands the free slots to the first call waiting for the class whose turn it is
+func (q *createQueue) dispatch() {
+	for q.running < q.limit && len(q.turns) > 0 {
+		class := q.turns[0]
+		q.turns = q.turns[1:]
+
+		waiting := q.classes[class]
+		ticket := waiting[0]
+		if len(waiting) > 1 {
+			q.classes[class] = waiting[1:]
+			q.turns = append(q.turns, class)
+		} else {
+			delete(q.classes, class)
+		}
+
+		q.queued--
+		q.running++
+		ticket.granted = true
+		close(ticket.ready)
+	}
+}
+
+// drop removes the call which gave up waiting
+func (q *createQueue) drop(class string, ticket *createTicket) {
+	waiting := q.classes[class]
+	for i, t := range waiting {
+		if t != ticket {
+			continue
+		}
+
+		q.queued--
+		if len(waiting) > 1 {
+			q.classes[class] = append(waiting[:i:i], waiting[i+1:]...)
+			return
+		}
+
+		delete(q.classes, class)
+		for j, c := range q.turns {
+			if c == class {
+				q.turns = append(q.turns[:j:j], q.turns[j+1:]...)
+				break
+			}
+		}
+		return
+	}
+}
+
+// retryAfter is the backoff for a call refused behind the queued ones, a round of creates
+// for each limit of them
+func (q *createQueue) retryAfter() time.Duration {
+	retry := time.Duration(q.queued/q.limit+1) * createQueueRetryAfter
+	if retry > createQueueMaxRetryAfter {
+		return createQueueMaxRetryAfter
+	}
+	return retry
+}
+
+// createQueueFull returns the Unavailable error of a full create queue, whose RetryInfo
+// tells the backoff as the message does
+func createQueueFull(limit int, retry time.Duration) error {
+	st := status.Newf(codes.Unavailable,
+		"CreateVolume: %d volumes are being created and the create queue is full, retry after %s", limit, retry)
+
+	withInfo, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retry)})
+	if err != nil {
+		return st.Err()
+	}
+	return withInfo.Err()
+}
+
+// createClass returns the key the calls of a storage class are queued under, its
+// parameters: CreateVolume is not told the name of the class, but the claims of a
+// class share its parameters, less the metadata of the claim
+func createClass(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		if !strings.HasPrefix(k, coMetadataPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var class strings.Builder
+	for _, k := range keys {
+		class.WriteString(k + "=" + params[k] + "\n")
+	}
+	return class.String()
+}
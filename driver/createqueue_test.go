@@ -0,0 +1,100 @@
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreateQueue(t *testing.T) {
+	q := newCreateQueue(1, 4)
+	release, err := q.acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the claims of class a queued first do not hold up the one of class b
+	order := make(chan string, 4)
+	for _, class := range []string{"a", "a", "a", "b"} {
+		class := class
+		queued := q.queued
+		go func() {
+			release, err := q.acquire(context.Background(), class)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- class
+			release()
+		}()
+		waitFor(t, func() bool { q.mu.Lock(); defer q.mu.Unlock(); return q.queued == queued+1 })
+	}
+
+	_, err = q.acquire(context.Background(), "c")
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected Unavailable with the queue full, got %v", err)
+	}
+	var retry *errdetails.RetryInfo
+	for _, d := range status.Convert(err).Details() {
+		retry, _ = d.(*errdetails.RetryInfo)
+	}
+	if retry == nil || retry.GetRetryDelay().AsDuration() != 5*createQueueRetryAfter {
+		t.Errorf("expected a retry delay of %s, got %v", 5*createQueueRetryAfter, retry)
+	}
+
+	release()
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, <-order)
+	}
+	if got[0] != "a" || got[1] != "b" {
+		t.Errorf("expected the classes to take turns, got %v", got)
+	}
+	waitFor(t, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return q.running == 0 && q.queued == 0 && len(q.turns) == 0 && len(q.classes) == 0
+	})
+}
+
+func TestCreateQueueCanceled(t *testing.T) {
+	q := newCreateQueue(1, 4)
+	release, err := q.acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := q.acquire(ctx, "a"); status.Code(err) != codes.Aborted {
+		t.Fatalf("expected Aborted once the call gave up waiting, got %v", err)
+	}
+	if q.queued != 0 || len(q.turns) != 0 || len(q.classes) != 0 {
+		t.Errorf("expected the call to leave the queue, got %+v", q)
+	}
+
+	release()
+	if release, err = q.acquire(context.Background(), "b"); err != nil {
+		t.Fatalf("expected the freed slot to be taken, got %v", err)
+	}
+	release()
+
+	if release, err := newCreateQueue(0, 0).acquire(context.Background(), "a"); err != nil {
+		t.Errorf("expected an unlimited queue to let calls through, got %v", err)
+	} else {
+		release()
+	}
+}
+
+func TestCreateClass(t *testing.T) {
+	a := createClass(map[string]string{blockTypeParam: blockTypeNvme, pvcNameParam: "data-0", pvcNamespaceParam: "db"})
+	b := createClass(map[string]string{blockTypeParam: blockTypeNvme, pvcNameParam: "data-1", pvcNamespaceParam: "db"})
+	c := createClass(map[string]string{blockTypeParam: blockTypeHDD, pvcNameParam: "data-0", pvcNamespaceParam: "db"})
+	if a != b || a == c {
+		t.Errorf("expected the class to be keyed by its parameters only, got %q, %q and %q", a, b, c)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+
+	"github.com/vultr/govultr/v3"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// apiKeySecret is the key of the Vultr API key in the CSI secrets of a StorageClass, such
+// as its provisioner and controller publish secrets
+const apiKeySecret = "api-key"
+
+var apiKeyAccounts = metrics.newGauge("api_key_accounts",
+	"Number of Vultr API keys from CSI secrets the controller holds a client for")
+
+// apiTokenKey is the context key of the token a request of the client of an API key from
+// CSI secrets is authenticated with
+type apiTokenKey struct{}
+
+// apiTokenTransport authenticates each request with the token in its context, and any
+// other with the token of the driver
+type apiTokenTransport struct {
+	auth *oauth2.Transport
+}
+
+func (t *apiTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, ok := req.Context().Value(apiTokenKey{}).(string)
+	if !ok {
+		return t.auth.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.auth.Base.RoundTrip(req)
+}
+
+// apiKeyTransport puts the API key of its client in the context of the requests, for
+// apiTokenTransport to authenticate them with deep in the transports of the driver. The
+// requests of every API key are so timed out, rate limited, audited and held back by the
+// dry run, and trip the circuit breaker, as those of the driver's token do.
+type apiKeyTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.next.RoundTrip(req.WithContext(context.WithValue(req.Context(), apiTokenKey{}, t.token)))
+}
+
+// newAPIKeyClient returns a govultr client like the driver's own, which authenticates
+// with token instead and keeps a rate limit of its own as Vultr does for each key
+func (d *VultrDriver) newAPIKeyClient(token string) (*govultr.Client, error) {
+	client := govultr.NewClient(&http.Client{Transport: &apiKeyTransport{token: token, next: d.apiTransport}})
+	client.UserAgent = d.client.UserAgent
+	if err := client.SetBaseURL(d.apiURL); err != nil {
+		return nil, err
+	}
+
+	client.OnRequestCompleted(d.apiRequestCompleted)
+	client.SetRateLimit(d.apiRateLimit)
+	client.SetRetryLimit(d.apiRetryLimit)
+	return client, nil
+}
+
+// apiKeyControllers holds the controller acting in the account of each Vultr API key the
+// CSI secrets of the RPCs carried, keyed by the SHA-256 of the key
+type apiKeyControllers struct {
+	mu          sync.Mutex
+	controllers map[string]*VultrControllerServer
+}
+
+func newAPIKeyControllers() *apiKeyControllers {
+	return &apiKeyControllers{controllers: make(map[string]*VultrControllerServer)}
+}
+
+// forSecrets returns the controller acting with the Vultr API key of the CSI secrets of
+// the RPC, c itself when they hold none, as the secrets of a StorageClass may only hold
+// the passphrase of its encrypted volumes. The controller of a key is made the first time
+// the key is seen and kept. It has its own govultr client, and its own backends and caches
+// of the volumes and instances of the account, but shares the locks and the bookkeeping
+// of the RPCs in flight with c. The RPCs CSI sends no secrets with, ListVolumes and
+// ControllerGetVolume, and the orphan collector only see the account of the driver's token.
+func (c *VultrControllerServer) forSecrets(rpc string, secrets map[string]string) (*VultrControllerServer, error) {
+	token := secrets[apiKeySecret]
+	if token == "" {
+		return c, nil
+	}
+	if c.Driver.apiTransport == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s cannot use the Vultr API key of the secrets with this driver", rpc)
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	c.apiKeys.mu.Lock()
+	defer c.apiKeys.mu.Unlock()
+
+	if account, ok := c.apiKeys.controllers[key]; ok {
+		return account, nil
+	}
+
+	client, err := c.Driver.newAPIKeyClient(token)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%s cannot make a client for the Vultr API key of the secrets: %v", rpc, err)
+	}
+
+	d := *c.Driver
+	d.client = client
+	if d.vfs != nil {
+		d.vfs = &vfsServiceHandler{client: client}
+	}
+	d.log = d.log.WithField("api_key", key[:8])
+
+	account := *c
+	account.Driver = &d
+	account.cloud = d.cloudProvider()
+	account.backends = newBackendRegistry(&d)
+	account.volumes = newVolumeCache(account.backends, volumeCacheTTL)
+	account.nodes = newInstanceCache(account.cloud, instanceCacheTTL)
+	// ListVolumes prunes the orphans missing from the account of the driver's token
+	account.orphans = newOrphanTracker()
+
+	c.apiKeys.controllers[key] = &account
+	apiKeyAccounts.set(float64(len(c.apiKeys.controllers)))
+	d.log.Info("acting with a Vultr API key from CSI secrets")
+
+	return &account, nil
+}
@@ -0,0 +1,109 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/vultr/vultr-csi/internal/fakevultr"
+)
+
+func TestForSecrets(t *testing.T) {
+	const nodeID = "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"
+
+	// each API key reaches an account of its own
+	accounts := map[string]*fakevultr.API{}
+	for _, token := range []string{"driver-key", "billing-key"} {
+		api := fakevultr.New()
+		api.AddRegion("ewr", "block_storage_high_perf", "block_storage_storage_opt")
+		api.AddInstance(nodeID, "ewr", "node", "vc2-1c-1gb")
+		accounts["Bearer "+token] = api
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api, ok := accounts[r.Header.Get("Authorization")]
+		if !ok {
+			http.Error(w, `{"error":"Invalid API token","status":401}`, http.StatusUnauthorized)
+			return
+		}
+		api.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	d, err := NewDriver("", "driver-key", DefaultDriverName, "test", "", srv.URL,
+		WithInstanceIdentity(nodeID, "ewr"), WithAPIPacing(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller := NewVultrControllerServer(d)
+
+	secrets := map[string]string{apiKeySecret: "billing-key"}
+	account, err := controller.forSecrets("CreateVolume", secrets)
+	if err != nil || account == controller {
+		t.Fatalf("expected a controller of the API key of the secrets, got %v", err)
+	}
+	if again, _ := controller.forSecrets("DeleteVolume", secrets); again != account {
+		t.Error("expected the controller of the API key to be kept")
+	}
+	if same, _ := controller.forSecrets("CreateVolume", map[string]string{encryptionPassphraseKey: "passphrase"}); same != controller {
+		t.Error("expected secrets without an API key to use the driver's own")
+	}
+
+	req := &csi.CreateVolumeRequest{
+		Name:       "pvc-billed",
+		Parameters: map[string]string{"block_type": "high_perf"},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		Secrets: secrets,
+	}
+	created, err := controller.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("expected the volume created with the API key of the secrets, got %v", err)
+	}
+	volumeID := created.GetVolume().GetVolumeId()
+
+	if _, err := account.backends.backends[storageTypeBlock].Get(context.Background(), volumeID); err != nil {
+		t.Errorf("expected the volume in the account of the secrets, got %v", err)
+	}
+	if _, err := controller.backends.backends[storageTypeBlock].Get(context.Background(), volumeID); err == nil {
+		t.Error("expected the volume not to be in the account of the driver")
+	}
+
+	retried, err := controller.CreateVolume(context.Background(), req)
+	if err != nil || retried.GetVolume().GetVolumeId() != volumeID {
+		t.Errorf("expected the retry to find the volume in the account of the secrets, got %v", err)
+	}
+
+	validated, err := controller.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           volumeID,
+		VolumeCapabilities: req.VolumeCapabilities,
+		Secrets:            secrets,
+	})
+	if err != nil || validated.GetConfirmed() == nil {
+		t.Errorf("expected the volume validated in the account of the secrets, got %v, %v", validated, err)
+	}
+	if _, err := controller.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           volumeID,
+		VolumeCapabilities: req.VolumeCapabilities,
+	}); err == nil {
+		t.Error("expected the volume not found in the account of the driver")
+	}
+
+	if _, err := controller.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{
+		VolumeId: volumeID,
+		Secrets:  secrets,
+	}); err != nil {
+		t.Errorf("expected the volume modified in the account of the secrets, got %v", err)
+	}
+
+	if _, err := controller.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID, Secrets: secrets}); err != nil {
+		t.Fatalf("expected the volume deleted with the API key of the secrets, got %v", err)
+	}
+	if _, err := account.backends.backends[storageTypeBlock].Get(context.Background(), volumeID); err == nil {
+		t.Error("expected the volume deleted from the account of the secrets")
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// encryptionPassphraseKey is the key of the node stage secret holding the LUKS passphrase
+	encryptionPassphraseKey = "encryptionPassphrase"
+
+	// encryptedMapperPrefix starts the device mapper name of every volume the node decrypts
+	encryptedMapperPrefix = "vultr-csi-"
+
+	// fsTypeLUKS is what blkid reports for a LUKS formatted device
+	fsTypeLUKS = "crypto_LUKS"
+)
+
+// devMapperPath holds the device nodes of the opened device mapper targets
+var devMapperPath = "/dev/mapper"
+
+// isEncrypted reports whether the volume context asks for the volume to be encrypted on the node
+func isEncrypted(volCtx map[string]string) bool {
+	encrypted, err := strconv.ParseBool(volCtx[volumeContextEncrypted])
+	return err == nil && encrypted
+}
+
+// encryptedMapperName is the device mapper name of the decrypted volume
+func encryptedMapperName(volumeID string) string {
+	return encryptedMapperPrefix + volumeID
+}
+
+// openEncryptedDevice opens the LUKS2 mapping of the volume over device and returns the
+// decrypted device, formatting device with LUKS2 first when it is blank. A device holding
+// anything else is refused rather than formatted, so plain text data is never destroyed
+// by turning encryption on for an existing volume.
+func (n *VultrNodeServer) openEncryptedDevice(ctx context.Context, volumeID, device string, secrets map[string]string) (string, error) {
+	name := encryptedMapperName(volumeID)
+	mapped := filepath.Join(devMapperPath, name)
+
+	// already opened by an earlier stage of the volume
+	if _, err := os.Stat(mapped); err == nil {
+		return mapped, nil
+	}
+
+	passphrase := secrets[encryptionPassphraseKey]
+	if passphrase == "" {
+		return "", status.Errorf(codes.InvalidArgument,
+			"NodeStageVolume encrypted volume %s requires the %q node stage secret", volumeID, encryptionPassphraseKey)
+	}
+
+	format, err := n.host.diskFormat(device)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "cannot determine existing format of %s: %v", device, err)
+	}
+
+	log := requestLogger(ctx, n.Driver.log).WithFields(logrus.Fields{
+		"volume": volumeID,
+		"device": device,
+	})
+
+	switch format {
+	case fsTypeLUKS:
+	case "":
+		log.Info("Node Stage Volume: formatting device with LUKS2")
+		if out, err := n.runCommandWithInput(ctx, passphrase,
+			"cryptsetup", "luksFormat", "--type", "luks2", "--batch-mode", "--key-file=-", device); err != nil {
+			if _, ok := status.FromError(err); ok {
+				return "", err
+			}
+			return "", status.Errorf(codes.Internal, "cannot format %s with LUKS2: %v: %s", device, err, out)
+		}
+	default:
+		return "", status.Errorf(codes.FailedPrecondition,
+			"device %s already contains %s data and cannot be encrypted in place", device, format)
+	}
+
+	if out, err := n.runCommandWithInput(ctx, passphrase,
+		"cryptsetup", "open", "--type", "luks2", "--key-file=-", device, name); err != nil {
+		if _, ok := status.FromError(err); ok {
+			return "", err
+		}
+		return "", status.Errorf(codes.Internal, "cannot open LUKS2 device %s: %v: %s", device, err, out)
+	}
+
+	log.WithField("mapped", mapped).Info("Node Stage Volume: encrypted device opened")
+	return mapped, nil
+}
+
+// closeEncryptedDevice closes the LUKS2 mapping of the volume, if the node has one open
+func (n *VultrNodeServer) closeEncryptedDevice(ctx context.Context, volumeID string) error {
+	name := encryptedMapperName(volumeID)
+	if _, err := os.Stat(filepath.Join(devMapperPath, name)); os.IsNotExist(err) {
+		return nil
+	}
+
+	if out, err := n.runCommand(ctx, "cryptsetup", "close", name); err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Errorf(codes.Internal, "cannot close LUKS2 mapping %s: %v: %s", name, err, out)
+	}
+
+	requestLogger(ctx, n.Driver.log).WithField("volume", volumeID).Info("Node Unstage Volume: encrypted device closed")
+	return nil
+}
+
+// resizeEncryptedDevice grows the LUKS2 mapping at device to fill the underlying volume,
+// which the filesystem on top can only grow into afterwards
+func (n *VultrNodeServer) resizeEncryptedDevice(ctx context.Context, device string, secrets map[string]string) error {
+	name := strings.TrimPrefix(device, devMapperPath+"/")
+
+	args := []string{"resize", name}
+	passphrase := secrets[encryptionPassphraseKey]
+	if passphrase != "" {
+		args = append(args, "--key-file=-")
+	}
+
+	if out, err := n.runCommandWithInput(ctx, passphrase, "cryptsetup", args...); err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Errorf(codes.Internal, "cannot resize LUKS2 mapping %s: %v: %s", name, err, out)
+	}
+
+	return nil
+}
+
+// isEncryptedDevice reports whether device is a LUKS2 mapping opened by the node
+func isEncryptedDevice(device string) bool {
+	return strings.HasPrefix(device, filepath.Join(devMapperPath, encryptedMapperPrefix))
+}
@@ -0,0 +1,125 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOpenEncryptedDevice(t *testing.T) {
+	devMapperPath = t.TempDir()
+	defer func() { devMapperPath = "/dev/mapper" }()
+
+	secrets := map[string]string{encryptionPassphraseKey: "hunter2"}
+	mapped := filepath.Join(devMapperPath, "vultr-csi-vol")
+
+	t.Run("blank device", func(t *testing.T) {
+		fe := &fakeExec{exitCodes: map[string]int{"blkid": 2}}
+		n := newFakeMountNode(fe)
+
+		device, err := n.openEncryptedDevice(context.Background(), "vol", "/dev/vdb", secrets)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if device != mapped {
+			t.Errorf("expected %s, got %s", mapped, device)
+		}
+
+		var cryptsetup [][]string
+		for _, c := range fe.run {
+			if c[0] == "cryptsetup" {
+				cryptsetup = append(cryptsetup, c[1:])
+			}
+		}
+		expected := [][]string{
+			{"luksFormat", "--type", "luks2", "--batch-mode", "--key-file=-", "/dev/vdb"},
+			{"open", "--type", "luks2", "--key-file=-", "/dev/vdb", "vultr-csi-vol"},
+		}
+		if !reflect.DeepEqual(cryptsetup, expected) {
+			t.Errorf("expected %v, got %v", expected, cryptsetup)
+		}
+	})
+
+	t.Run("luks device", func(t *testing.T) {
+		fe := &fakeExec{outputs: map[string]string{"blkid": "TYPE=" + fsTypeLUKS}}
+		n := newFakeMountNode(fe)
+
+		if _, err := n.openEncryptedDevice(context.Background(), "vol", "/dev/vdb", secrets); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if args := fe.ran("cryptsetup"); len(args) == 0 || args[0] != "open" {
+			t.Errorf("expected the device to be opened without formatting, got %v", args)
+		}
+	})
+
+	t.Run("plain text device", func(t *testing.T) {
+		fe := &fakeExec{outputs: map[string]string{"blkid": "TYPE=ext4"}}
+		n := newFakeMountNode(fe)
+
+		_, err := n.openEncryptedDevice(context.Background(), "vol", "/dev/vdb", secrets)
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("expected FailedPrecondition, got %v", err)
+		}
+		if args := fe.ran("cryptsetup"); args != nil {
+			t.Errorf("expected cryptsetup not to run, got %v", args)
+		}
+	})
+
+	t.Run("missing passphrase", func(t *testing.T) {
+		n := newFakeMountNode(&fakeExec{})
+
+		_, err := n.openEncryptedDevice(context.Background(), "vol", "/dev/vdb", nil)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument, got %v", err)
+		}
+	})
+
+	t.Run("already open", func(t *testing.T) {
+		if err := os.WriteFile(mapped, nil, mkFileMode); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(mapped)
+
+		fe := &fakeExec{}
+		n := newFakeMountNode(fe)
+
+		device, err := n.openEncryptedDevice(context.Background(), "vol", "/dev/vdb", nil)
+		if err != nil || device != mapped {
+			t.Errorf("expected %s, got %s, %v", mapped, device, err)
+		}
+		if len(fe.run) != 0 {
+			t.Errorf("expected no command to run, got %v", fe.run)
+		}
+	})
+}
+
+func TestCloseEncryptedDevice(t *testing.T) {
+	devMapperPath = t.TempDir()
+	defer func() { devMapperPath = "/dev/mapper" }()
+
+	fe := &fakeExec{}
+	n := newFakeMountNode(fe)
+
+	if err := n.closeEncryptedDevice(context.Background(), "vol"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(fe.run) != 0 {
+		t.Errorf("expected nothing to close, got %v", fe.run)
+	}
+
+	if err := os.WriteFile(filepath.Join(devMapperPath, "vultr-csi-vol"), nil, mkFileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.closeEncryptedDevice(context.Background(), "vol"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if args := fe.ran("cryptsetup"); !reflect.DeepEqual(args, []string{"close", "vultr-csi-vol"}) {
+		t.Errorf("expected the mapping to be closed, got %v", args)
+	}
+}
@@ -0,0 +1,31 @@
+//go:build csisanity
+
+package driver
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/kubernetes-csi/csi-test/v5/pkg/sanity"
+)
+
+// TestCSISanity runs csi-sanity against the driver serving its gRPC services on the fake
+// Vultr API. The suite is not vendored, so the test only builds with the csisanity tag
+// once it is added with go get github.com/kubernetes-csi/csi-test/v5 and go mod vendor.
+func TestCSISanity(t *testing.T) {
+	s := newSanityDriver(t)
+
+	// the fake API numbers its volumes, so the serials the node finds their devices by
+	// are the same and one device serves every volume the suite stages
+	s.addDevice(t, "vdb", "00000000-0000-4000-8000-000000000001")
+
+	config := sanity.NewTestConfig()
+	config.Address = s.address
+	config.TargetPath = filepath.Join(s.dir, "target")
+	config.StagingPath = filepath.Join(s.dir, "staging")
+	config.TestVolumeParameters = map[string]string{blockTypeParam: blockTypeNvme}
+	config.TestVolumeSize = 10 * giB
+	config.IdempotentCount = 2
+
+	sanity.Test(t, config)
+}
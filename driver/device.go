@@ -0,0 +1,317 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultDeviceWaitTimeout is how long staging waits for the device of an attached volume to appear
+	DefaultDeviceWaitTimeout = 30 * time.Second
+
+	// DefaultDeviceRecheckTimeout is how long the node keeps looking for a device after
+	// staging gave up waiting for it
+	DefaultDeviceRecheckTimeout = 5 * time.Minute
+)
+
+const (
+	// deviceCheckInterval is the first pause between looks for a device, doubling up to maxDeviceCheckInterval
+	deviceCheckInterval    = 250 * time.Millisecond
+	maxDeviceCheckInterval = 2 * time.Second
+
+	// udevSettleTimeout bounds each udevadm settle, in seconds
+	udevSettleTimeout = "5"
+
+	// virtioSerialLength is the length virtio truncates disk serials to
+	virtioSerialLength = 20
+)
+
+var (
+	// diskPath holds the links udev names after the serial of each disk, prefixed with diskPrefix
+	diskPath = "/dev/disk/by-id"
+	// sysBlockPath lists the block devices the kernel enumerated, with their virtio serial
+	sysBlockPath = "/sys/block"
+	// devPath holds the device nodes named after the entries of sysBlockPath
+	devPath = "/dev"
+
+	deviceRechecksTotal = metrics.newCounter("device_rechecks_total",
+		"Number of devices looked for after staging gave up waiting, by whether they appeared", "result")
+	deviceAppearanceDuration = metrics.newHistogram("device_appearance_seconds",
+		"Time taken for the device of an attached volume to appear, by how it was found", defaultDurationBuckets, "found_by")
+	deviceSerialsScanned = metrics.newCounter("device_serials_scanned_total",
+		"Number of block device serials read looking for the device of a volume")
+	deviceSerialMismatches = metrics.newCounter("device_serial_mismatches_total",
+		"Number of devices linked by the ID of a volume whose serial identifies another volume")
+)
+
+// How the device of a volume was found, labelling deviceAppearanceDuration
+const (
+	foundByLink   = "link"
+	foundBySerial = "serial"
+	// foundByRecheck is a device found in the background after staging gave up waiting
+	foundByRecheck = "recheck"
+)
+
+// waitForDevice returns the device of the attached volume. A freshly attached virtio disk
+// can take a while to enumerate on a slow hypervisor, and udev a while longer to link it
+// by id, so until the timeout the node looks again with backoff, asks udev to replay the
+// block device events and settle, and falls back to the device whose serial matches the
+// mount ID when the link is still missing. Past the timeout the node keeps looking in the
+// background, which the next attempt waits on rather than starting over.
+func (n *VultrNodeServer) waitForDevice(ctx context.Context, mountID string) (string, error) {
+	log := requestLogger(ctx, n.Driver.log)
+	link := getDeviceByPath(mountID)
+
+	if r := n.rechecks.get(mountID); r != nil {
+		log.WithField("device", link).Info("waiting for the background look for the device of the volume")
+
+		timer := time.NewTimer(n.Driver.deviceWaitTimeout)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", status.FromContextError(ctx.Err()).Err()
+		case <-timer.C:
+			return "", status.Errorf(codes.NotFound, "device %s did not appear after %v, the node is still looking for it",
+				link, n.Driver.deviceWaitTimeout)
+		case <-r.done:
+			timer.Stop()
+			n.rechecks.forget(mountID, r)
+		}
+	}
+
+	start := time.Now()
+	deadline := start.Add(n.Driver.deviceWaitTimeout)
+	interval := deviceCheckInterval
+
+	for attempt := 0; ; attempt++ {
+		if device, foundBy := n.host.findDevice(ctx, log, mountID); device != "" {
+			if foundBy == foundBySerial {
+				log.WithFields(logrus.Fields{
+					"mount_id": mountID,
+					"device":   device,
+				}).Warn("device is not linked by id, using the device with its serial")
+			}
+			deviceAppearanceDuration.observe(time.Since(start).Seconds(), foundBy)
+			log.WithFields(logrus.Fields{
+				"device":   device,
+				"found_by": foundBy,
+				"attempts": attempt + 1,
+				"waited":   time.Since(start).String(),
+			}).Debug("found the device of the volume")
+			return device, nil
+		}
+
+		if !time.Now().Before(deadline) {
+			if n.startDeviceRecheck(mountID, start) {
+				return "", status.Errorf(codes.NotFound, "device %s did not appear after %v, the node keeps looking for it",
+					link, n.Driver.deviceWaitTimeout)
+			}
+			return "", status.Errorf(codes.NotFound, "device %s did not appear after %v", link, n.Driver.deviceWaitTimeout)
+		}
+
+		if attempt == 0 {
+			log.WithField("device", link).Info("waiting for the device of the volume to appear")
+		}
+		log.WithFields(logrus.Fields{
+			"device":  link,
+			"attempt": attempt + 1,
+			"retry":   interval.String(),
+		}).Debug("device of the volume not found, rescanning")
+		n.host.rescanDevices(ctx)
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", status.FromContextError(ctx.Err()).Err()
+		case <-timer.C:
+		}
+
+		if interval *= 2; interval > maxDeviceCheckInterval {
+			interval = maxDeviceCheckInterval
+		}
+	}
+}
+
+// checkLinkSerial logs and counts the link of the mount ID resolving to a disk whose
+// serial identifies another volume, which a stale udev link left by a detach the node
+// did not see would. The link is still used, the check being only for diagnosis.
+func checkLinkSerial(log *logrus.Entry, mountID, link string) {
+	device, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return
+	}
+
+	serial, err := os.ReadFile(filepath.Join(sysBlockPath, filepath.Base(device), "serial"))
+	if err != nil {
+		return
+	}
+
+	if s := strings.TrimSpace(string(serial)); s != "" && !serialMatches(s, mountID) {
+		deviceSerialMismatches.add(1)
+		log.WithFields(logrus.Fields{
+			"mount_id": mountID,
+			"link":     link,
+			"device":   device,
+			"serial":   s,
+		}).Warn("device linked by id has the serial of another volume")
+	}
+}
+
+// serialMatches reports whether the virtio serial identifies the mount ID. virtio
+// truncates serials, so a truncated serial matches its prefix.
+func serialMatches(serial, mountID string) bool {
+	return serial == mountID || (len(serial) == virtioSerialLength && strings.HasPrefix(mountID, serial))
+}
+
+// deviceRechecks are the looks for devices which staging gave up waiting for. kubelet
+// retries staging with backoff, and without them each retry would wait the full timeout
+// from scratch even though udev was asked to rescan all along.
+type deviceRechecks struct {
+	mu     sync.Mutex
+	checks map[string]*deviceRecheck
+}
+
+// deviceRecheck is the look for the device of a mount ID, done once it is found or expired
+type deviceRecheck struct {
+	done chan struct{}
+}
+
+func newDeviceRechecks() *deviceRechecks {
+	return &deviceRechecks{checks: make(map[string]*deviceRecheck)}
+}
+
+// get returns the look for the device of the mount ID, nil when there is none
+func (d *deviceRechecks) get(mountID string) *deviceRecheck {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.checks[mountID]
+}
+
+// start registers a look for the device of the mount ID, returning false when one is
+// already registered
+func (d *deviceRechecks) start(mountID string) (*deviceRecheck, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if r, ok := d.checks[mountID]; ok {
+		return r, false
+	}
+
+	r := &deviceRecheck{done: make(chan struct{})}
+	d.checks[mountID] = r
+	return r, true
+}
+
+// forget drops the finished look for the device of the mount ID
+func (d *deviceRechecks) forget(mountID string, r *deviceRecheck) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.checks[mountID] == r {
+		delete(d.checks, mountID)
+	}
+}
+
+// startDeviceRecheck keeps looking for the device of the mount ID in the background for
+// the recheck timeout, reporting false when rechecks are disabled. since is when staging
+// started waiting for the device.
+func (n *VultrNodeServer) startDeviceRecheck(mountID string, since time.Time) bool {
+	if n.Driver.deviceRecheckTimeout <= 0 {
+		return false
+	}
+
+	if r, started := n.rechecks.start(mountID); started {
+		go n.recheckDevice(mountID, since, r)
+	}
+	return true
+}
+
+func (n *VultrNodeServer) recheckDevice(mountID string, since time.Time, r *deviceRecheck) {
+	defer close(r.done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.Driver.deviceRecheckTimeout)
+	defer cancel()
+
+	log := n.Driver.log.WithField("mount_id", mountID)
+	for {
+		if device, _ := n.host.findDevice(ctx, log, mountID); device != "" {
+			log.WithField("device", device).Info("device of the volume appeared after staging gave up waiting")
+			deviceRechecksTotal.add(1, "found")
+			deviceAppearanceDuration.observe(time.Since(since).Seconds(), foundByRecheck)
+			return
+		}
+
+		n.host.rescanDevices(ctx)
+
+		timer := time.NewTimer(maxDeviceCheckInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Warnf("device of the volume did not appear within %v of staging giving up", n.Driver.deviceRecheckTimeout)
+			deviceRechecksTotal.add(1, "expired")
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// deviceBySerial returns the device whose virtio serial identifies the mount ID, empty
+// when none does
+func deviceBySerial(log *logrus.Entry, mountID string) string {
+	entries, err := os.ReadDir(sysBlockPath)
+	if err != nil {
+		log.Debugf("cannot list block devices: %v", err)
+		return ""
+	}
+
+	serials := make(map[string]string, len(entries))
+	defer func() {
+		deviceSerialsScanned.add(float64(len(serials)))
+		log.WithFields(logrus.Fields{
+			"mount_id": mountID,
+			"serials":  serials,
+		}).Debug("scanned block device serials")
+	}()
+
+	for _, e := range entries {
+		serial, err := os.ReadFile(filepath.Join(sysBlockPath, e.Name(), "serial"))
+		if err != nil {
+			continue
+		}
+
+		s := strings.TrimSpace(string(serial))
+		serials[e.Name()] = s
+		if serialMatches(s, mountID) {
+			device := filepath.Join(devPath, e.Name())
+			if _, err := os.Stat(device); err == nil {
+				return device
+			}
+			log.WithField("device", device).Debugf("block device %s has the serial of the volume but no device node", e.Name())
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,172 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWaitForDeviceBySerial(t *testing.T) {
+	dir := t.TempDir()
+	sysBlock, dev := filepath.Join(dir, "sys"), filepath.Join(dir, "dev")
+	defer func(s, d string) { sysBlockPath, devPath = s, d }(sysBlockPath, devPath)
+	sysBlockPath, devPath = sysBlock, dev
+
+	mountID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	for _, p := range []string{filepath.Join(sysBlock, "vda"), filepath.Join(sysBlock, "vdb"), dev} {
+		if err := os.MkdirAll(p, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(sysBlock, "vda", "serial"): "other-volume",
+		filepath.Join(sysBlock, "vdb", "serial"): mountID[:virtioSerialLength] + "\n",
+		filepath.Join(dev, "vda"):                "",
+		filepath.Join(dev, "vdb"):                "",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fe := &fakeExec{}
+	node := newFakeMountNode(fe)
+	node.Driver.deviceWaitTimeout = time.Second
+
+	device, err := node.waitForDevice(context.Background(), mountID)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if device != filepath.Join(dev, "vdb") {
+		t.Errorf("expected the device with the truncated serial, got %s", device)
+	}
+}
+
+func TestWaitForDeviceTimeout(t *testing.T) {
+	defer func(s string) { sysBlockPath = s }(sysBlockPath)
+	sysBlockPath = t.TempDir()
+
+	fe := &fakeExec{}
+	node := newFakeMountNode(fe)
+	node.Driver.deviceWaitTimeout = 300 * time.Millisecond
+
+	_, err := node.waitForDevice(context.Background(), "missing-volume")
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+
+	if args := fe.ran("udevadm"); len(args) == 0 || args[0] != "trigger" {
+		t.Errorf("expected udev to be asked to replay the block device events, got %v", fe.run)
+	}
+}
+
+func TestWaitForDeviceRecheck(t *testing.T) {
+	dir := t.TempDir()
+	defer func(s, d string) { sysBlockPath, devPath = s, d }(sysBlockPath, devPath)
+	sysBlockPath, devPath = filepath.Join(dir, "sys"), filepath.Join(dir, "dev")
+
+	fe := &fakeExec{}
+	node := newFakeMountNode(fe)
+	node.Driver.deviceWaitTimeout = 300 * time.Millisecond
+	node.Driver.deviceRecheckTimeout = time.Minute
+
+	mountID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	if _, err := node.waitForDevice(context.Background(), mountID); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+
+	r := node.rechecks.get(mountID)
+	if r == nil {
+		t.Fatal("expected the device to be looked for in the background")
+	}
+
+	// the device is hot-plugged after staging gave up waiting
+	if err := os.MkdirAll(filepath.Join(sysBlockPath, "vdb"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(devPath, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(devPath, "vdb"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sysBlockPath, "vdb", "serial"), []byte(mountID[:virtioSerialLength]), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the retry waits on the background look rather than for its own timeout
+	node.Driver.deviceWaitTimeout = 10 * time.Second
+	start := time.Now()
+	device, err := node.waitForDevice(context.Background(), mountID)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if device != filepath.Join(devPath, "vdb") {
+		t.Errorf("expected the hot-plugged device, got %s", device)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the retry to find the device with the background look, took %v", elapsed)
+	}
+
+	<-r.done
+	if node.rechecks.get(mountID) != nil {
+		t.Error("expected the finished background look to be forgotten")
+	}
+}
+
+func TestCheckLinkSerial(t *testing.T) {
+	dir := t.TempDir()
+	defer func(s string) { sysBlockPath = s }(sysBlockPath)
+	sysBlockPath = filepath.Join(dir, "sys")
+
+	mountID := "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	for name, serial := range map[string]string{"vdb": mountID[:virtioSerialLength], "vdc": "bda4f333-7e2b-4c5a-b"} {
+		if err := os.MkdirAll(filepath.Join(sysBlockPath, name), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(sysBlockPath, name, "serial"), []byte(serial+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mismatches := func() float64 {
+		deviceSerialMismatches.mu.Lock()
+		defer deviceSerialMismatches.mu.Unlock()
+		return deviceSerialMismatches.get(nil).value
+	}
+
+	log := newFakeMountNode(&fakeExec{}).Driver.log
+	tests := []struct {
+		name     string
+		device   string
+		mismatch bool
+	}{
+		{name: "link to the disk of the volume", device: "vdb"},
+		{name: "stale link to the disk of another volume", device: "vdc", mismatch: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			link := filepath.Join(dir, "link-"+test.device)
+			if err := os.Symlink(filepath.Join(dir, test.device), link); err != nil {
+				t.Fatal(err)
+			}
+
+			before := mismatches()
+			checkLinkSerial(log, mountID, link)
+			if counted := mismatches() > before; counted != test.mismatch {
+				t.Errorf("expected mismatch %v, counted %v", test.mismatch, counted)
+			}
+		})
+	}
+}
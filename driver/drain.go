@@ -0,0 +1,138 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultDrainTimeout is how long the driver waits for in-flight RPCs once asked to stop,
+// short of the 30 seconds Kubernetes gives a pod before killing it
+const DefaultDrainTimeout = 25 * time.Second
+
+// inflightRPCs tracks the RPCs GRPCLogger is serving, so that a shutdown can report
+// what it is waiting on and what it abandoned
+var inflightRPCs = newInflightCalls()
+
+type inflightCall struct {
+	method   string
+	volumeID string
+	started  time.Time
+}
+
+type inflightCalls struct {
+	now func() time.Time
+
+	mu    sync.Mutex
+	next  uint64
+	calls map[uint64]inflightCall
+}
+
+func newInflightCalls() *inflightCalls {
+	return &inflightCalls{
+		now:   time.Now,
+		calls: make(map[uint64]inflightCall),
+	}
+}
+
+// start records the call until the returned function is called
+func (c *inflightCalls) start(method, volumeID string) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.next
+	c.next++
+	c.calls[id] = inflightCall{method: method, volumeID: volumeID, started: c.now()}
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.calls, id)
+	}
+}
+
+// list describes the calls in flight, the longest running first
+func (c *inflightCalls) list() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	calls := make([]inflightCall, 0, len(c.calls))
+	for _, call := range c.calls {
+		calls = append(calls, call)
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		return calls[i].started.Before(calls[j].started)
+	})
+
+	now := c.now()
+	described := make([]string, 0, len(calls))
+	for _, call := range calls {
+		running := now.Sub(call.started).Round(time.Millisecond)
+		if call.volumeID == "" {
+			described = append(described, fmt.Sprintf("%s for %s", call.method, running))
+			continue
+		}
+		described = append(described, fmt.Sprintf("%s on volume %s for %s", call.method, call.volumeID, running))
+	}
+	return described
+}
+
+// awaitTermination blocks until the process is asked to stop, then stops the background
+// loops with stop, so that none starts a pass against the Vultr API while draining, and
+// drains the server
+func (d *VultrDriver) awaitTermination(server NonBlockingGRPCServer, stop context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	sig := <-signals
+	d.log.WithField("signal", sig.String()).Info("shutting down, no longer accepting RPCs")
+
+	stop()
+	drain(server, d.drainTimeout, d.log)
+}
+
+// drain stops the server from accepting RPCs and waits for those in flight, so that a
+// volume is not left half staged or published, forcing the server to stop after the
+// timeout. Stopping the server closes its listener, which removes the unix socket.
+func drain(server NonBlockingGRPCServer, timeout time.Duration, log *logrus.Entry) {
+	if calls := inflightRPCs.list(); len(calls) > 0 {
+		log.WithField("rpcs", calls).Infof("waiting up to %s for %d in-flight RPCs", timeout, len(calls))
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		server.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		log.Info("in-flight RPCs drained, server stopped")
+	case <-time.After(timeout):
+		log.WithField("rpcs", inflightRPCs.list()).Errorf("in-flight RPCs still running after %s, "+
+			"stopping the server anyway, the volumes they were operating on may need to be checked", timeout)
+		server.ForceStop()
+		<-stopped
+	}
+}
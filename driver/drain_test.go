@@ -0,0 +1,101 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// blockingIdentity answers probes once released or once the call is cancelled
+type blockingIdentity struct {
+	csi.UnimplementedIdentityServer
+	release chan struct{}
+}
+
+func (b *blockingIdentity) Probe(ctx context.Context, _ *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	select {
+	case <-b.release:
+		return &csi.ProbeResponse{}, nil
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		release bool
+		code    codes.Code
+	}{
+		{"drained", time.Minute, true, codes.OK},
+		{"timed out", 50 * time.Millisecond, false, codes.Unavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socket := filepath.Join(t.TempDir(), "csi.sock")
+			identity := &blockingIdentity{release: make(chan struct{})}
+
+			server := NewNonBlockingGRPCServer()
+			server.Start("unix://"+socket, identity, nil, nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			conn, err := grpc.DialContext(ctx, "unix://"+socket, //nolint:staticcheck
+				grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock()) //nolint:staticcheck
+			if err != nil {
+				t.Fatalf("cannot connect to the driver: %v", err)
+			}
+			defer conn.Close()
+
+			probed := make(chan error, 1)
+			go func() {
+				_, err := csi.NewIdentityClient(conn).Probe(ctx, &csi.ProbeRequest{})
+				probed <- err
+			}()
+
+			for len(inflightRPCs.list()) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			drained := make(chan struct{})
+			go func() {
+				drain(server, tt.timeout, logrus.NewEntry(logrus.New()))
+				close(drained)
+			}()
+
+			if tt.release {
+				select {
+				case <-drained:
+					t.Fatal("expected the server to wait for the in-flight probe")
+				case <-time.After(50 * time.Millisecond):
+				}
+				close(identity.release)
+			}
+
+			<-drained
+			server.Wait()
+
+			if err := <-probed; status.Code(err) != tt.code {
+				t.Errorf("expected probe %v, got %v", tt.code, err)
+			}
+			if _, err := os.Stat(socket); !os.IsNotExist(err) {
+				t.Errorf("expected the socket to be removed, got %v", err)
+			}
+			if calls := inflightRPCs.list(); len(calls) != 0 {
+				t.Errorf("expected no RPC in flight, got %v", calls)
+			}
+		})
+	}
+}
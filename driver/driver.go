@@ -17,12 +17,15 @@ package driver
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"os"
 	"time"
 
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/sirupsen/logrus"
 	"github.com/vultr/govultr/v3"
-	"github.com/vultr/metadata"
 	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
 	"k8s.io/mount-utils"
 	"k8s.io/utils/exec"
 )
@@ -30,6 +33,18 @@ import (
 const (
 	DefaultDriverName = "block.csi.vultr.com"
 	defaultTimeout    = 1 * time.Minute
+
+	// DefaultVolumeLabelMaxLength is the longest label the driver gives a Vultr volume by default
+	DefaultVolumeLabelMaxLength = 64
+
+	// DefaultAttachTimeout and DefaultDetachTimeout are how long publish and unpublish wait
+	// for the Vultr API to report the volume attached or detached
+	DefaultAttachTimeout = 30 * time.Second
+	DefaultDetachTimeout = 30 * time.Second
+
+	// DefaultResizeTolerance is the percentage of the capacity required a filesystem may
+	// keep to itself for its metadata and still be reported expanded
+	DefaultResizeTolerance = 5.0
 )
 
 // VultrDriver struct
@@ -38,23 +53,577 @@ type VultrDriver struct {
 	endpoint string
 	nodeID   string
 	region   string
+	hostname string
 	client   *govultr.Client
+	vfs      vfsService
+	// cloud is the provider the controller reaches the cloud through, nil for govultr
+	cloud cloudProvider
+
+	// metadataURL overrides the base URL of the instance metadata service
+	metadataURL string
 
 	publishVolumeID string
 	mountID         string
 
 	isController bool
-	waitTimeout  time.Duration
+	// nodeOnly keeps a plugin with a token from serving the controller service, the token
+	// only being for the calls of the node itself
+	nodeOnly    bool
+	waitTimeout time.Duration
 
 	log *logrus.Entry
+	// logLevel and logFormat configure the driver logs and those of the gRPC calls
+	logLevel  string
+	logFormat string
 
-	mounter *mount.SafeFormatAndMount
-	resizer *mount.ResizeFs
+	mounter nodeMounter
+	resizer fsResizer
+	// exec runs the commands of the node
+	exec exec.Interface
 
 	version string
+	// commit is the commit the driver was built from
+	commit string
+
+	adminAddr  string
+	adminToken string
+
+	volumeLabelPrefix    string
+	volumeLabelMaxLength int
+
+	// clusterID starts the labels and tags the VFS volumes of the cluster
+	clusterID string
+
+	// sidecarLeases are the Leases the sidecars elect their leader under, in leaseNamespace
+	sidecarLeases        []string
+	leaseNamespace       string
+	allowMultiController bool
+	controllerLease      *controllerLease
+
+	maxConcurrentStages int
+
+	maxParallelCreates int
+	maxQueuedCreates   int
+
+	// volumeStatsCacheTTL is how long the node reuses the statistics of a volume path
+	volumeStatsCacheTTL time.Duration
+
+	metricsAddr string
+
+	healthAddr string
+
+	// regionTopologyKey is the authoritative topology key of the region, region when empty
+	regionTopologyKey string
+
+	// grpcMaxConcurrentStreams bounds the RPCs a client runs at once on its connection, 0 when unbounded
+	grpcMaxConcurrentStreams uint32
+	// grpcKeepalive are the keepalive pings of the server and those it accepts from clients
+	grpcKeepalive grpcKeepalive
+	// socketMode and socketOwner are set on the unix socket of the endpoint, left as
+	// created when 0 and nil
+	socketMode  os.FileMode
+	socketOwner *dirOwner
+
+	targetDirMode  os.FileMode
+	targetDirOwner *dirOwner
+
+	fsckOnStage bool
+
+	// defaultFsType formats volumes whose capability and StorageClass name no filesystem
+	defaultFsType string
+
+	maxVolumesPerNode    int
+	blockDiskSlots       int
+	maxVFSVolumesPerNode int
+
+	maintenanceBackoff time.Duration
+	maintenance        *maintenanceMode
+
+	// apiHooks are told of every Vultr API request, the default metrics one first
+	apiHooks []APIRequestHook
+
+	apiRecordPath     string
+	apiRecordMaxBytes int64
+
+	// auditLogPath is where the audit records are appended, - for stdout
+	auditLogPath string
+	audit        *auditLog
+
+	dryRun bool
+	// simulate answers the Vultr API calls from an in-memory API, making up the credentials
+	simulate bool
+
+	// strictSpec enforces the validations and error codes of the CSI spec rigorously
+	strictSpec bool
+
+	// featureGateSpec is the --feature-gates list, parsed into features
+	featureGateSpec string
+	features        featureGates
+
+	nodeAttachVFS bool
+
+	// ephemeralVolumes lets the node provision the inline volumes of pods at publish
+	ephemeralVolumes bool
+
+	// resizeTolerance is the percentage of the capacity required an expanded filesystem
+	// may fall short of
+	resizeTolerance float64
+
+	// usageEventThreshold is the percentage of bytes or inodes used above which the node
+	// posts an event on the claim of the volume, 0 when disabled
+	usageEventThreshold float64
+
+	// unstageForceUnmount lets unstage unmount the publish mounts still referencing the staged filesystem
+	unstageForceUnmount bool
+	// vfsDisabled drops the vfs storage type, for accounts and regions without VFS
+	vfsDisabled bool
+
+	attachTimeout time.Duration
+	detachTimeout time.Duration
+
+	// drainTimeout bounds how long a stopping driver waits for in-flight RPCs
+	drainTimeout time.Duration
+
+	deviceWaitTimeout    time.Duration
+	deviceRecheckTimeout time.Duration
+
+	apiRateLimit  time.Duration
+	apiRetryLimit int
+	// apiTimeout bounds each Vultr API request, 0 leaves them bound by the RPC deadline
+	apiTimeout time.Duration
+
+	// apiURL is the base URL the Vultr API is reached at
+	apiURL string
+	// apiTransport is the transport of the client, which the clients of the API keys from
+	// CSI secrets send their requests through too
+	apiTransport http.RoundTripper
+	// apiCABundle is a PEM file of CA certificates trusted for the Vultr API besides the system ones
+	apiCABundle string
+
+	apiRequestRate       float64
+	apiRequestBurst      int
+	apiThrottleThreshold time.Duration
+	apiLimiter           *apiRequestLimiter
+
+	apiBreakerThreshold      int
+	apiBreakerOpenTimeout    time.Duration
+	apiBreakerMaxOpenTimeout time.Duration
+	apiBreaker               *apiCircuitBreaker
+
+	detachFromDeletedNodes bool
+
+	// deleteForceDetach lets DeleteVolume detach volumes still attached after deleteForceDetachGrace
+	deleteForceDetach      bool
+	deleteForceDetachGrace time.Duration
+	// forceDetachAfter is how long ControllerUnpublishVolume keeps failing to detach a
+	// volume before forcing it, 0 never forces
+	forceDetachAfter time.Duration
+
+	shutdownDetachInterval time.Duration
+
+	// gcInterval is how often the controller looks for orphaned volumes, 0 disables
+	gcInterval    time.Duration
+	gcMode        string
+	gcGracePeriod time.Duration
+
+	// webhookURL is where volume events are POSTed, signed with webhookSecret
+	webhookURL    string
+	webhookSecret string
+	events        *eventWebhook
+
+	// tracingEndpoint is the OTLP/HTTP collector the spans are sent to, tracing is off when empty
+	tracingEndpoint string
+	tracer          *tracer
+
+	// ioStatsInterval is how often the node plugin exports the IO counters of the
+	// staged volumes
+	ioStatsInterval time.Duration
+
+	// vfsMonitorInterval is how often the node plugin probes the virtiofs mounts of the
+	// staged vfs volumes
+	vfsMonitorInterval time.Duration
+
+	// volumeStatusInterval is how often volume status documents are published to claims
+	volumeStatusInterval time.Duration
+
+	// nodeLabelsInterval is how often the Kubernetes Node kubeNodeName is labeled with the
+	// attach limit and staged volumes of the node
+	nodeLabelsInterval time.Duration
+	kubeNodeName       string
+
+	// kubeletDir is the root directory of kubelet the node RPCs paths are under, and
+	// kubeletDirs it and where it resolves to, empty when the paths are not checked
+	kubeletDir       string
+	kubeletDirs      []string
+	registrationPath string
+
+	// stagingCleanup cleans up the stale staging paths under kubeletDir as the node plugin starts
+	stagingCleanup bool
+
+	blockStorageQuotaBytes int64
+
+	// allowedRegions are the only regions volumes are provisioned in, parsed from
+	// allowedRegionList, nil when any region is
+	allowedRegionList string
+	allowedRegions    map[string]bool
+
+	// namespaceMaxVolumeBytes caps the size of the volumes of each namespace, parsed from namespaceSizePolicy
+	namespaceSizePolicy     string
+	namespaceMaxVolumeBytes map[string]int64
+}
+
+// dirOwner is the ownership given to the staging and target directories the node creates,
+// and to the socket of the endpoint
+type dirOwner struct {
+	uid int
+	gid int
+}
+
+// grpcKeepalive configures the keepalive pings of the gRPC server, gRPC defaults
+// applying to zero durations
+type grpcKeepalive struct {
+	// time and timeout are how long the server waits on an idle connection before it
+	// pings the client, and then for the ping to be acknowledged
+	time    time.Duration
+	timeout time.Duration
+	// minTime is how often clients may ping, permitWithoutStream whether they may ping
+	// connections without RPCs in flight, clients pinging otherwise being disconnected
+	minTime             time.Duration
+	permitWithoutStream bool
+}
+
+// Option configures optional behaviour of the VultrDriver
+type Option func(*VultrDriver)
+
+// WithAdminServer enables the admin HTTP API on addr, guarded by token
+func WithAdminServer(addr, token string) Option {
+	return func(d *VultrDriver) {
+		d.adminAddr = addr
+		d.adminToken = token
+	}
+}
+
+// WithVolumeLabel sets the prefix added to volume labels and the maximum label length
+func WithVolumeLabel(prefix string, maxLength int) Option {
+	return func(d *VultrDriver) {
+		d.volumeLabelPrefix = prefix
+		d.volumeLabelMaxLength = maxLength
+	}
+}
+
+// WithMaxConcurrentStages limits how many volumes the node formats and mounts at once, 0 is unlimited
+func WithMaxConcurrentStages(n int) Option {
+	return func(d *VultrDriver) {
+		d.maxConcurrentStages = n
+	}
+}
+
+// WithVolumeStatsCacheTTL sets how long NodeGetVolumeStats answers from the statistics it
+// last measured of a volume path, 0 measures on every call
+func WithVolumeStatsCacheTTL(ttl time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.volumeStatsCacheTTL = ttl
+	}
+}
+
+// WithMetricsAddr serves Prometheus metrics on addr, disabled when empty
+func WithMetricsAddr(addr string) Option {
+	return func(d *VultrDriver) {
+		d.metricsAddr = addr
+	}
+}
+
+// WithHealthAddr serves HTTP liveness and readiness probes on addr, disabled when empty
+func WithHealthAddr(addr string) Option {
+	return func(d *VultrDriver) {
+		d.healthAddr = addr
+	}
+}
+
+// WithGRPCMaxConcurrentStreams bounds the RPCs each client runs at once on its
+// connection, unbounded when 0
+func WithGRPCMaxConcurrentStreams(streams uint) Option {
+	return func(d *VultrDriver) {
+		d.grpcMaxConcurrentStreams = uint32(streams)
+	}
+}
+
+// WithGRPCKeepalive sets how long the gRPC server waits on an idle connection before it
+// pings the client and for the ping to be acknowledged, and enforces how often clients
+// may ping, with or without RPCs in flight. Zero durations keep the gRPC defaults.
+func WithGRPCKeepalive(idleTime, timeout, minClientTime time.Duration, permitWithoutStream bool) Option {
+	return func(d *VultrDriver) {
+		d.grpcKeepalive = grpcKeepalive{time: idleTime, timeout: timeout, minTime: minClientTime, permitWithoutStream: permitWithoutStream}
+	}
+}
+
+// WithSocketPermissions sets the mode and ownership of the unix socket of the endpoint,
+// for kubelets and sidecars not running as root. A mode of 0 leaves the mode the umask
+// gives, and a uid or gid of -1 leaves that id unchanged.
+func WithSocketPermissions(mode os.FileMode, uid, gid int) Option {
+	return func(d *VultrDriver) {
+		d.socketMode = mode
+		if uid >= 0 || gid >= 0 {
+			d.socketOwner = &dirOwner{uid: uid, gid: gid}
+		}
+	}
+}
+
+// WithStrictSpec enforces the validations and error codes of the CSI spec rigorously,
+// rejecting requests the driver otherwise tolerates such as unknown StorageClass
+// parameters or unsupported capabilities reaching the node
+func WithStrictSpec(enabled bool) Option {
+	return func(d *VultrDriver) {
+		d.strictSpec = enabled
+	}
+}
+
+// WithTargetDirectory sets the mode and ownership of the staging and target directories the
+// node creates. A uid or gid of -1 leaves that id unchanged.
+func WithTargetDirectory(mode os.FileMode, uid, gid int) Option {
+	return func(d *VultrDriver) {
+		d.targetDirMode = mode
+		if uid >= 0 || gid >= 0 {
+			d.targetDirOwner = &dirOwner{uid: uid, gid: gid}
+		}
+	}
+}
+
+// WithFsckOnStage checks existing filesystems before they are staged, unless the volume's
+// StorageClass sets the fsck parameter
+func WithFsckOnStage(enabled bool) Option {
+	return func(d *VultrDriver) {
+		d.fsckOnStage = enabled
+	}
+}
+
+// WithDefaultFsType sets the filesystem volumes are formatted with when neither their
+// capability nor their StorageClass names one
+func WithDefaultFsType(fsType string) Option {
+	return func(d *VultrDriver) {
+		d.defaultFsType = fsType
+	}
+}
+
+// WithMaxVolumesPerNode overrides the number of volumes the node reports it can attach,
+// 0 derives it from the instance plan
+func WithMaxVolumesPerNode(n int) Option {
+	return func(d *VultrDriver) {
+		d.maxVolumesPerNode = n
+	}
+}
+
+// WithVolumeSlots sets the block disk slots of an instance, which the local disks of its
+// plan and attached block storage share, and the VFS volumes the node attaches besides,
+// from which the node derives the number of volumes it reports it can attach
+func WithVolumeSlots(blockDiskSlots, vfsVolumes int) Option {
+	return func(d *VultrDriver) {
+		d.blockDiskSlots = blockDiskSlots
+		d.maxVFSVolumesPerNode = vfsVolumes
+	}
+}
+
+// WithMaintenanceBackoff sets how long API calls are held off after the Vultr API reports
+// maintenance, 0 disables maintenance mode
+func WithMaintenanceBackoff(backoff time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.maintenanceBackoff = backoff
+	}
+}
+
+// WithAPIRecording records sanitized Vultr API exchanges to path, rotating it once it
+// reaches maxBytes. Recording is disabled when path is empty.
+func WithAPIRecording(path string, maxBytes int64) Option {
+	return func(d *VultrDriver) {
+		d.apiRecordPath = path
+		d.apiRecordMaxBytes = maxBytes
+	}
+}
+
+// WithDryRun makes the controller validate requests and log the Vultr API calls which
+// would change anything instead of sending them
+func WithDryRun(enabled bool) Option {
+	return func(d *VultrDriver) {
+		d.dryRun = enabled
+	}
+}
+
+// WithFeatureGates turns the features named in a comma separated list of Feature=bool
+// pairs on or off, such as Snapshots=true,RawBlock=false
+func WithFeatureGates(spec string) Option {
+	return func(d *VultrDriver) {
+		d.featureGateSpec = spec
+	}
+}
+
+// WithNodeAttachVFS makes the node plugin attach VFS volumes at stage and detach them at
+// unstage, for deployments whose CSIDriver sets attachRequired to false
+func WithNodeAttachVFS(enabled bool) Option {
+	return func(d *VultrDriver) {
+		d.nodeAttachVFS = enabled
+	}
+}
+
+// WithNodeOnly makes the plugin serve the node service alone, as the node plugin of a
+// cluster whose controller runs separately, even with the token some node features need
+func WithNodeOnly(enabled bool) Option {
+	return func(d *VultrDriver) {
+		d.nodeOnly = enabled
+	}
+}
+
+// servesController reports whether the plugin serves the controller service
+func (d *VultrDriver) servesController() bool {
+	return d.isController && !d.nodeOnly
+}
+
+// WithEphemeralVolumes makes the node plugin provision the inline volumes pods declare,
+// creating and attaching them at publish and deleting them at unpublish
+func WithEphemeralVolumes(enabled bool) Option {
+	return func(d *VultrDriver) {
+		d.ephemeralVolumes = enabled
+	}
+}
+
+// WithUsageEvents makes the node plugin post a Warning event on the claim of a volume
+// whose bytes or inodes NodeGetVolumeStats finds used above threshold percent
+func WithUsageEvents(threshold float64) Option {
+	return func(d *VultrDriver) {
+		d.usageEventThreshold = threshold
+	}
+}
+
+// WithResizeTolerance sets the percentage of the capacity required by which a filesystem
+// NodeExpandVolume grew may fall short of it before the expansion fails with OutOfRange
+func WithResizeTolerance(percent float64) Option {
+	return func(d *VultrDriver) {
+		d.resizeTolerance = percent
+	}
+}
+
+// WithUnstageForceUnmount makes NodeUnstageVolume unmount the publish mounts still
+// referencing the staged filesystem, rather than failing with FailedPrecondition
+func WithUnstageForceUnmount(enabled bool) Option {
+	return func(d *VultrDriver) {
+		d.unstageForceUnmount = enabled
+	}
+}
+
+// WithVFS enables the vfs storage type, which is enabled by default. Disabled, the
+// controller rejects vfs volumes and never calls the VFS API, and the node refuses to
+// mount them over virtiofs.
+func WithVFS(enabled bool) Option {
+	return func(d *VultrDriver) {
+		d.vfsDisabled = !enabled
+	}
+}
+
+// WithAttachTimeouts sets how long publish waits for the Vultr API to report a volume
+// attached, and unpublish for it to report it detached
+func WithAttachTimeouts(attach, detach time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.attachTimeout = attach
+		d.detachTimeout = detach
+	}
+}
+
+// WithDrainTimeout sets how long the driver waits for in-flight RPCs to complete once
+// asked to stop before it stops anyway
+func WithDrainTimeout(timeout time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.drainTimeout = timeout
+	}
 }
 
-func NewDriver(endpoint, token, driverName, version, userAgent, apiURL string) (*VultrDriver, error) {
+// WithDeviceWaitTimeout sets how long staging waits for the device of an attached volume to appear
+func WithDeviceWaitTimeout(timeout time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.deviceWaitTimeout = timeout
+	}
+}
+
+// WithDeviceRecheckTimeout sets how long the node keeps looking for a device after
+// staging gave up waiting for it, so a retry finds it at once, 0 disables
+func WithDeviceRecheckTimeout(timeout time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.deviceRecheckTimeout = timeout
+	}
+}
+
+// WithAPIPacing sets the minimum pause between Vultr API requests and how many times a
+// failed request is retried
+func WithAPIPacing(rateLimit time.Duration, retryLimit int) Option {
+	return func(d *VultrDriver) {
+		d.apiRateLimit = rateLimit
+		d.apiRetryLimit = retryLimit
+	}
+}
+
+// WithAPIRequestLimit sets how many Vultr API requests per second the driver sends at
+// most, up to burst at once after being idle. A rate of 0 lifts the limit, the driver
+// still holding off the API when it throttles.
+func WithAPIRequestLimit(rate float64, burst int) Option {
+	return func(d *VultrDriver) {
+		d.apiRequestRate = rate
+		d.apiRequestBurst = burst
+	}
+}
+
+// WithAPIThrottleThreshold sets how long the Vultr API throttles the driver before
+// controller RPCs fail fast with Unavailable, 0 disables
+func WithAPIThrottleThreshold(threshold time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.apiThrottleThreshold = threshold
+	}
+}
+
+// WithAPICircuitBreaker sets how many Vultr API requests in a row fail before controller
+// RPCs fail fast with Unavailable, for openTimeout at first and doubling up to
+// maxOpenTimeout as the API keeps failing, 0 disables
+func WithAPICircuitBreaker(threshold int, openTimeout, maxOpenTimeout time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.apiBreakerThreshold = threshold
+		d.apiBreakerOpenTimeout = openTimeout
+		d.apiBreakerMaxOpenTimeout = maxOpenTimeout
+	}
+}
+
+// WithDetachFromDeletedNodes lets publish detach a volume from the instance it is attached
+// to when that instance no longer exists, as after a node was deleted or recreated, and
+// attach it to the requested node instead of failing. Enabled by default.
+func WithDetachFromDeletedNodes(enabled bool) Option {
+	return func(d *VultrDriver) {
+		d.detachFromDeletedNodes = enabled
+	}
+}
+
+// WithShutdownDetach makes the controller look for Kubernetes nodes tainted as shut down
+// every interval and detach their volumes, 0 disables
+func WithShutdownDetach(interval time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.shutdownDetachInterval = interval
+	}
+}
+
+// WithVolumeStatus publishes a status document of each volume to an annotation of its
+// PersistentVolumeClaim every interval, from the controller and from the nodes staging
+// it, 0 disables
+func WithVolumeStatus(interval time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.volumeStatusInterval = interval
+	}
+}
+
+// WithBlockStorageQuota sets the block storage, in GB, the Vultr account may provision
+// in total, which GetCapacity reports what is left of. 0 leaves the quota unknown.
+func WithBlockStorageQuota(gb int) Option {
+	return func(d *VultrDriver) {
+		d.blockStorageQuotaBytes = int64(gb) * giB
+	}
+}
+
+// NewDriver returns a configured VultrDriver
+func NewDriver(endpoint, token, driverName, version, customUserAgent, apiURL string, opts ...Option) (*VultrDriver, error) { //nolint:lll
 	if driverName == "" {
 		driverName = DefaultDriverName
 	}
@@ -62,15 +631,12 @@ func NewDriver(endpoint, token, driverName, version, userAgent, apiURL string) (
 	ctx := context.Background()
 	config := &oauth2.Config{}
 	ts := config.TokenSource(ctx, &oauth2.Token{AccessToken: token})
-	client := govultr.NewClient(oauth2.NewClient(ctx, ts))
+	// the base transport is only known once the options are applied
+	auth := &oauth2.Transport{Source: ts}
+	httpClient := &http.Client{Transport: &apiTokenTransport{auth: auth}}
+	client := govultr.NewClient(httpClient)
 
-	client.UserAgent = "csi-vultr/" + version
-
-	if userAgent != "" {
-		client.UserAgent = fmt.Sprintf("csi-vultr/%s/%s", version, userAgent)
-	} else {
-		client.UserAgent = "csi-vultr/" + version
-	}
+	client.UserAgent = userAgent(version, customUserAgent)
 
 	if apiURL != "" {
 		if err := client.SetBaseURL(apiURL); err != nil {
@@ -78,49 +644,491 @@ func NewDriver(endpoint, token, driverName, version, userAgent, apiURL string) (
 		}
 	}
 
-	c := metadata.NewClient()
-	meta, err := c.Metadata()
-	if err != nil {
-		return nil, err
-	}
-
-	log := logrus.New().WithFields(logrus.Fields{
-		"region":  meta.Region.RegionCode,
-		"host_id": meta.InstanceV2ID,
-		"version": version,
-	})
+	log := logrus.New().WithField("version", version)
 
-	return &VultrDriver{
+	d := &VultrDriver{
 		name:     driverName,
 		endpoint: endpoint,
-		nodeID:   meta.InstanceV2ID,
-		region:   meta.Region.RegionCode,
 		client:   client,
+		vfs:      &vfsServiceHandler{client: client},
 
 		isController: token != "",
 		waitTimeout:  defaultTimeout,
 
-		log: log,
+		volumeLabelMaxLength: DefaultVolumeLabelMaxLength,
+
+		targetDirMode: mkDirMode,
+
+		defaultFsType: defaultFsType,
+
+		maintenanceBackoff: DefaultMaintenanceBackoff,
+
+		volumeStatsCacheTTL: DefaultVolumeStatsCacheTTL,
+
+		gcMode:        GCModeReport,
+		gcGracePeriod: DefaultGCGracePeriod,
+
+		maxParallelCreates: DefaultMaxParallelCreates,
+		maxQueuedCreates:   DefaultMaxQueuedCreates,
+
+		apiRequestRate:       DefaultAPIRequestRate,
+		apiRequestBurst:      DefaultAPIRequestBurst,
+		apiThrottleThreshold: DefaultAPIThrottleThreshold,
+
+		apiBreakerThreshold:      DefaultAPIBreakerThreshold,
+		apiBreakerOpenTimeout:    DefaultAPIBreakerOpenTimeout,
+		apiBreakerMaxOpenTimeout: DefaultAPIBreakerMaxOpenTimeout,
+
+		apiRecordMaxBytes: DefaultAPIRecordMaxBytes,
+
+		attachTimeout: DefaultAttachTimeout,
+		detachTimeout: DefaultDetachTimeout,
+
+		blockDiskSlots: DefaultBlockDiskSlots,
+
+		resizeTolerance: DefaultResizeTolerance,
+
+		detachFromDeletedNodes: true,
+		deleteForceDetachGrace: DefaultDeleteForceDetachGrace,
+
+		drainTimeout: DefaultDrainTimeout,
+
+		deviceWaitTimeout:    DefaultDeviceWaitTimeout,
+		deviceRecheckTimeout: DefaultDeviceRecheckTimeout,
+
+		apiRateLimit:  DefaultAPIRateLimit,
+		apiRetryLimit: DefaultAPIRetryLimit,
+		apiTimeout:    DefaultAPITimeout,
+
+		log:       log,
+		logLevel:  DefaultLogLevel,
+		logFormat: LogFormatText,
 		mounter: &mount.SafeFormatAndMount{
 			Interface: mount.New(""),
-			Exec:      exec.New(),
+			Exec:      newHelperExec(),
 		},
-
-		resizer: mount.NewResizeFs(mount.SafeFormatAndMount{
-			Interface: mount.New(""),
-			Exec:      exec.New(),
-		}.Exec),
+		resizer: mount.NewResizeFs(newHelperExec()),
+		exec:    newHelperExec(),
 
 		version: version,
-	}, nil
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	// GRPCLogger logs the calls with the standard logger
+	for _, logger := range []*logrus.Logger{log.Logger, logrus.StandardLogger()} {
+		if err := configureLogger(logger, d.logLevel, d.logFormat); err != nil {
+			return nil, err
+		}
+	}
+
+	features, err := parseFeatureGates(d.featureGateSpec)
+	if err != nil {
+		return nil, err
+	}
+	d.features = features
+
+	if d.simulate {
+		if d.dryRun {
+			return nil, fmt.Errorf("dry run and API simulation cannot be enabled together")
+		}
+		d.isController = true
+		if d.nodeID == "" && d.region == "" {
+			d.nodeID, d.region = simulatedNodeID, simulatedRegion
+		}
+	}
+
+	if err := d.discoverInstance(); err != nil {
+		return nil, err
+	}
+	log = log.WithFields(logrus.Fields{
+		"region":  d.region,
+		"host_id": d.nodeID,
+	})
+	d.log = log
+
+	if err := d.validateKubeletDir(); err != nil {
+		return nil, err
+	}
+
+	if d.adminAddr != "" && d.adminToken == "" {
+		return nil, fmt.Errorf("an admin token is required when the admin server is enabled")
+	}
+
+	if d.vfsDisabled {
+		if d.nodeAttachVFS {
+			return nil, fmt.Errorf("the node cannot attach vfs volumes with vfs disabled")
+		}
+		d.vfs = nil
+	}
+
+	if d.nodeAttachVFS && !d.isController {
+		return nil, fmt.Errorf("an API token is required for the node to attach vfs volumes")
+	}
+
+	if d.ephemeralVolumes && !d.isController {
+		return nil, fmt.Errorf("an API token is required for the node to provision ephemeral volumes")
+	}
+
+	if d.resizeTolerance < 0 || d.resizeTolerance > 100 {
+		return nil, fmt.Errorf("resize tolerance %v must be a percentage between 0 and 100", d.resizeTolerance)
+	}
+
+	if d.usageEventThreshold < 0 || d.usageEventThreshold > 100 {
+		return nil, fmt.Errorf("usage event threshold %v must be a percentage between 0 and 100", d.usageEventThreshold)
+	}
+
+	if err := d.validateGRPCServer(); err != nil {
+		return nil, err
+	}
+
+	if err := d.validateTopologyRegionKey(); err != nil {
+		return nil, err
+	}
+
+	if d.targetDirMode&^os.ModePerm != 0 || d.targetDirMode&0100 == 0 {
+		return nil, fmt.Errorf("target directory mode %#o must be permission bits traversable by the owner", d.targetDirMode)
+	}
+
+	fsType, err := resolveFsType(d.defaultFsType, defaultFsType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default filesystem: %w", err)
+	}
+	d.defaultFsType = fsType
+
+	if d.maintenanceBackoff < 0 {
+		return nil, fmt.Errorf("maintenance backoff must not be negative")
+	}
+
+	base, err := newAPITransport(d.apiCABundle)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Vultr API CA bundle: %w", err)
+	}
+	auth.Base = &apiLatencyTransport{next: base}
+	if d.simulate {
+		// no token is needed, nor sent anywhere
+		httpClient.Transport = &apiLatencyTransport{next: newSimulatedTransport(d.region, log)}
+		log.Warn("simulating the Vultr API: no call reaches Vultr and the volumes only exist in memory")
+	}
+	d.apiURL = client.BaseURL.String()
+	if proxy := apiProxy(base, client.BaseURL); proxy != "" {
+		log.WithField("proxy", proxy).Info("Vultr API requests go through a proxy")
+	}
+
+	d.maintenance = newMaintenanceMode(d.maintenanceBackoff, log)
+	d.apiHooks = append([]APIRequestHook{apiRequestMetrics{log: log}}, d.apiHooks...)
+	client.OnRequestCompleted(d.apiRequestCompleted)
+
+	if d.attachTimeout <= 0 || d.detachTimeout <= 0 {
+		return nil, fmt.Errorf("attach and detach timeouts must be positive")
+	}
+
+	if d.deleteForceDetachGrace < 0 {
+		return nil, fmt.Errorf("delete force detach grace must not be negative")
+	}
+
+	if d.forceDetachAfter < 0 {
+		return nil, fmt.Errorf("force detach timeout must not be negative")
+	}
+
+	if d.drainTimeout <= 0 {
+		return nil, fmt.Errorf("drain timeout must be positive")
+	}
+
+	if d.deviceWaitTimeout < 0 || d.deviceRecheckTimeout < 0 {
+		return nil, fmt.Errorf("device wait and recheck timeouts must not be negative")
+	}
+
+	if d.apiRateLimit < 0 || d.apiRetryLimit < 0 {
+		return nil, fmt.Errorf("API rate and retry limits must not be negative")
+	}
+	client.SetRateLimit(d.apiRateLimit)
+	client.SetRetryLimit(d.apiRetryLimit)
+
+	if d.apiTimeout < 0 {
+		return nil, fmt.Errorf("API timeout must not be negative")
+	}
+	httpClient.Transport = newTimeoutTransport(httpClient.Transport, d.apiTimeout)
+
+	if d.apiBreakerThreshold < 0 {
+		return nil, fmt.Errorf("API circuit breaker threshold must not be negative")
+	}
+	if d.apiBreakerThreshold > 0 && (d.apiBreakerOpenTimeout <= 0 || d.apiBreakerMaxOpenTimeout < d.apiBreakerOpenTimeout) {
+		return nil, fmt.Errorf("API circuit breaker open timeout must be positive and at most its max open timeout")
+	}
+	d.apiBreaker = newAPICircuitBreaker(d.apiBreakerThreshold, d.apiBreakerOpenTimeout, d.apiBreakerMaxOpenTimeout, log)
+	httpClient.Transport = d.apiBreaker.transport(httpClient.Transport)
+
+	if d.apiRequestRate < 0 || d.apiThrottleThreshold < 0 {
+		return nil, fmt.Errorf("API request rate and throttle threshold must not be negative")
+	}
+	if d.apiRequestRate > 0 && d.apiRequestBurst < 1 {
+		return nil, fmt.Errorf("API request burst must be at least 1")
+	}
+	d.apiLimiter = newAPIRequestLimiter(d.apiRequestRate, d.apiRequestBurst, d.apiThrottleThreshold, log)
+	httpClient.Transport = d.apiLimiter.transport(httpClient.Transport)
+
+	if d.shutdownDetachInterval < 0 {
+		return nil, fmt.Errorf("shutdown detach interval must not be negative")
+	}
+
+	if d.shutdownDetachInterval > 0 && !d.isController {
+		return nil, fmt.Errorf("an API token is required to detach volumes from shut down nodes")
+	}
+
+	if err := d.validateOrphanCollection(); err != nil {
+		return nil, err
+	}
+
+	if d.nodeOnly && (d.shutdownDetachInterval > 0 || d.gcInterval > 0) {
+		return nil, fmt.Errorf("the controller detaches volumes from shut down nodes and collects orphaned volumes, a node-only plugin does not")
+	}
+
+	if d.volumeStatusInterval < 0 {
+		return nil, fmt.Errorf("volume status interval must not be negative")
+	}
+
+	if d.nodeLabelsInterval < 0 {
+		return nil, fmt.Errorf("node labels interval must not be negative")
+	}
+
+	if d.ioStatsInterval < 0 {
+		return nil, fmt.Errorf("volume IO stats interval must not be negative")
+	}
+
+	if d.vfsMonitorInterval < 0 {
+		return nil, fmt.Errorf("vfs mount monitor interval must not be negative")
+	}
+
+	if d.blockStorageQuotaBytes < 0 {
+		return nil, fmt.Errorf("block storage quota must not be negative")
+	}
+
+	if d.namespaceMaxVolumeBytes, err = parseNamespaceSizePolicy(d.namespaceSizePolicy); err != nil {
+		return nil, err
+	}
+
+	if d.allowedRegions, err = parseAllowedRegions(d.allowedRegionList); err != nil {
+		return nil, err
+	}
+
+	if d.maxVolumesPerNode < 0 {
+		return nil, fmt.Errorf("max volumes per node must not be negative")
+	}
+
+	if d.blockDiskSlots < 1 {
+		return nil, fmt.Errorf("block disk slots must be at least 1")
+	}
+
+	if d.maxVFSVolumesPerNode < 0 {
+		return nil, fmt.Errorf("max vfs volumes per node must not be negative")
+	}
+
+	if d.maxConcurrentStages < 0 {
+		return nil, fmt.Errorf("max concurrent stages must not be negative")
+	}
+
+	if d.maxParallelCreates < 0 || d.maxQueuedCreates < 0 {
+		return nil, fmt.Errorf("max parallel and queued creates must not be negative")
+	}
+
+	if d.volumeStatsCacheTTL < 0 {
+		return nil, fmt.Errorf("volume stats cache TTL must not be negative")
+	}
+
+	if err := validateClusterID(d.clusterID); err != nil {
+		return nil, err
+	}
+
+	// the hash of a label too long must leave the prefix the orphan collector tells the
+	// inline volumes apart with
+	if d.volumeLabelMaxLength <= len(d.volumeLabelPrefix)+len(d.clusterVolumeName(inlineVolumePrefix))+volumeLabelHashLength+1 {
+		return nil, fmt.Errorf("volume label max length %d is too short for prefix %q and cluster ID %q",
+			d.volumeLabelMaxLength, d.volumeLabelPrefix, d.clusterID)
+	}
+
+	if d.webhookURL != "" {
+		if d.events, err = newEventWebhook(d); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.tracingEndpoint != "" {
+		if d.tracer, err = newTracer(d); err != nil {
+			return nil, err
+		}
+		d.apiHooks = append(d.apiHooks, d.tracer)
+	}
+
+	if d.dryRun {
+		httpClient.Transport = newDryRunTransport(httpClient.Transport, log)
+		log.Warn("dry run mode: Vultr API calls which change anything are logged and not sent")
+	}
+
+	if d.apiRecordPath != "" {
+		if d.apiRecordMaxBytes <= 0 {
+			return nil, fmt.Errorf("API recording max bytes must be positive")
+		}
+
+		recorder, err := newAPIRecorder(httpClient.Transport, d.apiRecordPath, d.apiRecordMaxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot record API exchanges: %w", err)
+		}
+		httpClient.Transport = recorder
+
+		log.WithField("path", d.apiRecordPath).Warn("recording Vultr API exchanges, disable once the trace is captured")
+	}
+
+	// outside the others, so that the calls held back by the dry run are audited too
+	if d.auditLogPath != "" {
+		if d.audit, err = newAuditLog(d.auditLogPath, log); err != nil {
+			return nil, fmt.Errorf("cannot open audit log: %w", err)
+		}
+		httpClient.Transport = d.audit.transport(httpClient.Transport)
+	}
+
+	httpClient.Transport = &apiTimingTransport{next: httpClient.Transport}
+	d.apiTransport = httpClient.Transport
+
+	return d, nil
 }
 
 func (d *VultrDriver) Run() {
-	server := NewNonBlockingGRPCServer()
+	d.reportAPIConfig()
+
+	var interceptors []grpc.UnaryServerInterceptor
+	if d.events != nil {
+		interceptors = append(interceptors, d.events.intercept)
+		go d.events.run(context.Background())
+	}
+	if d.audit != nil {
+		interceptors = append(interceptors, d.audit.intercept)
+	}
+	if d.tracer != nil {
+		interceptors = append(interceptors, d.tracer.intercept)
+		go d.tracer.run(context.Background())
+	}
+
+	server := &nonBlockingGRPCServer{
+		interceptors: interceptors,
+		options:      d.grpcServerOptions(),
+		socketMode:   d.socketMode,
+		socketOwner:  d.socketOwner,
+	}
 	identity := NewVultrIdentityServer(d)
 	controller := NewVultrControllerServer(d)
 	node := NewVultrNodeDriver(d)
 
-	server.Start(d.endpoint, identity, controller, node)
+	if d.usageEventThreshold > 0 {
+		watcher, err := newInClusterUsageWatcher(d)
+		if err != nil {
+			d.log.Warnf("cannot post volume usage events to claims: %v", err)
+		} else {
+			node.usageEvents = watcher
+		}
+	}
+
+	if kube, err := newInClusterKubeAPI(quarantineEventTimeout); err != nil {
+		d.log.Infof("cannot post quarantine events to claims: %v", err)
+	} else {
+		node.kube = &kube
+	}
+
+	// before serving, so no NodeStageVolume races the cleanup of its path
+	if d.stagingCleanup && d.kubeletDir != "" {
+		node.cleanupStaleStaging(d.kubeletDir)
+	}
+
+	var controllerService csi.ControllerServer = controller
+	if d.nodeOnly {
+		controllerService = nil
+	}
+	server.Start(d.endpoint, identity, controllerService, node)
+
+	// the background loops stop as the server starts draining, the lease is renewed until
+	// the RPCs in flight are drained
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	if d.servesController() {
+		go controller.warmVolumeCache()
+	}
+
+	if d.controllerLease != nil {
+		go d.controllerLease.run(context.Background())
+	}
+
+	if d.shutdownDetachInterval > 0 {
+		watcher, err := newInClusterShutdownWatcher(controller, d.shutdownDetachInterval)
+		if err != nil {
+			d.log.Warnf("cannot watch nodes for shutdown taints: %v", err)
+		} else {
+			go watcher.run(ctx)
+		}
+	}
+
+	if d.gcInterval > 0 {
+		collector, err := newInClusterVolumeCollector(controller)
+		if err != nil {
+			d.log.Warnf("cannot collect orphaned volumes: %v", err)
+		} else {
+			go collector.run(ctx)
+		}
+	}
+
+	if d.volumeStatusInterval > 0 {
+		annotation, documents := nodeStatusAnnotationPrefix+d.nodeID, node.volumeStatusDocuments
+		if d.servesController() {
+			annotation, documents = volumeStatusAnnotation, controller.volumeStatusDocuments
+		}
+
+		publisher, err := newVolumeStatusPublisher(d, annotation, documents)
+		if err != nil {
+			d.log.Warnf("cannot publish volume status to claims: %v", err)
+		} else {
+			go publisher.run(ctx)
+		}
+	}
+
+	if d.nodeLabelsInterval > 0 {
+		publisher, err := newNodeLabelPublisher(node)
+		if err != nil {
+			d.log.Warnf("cannot label the node: %v", err)
+		} else {
+			go publisher.run(ctx)
+		}
+	}
+
+	if d.ioStatsInterval > 0 {
+		go newIOStatsSampler(node).run(ctx)
+	}
+
+	if d.vfsMonitorInterval > 0 {
+		go newVFSMountMonitor(node).run(ctx)
+	}
+
+	if d.metricsAddr != "" {
+		go serveMetrics(d.metricsAddr, d.log)
+	}
+
+	if d.adminAddr != "" {
+		admin := newAdminServer(d, controller, node)
+		go admin.serve()
+	}
+
+	if d.healthAddr != "" {
+		go newHealthServer(d, server).serve()
+	}
+
+	d.awaitTermination(server, stop)
 	server.Wait()
+
+	// the spans of the drained RPCs are sent before exiting
+	if d.tracer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingTimeout)
+		d.tracer.flush(ctx)
+		cancel()
+	}
 }
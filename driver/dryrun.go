@@ -0,0 +1,97 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// dryRunMarker starts the error of every Vultr API call held back in dry run mode
+const dryRunMarker = "dry run:"
+
+// dryRunTransport is an http.RoundTripper which sends only read requests to the Vultr API.
+// Every other call is logged with its sanitized body and answered with a 412, which the
+// Vultr client does not retry, so the RPC which made it fails without changing anything.
+type dryRunTransport struct {
+	next http.RoundTripper
+	log  *logrus.Entry
+}
+
+func newDryRunTransport(next http.RoundTripper, log *logrus.Entry) *dryRunTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return &dryRunTransport{next: next, log: log}
+}
+
+// RoundTrip sends read requests and logs the others in place of sending them
+func (t *dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return t.next.RoundTrip(req)
+	}
+
+	fields := logrus.Fields{
+		"method": req.Method,
+		"path":   req.URL.Path,
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		body := sanitizeBody(req.Body)
+		req.Body.Close()
+		if body != nil {
+			fields["body"] = string(body)
+		}
+	}
+
+	t.log.WithFields(fields).Info("dry run: Vultr API call not sent")
+
+	msg := fmt.Sprintf("%s %s %s was not sent", dryRunMarker, req.Method, req.URL.Path)
+	body, _ := json.Marshal(map[string]interface{}{"error": msg, "status": http.StatusPreconditionFailed})
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", http.StatusPreconditionFailed, http.StatusText(http.StatusPreconditionFailed)),
+		StatusCode:    http.StatusPreconditionFailed,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// isDryRunError reports whether the Vultr API call was held back by dry run mode
+func isDryRunError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), dryRunMarker)
+}
+
+// dryRunCheck returns a FailedPrecondition error for rpc when err is an API call held
+// back by dry run mode, so the CO reports the call the RPC would have made
+func dryRunCheck(rpc string, err error) error {
+	if isDryRunError(err) {
+		return status.Errorf(codes.FailedPrecondition, "%s: %v", rpc, err)
+	}
+	return nil
+}
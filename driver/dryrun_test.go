@@ -0,0 +1,47 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vultr/govultr/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDryRunTransport(t *testing.T) {
+	var writes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			atomic.AddInt32(&writes, 1)
+		}
+		w.Write([]byte(`{"block":{"id":"abc","status":"active"}}`)) //nolint:errcheck
+	}))
+	defer server.Close()
+
+	client := govultr.NewClient(&http.Client{Transport: newDryRunTransport(nil, logrus.New().WithField("test", "dry run"))})
+	if err := client.SetBaseURL(server.URL); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if _, _, err := client.BlockStorage.Get(context.Background(), "abc"); err != nil { //nolint:bodyclose
+		t.Fatalf("expected reads to reach the API, got %v", err)
+	}
+
+	_, _, err := client.BlockStorage.Create(context.Background(), &govultr.BlockStorageCreate{Region: "ewr", SizeGB: 10}) //nolint:bodyclose
+	if !isDryRunError(err) {
+		t.Fatalf("expected a dry run error, got %v", err)
+	}
+
+	if n := atomic.LoadInt32(&writes); n != 0 {
+		t.Errorf("expected no write to reach the API, got %d", n)
+	}
+
+	if code := status.Code(dryRunCheck("CreateVolume", err)); code != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition, got %v", code)
+	}
+}
@@ -0,0 +1,341 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// volumeContextEphemeral is set by kubelet on the NodePublishVolume of a volume
+	// declared inline in a pod
+	volumeContextEphemeral = "csi.storage.k8s.io/ephemeral"
+
+	// kubeletContextPrefix prefixes the attributes kubelet adds to the volume context,
+	// such as the pod an inline volume is for
+	kubeletContextPrefix = "csi.storage.k8s.io/"
+
+	// ephemeralDir is created next to the target path of an inline volume the node
+	// provisioned and holds its staging path. It outlives the staging mount, so that an
+	// unpublish retried after a failed delete still knows there is a volume to delete.
+	ephemeralDir = "vultr-ephemeral"
+
+	// ephemeralLockPrefix keys the lock held while provisioning or deleting an inline
+	// volume, apart from the lock on its volume ID which its stage and publish take
+	ephemeralLockPrefix = "ephemeral/"
+)
+
+// isEphemeral reports whether the volume context is that of an inline volume
+func isEphemeral(volCtx map[string]string) bool {
+	return volCtx[volumeContextEphemeral] == "true"
+}
+
+// ephemeralStagingPath returns where the inline volume published at targetPath is staged
+func ephemeralStagingPath(targetPath string) string {
+	return filepath.Join(filepath.Dir(targetPath), ephemeralDir, "staging")
+}
+
+// isEphemeralTarget reports whether the target path is that of an inline volume the node provisioned
+func isEphemeralTarget(targetPath string) bool {
+	_, err := os.Stat(filepath.Dir(ephemeralStagingPath(targetPath)))
+	return err == nil
+}
+
+// ephemeralParameters returns the parameters an inline volume is created with from the
+// attributes the pod declares for it, the same a StorageClass takes, and the capacity
+// of its size_gb attribute. Inline volumes are block storage, high_perf unless the pod
+// asks for another block type.
+func ephemeralParameters(volCtx map[string]string) (map[string]string, *csi.CapacityRange, error) {
+	attrs := make(map[string]string, len(volCtx))
+	for k, v := range volCtx {
+		if !strings.HasPrefix(k, kubeletContextPrefix) {
+			attrs[k] = v
+		}
+	}
+
+	params, err := normalizeParameters(attrs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if storageType := params[storageTypeParam]; storageType != "" && storageType != storageTypeBlock {
+		return nil, nil, fmt.Errorf("%w: inline volumes are block storage, not %s", errInvalidParameter, storageType)
+	}
+	if params[blockTypeParam] == "" {
+		params[blockTypeParam] = blockTypeNvme
+	}
+
+	var capRange *csi.CapacityRange
+	if v, ok := params[volumeContextSizeGB]; ok {
+		gb, err := parseVolumeSizeGB(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: attribute %q: %v", errInvalidParameter, volumeContextSizeGB, err)
+		}
+		capRange = &csi.CapacityRange{RequiredBytes: gb * giB}
+		delete(params, volumeContextSizeGB)
+	}
+
+	return params, capRange, nil
+}
+
+// publishEphemeralVolume provisions an inline volume and publishes it at the target path.
+// Kubernetes neither creates, attaches nor stages the volumes pods declare inline, so the
+// node creates a block storage volume labelled with the volume ID kubelet generated for
+// it, attaches it to itself, then stages and publishes it as any other volume. A retry
+// finds the volume it created by its label.
+func (n *VultrNodeServer) publishEphemeralVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) { //nolint:lll
+	if !n.Driver.ephemeralVolumes {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"NodePublishVolume inline volume %s cannot be provisioned, ephemeral volumes are not enabled on the node", req.VolumeId)
+	}
+
+	if req.VolumeCapability.GetBlock() != nil {
+		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume inline volumes are filesystems and cannot be raw block volumes")
+	}
+
+	params, capRange, err := ephemeralParameters(req.VolumeContext)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume %v", err)
+	}
+
+	unlock, err := n.locks.acquire(ephemeralLockPrefix + req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// marks the target before anything is created, so that unpublish cleans up whatever publish got to
+	stagingPath := ephemeralStagingPath(req.TargetPath)
+	if err := n.makeTargetDir(filepath.Dir(stagingPath)); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	vol, err := n.provisionEphemeralVolume(ctx, req.VolumeId, capRange, params)
+	if err != nil {
+		return nil, err
+	}
+
+	caps := []*csi.VolumeCapability{req.VolumeCapability}
+	volCtx := provisionedVolumeContext(vol, caps, params, n.fallbackFsType(params))
+	publishContext := map[string]string{n.Driver.mountID: vol.mountIDFor(n.Driver.nodeID)}
+
+	if _, err := n.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          req.VolumeId,
+		PublishContext:    publishContext,
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  req.VolumeCapability,
+		Secrets:           req.Secrets,
+		VolumeContext:     volCtx,
+	}); err != nil {
+		return nil, err
+	}
+
+	res, err := n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          req.VolumeId,
+		PublishContext:    publishContext,
+		StagingTargetPath: stagingPath,
+		TargetPath:        req.TargetPath,
+		VolumeCapability:  req.VolumeCapability,
+		Readonly:          req.Readonly,
+		Secrets:           req.Secrets,
+		VolumeContext:     volCtx,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	requestLogger(ctx, n.Driver.log).WithField("vultr_volume_id", vol.ID).Info("Node Publish Volume: inline volume published")
+	return res, nil
+}
+
+// provisionEphemeralVolume returns the block storage volume of the inline volume attached
+// to the node, creating it on the first attempt
+func (n *VultrNodeServer) provisionEphemeralVolume(ctx context.Context, name string, capRange *csi.CapacityRange, params map[string]string) (*backendVolume, error) { //nolint:lll
+	backend := newBlockBackend(n.Driver)
+	nodeID := n.Driver.nodeID
+	label := n.Driver.inlineVolumeLabel(name)
+	log := requestLogger(ctx, n.Driver.log).WithField("volume_label", label)
+
+	if err := n.Driver.checkAPI("NodePublishVolume"); err != nil {
+		return nil, err
+	}
+
+	vol, err := n.findInlineVolume(ctx, backend, name)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot look up inline volume %s: %v", name, err)
+	}
+
+	if vol == nil {
+		params[regionParam] = n.Driver.region
+		vol, err = backend.Create(ctx, label, capRange, params)
+		if err != nil {
+			if errors.Is(err, errInvalidParameter) {
+				return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume %v", err)
+			}
+			if errors.Is(err, errOutOfRange) {
+				return nil, status.Errorf(codes.OutOfRange, "NodePublishVolume %v", err)
+			}
+			if err := dryRunCheck("NodePublishVolume", err); err != nil {
+				return nil, err
+			}
+			return nil, status.Errorf(codes.Internal, "cannot create inline volume %s: %v", name, err)
+		}
+
+		log.WithFields(logrus.Fields{
+			"vultr_volume_id": vol.ID,
+			"size":            vol.SizeBytes,
+		}).Info("Node Publish Volume: inline volume created")
+	}
+
+	if vol.Status != "active" {
+		if err := n.watcher.wait(ctx, backend, vol.ID, loopVolumeActive, volumeActiveTimeout, func(vol *backendVolume) bool {
+			return vol.Status == "active"
+		}); err != nil {
+			return nil, status.Errorf(codes.Internal, "inline volume %s is not active: %v", name, err)
+		}
+	}
+
+	if vol.isAttachedTo(nodeID) {
+		return vol, nil
+	}
+
+	if len(vol.AttachedTo) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "inline volume %s is attached to another node %v", name, vol.AttachedTo)
+	}
+
+	if err := backend.Attach(ctx, vol.ID, nodeID); err != nil && !errors.Is(err, errAlreadyAttached) {
+		if errors.Is(err, errInstanceLocked) {
+			return nil, status.Errorf(codes.Aborted, "cannot attach inline volume %s to node: %v", name, err)
+		}
+		return nil, status.Errorf(codes.Internal, "cannot attach inline volume %s to node: %v", name, err)
+	}
+
+	if err := n.watcher.wait(ctx, backend, vol.ID, loopAttach, n.Driver.attachTimeout, func(attached *backendVolume) bool {
+		vol = attached
+		return attached.isAttachedTo(nodeID)
+	}); err != nil {
+		return nil, status.Errorf(codes.Internal, "inline volume %s is not attached to node: %v", name, err)
+	}
+
+	log.WithField("vultr_volume_id", vol.ID).Info("Node Publish Volume: inline volume attached by the node")
+	return vol, nil
+}
+
+// unpublishEphemeralVolume unpublishes an inline volume the node provisioned, then
+// unstages, detaches and deletes it. The directory marking the target goes last, so that
+// a retry after a failure carries on with the cleanup.
+func (n *VultrNodeServer) unpublishEphemeralVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) { //nolint:lll
+	unlock, err := n.locks.acquire(ephemeralLockPrefix + req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	res, err := n.unpublishVolume(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	stagingPath := ephemeralStagingPath(req.TargetPath)
+	if _, err := n.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+		VolumeId:          req.VolumeId,
+		StagingTargetPath: stagingPath,
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := n.deleteEphemeralVolume(ctx, req.VolumeId); err != nil {
+		return nil, err
+	}
+
+	if err := os.Remove(filepath.Dir(stagingPath)); err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "cannot remove %s: %v", filepath.Dir(stagingPath), err)
+	}
+
+	requestLogger(ctx, n.Driver.log).Info("Node Unpublish Volume: inline volume deleted")
+	return res, nil
+}
+
+// deleteEphemeralVolume detaches the block storage volume of the inline volume from the
+// node and deletes it, if it is still there
+func (n *VultrNodeServer) deleteEphemeralVolume(ctx context.Context, name string) error {
+	backend := newBlockBackend(n.Driver)
+	nodeID := n.Driver.nodeID
+
+	if err := n.Driver.checkAPI("NodeUnpublishVolume"); err != nil {
+		return err
+	}
+
+	vol, err := n.findInlineVolume(ctx, backend, name)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot look up inline volume %s: %v", name, err)
+	}
+	if vol == nil {
+		return nil
+	}
+
+	if vol.isAttachedTo(nodeID) {
+		if err := backend.Detach(ctx, vol.ID, nodeID); err != nil && !errors.Is(err, errNotAttached) {
+			return status.Errorf(codes.Internal, "cannot detach inline volume %s from node: %v", name, err)
+		}
+
+		if err := n.watcher.wait(ctx, backend, vol.ID, loopDetach, n.Driver.detachTimeout, func(vol *backendVolume) bool {
+			return !vol.isAttachedTo(nodeID)
+		}); err != nil {
+			return status.Errorf(codes.Internal, "inline volume %s is not detached from node: %v", name, err)
+		}
+	}
+
+	if err := backend.Delete(ctx, vol.ID); err != nil {
+		return status.Errorf(codes.Internal, "cannot delete inline volume %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// findInlineVolume returns the block storage volume of the inline volume, nil when there
+// is none. Inline volumes created before they had a label of their own carry the label of
+// a persistent volume, so a retry still finds them.
+func (n *VultrNodeServer) findInlineVolume(ctx context.Context, backend storageBackend, name string) (*backendVolume, error) {
+	vol, err := findVolumeByLabel(ctx, backend, n.Driver.inlineVolumeLabel(name))
+	if err != nil || vol != nil {
+		return vol, err
+	}
+	return findVolumeByLabel(ctx, backend, n.Driver.newVolumeLabel(name))
+}
+
+// findVolumeByLabel lists the volumes of the backend for the one with the label, nil when there is none
+func findVolumeByLabel(ctx context.Context, backend storageBackend, label string) (*backendVolume, error) {
+	list, err := backend.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range list {
+		if list[i].Label == label {
+			return &list[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,144 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/vultr/vultr-csi/internal/fakevultr"
+)
+
+func TestEphemeralParameters(t *testing.T) {
+	params, capRange, err := ephemeralParameters(map[string]string{
+		volumeContextEphemeral:                   "true",
+		"csi.storage.k8s.io/pod.name":            "scratch",
+		"size_gb":                                "40",
+		"fsType":                                 "xfs",
+		"csi.storage.k8s.io/serviceAccount.name": "default",
+	})
+	if err != nil {
+		t.Fatalf("ephemeralParameters: %v", err)
+	}
+	if capRange.GetRequiredBytes() != 40*giB {
+		t.Errorf("expected 40GB to be required, got %v", capRange)
+	}
+	expected := map[string]string{blockTypeParam: blockTypeNvme, fsTypeParam: fsTypeXFS}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("expected %v, got %v", expected, params)
+	}
+
+	for _, attrs := range []map[string]string{
+		{"size_gb": "10Gi"},
+		{"storage_type": "vfs"},
+		{"block_type": "ssd"},
+	} {
+		if _, _, err := ephemeralParameters(attrs); err == nil {
+			t.Errorf("expected %v to be refused", attrs)
+		}
+	}
+}
+
+func TestEphemeralVolume(t *testing.T) {
+	const nodeID = "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"
+
+	api := fakevultr.New()
+	api.AddInstance(nodeID, "ewr", "node", "vc2-1c-1gb")
+
+	d := newPreflightDriver(t, api)
+	d.nodeID, d.region = nodeID, "ewr"
+	d.ephemeralVolumes = true
+	d.attachTimeout, d.detachTimeout = DefaultAttachTimeout, DefaultDetachTimeout
+	d.deviceWaitTimeout = 10 * time.Millisecond
+
+	dir := t.TempDir()
+	device := filepath.Join(dir, "device")
+	if err := os.WriteFile(device, nil, mkFileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	mounter := newFakeMounter(nil)
+	d.mounter, d.resizer, d.exec = mounter, &fakeResizer{}, &fakeExec{}
+	node := NewVultrNodeDriver(d)
+	// the first volume the fake API creates
+	devices := map[string]string{"00000000-0000-4000-8000-000000000001": device}
+	node.host = &fakeHost{hostOS: node.host, mounter: mounter, devices: devices}
+
+	volumeDir := filepath.Join(dir, "pods", "scratch")
+	if err := os.MkdirAll(volumeDir, mkDirMode); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(volumeDir, "mount")
+
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:   "csi-0123456789abcdef",
+		TargetPath: target,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{volumeContextEphemeral: "true", "size_gb": "40"},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := node.NodePublishVolume(context.Background(), req); err != nil {
+			t.Fatalf("NodePublishVolume: %v", err)
+		}
+	}
+
+	blocks, _, _, err := d.client.BlockStorage.List(context.Background(), nil) //nolint:bodyclose
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 || blocks[0].SizeGB != 40 || blocks[0].AttachedToInstance != nodeID {
+		t.Fatalf("expected one 40GB volume attached to the node, got %+v", blocks)
+	}
+	if mounter.formats[device] != defaultFsType {
+		t.Errorf("expected the volume to be formatted with %s, got %q", defaultFsType, mounter.formats[device])
+	}
+	if notMnt, err := mounter.IsLikelyNotMountPoint(target); err != nil || notMnt {
+		t.Errorf("expected the volume to be published at the target, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := node.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   req.VolumeId,
+			TargetPath: target,
+		}); err != nil {
+			t.Fatalf("NodeUnpublishVolume: %v", err)
+		}
+	}
+
+	if blocks, _, _, err = d.client.BlockStorage.List(context.Background(), nil); err != nil { //nolint:bodyclose
+		t.Fatal(err)
+	}
+	if len(blocks) != 0 {
+		t.Errorf("expected the inline volume to be deleted, got %+v", blocks)
+	}
+	if entries, err := os.ReadDir(volumeDir); err != nil || len(entries) != 0 {
+		t.Errorf("expected nothing left in the volume directory, got %v %v", entries, err)
+	}
+}
+
+func TestEphemeralVolumeDisabled(t *testing.T) {
+	node := NewVultrNodeDriver(&VultrDriver{log: logrus.NewEntry(logrus.New())})
+
+	_, err := node.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:   "csi-0123456789abcdef",
+		TargetPath: filepath.Join(t.TempDir(), "mount"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{volumeContextEphemeral: "true"},
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected an inline volume on a node without ephemeral volumes to fail with FailedPrecondition, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto" //nolint:staticcheck // the CSI messages are generated against the v1 API
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// failureSummaryInterval is how often a failure repeating for the same RPC and volume is logged again
+const failureSummaryInterval = 5 * time.Minute
+
+// repeatedFailures collapses the errors GRPCLogger logs for RPCs the sidecars retry in a loop
+var repeatedFailures = newFailureLog(failureSummaryInterval)
+
+type failureKey struct {
+	method   string
+	volumeID string
+	err      string
+}
+
+type failureRecord struct {
+	logged     time.Time
+	seen       time.Time
+	suppressed int
+}
+
+// failureLog tracks identical failures of an RPC on a volume so that, during an incident
+// where every retry fails the same way, the error is logged once and then summarized with
+// a count once per interval instead of on every retry
+type failureLog struct {
+	interval time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	failures map[failureKey]*failureRecord
+}
+
+func newFailureLog(interval time.Duration) *failureLog {
+	return &failureLog{
+		interval: interval,
+		now:      time.Now,
+		failures: make(map[failureKey]*failureRecord),
+	}
+}
+
+// failed records the failure and reports whether it should be logged, along with how
+// many identical failures were suppressed since it last was
+func (f *failureLog) failed(method, volumeID string, err error) (bool, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+	for k, r := range f.failures {
+		if now.Sub(r.seen) > f.interval {
+			delete(f.failures, k)
+		}
+	}
+
+	key := failureKey{method: method, volumeID: volumeID, err: err.Error()}
+	r, ok := f.failures[key]
+	if !ok {
+		f.failures[key] = &failureRecord{logged: now, seen: now}
+		return true, 0
+	}
+
+	r.seen = now
+	if now.Sub(r.logged) < f.interval {
+		r.suppressed++
+		return false, 0
+	}
+
+	suppressed := r.suppressed
+	r.logged, r.suppressed = now, 0
+	return true, suppressed
+}
+
+// succeeded forgets the failures of the RPC on the volume, so a later failure is logged straight away
+func (f *failureLog) succeeded(method, volumeID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for k := range f.failures {
+		if k.method == method && k.volumeID == volumeID {
+			delete(f.failures, k)
+		}
+	}
+}
+
+// requestVolumeID returns the volume_id field of a CSI request, empty when it has none
+func requestVolumeID(req interface{}) string {
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return ""
+	}
+
+	m := proto.MessageReflect(msg)
+	field := m.Descriptor().Fields().ByName("volume_id")
+	if field == nil || field.Kind() != protoreflect.StringKind {
+		return ""
+	}
+
+	return m.Get(field).String()
+}
@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestFailureLog(t *testing.T) {
+	now := time.Now()
+	f := newFailureLog(time.Minute)
+	f.now = func() time.Time { return now }
+
+	const method = "/csi.v1.Controller/ControllerPublishVolume"
+	errLocked := errors.New("instance is locked")
+
+	if logged, _ := f.failed(method, "vol-1", errLocked); !logged {
+		t.Error("expected the first failure to be logged")
+	}
+
+	for i := 0; i < 3; i++ {
+		now = now.Add(10 * time.Second)
+		if logged, _ := f.failed(method, "vol-1", errLocked); logged {
+			t.Error("expected repeated failures within the interval to be suppressed")
+		}
+	}
+
+	if logged, _ := f.failed(method, "vol-2", errLocked); !logged {
+		t.Error("expected the failure of another volume to be logged")
+	}
+
+	if logged, _ := f.failed(method, "vol-1", errors.New("other")); !logged {
+		t.Error("expected a different failure to be logged")
+	}
+
+	now = now.Add(time.Minute)
+	if logged, suppressed := f.failed(method, "vol-1", errLocked); !logged || suppressed != 3 {
+		t.Errorf("expected a summary of 3 suppressed failures, got logged %v suppressed %d", logged, suppressed)
+	}
+
+	f.succeeded(method, "vol-1")
+	if logged, _ := f.failed(method, "vol-1", errLocked); !logged {
+		t.Error("expected a failure after a success to be logged")
+	}
+}
+
+func TestRequestVolumeID(t *testing.T) {
+	if id := requestVolumeID(&csi.NodeStageVolumeRequest{VolumeId: "vol-1"}); id != "vol-1" {
+		t.Errorf("expected vol-1, got %q", id)
+	}
+
+	if id := requestVolumeID(&csi.ProbeRequest{}); id != "" {
+		t.Errorf("expected no volume ID, got %q", id)
+	}
+}
@@ -2,7 +2,11 @@ package driver
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/vultr/govultr/v3"
 )
@@ -14,6 +18,8 @@ func newFakeClient() *govultr.Client {
 	return &govultr.Client{
 		Instance:     &fakeInstance,
 		BlockStorage: &fakeBlockStorage,
+		Plan:         &fakePlan{},
+		Region:       &fakeRegion{},
 	}
 }
 
@@ -33,6 +39,9 @@ func newFakeBS() *govultr.BlockStorage {
 
 type fakeBS struct {
 	client *govultr.Client
+
+	mu       sync.Mutex
+	detached map[string]bool
 }
 
 func (f *fakeBS) Create(ctx context.Context, blockReq *govultr.BlockStorageCreate) (*govultr.BlockStorage, *http.Response, error) {
@@ -40,11 +49,22 @@ func (f *fakeBS) Create(ctx context.Context, blockReq *govultr.BlockStorageCreat
 }
 
 func (f *fakeBS) Get(ctx context.Context, blockID string) (*govultr.BlockStorage, *http.Response, error) {
-	return newFakeBS(), nil, nil
+	// volumes of the fake VFS are not block storage
+	if strings.HasPrefix(blockID, "vfs-") {
+		return nil, nil, errors.New(`{"error":"Invalid block storage ID","status":404}`)
+	}
+
+	volume := newFakeBS()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.detached[volume.ID] {
+		volume.AttachedToInstance = ""
+	}
+	return volume, nil, nil
 }
 
 func (f *fakeBS) Update(ctx context.Context, blockID string, blockReq *govultr.BlockStorageUpdate) error {
-	panic("implement me")
+	return nil
 }
 
 func (f *fakeBS) Delete(ctx context.Context, blockID string) error {
@@ -52,7 +72,7 @@ func (f *fakeBS) Delete(ctx context.Context, blockID string) error {
 }
 
 func (f *fakeBS) List(ctx context.Context, options *govultr.ListOptions) ([]govultr.BlockStorage, *govultr.Meta, *http.Response, error) {
-	return []govultr.BlockStorage{
+	list := []govultr.BlockStorage{
 			{
 				ID:                 "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
 				DateCreated:        "",
@@ -75,7 +95,17 @@ func (f *fakeBS) List(ctx context.Context, options *govultr.ListOptions) ([]govu
 				Label:              "test-bs2",
 				MountID:            "b9d23eb3-1880-4746-acc7-f1ef56565320",
 			},
-		}, &govultr.Meta{
+		}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range list {
+		if f.detached[list[i].ID] {
+			list[i].AttachedToInstance = ""
+		}
+	}
+
+	return list, &govultr.Meta{
 			Total: 0,
 			Links: &govultr.Links{
 				Next: "",
@@ -89,20 +119,59 @@ func (f *fakeBS) Attach(ctx context.Context, blockID string, attach *govultr.Blo
 }
 
 func (f *fakeBS) Detach(ctx context.Context, blockID string, detach *govultr.BlockStorageDetach) error {
-	list, _, _, err := f.List(ctx, nil) //nolint:bodyclose
-	if err != nil {
-		return err
-	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-	for i := range list {
-		if list[i].ID == blockID {
-			list[i].AttachedToInstance = ""
-		}
+	if f.detached == nil {
+		f.detached = make(map[string]bool)
 	}
+	f.detached[blockID] = true
 
 	return nil
 }
 
+type fakePlan struct{}
+
+func (f *fakePlan) List(ctx context.Context, planType string, options *govultr.ListOptions) ([]govultr.Plan, *govultr.Meta, *http.Response, error) {
+	return []govultr.Plan{
+		{
+			ID:        "vc2-1c-1gb",
+			VCPUCount: 1,
+			DiskCount: 1,
+			Type:      "vc2",
+		},
+		{
+			ID:        "vc2-4c-8gb",
+			VCPUCount: 4,
+			DiskCount: 2,
+			Type:      "vc2",
+		},
+	}, &govultr.Meta{}, nil, nil
+}
+
+func (f *fakePlan) ListBareMetal(ctx context.Context, options *govultr.ListOptions) ([]govultr.BareMetalPlan, *govultr.Meta, *http.Response, error) {
+	return nil, &govultr.Meta{}, nil, nil
+}
+
+type fakeRegion struct{}
+
+func (f *fakeRegion) List(ctx context.Context, options *govultr.ListOptions) ([]govultr.Region, *govultr.Meta, *http.Response, error) {
+	return []govultr.Region{
+		{
+			ID:      "ewr",
+			Options: []string{"ddos_protection", "block_storage_storage_opt", "block_storage_high_perf"},
+		},
+		{
+			ID:      "sao",
+			Options: []string{"ddos_protection", "block_storage_storage_opt"},
+		},
+	}, &govultr.Meta{Links: &govultr.Links{}}, nil, nil
+}
+
+func (f *fakeRegion) Availability(ctx context.Context, regionID, planType string) (*govultr.PlanAvailability, *http.Response, error) {
+	return nil, nil, nil
+}
+
 // FakeInstance returns the client
 type FakeInstance struct {
 	client *govultr.Client
@@ -320,3 +389,120 @@ func (f *FakeInstance) GetUserData(_ context.Context, _ string) (*govultr.UserDa
 func (f *FakeInstance) GetUpgrades(_ context.Context, _ string) (*govultr.Upgrades, *http.Response, error) {
 	panic("implement me")
 }
+
+// fakeVFS is an in memory VFS API
+type fakeVFS struct {
+	mu          sync.Mutex
+	volumes     map[string]*vfsStorage
+	attachments map[string][]vfsAttachment
+	created     []*vfsCreate
+}
+
+func newFakeVFS() *fakeVFS {
+	return &fakeVFS{
+		volumes:     make(map[string]*vfsStorage),
+		attachments: make(map[string][]vfsAttachment),
+	}
+}
+
+func (f *fakeVFS) Create(_ context.Context, vfsReq *vfsCreate) (*vfsStorage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.created = append(f.created, vfsReq)
+	vfs := &vfsStorage{
+		ID:          fmt.Sprintf("vfs-%d", len(f.created)),
+		Region:      vfsReq.Region,
+		Status:      "active",
+		Label:       vfsReq.Label,
+		Tags:        vfsReq.Tags,
+		DiskType:    vfsReq.DiskType,
+		StorageSize: vfsReq.StorageSize,
+	}
+	f.volumes[vfs.ID] = vfs
+
+	c := *vfs
+	return &c, nil
+}
+
+func (f *fakeVFS) Get(_ context.Context, vfsID string) (*vfsStorage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	vfs, ok := f.volumes[vfsID]
+	if !ok {
+		return nil, errors.New(`{"error":"Not found","status":404}`)
+	}
+
+	c := *vfs
+	return &c, nil
+}
+
+func (f *fakeVFS) Update(_ context.Context, vfsID string, vfsReq *vfsUpdate) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if vfsReq.StorageSize != nil {
+		f.volumes[vfsID].StorageSize = *vfsReq.StorageSize
+	}
+	if vfsReq.Tags != nil {
+		f.volumes[vfsID].Tags = *vfsReq.Tags
+	}
+	return nil
+}
+
+func (f *fakeVFS) Delete(_ context.Context, vfsID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.volumes, vfsID)
+	return nil
+}
+
+func (f *fakeVFS) List(_ context.Context, _ *govultr.ListOptions) ([]vfsStorage, *govultr.Meta, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var list []vfsStorage
+	for _, vfs := range f.volumes {
+		list = append(list, *vfs)
+	}
+	return list, &govultr.Meta{Links: &govultr.Links{}}, nil
+}
+
+func (f *fakeVFS) Attach(_ context.Context, vfsID, instanceID string) (*vfsAttachment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	attachment := vfsAttachment{
+		State:    "ATTACHED",
+		VFSID:    vfsID,
+		TargetID: instanceID,
+		MountTag: vfsMountTag(fmt.Sprintf("%d", len(f.attachments[vfsID])+1)),
+	}
+	f.attachments[vfsID] = append(f.attachments[vfsID], attachment)
+
+	return &attachment, nil
+}
+
+func (f *fakeVFS) Detach(_ context.Context, vfsID, instanceID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	attachments := f.attachments[vfsID][:0]
+	for _, a := range f.attachments[vfsID] {
+		if a.TargetID != instanceID {
+			attachments = append(attachments, a)
+		}
+	}
+	f.attachments[vfsID] = attachments
+
+	return nil
+}
+
+func (f *fakeVFS) ListAttachments(_ context.Context, vfsID string) ([]vfsAttachment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]vfsAttachment(nil), f.attachments[vfsID]...), nil
+}
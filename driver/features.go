@@ -0,0 +1,148 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// feature names a driver feature --feature-gates turns on or off
+type feature string
+
+const (
+	// featureSnapshots gates CreateSnapshot, DeleteSnapshot, ListSnapshots and volumes
+	// created from snapshots
+	featureSnapshots feature = "Snapshots"
+	// featureCloning gates volumes created from other volumes
+	featureCloning feature = "Cloning"
+	// featureRawBlock gates volumes with a block access type
+	featureRawBlock feature = "RawBlock"
+	// featureExpansion gates ControllerExpandVolume and NodeExpandVolume
+	featureExpansion feature = "Expansion"
+	// featureModifyVolume gates ControllerModifyVolume and the mutable parameters of
+	// VolumeAttributesClasses
+	featureModifyVolume feature = "ModifyVolume"
+	// featureVolumeCondition gates the volume conditions reported by ListVolumes,
+	// ControllerGetVolume and NodeGetVolumeStats
+	featureVolumeCondition feature = "VolumeCondition"
+	// featureVolumeMountGroup gates the VOLUME_MOUNT_GROUP node capability, with which
+	// kubelet leaves the fsGroup of a pod to the driver
+	featureVolumeMountGroup feature = "VolumeMountGroup"
+	// featureStrictParameters gates the refusal of StorageClass parameters the storage
+	// type of the volume does not act on
+	featureStrictParameters feature = "StrictParameters"
+)
+
+// defaultFeatures are the features the driver knows of, and whether each is enabled when
+// --feature-gates does not name it
+var defaultFeatures = map[feature]bool{
+	featureSnapshots:        true,
+	featureCloning:          true,
+	featureRawBlock:         true,
+	featureExpansion:        true,
+	featureModifyVolume:     true,
+	featureVolumeCondition:  true,
+	featureVolumeMountGroup: true,
+	featureStrictParameters: true,
+}
+
+// featureGates are the features --feature-gates turned on or off. The capability RPCs
+// and the handlers of each feature both consult them, so a disabled feature is neither
+// advertised nor served. A nil featureGates enables the default features.
+type featureGates map[feature]bool
+
+// parseFeatureGates parses a comma separated list of Feature=bool pairs, refusing
+// features the driver does not know
+func parseFeatureGates(spec string) (featureGates, error) {
+	gates := featureGates{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("feature gate %q must be of the form Feature=true|false", pair)
+		}
+
+		f := feature(strings.TrimSpace(name))
+		if _, known := defaultFeatures[f]; !known {
+			return nil, fmt.Errorf("unknown feature gate %q, known feature gates are %s", f, knownFeatureNames())
+		}
+
+		enabled, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("feature gate %s has non boolean value %q", f, value)
+		}
+		gates[f] = enabled
+	}
+
+	return gates, nil
+}
+
+// enabled reports whether the feature is on
+func (g featureGates) enabled(f feature) bool {
+	if enabled, ok := g[f]; ok {
+		return enabled
+	}
+	return defaultFeatures[f]
+}
+
+// String returns every known feature with whether it is on, sorted by name
+func (g featureGates) String() string {
+	names := knownFeatureNames()
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"="+strconv.FormatBool(g.enabled(feature(name))))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func knownFeatureNames() []string {
+	names := make([]string, 0, len(defaultFeatures))
+	for f := range defaultFeatures {
+		names = append(names, string(f))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkFeature fails rpc with Unimplemented when the feature is disabled
+func (d *VultrDriver) checkFeature(rpc string, f feature) error {
+	if d.features.enabled(f) {
+		return nil
+	}
+	return status.Errorf(codes.Unimplemented, "%s is not available, feature gate %s is disabled", rpc, f)
+}
+
+// checkCapabilityFeatures fails rpc with Unimplemented when a capability asks for an
+// access type whose feature is disabled
+func (d *VultrDriver) checkCapabilityFeatures(rpc string, caps ...*csi.VolumeCapability) error {
+	for _, capability := range caps {
+		if capability.GetBlock() != nil {
+			if err := d.checkFeature(rpc+" raw block volumes", featureRawBlock); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseFeatureGates(t *testing.T) {
+	gates, err := parseFeatureGates(" Snapshots=true, RawBlock=false,,Expansion=0")
+	if err != nil {
+		t.Fatalf("parseFeatureGates: %v", err)
+	}
+	if !gates.enabled(featureSnapshots) || gates.enabled(featureRawBlock) || gates.enabled(featureExpansion) {
+		t.Errorf("expected the gates to be applied, got %v", gates)
+	}
+	if !gates.enabled(featureCloning) {
+		t.Errorf("expected a feature not named to keep its default")
+	}
+
+	expected := "Cloning=true,Expansion=false,ModifyVolume=true,RawBlock=false,Snapshots=true,StrictParameters=true," +
+		"VolumeCondition=true,VolumeMountGroup=true"
+	if s := gates.String(); s != expected {
+		t.Errorf("expected %s, got %s", expected, s)
+	}
+
+	var none featureGates
+	if !none.enabled(featureRawBlock) {
+		t.Errorf("expected no gates to enable the default features")
+	}
+
+	for _, spec := range []string{"Snapshots", "Snapshot=true", "RawBlock=maybe"} {
+		if _, err := parseFeatureGates(spec); err == nil {
+			t.Errorf("expected %q to be refused", spec)
+		}
+	}
+}
+
+func TestDisabledFeatures(t *testing.T) {
+	controller := NewFakeVultrControllerServer("disabled features")
+	controller.Driver.features = featureGates{featureExpansion: false, featureRawBlock: false, featureVolumeCondition: false,
+		featureVolumeMountGroup: false}
+	node := NewVultrNodeDriver(&VultrDriver{log: logrus.NewEntry(logrus.New()), features: controller.Driver.features})
+	identity := NewVultrIdentityServer(controller.Driver)
+
+	controllerCaps, err := controller.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range controllerCaps.Capabilities {
+		switch c.GetRpc().GetType() {
+		case csi.ControllerServiceCapability_RPC_EXPAND_VOLUME, csi.ControllerServiceCapability_RPC_VOLUME_CONDITION:
+			t.Errorf("expected %v not to be advertised by the controller", c.GetRpc().GetType())
+		}
+	}
+
+	nodeCaps, err := node.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range nodeCaps.Capabilities {
+		switch c.GetRpc().GetType() {
+		case csi.NodeServiceCapability_RPC_EXPAND_VOLUME, csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+			csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP:
+			t.Errorf("expected %v not to be advertised by the node", c.GetRpc().GetType())
+		}
+	}
+
+	pluginCaps, err := identity.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range pluginCaps.Capabilities {
+		if c.GetVolumeExpansion() != nil {
+			t.Errorf("expected volume expansion not to be advertised")
+		}
+	}
+
+	_, err = controller.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * giB},
+	})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("expected ControllerExpandVolume to be Unimplemented, got %v", err)
+	}
+
+	_, err = node.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{VolumeId: "vol-1", VolumePath: t.TempDir()})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("expected NodeExpandVolume to be Unimplemented, got %v", err)
+	}
+
+	_, err = controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:       "volume-test-name",
+		Parameters: map[string]string{"block_type": "high_perf"},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		},
+	})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("expected a raw block CreateVolume to be Unimplemented, got %v", err)
+	}
+
+	vol, err := controller.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{
+		VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.Status.GetVolumeCondition() != nil {
+		t.Errorf("expected no volume condition, got %v", vol.Status.GetVolumeCondition())
+	}
+}
+
+func TestSnapshotsFeature(t *testing.T) {
+	controller := NewFakeVultrControllerServer("snapshots feature")
+	controller.Driver.features = featureGates{featureSnapshots: false}
+
+	_, err := controller.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		SourceVolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		Name:           "snap",
+	})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("expected CreateSnapshot to be Unimplemented, got %v", err)
+	}
+
+	_, err = controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:       "volume-test-name",
+		Parameters: map[string]string{"block_type": "high_perf"},
+		VolumeContentSource: &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snap-1"},
+		}},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		},
+	})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("expected a volume from a snapshot to be Unimplemented, got %v", err)
+	}
+}
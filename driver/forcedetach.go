@@ -0,0 +1,274 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultDeleteForceDetachGrace is how long DeleteVolume keeps finding a volume attached
+// before it force detaches it, when force detaching is enabled
+const DefaultDeleteForceDetachGrace = 5 * time.Minute
+
+// auditActionForceDetach is the audit action of a detach forced as it was stuck
+const auditActionForceDetach = "force_detach"
+
+var (
+	deleteForceDetaches = metrics.newCounter("delete_force_detaches_total",
+		"Number of volumes DeleteVolume force detached from an instance, by result", "result")
+	unpublishForceDetaches = metrics.newCounter("unpublish_force_detaches_total",
+		"Number of stuck detaches ControllerUnpublishVolume forced, restarting the instance, by result", "result")
+)
+
+// WithDeleteForceDetach lets DeleteVolume force detach a volume which is still attached,
+// once the deletion has found it attached for grace. It is otherwise refused until the
+// volume is unpublished, as when a node crashed before ControllerUnpublishVolume.
+func WithDeleteForceDetach(enabled bool, grace time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.deleteForceDetach = enabled
+		d.deleteForceDetachGrace = grace
+	}
+}
+
+// WithForceDetachAfter has ControllerUnpublishVolume force the detach of a volume it has
+// kept failing to detach from a node for after, as when the instance is wedged and the
+// detach stays pending. Vultr forces it by restarting the instance. 0 disables.
+func WithForceDetachAfter(after time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.forceDetachAfter = after
+	}
+}
+
+// stuckDetaches remembers when ControllerUnpublishVolume first tried to detach each
+// volume from a node, when it last tried and when it last forced the detach, across the
+// retries of the attacher. Keys are the volume ID and node ID.
+type stuckDetaches struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	since  map[string]time.Time
+	tried  map[string]time.Time
+	forced map[string]time.Time
+}
+
+func newStuckDetaches() *stuckDetaches {
+	return &stuckDetaches{
+		now:    time.Now,
+		since:  make(map[string]time.Time),
+		tried:  make(map[string]time.Time),
+		forced: make(map[string]time.Time),
+	}
+}
+
+// pending records the detach as tried and returns for how long it has been, and for how
+// long since it was last forced along with whether it ever was. Detaches not tried again
+// for expiry, which the attacher gave up on, are forgotten first, so a later detach of
+// the volume from the node starts over rather than being forced at once.
+func (s *stuckDetaches) pending(key string, expiry time.Duration) (time.Duration, time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for k, tried := range s.tried {
+		if now.Sub(tried) > expiry {
+			s.forgetLocked(k)
+		}
+	}
+
+	since, ok := s.since[key]
+	if !ok {
+		since = now
+		s.since[key] = since
+	}
+	s.tried[key] = now
+
+	forced, ok := s.forced[key]
+	return now.Sub(since), now.Sub(forced), ok
+}
+
+func (s *stuckDetaches) force(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.forced[key] = s.now()
+}
+
+func (s *stuckDetaches) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.forgetLocked(key)
+}
+
+// forgetDetached forgets the detaches of the volume from the nodes it is no longer
+// attached to, which are done whatever detached it
+func (s *stuckDetaches) forgetDetached(volumeID string, attachedTo []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.since {
+		nodeID, ok := strings.CutPrefix(key, volumeID+"/")
+		if ok && !slices.Contains(attachedTo, nodeID) {
+			s.forgetLocked(key)
+		}
+	}
+}
+
+func (s *stuckDetaches) forgetLocked(key string) {
+	delete(s.since, key)
+	delete(s.tried, key)
+	delete(s.forced, key)
+}
+
+// detachForUnpublish asks the backend to detach the volume from the node, forcing the
+// detach once it has been tried for forceDetachAfter. A forced detach restarts the
+// instance, so it is not forced again for another forceDetachAfter while the instance
+// lets go of the volume, only waited for.
+func (c *VultrControllerServer) detachForUnpublish(ctx context.Context, backend storageBackend, volumeID, nodeID string) error {
+	forcer, ok := backend.(forceDetacher)
+	after := c.Driver.forceDetachAfter
+	if !ok || after <= 0 {
+		return backend.Detach(ctx, volumeID, nodeID)
+	}
+
+	// the attacher retries a failed detach within the timeout it waits for the detach
+	expiry := after + c.Driver.detachTimeout
+	pendingFor, sinceForced, forced := c.detachesStuck.pending(volumeID+"/"+nodeID, expiry)
+	switch {
+	case pendingFor < after:
+		return backend.Detach(ctx, volumeID, nodeID)
+	case forced && sinceForced < after:
+		return nil
+	}
+
+	log := requestLogger(ctx, c.Driver.log).WithFields(logrus.Fields{
+		"node_id":     nodeID,
+		"pending_for": pendingFor.Round(time.Second).String(),
+	})
+	log.Warn("Controller Unpublish Volume: detach is stuck, forcing it by restarting the instance")
+	auditAction(ctx, auditActionForceDetach)
+
+	err := forcer.ForceDetach(ctx, volumeID, nodeID)
+	if err != nil && !errors.Is(err, errNotAttached) {
+		unpublishForceDetaches.add(1, "failed")
+		return err
+	}
+	c.detachesStuck.force(volumeID + "/" + nodeID)
+	unpublishForceDetaches.add(1, "forced")
+
+	if c.Driver.events != nil {
+		c.Driver.events.emit(volumeEvent{
+			Type:      eventForceDetached,
+			Operation: "ControllerUnpublishVolume",
+			ClusterID: c.Driver.clusterID,
+			VolumeID:  volumeID,
+			NodeID:    nodeID,
+		})
+	}
+	return err
+}
+
+// attachedDeletes remembers when DeleteVolume first found each volume still attached, so
+// the grace before force detaching spans the retries of the provisioner
+type attachedDeletes struct {
+	now func() time.Time
+
+	mu    sync.Mutex
+	since map[string]time.Time
+}
+
+func newAttachedDeletes() *attachedDeletes {
+	return &attachedDeletes{now: time.Now, since: make(map[string]time.Time)}
+}
+
+// attachedFor records the volume found attached and returns for how long it has been
+func (a *attachedDeletes) attachedFor(volumeID string) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	since, ok := a.since[volumeID]
+	if !ok {
+		since = now
+		a.since[volumeID] = since
+	}
+	return now.Sub(since)
+}
+
+func (a *attachedDeletes) forget(volumeID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.since, volumeID)
+}
+
+// detachForDelete detaches the volume DeleteVolume found attached when force detaching
+// is enabled and the grace passed, returning FailedPrecondition otherwise
+func (c *VultrControllerServer) detachForDelete(ctx context.Context, backend storageBackend, volume *backendVolume) error {
+	nodes := strings.Join(volume.AttachedTo, ", ")
+
+	attachedFor := c.deletesAttached.attachedFor(volume.ID)
+	if !c.Driver.deleteForceDetach {
+		return status.Errorf(codes.FailedPrecondition, "DeleteVolume volume %s is still attached to %s, unpublish it first", volume.ID, nodes)
+	}
+	if left := c.Driver.deleteForceDetachGrace - attachedFor; left > 0 {
+		return status.Errorf(codes.FailedPrecondition,
+			"DeleteVolume volume %s is still attached to %s, it is force detached if still attached in %v",
+			volume.ID, nodes, left.Round(time.Second))
+	}
+
+	log := requestLogger(ctx, c.Driver.log).WithFields(logrus.Fields{
+		"volume_id":    volume.ID,
+		"attached_to":  volume.AttachedTo,
+		"attached_for": attachedFor.String(),
+	})
+	log.Warn("Delete Volume: force detaching volume still attached")
+
+	for _, nodeID := range volume.AttachedTo {
+		if err := backend.Detach(ctx, volume.ID, nodeID); err != nil && !errors.Is(err, errNotAttached) {
+			if err := dryRunCheck("DeleteVolume", err); err != nil {
+				return err
+			}
+			deleteForceDetaches.add(1, "failed")
+			c.orphans.failed(volume, err)
+			return status.Errorf(codes.Internal, "DeleteVolume cannot force detach volume %s from %s: %v", volume.ID, nodeID, err)
+		}
+
+		if err := c.waitDetached(ctx, backend, volume.ID, nodeID); err != nil {
+			deleteForceDetaches.add(1, "failed")
+			return status.Errorf(codes.Unavailable, "DeleteVolume volume %s is still detaching from %s: %v", volume.ID, nodeID, err)
+		}
+		c.detachesStuck.forget(volume.ID + "/" + nodeID)
+	}
+
+	deleteForceDetaches.add(1, "detached")
+	c.deletesAttached.forget(volume.ID)
+	return nil
+}
+
+// isAttachedError reports whether the Vultr API refused to delete a volume because it
+// is attached, which happens when it was attached after the volume was looked up
+func isAttachedError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "is attached") || strings.Contains(msg, "still attached") || strings.Contains(msg, "currently attached")
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+
+	"github.com/vultr/vultr-csi/internal/volumes"
+)
+
+const (
+	// DefaultGCGracePeriod is how long a volume goes unreferenced by any PersistentVolume
+	// before the collector reports or deletes it
+	DefaultGCGracePeriod = time.Hour
+
+	// GCModeReport only reports orphaned volumes
+	GCModeReport = "report"
+	// GCModeDelete deletes orphaned volumes which are not attached
+	GCModeDelete = "delete"
+)
+
+var (
+	gcOrphanedVolumes = metrics.newGauge("gc_orphaned_volumes",
+		"Number of volumes of the cluster no PersistentVolume referenced for longer than the grace period", "storage_type")
+	gcOrphanedVolumeBytes = metrics.newGauge("gc_orphaned_volume_bytes",
+		"Size of the volumes of the cluster no PersistentVolume referenced for longer than the grace period", "storage_type")
+	gcDeletions = metrics.newCounter("gc_deletions_total",
+		"Number of orphaned volumes the collector deleted, by result", "result")
+)
+
+// WithOrphanCollection makes the controller look for volumes of the cluster which no
+// PersistentVolume references every interval, left behind by a DeleteVolume the CO gave
+// up on or by a cluster which was torn down, and report them or, in delete mode, delete
+// those unreferenced for longer than grace. 0 disables.
+func WithOrphanCollection(interval time.Duration, mode string, grace time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.gcInterval = interval
+		d.gcMode = mode
+		d.gcGracePeriod = grace
+	}
+}
+
+// validateOrphanCollection reports settings the collector cannot safely run with
+func (d *VultrDriver) validateOrphanCollection() error {
+	if d.gcInterval < 0 || d.gcGracePeriod < 0 {
+		return fmt.Errorf("orphan collection interval and grace period must not be negative")
+	}
+	if d.gcInterval == 0 {
+		return nil
+	}
+
+	if d.gcMode != GCModeReport && d.gcMode != GCModeDelete {
+		return fmt.Errorf("orphan collection mode %q is not one of %s or %s", d.gcMode, GCModeReport, GCModeDelete)
+	}
+	if !d.isController {
+		return fmt.Errorf("an API token is required to collect orphaned volumes")
+	}
+	// other clusters sharing the account and label prefix would otherwise look orphaned
+	if d.clusterID == "" {
+		return fmt.Errorf("a cluster ID is required to collect orphaned volumes")
+	}
+	return nil
+}
+
+// unreferencedVolume is a volume of the cluster no PersistentVolume referenced at the last pass
+type unreferencedVolume struct {
+	since    time.Time
+	reported bool
+}
+
+// volumeCollector finds the volumes of the cluster which no PersistentVolume references.
+// Only volumes labelled with the cluster ID are considered, so those created before it
+// was set are never collected, and a volume must stay unreferenced across passes for the
+// grace period, which covers the PersistentVolume of a just created volume not existing yet.
+type volumeCollector struct {
+	controller *VultrControllerServer
+	kube       kubeAPI
+	interval   time.Duration
+	grace      time.Duration
+	mode       string
+	filter     volumes.Filter
+	log        *logrus.Entry
+	now        func() time.Time
+
+	unreferenced map[string]*unreferencedVolume
+}
+
+// newInClusterVolumeCollector returns a volumeCollector reaching the Kubernetes API with
+// the service account of the controller pod
+func newInClusterVolumeCollector(c *VultrControllerServer) (*volumeCollector, error) {
+	kube, err := newInClusterKubeAPI(c.Driver.gcInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	return newVolumeCollector(c, kube), nil
+}
+
+func newVolumeCollector(c *VultrControllerServer, kube kubeAPI) *volumeCollector {
+	return &volumeCollector{
+		controller:   c,
+		kube:         kube,
+		interval:     c.Driver.gcInterval,
+		grace:        c.Driver.gcGracePeriod,
+		mode:         c.Driver.gcMode,
+		filter:       c.Driver.clusterVolumes(),
+		log:          c.Driver.log.WithField("loop", "orphan_gc"),
+		now:          time.Now,
+		unreferenced: make(map[string]*unreferencedVolume),
+	}
+}
+
+// run collects every interval until ctx is done
+func (g *volumeCollector) run(ctx context.Context) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		g.collect(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collect reports, and in delete mode deletes, the volumes of the cluster unreferenced
+// for longer than the grace period
+func (g *volumeCollector) collect(ctx context.Context) {
+	if err := g.controller.Driver.checkAPI("orphan collection"); err != nil {
+		g.log.Infof("skipping this pass: %v", err)
+		return
+	}
+
+	// volumes are listed before PersistentVolumes, so a volume created in between is not
+	// seen at all rather than seen without the PersistentVolume made for it
+	listed, err := g.controller.volumes.query(ctx, g.filter)
+	if err != nil {
+		g.log.Warnf("cannot list volumes: %v", err)
+		return
+	}
+
+	handles, err := g.kube.volumeHandles(ctx, g.controller.Driver.name)
+	if err != nil {
+		g.log.Warnf("cannot list persistent volumes: %v", err)
+		return
+	}
+
+	now := g.now()
+	unreferenced := make(map[string]*unreferencedVolume)
+	count, bytes := make(map[string]int), make(map[string]int64)
+
+	for i := range listed {
+		vol := &listed[i]
+		if handles[vol.ID] {
+			continue
+		}
+
+		u, ok := g.unreferenced[vol.ID]
+		if !ok {
+			u = &unreferencedVolume{since: now}
+		}
+		unreferenced[vol.ID] = u
+
+		if now.Sub(u.since) < g.grace {
+			continue
+		}
+		count[vol.StorageType]++
+		bytes[vol.StorageType] += vol.SizeBytes
+
+		log := g.log.WithFields(logrus.Fields{
+			"volume_id":    vol.ID,
+			"label":        vol.Label,
+			"storage_type": vol.StorageType,
+			"size_gb":      vol.SizeBytes / giB,
+			"since":        u.since.UTC().Format(time.RFC3339),
+		})
+
+		if g.mode != GCModeDelete {
+			if !u.reported {
+				log.Warn("volume of the cluster is not referenced by any persistent volume")
+				u.reported = true
+			}
+			continue
+		}
+
+		if len(vol.AttachedTo) > 0 {
+			if !u.reported {
+				log.WithField("attached_to", vol.AttachedTo).Warn("orphaned volume is attached, not deleting it")
+				u.reported = true
+			}
+			continue
+		}
+
+		if _, err := g.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.ID}); err != nil {
+			log.Warnf("cannot delete orphaned volume: %v", err)
+			gcDeletions.add(1, "failed")
+			continue
+		}
+		log.Info("deleted orphaned volume")
+		gcDeletions.add(1, "deleted")
+		delete(unreferenced, vol.ID)
+		count[vol.StorageType]--
+		bytes[vol.StorageType] -= vol.SizeBytes
+	}
+
+	g.unreferenced = unreferenced
+	for _, t := range g.controller.backends.types() {
+		gcOrphanedVolumes.set(float64(count[t]), t)
+		gcOrphanedVolumeBytes.set(float64(bytes[t]), t)
+	}
+}
@@ -0,0 +1,133 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vultr/govultr/v3"
+
+	"github.com/vultr/vultr-csi/internal/fakevultr"
+)
+
+func TestVolumeCollector(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/persistentvolumes" {
+			http.Error(w, "unexpected request", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"items":[` + //nolint:errcheck
+			`{"spec":{"csi":{"driver":"block.csi.vultr.com","volumeHandle":"bda4f333-bfd7-477b-84c2-e4df0ec9e5bf:ewr"}},` +
+			`"status":{"phase":"Released"}},` +
+			`{"spec":{"csi":{"driver":"other.csi.io","volumeHandle":"c56c7b6e-15c2-445e-9a5d-1063ab5828ec"}},` +
+			`"status":{"phase":"Bound"}}]}`))
+	}))
+	defer api.Close()
+
+	controller := NewFakeVultrControllerServer("volume collector")
+	controller.Driver.name = DefaultDriverName
+	controller.Driver.clusterID = "test"
+	controller.Driver.gcMode = GCModeDelete
+	controller.Driver.gcGracePeriod = time.Hour
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	g := newVolumeCollector(controller, kubeAPI{client: api.Client(), apiURL: api.URL})
+	g.now = func() time.Time { return now }
+
+	deletions := func() float64 {
+		gcDeletions.mu.Lock()
+		defer gcDeletions.mu.Unlock()
+		return gcDeletions.get([]string{"deleted"}).value
+	}
+	before := deletions()
+
+	// no pass runs while the driver holds off the Vultr API
+	controller.Driver.maintenance = newMaintenanceMode(time.Hour, controller.Driver.log)
+	controller.Driver.maintenance.observe(nil, &http.Response{StatusCode: http.StatusServiceUnavailable})
+	g.collect(context.Background())
+	if len(g.unreferenced) != 0 {
+		t.Fatalf("expected no collection during maintenance, got %v", g.unreferenced)
+	}
+	controller.Driver.maintenance = nil
+
+	const orphan = "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+	g.collect(context.Background())
+	if _, ok := g.unreferenced[orphan]; !ok || len(g.unreferenced) != 1 {
+		t.Fatalf("expected only the volume no persistent volume of the driver references, got %v", g.unreferenced)
+	}
+	if deletions() != before {
+		t.Error("expected no deletion within the grace period")
+	}
+
+	now = now.Add(2 * time.Hour)
+	g.collect(context.Background())
+	if deletions() != before {
+		t.Error("expected the attached orphan not to be deleted")
+	}
+
+	if err := controller.Driver.client.BlockStorage.Detach(context.Background(), orphan, nil); err != nil {
+		t.Fatal(err)
+	}
+	controller.volumes.invalidate()
+
+	g.collect(context.Background())
+	if deletions() != before+1 {
+		t.Error("expected the detached orphan past the grace period to be deleted")
+	}
+	if _, ok := g.unreferenced[orphan]; ok {
+		t.Error("expected the deleted orphan to be forgotten")
+	}
+}
+
+func TestVolumeCollectorInlineVolumes(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items":[]}`)) //nolint:errcheck
+	}))
+	defer api.Close()
+
+	d := newPreflightDriver(t, fakevultr.New())
+	d.name, d.clusterID, d.gcMode = DefaultDriverName, "test", GCModeReport
+	controller := NewVultrControllerServer(d)
+
+	ctx := context.Background()
+	create := func(label string) string {
+		vol, _, err := d.client.BlockStorage.Create(ctx, &govultr.BlockStorageCreate{Region: "ewr", SizeGB: 10, Label: label}) //nolint:bodyclose
+		if err != nil {
+			t.Fatal(err)
+		}
+		return vol.ID
+	}
+	orphan := create(d.newVolumeLabel("pvc-4f0b"))
+	// kubelet names inline volumes csi- and a hash, hashed again into the label
+	create(d.inlineVolumeLabel("csi-8a6ec8e6a2c1d5ea1c24aa9b1310cf3d7302ec4dd538bd8b4247a1a2d3e5a0f0"))
+
+	g := newVolumeCollector(controller, kubeAPI{client: api.Client(), apiURL: api.URL})
+	g.collect(ctx)
+	if _, ok := g.unreferenced[orphan]; !ok || len(g.unreferenced) != 1 {
+		t.Errorf("expected only the volume of the claim unreferenced, not the inline volume, got %v", g.unreferenced)
+	}
+}
+
+func TestValidateOrphanCollection(t *testing.T) {
+	tests := []struct {
+		name   string
+		driver VultrDriver
+		valid  bool
+	}{
+		{name: "disabled", driver: VultrDriver{}, valid: true},
+		{name: "report", driver: VultrDriver{gcInterval: time.Hour, gcMode: GCModeReport, isController: true, clusterID: "prod"}, valid: true},
+		{name: "unknown mode", driver: VultrDriver{gcInterval: time.Hour, gcMode: "purge", isController: true, clusterID: "prod"}},
+		{name: "node", driver: VultrDriver{gcInterval: time.Hour, gcMode: GCModeDelete, clusterID: "prod"}},
+		{name: "no cluster ID", driver: VultrDriver{gcInterval: time.Hour, gcMode: GCModeDelete, isController: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.driver.validateOrphanCollection(); (err == nil) != test.valid {
+				t.Errorf("expected valid %v, got %v", test.valid, err)
+			}
+		})
+	}
+}
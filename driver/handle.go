@@ -0,0 +1,92 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto" //nolint:staticcheck // the CSI messages are generated against the v1 API
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// legacyHandlePattern matches the volume handles of older driver releases, which carried
+// the region of the volume before or after its ID, such as ewr:<id> or <id>@ewr, and did
+// not always lower case the ID
+var legacyHandlePattern = regexp.MustCompile(`(?i)^(?:([a-z]{3})[:/@])?` +
+	`([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})(?:[:/@_-]([a-z]{3}))?$`)
+
+// volumeHandleFields are the request fields holding a volume handle
+var volumeHandleFields = []protoreflect.Name{"volume_id", "source_volume_id"}
+
+var legacyVolumeHandles = metrics.newCounter("legacy_volume_handles_total",
+	"Number of requests carrying a legacy volume handle which was converted")
+
+// convertedHandles are the legacy handles already converted, so that each is logged once
+var convertedHandles sync.Map
+
+// parseVolumeHandle returns the volume ID a handle names and the region a legacy handle
+// carried, reporting false for a handle in none of the legacy formats, which is used as is
+func parseVolumeHandle(handle string) (volumeID, region string, ok bool) {
+	m := legacyHandlePattern.FindStringSubmatch(strings.TrimSpace(handle))
+	if m == nil || (m[1] != "" && m[3] != "") {
+		return "", "", false
+	}
+
+	region = m[1]
+	if region == "" {
+		region = m[3]
+	}
+	return strings.ToLower(m[2]), strings.ToLower(region), true
+}
+
+// normalizeVolumeHandles rewrites the legacy volume handles of a CSI request to the volume
+// IDs they name, in place. PersistentVolumes keep the handle they were provisioned with
+// for life, so long lived clusters upgrading from older releases still send them.
+func normalizeVolumeHandles(req interface{}, log *logrus.Entry) {
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return
+	}
+
+	m := proto.MessageReflect(msg)
+	for _, name := range volumeHandleFields {
+		field := m.Descriptor().Fields().ByName(name)
+		if field == nil || field.Kind() != protoreflect.StringKind {
+			continue
+		}
+
+		handle := m.Get(field).String()
+		volumeID, region, ok := parseVolumeHandle(handle)
+		if !ok || volumeID == handle {
+			continue
+		}
+
+		m.Set(field, protoreflect.ValueOfString(volumeID))
+		legacyVolumeHandles.add(1)
+
+		fields := logrus.Fields{
+			"handle":    handle,
+			"volume_id": volumeID,
+			"region":    region,
+		}
+		if _, seen := convertedHandles.LoadOrStore(handle, struct{}{}); seen {
+			log.WithFields(fields).Debug("converted legacy volume handle")
+		} else {
+			log.WithFields(fields).Info("converted legacy volume handle, it is accepted but new volumes get plain IDs")
+		}
+	}
+}
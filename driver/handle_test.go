@@ -0,0 +1,61 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseVolumeHandle(t *testing.T) {
+	const volumeID = "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+
+	tests := []struct {
+		handle   string
+		volumeID string
+		region   string
+		ok       bool
+	}{
+		{handle: volumeID, volumeID: volumeID, ok: true},
+		{handle: "C56C7B6E-15C2-445E-9A5D-1063AB5828EC", volumeID: volumeID, ok: true},
+		{handle: volumeID + ":ewr", volumeID: volumeID, region: "ewr", ok: true},
+		{handle: volumeID + "@EWR", volumeID: volumeID, region: "ewr", ok: true},
+		{handle: volumeID + "-sjc", volumeID: volumeID, region: "sjc", ok: true},
+		{handle: "ams/" + volumeID, volumeID: volumeID, region: "ams", ok: true},
+		{handle: "ams/" + volumeID + ":ewr"},
+		{handle: volumeID + ":newark"},
+		{handle: "some-volume"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.handle, func(t *testing.T) {
+			volumeID, region, ok := parseVolumeHandle(test.handle)
+			if volumeID != test.volumeID || region != test.region || ok != test.ok {
+				t.Errorf("expected %q, %q, %v, got %q, %q, %v", test.volumeID, test.region, test.ok, volumeID, region, ok)
+			}
+		})
+	}
+}
+
+func TestNormalizeVolumeHandles(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	const volumeID = "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+
+	stage := &csi.NodeStageVolumeRequest{VolumeId: volumeID + ":ewr"}
+	normalizeVolumeHandles(stage, log)
+	if stage.VolumeId != volumeID {
+		t.Errorf("expected the legacy handle to be converted, got %q", stage.VolumeId)
+	}
+
+	snapshot := &csi.CreateSnapshotRequest{SourceVolumeId: "ewr/" + volumeID, Name: "snapshot"}
+	normalizeVolumeHandles(snapshot, log)
+	if snapshot.SourceVolumeId != volumeID || snapshot.Name != "snapshot" {
+		t.Errorf("expected the legacy source volume handle to be converted, got %+v", snapshot)
+	}
+
+	other := &csi.NodeUnstageVolumeRequest{VolumeId: "some-volume"}
+	normalizeVolumeHandles(other, log)
+	if other.VolumeId != "some-volume" {
+		t.Errorf("expected an unknown handle to be left as is, got %q", other.VolumeId)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vultr/govultr/v3"
+)
+
+const (
+	// HealthzPath is the health API path answering liveness probes
+	HealthzPath = "/healthz"
+	// ReadyzPath is the health API path answering readiness probes
+	ReadyzPath = "/readyz"
+
+	healthReadTimeout = 10 * time.Second
+
+	// apiCheckTimeout bounds the Vultr API call of a readiness check
+	apiCheckTimeout = 5 * time.Second
+	// apiCheckTTL is how long the outcome of a Vultr API check answers probes, so that
+	// frequent probes do not eat into the API rate limit
+	apiCheckTTL = 30 * time.Second
+)
+
+// healthCheck is the outcome of one of the checks behind a probe
+type healthCheck struct {
+	name string
+	err  error
+}
+
+// healthServer serves HTTP liveness and readiness probes. Liveness only needs the gRPC
+// server to be serving, as restarting the plugin fixes nothing else. Readiness also needs
+// the Vultr API to answer the controller and the block devices to be visible to the node.
+type healthServer struct {
+	driver *VultrDriver
+	grpc   NonBlockingGRPCServer
+	now    func() time.Time
+
+	mu         sync.Mutex
+	apiChecked time.Time
+	apiErr     error
+}
+
+func newHealthServer(driver *VultrDriver, grpc NonBlockingGRPCServer) *healthServer {
+	return &healthServer{driver: driver, grpc: grpc, now: time.Now}
+}
+
+func (h *healthServer) serve() {
+	mux := http.NewServeMux()
+	mux.HandleFunc(HealthzPath, h.handleHealthz)
+	mux.HandleFunc(ReadyzPath, h.handleReadyz)
+
+	server := &http.Server{
+		Addr:              h.driver.healthAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: healthReadTimeout,
+	}
+
+	h.driver.log.WithFields(logrus.Fields{
+		"address": h.driver.healthAddr,
+	}).Info("Health API: listening")
+
+	if err := server.ListenAndServe(); err != nil {
+		h.driver.log.Errorf("Health API: failed to serve: %v", err)
+	}
+}
+
+func (h *healthServer) handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	writeHealthChecks(w, []healthCheck{h.checkGRPC()})
+}
+
+func (h *healthServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := []healthCheck{h.checkGRPC()}
+	if h.driver.isController {
+		checks = append(checks, h.checkAPI(r.Context()))
+	}
+	// the controller deployment runs with a token and stages nothing, node plugins run
+	// without one unless they attach vfs volumes themselves
+	if !h.driver.isController || h.driver.nodeAttachVFS {
+		checks = append(checks, checkDevicePaths())
+	}
+
+	writeHealthChecks(w, checks)
+}
+
+// writeHealthChecks answers a probe with one line per check, failing it when any check failed
+func writeHealthChecks(w http.ResponseWriter, checks []healthCheck) {
+	var lines []string
+	code := http.StatusOK
+
+	for _, c := range checks {
+		if c.err != nil {
+			lines = append(lines, fmt.Sprintf("[-]%s failed: %v", c.name, c.err))
+			code = http.StatusServiceUnavailable
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("[+]%s ok", c.name))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	fmt.Fprintln(w, strings.Join(lines, "\n")) //nolint:errcheck
+}
+
+func (h *healthServer) checkGRPC() healthCheck {
+	check := healthCheck{name: "grpc"}
+	if !h.grpc.Serving() {
+		check.err = errors.New("server is not serving")
+	}
+	return check
+}
+
+// checkAPI lists a single volume to tell that the Vultr API answers with the token of
+// the controller, reusing the outcome of the last call for apiCheckTTL
+func (h *healthServer) checkAPI(ctx context.Context) healthCheck {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if now := h.now(); h.apiChecked.IsZero() || now.Sub(h.apiChecked) >= apiCheckTTL {
+		ctx, cancel := context.WithTimeout(ctx, apiCheckTimeout)
+		defer cancel()
+
+		_, _, _, h.apiErr = h.driver.client.BlockStorage.List(ctx, &govultr.ListOptions{PerPage: 1}) //nolint:bodyclose
+		h.apiChecked = now
+	}
+
+	return healthCheck{name: "vultr_api", err: h.apiErr}
+}
+
+// checkDevicePaths tells that the node sees the device nodes of the virtio disks the
+// kernel enumerated, which a plugin container without the host /dev does not
+func checkDevicePaths() healthCheck {
+	check := healthCheck{name: "devices"}
+
+	entries, err := os.ReadDir(sysBlockPath)
+	if err != nil {
+		check.err = fmt.Errorf("cannot list block devices: %w", err)
+		return check
+	}
+
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "vd") {
+			continue
+		}
+
+		if _, err := os.Stat(filepath.Join(devPath, e.Name())); err != nil {
+			check.err = fmt.Errorf("block device %s has no accessible device node: %w", e.Name(), err)
+			return check
+		}
+	}
+
+	return check
+}
@@ -0,0 +1,102 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vultr/govultr/v3"
+)
+
+// fakeGRPCServer reports a fixed serving state
+type fakeGRPCServer struct {
+	NonBlockingGRPCServer
+	serving bool
+}
+
+func (f *fakeGRPCServer) Serving() bool { return f.serving }
+
+// failingBS fails every listing, counting the calls
+type failingBS struct {
+	govultr.BlockStorageService
+	lists int
+}
+
+func (f *failingBS) List(context.Context, *govultr.ListOptions) ([]govultr.BlockStorage, *govultr.Meta, *http.Response, error) {
+	f.lists++
+	return nil, nil, nil, errors.New("connection refused")
+}
+
+func TestHealthProbes(t *testing.T) {
+	dir := t.TempDir()
+	defer func(s, d string) { sysBlockPath, devPath = s, d }(sysBlockPath, devPath)
+	sysBlockPath, devPath = filepath.Join(dir, "sys"), filepath.Join(dir, "dev")
+	for _, p := range []string{filepath.Join(sysBlockPath, "vda"), devPath} {
+		if err := os.MkdirAll(p, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	probe := func(h *healthServer, path string) (int, string) {
+		rec := httptest.NewRecorder()
+		mux := http.NewServeMux()
+		mux.HandleFunc(HealthzPath, h.handleHealthz)
+		mux.HandleFunc(ReadyzPath, h.handleReadyz)
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, http.NoBody))
+		return rec.Code, rec.Body.String()
+	}
+
+	grpc := &fakeGRPCServer{}
+	node := newHealthServer(&VultrDriver{log: logrus.NewEntry(logrus.New())}, grpc)
+
+	if code, body := probe(node, HealthzPath); code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]grpc") {
+		t.Errorf("expected liveness to fail before the gRPC server serves, got %d %q", code, body)
+	}
+
+	grpc.serving = true
+	if code, body := probe(node, HealthzPath); code != http.StatusOK {
+		t.Errorf("expected liveness to pass, got %d %q", code, body)
+	}
+
+	// the container does not see the host device nodes
+	if code, body := probe(node, ReadyzPath); code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]devices") {
+		t.Errorf("expected readiness to fail without the device node, got %d %q", code, body)
+	}
+
+	if err := os.WriteFile(filepath.Join(devPath, "vda"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := probe(node, ReadyzPath); code != http.StatusOK {
+		t.Errorf("expected the node to be ready, got %d %q", code, body)
+	}
+
+	bs := &failingBS{}
+	client := newFakeClient()
+	client.BlockStorage = bs
+	controller := newHealthServer(&VultrDriver{log: logrus.NewEntry(logrus.New()), isController: true, client: client}, grpc)
+
+	now := time.Unix(0, 0)
+	controller.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if code, body := probe(controller, ReadyzPath); code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]vultr_api") {
+			t.Errorf("expected readiness to fail while the API is unreachable, got %d %q", code, body)
+		}
+	}
+	if bs.lists != 1 {
+		t.Errorf("expected the API check to be reused, got %d calls", bs.lists)
+	}
+
+	now = now.Add(apiCheckTTL)
+	client.BlockStorage = &fakeBS{}
+	if code, body := probe(controller, ReadyzPath); code != http.StatusOK || strings.Contains(body, "devices") {
+		t.Errorf("expected the controller to be ready without checking devices, got %d %q", code, body)
+	}
+}
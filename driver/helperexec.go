@@ -0,0 +1,214 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	osexec "os/exec"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+)
+
+const (
+	// helperCleanupReserve is the most of the time left to an RPC kept from its helpers,
+	// to clean up after one killed by the deadline and still answer the caller in time
+	helperCleanupReserve = 5 * time.Second
+
+	// helperWaitDelay bounds the wait for the output of a killed helper, which a process
+	// it left behind could otherwise hold open
+	helperWaitDelay = 5 * time.Second
+)
+
+var killedHelpers = metrics.newCounter("killed_helpers_total",
+	"Number of filesystem helpers killed by the deadline of their RPC, by command", "command")
+
+// helperExec runs the commands of the node, such as mkfs and the resize tools, each in a
+// process group of its own, which is killed whole once the context of the command is
+// done. Killing the command alone would leave the processes it started, such as the
+// mkfs.ext4 of mkfs, running on the device.
+type helperExec struct{}
+
+func newHelperExec() exec.Interface {
+	return &helperExec{}
+}
+
+func (e *helperExec) Command(cmd string, args ...string) exec.Cmd {
+	return e.CommandContext(context.Background(), cmd, args...)
+}
+
+func (e *helperExec) CommandContext(ctx context.Context, cmd string, args ...string) exec.Cmd {
+	c := osexec.CommandContext(ctx, cmd, args...)
+	setProcessGroup(c)
+	c.WaitDelay = helperWaitDelay
+	return &helperCmd{Cmd: c}
+}
+
+func (e *helperExec) LookPath(file string) (string, error) {
+	path, err := osexec.LookPath(file)
+	return path, helperError(err)
+}
+
+// helperCmd is the exec.Cmd of helperExec
+type helperCmd struct {
+	*osexec.Cmd
+}
+
+func (c *helperCmd) Run() error {
+	return helperError(c.Cmd.Run())
+}
+
+func (c *helperCmd) CombinedOutput() ([]byte, error) {
+	out, err := c.Cmd.CombinedOutput()
+	return out, helperError(err)
+}
+
+func (c *helperCmd) Output() ([]byte, error) {
+	out, err := c.Cmd.Output()
+	return out, helperError(err)
+}
+
+func (c *helperCmd) SetDir(dir string)                  { c.Dir = dir }
+func (c *helperCmd) SetStdin(in io.Reader)              { c.Stdin = in }
+func (c *helperCmd) SetStdout(out io.Writer)            { c.Stdout = out }
+func (c *helperCmd) SetStderr(out io.Writer)            { c.Stderr = out }
+func (c *helperCmd) SetEnv(env []string)                { c.Env = env }
+func (c *helperCmd) Start() error                       { return helperError(c.Cmd.Start()) }
+func (c *helperCmd) Wait() error                        { return helperError(c.Cmd.Wait()) }
+func (c *helperCmd) StdoutPipe() (io.ReadCloser, error) { return c.Cmd.StdoutPipe() }
+func (c *helperCmd) StderrPipe() (io.ReadCloser, error) { return c.Cmd.StderrPipe() }
+
+// Stop kills the process group of the command
+func (c *helperCmd) Stop() {
+	if c.Process != nil {
+		_ = c.Cancel()
+	}
+}
+
+// helperError returns the errors of os/exec as those of k8s.io/utils/exec, which
+// mount-utils and the node tell exit codes and missing tools apart with
+func helperError(err error) error {
+	var exitErr *osexec.ExitError
+	var pathErr *fs.PathError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &exitErr):
+		return &exec.ExitErrorWrapper{ExitError: exitErr}
+	case errors.Is(err, osexec.ErrNotFound), errors.As(err, &pathErr):
+		return exec.ErrExecutableNotFound
+	}
+	return err
+}
+
+// deadlineExec runs the commands of mount-utils, which takes no context, until ctx is done
+type deadlineExec struct {
+	exec.Interface
+	ctx context.Context
+}
+
+func (e *deadlineExec) Command(cmd string, args ...string) exec.Cmd {
+	return e.observe(cmd, e.Interface.CommandContext(e.ctx, cmd, args...))
+}
+
+func (e *deadlineExec) CommandContext(ctx context.Context, cmd string, args ...string) exec.Cmd {
+	return e.observe(cmd, e.Interface.CommandContext(ctx, cmd, args...))
+}
+
+func (e *deadlineExec) observe(name string, c exec.Cmd) exec.Cmd {
+	return &deadlineCmd{Cmd: c, ctx: e.ctx, name: name}
+}
+
+// deadlineCmd counts the commands the deadline killed
+type deadlineCmd struct {
+	exec.Cmd
+	ctx  context.Context
+	name string
+}
+
+func (c *deadlineCmd) Run() error {
+	return c.killed(c.Cmd.Run())
+}
+
+func (c *deadlineCmd) CombinedOutput() ([]byte, error) {
+	out, err := c.Cmd.CombinedOutput()
+	return out, c.killed(err)
+}
+
+func (c *deadlineCmd) Output() ([]byte, error) {
+	out, err := c.Cmd.Output()
+	return out, c.killed(err)
+}
+
+func (c *deadlineCmd) killed(err error) error {
+	if err != nil && c.ctx.Err() != nil {
+		killedHelpers.add(1, c.name)
+	}
+	return err
+}
+
+// helperContext returns the context the helpers of an RPC run with, done short of the
+// deadline of ctx by helperCleanupReserve, or a tenth of the time left when that is less
+func helperContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline.Add(-min(time.Until(deadline)/10, helperCleanupReserve)))
+}
+
+// cleanupContext returns the context of the cleanup after a helper killed by the end of
+// ctx, which goes on however the RPC ended
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), helperCleanupReserve)
+}
+
+// boundMounter returns the mounter of the driver with its helpers, such as mkfs, run
+// until ctx is done
+func (n *VultrNodeServer) boundMounter(ctx context.Context) nodeMounter {
+	safe, ok := n.Driver.mounter.(*mount.SafeFormatAndMount)
+	if !ok {
+		return n.Driver.mounter
+	}
+	return mount.NewSafeFormatAndMount(safe.Interface, &deadlineExec{Interface: safe.Exec, ctx: ctx})
+}
+
+// boundResizer returns the resizer of the driver with its helpers, such as resize2fs and
+// xfs_growfs, run until ctx is done
+func (n *VultrNodeServer) boundResizer(ctx context.Context) fsResizer {
+	if _, ok := n.Driver.resizer.(*mount.ResizeFs); !ok {
+		return n.Driver.resizer
+	}
+	return mount.NewResizeFs(&deadlineExec{Interface: n.Driver.exec, ctx: ctx})
+}
+
+// wipePartialFormat wipes the signatures a mkfs killed by the deadline of its RPC left on
+// the device, formatted only as the device was blank, so that the next stage formats the
+// device again rather than finding a filesystem mkfs did not finish
+func (n *VultrNodeServer) wipePartialFormat(ctx context.Context, log *logrus.Entry, device string) {
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+
+	log = log.WithField("device", device)
+	if out, err := n.runCommand(ctx, "wipefs", "-a", device); err != nil {
+		log.Errorf("cannot wipe the filesystem mkfs left unfinished on the device: %v: %s", err, out)
+		return
+	}
+	log.Warn("wiped the filesystem mkfs left unfinished on the device as the request ran out of time")
+}
@@ -0,0 +1,40 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"k8s.io/utils/exec"
+)
+
+func TestHelperExecKillsProcessGroup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// the sleep the shell starts holds the output open unless it is killed with the shell
+	start := time.Now()
+	if _, err := newHelperExec().CommandContext(ctx, "sh", "-c", "sleep 30; echo done").CombinedOutput(); err == nil {
+		t.Fatal("expected the helper killed by its context")
+	}
+	if elapsed := time.Since(start); elapsed >= helperWaitDelay {
+		t.Errorf("expected the process group of the helper killed, the helper returned after %v", elapsed)
+	}
+}
+
+func TestHelperExecErrors(t *testing.T) {
+	e := newHelperExec()
+
+	var exitErr exec.ExitError
+	if err := e.Command("sh", "-c", "exit 3").Run(); !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+
+	if err := e.Command("no-such-helper").Run(); !errors.Is(err, exec.ErrExecutableNotFound) {
+		t.Errorf("expected ErrExecutableNotFound, got %v", err)
+	}
+	if _, err := e.LookPath("no-such-helper"); !errors.Is(err, exec.ErrExecutableNotFound) {
+		t.Errorf("expected ErrExecutableNotFound, got %v", err)
+	}
+}
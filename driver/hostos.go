@@ -0,0 +1,114 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// hostOS is what the node server needs from the operating system of the node beyond
+// the mounts mount-utils abstracts. Linux nodes are served by linuxHost, and Windows
+// nodes by windowsHost, with the node plugin running as a HostProcess container. Other
+// operating systems get unsupportedHost, which stages nothing.
+type hostOS interface {
+	deviceLinker
+
+	// diskFormat returns the filesystem or LUKS format on device, empty when unformatted
+	diskFormat(device string) (string, error)
+
+	// partitionTable returns the partition table on a device holding no filesystem,
+	// empty when there is none
+	partitionTable(device string) (string, error)
+
+	// statfs returns the capacity and usage of the filesystem mounted at path
+	statfs(path string) (*volumeUsage, error)
+
+	// rescanDeviceSize asks the node to re-read the size of the disks backing device,
+	// which the kernel may not pick up after Vultr expanded the volume until then
+	rescanDeviceSize(ctx context.Context, log *logrus.Entry, device string)
+
+	// diskIOStats returns the IO counters of the block device, errors.ErrUnsupported
+	// when the host keeps none the driver can read
+	diskIOStats(device string) (*diskIOStats, error)
+
+	// blockDeviceBytes returns the size of the block device at path, reporting false
+	// when path is not a block device
+	blockDeviceBytes(path string) (int64, bool, error)
+
+	// isReadOnlyMount reports whether the mount at target is read-only
+	isReadOnlyMount(target string) (bool, error)
+
+	// remountReadOnly flips an existing bind mount to read-only
+	remountReadOnly(target string) error
+
+	// remountFilesystem flips the filesystem mounted at target, and with it every bind
+	// mount of it, to read-only or writable
+	remountFilesystem(target string, readOnly bool) error
+
+	// openFilesUnder returns how many files processes of the node have open, or as their
+	// working directory, under any of paths, errors.ErrUnsupported when the host cannot tell
+	openFilesUnder(paths []string) (int, error)
+
+	// lazyUnmount detaches the mount at target from the node at once, which a plain unmount
+	// of a dead mount may fail or hang at, the kernel dropping it once no longer in use
+	lazyUnmount(target string) error
+
+	// isBusy reports whether a mount failed because its target is already in use
+	isBusy(err error) bool
+
+	// fsTypes returns the filesystems the node can format and mount
+	fsTypes() []string
+
+	// rawBlock reports whether the node can publish raw block volumes
+	rawBlock() bool
+
+	// mountGroups reports whether the node can give the files of a volume to the group
+	// of a volume mount group
+	mountGroups() bool
+
+	// setGroupOwnership gives the files under root to gid as kubelet does for an fsGroup,
+	// unless root already is, reporting whether it changed any
+	setGroupOwnership(ctx context.Context, root string, gid int) (bool, error)
+}
+
+// deviceLinker finds the devices the disks of attached volumes appear as on the node
+type deviceLinker interface {
+	// findDevice returns the device of the attached volume with the mount ID, reporting
+	// how it was found, and empty when it did not appear yet
+	findDevice(ctx context.Context, log *logrus.Entry, mountID string) (string, string)
+
+	// rescanDevices asks the node to enumerate the disks attached since it last did
+	rescanDevices(ctx context.Context)
+}
+
+// checkHostCapability refuses a filesystem or raw block volume the operating system of
+// the node cannot stage, which the controller could not tell when creating the volume
+func (n *VultrNodeServer) checkHostCapability(rpc, fsType string, block bool) error {
+	if block {
+		if !n.host.rawBlock() {
+			return status.Errorf(codes.InvalidArgument, "%s raw block volumes are not supported on this node", rpc)
+		}
+		return nil
+	}
+
+	if !hasOption(n.host.fsTypes(), fsType) {
+		return status.Errorf(codes.InvalidArgument, "%s %s filesystems are not supported on this node, supported types are %v",
+			rpc, fsType, n.host.fsTypes())
+	}
+	return nil
+}
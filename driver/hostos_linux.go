@@ -0,0 +1,374 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+)
+
+// linuxHost finds virtio disks through udev and sysfs and formats them with the mkfs
+// tools of the node plugin image
+type linuxHost struct {
+	n *VultrNodeServer
+}
+
+func newHostOS(n *VultrNodeServer) hostOS {
+	return &linuxHost{n: n}
+}
+
+// findDevice returns the device linked by the mount ID, else the device whose serial
+// matches it, reporting which, and empty when neither exists yet
+func (h *linuxHost) findDevice(_ context.Context, log *logrus.Entry, mountID string) (string, string) {
+	link := getDeviceByPath(mountID)
+	if _, err := os.Stat(link); err == nil {
+		checkLinkSerial(log, mountID, link)
+		return link, foundByLink
+	}
+
+	if device := deviceBySerial(log, mountID); device != "" {
+		return device, foundBySerial
+	}
+	return "", ""
+}
+
+// rescanDevices asks udev to replay the block device events and waits for it to process
+// them. Failures are only logged as the next look for the device tells whether it helped.
+func (h *linuxHost) rescanDevices(ctx context.Context) {
+	for _, args := range [][]string{
+		{"trigger", "--subsystem-match=block", "--action=add"},
+		{"settle", "--timeout=" + udevSettleTimeout},
+	} {
+		if out, err := h.n.runCommand(ctx, "udevadm", args...); err != nil {
+			h.n.Driver.log.Debugf("udevadm %s failed: %v: %s", strings.Join(args, " "), err, out)
+		}
+	}
+}
+
+// rescanDeviceSize writes to the rescan attribute of the disks backing device, those
+// under a LUKS2 mapping included. virtio-blk disks have none and are resized by the
+// kernel when the hypervisor notifies them, so they are left to that.
+func (h *linuxHost) rescanDeviceSize(_ context.Context, log *logrus.Entry, device string) {
+	name := filepath.Base(device)
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		name = filepath.Base(resolved)
+	}
+
+	disks := []string{name}
+	if slaves, err := os.ReadDir(filepath.Join(sysBlockPath, name, "slaves")); err == nil && len(slaves) > 0 {
+		disks = disks[:0]
+		for _, s := range slaves {
+			disks = append(disks, s.Name())
+		}
+	}
+
+	for _, disk := range disks {
+		rescan := filepath.Join(sysBlockPath, disk, "device", "rescan")
+		if _, err := os.Stat(rescan); err != nil {
+			continue
+		}
+		if err := os.WriteFile(rescan, []byte("1"), 0); err != nil {
+			log.Warnf("cannot rescan the size of %s: %v", disk, err)
+			continue
+		}
+		log.WithField("disk", disk).Debug("rescanned disk size")
+	}
+}
+
+func (h *linuxHost) diskFormat(device string) (string, error) {
+	formatter := &mount.SafeFormatAndMount{Interface: h.n.Driver.mounter, Exec: h.n.Driver.exec}
+	return formatter.GetDiskFormat(device)
+}
+
+// blkidNothingFound is the exit status of blkid finding no signature on the device
+const blkidNothingFound = 2
+
+// partitionTable probes device with blkid as mount-utils does, which only reports that
+// there probably are partitions rather than the table it found
+func (h *linuxHost) partitionTable(device string) (string, error) {
+	out, err := h.n.Driver.exec.Command("blkid", "-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", device).CombinedOutput()
+	if err != nil {
+		var exitErr exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == blkidNothingFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("blkid on %s failed: %v: %s", device, err, out)
+	}
+
+	var fsType, table string
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+		switch key {
+		case "TYPE":
+			fsType = value
+		case "PTTYPE":
+			table = value
+		}
+	}
+
+	// a filesystem on the whole device is mounted as is, whatever table blkid also sees
+	if fsType != "" {
+		return "", nil
+	}
+	return table, nil
+}
+
+func (h *linuxHost) statfs(path string) (*volumeUsage, error) {
+	statfs := &unix.Statfs_t{}
+	if err := unix.Statfs(path, statfs); err != nil {
+		return nil, err
+	}
+
+	return &volumeUsage{
+		TotalBytes:     int64(statfs.Blocks) * int64(statfs.Bsize),                         //nolint:unconvert // 32bit builds fail otherwise
+		UsedBytes:      (int64(statfs.Blocks) - int64(statfs.Bfree)) * int64(statfs.Bsize), //nolint:unconvert // 32bit builds fail otherwise
+		AvailableBytes: int64(statfs.Bavail) * int64(statfs.Bsize),                         //nolint:unconvert // 32bit builds fail otherwise
+		TotalInodes:    int64(statfs.Files),
+		UsedInodes:     int64(statfs.Files) - int64(statfs.Ffree),
+	}, nil
+}
+
+// diskIOStats reads the stat of the device in sysfs, after the links to it
+func (h *linuxHost) diskIOStats(device string) (*diskIOStats, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(sysBlockPath, filepath.Base(resolved), "stat"))
+	if err != nil {
+		return nil, err
+	}
+	return parseDiskStat(string(data))
+}
+
+// blockDeviceBytes returns the size of the block device at path with the BLKGETSIZE64
+// ioctl, which a raw block volume published as a device node has no filesystem to report
+func (h *linuxHost) blockDeviceBytes(path string) (int64, bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false, err
+	}
+	if info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return 0, false, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, true, err
+	}
+	defer f.Close()
+
+	var size uint64
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, true, errno
+	}
+	return int64(size), true, nil
+}
+
+// isReadOnlyMount reports whether the topmost mount at target has the ro option
+func (h *linuxHost) isReadOnlyMount(target string) (bool, error) {
+	mountPoints, err := h.n.Driver.mounter.List()
+	if err != nil {
+		return false, err
+	}
+
+	path, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		path = target
+	}
+
+	var found *mount.MountPoint
+	for i := range mountPoints {
+		if mountPoints[i].Path == path {
+			found = &mountPoints[i]
+		}
+	}
+
+	if found == nil {
+		return false, fmt.Errorf("%s is not a mount point", target)
+	}
+
+	return hasOption(found.Opts, "ro"), nil
+}
+
+func (h *linuxHost) remountReadOnly(target string) error {
+	return unix.Mount("", target, "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY, "")
+}
+
+// remountFilesystem remounts with mount, which keeps the other options of the mount where
+// a bare remount with the mount syscall would reset them
+func (h *linuxHost) remountFilesystem(target string, readOnly bool) error {
+	mode := "rw"
+	if readOnly {
+		mode = "ro"
+	}
+
+	out, err := h.n.Driver.exec.Command("mount", "-o", "remount,"+mode, target).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mount -o remount,%s %s failed: %v: %s", mode, target, err, out)
+	}
+	return nil
+}
+
+// procPath is where the processes of the node are found, all of them when the node plugin
+// runs in the PID namespace of the host
+var procPath = "/proc"
+
+// openFilesUnder reads the links of the open files and working directory of each process,
+// which name the path opened even when the mount under it is dead
+func (h *linuxHost) openFilesUnder(paths []string) (int, error) {
+	procs, err := os.ReadDir(procPath)
+	if err != nil {
+		return 0, err
+	}
+
+	open := 0
+	for _, proc := range procs {
+		if _, err := strconv.Atoi(proc.Name()); err != nil {
+			continue
+		}
+		dir := filepath.Join(procPath, proc.Name())
+
+		links := []string{filepath.Join(dir, "cwd")}
+		// the process may have exited since
+		fds, _ := os.ReadDir(filepath.Join(dir, "fd"))
+		for _, fd := range fds {
+			links = append(links, filepath.Join(dir, "fd", fd.Name()))
+		}
+
+		for _, link := range links {
+			if target, err := os.Readlink(link); err == nil && underAnyPath(target, paths) {
+				open++
+			}
+		}
+	}
+	return open, nil
+}
+
+func underAnyPath(path string, roots []string) bool {
+	for _, root := range roots {
+		if path == root || strings.HasPrefix(path, strings.TrimSuffix(root, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *linuxHost) lazyUnmount(target string) error {
+	out, err := h.n.Driver.exec.Command("umount", "-l", target).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("umount -l %s failed: %v: %s", target, err, out)
+	}
+	return nil
+}
+
+// isBusy reports whether err is EBUSY, which mount prints rather than returns
+func (h *linuxHost) isBusy(err error) bool {
+	return errors.Is(err, unix.EBUSY) || strings.Contains(err.Error(), unix.EBUSY.Error())
+}
+
+func (h *linuxHost) fsTypes() []string {
+	return []string{fsTypeBtrfs, fsTypeExt3, fsTypeExt4, fsTypeXFS}
+}
+
+func (h *linuxHost) rawBlock() bool {
+	return true
+}
+
+func (h *linuxHost) mountGroups() bool {
+	return true
+}
+
+const (
+	// groupRWMode and groupExecMode are the permissions kubelet adds for an fsGroup,
+	// execute only to directories
+	groupRWMode   os.FileMode = 0o660
+	groupExecMode os.FileMode = 0o110
+)
+
+// setGroupOwnership walks root like kubelet's fsGroupChangePolicy OnRootMismatch, so a
+// volume already given to gid is not walked again on each stage and publish. root is
+// changed last, so a walk cut short by ctx is taken up again on the next call.
+func (h *linuxHost) setGroupOwnership(ctx context.Context, root string, gid int) (bool, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return false, err
+	}
+	if ownedByGroup(info, gid) {
+		return false, nil
+	}
+
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		return setGroup(path, entry, gid)
+	})
+	if err != nil {
+		return true, err
+	}
+
+	return true, setGroup(root, fs.FileInfoToDirEntry(info), gid)
+}
+
+// setGroup gives path to gid, group read-write and with directories setgid. The mode of
+// a symlink is that of its target, so only its group is changed.
+func setGroup(path string, entry fs.DirEntry, gid int) error {
+	if err := os.Lchown(path, -1, gid); err != nil {
+		return err
+	}
+	if entry.Type()&fs.ModeSymlink != 0 {
+		return nil
+	}
+
+	info, err := entry.Info()
+	if err != nil {
+		return err
+	}
+	mode := info.Mode() | groupRWMode
+	if info.IsDir() {
+		mode |= os.ModeSetgid | groupExecMode
+	}
+	return os.Chmod(path, mode)
+}
+
+// ownedByGroup reports whether the directory at the root of a volume is already given to gid
+func ownedByGroup(info os.FileInfo, gid int) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || int(st.Gid) != gid {
+		return false
+	}
+	mode := info.Mode()
+	return mode&groupRWMode == groupRWMode && (!info.IsDir() || mode&groupExecMode == groupExecMode && mode&os.ModeSetgid != 0)
+}
@@ -0,0 +1,207 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckHostCapability(t *testing.T) {
+	node := NewVultrNodeDriver(&VultrDriver{log: logrus.NewEntry(logrus.New())})
+
+	for _, fsType := range node.host.fsTypes() {
+		if err := node.checkHostCapability("NodeStageVolume", fsType, false); err != nil {
+			t.Errorf("expected %s to be supported, got %v", fsType, err)
+		}
+	}
+	if err := node.checkHostCapability("NodeStageVolume", "", true); err != nil {
+		t.Errorf("expected raw block volumes to be supported, got %v", err)
+	}
+
+	if err := node.checkHostCapability("NodeStageVolume", fsTypeNTFS, false); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for ntfs on a Linux node, got %v", err)
+	}
+}
+
+func TestPartitionTable(t *testing.T) {
+	const probe = "blkid -p -s TYPE -s PTTYPE -o export /dev/vdb"
+
+	tests := []struct {
+		name     string
+		output   string
+		exitCode int
+		expected string
+		wantErr  bool
+	}{
+		{name: "gpt", output: "DEVNAME=/dev/vdb\nPTTYPE=gpt\n", expected: "gpt"},
+		{name: "dos", output: "DEVNAME=/dev/vdb\nPTTYPE=dos\n", expected: "dos"},
+		{name: "filesystem", output: "DEVNAME=/dev/vdb\nTYPE=ext4\n"},
+		{name: "filesystem over a table", output: "DEVNAME=/dev/vdb\nTYPE=iso9660\nPTTYPE=dos\n"},
+		{name: "blank", exitCode: blkidNothingFound},
+		{name: "blkid failure", output: "permission denied", exitCode: 4, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fe := &fakeExec{outputs: map[string]string{probe: test.output}}
+			if test.exitCode != 0 {
+				fe.exitCodes = map[string]int{probe: test.exitCode}
+			}
+			node := newFakeMountNode(fe)
+
+			table, err := node.host.partitionTable("/dev/vdb")
+			if (err != nil) != test.wantErr || table != test.expected {
+				t.Errorf("expected %q, error %v, got %q, %v", test.expected, test.wantErr, table, err)
+			}
+			if err != nil && !strings.Contains(err.Error(), "permission denied") {
+				t.Errorf("expected the output of blkid in the error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSetGroupOwnership(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Chmod(root, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "dir"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dir", "file"), []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/file", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	node := NewVultrNodeDriver(&VultrDriver{log: logrus.NewEntry(logrus.New())})
+	gid := os.Getgid()
+
+	changed, err := node.host.setGroupOwnership(context.Background(), root, gid)
+	if err != nil || !changed {
+		t.Fatalf("expected the files to be given to the group, got %v, %v", changed, err)
+	}
+
+	for path, expected := range map[string]os.FileMode{
+		root:                               os.ModeDir | os.ModeSetgid | 0o770,
+		filepath.Join(root, "dir"):         os.ModeDir | os.ModeSetgid | 0o770,
+		filepath.Join(root, "dir", "file"): 0o660,
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != expected {
+			t.Errorf("expected %s to be %v, got %v", path, expected, info.Mode())
+		}
+	}
+
+	if changed, err := node.host.setGroupOwnership(context.Background(), root, gid); err != nil || changed {
+		t.Errorf("expected a root owned by the group to be left as is, got %v, %v", changed, err)
+	}
+
+	// a walk cut short leaves the root for the next call to take up
+	other := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := node.host.setGroupOwnership(ctx, other, gid); err == nil {
+		t.Fatal("expected the canceled walk to fail")
+	}
+	if changed, err := node.host.setGroupOwnership(context.Background(), other, gid); err != nil || !changed {
+		t.Errorf("expected the root of a canceled walk to be changed on the next call, got %v, %v", changed, err)
+	}
+}
+
+func TestDiskIOStats(t *testing.T) {
+	dir := t.TempDir()
+	defer func(s string) { sysBlockPath = s }(sysBlockPath)
+	sysBlockPath = filepath.Join(dir, "sys")
+
+	if err := os.MkdirAll(filepath.Join(sysBlockPath, "vdb"), mkDirMode); err != nil {
+		t.Fatal(err)
+	}
+	stat := "     120        3     4096      50      240        7    16384     300        0      280      350        0\n"
+	if err := os.WriteFile(filepath.Join(sysBlockPath, "vdb", "stat"), []byte(stat), mkFileMode); err != nil {
+		t.Fatal(err)
+	}
+	device, link := filepath.Join(dir, "vdb"), filepath.Join(dir, "virtio-vol-1")
+	if err := os.WriteFile(device, nil, mkFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(device, link); err != nil {
+		t.Fatal(err)
+	}
+
+	host := &linuxHost{}
+	stats, err := host.diskIOStats(link)
+	if err != nil {
+		t.Fatalf("expected the stat of the linked device, got %v", err)
+	}
+	expected := diskIOStats{Reads: 120, ReadBytes: 4096 * 512, Writes: 240, WriteBytes: 16384 * 512, IOTimeMilli: 280}
+	if *stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, *stats)
+	}
+
+	if _, err := host.diskIOStats(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing device")
+	}
+}
+
+func TestOpenFilesUnder(t *testing.T) {
+	defer func(s string) { procPath = s }(procPath)
+	procPath = t.TempDir()
+
+	links := map[string]string{
+		"1/cwd":      "/",
+		"1/fd/0":     "/dev/null",
+		"42/cwd":     "/pods/writer/logs",
+		"42/fd/3":    "/pods/writer/logs/app.log",
+		"42/fd/4":    "socket:[1234]",
+		"43/cwd":     "/tmp",
+		"43/fd/5":    "/staging/vfs-1",
+		"44/fd/6":    "/staging/vfs-10/data",
+		"self/cwd":   "/pods/writer",
+		"self/fd/10": "/pods/writer/data",
+	}
+	for link, target := range links {
+		path := filepath.Join(procPath, link)
+		if err := os.MkdirAll(filepath.Dir(path), mkDirMode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	host := &linuxHost{}
+	open, err := host.openFilesUnder([]string{"/staging/vfs-1", "/pods/writer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the links of self are those of a process counted under its PID
+	if open != 3 {
+		t.Errorf("expected the working directory and files open under the paths counted, got %d", open)
+	}
+}
+
+func TestLazyUnmount(t *testing.T) {
+	fe := &fakeExec{exitCodes: map[string]int{"umount -l /busy": 32}}
+	node := newFakeMountNode(fe)
+
+	if err := node.host.lazyUnmount("/staging/vfs-1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fe.run) != 1 || strings.Join(fe.run[0], " ") != "umount -l /staging/vfs-1" {
+		t.Errorf("expected the mount detached lazily, got %v", fe.run)
+	}
+	if err := node.host.lazyUnmount("/busy"); err == nil {
+		t.Error("expected the failed unmount reported")
+	}
+}
@@ -0,0 +1,107 @@
+//go:build !linux && !windows
+
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errUnsupportedHost is the error of the node calls on an operating system the node
+// plugin does not support, which the driver still builds for, as for the tools and the
+// controller run from a workstation
+var errUnsupportedHost = fmt.Errorf("%s nodes are not supported: %w", runtime.GOOS, errors.ErrUnsupported)
+
+// unsupportedHost is the host of a node on an operating system other than Linux or
+// Windows, which stages nothing
+type unsupportedHost struct{}
+
+func newHostOS(*VultrNodeServer) hostOS {
+	return unsupportedHost{}
+}
+
+func (unsupportedHost) findDevice(context.Context, *logrus.Entry, string) (string, string) {
+	return "", ""
+}
+
+func (unsupportedHost) rescanDevices(context.Context) {}
+
+func (unsupportedHost) rescanDeviceSize(context.Context, *logrus.Entry, string) {}
+
+func (unsupportedHost) diskFormat(string) (string, error) {
+	return "", errUnsupportedHost
+}
+
+func (unsupportedHost) partitionTable(string) (string, error) {
+	return "", errUnsupportedHost
+}
+
+func (unsupportedHost) statfs(string) (*volumeUsage, error) {
+	return nil, errUnsupportedHost
+}
+
+func (unsupportedHost) diskIOStats(string) (*diskIOStats, error) {
+	return nil, errUnsupportedHost
+}
+
+func (unsupportedHost) blockDeviceBytes(string) (int64, bool, error) {
+	return 0, false, errUnsupportedHost
+}
+
+func (unsupportedHost) isReadOnlyMount(string) (bool, error) {
+	return false, errUnsupportedHost
+}
+
+func (unsupportedHost) remountReadOnly(string) error {
+	return errUnsupportedHost
+}
+
+func (unsupportedHost) remountFilesystem(string, bool) error {
+	return errUnsupportedHost
+}
+
+func (unsupportedHost) openFilesUnder([]string) (int, error) {
+	return 0, errUnsupportedHost
+}
+
+func (unsupportedHost) lazyUnmount(string) error {
+	return errUnsupportedHost
+}
+
+func (unsupportedHost) isBusy(error) bool {
+	return false
+}
+
+// fsTypes is empty, so the node refuses to stage any volume
+func (unsupportedHost) fsTypes() []string {
+	return nil
+}
+
+func (unsupportedHost) rawBlock() bool {
+	return false
+}
+
+func (unsupportedHost) mountGroups() bool {
+	return false
+}
+
+func (unsupportedHost) setGroupOwnership(context.Context, string, int) (bool, error) {
+	return false, errUnsupportedHost
+}
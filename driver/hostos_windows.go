@@ -0,0 +1,177 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows"
+)
+
+// windowsHost finds and queries disks with the Storage module of PowerShell, which the
+// node plugin reaches by running as a HostProcess container. mount-utils formats the
+// disks with Format-Volume and links the volumes to their targets.
+type windowsHost struct {
+	n *VultrNodeServer
+}
+
+func newHostOS(n *VultrNodeServer) hostOS {
+	return &windowsHost{n: n}
+}
+
+func (h *windowsHost) powershell(ctx context.Context, command string) (string, error) {
+	out, err := h.n.runCommand(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", command)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w: %s", command, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// findDevice returns the number of the disk whose serial matches the mount ID, which is
+// the device mount-utils formats and mounts on Windows
+func (h *windowsHost) findDevice(ctx context.Context, log *logrus.Entry, mountID string) (string, string) {
+	out, err := h.powershell(ctx, `Get-Disk | ForEach-Object { "$($_.Number) $($_.SerialNumber)" }`)
+	if err != nil {
+		log.Debugf("cannot list disks: %v", err)
+		return "", ""
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		number, serial, _ := strings.Cut(strings.TrimSpace(line), " ")
+		if serial = strings.TrimSpace(serial); serial != "" && serialMatches(serial, mountID) {
+			return number, foundBySerial
+		}
+	}
+	return "", ""
+}
+
+// rescanDevices has the storage cache of the node pick up the disks attached since
+func (h *windowsHost) rescanDevices(ctx context.Context) {
+	if _, err := h.powershell(ctx, "Update-HostStorageCache"); err != nil {
+		h.n.Driver.log.Debugf("cannot update the storage cache: %v", err)
+	}
+}
+
+// rescanDeviceSize has the disk numbered device re-read its size
+func (h *windowsHost) rescanDeviceSize(ctx context.Context, log *logrus.Entry, device string) {
+	if _, err := strconv.Atoi(device); err != nil {
+		return
+	}
+	if _, err := h.powershell(ctx, "Update-Disk -Number "+device); err != nil {
+		log.Warnf("cannot rescan the size of disk %s: %v", device, err)
+	}
+}
+
+// diskFormat returns the filesystem of the volume on the disk numbered device
+func (h *windowsHost) diskFormat(device string) (string, error) {
+	if _, err := strconv.Atoi(device); err != nil {
+		return "", fmt.Errorf("%s is not a disk number", device)
+	}
+
+	out, err := h.powershell(context.Background(),
+		fmt.Sprintf("(Get-Disk -Number %s | Get-Partition | Get-Volume).FileSystemType", device))
+	if err != nil {
+		return "", err
+	}
+
+	switch format := strings.ToLower(out); format {
+	case "", "unknown":
+		return "", nil
+	default:
+		return format, nil
+	}
+}
+
+// partitionTable reports no table, as mount-utils partitions every disk it formats on Windows
+func (h *windowsHost) partitionTable(string) (string, error) {
+	return "", nil
+}
+
+func (h *windowsHost) statfs(path string) (*volumeUsage, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &available, &total, &free); err != nil {
+		return nil, err
+	}
+
+	// NTFS has no fixed inode table, so no inodes are reported
+	return &volumeUsage{
+		TotalBytes:     int64(total),
+		UsedBytes:      int64(total - free),
+		AvailableBytes: int64(available),
+	}, nil
+}
+
+// diskIOStats reports no counters, Windows keeping none under the device of a volume
+func (h *windowsHost) diskIOStats(string) (*diskIOStats, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// blockDeviceBytes reports no block device, raw block volumes not being published on Windows nodes
+func (h *windowsHost) blockDeviceBytes(string) (int64, bool, error) {
+	return 0, false, nil
+}
+
+// isReadOnlyMount reports false, the targets being symbolic links to the volume
+func (h *windowsHost) isReadOnlyMount(string) (bool, error) {
+	return false, nil
+}
+
+func (h *windowsHost) remountReadOnly(target string) error {
+	return fmt.Errorf("%s cannot be made read-only, read-only mounts are not supported on Windows nodes", target)
+}
+
+func (h *windowsHost) remountFilesystem(target string, _ bool) error {
+	return fmt.Errorf("%s cannot be remounted, read-only mounts are not supported on Windows nodes", target)
+}
+
+// openFilesUnder cannot tell, vfs volumes not being staged on Windows nodes
+func (h *windowsHost) openFilesUnder([]string) (int, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func (h *windowsHost) lazyUnmount(target string) error {
+	return fmt.Errorf("%s cannot be detached, vfs volumes are not supported on Windows nodes", target)
+}
+
+// isBusy reports whether the target link already exists
+func (h *windowsHost) isBusy(err error) bool {
+	return errors.Is(err, windows.ERROR_ALREADY_EXISTS) || os.IsExist(err)
+}
+
+func (h *windowsHost) fsTypes() []string {
+	return []string{fsTypeNTFS}
+}
+
+func (h *windowsHost) rawBlock() bool {
+	return false
+}
+
+func (h *windowsHost) mountGroups() bool {
+	return false
+}
+
+func (h *windowsHost) setGroupOwnership(context.Context, string, int) (bool, error) {
+	return false, errors.New("volume mount groups are not supported on Windows nodes")
+}
@@ -15,6 +15,8 @@ package driver
 
 import (
 	"context"
+	"strconv"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/protobuf/ptypes/wrappers"
@@ -34,43 +36,119 @@ func NewVultrIdentityServer(driver *VultrDriver) *VultrIdentityServer {
 
 // GetPluginInfo returns basic plugin data
 func (vultrIdentity *VultrIdentityServer) GetPluginInfo(context.Context, *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
-	vultrIdentity.Driver.log.Info("VultrIdentityServer.GetPluginInfo called")
-
 	res := &csi.GetPluginInfoResponse{
 		Name:          vultrIdentity.Driver.name,
 		VendorVersion: vultrIdentity.Driver.version,
+		Manifest:      vultrIdentity.Driver.manifest(),
 	}
 	return res, nil
 }
 
+// mode returns the plugin services the deployment runs
+func (d *VultrDriver) mode() string {
+	if d.servesController() {
+		return "controller,node"
+	}
+	return "node"
+}
+
+// manifest describes the deployment's mode, limits and enabled features so cluster
+// tooling can introspect it without reading the driver flags
+func (d *VultrDriver) manifest() map[string]string {
+	maxVolumes := "auto"
+	if d.maxVolumesPerNode > 0 {
+		maxVolumes = strconv.Itoa(d.maxVolumesPerNode)
+	}
+
+	orphanGC := "disabled"
+	if d.gcInterval > 0 {
+		orphanGC = d.gcMode
+	}
+
+	versions := NewVersionInfo(d.version, d.commit)
+	authoritativeKey, _ := d.regionKeys()
+
+	return map[string]string{
+		"commit":           versions.Commit,
+		"govultr_version":  versions.Govultr,
+		"csi_spec_version": versions.CSISpec,
+
+		"mode":            d.mode(),
+		"storage_types":   strings.Join(newBackendRegistry(d).types(), ","),
+		"fs_types":        strings.Join(supportedFsTypes(), ","),
+		"default_fs_type": d.defaultFsType,
+
+		"max_volumes_per_node":    maxVolumes,
+		"max_concurrent_stages":   strconv.Itoa(d.maxConcurrentStages),
+		"max_parallel_creates":    strconv.Itoa(d.maxParallelCreates),
+		"volume_label_prefix":     d.volumeLabelPrefix,
+		"volume_label_max_length": strconv.Itoa(d.volumeLabelMaxLength),
+		"cluster_id":              d.clusterID,
+
+		"block_disk_slots":         strconv.Itoa(d.blockDiskSlots),
+		"max_vfs_volumes_per_node": strconv.Itoa(d.maxVFSVolumesPerNode),
+
+		"block_high_perf_min_size_gb":   strconv.FormatInt(nvmeMinVolumeSizeInBytes/giB, 10),
+		"block_high_perf_max_size_gb":   strconv.FormatInt(nvmeMaxVolumeSizeInBytes/giB, 10),
+		"block_storage_opt_min_size_gb": strconv.FormatInt(hddMinVolumeSizeInBytes/giB, 10),
+		"block_storage_opt_max_size_gb": strconv.FormatInt(hddMaxVolumeSizeInBytes/giB, 10),
+
+		"admin_api":     strconv.FormatBool(d.adminAddr != ""),
+		"metrics":       strconv.FormatBool(d.metricsAddr != ""),
+		"health_api":    strconv.FormatBool(d.healthAddr != ""),
+		"strict_spec":   strconv.FormatBool(d.strictSpec),
+		"volume_status": strconv.FormatBool(d.volumeStatusInterval > 0),
+		"orphan_gc":     orphanGC,
+		"fsck_on_stage": strconv.FormatBool(d.fsckOnStage),
+
+		"node_attach_vfs":     strconv.FormatBool(d.nodeAttachVFS),
+		"feature_gates":       d.features.String(),
+		"topology_region_key": authoritativeKey,
+
+		"kubelet_dir":               d.kubeletDir,
+		"kubelet_registration_path": d.registrationPath,
+	}
+}
+
 // GetPluginCapabilities returns plugins available capabilities
-func (vultrIdentity *VultrIdentityServer) GetPluginCapabilities(_ context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) { //nolint:lll
-	vultrIdentity.Driver.log.Infof("VultrIdentityServer.GetPluginCapabilities called with request : %v", req)
+func (vultrIdentity *VultrIdentityServer) GetPluginCapabilities(context.Context, *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) { //nolint:lll
+	capabilities := []*csi.PluginCapability{
+		{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		},
+	}
 
-	return &csi.GetPluginCapabilitiesResponse{
-		Capabilities: []*csi.PluginCapability{
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
-					},
+	if !vultrIdentity.Driver.nodeOnly {
+		capabilities = append(capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
 				},
 			},
-			{
-				Type: &csi.PluginCapability_VolumeExpansion_{
-					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
-						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
-					},
+		})
+	}
+
+	if vultrIdentity.Driver.features.enabled(featureExpansion) {
+		capabilities = append(capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_VolumeExpansion_{
+				VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+					Type: csi.PluginCapability_VolumeExpansion_ONLINE,
 				},
 			},
-		},
+		})
+	}
+
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: capabilities,
 	}, nil
 }
 
 // Probe logs the request
-func (vultrIdentity *VultrIdentityServer) Probe(_ context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	vultrIdentity.Driver.log.Infof("VultrIdentityServer.Probe called with request : %v", req)
-
+func (vultrIdentity *VultrIdentityServer) Probe(context.Context, *csi.ProbeRequest) (*csi.ProbeResponse, error) {
 	return &csi.ProbeResponse{
 		Ready: &wrappers.BoolValue{Value: true},
 	}, nil
@@ -0,0 +1,67 @@
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+)
+
+func TestGetPluginInfoManifest(t *testing.T) {
+	identity := NewVultrIdentityServer(&VultrDriver{
+		name:                 DefaultDriverName,
+		version:              "test",
+		isController:         true,
+		log:                  logrus.NewEntry(logrus.New()),
+		volumeLabelMaxLength: DefaultVolumeLabelMaxLength,
+		metricsAddr:          ":9090",
+		defaultFsType:        fsTypeXFS,
+	})
+
+	res, err := identity.GetPluginInfo(context.TODO(), &csi.GetPluginInfoRequest{})
+	if err != nil {
+		t.Fatalf("got error, expected no error: %v", err)
+	}
+
+	versions := NewVersionInfo("test", "")
+	expected := map[string]string{
+		"commit":                        "unknown",
+		"govultr_version":               versions.Govultr,
+		"csi_spec_version":              versions.CSISpec,
+		"mode":                          "controller,node",
+		"storage_types":                 "block",
+		"fs_types":                      "btrfs,ext3,ext4,ntfs,xfs",
+		"default_fs_type":               "xfs",
+		"max_volumes_per_node":          "auto",
+		"block_disk_slots":              "0",
+		"max_vfs_volumes_per_node":      "0",
+		"max_concurrent_stages":         "0",
+		"max_parallel_creates":          "0",
+		"volume_label_prefix":           "",
+		"volume_label_max_length":       "64",
+		"cluster_id":                    "",
+		"block_high_perf_min_size_gb":   "1",
+		"block_high_perf_max_size_gb":   "10240",
+		"block_storage_opt_min_size_gb": "40",
+		"block_storage_opt_max_size_gb": "40960",
+		"admin_api":                     "false",
+		"metrics":                       "true",
+		"health_api":                    "false",
+		"strict_spec":                   "false",
+		"volume_status":                 "false",
+		"orphan_gc":                     "disabled",
+		"fsck_on_stage":                 "false",
+		"node_attach_vfs":               "false",
+		"feature_gates": "Cloning=true,Expansion=true,ModifyVolume=true,RawBlock=true,Snapshots=true,StrictParameters=true," +
+			"VolumeCondition=true,VolumeMountGroup=true",
+		"topology_region_key":       "region",
+		"kubelet_dir":               "",
+		"kubelet_registration_path": "",
+	}
+
+	if !reflect.DeepEqual(res.Manifest, expected) {
+		t.Errorf("expected manifest %v, got %v", expected, res.Manifest)
+	}
+}
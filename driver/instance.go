@@ -0,0 +1,100 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vultr/metadata"
+)
+
+// metadataAttempts is how many times the instance metadata is fetched at startup before
+// giving up, the link local endpoint answering late on freshly booted instances
+const metadataAttempts = 5
+
+// metadataRetryInterval is the wait before the first retry, doubling with each one
+var metadataRetryInterval = time.Second
+
+// WithInstanceIdentity sets the instance ID and region of the node, which are otherwise
+// discovered from the Vultr instance metadata service. The metadata service is not
+// queried at all when both are set.
+func WithInstanceIdentity(nodeID, region string) Option {
+	return func(d *VultrDriver) {
+		d.nodeID = nodeID
+		d.region = region
+	}
+}
+
+// WithMetadataURL sets the base URL of the Vultr instance metadata service
+func WithMetadataURL(url string) Option {
+	return func(d *VultrDriver) {
+		d.metadataURL = url
+	}
+}
+
+// discoverInstance fills in the instance ID, region and hostname of the node left unset
+// from the Vultr instance metadata service, retrying while it does not answer
+func (d *VultrDriver) discoverInstance() error {
+	if d.nodeID != "" && d.region != "" {
+		d.log.Info("instance ID and region set, not querying the instance metadata service")
+		return nil
+	}
+
+	c := metadata.NewClient()
+	if d.metadataURL != "" {
+		if err := c.SetBaseURL(d.metadataURL); err != nil {
+			return fmt.Errorf("invalid metadata URL %q: %w", d.metadataURL, err)
+		}
+	}
+
+	var (
+		meta *metadata.MetaData
+		err  error
+	)
+	wait := metadataRetryInterval
+	for attempt := 1; ; attempt++ {
+		if meta, err = c.Metadata(); err == nil {
+			break
+		}
+		if attempt == metadataAttempts {
+			return fmt.Errorf("cannot get instance metadata after %d attempts, "+
+				"set the node ID and region to run without it: %w", metadataAttempts, err)
+		}
+
+		d.log.WithField("attempt", attempt).Warnf("cannot get instance metadata, retrying in %s: %v", wait, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+
+	if d.nodeID == "" {
+		d.nodeID = meta.InstanceV2ID
+	}
+	if d.region == "" {
+		d.region = meta.Region.RegionCode
+	}
+	d.hostname = meta.Hostname
+
+	if d.nodeID == "" || d.region == "" {
+		return fmt.Errorf("instance metadata holds no instance ID or region")
+	}
+
+	d.log.WithFields(logrus.Fields{
+		"host_id":  d.nodeID,
+		"region":   d.region,
+		"hostname": d.hostname,
+	}).Info("discovered instance from the metadata service")
+	return nil
+}
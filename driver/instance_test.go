@@ -0,0 +1,68 @@
+package driver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestDiscoverInstance(t *testing.T) {
+	metadataRetryInterval = time.Millisecond
+	defer func() { metadataRetryInterval = time.Second }()
+
+	var requests, failures atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/v1.json" || failures.Add(-1) >= 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"hostname":"worker-1","instance-v2-id":"245bb2fe-b55c-44a0-9a1e-ab80e4b5f088",` + //nolint:errcheck
+			`"region":{"regioncode":"EWR"}}`))
+	}))
+	defer api.Close()
+
+	tests := []struct {
+		name     string
+		nodeID   string
+		region   string
+		failures int32
+		expected [3]string
+		requests int32
+		fails    bool
+	}{
+		{"discovered", "", "", 0, [3]string{"245bb2fe-b55c-44a0-9a1e-ab80e4b5f088", "EWR", "worker-1"}, 1, false},
+		{"retried", "", "", 2, [3]string{"245bb2fe-b55c-44a0-9a1e-ab80e4b5f088", "EWR", "worker-1"}, 3, false},
+		{"region override", "", "ams", 0, [3]string{"245bb2fe-b55c-44a0-9a1e-ab80e4b5f088", "ams", "worker-1"}, 1, false},
+		{"full override", "b9d23eb3", "ams", 0, [3]string{"b9d23eb3", "ams", ""}, 0, false},
+		{"unavailable", "", "", metadataAttempts, [3]string{}, metadataAttempts, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests.Store(0)
+			failures.Store(tt.failures)
+
+			d := &VultrDriver{
+				log:         logrus.NewEntry(logrus.New()),
+				metadataURL: api.URL,
+			}
+			WithInstanceIdentity(tt.nodeID, tt.region)(d)
+
+			err := d.discoverInstance()
+			if (err != nil) != tt.fails {
+				t.Fatalf("expected failure %t, got %v", tt.fails, err)
+			}
+			if got := requests.Load(); got != tt.requests {
+				t.Errorf("expected %d metadata requests, got %d", tt.requests, got)
+			}
+			if !tt.fails && [3]string{d.nodeID, d.region, d.hostname} != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, [3]string{d.nodeID, d.region, d.hostname})
+			}
+		})
+	}
+}
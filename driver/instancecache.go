@@ -0,0 +1,91 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// instanceCacheTTL is how long a looked up instance is reused. The controller only reads
+// the region and label of the instances, which do not change, and whether they exist.
+const instanceCacheTTL = time.Minute
+
+var instanceCacheLookups = metrics.newCounter("instance_cache_lookups_total",
+	"Number of instance lookups answered by the instance cache, by whether the Vultr API was called", "result")
+
+// instanceCache holds the instances the controller looked up. Every ControllerPublishVolume
+// and ControllerUnpublishVolume looks its node up, and every attach conflict the nodes
+// holding the volume, which in large clusters is most of the calls made to the Vultr API.
+// Only instances found are cached, so a deleted instance is noticed on its next lookup
+// once the entry expired.
+type instanceCache struct {
+	cloud cloudProvider
+	ttl   time.Duration
+	now   func() time.Time
+
+	mu        sync.Mutex
+	instances map[string]cachedInstance
+}
+
+type cachedInstance struct {
+	instance cloudInstance
+	fetched  time.Time
+}
+
+func newInstanceCache(cloud cloudProvider, ttl time.Duration) *instanceCache {
+	return &instanceCache{
+		cloud:     cloud,
+		ttl:       ttl,
+		now:       time.Now,
+		instances: map[string]cachedInstance{},
+	}
+}
+
+// get returns the instance, looking it up in the cloud when it is not cached
+func (c *instanceCache) get(ctx context.Context, instanceID string) (*cloudInstance, error) {
+	c.mu.Lock()
+	cached, ok := c.instances[instanceID]
+	if ok && c.now().Sub(cached.fetched) < c.ttl {
+		c.mu.Unlock()
+		instanceCacheLookups.add(1, "hit")
+		instance := cached.instance
+		return &instance, nil
+	}
+	c.mu.Unlock()
+	instanceCacheLookups.add(1, "miss")
+
+	instance, err := c.cloud.GetInstance(ctx, instanceID)
+	if err != nil {
+		if isNotFoundError(err) {
+			c.forget(instanceID)
+		}
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.instances[instanceID] = cachedInstance{instance: *instance, fetched: c.now()}
+	c.mu.Unlock()
+
+	return instance, nil
+}
+
+// forget drops the cached instance, so its next lookup calls the Vultr API
+func (c *instanceCache) forget(instanceID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.instances, instanceID)
+}
@@ -0,0 +1,56 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/vultr/govultr/v3"
+)
+
+// countingInstances counts the lookups of the instances
+type countingInstances struct {
+	goneInstance
+	gets int
+}
+
+func (c *countingInstances) Get(ctx context.Context, instanceID string) (*govultr.Instance, *http.Response, error) {
+	c.gets++
+	return c.goneInstance.Get(ctx, instanceID)
+}
+
+func TestInstanceCache(t *testing.T) {
+	controller := NewFakeVultrControllerServer("instance cache")
+	instances := &countingInstances{goneInstance: goneInstance{InstanceService: controller.Driver.client.Instance, gone: "gone"}}
+	controller.Driver.client.Instance = instances
+
+	cache := controller.nodes
+	now := time.Unix(0, 0)
+	cache.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if instance, err := cache.get(ctx, "node-1"); err != nil || instance.Region != "ewr" {
+			t.Fatalf("expected the instance, got %v, %v", instance, err)
+		}
+	}
+	if instances.gets != 1 {
+		t.Errorf("expected the instance to be looked up once, got %d lookups", instances.gets)
+	}
+
+	now = now.Add(instanceCacheTTL)
+	cache.get(ctx, "node-1") //nolint:errcheck
+	if instances.gets != 2 {
+		t.Errorf("expected the expired instance to be looked up again, got %d lookups", instances.gets)
+	}
+
+	// the instance is deleted after it was cached
+	cache.instances["gone"] = cachedInstance{fetched: now.Add(-instanceCacheTTL)}
+	if _, err := cache.get(ctx, "gone"); !isNotFoundError(err) {
+		t.Errorf("expected the deleted instance not to be found, got %v", err)
+	}
+	if _, ok := cache.instances["gone"]; ok {
+		t.Error("expected the deleted instance to be dropped from the cache")
+	}
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// diskSectorBytes is the unit of the sector counts of the block layer, whatever the
+// sector size of the device
+const diskSectorBytes = 512
+
+var (
+	volumeReadBytes = metrics.newCounter("volume_read_bytes_total",
+		"Bytes read from the device of each staged volume", "volume_id", "pvc_namespace", "pvc_name")
+	volumeWrittenBytes = metrics.newCounter("volume_written_bytes_total",
+		"Bytes written to the device of each staged volume", "volume_id", "pvc_namespace", "pvc_name")
+	volumeReads = metrics.newCounter("volume_reads_total",
+		"Reads completed by the device of each staged volume", "volume_id", "pvc_namespace", "pvc_name")
+	volumeWrites = metrics.newCounter("volume_writes_total",
+		"Writes completed by the device of each staged volume", "volume_id", "pvc_namespace", "pvc_name")
+	volumeIOTime = metrics.newCounter("volume_io_time_seconds_total",
+		"Time the device of each staged volume spent with IO in flight", "volume_id", "pvc_namespace", "pvc_name")
+
+	volumeIOMetrics = []*metricFamily{volumeReadBytes, volumeWrittenBytes, volumeReads, volumeWrites, volumeIOTime}
+)
+
+// WithVolumeIOStats has the node plugin read the IO counters of the device of each staged
+// volume every interval, exporting them with the volume ID and claim as labels. 0 disables.
+func WithVolumeIOStats(interval time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.ioStatsInterval = interval
+	}
+}
+
+// diskIOStats are the counters the kernel keeps for a block device since it appeared
+type diskIOStats struct {
+	Reads       uint64
+	ReadBytes   uint64
+	Writes      uint64
+	WriteBytes  uint64
+	IOTimeMilli uint64
+}
+
+// parseDiskStat parses the contents of /sys/block/<device>/stat, whose fields are those of
+// /proc/diskstats after the device numbers and name
+func parseDiskStat(data string) (*diskIOStats, error) {
+	fields := strings.Fields(data)
+	if len(fields) < 11 {
+		return nil, fmt.Errorf("expected at least 11 fields in the device stat, got %d", len(fields))
+	}
+
+	values := make([]uint64, 11)
+	for i := range values {
+		v, err := strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse field %d of the device stat: %w", i+1, err)
+		}
+		values[i] = v
+	}
+
+	return &diskIOStats{
+		Reads:       values[0],
+		ReadBytes:   values[2] * diskSectorBytes,
+		Writes:      values[4],
+		WriteBytes:  values[6] * diskSectorBytes,
+		IOTimeMilli: values[9],
+	}, nil
+}
+
+// ioStatsSampler exports the IO counters of the staged volumes, from which rate() gives
+// their throughput and IOPS. The series of the volumes no longer staged are dropped.
+type ioStatsSampler struct {
+	node     *VultrNodeServer
+	interval time.Duration
+	log      *logrus.Entry
+
+	// exported are the label values of the series of each volume
+	exported map[string][]string
+}
+
+func newIOStatsSampler(n *VultrNodeServer) *ioStatsSampler {
+	return &ioStatsSampler{
+		node:     n,
+		interval: n.Driver.ioStatsInterval,
+		log:      n.Driver.log.WithField("loop", "volume_io_stats"),
+		exported: make(map[string][]string),
+	}
+}
+
+// run samples the staged volumes every interval until ctx is done, or the host keeps no
+// counters to read
+func (s *ioStatsSampler) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.sample(); err != nil {
+			s.log.Warnf("cannot export the IO stats of the volumes: %v", err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sample sets the series of the staged volumes backed by a block device, returning an
+// error only when the host cannot report IO stats at all
+func (s *ioStatsSampler) sample() error {
+	staged := make(map[string]bool)
+	for _, v := range s.node.staged.list() {
+		if v.FsType == fsTypeVirtiofs || v.Device == "" {
+			continue
+		}
+		// kept when its stats cannot be read for now
+		staged[v.VolumeID] = true
+
+		stats, err := s.node.host.diskIOStats(v.Device)
+		if errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+		if err != nil {
+			s.log.WithFields(logrus.Fields{"volume_id": v.VolumeID, "device": v.Device}).Debugf("cannot read the IO stats: %v", err)
+			continue
+		}
+
+		labels := []string{v.VolumeID, v.PVCNamespace, v.PVCName}
+		if previous, ok := s.exported[v.VolumeID]; ok && strings.Join(previous, "/") != strings.Join(labels, "/") {
+			s.remove(previous)
+		}
+		s.exported[v.VolumeID] = labels
+
+		volumeReadBytes.set(float64(stats.ReadBytes), labels...)
+		volumeWrittenBytes.set(float64(stats.WriteBytes), labels...)
+		volumeReads.set(float64(stats.Reads), labels...)
+		volumeWrites.set(float64(stats.Writes), labels...)
+		volumeIOTime.set(float64(stats.IOTimeMilli)/1000, labels...)
+	}
+
+	for volumeID, labels := range s.exported {
+		if !staged[volumeID] {
+			s.remove(labels)
+			delete(s.exported, volumeID)
+		}
+	}
+
+	return nil
+}
+
+func (s *ioStatsSampler) remove(labels []string) {
+	for _, m := range volumeIOMetrics {
+		m.remove(labels...)
+	}
+}
@@ -0,0 +1,90 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseDiskStat(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected diskIOStats
+		wantErr  bool
+	}{
+		{
+			name:     "kernel with discard and flush fields",
+			data:     "1 2 8 4 5 6 16 8 0 10 11 0 0 0 0 0 0\n",
+			expected: diskIOStats{Reads: 1, ReadBytes: 8 * diskSectorBytes, Writes: 5, WriteBytes: 16 * diskSectorBytes, IOTimeMilli: 10},
+		},
+		{
+			name:     "older kernel",
+			data:     "1 2 8 4 5 6 16 8 0 10 11",
+			expected: diskIOStats{Reads: 1, ReadBytes: 8 * diskSectorBytes, Writes: 5, WriteBytes: 16 * diskSectorBytes, IOTimeMilli: 10},
+		},
+		{name: "truncated", data: "1 2 3", wantErr: true},
+		{name: "not a number", data: "1 2 x 4 5 6 7 8 9 10 11", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats, err := parseDiskStat(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", stats)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *stats != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, *stats)
+			}
+		})
+	}
+}
+
+func TestIOStatsSampler(t *testing.T) {
+	node := NewVultrNodeDriver(&VultrDriver{log: logrus.NewEntry(logrus.New()), ioStatsInterval: time.Minute})
+	host := &fakeHost{hostOS: node.host, ioStats: map[string]*diskIOStats{
+		"/dev/vdb": {Reads: 10, ReadBytes: 4096, Writes: 20, WriteBytes: 8192, IOTimeMilli: 1500},
+	}}
+	node.host = host
+
+	node.staged.stage("vol-1", "/staging/vol-1", "/dev/vdb", fsTypeExt4)
+	node.staged.setClaim("vol-1", map[string]string{volumeContextPVCNamespace: "default", volumeContextPVCName: "data"})
+	node.staged.stage("vol-2", "/staging/vol-2", "/dev/vdc", fsTypeExt4)
+	node.staged.stage("vfs-1", "/staging/vfs-1", "vfs-tag", fsTypeVirtiofs)
+
+	sampler := newIOStatsSampler(node)
+	if err := sampler.sample(); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := []string{"vol-1", "default", "data"}
+	for m, expected := range map[*metricFamily]float64{
+		volumeReads: 10, volumeReadBytes: 4096, volumeWrites: 20, volumeWrittenBytes: 8192, volumeIOTime: 1.5,
+	} {
+		if got := m.get(labels).value; got != expected {
+			t.Errorf("expected %s %v, got %v", m.name, expected, got)
+		}
+	}
+	if _, ok := sampler.exported["vfs-1"]; ok {
+		t.Error("expected no IO stats for a vfs volume")
+	}
+	if _, ok := sampler.exported["vol-2"]; ok {
+		t.Error("expected no IO stats for a device whose stat cannot be read")
+	}
+
+	node.staged.unstage("vol-1")
+	if err := sampler.sample(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := volumeReads.series[strings.Join(labels, "\xff")]; ok {
+		t.Error("expected the series of the unstaged volume to be dropped")
+	}
+}
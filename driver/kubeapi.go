@@ -0,0 +1,323 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// serviceAccountPath holds the credentials Kubernetes mounts into the driver pods
+var serviceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeAPI reaches the Kubernetes API with the service account of the driver pod, for
+// the few reads and patches the driver makes without pulling in client-go
+type kubeAPI struct {
+	client *http.Client
+	apiURL string
+
+	// tokenFile holds the token of the service account, read again for each request as
+	// the kubelet rotates the projected token well before it expires
+	tokenFile string
+}
+
+// newInClusterKubeAPI returns a kubeAPI for the cluster the pod runs in, its requests
+// timing out after timeout
+func newInClusterKubeAPI(timeout time.Duration) (kubeAPI, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return kubeAPI{}, errors.New("not running in a Kubernetes pod")
+	}
+
+	tokenFile := serviceAccountPath + "/token"
+	if _, err := readKubeToken(tokenFile); err != nil {
+		return kubeAPI{}, err
+	}
+
+	ca, err := os.ReadFile(serviceAccountPath + "/ca.crt")
+	if err != nil {
+		return kubeAPI{}, fmt.Errorf("cannot read service account CA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return kubeAPI{}, errors.New("service account CA holds no certificate")
+	}
+
+	return kubeAPI{
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}},
+		},
+		apiURL:    "https://" + net.JoinHostPort(host, port),
+		tokenFile: tokenFile,
+	}, nil
+}
+
+// readKubeToken reads the service account token in file
+func readKubeToken(file string) (string, error) {
+	token, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("cannot read service account token: %w", err)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// get decodes the object at path into out
+func (k kubeAPI) get(ctx context.Context, path string, out interface{}) error {
+	res, err := k.do(ctx, http.MethodGet, path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("cannot decode %s: %w", path, err)
+	}
+	return nil
+}
+
+// mergePatch applies a JSON merge patch to the object at path
+func (k kubeAPI) mergePatch(ctx context.Context, path string, patch interface{}) error {
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	res, err := k.do(ctx, http.MethodPatch, path, "application/merge-patch+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// put replaces the object at path, failing with 409 Conflict when it changed since the
+// resource version the object holds
+func (k kubeAPI) put(ctx context.Context, path string, object interface{}) error {
+	body, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	res, err := k.do(ctx, http.MethodPut, path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// post creates the object at path, under the collection it is posted to
+func (k kubeAPI) post(ctx context.Context, path string, object interface{}) error {
+	body, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	res, err := k.do(ctx, http.MethodPost, path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (k kubeAPI) do(ctx context.Context, method, path, contentType string, body io.Reader) (*http.Response, error) {
+	if body == nil {
+		body = http.NoBody
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, k.apiURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if k.tokenFile != "" {
+		token, err := readKubeToken(k.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		res.Body.Close() //nolint:errcheck
+		return nil, &kubeAPIError{status: res.StatusCode, msg: fmt.Sprintf("kubernetes API answered %s to %s %s", res.Status, method, path)}
+	}
+	return res, nil
+}
+
+// kubeAPIError is an answer of the Kubernetes API other than 200 or 201
+type kubeAPIError struct {
+	status int
+	msg    string
+}
+
+func (e *kubeAPIError) Error() string {
+	return e.msg
+}
+
+// isKubeStatus reports whether the Kubernetes API answered the status to the request failing with err
+func isKubeStatus(err error, status int) bool {
+	var apiErr *kubeAPIError
+	return errors.As(err, &apiErr) && apiErr.status == status
+}
+
+// kubeClaim identifies a PersistentVolumeClaim
+type kubeClaim struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+func (c kubeClaim) path() string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/persistentvolumeclaims/%s", url.PathEscape(c.Namespace), url.PathEscape(c.Name))
+}
+
+// kubePVList is the part of a Kubernetes PersistentVolume list the driver reads
+type kubePVList struct {
+	Items []struct {
+		Spec struct {
+			CSI *struct {
+				Driver       string `json:"driver"`
+				VolumeHandle string `json:"volumeHandle"`
+			} `json:"csi"`
+			ClaimRef *kubeClaim `json:"claimRef"`
+		} `json:"spec"`
+		Status struct {
+			Phase string `json:"phase"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// boundClaims returns the claims bound to the PersistentVolumes of the driver, by volume ID
+func (k kubeAPI) boundClaims(ctx context.Context, driverName string) (map[string]kubeClaim, error) {
+	var pvs kubePVList
+	if err := k.get(ctx, "/api/v1/persistentvolumes", &pvs); err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]kubeClaim)
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName || pv.Spec.ClaimRef == nil || pv.Status.Phase != "Bound" {
+			continue
+		}
+		claims[pv.Spec.CSI.VolumeHandle] = *pv.Spec.ClaimRef
+	}
+	return claims, nil
+}
+
+// volumeHandles returns the volume IDs referenced by the PersistentVolumes of the driver,
+// whatever their phase, legacy handles converted
+func (k kubeAPI) volumeHandles(ctx context.Context, driverName string) (map[string]bool, error) {
+	var pvs kubePVList
+	if err := k.get(ctx, "/api/v1/persistentvolumes", &pvs); err != nil {
+		return nil, err
+	}
+
+	handles := make(map[string]bool)
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			continue
+		}
+
+		handle := pv.Spec.CSI.VolumeHandle
+		if volumeID, _, ok := parseVolumeHandle(handle); ok {
+			handle = volumeID
+		}
+		handles[handle] = true
+	}
+	return handles, nil
+}
+
+// kubeObjectMeta is the part of the metadata of a Kubernetes object the driver reads
+type kubeObjectMeta struct {
+	UID string `json:"uid"`
+}
+
+// kubeEvent is a core/v1 Kubernetes Event
+type kubeEvent struct {
+	Metadata struct {
+		GenerateName string `json:"generateName"`
+		Namespace    string `json:"namespace"`
+	} `json:"metadata"`
+	InvolvedObject struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Namespace  string `json:"namespace"`
+		Name       string `json:"name"`
+		UID        string `json:"uid,omitempty"`
+	} `json:"involvedObject"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Source  struct {
+		Component string `json:"component"`
+		Host      string `json:"host,omitempty"`
+	} `json:"source"`
+	FirstTimestamp     time.Time `json:"firstTimestamp"`
+	LastTimestamp      time.Time `json:"lastTimestamp"`
+	Count              int       `json:"count"`
+	ReportingComponent string    `json:"reportingComponent"`
+	ReportingInstance  string    `json:"reportingInstance,omitempty"`
+}
+
+// warnClaim posts a Warning event on the claim, which kubectl describe shows with it
+func (k kubeAPI) warnClaim(ctx context.Context, claim kubeClaim, reason, message, component, host string) error {
+	// kubectl shows the events of an object by its UID
+	var pvc struct {
+		Metadata kubeObjectMeta `json:"metadata"`
+	}
+	if err := k.get(ctx, claim.path(), &pvc); err != nil {
+		return err
+	}
+
+	var event kubeEvent
+	event.Metadata.GenerateName = claim.Name + "."
+	event.Metadata.Namespace = claim.Namespace
+	event.InvolvedObject.APIVersion = "v1"
+	event.InvolvedObject.Kind = "PersistentVolumeClaim"
+	event.InvolvedObject.Namespace = claim.Namespace
+	event.InvolvedObject.Name = claim.Name
+	event.InvolvedObject.UID = pvc.Metadata.UID
+	event.Reason = reason
+	event.Message = message
+	event.Type = "Warning"
+	event.Source.Component = component
+	event.Source.Host = host
+	event.FirstTimestamp = time.Now().UTC().Truncate(time.Second)
+	event.LastTimestamp = event.FirstTimestamp
+	event.Count = 1
+	event.ReportingComponent = component
+	event.ReportingInstance = host
+
+	return k.post(ctx, fmt.Sprintf("/api/v1/namespaces/%s/events", url.PathEscape(claim.Namespace)), &event)
+}
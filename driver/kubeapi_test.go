@@ -0,0 +1,38 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKubeAPIRotatedToken(t *testing.T) {
+	var got []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Authorization"))
+		w.Write([]byte(`{}`)) //nolint:errcheck
+	}))
+	defer api.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	kube := kubeAPI{client: api.Client(), apiURL: api.URL, tokenFile: tokenFile}
+	for _, token := range []string{"first", "rotated"} {
+		if err := os.WriteFile(tokenFile, []byte(token+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := kube.get(context.Background(), "/api/v1/nodes", &struct{}{}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if len(got) != 2 || got[0] != "Bearer first" || got[1] != "Bearer rotated" {
+		t.Errorf("expected each request sent with the token of the time, got %v", got)
+	}
+
+	os.Remove(tokenFile) //nolint:errcheck
+	if err := kube.get(context.Background(), "/api/v1/nodes", &struct{}{}); err == nil {
+		t.Error("expected an error without a token")
+	}
+}
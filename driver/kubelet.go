@@ -0,0 +1,113 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WithKubeletDir sets the root directory of kubelet, its --root-dir, which the staging and
+// target paths of the node RPCs must be under, and the path kubelet reaches the socket of
+// the node plugin at, its plugin registration path. The registration path defaults to
+// plugins/<driver name>/csi.sock under the kubelet directory, and is served when no
+// endpoint is given, as when the node plugin sees the host paths as they are. An empty
+// kubeletDir leaves the paths of the requests unchecked.
+func WithKubeletDir(kubeletDir, registrationPath string) Option {
+	return func(d *VultrDriver) {
+		d.kubeletDir = kubeletDir
+		d.registrationPath = registrationPath
+	}
+}
+
+// validateKubeletDir checks the kubelet directory and registration path, and refuses a
+// kubelet directory mounted into the node plugin that it cannot stage volumes under, such
+// as a read-only host root, which would otherwise only fail the first NodeStageVolume.
+func (d *VultrDriver) validateKubeletDir() error {
+	if d.kubeletDir == "" {
+		if d.registrationPath != "" {
+			return fmt.Errorf("the kubelet registration path requires the kubelet directory")
+		}
+		return nil
+	}
+
+	if !filepath.IsAbs(d.kubeletDir) {
+		return fmt.Errorf("kubelet directory %q must be an absolute path", d.kubeletDir)
+	}
+	d.kubeletDir = filepath.Clean(d.kubeletDir)
+	d.kubeletDirs = []string{d.kubeletDir}
+	// kubelet resolves the symlinks of its root directory, and sends the resolved paths
+	if resolved, err := filepath.EvalSymlinks(d.kubeletDir); err == nil && resolved != d.kubeletDir {
+		d.kubeletDirs = append(d.kubeletDirs, resolved)
+	}
+
+	if d.registrationPath == "" {
+		d.registrationPath = filepath.Join(d.kubeletDir, "plugins", d.name, "csi.sock")
+	}
+	if !filepath.IsAbs(d.registrationPath) {
+		return fmt.Errorf("kubelet registration path %q must be an absolute path", d.registrationPath)
+	}
+	d.registrationPath = filepath.Clean(d.registrationPath)
+
+	if d.endpoint == "" {
+		d.endpoint = "unix://" + filepath.ToSlash(d.registrationPath)
+	}
+
+	// the controller has no kubelet directory, the node plugin mounts it from the host
+	if _, err := os.Stat(d.kubeletDir); err == nil {
+		if check := checkStagingDir(d.kubeletDir); check.Result != NodeCheckPass {
+			return fmt.Errorf("kubelet directory %s cannot hold the staging paths: %s", d.kubeletDir, check.Detail)
+		}
+	}
+
+	return nil
+}
+
+// checkKubeletPaths fails rpc with InvalidArgument when one of the paths kubelet sent is
+// not under the kubelet directory, as when kubelet runs with a --root-dir the driver was
+// not told of, rather than staging or mounting where kubelet never looks
+func (d *VultrDriver) checkKubeletPaths(rpc string, paths ...string) error {
+	if len(d.kubeletDirs) == 0 {
+		return nil
+	}
+
+	for _, path := range paths {
+		if path == "" || underKubeletDir(d.kubeletDirs, path) {
+			continue
+		}
+		return status.Errorf(codes.InvalidArgument,
+			"%s path %s is outside the kubelet directory %s, is --kubelet-dir the --root-dir of kubelet?", rpc, path, d.kubeletDir)
+	}
+	return nil
+}
+
+// underKubeletDir reports whether path is below one of dirs, after resolving any ..
+func underKubeletDir(dirs []string, path string) bool {
+	if !filepath.IsAbs(path) {
+		return false
+	}
+
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(dir, filepath.Clean(path))
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
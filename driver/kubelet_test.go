@@ -0,0 +1,91 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateKubeletDir(t *testing.T) {
+	kubeletDir := t.TempDir()
+	link := filepath.Join(t.TempDir(), "kubelet")
+	if err := os.Symlink(kubeletDir, link); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &VultrDriver{name: DefaultDriverName, kubeletDir: link + "/"}
+	if err := d.validateKubeletDir(); err != nil {
+		t.Fatalf("expected the kubelet directory to be valid, got %v", err)
+	}
+	registration := filepath.Join(link, "plugins", DefaultDriverName, "csi.sock")
+	if d.kubeletDir != link || d.registrationPath != registration || d.endpoint != "unix://"+registration {
+		t.Errorf("expected the registration path to be derived from the kubelet directory, got %+v", d)
+	}
+	if len(d.kubeletDirs) != 2 || d.kubeletDirs[1] != kubeletDir {
+		t.Errorf("expected the resolved kubelet directory to be accepted too, got %v", d.kubeletDirs)
+	}
+
+	d = &VultrDriver{name: DefaultDriverName, endpoint: "unix:///csi/csi.sock", kubeletDir: kubeletDir}
+	if err := d.validateKubeletDir(); err != nil || d.endpoint != "unix:///csi/csi.sock" {
+		t.Errorf("expected the given endpoint to be kept, got %s, %v", d.endpoint, err)
+	}
+
+	// the controller has no kubelet directory to check
+	d = &VultrDriver{name: DefaultDriverName, kubeletDir: filepath.Join(kubeletDir, "missing")}
+	if err := d.validateKubeletDir(); err != nil {
+		t.Errorf("expected a missing kubelet directory to be accepted, got %v", err)
+	}
+
+	for _, d := range []*VultrDriver{
+		{kubeletDir: "var/lib/kubelet"},
+		{kubeletDir: kubeletDir, registrationPath: "csi.sock"},
+		{registrationPath: "/var/lib/kubelet/plugins/block.csi.vultr.com/csi.sock"},
+	} {
+		if err := d.validateKubeletDir(); err == nil {
+			t.Errorf("expected %q and %q to be refused", d.kubeletDir, d.registrationPath)
+		}
+	}
+}
+
+func TestCheckKubeletPaths(t *testing.T) {
+	d := &VultrDriver{
+		log:         logrus.NewEntry(logrus.New()),
+		kubeletDir:  "/var/lib/kubelet",
+		kubeletDirs: []string{"/var/lib/kubelet", "/data/kubelet"},
+	}
+
+	tests := map[string]bool{
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/block.csi.vultr.com/0a1b/globalmount": true,
+		"/data/kubelet/pods/1234/volumes/kubernetes.io~csi/pvc-1/mount":                   true,
+		"/var/lib/kubelet":                       false,
+		"/var/lib/kubelet-other/pods/1234/mount": false,
+		"/var/lib/kubelet/../../etc":             false,
+		"/tmp/mount":                             false,
+		"var/lib/kubelet/pods/1234/mount":        false,
+	}
+	for path, valid := range tests {
+		if err := d.checkKubeletPaths("NodePublishVolume", path); (err == nil) != valid {
+			t.Errorf("expected %s valid %v, got %v", path, valid, err)
+		}
+	}
+
+	node := NewVultrNodeDriver(d)
+	_, err := node.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: "/var/snap/kubelet/plugins/kubernetes.io/csi/block.csi.vultr.com/0a1b/globalmount",
+		VolumeCapability:  &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a staging path outside the kubelet directory, got %v", err)
+	}
+
+	if err := (&VultrDriver{}).checkKubeletPaths("NodePublishVolume", "/tmp/mount"); err != nil {
+		t.Errorf("expected paths to be unchecked without a kubelet directory, got %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package driver
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateKubeletDirWindows(t *testing.T) {
+	d := &VultrDriver{name: DefaultDriverName, kubeletDir: DefaultKubeletDir}
+	if err := d.validateKubeletDir(); err != nil {
+		t.Fatalf("expected the default kubelet directory of Windows nodes accepted, got %v", err)
+	}
+
+	const socket = `c:\var\lib\kubelet\plugins\block.csi.vultr.com\csi.sock`
+	if d.registrationPath != socket || d.endpoint != "unix://c:/var/lib/kubelet/plugins/block.csi.vultr.com/csi.sock" {
+		t.Errorf("expected the socket under the kubelet directory, got %s served at %s", d.registrationPath, d.endpoint)
+	}
+
+	staging := `c:\var\lib\kubelet\plugins\kubernetes.io\csi\block.csi.vultr.com\0a1b2c\globalmount`
+	if err := d.checkKubeletPaths("NodeStageVolume", staging); err != nil {
+		t.Errorf("expected a staging path under the kubelet directory accepted, got %v", err)
+	}
+	if err := d.checkKubeletPaths("NodeStageVolume", `d:\kubelet\staging`); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a path on another drive, got %v", err)
+	}
+
+	if err := (&VultrDriver{kubeletDir: "/var/lib/kubelet"}).validateKubeletDir(); err == nil {
+		t.Error("expected a kubelet directory without a drive refused")
+	}
+}
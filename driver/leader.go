@@ -0,0 +1,388 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// controllerLeasePrefix starts the name of the Lease the active controller of a
+	// cluster ID holds, followed by the cluster ID when one is set
+	controllerLeasePrefix = "vultr-csi-controller"
+
+	// controllerLeaseDuration is how long the Lease stays held without being renewed
+	controllerLeaseDuration = 30 * time.Second
+	// controllerLeaseRenew is how often the active controller renews the Lease
+	controllerLeaseRenew = 10 * time.Second
+
+	// kubeMicroTimeFormat is the format of the times of a Lease
+	kubeMicroTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+var controllerLeaseHeld = metrics.newGauge("controller_lease_held",
+	"Whether this controller holds the Lease making it the active controller of its cluster ID")
+
+// WithLeaderElectionLeases names the comma separated Leases the sidecars of the
+// controller run their leader election under, in namespace or that of the pod when
+// empty. A replica whose sidecars hold none of them gets no calls and is left standing
+// by, rather than refused as a second active controller.
+func WithLeaderElectionLeases(names, namespace string) Option {
+	return func(d *VultrDriver) {
+		d.sidecarLeases = nil
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				d.sidecarLeases = append(d.sidecarLeases, name)
+			}
+		}
+		d.leaseNamespace = namespace
+	}
+}
+
+// WithAllowMultiController lets several controllers be active for the same cluster ID,
+// which otherwise refuse to start while another holds the Lease of the cluster ID
+func WithAllowMultiController(allow bool) Option {
+	return func(d *VultrDriver) {
+		d.allowMultiController = allow
+	}
+}
+
+// kubeLease is the part of a coordination.k8s.io/v1 Lease the controller reads and writes
+type kubeLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// renewed returns when the Lease was last renewed, zero when never
+func (l *kubeLease) renewed() time.Time {
+	t, err := time.Parse(kubeMicroTimeFormat, l.Spec.RenewTime)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// controllerLease keeps a single controller active for a cluster ID. The active
+// controller holds a Lease named after the cluster ID, and the calls of a controller
+// which does not hold it fail with Unavailable, for the sidecars to retry them once the
+// lease moved. With the leader election of the sidecars plumbed through, the controller
+// holds the Lease while its sidecars lead.
+type controllerLease struct {
+	kube      kubeAPI
+	namespace string
+	name      string
+	identity  string
+	clusterID string
+	sidecars  []string
+	log       *logrus.Entry
+	now       func() time.Time
+
+	mu sync.Mutex
+	// renewedAt is when the controller last held the Lease, zero when it does not
+	renewedAt time.Time
+	holder    string
+}
+
+// ClaimControllerLease makes the controller the active one of its cluster ID, failing
+// while another controller holds the Lease of the cluster ID. A replica whose sidecars
+// do not lead is left standing by and claims the Lease once they do. Only a plugin
+// serving the controller service claims it, and nothing is claimed outside a pod, with
+// the simulated API or with --allow-multi-controller. The Kubernetes API refusing the
+// Lease fails the claim, as the controller would otherwise refuse every call.
+func (d *VultrDriver) ClaimControllerLease(ctx context.Context) error {
+	if !d.servesController() || d.simulate {
+		return nil
+	}
+	if d.allowMultiController {
+		d.log.Warn("several controllers may be active for the cluster ID, which need to be elected by the sidecars to be safe")
+		return nil
+	}
+
+	lease, err := newControllerLease(d)
+	if err != nil {
+		d.log.Warnf("cannot check for another active controller: %v", err)
+		return nil
+	}
+
+	return d.claimControllerLease(ctx, lease)
+}
+
+// claimControllerLease claims lease, which the controller then renews and checks its
+// calls against
+func (d *VultrDriver) claimControllerLease(ctx context.Context, lease *controllerLease) error {
+	active, err := lease.active(ctx)
+	if err != nil {
+		return lease.accessError("cannot read the leases of the sidecars", err)
+	}
+	if !active {
+		lease.log.Info("standing by, the sidecars of another replica lead")
+		d.controllerLease = lease
+		return nil
+	}
+
+	held, err := lease.acquire(ctx)
+	if err != nil {
+		return lease.accessError("cannot claim the lease of the active controller", err)
+	}
+	if !held {
+		return fmt.Errorf("controller %s is already active for cluster ID %q, holding lease %s/%s: run a single active controller, "+
+			"elect it with the sidecars and --leader-election-lease-names, or set --allow-multi-controller",
+			lease.currentHolder(), d.clusterID, lease.namespace, lease.name)
+	}
+	d.controllerLease = lease
+	return nil
+}
+
+// accessError is the error of a claim of the Lease the Kubernetes API failed
+func (l *controllerLease) accessError(msg string, err error) error {
+	if isKubeStatus(err, http.StatusForbidden) {
+		return fmt.Errorf("%s: %w: grant the service account of the controller get, create and update of "+
+			"coordination.k8s.io leases in namespace %s, or set --allow-multi-controller", msg, err, l.namespace)
+	}
+	return fmt.Errorf("%s %s/%s: %w", msg, l.namespace, l.name, err)
+}
+
+func newControllerLease(d *VultrDriver) (*controllerLease, error) {
+	kube, err := newInClusterKubeAPI(controllerLeaseRenew)
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := d.leaseNamespace
+	if namespace == "" {
+		ns, err := os.ReadFile(serviceAccountPath + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the namespace of the pod: %w", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get the name of the pod: %w", err)
+	}
+
+	return newKubeControllerLease(kube, namespace, identity, d), nil
+}
+
+func newKubeControllerLease(kube kubeAPI, namespace, identity string, d *VultrDriver) *controllerLease {
+	// the name of a Lease is a DNS subdomain, which cluster IDs need not be
+	name := controllerLeasePrefix
+	if d.clusterID != "" {
+		name += "-" + strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+				return r
+			}
+			return '-'
+		}, strings.ToLower(d.clusterID))
+	}
+
+	return &controllerLease{
+		kube:      kube,
+		namespace: namespace,
+		name:      name,
+		identity:  identity,
+		clusterID: d.clusterID,
+		sidecars:  d.sidecarLeases,
+		log:       d.log.WithFields(logrus.Fields{"loop": "controller_lease", "lease": namespace + "/" + name}),
+		now:       time.Now,
+	}
+}
+
+func (l *controllerLease) path(name string) string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", url.PathEscape(l.namespace), url.PathEscape(name))
+}
+
+// ownedBy reports whether the holder of a Lease is this pod, which the sidecars identify
+// by its name, optionally followed by an underscore and a unique suffix
+func (l *controllerLease) ownedBy(holder string) bool {
+	return holder == l.identity || strings.HasPrefix(holder, l.identity+"_")
+}
+
+// active reports whether the sidecars of the pod lead, always when no sidecar Leases are named
+func (l *controllerLease) active(ctx context.Context) (bool, error) {
+	if len(l.sidecars) == 0 {
+		return true, nil
+	}
+
+	for _, name := range l.sidecars {
+		var lease kubeLease
+		if err := l.kube.get(ctx, l.path(name), &lease); err != nil {
+			if isKubeStatus(err, http.StatusNotFound) {
+				continue
+			}
+			return false, err
+		}
+		if l.ownedBy(lease.Spec.HolderIdentity) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// acquire creates, renews or takes over the expired Lease, reporting false when another
+// controller holds it
+func (l *controllerLease) acquire(ctx context.Context) (bool, error) {
+	var lease kubeLease
+	err := l.kube.get(ctx, l.path(l.name), &lease)
+	switch {
+	case isKubeStatus(err, http.StatusNotFound):
+		lease.APIVersion, lease.Kind = "coordination.k8s.io/v1", "Lease"
+		lease.Metadata.Name, lease.Metadata.Namespace = l.name, l.namespace
+	case err != nil:
+		return false, err
+	}
+
+	now := l.now()
+	holder := lease.Spec.HolderIdentity
+	if holder != "" && holder != l.identity {
+		expires := lease.renewed().Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second)
+		if now.Before(expires) {
+			if l.lost(holder) {
+				l.log.WithField("holder", holder).Warn("another controller took over the lease of the active controller")
+			}
+			return false, nil
+		}
+	}
+
+	if holder != l.identity {
+		lease.Spec.AcquireTime = now.UTC().Format(kubeMicroTimeFormat)
+		if lease.Metadata.ResourceVersion != "" {
+			lease.Spec.LeaseTransitions++
+		}
+	}
+	lease.Spec.HolderIdentity = l.identity
+	lease.Spec.LeaseDurationSeconds = int(controllerLeaseDuration / time.Second)
+	lease.Spec.RenewTime = now.UTC().Format(kubeMicroTimeFormat)
+
+	if lease.Metadata.ResourceVersion == "" {
+		err = l.kube.post(ctx, fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", url.PathEscape(l.namespace)), &lease)
+	} else {
+		err = l.kube.put(ctx, l.path(l.name), &lease)
+	}
+	// another controller created or updated the Lease since it was read
+	if isKubeStatus(err, http.StatusConflict) {
+		if l.lost("") {
+			l.log.Warn("another controller took over the lease of the active controller")
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	l.mu.Lock()
+	if l.renewedAt.IsZero() {
+		l.log.Info("holding the lease of the active controller")
+	}
+	l.renewedAt, l.holder = now, l.identity
+	l.mu.Unlock()
+	controllerLeaseHeld.set(1)
+	return true, nil
+}
+
+// lost records that the controller does not hold the Lease, held by holder when known,
+// reporting whether it did
+func (l *controllerLease) lost(holder string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	held := !l.renewedAt.IsZero()
+	l.renewedAt = time.Time{}
+	if holder != "" {
+		l.holder = holder
+	}
+	controllerLeaseHeld.set(0)
+	return held
+}
+
+// held reports whether the controller holds the Lease, which it no longer does once it
+// failed to renew it for controllerLeaseDuration, whatever the Kubernetes API answered
+func (l *controllerLease) held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.renewedAt.IsZero() && l.now().Sub(l.renewedAt) < controllerLeaseDuration
+}
+
+func (l *controllerLease) currentHolder() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.holder == "" {
+		return "another controller"
+	}
+	return l.holder
+}
+
+// run renews the Lease every controllerLeaseRenew while the sidecars of the pod lead,
+// until ctx is done
+func (l *controllerLease) run(ctx context.Context) {
+	ticker := time.NewTicker(controllerLeaseRenew)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		active, err := l.active(ctx)
+		if err != nil {
+			l.log.Warnf("cannot read the leases of the sidecars: %v", err)
+			continue
+		}
+		if !active {
+			if l.lost("") {
+				l.log.Info("standing by, the sidecars of another replica took over")
+			}
+			continue
+		}
+
+		if _, err := l.acquire(ctx); err != nil {
+			l.log.Warnf("cannot renew the lease of the active controller: %v", err)
+		}
+	}
+}
+
+// check fails rpc with Unavailable while another controller is the active one
+func (l *controllerLease) check(rpc string) error {
+	if l == nil || l.held() {
+		return nil
+	}
+	return status.Errorf(codes.Unavailable, "%s: this controller is not the active one of cluster ID %q, %s holds lease %s/%s",
+		rpc, l.clusterID, l.currentHolder(), l.namespace, l.name)
+}
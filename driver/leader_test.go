@@ -0,0 +1,171 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeLeases serves the Leases of a namespace, refusing updates of stale resource versions
+type fakeLeases struct {
+	mu      sync.Mutex
+	leases  map[string]kubeLease
+	version int
+	// forbidden refuses every request, as without the RBAC of the Leases
+	forbidden bool
+}
+
+func (f *fakeLeases) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.forbidden {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	name := path.Base(r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		lease, ok := f.leases[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(lease) //nolint:errcheck
+		return
+	}
+
+	var lease kubeLease
+	if err := json.NewDecoder(r.Body).Decode(&lease); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	existing, ok := f.leases[lease.Metadata.Name]
+	stale := existing.Metadata.ResourceVersion != lease.Metadata.ResourceVersion
+	if (r.Method == http.MethodPost && ok) || (r.Method == http.MethodPut && stale) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	f.version++
+	lease.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.leases[lease.Metadata.Name] = lease
+	w.WriteHeader(http.StatusCreated)
+}
+
+func TestControllerLease(t *testing.T) {
+	leases := &fakeLeases{leases: map[string]kubeLease{}}
+	api := httptest.NewServer(leases)
+	defer api.Close()
+
+	now := time.Now()
+	newLease := func(identity string, sidecars ...string) *controllerLease {
+		d := &VultrDriver{log: logrus.NewEntry(logrus.New()), clusterID: "Prod_1", sidecarLeases: sidecars}
+		l := newKubeControllerLease(kubeAPI{client: api.Client(), apiURL: api.URL}, "kube-system", identity, d)
+		l.now = func() time.Time { return now }
+		return l
+	}
+	ctx := context.Background()
+
+	a, b := newLease("csi-vultr-controller-a"), newLease("csi-vultr-controller-b")
+	if a.name != "vultr-csi-controller-prod-1" {
+		t.Errorf("expected the cluster ID to name the lease, got %s", a.name)
+	}
+	if held, err := a.acquire(ctx); !held || err != nil {
+		t.Fatalf("expected the first controller to hold the lease, got %v, %v", held, err)
+	}
+	if err := a.check("CreateVolume"); err != nil {
+		t.Errorf("expected the active controller to serve calls, got %v", err)
+	}
+
+	if held, err := b.acquire(ctx); held || err != nil {
+		t.Fatalf("expected the lease to stay with the first controller, got %v, %v", held, err)
+	}
+	err := b.check("CreateVolume")
+	if status.Code(err) != codes.Unavailable || !strings.Contains(err.Error(), "csi-vultr-controller-a") {
+		t.Errorf("expected Unavailable naming the active controller, got %v", err)
+	}
+
+	// the first controller stops renewing, as when its node went away
+	now = now.Add(controllerLeaseDuration + time.Second)
+	if held, err := b.acquire(ctx); !held || err != nil {
+		t.Fatalf("expected the second controller to take over the expired lease, got %v, %v", held, err)
+	}
+	if held, _ := a.acquire(ctx); held || a.held() {
+		t.Errorf("expected the first controller to lose the lease")
+	}
+	if transitions := leases.leases[b.name].Spec.LeaseTransitions; transitions != 1 {
+		t.Errorf("expected 1 lease transition, got %d", transitions)
+	}
+
+	// a controller failing to renew stops serving calls once the lease may have moved
+	now = now.Add(controllerLeaseDuration)
+	if b.held() {
+		t.Errorf("expected the lease to be lost once it was not renewed for its duration")
+	}
+
+	var leader kubeLease
+	leader.Spec.HolderIdentity = "csi-vultr-controller-a_4f1b2c"
+	leases.leases["external-provisioner-leader-block-csi-vultr-com"] = leader
+
+	for identity, expected := range map[string]bool{"csi-vultr-controller-a": true, "csi-vultr-controller-b": false} {
+		active, err := newLease(identity, "external-provisioner-leader-block-csi-vultr-com").active(ctx)
+		if err != nil || active != expected {
+			t.Errorf("expected %s active %v with the sidecar lease, got %v, %v", identity, expected, active, err)
+		}
+	}
+
+	var none *controllerLease
+	if err := none.check("CreateVolume"); err != nil {
+		t.Errorf("expected no lease to let calls through, got %v", err)
+	}
+}
+
+func TestClaimControllerLease(t *testing.T) {
+	leases := &fakeLeases{leases: map[string]kubeLease{}, forbidden: true}
+	api := httptest.NewServer(leases)
+	defer api.Close()
+
+	d := &VultrDriver{log: logrus.NewEntry(logrus.New()), isController: true, clusterID: "prod"}
+	kube := kubeAPI{client: api.Client(), apiURL: api.URL}
+	ctx := context.Background()
+
+	// a controller refused the Lease fails to start rather than every call
+	err := d.claimControllerLease(ctx, newKubeControllerLease(kube, "kube-system", "csi-vultr-controller-0", d))
+	if err == nil || !strings.Contains(err.Error(), "coordination.k8s.io leases") {
+		t.Errorf("expected the missing RBAC named, got %v", err)
+	}
+	if d.controllerLease != nil {
+		t.Error("expected no lease kept from a failed claim")
+	}
+
+	leases.forbidden = false
+	if err := d.claimControllerLease(ctx, newKubeControllerLease(kube, "kube-system", "csi-vultr-controller-0", d)); err != nil {
+		t.Fatalf("expected the lease claimed, got %v", err)
+	}
+	if err := d.controllerLease.check("CreateVolume"); err != nil {
+		t.Errorf("expected the controller to serve calls, got %v", err)
+	}
+
+	// plugins not serving the controller service claim nothing, needing no Kubernetes API
+	for name, d := range map[string]*VultrDriver{
+		"node":      {log: d.log},
+		"node-only": {log: d.log, isController: true, nodeOnly: true},
+		"simulated": {log: d.log, isController: true, simulate: true},
+	} {
+		if err := d.ClaimControllerLease(ctx); err != nil || d.controllerLease != nil {
+			t.Errorf("expected a %s plugin to claim nothing, got %v, %v", name, err, d.controllerLease)
+		}
+	}
+}
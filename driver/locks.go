@@ -0,0 +1,196 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// volumeLocks serializes operations on the same volume. The CO retries RPCs which are
+// still running, so a second operation fails with Aborted rather than waiting and
+// racing the first once it is let through. The attachments of a volume to different
+// nodes, which shared volumes have several of, each lock the volume and node alone, so
+// that one does not abort the others, and hold off the operations on the whole volume.
+type volumeLocks struct {
+	mu          sync.Mutex
+	locks       map[string]struct{}
+	attachments map[string]int
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{locks: make(map[string]struct{}), attachments: make(map[string]int)}
+}
+
+// acquire locks id and returns the func unlocking it, or an Aborted error when an operation already holds it
+func (l *volumeLocks) acquire(id string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.locks[id]; ok || l.attachments[id] > 0 {
+		return nil, status.Errorf(codes.Aborted, "an operation on volume %s is already in progress", id)
+	}
+	l.locks[id] = struct{}{}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.locks, id)
+	}, nil
+}
+
+// acquireAttachment locks the attachment of the volume to the node and returns the func
+// unlocking it, or an Aborted error when an operation already holds the attachment or
+// the whole volume
+func (l *volumeLocks) acquireAttachment(volumeID, nodeID string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := volumeID + "/" + nodeID
+	if _, ok := l.locks[volumeID]; ok {
+		return nil, status.Errorf(codes.Aborted, "an operation on volume %s is already in progress", volumeID)
+	}
+	if _, ok := l.locks[key]; ok {
+		return nil, status.Errorf(codes.Aborted, "an operation on volume %s for node %s is already in progress", volumeID, nodeID)
+	}
+	l.locks[key] = struct{}{}
+	l.attachments[volumeID]++
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.locks, key)
+		if l.attachments[volumeID]--; l.attachments[volumeID] == 0 {
+			delete(l.attachments, volumeID)
+		}
+	}, nil
+}
+
+// createdVolumesTTL is how long CreateVolume remembers the volumes it created by name
+const createdVolumesTTL = 10 * time.Minute
+
+// createdVolumes dedupes CreateVolume by volume name beyond the call holding the lock.
+// The CO retries a CreateVolume whose response it did not get, which looks the volume
+// up in a Vultr list that can lag behind a volume created moments ago, and would then
+// provision a second volume for the name.
+type createdVolumes struct {
+	mu  sync.Mutex
+	now func() time.Time
+	ids map[string]createdVolume
+}
+
+type createdVolume struct {
+	id string
+	at time.Time
+}
+
+func newCreatedVolumes() *createdVolumes {
+	return &createdVolumes{now: time.Now, ids: make(map[string]createdVolume)}
+}
+
+// put remembers the volume created for the name
+func (c *createdVolumes) put(name, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids[name] = createdVolume{id: id, at: c.now()}
+}
+
+// get returns the ID of the volume created for the name in the last createdVolumesTTL
+func (c *createdVolumes) get(name string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for n, v := range c.ids {
+		if c.now().Sub(v.at) > createdVolumesTTL {
+			delete(c.ids, n)
+		}
+	}
+	v, ok := c.ids[name]
+	return v.id, ok
+}
+
+// forget drops the volume, once deleted
+func (c *createdVolumes) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for n, v := range c.ids {
+		if v.id == id {
+			delete(c.ids, n)
+		}
+	}
+}
+
+// attachQueueWait is how long attachments waited for the ones queued before them
+var attachQueueWait = metrics.newHistogram("attach_queue_wait_seconds",
+	"Time volume attachments and detachments waited for the others queued to their instance", defaultDurationBuckets)
+
+// instanceQueues serializes the attachments and detachments of each instance, which
+// Vultr processes one at a time and fails when another is in progress, while those of
+// different instances proceed in parallel. Unlike volumeLocks an operation waits its
+// turn, as it is a different volume than the one before it and would only be retried.
+type instanceQueues struct {
+	mu     sync.Mutex
+	queues map[string]*instanceQueue
+}
+
+type instanceQueue struct {
+	slot chan struct{}
+	// users are the operations holding or waiting for the slot
+	users int
+}
+
+func newInstanceQueues() *instanceQueues {
+	return &instanceQueues{queues: make(map[string]*instanceQueue)}
+}
+
+// acquire waits for the operations queued to the instance before it and returns the func
+// letting the next one through, or an Aborted error when ctx ends first
+func (l *instanceQueues) acquire(ctx context.Context, instanceID string) (func(), error) {
+	l.mu.Lock()
+	q, ok := l.queues[instanceID]
+	if !ok {
+		q = &instanceQueue{slot: make(chan struct{}, 1)}
+		l.queues[instanceID] = q
+	}
+	q.users++
+	l.mu.Unlock()
+
+	start := time.Now()
+	select {
+	case q.slot <- struct{}{}:
+		attachQueueWait.observe(time.Since(start).Seconds())
+		return func() {
+			<-q.slot
+			l.leave(instanceID, q)
+		}, nil
+	case <-ctx.Done():
+		l.leave(instanceID, q)
+		return nil, status.Errorf(codes.Aborted, "timed out waiting for the attachments queued to instance %s: %v", instanceID, ctx.Err())
+	}
+}
+
+// leave drops the queue of the instance once no operation uses it
+func (l *instanceQueues) leave(instanceID string, q *instanceQueue) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if q.users--; q.users == 0 {
+		delete(l.queues, instanceID)
+	}
+}
@@ -0,0 +1,137 @@
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeLocks(t *testing.T) {
+	locks := newVolumeLocks()
+
+	unlock, err := locks.acquire("vol-1")
+	if err != nil {
+		t.Fatalf("got error, expected no error: %v", err)
+	}
+
+	if _, err := locks.acquire("vol-1"); status.Code(err) != codes.Aborted {
+		t.Errorf("expected Aborted for a locked volume, got %v", err)
+	}
+
+	unlockOther, err := locks.acquire("vol-2")
+	if err != nil {
+		t.Fatalf("expected other volumes not to be locked, got %v", err)
+	}
+	unlockOther()
+
+	unlock()
+	if _, err := locks.acquire("vol-1"); err != nil {
+		t.Errorf("expected the volume to be unlocked, got %v", err)
+	}
+}
+
+func TestVolumeAttachmentLocks(t *testing.T) {
+	locks := newVolumeLocks()
+
+	unlockA, err := locks.acquireAttachment("vol-1", "node-a")
+	if err != nil {
+		t.Fatalf("got error, expected no error: %v", err)
+	}
+
+	if _, err := locks.acquireAttachment("vol-1", "node-a"); status.Code(err) != codes.Aborted {
+		t.Errorf("expected Aborted for a locked attachment, got %v", err)
+	}
+
+	unlockB, err := locks.acquireAttachment("vol-1", "node-b")
+	if err != nil {
+		t.Fatalf("expected the attachments to other nodes not to be locked, got %v", err)
+	}
+
+	if _, err := locks.acquire("vol-1"); status.Code(err) != codes.Aborted {
+		t.Errorf("expected Aborted for a volume with locked attachments, got %v", err)
+	}
+
+	unlockA()
+	unlockB()
+	unlock, err := locks.acquire("vol-1")
+	if err != nil {
+		t.Fatalf("expected the volume to be unlocked with its attachments, got %v", err)
+	}
+
+	if _, err := locks.acquireAttachment("vol-1", "node-a"); status.Code(err) != codes.Aborted {
+		t.Errorf("expected Aborted for the attachment of a locked volume, got %v", err)
+	}
+	unlock()
+}
+
+func TestInstanceQueues(t *testing.T) {
+	queues := newInstanceQueues()
+
+	release, err := queues.acquire(context.Background(), "instance-1")
+	if err != nil {
+		t.Fatalf("got error, expected no error: %v", err)
+	}
+
+	releaseOther, err := queues.acquire(context.Background(), "instance-2")
+	if err != nil {
+		t.Fatalf("expected other instances not to be queued, got %v", err)
+	}
+	releaseOther()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := queues.acquire(ctx, "instance-1"); status.Code(err) != codes.Aborted {
+		t.Errorf("expected Aborted once the context ends in the queue, got %v", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		releaseNext, err := queues.acquire(context.Background(), "instance-1")
+		if err != nil {
+			t.Errorf("got error, expected no error: %v", err)
+			return
+		}
+		releaseNext()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("expected the attachment to wait for the one before it")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	release()
+	<-acquired
+
+	queues.mu.Lock()
+	defer queues.mu.Unlock()
+	if len(queues.queues) != 0 {
+		t.Errorf("expected the unused queues to be dropped, got %d", len(queues.queues))
+	}
+}
+
+func TestCreatedVolumes(t *testing.T) {
+	created := newCreatedVolumes()
+	now := time.Now()
+	created.now = func() time.Time { return now }
+
+	created.put("pvc-1", "vol-1")
+	created.put("pvc-2", "vol-2")
+	if id, ok := created.get("pvc-1"); !ok || id != "vol-1" {
+		t.Errorf("expected the volume created for the name, got %q, %v", id, ok)
+	}
+
+	created.forget("vol-1")
+	if _, ok := created.get("pvc-1"); ok {
+		t.Errorf("expected a deleted volume to be forgotten")
+	}
+
+	now = now.Add(createdVolumesTTL + time.Second)
+	if _, ok := created.get("pvc-2"); ok {
+		t.Errorf("expected the volume to be forgotten after %v", createdVolumesTTL)
+	}
+}
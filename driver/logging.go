@@ -0,0 +1,61 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// LogFormatText logs lines of key=value fields
+	LogFormatText = "text"
+	// LogFormatJSON logs a JSON object per line, for log pipelines parsing the fields
+	LogFormatJSON = "json"
+
+	// DefaultLogLevel is the level the driver logs at without WithLogging
+	DefaultLogLevel = "info"
+)
+
+// WithLogging sets the lowest level logged, one of the logrus levels such as debug or
+// warn, and the format of the logs, text or json
+func WithLogging(level, format string) Option {
+	return func(d *VultrDriver) {
+		d.logLevel = level
+		d.logFormat = format
+	}
+}
+
+// configureLogger applies the log level and format to logger
+func configureLogger(logger *logrus.Logger, level, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level: %w", err)
+	}
+
+	var formatter logrus.Formatter
+	switch format {
+	case LogFormatText:
+		formatter = &logrus.TextFormatter{}
+	case LogFormatJSON:
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("invalid log format %q, must be %s or %s", format, LogFormatText, LogFormatJSON)
+	}
+
+	logger.SetLevel(lvl)
+	logger.SetFormatter(formatter)
+	return nil
+}
@@ -0,0 +1,29 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestConfigureLogger(t *testing.T) {
+	logger := logrus.New()
+	if err := configureLogger(logger, "debug", LogFormatJSON); err != nil {
+		t.Fatalf("got error, expected no error: %v", err)
+	}
+	if logger.GetLevel() != logrus.DebugLevel {
+		t.Errorf("expected the debug level, got %v", logger.GetLevel())
+	}
+	if _, ok := logger.Formatter.(*logrus.JSONFormatter); !ok {
+		t.Errorf("expected the JSON formatter, got %T", logger.Formatter)
+	}
+
+	for _, tt := range []struct{ level, format string }{
+		{"verbose", LogFormatText},
+		{"info", "logfmt"},
+	} {
+		if err := configureLogger(logrus.New(), tt.level, tt.format); err == nil {
+			t.Errorf("expected an error for level %q and format %q", tt.level, tt.format)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultMaintenanceBackoff is how long the driver holds off the Vultr API after it reports maintenance
+const DefaultMaintenanceBackoff = 5 * time.Minute
+
+var apiMaintenance = metrics.newGauge("api_maintenance",
+	"Whether the driver is holding off the Vultr API because it reported maintenance")
+
+// maintenanceMode tracks planned Vultr API maintenance. While it is active controller
+// RPCs fail fast with Unavailable, so the sidecars retry with their own backoff instead
+// of each call hitting the API and failing.
+type maintenanceMode struct {
+	backoff time.Duration
+	log     *logrus.Entry
+	now     func() time.Time
+
+	mu    sync.Mutex
+	until time.Time
+}
+
+func newMaintenanceMode(backoff time.Duration, log *logrus.Entry) *maintenanceMode {
+	return &maintenanceMode{
+		backoff: backoff,
+		log:     log,
+		now:     time.Now,
+	}
+}
+
+// observe is the Vultr client's request completion callback. A 503 enters or extends
+// maintenance mode and any successful response ends it.
+func (m *maintenanceMode) observe(_ *http.Request, resp *http.Response) {
+	if m == nil || m.backoff <= 0 || resp == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	wasActive := now.Before(m.until)
+
+	switch {
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		m.until = now.Add(m.backoff)
+		if !wasActive {
+			m.log.WithField("until", m.until).Warn("Vultr API is under maintenance, holding off API calls")
+		}
+		apiMaintenance.set(1)
+	case resp.StatusCode < http.StatusBadRequest && wasActive:
+		m.until = time.Time{}
+		m.log.Info("Vultr API maintenance is over")
+		apiMaintenance.set(0)
+	}
+}
+
+// active reports whether the API is held off and until when
+func (m *maintenanceMode) active() (bool, time.Time) {
+	if m == nil {
+		return false, time.Time{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.now().Before(m.until), m.until
+}
+
+// check returns a retryable Unavailable error for rpc while maintenance mode is active
+func (m *maintenanceMode) check(rpc string) error {
+	if active, until := m.active(); active {
+		return status.Errorf(codes.Unavailable, "%s: Vultr API is under maintenance, retry after %s",
+			rpc, until.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package driver
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := newMaintenanceMode(time.Minute, logrus.NewEntry(logrus.New()))
+	m.now = func() time.Time { return now }
+
+	if err := m.check("CreateVolume"); err != nil {
+		t.Fatalf("expected no error before maintenance, got %v", err)
+	}
+
+	m.observe(nil, &http.Response{StatusCode: http.StatusServiceUnavailable})
+	if err := m.check("CreateVolume"); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable during maintenance, got %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if err := m.check("CreateVolume"); err != nil {
+		t.Errorf("expected no error once the backoff passed, got %v", err)
+	}
+
+	m.observe(nil, &http.Response{StatusCode: http.StatusServiceUnavailable})
+	m.observe(nil, &http.Response{StatusCode: http.StatusOK})
+	if err := m.check("CreateVolume"); err != nil {
+		t.Errorf("expected a successful response to end maintenance, got %v", err)
+	}
+
+	var disabled *maintenanceMode
+	if err := disabled.check("CreateVolume"); err != nil {
+		t.Errorf("expected no error without maintenance mode, got %v", err)
+	}
+}
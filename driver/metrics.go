@@ -0,0 +1,305 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MetricsPath is the path metrics are served on in the Prometheus text format
+	MetricsPath = "/metrics"
+
+	metricsNamespace = "csi_vultr"
+
+	metricsReadTimeout = 10 * time.Second
+)
+
+type metricKind string
+
+const (
+	counterMetric   metricKind = "counter"
+	gaugeMetric     metricKind = "gauge"
+	histogramMetric metricKind = "histogram"
+)
+
+// defaultDurationBuckets are the histogram buckets, in seconds, for operation durations
+var defaultDurationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// metrics is the registry of all metrics exported by the driver
+var metrics = newMetricsRegistry()
+
+// Loop metrics are shared by the controller's background loops and queues
+var (
+	loopQueueDepth = metrics.newGauge("loop_queue_depth",
+		"Number of work items queued or in progress in a controller loop", "loop")
+	loopWorkDuration = metrics.newHistogram("loop_work_duration_seconds",
+		"Time taken to process a work item in a controller loop", defaultDurationBuckets, "loop")
+	loopFailures = metrics.newCounter("loop_failures_total",
+		"Number of work items which failed in a controller loop", "loop")
+)
+
+// trackLoopWork records a work item entering loop and returns a func to call with
+// the outcome once it is done
+func trackLoopWork(loop string) func(error) {
+	start := time.Now()
+	loopQueueDepth.add(1, loop)
+
+	return func(err error) {
+		loopQueueDepth.add(-1, loop)
+		loopWorkDuration.observe(time.Since(start).Seconds(), loop)
+		if err != nil {
+			loopFailures.add(1, loop)
+		}
+	}
+}
+
+// metricsRegistry holds metric families and renders them in the Prometheus text format
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families []*metricFamily
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{}
+}
+
+func (r *metricsRegistry) register(f *metricFamily) *metricFamily {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.families = append(r.families, f)
+	return f
+}
+
+func (r *metricsRegistry) newCounter(name, help string, labels ...string) *metricFamily {
+	return r.register(newMetricFamily(name, help, counterMetric, nil, labels))
+}
+
+func (r *metricsRegistry) newGauge(name, help string, labels ...string) *metricFamily {
+	return r.register(newMetricFamily(name, help, gaugeMetric, nil, labels))
+}
+
+func (r *metricsRegistry) newHistogram(name, help string, buckets []float64, labels ...string) *metricFamily {
+	return r.register(newMetricFamily(name, help, histogramMetric, buckets, labels))
+}
+
+// write renders every registered family
+func (r *metricsRegistry) write(w io.Writer) error {
+	r.mu.Lock()
+	families := make([]*metricFamily, len(r.families))
+	copy(families, r.families)
+	r.mu.Unlock()
+
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	for _, f := range families {
+		if err := f.write(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *metricsRegistry) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := r.write(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// metricFamily is a named metric with one series per label value combination
+type metricFamily struct {
+	name    string
+	help    string
+	kind    metricKind
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+
+	value float64
+
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+func newMetricFamily(name, help string, kind metricKind, buckets []float64, labels []string) *metricFamily {
+	return &metricFamily{
+		name:    metricsNamespace + "_" + name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricSeries),
+	}
+}
+
+func (f *metricFamily) get(labelValues []string) *metricSeries {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{
+			labelValues:  append([]string(nil), labelValues...),
+			bucketCounts: make([]uint64, len(f.buckets)),
+		}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+// add increments a counter or gauge
+func (f *metricFamily) add(v float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(labelValues).value += v
+}
+
+// set sets a gauge, or a counter to a count kept elsewhere
+func (f *metricFamily) set(v float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(labelValues).value = v
+}
+
+// remove drops the series for the label values, so it is no longer exported
+func (f *metricFamily) remove(labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.series, strings.Join(labelValues, "\xff"))
+}
+
+// observe records a histogram sample
+func (f *metricFamily) observe(v float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.get(labelValues)
+	for i, upper := range f.buckets {
+		if v <= upper {
+			s.bucketCounts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (f *metricFamily) write(w io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := f.series[k]
+
+		if f.kind != histogramMetric {
+			if _, err := fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), formatFloat(s.value)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for i, upper := range f.buckets {
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n",
+				f.name, formatLabels(f.labels, s.labelValues, "le", formatFloat(upper)), s.bucketCounts[i]); err != nil {
+				return err
+			}
+		}
+
+		labels := formatLabels(f.labels, s.labelValues, "", "")
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			f.name, formatLabels(f.labels, s.labelValues, "le", "+Inf"), s.count,
+			f.name, labels, formatFloat(s.sum),
+			f.name, labels, s.count); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+	}
+
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extraName, extraValue))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// serveMetrics serves the metrics registry on addr
+func serveMetrics(addr string, log *logrus.Entry) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(MetricsPath, metrics.handler())
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: metricsReadTimeout,
+	}
+
+	log.WithFields(logrus.Fields{
+		"address": addr,
+	}).Info("Metrics: listening")
+
+	if err := server.ListenAndServe(); err != nil {
+		log.Errorf("Metrics: failed to serve: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package driver
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMetricsRegistryWrite(t *testing.T) {
+	r := newMetricsRegistry()
+	counter := r.newCounter("test_total", "A test counter", "op")
+	histogram := r.newHistogram("test_seconds", "A test histogram", []float64{1, 5}, "op")
+
+	counter.add(2, "create")
+	histogram.observe(3, "create")
+
+	var buf bytes.Buffer
+	if err := r.write(&buf); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for _, line := range []string{
+		"# TYPE csi_vultr_test_total counter",
+		`csi_vultr_test_total{op="create"} 2`,
+		`csi_vultr_test_seconds_bucket{op="create",le="1"} 0`,
+		`csi_vultr_test_seconds_bucket{op="create",le="5"} 1`,
+		`csi_vultr_test_seconds_bucket{op="create",le="+Inf"} 1`,
+		`csi_vultr_test_seconds_sum{op="create"} 3`,
+		`csi_vultr_test_seconds_count{op="create"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestTrackLoopWork(t *testing.T) {
+	done := trackLoopWork("test_loop")
+
+	var buf bytes.Buffer
+	if err := loopQueueDepth.write(&buf); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !strings.Contains(buf.String(), `csi_vultr_loop_queue_depth{loop="test_loop"} 1`) {
+		t.Errorf("expected in flight work to be counted, got:\n%s", buf.String())
+	}
+
+	done(errors.New("failed"))
+
+	buf.Reset()
+	if err := loopFailures.write(&buf); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !strings.Contains(buf.String(), `csi_vultr_loop_failures_total{loop="test_loop"} 1`) {
+		t.Errorf("expected failure to be counted, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"sort"
+)
+
+// mutableParameters are the parameters a VolumeAttributesClass can set, on CreateVolume
+// and on existing volumes. Labels are not among them as they map volumes back to their
+// CSI name.
+var mutableParameters = map[string]bool{
+	blockTypeParam: true,
+	vfsTagsParam:   true,
+}
+
+// normalizeMutableParameters normalizes the mutable parameters of a request like
+// StorageClass parameters, refusing those which cannot change
+func normalizeMutableParameters(params map[string]string) (map[string]string, error) {
+	normalized, err := normalizeParameters(params)
+	if err != nil {
+		return nil, err
+	}
+
+	var immutable []string
+	for k := range normalized {
+		if !mutableParameters[k] {
+			immutable = append(immutable, k)
+		}
+	}
+	if len(immutable) > 0 {
+		sort.Strings(immutable)
+		return nil, fmt.Errorf("%w: parameters %v are not mutable, mutable parameters are %v",
+			errInvalidParameter, immutable, sortedParameterKeys(mutableParameters))
+	}
+	return normalized, nil
+}
+
+// withMutableParameters returns the normalized parameters of a CreateVolume overridden by
+// its mutable parameters, which take precedence
+func withMutableParameters(params, mutable map[string]string) (map[string]string, error) {
+	mutable, err := normalizeMutableParameters(mutable)
+	if err != nil || len(mutable) == 0 {
+		return params, err
+	}
+
+	merged := make(map[string]string, len(params)+len(mutable))
+	for k, v := range params {
+		merged[k] = v
+	}
+	for k, v := range mutable {
+		merged[k] = v
+	}
+	return merged, nil
+}
+
+func sortedParameterKeys(params map[string]bool) []string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,116 @@
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNormalizeMutableParameters(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   map[string]string
+		expected map[string]string
+		ok       bool
+	}{
+		{"none", nil, map[string]string{}, true},
+		{"block type alias", map[string]string{"Block_Type": "nvme"}, map[string]string{blockTypeParam: blockTypeNvme}, true},
+		{"tags", map[string]string{"tags": "team-a,ci"}, map[string]string{vfsTagsParam: "team-a,ci"}, true},
+		{"immutable", map[string]string{"fsType": "xfs"}, nil, false},
+		{"unknown", map[string]string{"iops": "1000"}, nil, false},
+		{"invalid block type", map[string]string{blockTypeParam: "ssd"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeMutableParameters(tt.params)
+			if (err == nil) != tt.ok {
+				t.Fatalf("expected ok %v, got %v", tt.ok, err)
+			}
+			if tt.ok && !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestControllerModifyVolume(t *testing.T) {
+	controller, vfs := newFakeVFSControllerServer("modify volume")
+	controller.Driver.clusterID = "prod"
+
+	created, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:              "vfs-modify",
+		Parameters:        map[string]string{storageTypeParam: storageTypeVFS, vfsTagsParam: "team-a"},
+		MutableParameters: map[string]string{vfsTagsParam: "team-b"},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+	volumeID := created.Volume.VolumeId
+
+	// the mutable parameters take precedence over the StorageClass ones
+	if expected := []string{"team-b", "kubernetes-cluster:prod"}; !reflect.DeepEqual(vfs.volumes[volumeID].Tags, expected) {
+		t.Errorf("expected the volume created with tags %v, got %v", expected, vfs.volumes[volumeID].Tags)
+	}
+
+	tests := []struct {
+		name    string
+		volume  string
+		mutable map[string]string
+		code    codes.Code
+		tags    []string
+	}{
+		{"tags replaced", volumeID, map[string]string{vfsTagsParam: "team-c, ci"}, codes.OK, []string{"team-c", "ci", "kubernetes-cluster:prod"}},
+		{"tags cleared", volumeID, map[string]string{vfsTagsParam: ""}, codes.OK, []string{"kubernetes-cluster:prod"}},
+		{"block type of vfs", volumeID, map[string]string{blockTypeParam: blockTypeHDD}, codes.InvalidArgument, nil},
+		{"immutable parameter", volumeID, map[string]string{encryptedParam: "true"}, codes.InvalidArgument, nil},
+		{"missing volume", "vfs-404", map[string]string{vfsTagsParam: "ci"}, codes.NotFound, nil},
+		{"no volume ID", "", map[string]string{vfsTagsParam: "ci"}, codes.InvalidArgument, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := controller.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{
+				VolumeId:          tt.volume,
+				MutableParameters: tt.mutable,
+			})
+			if status.Code(err) != tt.code {
+				t.Fatalf("expected %v, got %v", tt.code, err)
+			}
+			if tt.tags != nil && !reflect.DeepEqual(vfs.volumes[volumeID].Tags, tt.tags) {
+				t.Errorf("expected tags %v, got %v", tt.tags, vfs.volumes[volumeID].Tags)
+			}
+		})
+	}
+}
+
+func TestBlockModify(t *testing.T) {
+	backend := newBlockBackend(&VultrDriver{})
+	vol := &backendVolume{ID: "block", BlockType: blockTypeNvme}
+
+	tests := []struct {
+		name   string
+		params map[string]string
+		ok     bool
+	}{
+		{"same block type", map[string]string{blockTypeParam: blockTypeNvme}, true},
+		{"other block type", map[string]string{blockTypeParam: blockTypeHDD}, false},
+		{"tags", map[string]string{vfsTagsParam: "ci"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := backend.Modify(context.Background(), vol, tt.params); (err == nil) != tt.ok {
+				t.Errorf("expected ok %v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
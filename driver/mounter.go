@@ -0,0 +1,689 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+)
+
+// nodeMounter formats and mounts the volumes of the node, which mount.SafeFormatAndMount
+// does with the mount table of the node
+type nodeMounter interface {
+	mount.Interface
+
+	FormatAndMountSensitiveWithFormatOptions(source, target, fstype string, options, sensitiveOptions, formatOptions []string) error
+}
+
+// fsResizer grows the filesystems of expanded volumes, which mount.ResizeFs does with
+// the grow tool of each filesystem
+type fsResizer interface {
+	Resize(devicePath, deviceMountPath string) (bool, error)
+	NeedResize(devicePath, deviceMountPath string) (bool, error)
+}
+
+const (
+	fsTypeExt3  = "ext3"
+	fsTypeExt4  = "ext4"
+	fsTypeXFS   = "xfs"
+	fsTypeBtrfs = "btrfs"
+	// fsTypeNTFS is the filesystem of Windows nodes, formatted by mount-utils with Format-Volume
+	fsTypeNTFS = "ntfs"
+
+	// fsTypeVirtiofs is the filesystem VFS volumes are mounted with, never formatted by the node
+	fsTypeVirtiofs = "virtiofs"
+)
+
+var partitionedDevices = metrics.newCounter("partitioned_devices_total",
+	"Number of stages finding a partition table on the device, by whether it was refused or wiped", "result")
+
+var stagingRemounts = metrics.newCounter("staging_remounts_total",
+	"Number of staged filesystems remounted as their targets changed, by whether they were made read_only, writable or failed", "result")
+
+var unstageReferences = metrics.newCounter("unstage_references_total",
+	"Number of unstages finding targets still referencing the staged filesystem, by whether they were refused or unmounted", "result")
+
+// fsFormatOptions are the mkfs arguments for each supported filesystem, passed on top
+// of the force flags mount-utils sets. Freshly provisioned volumes are already zeroed
+// so discarding blocks at format time only slows down staging large volumes. mount-utils
+// only forces ext and xfs, so btrfs carries its own force flag to format over leftovers
+// blkid does not report, such as a partition table.
+var fsFormatOptions = map[string][]string{
+	fsTypeExt3:  {"-E", "nodiscard"},
+	fsTypeExt4:  {"-E", "nodiscard"},
+	fsTypeXFS:   {"-K"},
+	fsTypeBtrfs: {"-f", "-K"},
+	fsTypeNTFS:  nil,
+}
+
+// resolveFsType returns the canonical filesystem for a requested fsType, defaulting to
+// fallback, or ext4 without one, and rejecting filesystems the node cannot format and grow
+func resolveFsType(fsType, fallback string) (string, error) {
+	if fsType == "" {
+		fsType = fallback
+	}
+	if fsType == "" {
+		return defaultFsType, nil
+	}
+
+	fsType = strings.ToLower(fsType)
+	if _, ok := fsFormatOptions[fsType]; !ok {
+		return "", fmt.Errorf("unsupported filesystem type %q, supported types are %v", fsType, supportedFsTypes())
+	}
+
+	return fsType, nil
+}
+
+func supportedFsTypes() []string {
+	types := make([]string, 0, len(fsFormatOptions))
+	for t := range fsFormatOptions {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	return types
+}
+
+// isExtFs reports whether fsType is one of the ext filesystems tuned with tune2fs
+func isExtFs(fsType string) bool {
+	return fsType == fsTypeExt3 || fsType == fsTypeExt4
+}
+
+// e2fsck exit status bits, see e2fsck(8)
+const (
+	e2fsckErrorsUncorrected = 4
+	e2fsckOperationalError  = 8
+)
+
+// xfsRepairDirtyLog is the xfs_repair exit status when the log needs replaying, see xfs_repair(8)
+const xfsRepairDirtyLog = 2
+
+// formatAndMount formats source if needed and mounts it at target, translating
+// failures into gRPC errors which tell apart the stage that failed. mkfsOptions are
+// the operator's mkfs arguments from the StorageClass, used when source is unformatted.
+func (n *VultrNodeServer) formatAndMount(ctx context.Context, source, target, fsType string, options, mkfsOptions []string) error {
+	if len(mkfsOptions) > 0 && !hasOption(options, "ro") {
+		if err := n.formatWithOptions(ctx, source, fsType, mkfsOptions); err != nil {
+			return err
+		}
+	}
+
+	// do not start once the RPC is abandoned
+	if err := ctx.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+
+	// a restored clone carries the filesystem UUID of its source, which xfs refuses to
+	// mount twice on one node. ext filesystems mount with duplicate UUIDs as is.
+	if fsType == fsTypeXFS && !hasOption(options, "nouuid") {
+		options = append(append([]string(nil), options...), "nouuid")
+	}
+
+	hctx, cancel := helperContext(ctx)
+	defer cancel()
+
+	mounter := n.boundMounter(hctx)
+	err := mounter.FormatAndMountSensitiveWithFormatOptions(source, target, fsType, options, nil, fsFormatOptions[fsType])
+	if err == nil {
+		return nil
+	}
+
+	var mountErr mount.MountError
+	if !errors.As(err, &mountErr) {
+		return status.Errorf(codes.Internal, "mount of %s at %s failed: %v", source, target, err)
+	}
+
+	switch mountErr.Type {
+	case mount.GetDiskFormatFailed:
+		return status.Errorf(codes.Internal, "cannot determine existing filesystem on %s: %v", source, mountErr.Message)
+	case mount.UnformattedReadOnly:
+		return status.Errorf(codes.FailedPrecondition,
+			"device %s is unformatted and cannot be formatted for a read-only mount", source)
+	case mount.FormatFailed:
+		// mount-utils only formats blank devices
+		if hctx.Err() != nil {
+			n.wipePartialFormat(ctx, requestLogger(ctx, n.Driver.log), source)
+			return status.Errorf(codes.DeadlineExceeded,
+				"formatting %s as %s did not finish before the deadline, the partial filesystem was wiped: %v", source, fsType, mountErr.Message)
+		}
+		return status.Errorf(codes.Internal, "formatting %s as %s failed: %v", source, fsType, mountErr.Message)
+	case mount.HasFilesystemErrors:
+		return status.Errorf(codes.DataLoss, "filesystem on %s has errors which could not be repaired: %v", source, mountErr.Message)
+	case mount.FilesystemMismatch:
+		if table, ptErr := n.host.partitionTable(source); ptErr == nil && table != "" {
+			return partitionedError(source, table)
+		}
+		existing, fmtErr := n.host.diskFormat(source)
+		if fmtErr != nil {
+			existing = "unknown"
+		}
+		return status.Errorf(codes.FailedPrecondition,
+			"device %s already contains a %s filesystem but %s was requested: %v", source, existing, fsType, mountErr.Message)
+	default:
+		return status.Errorf(codes.Internal, "mount of %s at %s failed: %v", source, target, mountErr.Message)
+	}
+}
+
+// checkFsType refuses a device already formatted with another filesystem than fsType,
+// which would otherwise be mounted with the wrong type or fail deep in the mount. An
+// unformatted device is left to be formatted as fsType.
+func (n *VultrNodeServer) checkFsType(source, fsType string) error {
+	existing, err := n.host.diskFormat(source)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot determine existing filesystem on %s: %v", source, err)
+	}
+
+	if existing == "" || existing == fsType {
+		return nil
+	}
+
+	return status.Errorf(codes.FailedPrecondition,
+		"device %s already holds a %s filesystem but %s was requested, it is neither mounted as %s nor reformatted",
+		source, existing, fsType, fsType)
+}
+
+// checkPartitions refuses a device holding a partition table and no filesystem, as when
+// the volume was partitioned by hand, which mount-utils only fails to mount as a filesystem
+// mismatch. With wipe, which only the StorageClass opts into, the partition table is wiped
+// for the device to be formatted whole, losing whatever the partitions held.
+func (n *VultrNodeServer) checkPartitions(ctx context.Context, source string, readOnly, wipe bool) error {
+	table, err := n.host.partitionTable(source)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot check %s for a partition table: %v", source, err)
+	}
+	if table == "" {
+		return nil
+	}
+
+	if !wipe {
+		partitionedDevices.add(1, "refused")
+		return partitionedError(source, table)
+	}
+	if readOnly {
+		partitionedDevices.add(1, "refused")
+		return status.Errorf(codes.FailedPrecondition,
+			"device %s holds a %s partition table and no filesystem, which cannot be wiped for a read-only mount", source, table)
+	}
+
+	requestLogger(ctx, n.Driver.log).WithFields(logrus.Fields{
+		"device":          source,
+		"partition_table": table,
+	}).Warn("wiping the partition table of the device, as the StorageClass sets " + wipePartitionsParam)
+
+	out, err := n.runCommand(ctx, "wipefs", "-a", source)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		if errors.Is(err, exec.ErrExecutableNotFound) {
+			return status.Errorf(codes.FailedPrecondition, "cannot wipe the partition table of %s: wipefs is not installed", source)
+		}
+		return status.Errorf(codes.Internal, "wipefs -a on %s failed: %v: %s", source, err, out)
+	}
+	partitionedDevices.add(1, "wiped")
+
+	return nil
+}
+
+// partitionedError is the error of staging a device partitioned by hand
+func partitionedError(source, table string) error {
+	return status.Errorf(codes.FailedPrecondition,
+		"device %s holds a %s partition table and no filesystem, as when the volume was partitioned by hand: "+
+			"it is neither mounted nor formatted, move its data off the partitions or set the %s parameter "+
+			"of the StorageClass to wipe them", source, table, wipePartitionsParam)
+}
+
+// setReservedBlocks sets the percentage of the ext filesystem on source reserved for
+// root. mkfs reserves 5% by default, which is wasted on large data volumes; applying
+// it at every stage also brings filesystems formatted before the parameter was set in line.
+func (n *VultrNodeServer) setReservedBlocks(ctx context.Context, source, fsType, percentage string) error {
+	if !isExtFs(fsType) {
+		return status.Errorf(codes.InvalidArgument, "reserved blocks cannot be set on a %s filesystem", fsType)
+	}
+
+	out, err := n.runCommand(ctx, "tune2fs", "-m", percentage, source)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		if errors.Is(err, exec.ErrExecutableNotFound) {
+			return status.Errorf(codes.FailedPrecondition, "cannot set reserved blocks on %s: tune2fs is not installed", source)
+		}
+		return status.Errorf(codes.Internal, "tune2fs -m %s on %s failed: %v: %s", percentage, source, err, out)
+	}
+
+	return nil
+}
+
+// trimExpanded discards the blocks of the filesystem mounted at target past from, the
+// size it had before being expanded, so that the space just added to a thin provisioned
+// volume is reported unallocated right away rather than after the next periodic trim
+func (n *VultrNodeServer) trimExpanded(ctx context.Context, target string, from int64) error {
+	out, err := n.runCommand(ctx, "fstrim", "-o", strconv.FormatInt(from, 10), target)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		if errors.Is(err, exec.ErrExecutableNotFound) {
+			return status.Errorf(codes.FailedPrecondition, "cannot trim %s: fstrim is not installed", target)
+		}
+		return status.Errorf(codes.Internal, "fstrim -o %d %s failed: %v: %s", from, target, err, out)
+	}
+
+	return nil
+}
+
+// formatWithOptions formats an unformatted source itself, as mount-utils passes its own
+// defaults after any format options and would override flags such as ext's -m
+func (n *VultrNodeServer) formatWithOptions(ctx context.Context, source, fsType string, mkfsOptions []string) error {
+	existing, err := n.host.diskFormat(source)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot determine existing filesystem on %s: %v", source, err)
+	}
+
+	// existing filesystems are never reformatted
+	if existing != "" {
+		return nil
+	}
+
+	var args []string
+	switch fsType {
+	case fsTypeNTFS:
+		return status.Errorf(codes.InvalidArgument, "mkfs options cannot be set for %s filesystems", fsType)
+	case fsTypeXFS:
+		args = []string{"-f"}
+	case fsTypeBtrfs:
+		// forced by its fsFormatOptions
+	default:
+		args = []string{"-F", "-m0"}
+	}
+	args = append(args, fsFormatOptions[fsType]...)
+	args = append(args, mkfsOptions...)
+	args = append(args, source)
+
+	n.Driver.log.WithFields(logrus.Fields{
+		"device":  source,
+		"fs_type": fsType,
+		"args":    args,
+	}).Info("formatting device with StorageClass mkfs options")
+
+	hctx, cancel := helperContext(ctx)
+	defer cancel()
+
+	if out, err := n.runCommand(hctx, "mkfs."+fsType, args...); err != nil {
+		if hctx.Err() != nil {
+			n.wipePartialFormat(ctx, requestLogger(ctx, n.Driver.log), source)
+			return status.Errorf(codes.DeadlineExceeded,
+				"formatting %s as %s did not finish before the deadline, the partial filesystem was wiped", source, fsType)
+		}
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Errorf(codes.Internal, "formatting %s as %s with options %v failed: %v: %s", source, fsType, mkfsOptions, err, out)
+	}
+
+	return nil
+}
+
+// runCommand runs cmd until it exits or ctx is done, so a command stuck on an
+// unresponsive device does not hold the RPC past its deadline. It returns a gRPC
+// status error when ctx ended the command. The command is a span of the trace in ctx.
+func (n *VultrNodeServer) runCommand(ctx context.Context, cmd string, args ...string) ([]byte, error) {
+	return n.runCommandWithInput(ctx, "", cmd, args...)
+}
+
+// runCommandWithInput is runCommand feeding input to the command on stdin, which keeps
+// secrets such as passphrases out of the process arguments
+func (n *VultrNodeServer) runCommandWithInput(ctx context.Context, input, cmd string, args ...string) (out []byte, err error) {
+	ctx, span := n.Driver.tracer.start(ctx, cmd, spanKindInternal, spanAttrs{"process.command": cmd})
+	defer func() { span.end(err) }()
+
+	c := n.Driver.exec.CommandContext(ctx, cmd, args...)
+	if input != "" {
+		c.SetStdin(strings.NewReader(input))
+	}
+
+	out, err = c.CombinedOutput()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		killedHelpers.add(1, cmd)
+		return out, status.Errorf(status.FromContextError(ctxErr).Code(), "%s %v: %v", cmd, args, ctxErr)
+	}
+
+	return out, err
+}
+
+// ensureReadOnly verifies the mount at target ended up read-only and remounts it when
+// the ro option was not applied, as happens with bind mounts on older kernels
+func (n *VultrNodeServer) ensureReadOnly(target string) error {
+	readOnly, err := n.host.isReadOnlyMount(target)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot verify mount at %s is read-only: %v", target, err)
+	}
+
+	if readOnly {
+		return nil
+	}
+
+	n.Driver.log.WithField("target_path", target).Warn("read-only mount was left writable, remounting")
+
+	if err := n.host.remountReadOnly(target); err != nil {
+		return status.Errorf(codes.Internal, "cannot remount %s read-only: %v", target, err)
+	}
+
+	readOnly, err = n.host.isReadOnlyMount(target)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot verify mount at %s is read-only: %v", target, err)
+	}
+
+	if !readOnly {
+		return status.Errorf(codes.Internal, "mount at %s is still writable after remounting read-only", target)
+	}
+
+	return nil
+}
+
+// stagesReadOnly reports whether the capability has the filesystem staged read-only
+// whatever its publishes, with a reader only access mode or the ro mount option
+func stagesReadOnly(capability *csi.VolumeCapability, volumeContext map[string]string) bool {
+	if readOnlyAccessModes[capability.GetAccessMode().GetMode()] {
+		return true
+	}
+
+	options, _ := stageMountOptions(append([]string{volumeContext[volumeContextMountOptions]}, capability.GetMount().GetMountFlags()...))
+	return hasOption(options, "ro")
+}
+
+// remountStaging flips the filesystem staged at stagingPath to read-only or writable,
+// along with every target bind mounting it
+func (n *VultrNodeServer) remountStaging(ctx context.Context, volumeID, stagingPath string, readOnly bool) error {
+	mode, result := "writable", "writable"
+	if readOnly {
+		mode, result = "read-only", "read_only"
+	}
+
+	if err := n.host.remountFilesystem(stagingPath, readOnly); err != nil {
+		stagingRemounts.add(1, "failed")
+		return status.Errorf(codes.Internal, "cannot remount staging path %s %s: %v", stagingPath, mode, err)
+	}
+	n.staged.setReadOnly(volumeID, readOnly)
+	stagingRemounts.add(1, result)
+
+	requestLogger(ctx, n.Driver.log).WithField("staging_path", stagingPath).Infof("remounted the staged filesystem %s", mode)
+	return nil
+}
+
+// syncStagingReadOnly remounts the staged filesystem of the volume read-only while every
+// target publishing it is read-only, for a pod escaping its read-only bind mount not to be
+// able to write either, and writable again once a target is not
+func (n *VultrNodeServer) syncStagingReadOnly(ctx context.Context, volumeID string) error {
+	readOnly, ok := n.staged.stagingReadOnly(volumeID)
+	if !ok {
+		return nil
+	}
+
+	staged, _ := n.staged.get(volumeID)
+	if staged.ReadOnly == readOnly {
+		return nil
+	}
+	return n.remountStaging(ctx, volumeID, staged.StagingPath, readOnly)
+}
+
+// makeStagingWritable remounts the staged filesystem of the volume writable for a writable
+// target, unless the capability stages it read-only. A volume the node does not track, as
+// after the node plugin restarted, is remounted when the mount table has it read-only.
+func (n *VultrNodeServer) makeStagingWritable(ctx context.Context, req *csi.NodePublishVolumeRequest) error {
+	if req.VolumeContext[volumeContextStorageType] == storageTypeVFS || stagesReadOnly(req.VolumeCapability, req.VolumeContext) {
+		return nil
+	}
+
+	var readOnly bool
+	if staged, ok := n.staged.get(req.VolumeId); ok {
+		readOnly = staged.ReadOnly && !staged.pinned && staged.FsType != fsTypeVirtiofs
+	} else if ro, err := n.host.isReadOnlyMount(req.StagingTargetPath); err == nil {
+		readOnly = ro
+	}
+
+	if !readOnly {
+		return nil
+	}
+	return n.remountStaging(ctx, req.VolumeId, req.StagingTargetPath, false)
+}
+
+// isPublished reports whether target is already mounted from source, as when kubelet
+// retries a publish which succeeded. A target mounted from anything else, or with another
+// read-only setting than asked for, fails with AlreadyExists rather than a mount stacked on it.
+func (n *VultrNodeServer) isPublished(target, source string, readOnly bool) (bool, error) {
+	notMnt, err := n.Driver.mounter.IsLikelyNotMountPoint(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, status.Errorf(codes.Internal, "cannot check target path %s: %v", target, err)
+	}
+
+	if notMnt {
+		return false, nil
+	}
+
+	refs, err := n.Driver.mounter.GetMountRefs(source)
+	if err != nil {
+		return false, status.Errorf(codes.Internal, "cannot list the mounts of %s: %v", source, err)
+	}
+
+	resolved, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		resolved = target
+	}
+
+	for _, ref := range refs {
+		if ref != target && ref != resolved {
+			continue
+		}
+
+		ro, err := n.host.isReadOnlyMount(target)
+		if err != nil {
+			return false, status.Errorf(codes.Internal, "cannot verify mount at %s is read-only: %v", target, err)
+		}
+		switch {
+		case readOnly && !ro:
+			return false, status.Errorf(codes.AlreadyExists, "target path %s is already published writable, not read-only", target)
+		case !readOnly && ro:
+			return false, status.Errorf(codes.AlreadyExists, "target path %s is already published read-only, not writable", target)
+		}
+		return true, nil
+	}
+
+	return false, status.Errorf(codes.AlreadyExists, "target path %s is already mounted from something other than %s", target, source)
+}
+
+// stagingReferences returns the mounts other than the staging path itself referencing
+// the filesystem staged at it, the bind mounts of targets not unpublished yet
+func (n *VultrNodeServer) stagingReferences(stagingPath string) ([]string, error) {
+	notMnt, err := n.Driver.mounter.IsLikelyNotMountPoint(stagingPath)
+	if err != nil {
+		// a dead mount can only be cleaned up, whatever still references it
+		if os.IsNotExist(err) || mount.IsCorruptedMnt(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if notMnt {
+		return nil, nil
+	}
+
+	refs, err := n.Driver.mounter.GetMountRefs(stagingPath)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, err := filepath.EvalSymlinks(stagingPath)
+	if err != nil {
+		resolved = stagingPath
+	}
+
+	var others []string
+	for _, ref := range refs {
+		if ref != stagingPath && ref != resolved {
+			others = append(others, ref)
+		}
+	}
+	return others, nil
+}
+
+// releaseStagingReferences fails with FailedPrecondition while targets still reference the
+// filesystem staged at stagingPath, as unmounting it would pull the filesystem out from
+// under running pods when kubelet unstages before an unpublish finished, unless the
+// driver force unmounts those targets
+func (n *VultrNodeServer) releaseStagingReferences(ctx context.Context, stagingPath string) error {
+	refs, err := n.stagingReferences(stagingPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot list the mounts of staging path %s: %v", stagingPath, err)
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+
+	if !n.Driver.unstageForceUnmount {
+		unstageReferences.add(1, "refused")
+		return status.Errorf(codes.FailedPrecondition, "NodeUnstageVolume staging path %s is still mounted at %s, unpublish them first",
+			stagingPath, strings.Join(refs, ", "))
+	}
+
+	requestLogger(ctx, n.Driver.log).WithField("targets", refs).Warn("unmounting the targets still referencing the staging path")
+	for _, ref := range refs {
+		if err := n.Driver.mounter.Unmount(ref); err != nil {
+			return status.Errorf(codes.Internal, "cannot unmount %s still referencing staging path %s: %v", ref, stagingPath, err)
+		}
+	}
+	unstageReferences.add(1, "unmounted")
+	return nil
+}
+
+// publishMountError returns the error of a failed publish mount. A target which is busy
+// because a concurrent publish mounted it first is checked again, so the same source
+// succeeds and anything else fails with AlreadyExists instead of EBUSY.
+func (n *VultrNodeServer) publishMountError(target, source string, readOnly bool, err error) error {
+	if !n.host.isBusy(err) {
+		return status.Errorf(codes.Internal, "cannot bind mount %s to %s: %v", source, target, err)
+	}
+
+	published, checkErr := n.isPublished(target, source, readOnly)
+	if checkErr != nil {
+		return checkErr
+	}
+	if !published {
+		return status.Errorf(codes.AlreadyExists, "target path %s is busy: %v", target, err)
+	}
+	return nil
+}
+
+// checkFilesystem checks an existing filesystem on source before it is mounted. ext
+// filesystems are repaired where e2fsck can do so safely, xfs is only examined as
+// xfs_repair cannot run unattended. With repair, which only an operator opts into, every
+// fix either tool offers is made. Damage left behind fails with DataLoss.
+func (n *VultrNodeServer) checkFilesystem(ctx context.Context, source string, readOnly, repair bool) error {
+	format, err := n.host.diskFormat(source)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot determine existing filesystem on %s: %v", source, err)
+	}
+
+	log := n.Driver.log.WithFields(logrus.Fields{
+		"device":  source,
+		"fs_type": format,
+	})
+
+	var cmd string
+	var args []string
+	switch format {
+	case "":
+		// unformatted, it is formatted fresh when staged
+		return nil
+	case "ext2", fsTypeExt3, fsTypeExt4:
+		cmd, args = "e2fsck", []string{"-p", source}
+		if repair {
+			args = []string{"-f", "-y", source}
+		} else if readOnly {
+			args = []string{"-n", source}
+		}
+	case fsTypeXFS:
+		cmd, args = "xfs_repair", []string{"-n", source}
+		if repair {
+			args = []string{source}
+		}
+	default:
+		log.Warn("filesystem check skipped, no checker for filesystem")
+		return nil
+	}
+
+	out, err := n.runCommand(ctx, cmd, args...)
+	if err == nil {
+		log.Info("filesystem check found no errors")
+		return nil
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	if errors.Is(err, exec.ErrExecutableNotFound) {
+		return status.Errorf(codes.FailedPrecondition, "cannot check filesystem on %s: %s is not installed", source, cmd)
+	}
+
+	var exitErr exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return status.Errorf(codes.Internal, "%s on %s failed: %v", cmd, source, err)
+	}
+
+	code := exitErr.ExitStatus()
+	log = log.WithField("exit_status", code)
+
+	if cmd == "e2fsck" {
+		switch {
+		case code >= e2fsckOperationalError:
+			return status.Errorf(codes.Internal, "e2fsck on %s failed with status %d: %s", source, code, out)
+		case code&e2fsckErrorsUncorrected != 0:
+			log.Errorf("filesystem check found errors it could not correct: %s", out)
+			return status.Errorf(codes.DataLoss, "filesystem on %s has errors which could not be repaired: %s", source, out)
+		default:
+			log.Warnf("filesystem check corrected errors: %s", out)
+			return nil
+		}
+	}
+
+	if code == 1 {
+		log.Errorf("filesystem check found corruption: %s", out)
+		return status.Errorf(codes.DataLoss, "xfs filesystem on %s is corrupt and needs xfs_repair: %s", source, out)
+	}
+
+	if code == xfsRepairDirtyLog && repair {
+		log.Errorf("filesystem repair refused to discard the log: %s", out)
+		return status.Errorf(codes.DataLoss, "xfs filesystem on %s has a log to replay, which xfs_repair only discards with -L: %s",
+			source, out)
+	}
+
+	return status.Errorf(codes.Internal, "xfs_repair on %s failed with status %d: %s", source, code, out)
+}
@@ -0,0 +1,468 @@
+package driver
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+)
+
+// fakeExec records the commands it is asked to run and replies with canned output
+type fakeExec struct {
+	mu sync.Mutex
+	// outputs are keyed by command, or by the whole command line for a single invocation
+	outputs map[string]string
+	// exitCodes are keyed by command, or by the whole command line to fail a single invocation
+	exitCodes map[string]int
+	// hangs are the commands which run until their context is done
+	hangs map[string]bool
+	run   [][]string
+}
+
+func (f *fakeExec) Command(cmd string, args ...string) exec.Cmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.run = append(f.run, append([]string{cmd}, args...))
+
+	// a formatted device is reported by blkid from then on
+	if strings.HasPrefix(cmd, "mkfs.") {
+		if f.outputs == nil {
+			f.outputs = map[string]string{}
+		}
+		f.outputs["blkid"] = "TYPE=" + strings.TrimPrefix(cmd, "mkfs.")
+	}
+
+	c := &fakeCmd{output: f.outputs[cmd]}
+	if output, ok := f.outputs[strings.Join(append([]string{cmd}, args...), " ")]; ok {
+		c.output = output
+	}
+	if code, ok := f.exitCodes[strings.Join(append([]string{cmd}, args...), " ")]; ok {
+		c.err = fakeExitError(code)
+	} else if code, ok := f.exitCodes[cmd]; ok {
+		c.err = fakeExitError(code)
+	}
+	return c
+}
+
+func (f *fakeExec) CommandContext(ctx context.Context, cmd string, args ...string) exec.Cmd {
+	c := f.Command(cmd, args...)
+	if f.hangs[cmd] {
+		return &hangingCmd{fakeCmd: c.(*fakeCmd), ctx: ctx}
+	}
+	return c
+}
+
+func (f *fakeExec) LookPath(file string) (string, error) {
+	return "/usr/sbin/" + file, nil
+}
+
+// ran returns the recorded invocation of cmd, nil when it was not run
+func (f *fakeExec) ran(cmd string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, c := range f.run {
+		if c[0] == cmd {
+			return c[1:]
+		}
+	}
+	return nil
+}
+
+type fakeExitError int
+
+func (e fakeExitError) String() string  { return e.Error() }
+func (e fakeExitError) Error() string   { return "exit status " + strconv.Itoa(int(e)) }
+func (e fakeExitError) Exited() bool    { return true }
+func (e fakeExitError) ExitStatus() int { return int(e) }
+
+type fakeCmd struct {
+	output string
+	err    error
+}
+
+func (c *fakeCmd) Run() error                      { return c.err }
+func (c *fakeCmd) CombinedOutput() ([]byte, error) { return []byte(c.output), c.err }
+func (c *fakeCmd) Output() ([]byte, error)         { return []byte(c.output), c.err }
+func (c *fakeCmd) SetDir(string)                   {}
+func (c *fakeCmd) SetStdin(io.Reader)              {}
+func (c *fakeCmd) SetStdout(io.Writer)             {}
+func (c *fakeCmd) SetStderr(io.Writer)             {}
+func (c *fakeCmd) SetEnv([]string)                 {}
+func (c *fakeCmd) StdoutPipe() (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(c.output)), nil
+}
+func (c *fakeCmd) StderrPipe() (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader("")), nil
+}
+func (c *fakeCmd) Start() error { return nil }
+func (c *fakeCmd) Wait() error  { return nil }
+func (c *fakeCmd) Stop()        {}
+
+// hangingCmd runs until its context is done, as a helper killed by the deadline does
+type hangingCmd struct {
+	*fakeCmd
+	ctx context.Context
+}
+
+func (c *hangingCmd) Run() error {
+	<-c.ctx.Done()
+	return c.ctx.Err()
+}
+
+func (c *hangingCmd) CombinedOutput() ([]byte, error) { return nil, c.Run() }
+func (c *hangingCmd) Output() ([]byte, error)         { return nil, c.Run() }
+
+func newFakeMountNode(fe *fakeExec) *VultrNodeServer {
+	return NewVultrNodeDriver(&VultrDriver{
+		log:     logrus.NewEntry(logrus.New()),
+		mounter: &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil), Exec: fe},
+		resizer: mount.NewResizeFs(fe),
+		exec:    fe,
+	})
+}
+
+func TestFormatAndMountFsTypes(t *testing.T) {
+	tests := []struct {
+		name        string
+		fsType      string
+		mkfsOptions []string
+		mkfs        string
+		mkfsArgs    []string
+	}{
+		{"ext4", fsTypeExt4, nil, "mkfs.ext4", []string{"-E", "nodiscard", "-F", "-m0", "/dev/vdb"}},
+		{"xfs", fsTypeXFS, nil, "mkfs.xfs", []string{"-K", "-f", "/dev/vdb"}},
+		{"ext4 with options", fsTypeExt4, []string{"-i", "8192", "-m", "1"}, "mkfs.ext4",
+			[]string{"-F", "-m0", "-E", "nodiscard", "-i", "8192", "-m", "1", "/dev/vdb"}},
+		{"xfs with options", fsTypeXFS, []string{"-i", "size=512"}, "mkfs.xfs", []string{"-f", "-K", "-i", "size=512", "/dev/vdb"}},
+		{"btrfs", fsTypeBtrfs, nil, "mkfs.btrfs", []string{"-f", "-K", "/dev/vdb"}},
+		{"btrfs with options", fsTypeBtrfs, []string{"--csum", "xxhash"}, "mkfs.btrfs", []string{"-f", "-K", "--csum", "xxhash", "/dev/vdb"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// blkid reporting nothing means the device is unformatted
+			fe := &fakeExec{}
+			node := newFakeMountNode(fe)
+
+			if err := node.formatAndMount(context.Background(), "/dev/vdb", "/staging", tt.fsType, nil, tt.mkfsOptions); err != nil {
+				t.Fatalf("got error, expected no error: %v", err)
+			}
+
+			if args := fe.ran(tt.mkfs); !reflect.DeepEqual(args, tt.mkfsArgs) {
+				t.Errorf("expected %s %v, got %v", tt.mkfs, tt.mkfsArgs, args)
+			}
+		})
+	}
+}
+
+func TestResizeFsTypes(t *testing.T) {
+	tests := []struct {
+		fsType string
+		cmd    string
+		args   []string
+	}{
+		{fsTypeExt4, "resize2fs", []string{"/dev/vdb"}},
+		{fsTypeXFS, "xfs_growfs", []string{"-d", "/staging"}},
+		{fsTypeBtrfs, "btrfs", []string{"filesystem", "resize", "max", "/staging"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fsType, func(t *testing.T) {
+			fe := &fakeExec{outputs: map[string]string{"blkid": "TYPE=" + tt.fsType}}
+			node := newFakeMountNode(fe)
+
+			if _, err := node.Driver.resizer.Resize("/dev/vdb", "/staging"); err != nil {
+				t.Fatalf("got error, expected no error: %v", err)
+			}
+
+			if args := fe.ran(tt.cmd); !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("expected %s %v, got %v", tt.cmd, tt.args, args)
+			}
+		})
+	}
+}
+
+func TestResolveFsType(t *testing.T) {
+	for requested, expected := range map[string]string{
+		"": fsTypeExt4, "ext4": fsTypeExt4, "XFS": fsTypeXFS, "ext3": fsTypeExt3, "btrfs": fsTypeBtrfs,
+	} {
+		if fsType, err := resolveFsType(requested, ""); err != nil || fsType != expected {
+			t.Errorf("resolveFsType(%q) = %q, %v, expected %q", requested, fsType, err, expected)
+		}
+	}
+
+	if fsType, err := resolveFsType("", fsTypeXFS); err != nil || fsType != fsTypeXFS {
+		t.Errorf("expected the fallback filesystem, got %q, %v", fsType, err)
+	}
+
+	if _, err := resolveFsType("zfs", ""); err == nil {
+		t.Error("expected an error for an unsupported filesystem")
+	}
+}
+
+func TestCheckFsType(t *testing.T) {
+	tests := []struct {
+		existing string
+		fsType   string
+		code     codes.Code
+	}{
+		{"", fsTypeExt4, codes.OK},
+		{fsTypeExt4, fsTypeExt4, codes.OK},
+		{fsTypeXFS, fsTypeXFS, codes.OK},
+		{fsTypeExt4, fsTypeXFS, codes.FailedPrecondition},
+		{fsTypeXFS, fsTypeExt4, codes.FailedPrecondition},
+		{fsTypeExt3, fsTypeExt4, codes.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.existing+" as "+tt.fsType, func(t *testing.T) {
+			fe := &fakeExec{}
+			if tt.existing != "" {
+				fe.outputs = map[string]string{"blkid": "TYPE=" + tt.existing}
+			}
+			node := newFakeMountNode(fe)
+
+			if err := node.checkFsType("/dev/vdb", tt.fsType); status.Code(err) != tt.code {
+				t.Errorf("expected %v, got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+func TestCheckFilesystem(t *testing.T) {
+	tests := []struct {
+		name     string
+		fsType   string
+		exitCode int
+		readOnly bool
+		repair   bool
+		cmd      string
+		args     []string
+		code     codes.Code
+	}{
+		{"ext4 clean", fsTypeExt4, 0, false, false, "e2fsck", []string{"-p", "/dev/vdb"}, codes.OK},
+		{"ext4 corrected", fsTypeExt4, 1, false, false, "e2fsck", []string{"-p", "/dev/vdb"}, codes.OK},
+		{"ext4 uncorrected", fsTypeExt4, 4, false, false, "e2fsck", []string{"-p", "/dev/vdb"}, codes.DataLoss},
+		{"ext4 read-only", fsTypeExt4, 0, true, false, "e2fsck", []string{"-n", "/dev/vdb"}, codes.OK},
+		{"ext4 operational error", fsTypeExt4, 8, false, false, "e2fsck", []string{"-p", "/dev/vdb"}, codes.Internal},
+		{"ext4 repair", fsTypeExt4, 1, true, true, "e2fsck", []string{"-f", "-y", "/dev/vdb"}, codes.OK},
+		{"xfs clean", fsTypeXFS, 0, false, false, "xfs_repair", []string{"-n", "/dev/vdb"}, codes.OK},
+		{"xfs corrupt", fsTypeXFS, 1, false, false, "xfs_repair", []string{"-n", "/dev/vdb"}, codes.DataLoss},
+		{"xfs repair", fsTypeXFS, 0, false, true, "xfs_repair", []string{"/dev/vdb"}, codes.OK},
+		{"xfs repair dirty log", fsTypeXFS, 2, false, true, "xfs_repair", []string{"/dev/vdb"}, codes.DataLoss},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fe := &fakeExec{
+				outputs:   map[string]string{"blkid": "TYPE=" + tt.fsType},
+				exitCodes: map[string]int{},
+			}
+			if tt.exitCode != 0 {
+				fe.exitCodes[tt.cmd] = tt.exitCode
+			}
+			node := newFakeMountNode(fe)
+
+			err := node.checkFilesystem(context.Background(), "/dev/vdb", tt.readOnly, tt.repair)
+			if status.Code(err) != tt.code {
+				t.Errorf("expected %v, got %v", tt.code, err)
+			}
+
+			if args := fe.ran(tt.cmd); !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("expected %s %v, got %v", tt.cmd, tt.args, args)
+			}
+		})
+	}
+}
+
+func TestSetReservedBlocks(t *testing.T) {
+	fe := &fakeExec{}
+	node := newFakeMountNode(fe)
+
+	if err := node.setReservedBlocks(context.Background(), "/dev/vdb", fsTypeExt4, "0.5"); err != nil {
+		t.Fatalf("got error, expected no error: %v", err)
+	}
+
+	if args := fe.ran("tune2fs"); !reflect.DeepEqual(args, []string{"-m", "0.5", "/dev/vdb"}) {
+		t.Errorf("expected tune2fs -m 0.5 /dev/vdb, got %v", args)
+	}
+
+	if err := node.setReservedBlocks(context.Background(), "/dev/vdb", fsTypeXFS, "1"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for xfs, got %v", err)
+	}
+}
+
+func TestFormatAndMountXFSIgnoresUUID(t *testing.T) {
+	fe := &fakeExec{outputs: map[string]string{"blkid": "TYPE=" + fsTypeXFS}}
+	node := newFakeMountNode(fe)
+
+	if err := node.formatAndMount(context.Background(), "/dev/vdb", "/staging", fsTypeXFS, []string{"noatime"}, nil); err != nil {
+		t.Fatalf("got error, expected no error: %v", err)
+	}
+
+	mounts, err := node.Driver.mounter.List()
+	if err != nil || len(mounts) != 1 {
+		t.Fatalf("expected one mount, got %v, %v", mounts, err)
+	}
+
+	if !hasOption(mounts[0].Opts, "nouuid") || !hasOption(mounts[0].Opts, "noatime") {
+		t.Errorf("expected xfs to be mounted with nouuid alongside the requested options, got %v", mounts[0].Opts)
+	}
+}
+
+func TestFormatAndMountDeadline(t *testing.T) {
+	for name, mkfsOptions := range map[string][]string{"defaults": nil, "mkfs options": {"-i", "8192"}} {
+		t.Run(name, func(t *testing.T) {
+			fe := &fakeExec{hangs: map[string]bool{"mkfs.ext4": true}}
+			node := newFakeMountNode(fe)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			err := node.formatAndMount(ctx, "/dev/vdb", "/staging", fsTypeExt4, nil, mkfsOptions)
+			if status.Code(err) != codes.DeadlineExceeded {
+				t.Fatalf("expected DeadlineExceeded, got %v", err)
+			}
+			if ctx.Err() != nil {
+				t.Error("expected mkfs killed before the deadline of the RPC")
+			}
+			if args := fe.ran("wipefs"); !reflect.DeepEqual(args, []string{"-a", "/dev/vdb"}) {
+				t.Errorf("expected the partial filesystem wiped, got wipefs %v", args)
+			}
+		})
+	}
+}
+
+func TestResizeDeadline(t *testing.T) {
+	fe := &fakeExec{
+		outputs: map[string]string{
+			"blkid":                  "TYPE=" + fsTypeExt4,
+			"blockdev --getro /":     "0",
+			"blockdev --getsize64 /": "21474836480",
+			"dumpe2fs":               "Block count: 2621440\nBlock size: 4096\n",
+		},
+		hangs: map[string]bool{"resize2fs": true},
+	}
+	node := newFakeMountNode(fe)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// a device which exists on every node
+	err := node.completePendingExpansion(ctx, node.Driver.log, "vol-1", "/", "/staging", nil)
+	if status.Code(err) != codes.DeadlineExceeded || !strings.Contains(err.Error(), "pending") {
+		t.Fatalf("expected DeadlineExceeded leaving the expansion pending, got %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Error("expected xfs_growfs killed before the deadline of the RPC")
+	}
+}
+
+func TestHelperContext(t *testing.T) {
+	hctx, cancel := helperContext(context.Background())
+	defer cancel()
+	if _, ok := hctx.Deadline(); ok {
+		t.Error("expected no deadline without one on the RPC")
+	}
+
+	for timeout, reserve := range map[time.Duration]time.Duration{
+		time.Second:     100 * time.Millisecond,
+		2 * time.Minute: helperCleanupReserve,
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		deadline, _ := ctx.Deadline()
+		hctx, hcancel := helperContext(ctx)
+		if got, _ := hctx.Deadline(); deadline.Sub(got) < reserve-10*time.Millisecond || deadline.Sub(got) > reserve {
+			t.Errorf("expected the helpers of a %v RPC done %v before its deadline, got %v", timeout, reserve, deadline.Sub(got))
+		}
+		hcancel()
+		cancel()
+	}
+}
+
+func TestCheckFilesystemCanceled(t *testing.T) {
+	fe := &fakeExec{outputs: map[string]string{"blkid": "TYPE=" + fsTypeExt4}}
+	node := newFakeMountNode(fe)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := node.checkFilesystem(ctx, "/dev/vdb", false, false); status.Code(err) != codes.Canceled {
+		t.Errorf("expected Canceled once the RPC is abandoned, got %v", err)
+	}
+}
+
+func TestTrimExpanded(t *testing.T) {
+	fe := &fakeExec{}
+	node := newFakeMountNode(fe)
+
+	if err := node.trimExpanded(context.Background(), "/publish", 10*giB); err != nil {
+		t.Fatalf("got error, expected no error: %v", err)
+	}
+
+	if args := fe.ran("fstrim"); !reflect.DeepEqual(args, []string{"-o", "10737418240", "/publish"}) {
+		t.Errorf("expected fstrim from the previous size, got %v", args)
+	}
+
+	fe.exitCodes = map[string]int{"fstrim": 1}
+	if err := node.trimExpanded(context.Background(), "/publish", 10*giB); status.Code(err) != codes.Internal {
+		t.Errorf("expected Internal for a failed fstrim, got %v", err)
+	}
+}
+
+// fakeMounter mounts like the fake mounter of mount-utils and formats devices in memory,
+// failing like SafeFormatAndMount when a device holds another filesystem
+type fakeMounter struct {
+	*mount.FakeMounter
+	// formats are the filesystems on each device
+	formats   map[string]string
+	formatErr error
+	formatted []string
+}
+
+func newFakeMounter(mps []mount.MountPoint) *fakeMounter {
+	return &fakeMounter{FakeMounter: mount.NewFakeMounter(mps), formats: map[string]string{}}
+}
+
+func (m *fakeMounter) FormatAndMountSensitiveWithFormatOptions(source, target, fstype string, options, sensitiveOptions, _ []string) error { //nolint:lll
+	switch existing := m.formats[source]; {
+	case existing == "" && m.formatErr != nil:
+		return mount.NewMountError(mount.FormatFailed, "%v", m.formatErr)
+	case existing == "":
+		m.formats[source] = fstype
+		m.formatted = append(m.formatted, source)
+	case existing != fstype:
+		return mount.NewMountError(mount.FilesystemMismatch, "%s holds %s, not %s", source, existing, fstype)
+	}
+	return m.MountSensitive(source, target, fstype, options, sensitiveOptions)
+}
+
+// fakeResizer reports whether filesystems need resizing and records the ones resized,
+// which then no longer need it unless stuck
+type fakeResizer struct {
+	needResize bool
+	stuck      bool
+	resized    []string
+}
+
+func (r *fakeResizer) NeedResize(string, string) (bool, error) {
+	return r.needResize, nil
+}
+
+func (r *fakeResizer) Resize(devicePath, _ string) (bool, error) {
+	r.resized = append(r.resized, devicePath)
+	r.needResize = r.stuck
+	return true, nil
+}
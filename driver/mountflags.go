@@ -0,0 +1,260 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// fsMountOptions are the mount options specific to a filesystem, by name without their
+// value. An option specific to other filesystems only is refused rather than left to fail
+// the mount on the node, while options unknown to the driver are passed through.
+var fsMountOptions = map[string][]string{
+	fsTypeExt3: extMountOptions,
+	fsTypeExt4: extMountOptions,
+	fsTypeXFS: {
+		"allocsize", "attr2", "noattr2", "dax", "discard", "nodiscard", "filestreams", "grpid", "bsdgroups",
+		"nogrpid", "sysvgroups", "ikeep", "noikeep", "inode32", "inode64", "largeio", "nolargeio", "logbufs",
+		"logbsize", "logdev", "noalign", "norecovery", "nouuid", "noquota", "uquota", "usrquota", "quota",
+		"uqnoenforce", "qnoenforce", "gquota", "grpquota", "gqnoenforce", "pquota", "prjquota", "pqnoenforce",
+		"rtdev", "sunit", "swidth", "swalloc", "wsync",
+	},
+	fsTypeBtrfs: {
+		"acl", "noacl", "autodefrag", "noautodefrag", "barrier", "nobarrier", "check_int", "clear_cache",
+		"commit", "compress", "compress-force", "datacow", "nodatacow", "datasum", "nodatasum", "degraded",
+		"device", "discard", "nodiscard", "enospc_debug", "fatal_errors", "flushoncommit", "noflushoncommit",
+		"fragment", "max_inline", "metadata_ratio", "norecovery", "rescan_uuid_tree", "rescue", "skip_balance",
+		"space_cache", "nospace_cache", "ssd", "ssd_spread", "nossd", "nossd_spread", "subvol", "subvolid",
+		"thread_pool", "treelog", "notreelog", "user_subvol_rm_allowed",
+	},
+	fsTypeVirtiofs: {"dax"},
+}
+
+// mountOptionValues are the values a filesystem specific option takes, for the options
+// whose value is checked before the mount rather than left to fail it on the node
+var mountOptionValues = map[string]map[string][]string{
+	fsTypeVirtiofs: {"dax": {"always", "never", "inode"}},
+}
+
+var extMountOptions = []string{
+	"acl", "noacl", "auto_da_alloc", "noauto_da_alloc", "barrier", "nobarrier", "block_validity",
+	"noblock_validity", "bsddf", "minixdf", "commit", "data", "data_err", "dax", "debug", "delalloc",
+	"nodelalloc", "discard", "nodiscard", "errors", "grpid", "bsdgroups", "nogrpid", "sysvgroups", "grpjquota",
+	"usrjquota", "jqfmt", "i_version", "init_itable", "noinit_itable", "inode_readahead_blks", "journal_async_commit",
+	"journal_checksum", "nojournal_checksum", "journal_dev", "journal_ioprio", "journal_path", "max_batch_time",
+	"min_batch_time", "mb_optimize_scan", "nombcache", "noload", "norecovery", "quota", "noquota", "usrquota",
+	"grpquota", "prjquota", "resgid", "resuid", "sb", "stripe", "user_xattr", "nouser_xattr",
+}
+
+var (
+	// readWriteMountOptions mount a filesystem writable, defeating a read only access mode
+	readWriteMountOptions = map[string]bool{"rw": true}
+
+	// readOnlyAccessModes are the access modes publishing volumes read only
+	readOnlyAccessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY: true,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:  true,
+	}
+)
+
+var (
+	// bindMountOptions are the options of a mount point rather than of its filesystem,
+	// which publish applies to the bind mount of the staged filesystem
+	bindMountOptions = map[string]bool{
+		"bind": true, "ro": true, "rw": true, "nosuid": true, "suid": true, "nodev": true, "dev": true,
+		"noexec": true, "exec": true, "noatime": true, "atime": true, "relatime": true, "norelatime": true,
+		"strictatime": true, "nostrictatime": true, "nodiratime": true, "diratime": true,
+	}
+
+	// stageOnlyMountOptions only make sense for the bind mount of publish
+	stageOnlyMountOptions = map[string]bool{"bind": true, "rbind": true}
+
+	// opposedMountOptions are the flags undoing each other, of which the last one given applies
+	opposedMountOptions = map[string]string{
+		"ro": "rw", "nosuid": "suid", "nodev": "dev", "noexec": "exec", "noatime": "atime",
+		"norelatime": "relatime", "nostrictatime": "strictatime", "nodiratime": "diratime",
+	}
+)
+
+// stageMountOptions returns the options staging mounts the filesystem with, from the mount
+// flags of the capability, and the flags it leaves out
+func stageMountOptions(flags []string) ([]string, []string) {
+	var options, dropped []string
+	for _, flag := range sanitizeMountFlags(flags) {
+		if stageOnlyMountOptions[flag] {
+			dropped = append(dropped, flag)
+			continue
+		}
+		options = append(options, flag)
+	}
+
+	options, opposed := dedupeMountOptions(options)
+	return options, append(dropped, opposed...)
+}
+
+// publishMountOptions returns the options publish bind mounts the staged filesystem with,
+// which are the flags of the mount point as stage applied those of the filesystem, and the
+// flags it leaves out. A read-only publish drops the rw flag.
+func publishMountOptions(flags []string, readOnly bool) ([]string, []string) {
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+
+	var dropped []string
+	for _, flag := range sanitizeMountFlags(flags) {
+		switch {
+		case !bindMountOptions[flag] || hasOption(options, flag):
+			// the filesystem options were applied at stage
+			continue
+		case readOnly && flag == "rw":
+			dropped = append(dropped, flag)
+			continue
+		}
+		options = append(options, flag)
+	}
+
+	options, opposed := dedupeMountOptions(options)
+	return options, append(dropped, opposed...)
+}
+
+// dedupeMountOptions drops the flags which a later opposed flag undoes, returning the
+// options kept and the flags dropped. ro wins over rw whatever their order, so the flags
+// of a volume cannot make a read-only mount writable.
+func dedupeMountOptions(options []string) ([]string, []string) {
+	winners := make(map[string]int)
+	for i, flag := range options {
+		group, ok := mountOptionGroup(flag)
+		if !ok {
+			continue
+		}
+		if j, seen := winners[group]; seen && options[j] == "ro" && flag == "rw" {
+			continue
+		}
+		winners[group] = i
+	}
+
+	var kept, dropped []string
+	for i, flag := range options {
+		if group, ok := mountOptionGroup(flag); ok && winners[group] != i {
+			dropped = append(dropped, flag)
+			continue
+		}
+		kept = append(kept, flag)
+	}
+	return kept, dropped
+}
+
+// mountOptionGroup returns the flag of opposedMountOptions the flag either is or undoes
+func mountOptionGroup(flag string) (string, bool) {
+	if _, ok := opposedMountOptions[flag]; ok {
+		return flag, true
+	}
+	for group, opposite := range opposedMountOptions {
+		if opposite == flag {
+			return group, true
+		}
+	}
+	return "", false
+}
+
+// sanitizeMountFlags splits comma separated flags, trims them and drops empty and
+// repeated ones, so that flags written as a single "noatime,nodiratime" entry are
+// validated and passed to mount like separate ones
+func sanitizeMountFlags(flags []string) []string {
+	var sanitized []string
+	seen := make(map[string]bool)
+
+	for _, flag := range flags {
+		for _, f := range splitMountFlag(flag) {
+			f = strings.TrimSpace(f)
+			if f == "" || seen[f] {
+				continue
+			}
+			seen[f] = true
+			sanitized = append(sanitized, f)
+		}
+	}
+	return sanitized
+}
+
+// splitMountFlag splits a flag on the commas outside double quotes, which the SELinux
+// context flags kubelet adds hold in their categories
+func splitMountFlag(flag string) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i, r := range flag {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			parts = append(parts, flag[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, flag[start:])
+}
+
+// validateMountFlags checks the mount flags of a mount capability against the filesystem
+// the volume is mounted with and its access mode
+func validateMountFlags(capability *csi.VolumeCapability, fsType string) error {
+	flags := sanitizeMountFlags(capability.GetMount().GetMountFlags())
+	mode := capability.GetAccessMode().GetMode()
+
+	if readOnlyAccessModes[mode] {
+		for _, flag := range flags {
+			if name, _, _ := strings.Cut(flag, "="); readWriteMountOptions[name] {
+				return fmt.Errorf("mount flag %q cannot be used with read only access mode %s", flag, mode)
+			}
+		}
+	}
+
+	return validateMountOptions(flags, fsType)
+}
+
+// validateMountOptions checks sanitized mount options against the filesystem they mount,
+// refusing those of other filesystems only and values the filesystem does not take
+func validateMountOptions(flags []string, fsType string) error {
+	for _, flag := range flags {
+		name, value, hasValue := strings.Cut(flag, "=")
+
+		if owners := mountOptionOwners(name); len(owners) > 0 && !hasOption(owners, fsType) {
+			return fmt.Errorf("mount flag %q is not supported by %s, only by %s", flag, fsType, strings.Join(owners, ", "))
+		}
+
+		if values, ok := mountOptionValues[fsType][name]; ok && hasValue && !hasOption(values, value) {
+			return fmt.Errorf("mount flag %q of %s must be one of %s", flag, fsType, strings.Join(values, ", "))
+		}
+	}
+
+	if hasOption(flags, "ro") && hasOption(flags, "rw") {
+		return fmt.Errorf("mount flags ro and rw conflict")
+	}
+
+	return nil
+}
+
+// mountOptionOwners returns the filesystems supporting a filesystem specific mount option
+func mountOptionOwners(name string) []string {
+	var owners []string
+	for _, fsType := range []string{fsTypeExt3, fsTypeExt4, fsTypeXFS, fsTypeBtrfs, fsTypeVirtiofs} {
+		if hasOption(fsMountOptions[fsType], name) {
+			owners = append(owners, fsType)
+		}
+	}
+	return owners
+}
@@ -0,0 +1,115 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestSanitizeMountFlags(t *testing.T) {
+	flags := []string{
+		" noatime,nodiratime ",
+		"",
+		"noatime",
+		`context="system_u:object_r:container_file_t:s0:c0,c1"`,
+		"discard,,",
+	}
+
+	expected := []string{
+		"noatime",
+		"nodiratime",
+		`context="system_u:object_r:container_file_t:s0:c0,c1"`,
+		"discard",
+	}
+	if sanitized := sanitizeMountFlags(flags); !reflect.DeepEqual(sanitized, expected) {
+		t.Errorf("expected %q, got %q", expected, sanitized)
+	}
+}
+
+func TestValidateMountFlags(t *testing.T) {
+	tests := []struct {
+		name   string
+		fsType string
+		mode   csi.VolumeCapability_AccessMode_Mode
+		flags  []string
+		valid  bool
+	}{
+		{"generic", fsTypeExt4, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, []string{"noatime", "nosuid"}, true},
+		{"unknown", fsTypeExt4, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, []string{"x-mount.mkdir"}, true},
+		{"ext4 option", fsTypeExt4, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, []string{"data=journal"}, true},
+		{"xfs option on ext4", fsTypeExt4, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, []string{"nouuid"}, false},
+		{"xfs option", fsTypeXFS, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, []string{"nouuid"}, true},
+		{"btrfs option on xfs", fsTypeXFS, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, []string{"compress=zstd"}, false},
+		{"btrfs compression", fsTypeBtrfs, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, []string{"compress=zstd"}, true},
+		{"shared option", fsTypeBtrfs, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, []string{"discard"}, true},
+		{"block option on vfs", fsTypeVirtiofs, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, []string{"discard"}, false},
+		{"vfs option", fsTypeVirtiofs, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, []string{"dax=always"}, true},
+		{"vfs dax mode", fsTypeVirtiofs, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, []string{"dax=sometimes"}, false},
+		{"ext dax mode", fsTypeExt4, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, []string{"dax=sometimes"}, true},
+		{"rw on read only", fsTypeVirtiofs, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, []string{"rw"}, false},
+		{"ro on read only", fsTypeExt4, csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, []string{"ro"}, true},
+		{"ro and rw", fsTypeExt4, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, []string{"ro,rw"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capability := &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: tt.flags}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: tt.mode},
+			}
+
+			if err := validateMountFlags(capability, tt.fsType); (err == nil) != tt.valid {
+				t.Errorf("expected valid %t, got %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestStageMountOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   []string
+		options []string
+		dropped []string
+	}{
+		{"filesystem and mount point", []string{"noatime", "compress=zstd"}, []string{"noatime", "compress=zstd"}, nil},
+		{"bind", []string{"bind", "discard"}, []string{"discard"}, []string{"bind"}},
+		{"opposed", []string{"noatime,nosuid", "atime"}, []string{"nosuid", "atime"}, []string{"noatime"}},
+		{"rw undone by ro", []string{"ro", "rw"}, []string{"ro"}, []string{"rw"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, dropped := stageMountOptions(tt.flags)
+			if !reflect.DeepEqual(options, tt.options) || !reflect.DeepEqual(dropped, tt.dropped) {
+				t.Errorf("expected %q dropping %q, got %q dropping %q", tt.options, tt.dropped, options, dropped)
+			}
+		})
+	}
+}
+
+func TestPublishMountOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		flags    []string
+		readOnly bool
+		options  []string
+		dropped  []string
+	}{
+		{"none", nil, false, []string{"bind"}, nil},
+		{"filesystem options applied at stage", []string{"data=journal", "noatime", "nosuid"}, false, []string{"bind", "noatime", "nosuid"}, nil},
+		{"read only", []string{"ro"}, true, []string{"bind", "ro"}, nil},
+		{"rw on read only", []string{"rw", "noexec"}, true, []string{"bind", "ro", "noexec"}, []string{"rw"}},
+		{"opposed", []string{"nodev", "dev"}, false, []string{"bind", "dev"}, []string{"nodev"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, dropped := publishMountOptions(tt.flags, tt.readOnly)
+			if !reflect.DeepEqual(options, tt.options) || !reflect.DeepEqual(dropped, tt.dropped) {
+				t.Errorf("expected %q dropping %q, got %q dropping %q", tt.options, tt.dropped, options, dropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var volumeMountGroups = metrics.newCounter("volume_mount_group_changes_total",
+	"Number of volume mount groups applied to staged filesystems, by whether the files had to be changed", "result")
+
+// mountGroupID returns the group ID of the volume mount group of the capability, false
+// when it has none. kubelet passes the fsGroup of the pod once the node advertises
+// VOLUME_MOUNT_GROUP, and leaves the ownership of the files to the driver.
+func (n *VultrNodeServer) mountGroupID(rpc string, capability *csi.VolumeCapability) (int, bool, error) {
+	group := capability.GetMount().GetVolumeMountGroup()
+	if group == "" {
+		return 0, false, nil
+	}
+
+	if !n.Driver.features.enabled(featureVolumeMountGroup) || !n.host.mountGroups() {
+		return 0, false, status.Errorf(codes.InvalidArgument, "%s volume mount groups are not supported on this node", rpc)
+	}
+
+	gid, err := strconv.ParseUint(group, 10, 31)
+	if err != nil {
+		return 0, false, status.Errorf(codes.InvalidArgument, "%s volume mount group %q must be a numeric group ID", rpc, group)
+	}
+	return int(gid), true, nil
+}
+
+// applyMountGroup gives the files of the filesystem mounted at path to the volume mount
+// group of the capability. None of ext4, xfs, btrfs or virtiofs take a gid mount option,
+// so the files are changed, once: a root already owned by the group is left as is, for
+// a volume of millions of files not to be walked on every publish as kubelet would.
+func (n *VultrNodeServer) applyMountGroup(ctx context.Context, rpc, path string, capability *csi.VolumeCapability) error {
+	gid, ok, err := n.mountGroupID(rpc, capability)
+	if err != nil || !ok {
+		return err
+	}
+
+	start := time.Now()
+	changed, err := n.host.setGroupOwnership(ctx, path, gid)
+	if err != nil {
+		volumeMountGroups.add(1, "failed")
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			return status.Errorf(codes.DeadlineExceeded, "%s volume mount group %d not applied to %s in time, it is taken up again on the next call",
+				rpc, gid, path)
+		}
+		return status.Errorf(codes.Internal, "%s cannot apply volume mount group %d to %s: %v", rpc, gid, path, err)
+	}
+
+	if !changed {
+		volumeMountGroups.add(1, "unchanged")
+		return nil
+	}
+	volumeMountGroups.add(1, "changed")
+
+	requestLogger(ctx, n.Driver.log).WithFields(logrus.Fields{
+		"path":     path,
+		"gid":      gid,
+		"duration": time.Since(start).Round(time.Millisecond),
+	}).Info("volume mount group applied")
+	return nil
+}
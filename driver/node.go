@@ -2,41 +2,103 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"golang.org/x/sys/unix"
 	"k8s.io/mount-utils"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/sirupsen/logrus"
+	"github.com/vultr/govultr/v3"
+	"github.com/vultr/vultr-csi/internal/volumes"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 const (
-	diskPath   = "/dev/disk/by-id"
 	diskPrefix = "virtio-"
 
-	mkDirMode = 0750
+	mkDirMode  = 0750
+	mkFileMode = 0640
 
-	maxVolumesPerNode = 11
+	// defaultMaxVolumesPerNode is reported when the instance plan cannot be looked up
+	defaultMaxVolumesPerNode = 11
+
+	defaultFsType = fsTypeExt4
 
 	volumeModeBlock      = "block"
 	volumeModeFilesystem = "filesystem"
 )
 
+// DefaultBlockDiskSlots is the number of virtio disks an instance can have, shared between
+// the local disks of its plan and attached block storage. Vultr does not publish it: it is
+// the limit of 11 block storage volumes the node reported from the first release of the
+// driver, plus the boot disk every plan has. --block-disk-slots overrides it.
+const DefaultBlockDiskSlots = defaultMaxVolumesPerNode + 1
+
 var _ csi.NodeServer = &VultrNodeServer{}
 
 // VultrNodeServer type provides the VultrDriver
 type VultrNodeServer struct {
 	Driver *VultrDriver
+
+	staged *stagedVolumes
+	locks  *volumeLocks
+
+	// rechecks keep looking for the devices staging gave up waiting for
+	rechecks *deviceRechecks
+
+	// quarantine holds the volumes whose filesystem was found corrupt at stage
+	quarantine *volumeQuarantine
+	// kube posts events on the claims of quarantined volumes, nil outside a cluster
+	kube *kubeAPI
+
+	// volumeStats reuses the statistics of volume paths across kubelet polls
+	volumeStats *volumeStatsCache
+
+	// stageSlots bounds concurrent format and mount operations, nil when unlimited
+	stageSlots chan struct{}
+
+	// usageEvents posts events on the claims of volumes filling up, nil when disabled
+	usageEvents *usageWatcher
+
+	// watcher waits for the volumes the node attaches itself
+	watcher *volumeWatcher
+
+	// deadVFS holds the vfs volumes whose virtiofs mount the mount monitor found dead
+	deadVFS *deadVFSMounts
+
+	// host is the operating system of the node
+	host hostOS
 }
 
 // NewVultrNodeDriver provides a VultrNodeServer
 func NewVultrNodeDriver(driver *VultrDriver) *VultrNodeServer {
-	return &VultrNodeServer{Driver: driver}
+	n := &VultrNodeServer{
+		Driver:     driver,
+		staged:     newStagedVolumes(),
+		locks:      newVolumeLocks(),
+		rechecks:   newDeviceRechecks(),
+		quarantine: newVolumeQuarantine(),
+
+		volumeStats: newVolumeStatsCache(driver.volumeStatsCacheTTL),
+		watcher:     newVolumeWatcher(driver.log, driver.tracer),
+		deadVFS:     newDeadVFSMounts(),
+	}
+	n.host = newHostOS(n)
+
+	if driver.maxConcurrentStages > 0 {
+		n.stageSlots = make(chan struct{}, driver.maxConcurrentStages)
+	}
+
+	return n
 }
 
 // NodeStageVolume provides stages the node volume
@@ -48,316 +110,1508 @@ func (n *VultrNodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStag
 	if req.StagingTargetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Staging Target Path must be provided")
 	}
+	if err := n.Driver.checkKubeletPaths("NodeStageVolume", req.StagingTargetPath); err != nil {
+		return nil, err
+	}
 
 	if req.VolumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume Capability must be provided")
 	}
+	if err := n.Driver.strictNodeCapability("NodeStageVolume", req.VolumeCapability, req.VolumeContext); err != nil {
+		return nil, err
+	}
+	if err := n.Driver.checkCapabilityFeatures("NodeStageVolume", req.VolumeCapability); err != nil {
+		return nil, err
+	}
+	if _, _, err := n.mountGroupID("NodeStageVolume", req.VolumeCapability); err != nil {
+		return nil, err
+	}
 
-	n.Driver.log.WithFields(logrus.Fields{
-		"volume":   req.VolumeId,
-		"target":   req.StagingTargetPath,
-		"capacity": req.VolumeCapability,
-	}).Info("Node Stage Volume: called")
+	unlock, err := n.locks.acquire(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	defer n.volumeStats.invalidate(req.StagingTargetPath)
+
+	if err := n.Driver.checkVFSEnabled("NodeStageVolume", req.VolumeId, req.VolumeContext); err != nil {
+		return nil, err
+	}
+
+	if req.VolumeContext[volumeContextStorageType] == storageTypeVFS {
+		attachment, attached, err := vfsPublishInfoFrom(req.GetPublishContext(), n.Driver.mountID)
+		if err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "NodeStageVolume vfs volume %s cannot be mounted: %v", req.VolumeId, err)
+		}
+
+		// without a VolumeAttachment there was no ControllerPublishVolume to attach it
+		if !attached && n.Driver.nodeAttachVFS {
+			if attachment, err = n.attachVFSVolume(ctx, req.VolumeId); err != nil {
+				return nil, err
+			}
+			attached = true
+		}
+
+		if attached {
+			return n.stageVFSVolume(ctx, req, attachment)
+		}
+	}
 
 	volumeID, ok := req.GetPublishContext()[n.Driver.mountID]
+
 	if !ok {
 		return nil, status.Error(codes.InvalidArgument, "Could not find the volume id")
 	}
 
-	source := getDeviceByPath(volumeID)
+	waitCtx, span := n.Driver.tracer.start(ctx, "device_wait", spanKindInternal, spanAttrs{"csi.mount_id": volumeID})
+	source, err := n.waitForDevice(waitCtx, volumeID)
+	span.end(err)
+	if err != nil {
+		return nil, err
+	}
+
+	// everything from here on works on the decrypted device
+	if isEncrypted(req.VolumeContext) {
+		if source, err = n.openEncryptedDevice(ctx, req.VolumeId, source, req.Secrets); err != nil {
+			return nil, err
+		}
+	}
 	target := req.StagingTargetPath
-	mountBlk := req.VolumeCapability.GetMount()
-	options := mountBlk.MountFlags
 
-	fsType := "ext4"
-	if mountBlk.FsType != "" {
-		fsType = mountBlk.FsType
+	// raw block volumes are bind mounted straight from the device at publish
+	if req.VolumeCapability.GetBlock() != nil {
+		if err := n.checkHostCapability("NodeStageVolume", "", true); err != nil {
+			return nil, err
+		}
+		n.staged.stage(req.VolumeId, target, source, "")
+		n.staged.setClaim(req.VolumeId, req.GetPublishContext())
+
+		requestLogger(ctx, n.Driver.log).WithField("device", source).Info("Node Stage Volume: raw block volume staged")
+		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	n.Driver.log.WithFields(logrus.Fields{
-		"volume":   req.VolumeId,
-		"target":   req.StagingTargetPath,
-		"capacity": req.VolumeCapability,
-	}).Infof("Node Stage Volume: creating directory target %s\n", target)
+	// the StorageClass options come first, so that opposed capability flags win
+	mountBlk := req.VolumeCapability.GetMount()
+	options, dropped := stageMountOptions(append([]string{req.VolumeContext[volumeContextMountOptions]}, mountBlk.GetMountFlags()...))
 
-	err := os.MkdirAll(target, mkDirMode)
+	fsType, err := resolveFsType(mountBlk.GetFsType(), n.fallbackFsType(req.VolumeContext))
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume %v", err)
+	}
+	if err := n.checkHostCapability("NodeStageVolume", fsType, false); err != nil {
+		return nil, err
 	}
 
-	n.Driver.log.WithFields(logrus.Fields{
-		"volume":   req.VolumeId,
-		"target":   req.StagingTargetPath,
-		"capacity": req.VolumeCapability,
-	}).Infof("Node Stage Volume: directory created for target %s\n", target)
+	wipe := req.VolumeContext[volumeContextWipePartitions] == "true"
+	if err := n.checkPartitions(ctx, source, hasOption(options, "ro"), wipe); err != nil {
+		return nil, err
+	}
+	if err := n.checkFsType(source, fsType); err != nil {
+		return nil, err
+	}
 
-	n.Driver.log.WithFields(logrus.Fields{
-		"volume":   req.VolumeId,
+	log := requestLogger(ctx, n.Driver.log).WithFields(logrus.Fields{
 		"target":   req.StagingTargetPath,
 		"capacity": req.VolumeCapability,
-	}).Info("Node Stage Volume: attempting format and mount")
+	})
+	if len(dropped) > 0 {
+		log.WithField("dropped", dropped).Info("Node Stage Volume: mount flags left out of the staging mount")
+	}
+	log.Infof("Node Stage Volume: creating directory target %s", target)
 
-	if err := n.Driver.mounter.FormatAndMount(source, target, fsType, options); err != nil {
+	if err := n.makeTargetDir(target); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	if _, err := os.Stat(source); err == nil {
-		needResize, err := n.Driver.resizer.NeedResize(source, target)
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "could not determine if volume %q needs to be resized: %v", req.VolumeId, err)
+	log.Infof("Node Stage Volume: directory created for target %s", target)
+
+	staged, err := n.isStaged(target, source)
+	if err != nil {
+		return nil, err
+	}
+
+	// a retried stage which already mounted the device carries on with the steps after the mount
+	if staged {
+		log.Info("Node Stage Volume: device already mounted at the staging path")
+	} else if err := n.stageFilesystem(ctx, req, source, fsType, options); err != nil {
+		return nil, err
+	}
+
+	if reserved := req.VolumeContext[volumeContextReserved]; reserved != "" && !hasOption(options, "ro") {
+		if err := n.setReservedBlocks(ctx, source, fsType, reserved); err != nil {
+			return nil, err
 		}
+	}
 
-		if needResize {
-			n.Driver.log.WithFields(logrus.Fields{
-				"volume":   req.VolumeId,
-				"target":   req.StagingTargetPath,
-				"capacity": req.VolumeCapability,
-			}).Info("Node Stage Volume: resizing volume")
+	if err := n.completePendingExpansion(ctx, log, req.VolumeId, source, target, options); err != nil {
+		return nil, err
+	}
 
-			if _, err := n.Driver.resizer.Resize(source, target); err != nil {
-				return nil, status.Errorf(codes.Internal, "could not resize volume %q:  %v", req.VolumeId, err)
+	// the files are given to the group while the filesystem is still writable
+	if !hasOption(options, "ro") && !stagesReadOnly(req.VolumeCapability, req.VolumeContext) {
+		if err := n.applyMountGroup(ctx, "NodeStageVolume", target, req.VolumeCapability); err != nil {
+			return nil, err
+		}
+	}
+	n.staged.stage(req.VolumeId, target, source, fsType)
+	n.staged.setClaim(req.VolumeId, req.GetPublishContext())
+
+	// reader only volumes are mounted writable above for their filesystem to be formatted,
+	// checked and grown, and read-only from then on
+	if stagesReadOnly(req.VolumeCapability, req.VolumeContext) {
+		if !hasOption(options, "ro") {
+			if err := n.remountStaging(ctx, req.VolumeId, target, true); err != nil {
+				return nil, err
 			}
 		}
+		n.staged.pin(req.VolumeId)
 	}
-	n.Driver.log.Info("Node Stage Volume: volume staged")
+
+	log.Info("Node Stage Volume: volume staged")
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-// NodeUnstageVolume provides the node volume unstage functionality
-func (n *VultrNodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) { //nolint:dupl,lll
-	if req.VolumeId == "" {
-		return nil, status.Error(codes.InvalidArgument, "VolumeID must be provided")
+// completePendingExpansion grows the staged filesystem to its device, which grew while it
+// was not staged, as when the volume was expanded while detached. ControllerExpandVolume
+// then asks for a node expansion which kubelet only calls once the volume is staged
+// again, so the stage is what grows the filesystem first. A filesystem staged with the ro
+// mount option cannot be grown and stays pending for NodeExpandVolume.
+func (n *VultrNodeServer) completePendingExpansion(ctx context.Context, log *logrus.Entry, volumeID, source, target string, options []string) error { //nolint:lll
+	if _, err := os.Stat(source); err != nil {
+		return nil
 	}
 
-	if req.StagingTargetPath == "" {
-		return nil, status.Error(codes.InvalidArgument, "Staging Target Path must be provided")
+	needResize, err := n.Driver.resizer.NeedResize(source, target)
+	if err != nil {
+		return status.Errorf(codes.Internal, "could not determine if volume %q needs to be resized: %v", volumeID, err)
+	}
+	if !needResize {
+		return nil
 	}
 
-	n.Driver.log.WithFields(logrus.Fields{
-		"volume-id":           req.VolumeId,
-		"staging-target-path": req.StagingTargetPath,
-	}).Info("Node Unstage Volume: called")
-
-	err := n.Driver.mounter.Unmount(req.StagingTargetPath)
-	if err != nil {
-		return nil, err
+	if hasOption(options, "ro") {
+		log.Warn("Node Stage Volume: filesystem smaller than its device, not grown as it is mounted read-only")
+		return nil
 	}
 
-	n.Driver.log.Info("Node Unstage Volume: volume unstaged")
-	return &csi.NodeUnstageVolumeResponse{}, nil
-}
+	hctx, cancel := helperContext(ctx)
+	defer cancel()
 
-// NodePublishVolume allows the volume publish
-func (n *VultrNodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) { //nolint:lll
-	if req.VolumeId == "" {
-		return nil, status.Error(codes.InvalidArgument, "VolumeID must be provided")
+	log.Info("Node Stage Volume: completing pending filesystem expansion")
+	resizer := n.boundResizer(hctx)
+	if _, err := resizer.Resize(source, target); err != nil {
+		if hctx.Err() != nil {
+			return resizeDeadlineError(volumeID, err)
+		}
+		return status.Errorf(codes.Internal, "could not resize volume %q:  %v", volumeID, err)
 	}
 
-	if req.StagingTargetPath == "" {
-		return nil, status.Error(codes.InvalidArgument, "Staging Target Path must be provided")
+	// a filesystem still smaller than its device was not grown, whatever the tool returned
+	if grow, err := resizer.NeedResize(source, target); err != nil {
+		return status.Errorf(codes.Internal, "cannot check the size of the filesystem on %s: %v", source, err)
+	} else if grow {
+		return status.Errorf(codes.Internal, "the filesystem on %s did not grow to the size of the device", source)
 	}
 
-	if req.TargetPath == "" {
-		return nil, status.Error(codes.InvalidArgument, "Target Path must be provided")
+	fields := logrus.Fields{}
+	if size, err := n.expandedDeviceBytes(ctx, source, nil); err == nil {
+		fields["device_bytes"] = size
+	}
+	if usage, err := n.host.statfs(target); err == nil {
+		fields["filesystem_bytes"] = usage.TotalBytes
 	}
+	log.WithFields(fields).Info("Node Stage Volume: filesystem expanded to its device")
+	return nil
+}
 
-	log := n.Driver.log.WithFields(logrus.Fields{
-		"volume_id":           req.VolumeId,
-		"staging_target_path": req.StagingTargetPath,
-		"target_path":         req.TargetPath,
-	})
-	log.Info("Node Publish Volume: called")
+// resizeDeadlineError is the error of a resize killed by the deadline of its RPC. The
+// resize tools grow the filesystem in steps each left consistent, so the filesystem is
+// only left short of its device, to be grown by the next NodeExpandVolume or stage.
+func resizeDeadlineError(volumeID string, err error) error {
+	return status.Errorf(codes.DeadlineExceeded,
+		"resizing the filesystem of volume %q did not finish before the deadline, it stays pending for the next expansion: %v", volumeID, err)
+}
 
-	options := []string{"bind"}
-	if req.Readonly {
-		options = append(options, "ro")
+// stageFilesystem checks the filesystem on source, formatting it when there is none,
+// and mounts it at the staging path
+func (n *VultrNodeServer) stageFilesystem(ctx context.Context, req *csi.NodeStageVolumeRequest, source, fsType string, options []string) error { //nolint:lll
+	release, err := n.acquireStageSlot(ctx)
+	if err != nil {
+		return err
 	}
+	defer release()
 
-	mnt := req.VolumeCapability.GetMount()
-	options = append(options, mnt.MountFlags...)
+	requestLogger(ctx, n.Driver.log).WithField("target", req.StagingTargetPath).Info("Node Stage Volume: attempting format and mount")
 
-	fsType := "ext4"
-	if mnt.FsType != "" {
-		fsType = mnt.FsType
+	if err := n.checkStagedFilesystem(ctx, req.VolumeId, source, hasOption(options, "ro"), req.VolumeContext); err != nil {
+		return err
 	}
 
-	err := os.MkdirAll(req.TargetPath, mkDirMode)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	mkfsOptions := strings.Fields(req.VolumeContext[volumeContextMkfsOptions])
+	// an unformatted ext volume is formatted with its reserve, which tune2fs applies to formatted ones
+	if reserved := req.VolumeContext[volumeContextReserved]; reserved != "" && isExtFs(fsType) && !hasOption(mkfsOptions, "-m") {
+		mkfsOptions = append(mkfsOptions, "-m", reserved)
 	}
+	return n.Driver.tracer.trace(ctx, "format_and_mount", spanAttrs{"device": source, "fs_type": fsType}, func(ctx context.Context) error {
+		return n.formatAndMount(ctx, source, req.StagingTargetPath, fsType, options, mkfsOptions)
+	})
+}
 
-	err = n.Driver.mounter.Mount(req.StagingTargetPath, req.TargetPath, fsType, options)
+// isStaged reports whether target is already mounted from source, as when kubelet retries
+// a stage which mounted the device. A target mounted from another device fails with
+// AlreadyExists rather than having the device mounted over it.
+func (n *VultrNodeServer) isStaged(target, source string) (bool, error) {
+	device, _, err := mount.GetDeviceNameFromMount(n.Driver.mounter, target)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return false, status.Errorf(codes.Internal, "cannot check staging path %s: %v", target, err)
+	}
+	if device == "" {
+		return false, nil
 	}
 
-	n.Driver.log.Info("Node Publish Volume: published")
-	return &csi.NodePublishVolumeResponse{}, nil
+	// the device is linked by id while the mount table names the device itself
+	resolved, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		resolved = source
+	}
+	if device == source || device == resolved {
+		return true, nil
+	}
+	return false, status.Errorf(codes.AlreadyExists, "NodeStageVolume staging path %s is already mounted from %s, not %s",
+		target, device, source)
 }
 
-// NodeUnpublishVolume allows the volume to be unpublished
-func (n *VultrNodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) { //nolint:dupl,lll
-	if req.VolumeId == "" {
-		return nil, status.Error(codes.InvalidArgument, "VolumeID must be provided")
+// mountedWith reports whether the topmost mount at path has option. The mount table shows
+// the options of the staged filesystem on its bind mounts too.
+func (n *VultrNodeServer) mountedWith(path, option string) bool {
+	mountPoints, err := n.Driver.mounter.List()
+	if err != nil {
+		return false
 	}
 
-	if req.TargetPath == "" {
-		return nil, status.Error(codes.InvalidArgument, "Target Path must be provided")
+	found := false
+	for _, mp := range mountPoints {
+		if mp.Path == path {
+			found = hasOption(mp.Opts, option)
+		}
 	}
+	return found
+}
 
-	n.Driver.log.WithFields(logrus.Fields{
-		"volume-id":   req.VolumeId,
-		"target-path": req.TargetPath,
-	}).Info("Node Unpublish Volume: called")
-
-	err := n.Driver.mounter.Unmount(req.TargetPath)
+// mountType returns the filesystem type of the topmost mount at path, empty when nothing
+// is mounted there
+func (n *VultrNodeServer) mountType(path string) string {
+	mountPoints, err := n.Driver.mounter.List()
 	if err != nil {
-		return nil, err
+		return ""
 	}
 
-	n.Driver.log.Info("Node Publish Volume: unpublished")
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+	fsType := ""
+	for _, mp := range mountPoints {
+		if mp.Path == path {
+			fsType = mp.Type
+		}
+	}
+	return fsType
 }
 
-// NodeGetVolumeStats provides the volume stats
-func (n *VultrNodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) { //nolint:lll
-	if req.VolumeId == "" {
-		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats Volume ID must be provided")
+// stageVFSVolume mounts a VFS volume at the staging path over virtiofs, using the
+// mount tag of the node's attachment, with the vfs_mount_options of its StorageClass and
+// the mount flags of the capability
+func (n *VultrNodeServer) stageVFSVolume(ctx context.Context, req *csi.NodeStageVolumeRequest, attachment vfsPublishInfo) (*csi.NodeStageVolumeResponse, error) { //nolint:lll
+	target := req.StagingTargetPath
+	mountTag := attachment.MountTag
+
+	if err := n.makeTargetDir(target); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	volumePath := req.VolumePath
-	if volumePath == "" {
-		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats Volume Path must be provided")
+	notMnt, err := n.Driver.mounter.IsLikelyNotMountPoint(target)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot check staging path %s: %v", target, err)
 	}
 
-	log := n.Driver.log.WithFields(logrus.Fields{
-		"volume_id":   req.VolumeId,
-		"volume_path": req.VolumePath,
-		"method":      "node_get_volume_stats",
-	})
-	log.Info("node get volume stats called")
+	// the StorageClass options come first, so that opposed capability flags win
+	flags := append([]string{req.VolumeContext[volumeContextVFSMountOptions]}, req.VolumeCapability.GetMount().GetMountFlags()...)
+	options, _ := stageMountOptions(flags)
+
+	if notMnt {
+		if err := n.Driver.mounter.Mount(mountTag, target, fsTypeVirtiofs, options); err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot mount vfs volume %s with tag %s at %s: %v", req.VolumeId, mountTag, target, err)
+		}
+	}
+
+	n.staged.stage(req.VolumeId, target, mountTag, fsTypeVirtiofs)
+	n.staged.setMountOptions(req.VolumeId, options)
+
+	requestLogger(ctx, n.Driver.log).WithField("mount_tag", mountTag).Info("Node Stage Volume: vfs volume staged")
+	return &csi.NodeStageVolumeResponse{}, nil
+}
 
-	statfs := &unix.Statfs_t{}
-	err := unix.Statfs(volumePath, statfs)
+// attachVFSVolume attaches the VFS volume to this node, returning the attachment
+func (n *VultrNodeServer) attachVFSVolume(ctx context.Context, volumeID string) (vfsPublishInfo, error) {
+	backend := newVFSBackend(n.Driver)
+	nodeID := n.Driver.nodeID
+
+	vol, err := backend.Get(ctx, volumeID)
 	if err != nil {
-		return nil, err
+		if errors.Is(err, errVolumeNotFound) {
+			return vfsPublishInfo{}, status.Errorf(codes.NotFound, "vfs volume %s does not exist: %v", volumeID, err)
+		}
+		return vfsPublishInfo{}, status.Errorf(codes.Internal, "cannot get vfs volume %s: %v", volumeID, err)
 	}
 
-	availableBytes := int64(statfs.Bavail) * int64(statfs.Bsize)                    //nolint:unconvert // 32bit builds fail otherwise
-	usedBytes := (int64(statfs.Blocks) - int64(statfs.Bfree)) * int64(statfs.Bsize) //nolint:unconvert // 32bit builds fail otherwise
-	totalBytes := int64(statfs.Blocks) * int64(statfs.Bsize)                        //nolint:unconvert // 32bit builds fail otherwise
-	totalInodes := int64(statfs.Files)
-	availableInodes := int64(statfs.Ffree)
-	usedInodes := totalInodes - availableInodes
+	if attachment, ok := vfsAttachmentOf(backend, vol, nodeID); ok {
+		return attachment, nil
+	}
 
-	log.WithFields(logrus.Fields{
-		"volume_mode":      volumeModeFilesystem,
-		"bytes_available":  availableBytes,
-		"bytes_total":      totalBytes,
-		"bytes_used":       usedBytes,
-		"inodes_available": availableInodes,
-		"inodes_total":     totalInodes,
-		"inodes_used":      usedInodes,
-	}).Info("node capacity statistics retrieved")
+	if err := backend.Attach(ctx, volumeID, nodeID); err != nil && !errors.Is(err, errAlreadyAttached) {
+		return vfsPublishInfo{}, status.Errorf(codes.Internal, "cannot attach vfs volume %s to node: %v", volumeID, err)
+	}
 
-	return &csi.NodeGetVolumeStatsResponse{
-		Usage: []*csi.VolumeUsage{
-			{
-				Available: availableBytes,
-				Total:     totalBytes,
-				Used:      usedBytes,
-				Unit:      csi.VolumeUsage_BYTES,
-			},
-			{
-				Available: availableInodes,
-				Total:     totalInodes,
-				Used:      usedInodes,
-				Unit:      csi.VolumeUsage_INODES,
-			},
-		},
-	}, nil
+	var attachment vfsPublishInfo
+	if err := n.watcher.wait(ctx, backend, volumeID, loopAttach, n.Driver.attachTimeout, func(vol *backendVolume) bool {
+		var ok bool
+		attachment, ok = vfsAttachmentOf(backend, vol, nodeID)
+		return ok
+	}); err != nil {
+		return vfsPublishInfo{}, status.Errorf(codes.Internal, "vfs volume %s is not attached to node: %v", volumeID, err)
+	}
+
+	requestLogger(ctx, n.Driver.log).WithField("mount_tag", attachment.MountTag).Info("Node Stage Volume: vfs volume attached by the node")
+	return attachment, nil
 }
 
-// NodeExpandVolume provides the node volume expansion
-func (n *VultrNodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	log := n.Driver.log.WithFields(logrus.Fields{
-		"volume_id":   req.VolumeId,
-		"volume_path": req.VolumePath,
-		"method":      "NodeExpandVolume",
-	})
+// vfsAttachmentOf returns the attachment of the VFS volume to the node once it can be mounted
+func vfsAttachmentOf(backend *vfsBackend, vol *backendVolume, nodeID string) (vfsPublishInfo, bool) {
+	attachment, ok, err := vfsPublishInfoFrom(backend.PublishContext(vol, nodeID), "")
+	return attachment, ok && err == nil
+}
 
-	n.Driver.log.WithFields(logrus.Fields{
-		"required_bytes": req.CapacityRange.RequiredBytes,
-	}).Info("Node Expand Volume: called")
+// detachVFSVolume detaches the volume from this node if it is a VFS volume attached to it,
+// which only the node does when there is no ControllerUnpublishVolume to do it
+func (n *VultrNodeServer) detachVFSVolume(ctx context.Context, volumeID string) error {
+	backend := newVFSBackend(n.Driver)
+	nodeID := n.Driver.nodeID
 
-	devicePath, _, err := mount.GetDeviceNameFromMount(mount.New(""), req.VolumePath)
+	vol, err := backend.Get(ctx, volumeID)
 	if err != nil {
-		log.Infof("failed to determine mount path for %s: %s", req.VolumePath, err)
-		return nil, fmt.Errorf("failed to determine mount path for %s: %s", req.VolumePath, err)
+		// block volumes are not found as vfs volumes
+		if errors.Is(err, errVolumeNotFound) {
+			return nil
+		}
+		return status.Errorf(codes.Internal, "cannot get vfs volume %s: %v", volumeID, err)
 	}
 
-	log.Infof("attempting to resize devicepath: %s", devicePath)
+	if !vol.isAttachedTo(nodeID) {
+		return nil
+	}
 
-	if _, err := n.Driver.resizer.Resize(devicePath, req.VolumePath); err != nil {
-		log.Infof("failed to resize volume: %s", err)
-		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to resize volume: %s", err))
+	if err := backend.Detach(ctx, volumeID, nodeID); err != nil && !errors.Is(err, errNotAttached) {
+		return status.Errorf(codes.Internal, "cannot detach vfs volume %s from node: %v", volumeID, err)
 	}
 
-	return &csi.NodeExpandVolumeResponse{
-		CapacityBytes: req.CapacityRange.RequiredBytes,
-	}, nil
+	requestLogger(ctx, n.Driver.log).Info("Node Unstage Volume: vfs volume detached by the node")
+	return nil
 }
 
-// NodeGetCapabilities provides the node capabilities
-func (n *VultrNodeServer) NodeGetCapabilities(context.Context, *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	nodeCapabilities := []*csi.NodeServiceCapability{
-		{
-			Type: &csi.NodeServiceCapability_Rpc{
-				Rpc: &csi.NodeServiceCapability_RPC{
-					Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
-				},
-			},
-		},
-		{
-			Type: &csi.NodeServiceCapability_Rpc{
-				Rpc: &csi.NodeServiceCapability_RPC{
-					Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
-				},
-			},
-		},
-		{
-			Type: &csi.NodeServiceCapability_Rpc{
-				Rpc: &csi.NodeServiceCapability_RPC{
-					Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
-				},
-			},
-		},
+// NodeUnstageVolume provides the node volume unstage functionality
+func (n *VultrNodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) { //nolint:dupl,lll
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "VolumeID must be provided")
+	}
+
+	if req.StagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging Target Path must be provided")
+	}
+	if err := n.Driver.checkKubeletPaths("NodeUnstageVolume", req.StagingTargetPath); err != nil {
+		return nil, err
 	}
 
-	n.Driver.log.WithFields(logrus.Fields{
-		"capabilities": nodeCapabilities,
-	}).Info("Node Get Capabilities: called")
+	unlock, err := n.locks.acquire(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	defer n.volumeStats.invalidate(req.StagingTargetPath)
 
-	return &csi.NodeGetCapabilitiesResponse{
-		Capabilities: nodeCapabilities,
-	}, nil
-}
+	if err := n.releaseStagingReferences(ctx, req.StagingTargetPath); err != nil {
+		return nil, err
+	}
 
-// NodeGetInfo provides the node info
-func (n *VultrNodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	n.Driver.log.WithFields(logrus.Fields{}).Info("Node Get Info: called")
+	// raw block volumes have nothing mounted at the staging path
+	if err := mount.CleanupMountPoint(req.StagingTargetPath, n.Driver.mounter, true); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot unmount staging path %s: %v", req.StagingTargetPath, err)
+	}
 
-	return &csi.NodeGetInfoResponse{
-		NodeId:            n.Driver.nodeID,
-		MaxVolumesPerNode: maxVolumesPerNode,
-		AccessibleTopology: &csi.Topology{
-			Segments: map[string]string{
-				"region": n.Driver.region,
-			},
-		},
-	}, nil
+	n.staged.unstage(req.VolumeId)
+	n.deadVFS.clear(req.VolumeId)
+
+	if err := n.closeEncryptedDevice(ctx, req.VolumeId); err != nil {
+		return nil, err
+	}
+
+	if n.Driver.nodeAttachVFS {
+		if err := n.detachVFSVolume(ctx, req.VolumeId); err != nil {
+			return nil, err
+		}
+	}
+
+	requestLogger(ctx, n.Driver.log).Info("Node Unstage Volume: volume unstaged")
+	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-func getDeviceByPath(volumeID string) string {
-	return filepath.Join(diskPath, fmt.Sprintf("%s%s", diskPrefix, volumeID))
+// NodePublishVolume allows the volume publish
+func (n *VultrNodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) { //nolint:lll
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "VolumeID must be provided")
+	}
+
+	// kubelet does not stage the volumes pods declare inline
+	if req.StagingTargetPath == "" && !isEphemeral(req.VolumeContext) {
+		return nil, status.Error(codes.InvalidArgument, "Staging Target Path must be provided")
+	}
+
+	if req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target Path must be provided")
+	}
+	if err := n.Driver.checkKubeletPaths("NodePublishVolume", req.TargetPath, req.StagingTargetPath); err != nil {
+		return nil, err
+	}
+
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume Capability must be provided")
+	}
+	if err := n.Driver.strictNodeCapability("NodePublishVolume", req.VolumeCapability, req.VolumeContext); err != nil {
+		return nil, err
+	}
+	if err := n.Driver.checkCapabilityFeatures("NodePublishVolume", req.VolumeCapability); err != nil {
+		return nil, err
+	}
+	if _, _, err := n.mountGroupID("NodePublishVolume", req.VolumeCapability); err != nil {
+		return nil, err
+	}
+
+	if isEphemeral(req.VolumeContext) {
+		return n.publishEphemeralVolume(ctx, req)
+	}
+
+	unlock, err := n.locks.acquire(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	defer n.volumeStats.invalidate(req.TargetPath)
+
+	// reader only volumes are mounted read only whatever the pod asks for
+	readOnly := req.Readonly || readOnlyAccessModes[req.VolumeCapability.GetAccessMode().GetMode()]
+
+	// the filesystem got its options at stage, so only those of the mount point apply to the bind mount
+	options, dropped := publishMountOptions(req.VolumeCapability.GetMount().GetMountFlags(), readOnly)
+
+	if req.VolumeCapability.GetBlock() != nil {
+		return n.publishBlockVolume(ctx, req, options)
+	}
+
+	if len(dropped) > 0 {
+		requestLogger(ctx, n.Driver.log).WithField("dropped", dropped).Info("Node Publish Volume: mount flags left out of the bind mount")
+	}
+
+	// a writable target needs the staged filesystem writable, which a read-only one
+	// does not tell apart in the mount table once the filesystem is read-only
+	if !readOnly {
+		if err := n.makeStagingWritable(ctx, req); err != nil {
+			return nil, err
+		}
+		// kubelet leaves the group of read-only publishes alone too. A vfs volume, whose
+		// stage is only a mount, or one published for another group gets it here.
+		if err := n.applyMountGroup(ctx, "NodePublishVolume", req.StagingTargetPath, req.VolumeCapability); err != nil {
+			return nil, err
+		}
+	}
+
+	published, err := n.isPublished(req.TargetPath, req.StagingTargetPath, readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	if published {
+		n.staged.publish(req.VolumeId, req.TargetPath, readOnly)
+		if err := n.syncStagingReadOnly(ctx, req.VolumeId); err != nil {
+			return nil, err
+		}
+
+		requestLogger(ctx, n.Driver.log).Info("Node Publish Volume: already published")
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	if err := n.makeTargetDir(req.TargetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	err = n.Driver.mounter.Mount(req.StagingTargetPath, req.TargetPath, "", options)
+	if err != nil {
+		if err := n.publishMountError(req.TargetPath, req.StagingTargetPath, readOnly, err); err != nil {
+			return nil, err
+		}
+		n.staged.publish(req.VolumeId, req.TargetPath, readOnly)
+		if err := n.syncStagingReadOnly(ctx, req.VolumeId); err != nil {
+			return nil, err
+		}
+
+		requestLogger(ctx, n.Driver.log).Info("Node Publish Volume: already published")
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	if readOnly {
+		if err := n.ensureReadOnly(req.TargetPath); err != nil {
+			return nil, err
+		}
+	}
+
+	n.staged.publish(req.VolumeId, req.TargetPath, readOnly)
+	if err := n.syncStagingReadOnly(ctx, req.VolumeId); err != nil {
+		return nil, err
+	}
+
+	requestLogger(ctx, n.Driver.log).Info("Node Publish Volume: published")
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// publishBlockVolume bind mounts the raw device onto a file at the target path
+func (n *VultrNodeServer) publishBlockVolume(ctx context.Context, req *csi.NodePublishVolumeRequest, options []string) (*csi.NodePublishVolumeResponse, error) { //nolint:lll
+	mountID, ok := req.GetPublishContext()[n.Driver.mountID]
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "Could not find the volume id")
+	}
+
+	// the device staging found, which is not linked by id when udev never caught up
+	source := getDeviceByPath(mountID)
+	if staged, ok := n.staged.get(req.VolumeId); ok && staged.Device != "" {
+		source = staged.Device
+	}
+
+	if _, err := os.Stat(source); err != nil {
+		return nil, status.Errorf(codes.NotFound, "device %s for volume %s is not accessible: %v", source, req.VolumeId, err)
+	}
+	log := requestLogger(ctx, n.Driver.log).WithFields(logrus.Fields{
+		"device":      source,
+		"target_path": req.TargetPath,
+	})
+
+	published, err := n.isPublished(req.TargetPath, source, req.Readonly)
+	if err != nil {
+		return nil, err
+	}
+
+	if published {
+		n.staged.publish(req.VolumeId, req.TargetPath, req.Readonly)
+
+		log.Info("Node Publish Volume: raw block volume already published")
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	if err := n.makeTargetDir(filepath.Dir(req.TargetPath)); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	file, err := os.OpenFile(req.TargetPath, os.O_CREATE, mkFileMode)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot create block device target %s: %v", req.TargetPath, err)
+	}
+	if err := file.Close(); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot create block device target %s: %v", req.TargetPath, err)
+	}
+
+	if err := n.Driver.mounter.Mount(source, req.TargetPath, "", options); err != nil {
+		if err := n.publishMountError(req.TargetPath, source, req.Readonly, err); err != nil {
+			return nil, err
+		}
+		n.staged.publish(req.VolumeId, req.TargetPath, req.Readonly)
+
+		log.Info("Node Publish Volume: raw block volume already published")
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	if req.Readonly {
+		if err := n.ensureReadOnly(req.TargetPath); err != nil {
+			return nil, err
+		}
+	}
+
+	n.staged.publish(req.VolumeId, req.TargetPath, req.Readonly)
+
+	log.Info("Node Publish Volume: raw block volume published")
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// NodeUnpublishVolume allows the volume to be unpublished
+func (n *VultrNodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) { //nolint:dupl,lll
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "VolumeID must be provided")
+	}
+
+	if req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target Path must be provided")
+	}
+	if err := n.Driver.checkKubeletPaths("NodeUnpublishVolume", req.TargetPath); err != nil {
+		return nil, err
+	}
+
+	if isEphemeralTarget(req.TargetPath) {
+		return n.unpublishEphemeralVolume(ctx, req)
+	}
+
+	return n.unpublishVolume(ctx, req)
+}
+
+// unpublishVolume unmounts the target path of the volume
+func (n *VultrNodeServer) unpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) { //nolint:lll
+	unlock, err := n.locks.acquire(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	defer n.volumeStats.invalidate(req.TargetPath)
+
+	// removes the target directory, or the device file of a raw block volume
+	if err := mount.CleanupMountPoint(req.TargetPath, n.Driver.mounter, true); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot unmount target path %s: %v", req.TargetPath, err)
+	}
+
+	n.staged.unpublish(req.VolumeId, req.TargetPath)
+
+	// the target is gone already, so a filesystem left writable is only retried at the next publish
+	if err := n.syncStagingReadOnly(ctx, req.VolumeId); err != nil {
+		requestLogger(ctx, n.Driver.log).Warnf("Node Unpublish Volume: %v", err)
+	}
+
+	requestLogger(ctx, n.Driver.log).Info("Node Publish Volume: unpublished")
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// NodeGetVolumeStats provides the volume stats
+func (n *VultrNodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) { //nolint:lll
+	res, err := n.volumeStatsOf(ctx, req)
+	// kubelet is told of no condition with the VolumeCondition feature disabled
+	if res != nil && !n.Driver.features.enabled(featureVolumeCondition) {
+		res.VolumeCondition = nil
+	}
+	return res, err
+}
+
+// volumeStatsOf measures the volume at the volume path and reports its condition
+func (n *VultrNodeServer) volumeStatsOf(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) { //nolint:lll
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats Volume ID must be provided")
+	}
+
+	volumePath := req.VolumePath
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats Volume Path must be provided")
+	}
+	if err := n.Driver.checkKubeletPaths("NodeGetVolumeStats", volumePath, req.StagingTargetPath); err != nil {
+		return nil, err
+	}
+
+	log := requestLogger(ctx, n.Driver.log).WithFields(logrus.Fields{
+		"volume_path": req.VolumePath,
+		"method":      "node_get_volume_stats",
+	})
+
+	// the spec wants a volume missing from the path to be not found rather than abnormal
+	if n.Driver.strictSpec {
+		if _, err := os.Stat(volumePath); os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "NodeGetVolumeStats volume path %s does not exist", volumePath)
+		}
+	}
+
+	// a dead mount is reported without being touched again, as stat and statfs on it can hang
+	if err := n.volumeStats.deadMount(volumePath); err != nil {
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: deadMountCondition(volumePath, err)}, nil
+	}
+
+	// an unhealthy volume is reported through its condition, so kubelet surfaces it as an event
+	if condition := n.abnormalCondition(req.VolumeId, volumePath); condition != nil {
+		log.WithField("condition", condition.Message).Warn("volume is abnormal")
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+	}
+
+	stats, err := n.volumeStats.get(ctx, volumePath, func() (*volumeStats, error) { return n.measureVolume(volumePath) })
+	switch {
+	case err != nil && ctx.Err() != nil:
+		return nil, status.Errorf(codes.DeadlineExceeded, "NodeGetVolumeStats volume path %s: %v", volumePath, ctx.Err())
+	case isDeadMount(err):
+		log.WithError(err).Warn("volume mount is dead")
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: deadMountCondition(volumePath, err)}, nil
+	case err != nil:
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  err.Error(),
+			},
+		}, nil
+	}
+
+	// the spec leaves the used and available bytes of a raw block volume out
+	if stats.isBlock {
+		log.WithFields(logrus.Fields{
+			"volume_mode": volumeModeBlock,
+			"bytes_total": stats.blockBytes,
+		}).Info("node capacity statistics retrieved")
+
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{
+					Total: stats.blockBytes,
+					Unit:  csi.VolumeUsage_BYTES,
+				},
+			},
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: false,
+				Message:  "volume is healthy",
+			},
+		}, nil
+	}
+
+	usage := stats.usage
+	availableBytes := usage.AvailableBytes
+	usedBytes := usage.UsedBytes
+	totalBytes := usage.TotalBytes
+	totalInodes := usage.TotalInodes
+	usedInodes := usage.UsedInodes
+	availableInodes := totalInodes - usedInodes
+
+	log.WithFields(logrus.Fields{
+		"volume_mode":      volumeModeFilesystem,
+		"bytes_available":  availableBytes,
+		"bytes_total":      totalBytes,
+		"bytes_used":       usedBytes,
+		"inodes_available": availableInodes,
+		"inodes_total":     totalInodes,
+		"inodes_used":      usedInodes,
+	}).Info("node capacity statistics retrieved")
+
+	if n.usageEvents != nil {
+		n.usageEvents.observe(req.VolumeId, usage)
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Available: availableBytes,
+				Total:     totalBytes,
+				Used:      usedBytes,
+				Unit:      csi.VolumeUsage_BYTES,
+			},
+			{
+				Available: availableInodes,
+				Total:     totalInodes,
+				Used:      usedInodes,
+				Unit:      csi.VolumeUsage_INODES,
+			},
+		},
+		VolumeCondition: &csi.VolumeCondition{
+			Abnormal: false,
+			Message:  "volume is healthy",
+		},
+	}, nil
+}
+
+// measureVolume returns the size of the raw block device or the filesystem usage of a
+// published volume
+func (n *VultrNodeServer) measureVolume(volumePath string) (*volumeStats, error) {
+	size, isBlock, err := n.host.blockDeviceBytes(volumePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get the size of block device %s: %w", volumePath, err)
+	}
+	if isBlock {
+		return &volumeStats{isBlock: true, blockBytes: size}, nil
+	}
+
+	usage, err := n.host.statfs(volumePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get filesystem statistics of %s: %w", volumePath, err)
+	}
+	return &volumeStats{usage: usage}, nil
+}
+
+func deadMountCondition(volumePath string, err error) *csi.VolumeCondition {
+	return &csi.VolumeCondition{
+		Abnormal: true,
+		Message:  fmt.Sprintf("volume path %s is a dead mount, it must be mounted again: %v", volumePath, err),
+	}
+}
+
+// abnormalCondition returns the condition of a volume whose path has disappeared, is no
+// longer mounted or whose device is gone, nil when none of these apply
+func (n *VultrNodeServer) abnormalCondition(volumeID, volumePath string) *csi.VolumeCondition {
+	abnormal := func(format string, args ...interface{}) *csi.VolumeCondition {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if q, ok := n.quarantine.get(volumeID); ok {
+		return abnormal("filesystem of the volume is quarantined since %s: %s", q.Since.Format(time.RFC3339), q.Reason)
+	}
+	if dead, ok := n.deadVFS.get(volumeID); ok {
+		return abnormal("virtiofs mount of the volume is dead since %s, it is not mounted again as %s: %v",
+			dead.Since.Format(time.RFC3339), dead.Pending, dead.Err)
+	}
+
+	if _, err := os.Stat(volumePath); err != nil {
+		if os.IsNotExist(err) {
+			return abnormal("volume path %s does not exist", volumePath)
+		}
+		if isDeadMount(err) {
+			n.volumeStats.markDead(volumePath, err)
+			return deadMountCondition(volumePath, err)
+		}
+		return abnormal("cannot access volume path %s: %v", volumePath, err)
+	}
+
+	notMnt, err := n.Driver.mounter.IsLikelyNotMountPoint(volumePath)
+	if err != nil {
+		return abnormal("cannot check the mount of volume path %s: %v", volumePath, err)
+	}
+	if notMnt {
+		return abnormal("volume path %s is not mounted", volumePath)
+	}
+
+	// vfs volumes are mounted by tag and have no device node
+	if staged, ok := n.staged.get(volumeID); ok && staged.Device != "" && staged.FsType != fsTypeVirtiofs {
+		if _, err := os.Stat(staged.Device); err != nil {
+			return abnormal("device %s of the volume is gone: %v", staged.Device, err)
+		}
+	}
+
+	return nil
+}
+
+// NodeExpandVolume provides the node volume expansion. The disk is rescanned and its size
+// checked first, then raw block volumes only need their LUKS2 mapping grown, filesystems
+// are grown with the tool of their type. The size the device ended up at is returned,
+// rather than the size requested.
+func (n *VultrNodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	if err := n.Driver.checkFeature("NodeExpandVolume", featureExpansion); err != nil {
+		return nil, err
+	}
+
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume Volume ID is missing")
+	}
+	if req.VolumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume Volume Path is missing")
+	}
+	if err := n.Driver.checkKubeletPaths("NodeExpandVolume", req.VolumePath, req.StagingTargetPath); err != nil {
+		return nil, err
+	}
+
+	log := requestLogger(ctx, n.Driver.log).WithFields(logrus.Fields{
+		"volume_path": req.VolumePath,
+		"method":      "NodeExpandVolume",
+	})
+
+	unlock, err := n.locks.acquire(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	defer n.volumeStats.invalidate(req.VolumePath)
+
+	if staged, ok := n.staged.get(req.VolumeId); (ok && staged.FsType == fsTypeVirtiofs) || n.mountType(req.VolumePath) == fsTypeVirtiofs {
+		return n.expandVFSVolume(req, log)
+	}
+
+	// kubelets predating the capability in the request publish raw block volumes as files
+	isBlock := req.VolumeCapability.GetBlock() != nil
+	if req.VolumeCapability == nil {
+		if info, err := os.Stat(req.VolumePath); err == nil && !info.IsDir() {
+			isBlock = true
+		}
+	}
+	if isBlock {
+		return n.expandBlockVolume(ctx, req, log)
+	}
+
+	devicePath, _, err := mount.GetDeviceNameFromMount(n.Driver.mounter, req.VolumePath)
+	if err != nil {
+		log.Infof("failed to determine mount path for %s: %s", req.VolumePath, err)
+		return nil, status.Errorf(codes.Internal, "failed to determine mount path for %s: %s", req.VolumePath, err)
+	}
+	if devicePath == "" {
+		return nil, status.Errorf(codes.NotFound, "NodeExpandVolume volume path %s is not mounted", req.VolumePath)
+	}
+
+	fsType, err := n.host.diskFormat(devicePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot determine filesystem on %s: %v", devicePath, err)
+	}
+	switch {
+	case fsType == "":
+		return nil, status.Errorf(codes.FailedPrecondition, "NodeExpandVolume device %s has no filesystem to expand", devicePath)
+	case isExtFs(fsType), fsType == fsTypeXFS, fsType == fsTypeBtrfs:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "NodeExpandVolume cannot expand a %s filesystem", fsType)
+	}
+
+	// ext filesystems are grown with resize2fs on the device, xfs and btrfs on the mount path
+	log = log.WithFields(logrus.Fields{"device": devicePath, "fs_type": fsType})
+	log.Info("attempting to resize filesystem")
+
+	size, err := n.growDevice(ctx, log, devicePath, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// volumes staged with the discard mount option also have the space the expansion
+	// added trimmed, from the size the filesystem had before it grew. The option comes
+	// from the capability or, for those of the StorageClass, from the mount table.
+	var trimFrom int64
+	discard := hasOption(sanitizeMountFlags(req.VolumeCapability.GetMount().GetMountFlags()), "discard") ||
+		n.mountedWith(req.VolumePath, "discard")
+	if discard {
+		if usage, err := n.host.statfs(req.VolumePath); err != nil {
+			log.Warnf("cannot determine filesystem size before resizing, not trimming: %v", err)
+			discard = false
+		} else {
+			trimFrom = usage.TotalBytes
+		}
+	}
+
+	// a filesystem read-only for its read-only targets is grown through its staging mount,
+	// writable for the time of the resize
+	resizePath := req.VolumePath
+	if staged, ok := n.staged.get(req.VolumeId); ok && staged.ReadOnly && !staged.pinned {
+		if err := n.remountStaging(ctx, req.VolumeId, staged.StagingPath, false); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := n.syncStagingReadOnly(ctx, req.VolumeId); err != nil {
+				log.Warnf("cannot remount the staged filesystem read-only after resizing: %v", err)
+			}
+		}()
+		resizePath = staged.StagingPath
+	}
+
+	hctx, cancel := helperContext(ctx)
+	defer cancel()
+
+	resizer := n.boundResizer(hctx)
+	if _, err := resizer.Resize(devicePath, resizePath); err != nil {
+		log.Infof("failed to resize volume: %s", err)
+		if hctx.Err() != nil {
+			return nil, resizeDeadlineError(req.VolumeId, err)
+		}
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to resize volume: %s", err))
+	}
+
+	// a filesystem still smaller than its device was not grown, whatever the tool returned
+	if grow, err := resizer.NeedResize(devicePath, resizePath); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot check the size of the %s filesystem on %s: %v", fsType, devicePath, err)
+	} else if grow {
+		return nil, status.Errorf(codes.Internal, "the %s filesystem on %s did not grow to the %d bytes of the device", fsType, devicePath, size)
+	}
+	if err := n.checkExpandedFilesystem(resizePath, devicePath, fsType, req.CapacityRange.GetRequiredBytes(), size); err != nil {
+		return nil, err
+	}
+
+	// the filesystem already grew, so a failed trim only leaves the space allocated until
+	// the next periodic trim and does not fail the expansion
+	if discard {
+		if err := n.trimExpanded(ctx, resizePath, trimFrom); err != nil {
+			log.Warnf("cannot trim expanded filesystem: %v", err)
+		} else {
+			log.WithField("trim_from", trimFrom).Info("trimmed expanded filesystem")
+		}
+	}
+
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: size}, nil
+}
+
+// checkExpandedFilesystem fails with OutOfRange when the filesystem mounted at path holds
+// less than the bytes required, or than the device without a capacity range, by more
+// than the resize tolerance. The resize tools can grow a filesystem short of its device
+// and still succeed, and a capacity returned for it would be recorded on the claim.
+func (n *VultrNodeServer) checkExpandedFilesystem(path, device, fsType string, required, deviceBytes int64) error {
+	if required == 0 {
+		required = deviceBytes
+	}
+
+	usage, err := n.host.statfs(path)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot get the size of the %s filesystem on %s: %v", fsType, device, err)
+	}
+
+	if minimum := float64(required) * (1 - n.Driver.resizeTolerance/100); float64(usage.TotalBytes) < minimum {
+		return status.Errorf(codes.OutOfRange, "the %s filesystem on %s is %d bytes, short of the %d bytes required by more than %v%%",
+			fsType, device, usage.TotalBytes, required, n.Driver.resizeTolerance)
+	}
+	return nil
+}
+
+// expandVFSVolume reports the size of a VFS volume, whose shared filesystem the host
+// grows along with the volume so there is nothing to resize on the node. ControllerExpandVolume
+// does not ask for node expansion of VFS volumes, so this only answers a CO calling anyway.
+func (n *VultrNodeServer) expandVFSVolume(req *csi.NodeExpandVolumeRequest, log *logrus.Entry) (*csi.NodeExpandVolumeResponse, error) {
+	var capacity int64
+	if usage, err := n.host.statfs(req.VolumePath); err != nil {
+		log.Warnf("cannot get the size of the virtiofs filesystem: %v", err)
+	} else {
+		capacity = usage.TotalBytes
+	}
+
+	log.WithField("capacity", capacity).Info("virtiofs filesystem grows with its volume, nothing to expand")
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: capacity}, nil
+}
+
+// expandBlockVolume expands a raw block volume, whose device the pod sees grow by itself
+// unless it is a LUKS2 mapping
+func (n *VultrNodeServer) expandBlockVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest, log *logrus.Entry) (*csi.NodeExpandVolumeResponse, error) { //nolint:lll
+	device := req.VolumePath
+	if staged, ok := n.staged.get(req.VolumeId); ok && staged.Device != "" {
+		device = staged.Device
+	}
+	log = log.WithField("device", device)
+	log.Info("expanding raw block volume")
+
+	size, err := n.growDevice(ctx, log, device, req)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: size}, nil
+}
+
+// growDevice has the node pick up the new size of the disks backing device and grows
+// the LUKS2 mapping on them, which is sized when opened, returning the size device
+// ended up at. A device still smaller than required fails with Unavailable and is left
+// for kubelet to retry, rather than growing the filesystem to the old size.
+func (n *VultrNodeServer) growDevice(ctx context.Context, log *logrus.Entry, device string, req *csi.NodeExpandVolumeRequest) (int64, error) { //nolint:lll
+	n.host.rescanDeviceSize(ctx, log, device)
+
+	if isEncryptedDevice(device) {
+		if err := n.resizeEncryptedDevice(ctx, device, req.Secrets); err != nil {
+			return 0, err
+		}
+	}
+
+	return n.expandedDeviceBytes(ctx, device, req.CapacityRange)
+}
+
+// expandedDeviceBytes returns the size of device, failing when it is smaller than the
+// capacity required, as when the node has not seen the volume grow yet
+func (n *VultrNodeServer) expandedDeviceBytes(ctx context.Context, device string, capRange *csi.CapacityRange) (int64, error) {
+	out, err := n.runCommand(ctx, "blockdev", "--getsize64", device)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return 0, err
+		}
+		return 0, status.Errorf(codes.Internal, "cannot get the size of %s: %v: %s", device, err, out)
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, status.Errorf(codes.Internal, "cannot parse the size of %s %q: %v", device, out, err)
+	}
+
+	if required := capRange.GetRequiredBytes(); size < required {
+		return 0, status.Errorf(codes.Unavailable, "device %s is %d bytes, less than the %d bytes required, the node did not see the volume grow yet", //nolint:lll
+			device, size, required)
+	}
+	return size, nil
+}
+
+// NodeGetCapabilities provides the node capabilities
+func (n *VultrNodeServer) NodeGetCapabilities(context.Context, *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	nodeCapabilities := []*csi.NodeServiceCapability{
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+				},
+			},
+		},
+	}
+
+	if n.Driver.features.enabled(featureExpansion) {
+		nodeCapabilities = append(nodeCapabilities, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+				},
+			},
+		})
+	}
+
+	if n.Driver.features.enabled(featureVolumeCondition) {
+		nodeCapabilities = append(nodeCapabilities, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		})
+	}
+
+	if n.Driver.features.enabled(featureVolumeMountGroup) && n.host.mountGroups() {
+		nodeCapabilities = append(nodeCapabilities, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+				},
+			},
+		})
+	}
+
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: nodeCapabilities,
+	}, nil
+}
+
+// NodeGetInfo provides the node info
+func (n *VultrNodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{
+		NodeId:             n.Driver.nodeID,
+		MaxVolumesPerNode:  n.maxVolumesPerNode(ctx),
+		AccessibleTopology: n.Driver.nodeTopology(),
+	}, nil
+}
+
+// maxVolumesPerNode returns the number of volumes this node can attach: the configured
+// override, or the block disk slots left over by the local disks of the instance plan and
+// the VFS volumes the node attaches besides, as VFS volumes take no block disk slot.
+// Kubernetes counts the volumes of both storage types against the one limit.
+func (n *VultrNodeServer) maxVolumesPerNode(ctx context.Context) int64 {
+	if n.Driver.maxVolumesPerNode > 0 {
+		return int64(n.Driver.maxVolumesPerNode)
+	}
+
+	var vfsVolumes int64
+	if !n.Driver.vfsDisabled {
+		vfsVolumes = int64(n.Driver.maxVFSVolumesPerNode)
+	}
+	return n.maxBlockVolumesPerNode(ctx) + vfsVolumes
+}
+
+// maxBlockVolumesPerNode returns the block disk slots left over by the local disks of the
+// instance plan. The plan is only looked up when the node plugin has an API token.
+func (n *VultrNodeServer) maxBlockVolumesPerNode(ctx context.Context) int64 {
+	if !n.Driver.isController {
+		return defaultMaxVolumesPerNode
+	}
+
+	log := requestLogger(ctx, n.Driver.log).WithField("node_id", n.Driver.nodeID)
+
+	diskCount, err := n.planDiskCount(ctx)
+	if err != nil {
+		log.Warnf("cannot look up instance plan, reporting default volume limit %d: %v", defaultMaxVolumesPerNode, err)
+		return defaultMaxVolumesPerNode
+	}
+
+	limit := n.Driver.blockDiskSlots - diskCount
+	if limit < 1 {
+		log.Warnf("plan has %d local disks, reporting default volume limit %d", diskCount, defaultMaxVolumesPerNode)
+		return defaultMaxVolumesPerNode
+	}
+
+	log.WithField("plan_disks", diskCount).Infof("Node Get Info: volume limit %d", limit)
+	return int64(limit)
+}
+
+// planDiskCount returns the number of local disks of this instance's plan
+func (n *VultrNodeServer) planDiskCount(ctx context.Context) (int, error) {
+	instance, _, err := n.Driver.client.Instance.Get(ctx, n.Driver.nodeID) //nolint:bodyclose
+	if err != nil {
+		return 0, err
+	}
+
+	diskCount := -1
+	err = volumes.Walk(ctx, &govultr.ListOptions{}, func(ctx context.Context, listOptions *govultr.ListOptions) ([]govultr.Plan, *govultr.Meta, error) { //nolint:lll
+		plans, meta, _, err := n.Driver.client.Plan.List(ctx, "", listOptions) //nolint:bodyclose
+		return plans, meta, err
+	}, func(plans []govultr.Plan) bool {
+		for i := range plans {
+			if plans[i].ID == instance.Plan {
+				diskCount = plans[i].DiskCount
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if diskCount < 0 {
+		return 0, fmt.Errorf("plan %q of instance %s not found", instance.Plan, n.Driver.nodeID)
+	}
+	return diskCount, nil
+}
+
+// fsckEnabled reports whether existing filesystems are checked before staging, the
+// StorageClass fsck parameter taking precedence over the driver default
+func (n *VultrNodeServer) fsckEnabled(volCtx map[string]string) bool {
+	if fsck, err := strconv.ParseBool(volCtx[volumeContextFsck]); err == nil {
+		return fsck
+	}
+	return n.Driver.fsckOnStage
+}
+
+// fallbackFsType returns the filesystem of a volume whose capability names none, the one
+// recorded when it was provisioned taking precedence over the driver default
+func (n *VultrNodeServer) fallbackFsType(volCtx map[string]string) string {
+	if fsType := volCtx[volumeContextFsType]; fsType != "" {
+		return fsType
+	}
+	return n.Driver.defaultFsType
+}
+
+func hasOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireStageSlot waits for a free stage slot, failing when ctx ends first
+func (n *VultrNodeServer) acquireStageSlot(ctx context.Context) (func(), error) {
+	if n.stageSlots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case n.stageSlots <- struct{}{}:
+		return func() { <-n.stageSlots }, nil
+	case <-ctx.Done():
+		return nil, status.Errorf(codes.Aborted,
+			"timed out waiting for one of %d concurrent stage slots: %v", cap(n.stageSlots), ctx.Err())
+	}
+}
+
+// makeTargetDir creates path with the configured directory mode and ownership. The mode is
+// applied explicitly as MkdirAll is subject to the umask and leaves existing directories alone.
+func (n *VultrNodeServer) makeTargetDir(path string) error {
+	mode := n.Driver.targetDirMode
+	if mode == 0 {
+		mode = mkDirMode
+	}
+
+	if err := os.MkdirAll(path, mode); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+
+	if owner := n.Driver.targetDirOwner; owner != nil {
+		if err := os.Chown(path, owner.uid, owner.gid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getDeviceByPath(volumeID string) string {
+	return filepath.Join(diskPath, fmt.Sprintf("%s%s", diskPrefix, volumeID))
+}
+
+// stagedVolume is the node's record of a volume it has staged
+type stagedVolume struct {
+	VolumeID    string    `json:"volume_id"`
+	StagingPath string    `json:"staging_path"`
+	Device      string    `json:"device"`
+	FsType      string    `json:"fs_type"`
+	StagedAt    time.Time `json:"staged_at"`
+	Targets     []string  `json:"targets"`
+	// ReadOnly is whether the staged filesystem is mounted read-only
+	ReadOnly bool `json:"read_only"`
+	// MountOptions are the options the virtiofs tag of a vfs volume was mounted with
+	MountOptions []string `json:"mount_options,omitempty"`
+	// PVCNamespace and PVCName are the claim of the volume from its publish context,
+	// empty when the controller did not pass it on
+	PVCNamespace string `json:"pvc_namespace,omitempty"`
+	PVCName      string `json:"pvc_name,omitempty"`
+
+	// targets are the publish targets, with whether each is read-only
+	targets map[string]bool
+	// pinned is set when the volume is staged read-only whatever its publishes
+	pinned bool
+}
+
+// stagedVolumes tracks the volumes staged and published by this node plugin
+type stagedVolumes struct {
+	mu      sync.RWMutex
+	volumes map[string]*stagedVolume
+}
+
+func newStagedVolumes() *stagedVolumes {
+	return &stagedVolumes{volumes: make(map[string]*stagedVolume)}
+}
+
+func (s *stagedVolumes) stage(volumeID, stagingPath, device, fsType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.volumes[volumeID]; ok && v.StagingPath == stagingPath {
+		return
+	}
+
+	s.volumes[volumeID] = &stagedVolume{
+		VolumeID:    volumeID,
+		StagingPath: stagingPath,
+		Device:      device,
+		FsType:      fsType,
+		StagedAt:    time.Now(),
+		targets:     make(map[string]bool),
+	}
+}
+
+// setClaim records the claim of the volume the publish context names
+func (s *stagedVolumes) setClaim(volumeID string, publishContext map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.volumes[volumeID]; ok {
+		v.PVCNamespace, v.PVCName = publishContext[volumeContextPVCNamespace], publishContext[volumeContextPVCName]
+	}
+}
+
+// setMountOptions records the options the staged filesystem of the volume was mounted with
+func (s *stagedVolumes) setMountOptions(volumeID string, options []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.volumes[volumeID]; ok {
+		v.MountOptions = options
+	}
+}
+
+// pin records the volume as staged read-only for good, as its capability asks
+func (s *stagedVolumes) pin(volumeID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.volumes[volumeID]; ok {
+		v.ReadOnly, v.pinned = true, true
+	}
+}
+
+// setReadOnly records whether the staged filesystem of the volume is mounted read-only
+func (s *stagedVolumes) setReadOnly(volumeID string, readOnly bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.volumes[volumeID]; ok {
+		v.ReadOnly = readOnly
+	}
+}
+
+// stagingReadOnly reports whether the staged filesystem of the volume should be mounted
+// read-only, which it should while every target publishing it is read-only. Without
+// targets it stays as it is. It reports false for the volumes it does not track, and for
+// those whose publishes have no say: pinned, raw block and vfs volumes.
+func (s *stagedVolumes) stagingReadOnly(volumeID string) (bool, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	v, ok := s.volumes[volumeID]
+	if !ok || v.pinned || v.FsType == "" || v.FsType == fsTypeVirtiofs {
+		return false, false
+	}
+	if len(v.targets) == 0 {
+		return v.ReadOnly, true
+	}
+
+	for _, readOnly := range v.targets {
+		if !readOnly {
+			return false, true
+		}
+	}
+	return true, true
+}
+
+// get returns a copy of the tracked volume
+func (s *stagedVolumes) get(volumeID string) (stagedVolume, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	v, ok := s.volumes[volumeID]
+	if !ok {
+		return stagedVolume{}, false
+	}
+
+	c := *v
+	c.targets = nil
+	return c, true
+}
+
+func (s *stagedVolumes) unstage(volumeID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.volumes, volumeID)
+}
+
+func (s *stagedVolumes) publish(volumeID, target string, readOnly bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.volumes[volumeID]; ok {
+		v.targets[target] = readOnly
+	}
+}
+
+// publishes returns the publish targets of the volume, with whether each is read-only
+func (s *stagedVolumes) publishes(volumeID string) map[string]bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	targets := make(map[string]bool)
+	if v, ok := s.volumes[volumeID]; ok {
+		for t, readOnly := range v.targets {
+			targets[t] = readOnly
+		}
+	}
+	return targets
+}
+
+func (s *stagedVolumes) unpublish(volumeID, target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.volumes[volumeID]; ok {
+		delete(v.targets, target)
+	}
+}
+
+// list returns copies of the tracked volumes along with their publish targets
+func (s *stagedVolumes) list() []stagedVolume {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	volumes := make([]stagedVolume, 0, len(s.volumes))
+	for _, v := range s.volumes {
+		c := *v
+		c.targets = nil
+		c.Targets = make([]string, 0, len(v.targets))
+		for t := range v.targets {
+			c.Targets = append(c.Targets, t)
+		}
+		sort.Strings(c.Targets)
+		volumes = append(volumes, c)
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].VolumeID < volumes[j].VolumeID
+	})
+
+	return volumes
 }
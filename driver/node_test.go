@@ -0,0 +1,967 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+)
+
+func TestAcquireStageSlot(t *testing.T) {
+	node := NewVultrNodeDriver(&VultrDriver{maxConcurrentStages: 1})
+
+	release, err := node.acquireStageSlot(context.Background())
+	if err != nil {
+		t.Fatalf("expected a free slot, got error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := node.acquireStageSlot(ctx); status.Code(err) != codes.Aborted {
+		t.Errorf("expected Aborted while the only slot is held, got %v", err)
+	}
+
+	release()
+
+	if _, err := node.acquireStageSlot(context.Background()); err != nil {
+		t.Errorf("expected the released slot to be reusable, got error: %v", err)
+	}
+}
+
+// remountHost remounts the mounts of the fake mounter read-only
+type remountHost struct {
+	hostOS
+	fake      *mount.FakeMounter
+	remounted []string
+}
+
+func (h *remountHost) remountReadOnly(target string) error {
+	h.remounted = append(h.remounted, target)
+	for i := range h.fake.MountPoints {
+		if h.fake.MountPoints[i].Path == target {
+			h.fake.MountPoints[i].Opts = append(h.fake.MountPoints[i].Opts, "ro")
+		}
+	}
+	return nil
+}
+
+func TestEnsureReadOnly(t *testing.T) {
+	fake := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "/dev/vda", Path: "/ro", Opts: []string{"bind", "ro"}},
+		{Device: "/dev/vdb", Path: "/rw", Opts: []string{"bind"}},
+	})
+
+	node := NewVultrNodeDriver(&VultrDriver{
+		log:     logrus.NewEntry(logrus.New()),
+		mounter: &mount.SafeFormatAndMount{Interface: fake, Exec: exec.New()},
+	})
+
+	host := &remountHost{hostOS: node.host, fake: fake}
+	node.host = host
+
+	if err := node.ensureReadOnly("/ro"); err != nil {
+		t.Errorf("expected read-only mount to verify, got error: %v", err)
+	}
+
+	if err := node.ensureReadOnly("/rw"); err != nil {
+		t.Errorf("expected writable mount to be remounted, got error: %v", err)
+	}
+
+	if len(host.remounted) != 1 || host.remounted[0] != "/rw" {
+		t.Errorf("expected only /rw to be remounted, got %v", host.remounted)
+	}
+
+	if err := node.ensureReadOnly("/missing"); status.Code(err) != codes.Internal {
+		t.Errorf("expected Internal for a missing mount, got %v", err)
+	}
+}
+
+func TestMountGroupID(t *testing.T) {
+	node := NewVultrNodeDriver(&VultrDriver{log: logrus.NewEntry(logrus.New())})
+	capability := func(group string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{VolumeMountGroup: group},
+		}}
+	}
+
+	tests := []struct {
+		group string
+		gid   int
+		ok    bool
+		code  codes.Code
+	}{
+		{group: ""},
+		{group: "2000", gid: 2000, ok: true},
+		{group: "0", gid: 0, ok: true},
+		{group: "staff", code: codes.InvalidArgument},
+		{group: "-1", code: codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		gid, ok, err := node.mountGroupID("NodeStageVolume", capability(tt.group))
+		if gid != tt.gid || ok != tt.ok || status.Code(err) != tt.code {
+			t.Errorf("expected %q to be %d, %v, %v, got %d, %v, %v", tt.group, tt.gid, tt.ok, tt.code, gid, ok, err)
+		}
+	}
+
+	node.Driver.features = featureGates{featureVolumeMountGroup: false}
+	if _, _, err := node.mountGroupID("NodeStageVolume", capability("2000")); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument with the feature disabled, got %v", err)
+	}
+}
+
+func TestMountedWith(t *testing.T) {
+	node := NewVultrNodeDriver(&VultrDriver{
+		log: logrus.NewEntry(logrus.New()),
+		mounter: &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter([]mount.MountPoint{
+			{Device: "/dev/vda", Path: "/publish", Opts: []string{"discard"}},
+			{Device: "/dev/vda", Path: "/publish", Opts: []string{"bind", "ro"}},
+			{Device: "/dev/vdb", Path: "/other", Opts: []string{"bind", "discard"}},
+		})},
+	})
+
+	if node.mountedWith("/publish", "discard") {
+		t.Errorf("expected the option of the topmost mount only")
+	}
+	if !node.mountedWith("/other", "discard") || node.mountedWith("/missing", "discard") {
+		t.Errorf("expected the option of the mount at the path")
+	}
+}
+
+func TestNodePublishVolumeIdempotency(t *testing.T) {
+	fake := mount.NewFakeMounter(nil)
+	node := NewVultrNodeDriver(&VultrDriver{
+		log:           logrus.NewEntry(logrus.New()),
+		mounter:       &mount.SafeFormatAndMount{Interface: fake, Exec: exec.New()},
+		targetDirMode: mkDirMode,
+	})
+
+	dir := t.TempDir()
+	publish := func(staging string, readOnly bool) error {
+		_, err := node.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+			StagingTargetPath: filepath.Join(dir, staging),
+			TargetPath:        filepath.Join(dir, "target"),
+			Readonly:          readOnly,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsTypeExt4}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		})
+		return err
+	}
+
+	for _, attempt := range []string{"publish", "retry"} {
+		if err := publish("staging", false); err != nil {
+			t.Fatalf("%s: expected no error, got %v", attempt, err)
+		}
+	}
+
+	mounts := 0
+	for _, mp := range fake.MountPoints {
+		if mp.Path == filepath.Join(dir, "target") {
+			mounts++
+		}
+	}
+	if mounts != 1 {
+		t.Errorf("expected the retry not to stack a mount, got %d mounts at the target", mounts)
+	}
+
+	if err := publish("other-staging", false); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected AlreadyExists for a target mounted from another staging path, got %v", err)
+	}
+
+	if err := publish("staging", true); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected AlreadyExists for a read-only publish of a writable target, got %v", err)
+	}
+
+	if err := fake.Unmount(filepath.Join(dir, "target")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := publish("staging", true); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := publish("staging", false); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected AlreadyExists for a writable publish of a read-only target, got %v", err)
+	}
+}
+
+func TestNodePublishVolumeReadOnlyStaging(t *testing.T) {
+	const volumeID = "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+
+	dir := t.TempDir()
+	staging := filepath.Join(dir, "staging")
+	fake := mount.NewFakeMounter([]mount.MountPoint{{Device: "/dev/vdb", Path: staging, Type: fsTypeExt4}})
+	fe := &fakeExec{}
+	node := NewVultrNodeDriver(&VultrDriver{
+		log:           logrus.NewEntry(logrus.New()),
+		mounter:       &mount.SafeFormatAndMount{Interface: fake, Exec: fe},
+		exec:          fe,
+		targetDirMode: mkDirMode,
+	})
+	node.staged.stage(volumeID, staging, "/dev/vdb", fsTypeExt4)
+
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsTypeExt4}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER},
+	}
+	publish := func(target string, readOnly bool) {
+		t.Helper()
+		_, err := node.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          volumeID,
+			StagingTargetPath: staging,
+			TargetPath:        filepath.Join(dir, target),
+			Readonly:          readOnly,
+			VolumeCapability:  capability,
+		})
+		if err != nil {
+			t.Fatalf("publish %s: expected no error, got %v", target, err)
+		}
+	}
+	unpublish := func(target string) {
+		t.Helper()
+		_, err := node.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   volumeID,
+			TargetPath: filepath.Join(dir, target),
+		})
+		if err != nil {
+			t.Fatalf("unpublish %s: expected no error, got %v", target, err)
+		}
+	}
+	remounts := func() []string {
+		var modes []string
+		for _, c := range fe.run {
+			if c[0] == "mount" && c[len(c)-1] == staging {
+				modes = append(modes, c[2])
+			}
+		}
+		return modes
+	}
+	expectRemounts := func(step string, expected ...string) {
+		t.Helper()
+		if got := remounts(); len(got)+len(expected) > 0 && !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected remounts %v, got %v", step, expected, got)
+		}
+	}
+
+	publish("reader-1", true)
+	expectRemounts("first read-only target", "remount,ro")
+	if staged, _ := node.staged.get(volumeID); !staged.ReadOnly {
+		t.Errorf("expected the staged filesystem to be recorded read-only")
+	}
+
+	publish("reader-2", true)
+	expectRemounts("second read-only target", "remount,ro")
+
+	publish("writer", false)
+	expectRemounts("writable target", "remount,ro", "remount,rw")
+
+	unpublish("writer")
+	expectRemounts("writable target unpublished", "remount,ro", "remount,rw", "remount,ro")
+
+	// without targets the filesystem is left as it is until unstaged
+	unpublish("reader-1")
+	unpublish("reader-2")
+	expectRemounts("read-only targets unpublished", "remount,ro", "remount,rw", "remount,ro")
+
+	// a restarted node plugin does not know the volume, and trusts the mount table
+	node.staged.unstage(volumeID)
+	fe.run = nil
+	fake.MountPoints[0].Opts = []string{"ro"}
+	publish("writer", false)
+	expectRemounts("writable target of an untracked volume", "remount,rw")
+
+	// a volume staged read-only by its capability is never made writable
+	node.staged.stage(volumeID, staging, "/dev/vdb", fsTypeExt4)
+	node.staged.pin(volumeID)
+	fe.run = nil
+	publish("another-writer", false)
+	unpublish("another-writer")
+	expectRemounts("pinned volume")
+}
+
+// busyMounter mounts like the fake mounter and then fails with EBUSY, as when a concurrent
+// publish won the race to the target
+type busyMounter struct {
+	*mount.FakeMounter
+}
+
+func (m *busyMounter) Mount(source, target, fstype string, options []string) error {
+	if err := m.FakeMounter.Mount(source, target, fstype, options); err != nil {
+		return err
+	}
+	return fmt.Errorf("mount failed: exit status 32\nmount: %s: %v", target, syscall.EBUSY)
+}
+
+func TestNodePublishVolumeBusy(t *testing.T) {
+	fake := &busyMounter{mount.NewFakeMounter(nil)}
+	node := NewVultrNodeDriver(&VultrDriver{
+		log:           logrus.NewEntry(logrus.New()),
+		mounter:       &mount.SafeFormatAndMount{Interface: fake, Exec: exec.New()},
+		targetDirMode: mkDirMode,
+	})
+
+	dir := t.TempDir()
+	_, err := node.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		StagingTargetPath: filepath.Join(dir, "staging"),
+		TargetPath:        filepath.Join(dir, "target"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsTypeExt4}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	if err != nil {
+		t.Errorf("expected a target busy with the same staging path to be published, got %v", err)
+	}
+}
+
+func TestMakeTargetDir(t *testing.T) {
+	node := NewVultrNodeDriver(&VultrDriver{
+		targetDirMode:  0711,
+		targetDirOwner: &dirOwner{uid: os.Getuid(), gid: os.Getgid()},
+	})
+
+	path := filepath.Join(t.TempDir(), "staging", "globalmount")
+	if err := node.makeTargetDir(path); err != nil {
+		t.Fatalf("got error, expected no error: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != 0711 {
+		t.Errorf("expected mode 0711, got %#o", info.Mode().Perm())
+	}
+}
+
+func TestMaxVolumesPerNode(t *testing.T) {
+	const planNodeID = "94cf529e-796c-44c0-8a18-6e0be753f155"
+	tests := []struct {
+		name     string
+		driver   *VultrDriver
+		expected int64
+	}{
+		{"override", &VultrDriver{maxVolumesPerNode: 5, isController: true}, 5},
+		{"no api token", &VultrDriver{}, defaultMaxVolumesPerNode},
+		{"derived from plan disks", &VultrDriver{isController: true, nodeID: planNodeID, blockDiskSlots: DefaultBlockDiskSlots}, 10},
+		{"configured block disk slots", &VultrDriver{isController: true, nodeID: planNodeID, blockDiskSlots: 16}, 14},
+		{"vfs volumes besides", &VultrDriver{isController: true, nodeID: planNodeID, blockDiskSlots: DefaultBlockDiskSlots,
+			maxVFSVolumesPerNode: 4}, 14},
+		{"vfs disabled", &VultrDriver{isController: true, nodeID: planNodeID, blockDiskSlots: DefaultBlockDiskSlots,
+			maxVFSVolumesPerNode: 4, vfsDisabled: true}, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.driver.client = newFakeClient()
+			tt.driver.log = logrus.NewEntry(logrus.New())
+
+			if got := NewVultrNodeDriver(tt.driver).maxVolumesPerNode(context.Background()); got != tt.expected {
+				t.Errorf("expected %d volumes, got %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestVolumeStatsCondition(t *testing.T) {
+	dir := t.TempDir()
+	mounted := filepath.Join(dir, "mounted")
+	unmounted := filepath.Join(dir, "unmounted")
+	for _, path := range []string{mounted, unmounted} {
+		if err := os.Mkdir(path, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	node := NewVultrNodeDriver(&VultrDriver{
+		log:     logrus.NewEntry(logrus.New()),
+		mounter: &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter([]mount.MountPoint{{Path: mounted}})},
+	})
+	node.staged.stage("gone", mounted, filepath.Join(dir, "vdz"), fsTypeExt4)
+
+	tests := []struct {
+		name     string
+		volumeID string
+		path     string
+		abnormal bool
+	}{
+		{"healthy", "healthy", mounted, false},
+		{"path missing", "missing", filepath.Join(dir, "missing"), true},
+		{"not mounted", "unmounted", unmounted, true},
+		{"device gone", "gone", mounted, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := node.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+				VolumeId:   tt.volumeID,
+				VolumePath: tt.path,
+			})
+			if err != nil {
+				t.Fatalf("expected the condition instead of an error, got %v", err)
+			}
+
+			if res.VolumeCondition == nil || res.VolumeCondition.Abnormal != tt.abnormal {
+				t.Errorf("expected abnormal %v, got %+v", tt.abnormal, res.VolumeCondition)
+			}
+
+			if tt.abnormal != (len(res.Usage) == 0) {
+				t.Errorf("expected usage only for healthy volumes, got %+v", res.Usage)
+			}
+		})
+	}
+}
+
+func TestVolumeStatsBlock(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "block")
+	if err := os.WriteFile(target, nil, mkFileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	mounter := newFakeMounter([]mount.MountPoint{{Path: target}})
+	node := NewVultrNodeDriver(&VultrDriver{log: logrus.NewEntry(logrus.New()), mounter: mounter})
+	node.host = &fakeHost{hostOS: node.host, mounter: mounter, blockSizes: map[string]int64{target: 10 * giB}}
+
+	res, err := node.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "block",
+		VolumePath: target,
+	})
+	if err != nil {
+		t.Fatalf("NodeGetVolumeStats: %v", err)
+	}
+
+	if res.VolumeCondition.GetAbnormal() {
+		t.Errorf("expected a healthy volume, got %+v", res.VolumeCondition)
+	}
+
+	if len(res.Usage) != 1 {
+		t.Fatalf("expected the bytes usage only, got %v", res.Usage)
+	}
+	if u := res.Usage[0]; u.Unit != csi.VolumeUsage_BYTES || u.Total != 10*giB || u.Used != 0 || u.Available != 0 {
+		t.Errorf("expected %d total bytes without used and available, got %v", int64(10*giB), u)
+	}
+}
+
+// sizedHost reports every filesystem to be totalBytes
+type sizedHost struct {
+	hostOS
+	totalBytes int64
+}
+
+func (h *sizedHost) statfs(string) (*volumeUsage, error) {
+	return &volumeUsage{TotalBytes: h.totalBytes}, nil
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	mountCapability := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}
+	blockCapability := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+
+	tests := []struct {
+		name       string
+		path       string
+		capability *csi.VolumeCapability
+		required   int64
+		outputs    map[string]string
+		code       codes.Code
+		size       int64
+		resized    bool
+		// fsBytes is the size statfs reports for the grown filesystem, 97% of the device when 0
+		fsBytes int64
+	}{
+		{
+			name: "ext4 grown", path: "/publish", capability: mountCapability, required: 20 * giB,
+			outputs: map[string]string{"dumpe2fs": "Block count: 5242880\nBlock size: 4096\n"},
+			code:    codes.OK, size: 20 * giB, resized: true,
+		},
+		{
+			name: "ext4 not grown", path: "/publish", capability: mountCapability, required: 20 * giB,
+			outputs: map[string]string{"dumpe2fs": "Block count: 2621440\nBlock size: 4096\n"},
+			code:    codes.Internal, resized: true,
+		},
+		{
+			// the resize tool succeeded but the filesystem holds far less than required
+			name: "ext4 grown short", path: "/publish", capability: mountCapability, required: 20 * giB,
+			outputs: map[string]string{"dumpe2fs": "Block count: 5242880\nBlock size: 4096\n"}, fsBytes: 15 * giB,
+			code: codes.OutOfRange, resized: true,
+		},
+		{
+			// the node did not see the volume grow, so the filesystem is left for a retry
+			name: "device smaller than required", path: "/publish", capability: mountCapability, required: 30 * giB,
+			outputs: map[string]string{"dumpe2fs": "Block count: 5242880\nBlock size: 4096\n"},
+			code:    codes.Unavailable,
+		},
+		{
+			// grown by btrfs on the mount path rather than by resize2fs
+			name: "btrfs grown", path: "/publish", capability: mountCapability, required: 20 * giB,
+			outputs: map[string]string{"blkid": "TYPE=" + fsTypeBtrfs, "btrfs": "sectorsize 4096\ntotal_bytes 21474836480\n"},
+			code:    codes.OK, size: 20 * giB,
+		},
+		{
+			name: "unformatted", path: "/publish", capability: mountCapability, required: 20 * giB,
+			outputs: map[string]string{"blkid": ""},
+			code:    codes.FailedPrecondition,
+		},
+		{name: "not mounted", path: "/other", capability: mountCapability, required: 20 * giB, code: codes.NotFound},
+		{name: "raw block", path: "/dev/vdb", capability: blockCapability, required: 20 * giB, code: codes.OK, size: 20 * giB},
+	}
+
+	defer func(s string) { sysBlockPath = s }(sysBlockPath)
+	sysBlockPath = t.TempDir()
+	rescan := filepath.Join(sysBlockPath, "vdb", "device", "rescan")
+	if err := os.MkdirAll(filepath.Dir(rescan), mkDirMode); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := os.WriteFile(rescan, nil, mkFileMode); err != nil {
+				t.Fatal(err)
+			}
+
+			fe := &fakeExec{outputs: map[string]string{
+				"blkid":                         "TYPE=" + fsTypeExt4,
+				"blockdev --getro /dev/vdb":     "0",
+				"blockdev --getsize64 /dev/vdb": "21474836480",
+			}}
+			for cmd, out := range test.outputs {
+				fe.outputs[cmd] = out
+			}
+
+			node := NewVultrNodeDriver(&VultrDriver{
+				log:     logrus.NewEntry(logrus.New()),
+				mounter: &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter([]mount.MountPoint{{Device: "/dev/vdb", Path: "/publish"}}), Exec: fe},
+				resizer: mount.NewResizeFs(fe),
+				exec:    fe,
+
+				resizeTolerance: DefaultResizeTolerance,
+			})
+			fsBytes := test.fsBytes
+			if fsBytes == 0 {
+				fsBytes = 20 * giB * 97 / 100
+			}
+			node.host = &sizedHost{hostOS: node.host, totalBytes: fsBytes}
+
+			res, err := node.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+				VolumeId:         "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+				VolumePath:       test.path,
+				VolumeCapability: test.capability,
+				CapacityRange:    &csi.CapacityRange{RequiredBytes: test.required},
+			})
+			if status.Code(err) != test.code {
+				t.Fatalf("expected %v, got %v", test.code, err)
+			}
+			if err == nil && res.CapacityBytes != test.size {
+				t.Errorf("expected %d bytes, got %d", test.size, res.CapacityBytes)
+			}
+			if resized := fe.ran("resize2fs") != nil; resized != test.resized {
+				t.Errorf("expected resize2fs run %v, got %v", test.resized, resized)
+			}
+			rescanned := test.code != codes.NotFound && test.code != codes.FailedPrecondition
+			if written, _ := os.ReadFile(rescan); rescanned && string(written) != "1" {
+				t.Errorf("expected the disk rescanned before resizing, got %q", written)
+			}
+		})
+	}
+}
+
+func TestNodeExpandVFSVolume(t *testing.T) {
+	fe := &fakeExec{}
+	mounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "vfs-tag", Path: "/shared", Type: fsTypeVirtiofs}})
+	node := NewVultrNodeDriver(&VultrDriver{
+		log:     logrus.NewEntry(logrus.New()),
+		mounter: &mount.SafeFormatAndMount{Interface: mounter, Exec: fe},
+		resizer: mount.NewResizeFs(fe),
+		exec:    fe,
+
+		resizeTolerance: DefaultResizeTolerance,
+	})
+	node.host = &sizedHost{hostOS: node.host, totalBytes: 20 * giB}
+
+	res, err := node.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+		VolumeId:         "vfs-1",
+		VolumePath:       "/shared",
+		VolumeCapability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}},
+		CapacityRange:    &csi.CapacityRange{RequiredBytes: 20 * giB},
+	})
+	if err != nil {
+		t.Fatalf("expected a virtiofs mount to need no expansion, got %v", err)
+	}
+	if res.CapacityBytes != 20*giB {
+		t.Errorf("expected the size of the shared filesystem, got %d", res.CapacityBytes)
+	}
+	if len(fe.run) != 0 {
+		t.Errorf("expected no command run on the node, got %v", fe.run)
+	}
+}
+
+// fakeHost finds the devices of the volumes from a map and reads their filesystem from
+// the fake mounter which formatted them
+type fakeHost struct {
+	hostOS
+	mounter *fakeMounter
+	// devices are the devices of each mount ID
+	devices map[string]string
+	// blockSizes are the sizes of the paths published as block devices
+	blockSizes map[string]int64
+	// ioStats are the IO counters of each device
+	ioStats map[string]*diskIOStats
+}
+
+func (h *fakeHost) findDevice(_ context.Context, _ *logrus.Entry, mountID string) (string, string) {
+	if device, ok := h.devices[mountID]; ok {
+		return device, foundByLink
+	}
+	return "", ""
+}
+
+func (h *fakeHost) rescanDevices(context.Context) {}
+
+func (h *fakeHost) diskFormat(device string) (string, error) {
+	return h.mounter.formats[device], nil
+}
+
+func (h *fakeHost) blockDeviceBytes(path string) (int64, bool, error) {
+	size, ok := h.blockSizes[path]
+	return size, ok, nil
+}
+
+func (h *fakeHost) diskIOStats(device string) (*diskIOStats, error) {
+	stats, ok := h.ioStats[device]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return stats, nil
+}
+
+func (h *fakeHost) fsTypes() []string {
+	return []string{fsTypeExt4, fsTypeXFS}
+}
+
+func (h *fakeHost) rawBlock() bool {
+	return true
+}
+
+func TestNodeStageVolume(t *testing.T) {
+	const mountID = "c56c7b6e15c2445e9a5d"
+
+	mountCapability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsTypeExt4}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	blockCapability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	tests := []struct {
+		name           string
+		capability     *csi.VolumeCapability
+		volumeContext  map[string]string
+		publishContext map[string]string
+		// format is the filesystem already on the device
+		format string
+		// partitionTable is the partition table blkid finds on the device
+		partitionTable string
+		// mountedFrom is the device already mounted at the staging path, "device" for the device of the volume
+		mountedFrom string
+		noDevice    bool
+		formatErr   error
+		needResize  bool
+		resizeStuck bool
+		code        codes.Code
+		formatted   bool
+		// mounted is the device mounted at the staging path once staged, "device" for the device of the volume
+		mounted string
+		fsType  string
+		// opts are options expected on the staging mount, and absent those prefixed with !
+		opts    []string
+		resized bool
+		// ran are the arguments expected for the commands run
+		ran map[string][]string
+		// stagedReadOnly is whether the staging mount ends up read-only for good
+		stagedReadOnly bool
+	}{
+		{
+			name: "formatted and mounted", capability: mountCapability,
+			code: codes.OK, formatted: true, mounted: "device", fsType: fsTypeExt4,
+		},
+		{
+			name: "existing filesystem mounted", capability: mountCapability, format: fsTypeExt4,
+			code: codes.OK, mounted: "device", fsType: fsTypeExt4,
+		},
+		{
+			name: "already staged", capability: mountCapability, format: fsTypeExt4, mountedFrom: "device",
+			code: codes.OK, mounted: "device", fsType: fsTypeExt4,
+		},
+		{
+			name: "staged from another device", capability: mountCapability, format: fsTypeExt4, mountedFrom: "/dev/vdz",
+			code: codes.AlreadyExists, mounted: "/dev/vdz",
+		},
+		{name: "other filesystem", capability: mountCapability, format: fsTypeXFS, code: codes.FailedPrecondition},
+		{name: "format failure", capability: mountCapability, formatErr: fmt.Errorf("mkfs.ext4 failed"), code: codes.Internal},
+		{
+			name: "pending resize", capability: mountCapability, format: fsTypeExt4, needResize: true,
+			code: codes.OK, mounted: "device", fsType: fsTypeExt4, resized: true,
+		},
+		{
+			name: "pending resize not completed", capability: mountCapability, format: fsTypeExt4, needResize: true, resizeStuck: true,
+			code: codes.Internal, mounted: "device", resized: true,
+		},
+		{
+			name: "reserved blocks at format", capability: mountCapability,
+			volumeContext: map[string]string{volumeContextReserved: "1"},
+			code:          codes.OK, formatted: true, mounted: "device", fsType: fsTypeExt4,
+			ran: map[string][]string{"mkfs.ext4": {"-F", "-m0", "-E", "nodiscard", "-m", "1"}, "tune2fs": {"-m", "1"}},
+		},
+		{
+			name: "reserved blocks of formatted", capability: mountCapability, format: fsTypeExt4,
+			volumeContext: map[string]string{volumeContextReserved: "1"},
+			code:          codes.OK, mounted: "device", fsType: fsTypeExt4,
+			ran: map[string][]string{"mkfs.ext4": nil, "tune2fs": {"-m", "1"}},
+		},
+		{
+			// the capability undoes the noatime of the StorageClass
+			name: "storage class mount options", format: fsTypeExt4,
+			capability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsTypeExt4, MountFlags: []string{"atime"}}},
+				AccessMode: mountCapability.AccessMode,
+			},
+			volumeContext: map[string]string{volumeContextMountOptions: "discard,noatime"},
+			code:          codes.OK, mounted: "device", fsType: fsTypeExt4, opts: []string{"discard", "atime", "!noatime"},
+		},
+		{name: "partitioned", capability: mountCapability, partitionTable: "gpt", code: codes.FailedPrecondition},
+		{
+			name: "partitioned wiped", capability: mountCapability, partitionTable: "gpt",
+			volumeContext: map[string]string{volumeContextWipePartitions: "true"},
+			code:          codes.OK, formatted: true, mounted: "device", fsType: fsTypeExt4,
+			ran: map[string][]string{"wipefs": {"-a"}},
+		},
+		{
+			name: "partitioned read-only", partitionTable: "dos",
+			capability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsTypeExt4, MountFlags: []string{"ro"}}},
+				AccessMode: mountCapability.AccessMode,
+			},
+			volumeContext: map[string]string{volumeContextWipePartitions: "true"},
+			code:          codes.FailedPrecondition, ran: map[string][]string{"wipefs": nil},
+		},
+		{
+			name: "reader only", format: fsTypeExt4,
+			capability: &csi.VolumeCapability{
+				AccessType: mountCapability.AccessType,
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY},
+			},
+			code: codes.OK, mounted: "device", fsType: fsTypeExt4, stagedReadOnly: true,
+		},
+		{name: "device missing", capability: mountCapability, noDevice: true, code: codes.NotFound},
+		{name: "no mount id", capability: mountCapability, publishContext: map[string]string{}, code: codes.InvalidArgument},
+		{name: "raw block", capability: blockCapability, code: codes.OK},
+		{
+			name: "vfs", capability: mountCapability, volumeContext: map[string]string{volumeContextStorageType: storageTypeVFS},
+			publishContext: vfsPublishInfo{MountTag: "vfs-tag", State: vfsAttachmentAttached}.publishContext(),
+			code:           codes.OK, mounted: "vfs-tag", fsType: fsTypeVirtiofs,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			device := filepath.Join(dir, "device")
+			if err := os.WriteFile(device, nil, mkFileMode); err != nil {
+				t.Fatal(err)
+			}
+			staging := filepath.Join(dir, "staging")
+			resolve := func(name string) string {
+				if name == "device" {
+					return device
+				}
+				return name
+			}
+
+			var mps []mount.MountPoint
+			if test.mountedFrom != "" {
+				mps = append(mps, mount.MountPoint{Device: resolve(test.mountedFrom), Path: staging, Type: fsTypeExt4})
+			}
+			mounter := newFakeMounter(mps)
+			mounter.formatErr = test.formatErr
+			if test.format != "" {
+				mounter.formats[device] = test.format
+			}
+			resizer := &fakeResizer{needResize: test.needResize, stuck: test.resizeStuck}
+
+			fe := &fakeExec{}
+			if test.partitionTable != "" {
+				fe.outputs = map[string]string{"blkid -p -s TYPE -s PTTYPE -o export " + device: "PTTYPE=" + test.partitionTable}
+			}
+			node := NewVultrNodeDriver(&VultrDriver{
+				log:               logrus.NewEntry(logrus.New()),
+				mounter:           mounter,
+				resizer:           resizer,
+				exec:              fe,
+				targetDirMode:     mkDirMode,
+				deviceWaitTimeout: 10 * time.Millisecond,
+			})
+			host := &fakeHost{hostOS: node.host, mounter: mounter, devices: map[string]string{}}
+			if !test.noDevice {
+				host.devices[mountID] = device
+			}
+			node.host = host
+
+			publishContext := test.publishContext
+			if publishContext == nil {
+				publishContext = map[string]string{node.Driver.mountID: mountID}
+			}
+
+			_, err := node.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+				VolumeId:          "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+				StagingTargetPath: staging,
+				VolumeCapability:  test.capability,
+				VolumeContext:     test.volumeContext,
+				PublishContext:    publishContext,
+			})
+			if status.Code(err) != test.code {
+				t.Fatalf("expected %v, got %v", test.code, err)
+			}
+
+			if formatted := len(mounter.formatted) > 0; formatted != test.formatted {
+				t.Errorf("expected formatted %v, got %v", test.formatted, formatted)
+			}
+
+			var mounted []mount.MountPoint
+			for _, mp := range mounter.MountPoints {
+				if mp.Path == staging {
+					mounted = append(mounted, mp)
+				}
+			}
+			switch {
+			case test.mounted == "" && len(mounted) > 0:
+				t.Errorf("expected nothing mounted at the staging path, got %v", mounted)
+			case test.mounted != "" && (len(mounted) != 1 || mounted[0].Device != resolve(test.mounted)):
+				t.Errorf("expected %s mounted once at the staging path, got %v", resolve(test.mounted), mounted)
+			case test.fsType != "" && mounted[0].Type != test.fsType:
+				t.Errorf("expected a %s mount, got %s", test.fsType, mounted[0].Type)
+			}
+			for _, opt := range test.opts {
+				if absent, ok := strings.CutPrefix(opt, "!"); ok == hasOption(mounted[0].Opts, absent) {
+					t.Errorf("expected option %s on the staging mount, got %v", opt, mounted[0].Opts)
+				}
+			}
+
+			if resized := len(resizer.resized) > 0; resized != test.resized {
+				t.Errorf("expected resized %v, got %v", test.resized, resized)
+			}
+
+			remounted := fe.ran("mount")
+			if staged, _ := node.staged.get("c56c7b6e-15c2-445e-9a5d-1063ab5828ec"); staged.ReadOnly != test.stagedReadOnly ||
+				staged.pinned != test.stagedReadOnly || (remounted != nil) != test.stagedReadOnly {
+				t.Errorf("expected the staging mount read-only %v, got %v after remounting with %v", test.stagedReadOnly, staged.ReadOnly, remounted)
+			}
+
+			for cmd, args := range test.ran {
+				if args != nil {
+					args = append(args, device)
+				}
+				if ran := fe.ran(cmd); !reflect.DeepEqual(ran, args) {
+					t.Errorf("expected %s %v, got %v", cmd, args, ran)
+				}
+			}
+		})
+	}
+}
+
+func TestNodeUnstageVolumeReferenced(t *testing.T) {
+	for _, force := range []bool{false, true} {
+		t.Run(fmt.Sprintf("force %v", force), func(t *testing.T) {
+			staging := filepath.Join(t.TempDir(), "staging")
+			target := filepath.Join(t.TempDir(), "target")
+			for _, dir := range []string{staging, target} {
+				if err := os.MkdirAll(dir, mkDirMode); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			mounter := newFakeMounter([]mount.MountPoint{
+				{Device: "/dev/vdb", Path: staging, Type: fsTypeExt4},
+				{Device: staging, Path: target, Type: fsTypeExt4, Opts: []string{"bind"}},
+			})
+			node := NewVultrNodeDriver(&VultrDriver{
+				log:                 logrus.NewEntry(logrus.New()),
+				mounter:             mounter,
+				unstageForceUnmount: force,
+			})
+
+			_, err := node.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+				VolumeId:          "block",
+				StagingTargetPath: staging,
+			})
+			if !force {
+				if status.Code(err) != codes.FailedPrecondition {
+					t.Fatalf("expected FailedPrecondition while a target references the staging path, got %v", err)
+				}
+				if len(mounter.MountPoints) != 2 {
+					t.Errorf("expected nothing to be unmounted, got %+v", mounter.MountPoints)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected the referencing target to be unmounted, got %v", err)
+			}
+			if len(mounter.MountPoints) != 0 {
+				t.Errorf("expected the target and staging path to be unmounted, got %+v", mounter.MountPoints)
+			}
+		})
+	}
+}
+
+func TestCompletePendingExpansion(t *testing.T) {
+	device := filepath.Join(t.TempDir(), "device")
+	if err := os.WriteFile(device, nil, mkFileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		device  string
+		options []string
+		resizer *fakeResizer
+		resized bool
+		code    codes.Code
+	}{
+		{name: "grown", device: device, resizer: &fakeResizer{needResize: true}, resized: true},
+		{name: "not needed", device: device, resizer: &fakeResizer{}},
+		{name: "read-only", device: device, options: []string{"ro"}, resizer: &fakeResizer{needResize: true}},
+		{name: "device gone", device: device + "-gone", resizer: &fakeResizer{needResize: true}},
+		{name: "not grown", device: device, resizer: &fakeResizer{needResize: true, stuck: true}, resized: true, code: codes.Internal},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := NewVultrNodeDriver(&VultrDriver{log: logrus.NewEntry(logrus.New()), resizer: test.resizer, exec: &fakeExec{}})
+
+			err := node.completePendingExpansion(context.Background(), node.Driver.log, "vol-1", test.device, t.TempDir(), test.options)
+			if status.Code(err) != test.code {
+				t.Fatalf("expected %v, got %v", test.code, err)
+			}
+			if resized := len(test.resizer.resized) > 0; resized != test.resized {
+				t.Errorf("expected resized %v, got %v", test.resized, resized)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// nodeMaxVolumesLabel is the label of the Kubernetes Node holding the number of
+	// volumes the node reports it can attach, after the driver name
+	nodeMaxVolumesLabel = "max-volumes"
+
+	// nodeStagedVolumesAnnotation is the annotation of the Kubernetes Node holding the
+	// number of volumes staged on it, after the driver name
+	nodeStagedVolumesAnnotation = "staged-volumes"
+)
+
+// WithNodeLabels labels the Kubernetes Node of the node plugin with the number of volumes
+// it can attach, and annotates it with the number of volumes staged, every interval. The
+// Node is kubeNodeName, or the hostname of the node plugin when empty. 0 disables.
+func WithNodeLabels(interval time.Duration, kubeNodeName string) Option {
+	return func(d *VultrDriver) {
+		d.nodeLabelsInterval = interval
+		d.kubeNodeName = kubeNodeName
+	}
+}
+
+// nodeLabelPublisher keeps the label and annotation of the Kubernetes Node current, for
+// scheduling constraints and dashboards to build on the attach limit of the instance,
+// which the CSINode object only reports to the scheduler
+type nodeLabelPublisher struct {
+	node       *VultrNodeServer
+	kube       kubeAPI
+	path       string
+	label      string
+	annotation string
+	interval   time.Duration
+	log        *logrus.Entry
+
+	// maxVolumes is the attach limit, looked up once as the plan of an instance is fixed
+	maxVolumes int64
+	// published is the label and annotation last published, empty before the first patch
+	published string
+}
+
+func newNodeLabelPublisher(n *VultrNodeServer) (*nodeLabelPublisher, error) {
+	kube, err := newInClusterKubeAPI(n.Driver.nodeLabelsInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	name := n.Driver.kubeNodeName
+	if name == "" {
+		if name, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("cannot get the name of the node: %w", err)
+		}
+	}
+
+	return newKubeNodeLabelPublisher(n, kube, name), nil
+}
+
+func newKubeNodeLabelPublisher(n *VultrNodeServer, kube kubeAPI, nodeName string) *nodeLabelPublisher {
+	return &nodeLabelPublisher{
+		node:       n,
+		kube:       kube,
+		path:       "/api/v1/nodes/" + url.PathEscape(nodeName),
+		label:      n.Driver.name + "/" + nodeMaxVolumesLabel,
+		annotation: n.Driver.name + "/" + nodeStagedVolumesAnnotation,
+		interval:   n.Driver.nodeLabelsInterval,
+		log:        n.Driver.log.WithFields(logrus.Fields{"loop": "node_labels", "node": nodeName}),
+	}
+}
+
+// run publishes the label and annotation every interval until ctx is done
+func (p *nodeLabelPublisher) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.publish(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publish patches the Node when the attach limit or the number of staged volumes changed
+// since it was last patched
+func (p *nodeLabelPublisher) publish(ctx context.Context) {
+	if p.maxVolumes == 0 {
+		p.maxVolumes = p.node.maxVolumesPerNode(ctx)
+	}
+	maxVolumes := strconv.FormatInt(p.maxVolumes, 10)
+	staged := strconv.Itoa(len(p.node.staged.list()))
+
+	if published := maxVolumes + "/" + staged; published != p.published {
+		err := p.kube.mergePatch(ctx, p.path, map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels":      map[string]string{p.label: maxVolumes},
+				"annotations": map[string]string{p.annotation: staged},
+			},
+		})
+		if err != nil {
+			p.log.Warnf("cannot label the node: %v", err)
+			return
+		}
+
+		p.log.WithFields(logrus.Fields{
+			"max_volumes":    maxVolumes,
+			"staged_volumes": staged,
+		}).Debug("labeled the node")
+		p.published = published
+	}
+}
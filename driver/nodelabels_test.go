@@ -0,0 +1,63 @@
+package driver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestNodeLabelPublisher(t *testing.T) {
+	var (
+		patches []string
+		fail    bool
+	)
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || r.URL.Path != "/api/v1/nodes/worker-1" {
+			http.Error(w, "unexpected request", http.StatusForbidden)
+			return
+		}
+		if fail {
+			http.Error(w, "nodes is forbidden", http.StatusForbidden)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		patches = append(patches, string(body))
+		w.Write([]byte(`{}`)) //nolint:errcheck
+	}))
+	defer api.Close()
+
+	node := NewVultrNodeDriver(&VultrDriver{
+		name:              "block.csi.vultr.com",
+		log:               logrus.NewEntry(logrus.New()),
+		maxVolumesPerNode: 9,
+	})
+	p := newKubeNodeLabelPublisher(node, kubeAPI{client: api.Client(), apiURL: api.URL}, "worker-1")
+	ctx := context.Background()
+
+	p.publish(ctx)
+	expected := `{"metadata":{"annotations":{"block.csi.vultr.com/staged-volumes":"0"},"labels":{"block.csi.vultr.com/max-volumes":"9"}}}`
+	if len(patches) != 1 || patches[0] != expected {
+		t.Fatalf("expected the node to be labeled with %s, got %v", expected, patches)
+	}
+
+	p.publish(ctx)
+	if len(patches) != 1 {
+		t.Errorf("expected no patch while nothing changed, got %v", patches)
+	}
+
+	// a failed patch is made again on the next publish
+	node.staged.stage("vol-1", "/staging/vol-1", "/dev/vdb", fsTypeExt4)
+	fail = true
+	p.publish(ctx)
+	fail = false
+	p.publish(ctx)
+	expected = `{"metadata":{"annotations":{"block.csi.vultr.com/staged-volumes":"1"},"labels":{"block.csi.vultr.com/max-volumes":"9"}}}`
+	if len(patches) != 2 || patches[1] != expected {
+		t.Errorf("expected the staged volume to be annotated with %s, got %v", expected, patches)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	orphanedVolumes = metrics.newGauge("orphaned_volumes",
+		"Number of volumes whose deletion failed and which still exist in Vultr", "storage_type")
+	orphanedVolumeBytes = metrics.newGauge("orphaned_volume_bytes",
+		"Size of the volumes whose deletion failed and which still exist in Vultr", "storage_type")
+	orphanedVolumeInfo = metrics.newGauge("orphaned_volume_failed_timestamp_seconds",
+		"Unix time at which deletion of an orphaned volume first failed", "volume_id", "storage_type", "label")
+)
+
+// orphanedVolume is a volume the CO asked to delete which is still billed in Vultr
+type orphanedVolume struct {
+	VolumeID    string
+	StorageType string
+	Label       string
+	SizeBytes   int64
+	FailedAt    time.Time
+	Error       string
+}
+
+// orphanTracker records volumes whose deletion failed. Once the CO gives up on a
+// deletion the volume is no longer referenced by any PV but still costs money, so the
+// orphans stay exported until a deletion succeeds or the volume is found to be gone.
+type orphanTracker struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	volumes map[string]*orphanedVolume
+}
+
+func newOrphanTracker() *orphanTracker {
+	return &orphanTracker{
+		now:     time.Now,
+		volumes: make(map[string]*orphanedVolume),
+	}
+}
+
+// failed records that deleting vol failed with err
+func (t *orphanTracker) failed(vol *backendVolume, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if o, ok := t.volumes[vol.ID]; ok {
+		o.Error = err.Error()
+		return
+	}
+
+	o := &orphanedVolume{
+		VolumeID:    vol.ID,
+		StorageType: vol.StorageType,
+		Label:       vol.Label,
+		SizeBytes:   vol.SizeBytes,
+		FailedAt:    t.now(),
+		Error:       err.Error(),
+	}
+	t.volumes[vol.ID] = o
+
+	orphanedVolumes.add(1, o.StorageType)
+	orphanedVolumeBytes.add(float64(o.SizeBytes), o.StorageType)
+	orphanedVolumeInfo.set(float64(o.FailedAt.Unix()), o.VolumeID, o.StorageType, o.Label)
+}
+
+// deleted forgets the volume once it no longer exists
+func (t *orphanTracker) deleted(volumeID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.forget(volumeID)
+}
+
+// prune forgets the orphans missing from volumes, a complete listing of the account
+func (t *orphanTracker) prune(volumes []backendVolume) {
+	exists := make(map[string]bool, len(volumes))
+	for i := range volumes {
+		exists[volumes[i].ID] = true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id := range t.volumes {
+		if !exists[id] {
+			t.forget(id)
+		}
+	}
+}
+
+func (t *orphanTracker) forget(volumeID string) {
+	o, ok := t.volumes[volumeID]
+	if !ok {
+		return
+	}
+	delete(t.volumes, volumeID)
+
+	orphanedVolumes.add(-1, o.StorageType)
+	orphanedVolumeBytes.add(-float64(o.SizeBytes), o.StorageType)
+	orphanedVolumeInfo.remove(o.VolumeID, o.StorageType, o.Label)
+}
+
+// get returns the orphan record of the volume, nil when its deletion has not failed
+func (t *orphanTracker) get(volumeID string) *orphanedVolume {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	o, ok := t.volumes[volumeID]
+	if !ok {
+		return nil
+	}
+	c := *o
+	return &c
+}
+
+// message describes the failed deletion for operators
+func (o *orphanedVolume) message() string {
+	return fmt.Sprintf("deletion failed since %s, %dGB still billed: %s",
+		o.FailedAt.UTC().Format(time.RFC3339), o.SizeBytes/giB, o.Error)
+}
@@ -0,0 +1,43 @@
+package driver
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestOrphanTracker(t *testing.T) {
+	orphans := newOrphanTracker()
+	vol := &backendVolume{ID: "orphan-1", StorageType: storageTypeBlock, Label: "pvc-orphan", SizeBytes: 10 * giB}
+
+	orphans.failed(vol, errors.New("server error"))
+	orphans.failed(vol, errors.New("still failing"))
+
+	if o := orphans.get(vol.ID); o == nil || o.Error != "still failing" {
+		t.Fatalf("expected the orphan to be tracked with the last error, got %+v", o)
+	}
+
+	var buf bytes.Buffer
+	if err := orphanedVolumeInfo.write(&buf); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !strings.Contains(buf.String(), `volume_id="orphan-1",storage_type="block",label="pvc-orphan"`) {
+		t.Errorf("expected the orphan to be exported, got:\n%s", buf.String())
+	}
+
+	// a listing without the volume means it was deleted out of band
+	orphans.prune([]backendVolume{{ID: "other"}})
+
+	if o := orphans.get(vol.ID); o != nil {
+		t.Errorf("expected the orphan to be forgotten, got %+v", o)
+	}
+
+	buf.Reset()
+	if err := orphanedVolumeInfo.write(&buf); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if strings.Contains(buf.String(), "orphan-1") {
+		t.Errorf("expected the orphan series to be removed, got:\n%s", buf.String())
+	}
+}
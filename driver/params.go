@@ -0,0 +1,222 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// blockTypeParam is the StorageClass parameter selecting the block storage tier
+	blockTypeParam = "block_type"
+
+	// fsckParam is the StorageClass parameter enabling a filesystem check before staging
+	fsckParam = "fsck"
+
+	// fsckRepairParam is the StorageClass parameter letting the filesystem check repair
+	// damage instead of quarantining the volume
+	fsckRepairParam = "fsck_repair"
+
+	// fsTypeParam is the StorageClass parameter selecting the filesystem of volumes whose
+	// capability names none
+	fsTypeParam = "fs_type"
+
+	// mkfsOptionsParam is the StorageClass parameter holding extra mkfs arguments
+	mkfsOptionsParam = "mkfs_options"
+
+	// mountOptionsParam is the StorageClass parameter holding comma separated options the
+	// node stages block volumes with, before the mount flags of the capability
+	mountOptionsParam = "mount_options"
+
+	// wipePartitionsParam is the StorageClass parameter letting the node wipe the partition
+	// table of a volume partitioned by hand and format it whole
+	wipePartitionsParam = "wipe_partitions"
+
+	// reservedBlocksParam is the StorageClass parameter setting the percentage of an ext
+	// filesystem reserved for root
+	reservedBlocksParam = "reserved_blocks_percentage"
+
+	// maxVolumeSizeParam is the StorageClass parameter capping the size of its volumes, in GB
+	maxVolumeSizeParam = "max_volume_size_gb"
+
+	// encryptedParam is the StorageClass parameter encrypting the volume with LUKS2 on the node
+	encryptedParam = "encrypted"
+
+	// placementInstanceTagParam is the StorageClass parameter restricting volumes to the
+	// regions of the instances with the tag
+	placementInstanceTagParam = "placement_instance_tag"
+
+	// placementVPCParam is the StorageClass parameter restricting volumes to the region of the VPC
+	placementVPCParam = "placement_vpc"
+
+	// regionParam carries the region chosen from the topology requirements to the backend
+	regionParam = "region"
+
+	// maxReservedBlocksPercentage is the highest reserve tune2fs accepts
+	maxReservedBlocksPercentage = 50
+)
+
+// parameterKeyAliases maps accepted, lower cased, parameter names to their canonical name
+var parameterKeyAliases = map[string]string{
+	"fstype":                    fsTypeParam,
+	"csi.storage.k8s.io/fstype": fsTypeParam,
+
+	"mkfsoptions":   mkfsOptionsParam,
+	"formatoptions": mkfsOptionsParam,
+
+	"reservedblockspercentage": reservedBlocksParam,
+	"reserved_blocks":          reservedBlocksParam,
+
+	"mountoptions": mountOptionsParam,
+	"mountflags":   mountOptionsParam,
+	"mount_flags":  mountOptionsParam,
+
+	"vfsmountoptions": vfsMountOptionsParam,
+
+	"wipepartitions": wipePartitionsParam,
+}
+
+// boolParameters are the parameters which take a boolean, normalized to "true" or "false"
+var boolParameters = map[string]bool{
+	fsckParam:       true,
+	fsckRepairParam: true,
+	encryptedParam:  true,
+
+	wipePartitionsParam: true,
+}
+
+// parameterAliases maps the accepted, lower cased, values of enumerated
+// parameters to their canonical value
+var parameterAliases = map[string]map[string]string{
+	blockTypeParam: {
+		blockTypeNvme: blockTypeNvme,
+		"nvme":        blockTypeNvme,
+		blockTypeHDD:  blockTypeHDD,
+		"hdd":         blockTypeHDD,
+	},
+}
+
+// normalizeParameters returns a copy of the StorageClass parameters with keys
+// trimmed, lower cased and resolved from their aliases, values trimmed, and enumerated values resolved to
+// their canonical form. Keys which collide after normalization and unknown
+// enumerated values are rejected rather than silently falling back to defaults.
+func normalizeParameters(params map[string]string) (map[string]string, error) {
+	normalized := make(map[string]string, len(params))
+	original := make(map[string]string, len(params))
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		key := strings.ToLower(strings.TrimSpace(k))
+		if canonical, ok := parameterKeyAliases[key]; ok {
+			key = canonical
+		}
+		value := strings.TrimSpace(params[k])
+
+		if prev, ok := original[key]; ok {
+			return nil, fmt.Errorf("%w: parameters %q and %q are the same parameter", errInvalidParameter, prev, k)
+		}
+		original[key] = k
+
+		if key == storageTypeParam {
+			value = strings.ToLower(value)
+		}
+
+		if aliases, ok := parameterAliases[key]; ok && value != "" {
+			canonical, ok := aliases[strings.ToLower(value)]
+			if !ok {
+				return nil, fmt.Errorf("%w: parameter %q has unsupported value %q, supported values are %v",
+					errInvalidParameter, k, params[k], aliasValues(aliases))
+			}
+			value = canonical
+		}
+
+		if boolParameters[key] && value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: parameter %q has non boolean value %q", errInvalidParameter, k, params[k])
+			}
+			value = strconv.FormatBool(b)
+		}
+
+		if key == fsTypeParam && value != "" {
+			fsType, err := resolveFsType(value, "")
+			if err != nil {
+				return nil, fmt.Errorf("%w: parameter %q: %v", errInvalidParameter, k, err)
+			}
+			value = fsType
+		}
+
+		if key == reservedBlocksParam && value != "" {
+			pct, err := parseReservedBlocks(value)
+			if err != nil {
+				return nil, err
+			}
+			value = pct
+		}
+
+		// checked against the filesystem once CreateVolume resolves it
+		if key == mountOptionsParam && value != "" {
+			value = strings.Join(sanitizeMountFlags([]string{value}), ",")
+		}
+
+		if key == vfsMountOptionsParam && value != "" {
+			options := sanitizeMountFlags([]string{value})
+			if err := validateMountOptions(options, fsTypeVirtiofs); err != nil {
+				return nil, fmt.Errorf("%w: parameter %q: %v", errInvalidParameter, k, err)
+			}
+			value = strings.Join(options, ",")
+		}
+
+		if key == maxVolumeSizeParam && value != "" {
+			gb, err := parseVolumeSizeGB(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: parameter %q: %v", errInvalidParameter, k, err)
+			}
+			value = strconv.FormatInt(gb, 10)
+		}
+
+		normalized[key] = value
+	}
+
+	return normalized, nil
+}
+
+func aliasValues(aliases map[string]string) []string {
+	values := make([]string, 0, len(aliases))
+	for v := range aliases {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+
+	return values
+}
+
+// parseReservedBlocks validates a reserved blocks percentage, returning it formatted for tune2fs
+func parseReservedBlocks(value string) (string, error) {
+	pct, err := strconv.ParseFloat(value, 64)
+	if err != nil || pct < 0 || pct > maxReservedBlocksPercentage {
+		return "", fmt.Errorf("%w: parameter %q must be a percentage between 0 and %d, got %q",
+			errInvalidParameter, reservedBlocksParam, maxReservedBlocksPercentage, value)
+	}
+
+	return strconv.FormatFloat(pct, 'f', -1, 64), nil
+}
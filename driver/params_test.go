@@ -0,0 +1,142 @@
+package driver
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeParameters(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   map[string]string
+		expected map[string]string
+		wantErr  bool
+	}{
+		{
+			name:     "canonical values are kept",
+			params:   map[string]string{"block_type": "high_perf"},
+			expected: map[string]string{"block_type": "high_perf"},
+		},
+		{
+			name:     "keys and values are case and whitespace insensitive",
+			params:   map[string]string{" Block_Type ": " NVMe ", "Storage_Type": "BLOCK"},
+			expected: map[string]string{"block_type": "high_perf", "storage_type": "block"},
+		},
+		{
+			name:     "hdd alias",
+			params:   map[string]string{"block_type": "HDD"},
+			expected: map[string]string{"block_type": "storage_opt"},
+		},
+		{
+			name:    "unknown enumerated value",
+			params:  map[string]string{"block_type": "ssd"},
+			wantErr: true,
+		},
+		{
+			name:     "boolean values are canonical",
+			params:   map[string]string{"fsck": "True"},
+			expected: map[string]string{"fsck": "true"},
+		},
+		{
+			name:    "non boolean value",
+			params:  map[string]string{"fsck": "sometimes"},
+			wantErr: true,
+		},
+		{
+			name:     "mkfs options key aliases",
+			params:   map[string]string{"mkfsOptions": "-i 8192"},
+			expected: map[string]string{"mkfs_options": "-i 8192"},
+		},
+		{
+			name:    "non boolean wipe partitions",
+			params:  map[string]string{"wipePartitions": "please"},
+			wantErr: true,
+		},
+		{
+			name:     "wipe partitions",
+			params:   map[string]string{"wipePartitions": "TRUE"},
+			expected: map[string]string{"wipe_partitions": "true"},
+		},
+		{
+			name:    "colliding key aliases",
+			params:  map[string]string{"mkfsOptions": "-i 8192", "formatOptions": "-m 1"},
+			wantErr: true,
+		},
+		{
+			name:     "filesystem key aliases",
+			params:   map[string]string{"fsType": "XFS"},
+			expected: map[string]string{"fs_type": "xfs"},
+		},
+		{
+			name:     "kubernetes filesystem key",
+			params:   map[string]string{"csi.storage.k8s.io/fstype": "btrfs"},
+			expected: map[string]string{"fs_type": "btrfs"},
+		},
+		{
+			name:    "unsupported filesystem",
+			params:  map[string]string{"fsType": "zfs"},
+			wantErr: true,
+		},
+		{
+			name:     "reserved blocks percentage",
+			params:   map[string]string{"reservedBlocksPercentage": "0.50"},
+			expected: map[string]string{"reserved_blocks_percentage": "0.5"},
+		},
+		{
+			name:    "reserved blocks percentage out of range",
+			params:  map[string]string{"reserved_blocks_percentage": "75"},
+			wantErr: true,
+		},
+		{
+			name:     "mount options",
+			params:   map[string]string{"mountOptions": "discard, noatime,,discard"},
+			expected: map[string]string{"mount_options": "discard,noatime"},
+		},
+		{
+			name:     "vfs mount options",
+			params:   map[string]string{"vfsMountOptions": " dax=inode, ro,,dax=inode"},
+			expected: map[string]string{"vfs_mount_options": "dax=inode,ro"},
+		},
+		{
+			name:    "vfs mount options of block filesystems",
+			params:  map[string]string{"vfs_mount_options": "nouuid"},
+			wantErr: true,
+		},
+		{
+			name:     "maximum volume size",
+			params:   map[string]string{"max_volume_size_gb": " 0100 "},
+			expected: map[string]string{"max_volume_size_gb": "100"},
+		},
+		{
+			name:    "maximum volume size not in whole GB",
+			params:  map[string]string{"max_volume_size_gb": "1.5"},
+			wantErr: true,
+		},
+		{
+			name:    "colliding keys",
+			params:  map[string]string{"block_type": "hdd", "Block_Type": "nvme"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeParameters(tt.params)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidParameter) {
+					t.Errorf("expected invalid parameter error, got %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v got %v", tt.expected, got)
+			}
+		})
+	}
+}
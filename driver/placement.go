@@ -0,0 +1,84 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WithAllowedRegions restricts the regions volumes are provisioned in to a comma separated
+// list of region IDs, whatever the StorageClasses and the topology of the claims ask for.
+// Empty allows every region.
+func WithAllowedRegions(regions string) Option {
+	return func(d *VultrDriver) {
+		d.allowedRegionList = regions
+	}
+}
+
+// parseAllowedRegions returns the set of the regions of the list, nil when it is empty
+func parseAllowedRegions(list string) (map[string]bool, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+
+	regions := make(map[string]bool)
+	for _, region := range strings.Split(list, ",") {
+		region = strings.ToLower(strings.TrimSpace(region))
+		if region == "" {
+			return nil, fmt.Errorf("allowed regions %q list an empty region", list)
+		}
+		regions[region] = true
+	}
+	return regions, nil
+}
+
+// placementRegions returns the regions the placement parameters restrict volumes to,
+// those of the instances with the tag and of the VPC, or nil when none is set
+func (c *VultrControllerServer) placementRegions(ctx context.Context, rpc string, params map[string]string) (map[string]bool, error) { //nolint:lll
+	var regions map[string]bool
+
+	if tag := params[placementInstanceTagParam]; tag != "" {
+		tagged, err := c.cloud.InstanceTagRegions(ctx, tag)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "%s cannot list the instances tagged %q: %v", rpc, tag, err)
+		}
+		if len(tagged) == 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "%s no instance is tagged %q to place the volume next to", rpc, tag)
+		}
+		regions = tagged
+	}
+
+	if vpcID := params[placementVPCParam]; vpcID != "" {
+		region, err := c.cloud.VPCRegion(ctx, vpcID)
+		if err != nil {
+			if isNotFoundError(err) {
+				return nil, status.Errorf(codes.InvalidArgument, "%s VPC %s to place the volume in does not exist", rpc, vpcID)
+			}
+			return nil, status.Errorf(codes.Internal, "%s cannot look up VPC %s: %v", rpc, vpcID, err)
+		}
+
+		if regions != nil && !regions[region] {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"%s VPC %s is in region %s, where no instance is tagged %q", rpc, vpcID, region, params[placementInstanceTagParam])
+		}
+		regions = map[string]bool{region: true}
+	}
+
+	return regions, nil
+}
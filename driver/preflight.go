@@ -0,0 +1,101 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vultr/govultr/v3"
+)
+
+const (
+	// preflightTimeout bounds each Vultr API call of the startup credential check
+	preflightTimeout = 30 * time.Second
+
+	// aclSubscriptions lets the user of a token manage subscriptions, volumes included,
+	// rather than only view them
+	aclSubscriptions = "subscriptions"
+	// aclProvisioning lets the user of a token create subscriptions
+	aclProvisioning = "provisioning"
+)
+
+// CheckAPIAccess tells that the API token of a controller is valid and may manage block
+// storage before the driver serves any call, logging the account it belongs to, rather
+// than the first CreateVolume failing. Only a token the API rejects or a user without
+// the permissions volumes need fail it; the API being unreachable or failing is logged
+// and left to the retries of the RPCs.
+func (d *VultrDriver) CheckAPIAccess(ctx context.Context) error {
+	if !d.isController {
+		return nil
+	}
+
+	accountCtx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	account, resp, err := d.client.Account.Get(accountCtx) //nolint:bodyclose
+	cancel()
+	if err != nil {
+		return d.preflightFailure("read the Vultr account", resp, err)
+	}
+
+	fields := logrus.Fields{"account": account.Name, "email": account.Email}
+	if len(account.ACL) > 0 {
+		fields["acls"] = strings.Join(account.ACL, ",")
+	}
+	d.log.WithFields(fields).Info("Vultr API token is valid")
+
+	// the owner of an account may report no ACLs, having every permission
+	if len(account.ACL) > 0 {
+		if !hasOption(account.ACL, aclSubscriptions) {
+			return fmt.Errorf("the Vultr API token of %s is read-only: its user lacks the %q permission volumes are managed with, "+
+				"grant it in the Vultr customer portal under Account > Users", account.Email, aclSubscriptions)
+		}
+		if !hasOption(account.ACL, aclProvisioning) {
+			d.log.WithField("email", account.Email).Warnf("the user of the Vultr API token lacks the %q permission, "+
+				"creating volumes may fail", aclProvisioning)
+		}
+	}
+
+	blockCtx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	_, _, resp, err = d.client.BlockStorage.List(blockCtx, &govultr.ListOptions{PerPage: 1}) //nolint:bodyclose
+	cancel()
+	if err != nil {
+		return d.preflightFailure("list block storage", resp, err)
+	}
+	return nil
+}
+
+// preflightFailure returns an actionable error when the API rejected the token of the
+// check, logging any other failure and returning nil
+func (d *VultrDriver) preflightFailure(action string, resp *http.Response, err error) error {
+	code := 0
+	if resp != nil {
+		code = resp.StatusCode
+	}
+
+	switch code {
+	case http.StatusUnauthorized:
+		return fmt.Errorf("the Vultr API rejected the API token to %s: %v; check the token the driver is given, "+
+			"that it was not revoked, and that its access control allows the addresses of the cluster", action, err)
+	case http.StatusForbidden:
+		return fmt.Errorf("the Vultr API token may not %s: %v; grant its user the %q and %q permissions",
+			action, err, aclSubscriptions, aclProvisioning)
+	default:
+		d.log.WithError(err).Warnf("cannot %s to check the Vultr API token, continuing", action)
+		return nil
+	}
+}
@@ -0,0 +1,92 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vultr/govultr/v3"
+
+	"github.com/vultr/vultr-csi/internal/fakevultr"
+)
+
+func newPreflightDriver(t *testing.T, handler http.Handler) *VultrDriver {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	client := govultr.NewClient(srv.Client())
+	if err := client.SetBaseURL(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	client.SetRetryLimit(0)
+
+	return &VultrDriver{isController: true, client: client, log: logrus.NewEntry(logrus.New())}
+}
+
+func TestCheckAPIAccess(t *testing.T) {
+	api := fakevultr.New()
+	d := newPreflightDriver(t, api)
+
+	if err := d.CheckAPIAccess(context.Background()); err != nil {
+		t.Errorf("expected a token of the account owner to pass, got %v", err)
+	}
+
+	api.SetACL("subscriptions_view", "dns")
+	err := d.CheckAPIAccess(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Errorf("expected a user only viewing subscriptions to fail as read-only, got %v", err)
+	}
+
+	api.SetACL("subscriptions")
+	if err := d.CheckAPIAccess(context.Background()); err != nil {
+		t.Errorf("expected a user without provisioning to only be warned about, got %v", err)
+	}
+
+	if err := (&VultrDriver{}).CheckAPIAccess(context.Background()); err != nil {
+		t.Errorf("expected a node without a token to skip the check, got %v", err)
+	}
+}
+
+func TestCheckAPIAccessFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		account  int
+		blocks   int
+		expected string
+	}{
+		{name: "invalid token", account: http.StatusUnauthorized, expected: "rejected the API token"},
+		{name: "no block storage access", account: http.StatusOK, blocks: http.StatusForbidden, expected: "may not list block storage"},
+		{name: "unavailable API", account: http.StatusServiceUnavailable},
+		{name: "failing block storage", account: http.StatusOK, blocks: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newPreflightDriver(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				code := tt.account
+				if strings.HasPrefix(r.URL.Path, "/v2/blocks") {
+					code = tt.blocks
+				}
+				w.WriteHeader(code)
+				if code == http.StatusOK {
+					w.Write([]byte(`{"account":{"name":"test"}}`)) //nolint:errcheck
+				} else {
+					w.Write([]byte(`{"error":"failed"}`)) //nolint:errcheck
+				}
+			}))
+
+			err := d.CheckAPIAccess(context.Background())
+			switch {
+			case tt.expected == "" && err != nil:
+				t.Errorf("expected an API failure not to fail the check, got %v", err)
+			case tt.expected != "" && (err == nil || !strings.Contains(err.Error(), tt.expected)):
+				t.Errorf("expected an error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
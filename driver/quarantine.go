@@ -0,0 +1,231 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// quarantineEventReason is the reason of the events posted on the claims of quarantined volumes
+	quarantineEventReason = "FilesystemQuarantined"
+
+	// quarantineEventTimeout bounds looking up the claim and posting its event
+	quarantineEventTimeout = 10 * time.Second
+)
+
+var quarantinedVolumes = metrics.newGauge("quarantined_volumes",
+	"Number of volumes the node refuses to mount since their filesystem was found corrupt")
+
+var quarantineEventsPosted = metrics.newCounter("quarantine_events_total",
+	"Number of Kubernetes events posted on the claims of quarantined volumes, by result", "result")
+
+// quarantinedVolume is a volume whose filesystem was found corrupt at stage
+type quarantinedVolume struct {
+	VolumeID string    `json:"volume_id"`
+	Reason   string    `json:"reason"`
+	Since    time.Time `json:"since"`
+	// Repair is set once an operator asked for the filesystem to be repaired at the next stage
+	Repair bool `json:"repair"`
+}
+
+// volumeQuarantine holds the volumes the node refuses to mount. A volume found corrupt
+// stays quarantined whatever its fsck setting until a check passes, which needs the
+// repair an operator opts into, so that kubelet retries never mount damaged data. The
+// quarantine is kept in memory only and lost when the node plugin restarts.
+type volumeQuarantine struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	volumes map[string]*quarantinedVolume
+}
+
+func newVolumeQuarantine() *volumeQuarantine {
+	return &volumeQuarantine{
+		now:     time.Now,
+		volumes: make(map[string]*quarantinedVolume),
+	}
+}
+
+// add quarantines the volume, keeping the time it was first found corrupt
+func (q *volumeQuarantine) add(volumeID, reason string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if v, ok := q.volumes[volumeID]; ok {
+		v.Reason, v.Repair = reason, false
+		return
+	}
+
+	q.volumes[volumeID] = &quarantinedVolume{VolumeID: volumeID, Reason: reason, Since: q.now()}
+	quarantinedVolumes.set(float64(len(q.volumes)))
+}
+
+// get returns a copy of the quarantine of the volume
+func (q *volumeQuarantine) get(volumeID string) (quarantinedVolume, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	v, ok := q.volumes[volumeID]
+	if !ok {
+		return quarantinedVolume{}, false
+	}
+	return *v, true
+}
+
+// repair marks the quarantined volume to be repaired at its next stage, reporting
+// false when it is not quarantined
+func (q *volumeQuarantine) repair(volumeID string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	v, ok := q.volumes[volumeID]
+	if ok {
+		v.Repair = true
+	}
+	return ok
+}
+
+// release lets the node mount the volume again, reporting false when it was not quarantined
+func (q *volumeQuarantine) release(volumeID string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	_, ok := q.volumes[volumeID]
+	delete(q.volumes, volumeID)
+	quarantinedVolumes.set(float64(len(q.volumes)))
+	return ok
+}
+
+// list returns the quarantined volumes ordered by volume ID
+func (q *volumeQuarantine) list() []quarantinedVolume {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	volumes := make([]quarantinedVolume, 0, len(q.volumes))
+	for _, v := range q.volumes {
+		volumes = append(volumes, *v)
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].VolumeID < volumes[j].VolumeID
+	})
+	return volumes
+}
+
+// checkStagedFilesystem checks the filesystem on source before the volume is staged,
+// quarantining the volume when damage is left behind. A quarantined volume is refused
+// until it is repaired, either by the StorageClass fsck_repair parameter, which also
+// repairs damage as soon as it is found, or by an operator through the admin API.
+func (n *VultrNodeServer) checkStagedFilesystem(ctx context.Context, volumeID, source string, readOnly bool, volCtx map[string]string) error { //nolint:lll
+	log := requestLogger(ctx, n.Driver.log).WithFields(logrus.Fields{
+		"volume": volumeID,
+		"device": source,
+	})
+
+	q, quarantined := n.quarantine.get(volumeID)
+	autoRepair := fsckRepairEnabled(volCtx)
+
+	if quarantined && !q.Repair && !autoRepair {
+		return status.Errorf(codes.FailedPrecondition,
+			"NodeStageVolume volume %s is quarantined since %s as its filesystem is corrupt: %s; "+
+				"set the fsck_repair StorageClass parameter or request a repair through the admin API to repair it",
+			volumeID, q.Since.Format(time.RFC3339), q.Reason)
+	}
+
+	if !quarantined && !n.fsckEnabled(volCtx) {
+		return nil
+	}
+
+	// a quarantined volume only gets here once a repair was asked for
+	err := n.checkFilesystem(ctx, source, readOnly, quarantined)
+	if status.Code(err) == codes.DataLoss && !quarantined && autoRepair {
+		log.Warnf("Node Stage Volume: repairing damaged filesystem: %v", err)
+		err = n.checkFilesystem(ctx, source, readOnly, true)
+	}
+
+	if status.Code(err) == codes.DataLoss {
+		reason := status.Convert(err).Message()
+		n.quarantine.add(volumeID, reason)
+
+		log.Errorf("Node Stage Volume: volume quarantined: %s", reason)
+		go n.postQuarantineEvent(log, volumeID, reason, volCtx)
+		return status.Errorf(codes.DataLoss, "NodeStageVolume volume %s is quarantined: %s", volumeID, reason)
+	}
+	if err != nil {
+		return err
+	}
+
+	if quarantined {
+		n.quarantine.release(volumeID)
+		log.Info("Node Stage Volume: volume repaired and released from quarantine")
+	}
+
+	return nil
+}
+
+// fsckRepairEnabled reports whether the StorageClass of the volume opted into repairing
+// damaged filesystems at stage
+func fsckRepairEnabled(volCtx map[string]string) bool {
+	repair, err := strconv.ParseBool(volCtx[volumeContextFsckRepair])
+	return err == nil && repair
+}
+
+// postQuarantineEvent posts a Warning event on the claim of the quarantined volume, so
+// that users see why their pod does not start without reading the node plugin logs. The
+// claim is the one of the volume context, or else the one bound to the volume.
+func (n *VultrNodeServer) postQuarantineEvent(log *logrus.Entry, volumeID, reason string, volCtx map[string]string) {
+	if n.kube == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), quarantineEventTimeout)
+	defer cancel()
+
+	claim := kubeClaim{Namespace: volCtx[volumeContextPVCNamespace], Name: volCtx[volumeContextPVCName]}
+	if claim.Name == "" || claim.Namespace == "" {
+		claims, err := n.kube.boundClaims(ctx, n.Driver.name)
+		if err != nil {
+			log.Warnf("cannot list persistent volumes: %v", err)
+			quarantineEventsPosted.add(1, "failed")
+			return
+		}
+		var ok bool
+		if claim, ok = claims[volumeID]; !ok {
+			log.Debug("volume is quarantined but no claim is bound to the volume")
+			return
+		}
+	}
+
+	message := fmt.Sprintf("filesystem of volume %s is quarantined on node %s as it is corrupt: %s; "+
+		"set the fsck_repair StorageClass parameter or request a repair through the admin API of the node",
+		volumeID, n.Driver.nodeID, reason)
+	if err := n.kube.warnClaim(ctx, claim, quarantineEventReason, message, n.Driver.name, n.Driver.nodeID); err != nil {
+		log.Warnf("cannot post quarantine event: %v", err)
+		quarantineEventsPosted.add(1, "failed")
+		return
+	}
+
+	log.WithField("claim", claim.Namespace+"/"+claim.Name).Info("posted quarantine event")
+	quarantineEventsPosted.add(1, "posted")
+}
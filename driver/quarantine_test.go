@@ -0,0 +1,150 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckStagedFilesystemQuarantine(t *testing.T) {
+	const volumeID = "c56c7b6e-15c2-445e-9a5d-1063ab5828ec"
+
+	fe := &fakeExec{
+		outputs:   map[string]string{"blkid": "TYPE=" + fsTypeExt4},
+		exitCodes: map[string]int{"e2fsck": 4},
+	}
+	node := newFakeMountNode(fe)
+	check := func(volCtx map[string]string) error {
+		fe.run = nil
+		return node.checkStagedFilesystem(context.Background(), volumeID, "/dev/vdb", false, volCtx)
+	}
+
+	if err := check(map[string]string{volumeContextFsck: "true"}); status.Code(err) != codes.DataLoss {
+		t.Fatalf("expected DataLoss for a damaged filesystem, got %v", err)
+	}
+	if _, ok := node.quarantine.get(volumeID); !ok {
+		t.Fatal("expected the damaged volume to be quarantined")
+	}
+	if condition := node.abnormalCondition(volumeID, "/staging"); condition == nil || !condition.Abnormal {
+		t.Errorf("expected the quarantined volume to be abnormal, got %v", condition)
+	}
+
+	// turning the check off does not let the damaged data be mounted
+	if err := check(map[string]string{volumeContextFsck: "false"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition for a quarantined volume, got %v", err)
+	}
+	if args := fe.ran("e2fsck"); args != nil {
+		t.Errorf("expected no check of a quarantined volume, got e2fsck %v", args)
+	}
+
+	node.quarantine.repair(volumeID)
+	delete(fe.exitCodes, "e2fsck")
+	if err := check(nil); err != nil {
+		t.Fatalf("expected the repair to succeed, got %v", err)
+	}
+	if args := fe.ran("e2fsck"); !reflect.DeepEqual(args, []string{"-f", "-y", "/dev/vdb"}) {
+		t.Errorf("expected e2fsck -f -y /dev/vdb, got %v", args)
+	}
+	if _, ok := node.quarantine.get(volumeID); ok {
+		t.Error("expected the repaired volume to be released")
+	}
+}
+
+func TestQuarantineEvent(t *testing.T) {
+	events := make(chan kubeEvent, 10)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/persistentvolumes":
+			w.Write([]byte(`{"items":[` + //nolint:errcheck
+				`{"spec":{"csi":{"driver":"block.csi.vultr.com","volumeHandle":"vol-2"},` +
+				`"claimRef":{"namespace":"db","name":"wal"}},"status":{"phase":"Bound"}}]}`))
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/"):
+			w.Write([]byte(`{"metadata":{"uid":"claim-uid"}}`)) //nolint:errcheck
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/events"):
+			var event kubeEvent
+			if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			events <- event
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`)) //nolint:errcheck
+		default:
+			http.Error(w, "unexpected request", http.StatusForbidden)
+		}
+	}))
+	defer api.Close()
+
+	fe := &fakeExec{
+		outputs:   map[string]string{"blkid": "TYPE=" + fsTypeExt4},
+		exitCodes: map[string]int{"e2fsck": 4},
+	}
+	node := newFakeMountNode(fe)
+	node.Driver.name, node.Driver.nodeID = "block.csi.vultr.com", "node-1"
+	node.kube = &kubeAPI{client: api.Client(), apiURL: api.URL}
+
+	expectEvent := func(claim string) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.Reason != quarantineEventReason || event.Type != "Warning" || event.InvolvedObject.UID != "claim-uid" {
+				t.Errorf("expected a warning on the claim, got %+v", event)
+			}
+			if got := event.InvolvedObject.Namespace + "/" + event.InvolvedObject.Name; got != claim {
+				t.Errorf("expected the event on claim %s, got %s", claim, got)
+			}
+			if !strings.Contains(event.Message, "quarantined on node node-1") {
+				t.Errorf("expected the node in the message, got %q", event.Message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected an event to be posted")
+		}
+	}
+
+	volCtx := map[string]string{volumeContextFsck: "true", volumeContextPVCNamespace: "app", volumeContextPVCName: "data"}
+	if err := node.checkStagedFilesystem(context.Background(), "vol-1", "/dev/vdb", false, volCtx); status.Code(err) != codes.DataLoss {
+		t.Fatalf("expected DataLoss for a damaged filesystem, got %v", err)
+	}
+	expectEvent("app/data")
+
+	// without the claim in the volume context, the event goes to the claim bound to the volume
+	volCtx = map[string]string{volumeContextFsck: "true"}
+	if err := node.checkStagedFilesystem(context.Background(), "vol-2", "/dev/vdb", false, volCtx); status.Code(err) != codes.DataLoss {
+		t.Fatalf("expected DataLoss for a damaged filesystem, got %v", err)
+	}
+	expectEvent("db/wal")
+}
+
+func TestCheckStagedFilesystemRepair(t *testing.T) {
+	fe := &fakeExec{
+		outputs:   map[string]string{"blkid": "TYPE=" + fsTypeXFS},
+		exitCodes: map[string]int{"xfs_repair -n /dev/vdb": 1},
+	}
+	node := newFakeMountNode(fe)
+
+	volCtx := map[string]string{volumeContextFsck: "true", volumeContextFsckRepair: "true"}
+	if err := node.checkStagedFilesystem(context.Background(), "vol-1", "/dev/vdb", false, volCtx); err != nil {
+		t.Fatalf("expected the damage to be repaired, got %v", err)
+	}
+
+	var runs [][]string
+	for _, run := range fe.run {
+		if run[0] == "xfs_repair" {
+			runs = append(runs, run[1:])
+		}
+	}
+	if expected := [][]string{{"-n", "/dev/vdb"}, {"/dev/vdb"}}; !reflect.DeepEqual(runs, expected) {
+		t.Errorf("expected a check then a repair %v, got %v", expected, runs)
+	}
+	if _, ok := node.quarantine.get("vol-1"); ok {
+		t.Error("expected the repaired volume not to be quarantined")
+	}
+}
@@ -0,0 +1,285 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultAPIRequestRate is how many Vultr API requests per second the driver sends at most
+	DefaultAPIRequestRate = 10
+	// DefaultAPIRequestBurst is how many Vultr API requests the driver may send at once
+	// after being idle
+	DefaultAPIRequestBurst = 20
+	// DefaultAPIThrottleThreshold is how long the Vultr API throttles the driver before
+	// controller RPCs fail fast with Unavailable
+	DefaultAPIThrottleThreshold = 30 * time.Second
+
+	// defaultThrottlePause is how long requests are held off after a 429 with no hint of when to retry
+	defaultThrottlePause = time.Second
+)
+
+var (
+	apiThrottled = metrics.newGauge("api_throttled",
+		"Whether the Vultr API is throttling the driver")
+	apiThrottledTotal = metrics.newCounter("api_throttled_total",
+		"Number of Vultr API responses throttling the driver")
+	apiRequestWait = metrics.newHistogram("api_request_wait_seconds",
+		"Time Vultr API requests waited on the request limiter of the driver", defaultDurationBuckets)
+)
+
+// apiRequestLimiter paces the requests of the driver to the Vultr API with a token
+// bucket shared by every RPC and background loop. A 429 holds off all requests until
+// the time its headers name, and while the API keeps throttling for longer than the
+// threshold controller RPCs fail fast with Unavailable, so the sidecars back off with
+// their own retries instead of piling onto the limiter.
+type apiRequestLimiter struct {
+	rate      float64
+	burst     float64
+	threshold time.Duration
+	log       *logrus.Entry
+	now       func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	// pausedUntil is when the API said requests may resume
+	pausedUntil time.Time
+	// throttledSince and lastThrottled bound the ongoing run of 429s, zero without one
+	throttledSince time.Time
+	lastThrottled  time.Time
+}
+
+// newAPIRequestLimiter returns a limiter sending rate requests per second, up to burst at
+// once. A rate of 0 only honours the pauses the API asks for.
+func newAPIRequestLimiter(rate float64, burst int, threshold time.Duration, log *logrus.Entry) *apiRequestLimiter {
+	return &apiRequestLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		threshold: threshold,
+		log:       log,
+		now:       time.Now,
+		tokens:    float64(burst),
+	}
+}
+
+// transport returns an http.RoundTripper sending each request, retries included,
+// through the limiter
+func (l *apiRequestLimiter) transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &limitedTransport{next: next, limiter: l}
+}
+
+type limitedTransport struct {
+	next    http.RoundTripper
+	limiter *apiRequestLimiter
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	for {
+		delay := t.limiter.reserve()
+		if delay <= 0 {
+			break
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+	apiRequestWait.observe(time.Since(start).Seconds())
+
+	resp, err := t.next.RoundTrip(req)
+	if err == nil {
+		t.limiter.observe(resp)
+	}
+	return resp, err
+}
+
+// reserve takes a token for a request, returning how long to wait before trying again
+// when there is none or the API asked to hold off
+func (l *apiRequestLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+	if l.rate <= 0 {
+		return 0
+	}
+
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// observe holds off requests for as long as a 429 asks, or until the rate limit window
+// resets once a response reports no request left in it, and ends the run of 429s on any
+// other response
+func (l *apiRequestLimiter) observe(resp *http.Response) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	delay, ok := throttleDelay(resp, now)
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if !ok {
+			delay = defaultThrottlePause
+		}
+		l.pause(now.Add(delay))
+		l.tokens = 0
+
+		// a 429 long after the last one starts a new run rather than sustaining a stale one
+		if l.throttledSince.IsZero() || now.Sub(l.lastThrottled) >= l.threshold {
+			l.throttledSince = now
+			l.log.WithField("retry_after", delay.String()).Warn("Vultr API is throttling the driver, holding off API calls")
+		}
+		l.lastThrottled = now
+		apiThrottledTotal.add(1)
+		apiThrottled.set(1)
+		return
+	}
+
+	if ok && remainingRequests(resp.Header) == 0 {
+		l.pause(now.Add(delay))
+		l.log.WithField("reset", delay.String()).Debug("Vultr API rate limit window used up, holding off API calls until it resets")
+	}
+
+	if !l.throttledSince.IsZero() && resp.StatusCode < http.StatusBadRequest {
+		l.log.WithField("throttled_for", now.Sub(l.throttledSince).String()).Info("Vultr API no longer throttles the driver")
+		l.throttledSince, l.lastThrottled = time.Time{}, time.Time{}
+		apiThrottled.set(0)
+	}
+}
+
+func (l *apiRequestLimiter) pause(until time.Time) {
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// check returns a retryable Unavailable error for rpc while the API has been throttling
+// the driver for longer than the threshold and still is
+func (l *apiRequestLimiter) check(rpc string) error {
+	if l == nil || l.threshold <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if l.throttledSince.IsZero() || l.lastThrottled.Sub(l.throttledSince) < l.threshold || now.Sub(l.lastThrottled) >= l.threshold {
+		return nil
+	}
+
+	retry := l.pausedUntil
+	if retry.Before(now) {
+		retry = now
+	}
+	return status.Errorf(codes.Unavailable, "%s: Vultr API has been throttling the driver since %s, retry after %s",
+		rpc, l.throttledSince.UTC().Format(time.RFC3339), retry.UTC().Format(time.RFC3339))
+}
+
+// throttleDelay returns how long the response asks requests to be held off for, from its
+// Retry-After header or the reset of its rate limit window, reporting whether it says
+func throttleDelay(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if seconds, err := strconv.ParseInt(v, 10, 64); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if at, err := http.ParseTime(v); err == nil {
+			return nonNegative(at.Sub(now)), true
+		}
+	}
+
+	for _, name := range []string{"RateLimit-Reset", "X-RateLimit-Reset"} {
+		v := strings.TrimSpace(resp.Header.Get(name))
+		if v == "" {
+			continue
+		}
+		seconds, err := strconv.ParseFloat(v, 64)
+		if err != nil || seconds < 0 {
+			continue
+		}
+
+		// the reset is either seconds from now or, past a year of them, a unix timestamp
+		if seconds > float64(365*24*time.Hour/time.Second) {
+			return nonNegative(time.Unix(int64(seconds), 0).Sub(now)), true
+		}
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+
+	return 0, false
+}
+
+// remainingRequests returns the requests left in the rate limit window of the response,
+// -1 when it does not say
+func remainingRequests(h http.Header) int {
+	for _, name := range []string{"RateLimit-Remaining", "X-RateLimit-Remaining"} {
+		if n, err := strconv.Atoi(strings.TrimSpace(h.Get(name))); err == nil {
+			return n
+		}
+	}
+	return -1
+}
+
+func nonNegative(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// checkAPI returns a retryable Unavailable error for rpc while the driver holds off the
+// Vultr API, because it is under maintenance, keeps failing or is throttling the driver,
+// or because another controller is the active one
+func (d *VultrDriver) checkAPI(rpc string) error {
+	if err := d.controllerLease.check(rpc); err != nil {
+		return err
+	}
+	if err := d.maintenance.check(rpc); err != nil {
+		return err
+	}
+	if err := d.apiBreaker.check(rpc); err != nil {
+		return err
+	}
+	return d.apiLimiter.check(rpc)
+}
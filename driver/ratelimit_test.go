@@ -0,0 +1,155 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAPIRequestLimiterTokenBucket(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newAPIRequestLimiter(2, 2, time.Minute, logrus.NewEntry(logrus.New()))
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if delay := l.reserve(); delay != 0 {
+			t.Fatalf("expected request %d of the burst to go at once, got %v", i, delay)
+		}
+	}
+	if delay := l.reserve(); delay != 500*time.Millisecond {
+		t.Errorf("expected to wait for the next token, got %v", delay)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if delay := l.reserve(); delay != 0 {
+		t.Errorf("expected the refilled token to be taken, got %v", delay)
+	}
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		l.reserve()
+	}
+	if delay := l.reserve(); delay == 0 {
+		t.Error("expected the tokens of an idle limiter to be capped at the burst")
+	}
+}
+
+func TestAPIRequestLimiterThrottling(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newAPIRequestLimiter(0, 0, time.Minute, logrus.NewEntry(logrus.New()))
+	l.now = func() time.Time { return now }
+
+	throttled := func(retryAfter string) *http.Response {
+		return &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{retryAfter}}}
+	}
+
+	l.observe(throttled("10"))
+	if delay := l.reserve(); delay != 10*time.Second {
+		t.Errorf("expected requests to be held off for the Retry-After, got %v", delay)
+	}
+	if err := l.check("CreateVolume"); err != nil {
+		t.Errorf("expected no error before the throttling is sustained, got %v", err)
+	}
+
+	now = now.Add(40 * time.Second)
+	l.observe(throttled("10"))
+	now = now.Add(40 * time.Second)
+	l.observe(throttled(now.Add(time.Minute).Format(http.TimeFormat)))
+	if delay := l.reserve(); delay != time.Minute {
+		t.Errorf("expected requests to be held off until the Retry-After date, got %v", delay)
+	}
+	if err := l.check("CreateVolume"); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable while the throttling is sustained, got %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if err := l.check("CreateVolume"); err != nil {
+		t.Errorf("expected no error once the API stopped throttling, got %v", err)
+	}
+
+	l.observe(throttled("1"))
+	if err := l.check("CreateVolume"); err != nil {
+		t.Errorf("expected a 429 long after the last one not to sustain the throttling, got %v", err)
+	}
+
+	now = now.Add(30 * time.Second)
+	l.observe(throttled("1"))
+	now = now.Add(40 * time.Second)
+	l.observe(throttled("1"))
+	if err := l.check("CreateVolume"); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable while the throttling is sustained, got %v", err)
+	}
+	l.observe(&http.Response{StatusCode: http.StatusOK, Header: http.Header{}})
+	if err := l.check("CreateVolume"); err != nil {
+		t.Errorf("expected a successful response to end the throttling, got %v", err)
+	}
+
+	l.observe(&http.Response{StatusCode: http.StatusOK, Header: http.Header{
+		"X-Ratelimit-Remaining": []string{"0"},
+		"X-Ratelimit-Reset":     []string{"3"},
+	}})
+	if delay := l.reserve(); delay != 3*time.Second {
+		t.Errorf("expected requests to be held off until the used up window resets, got %v", delay)
+	}
+
+	var disabled *apiRequestLimiter
+	if err := disabled.check("CreateVolume"); err != nil {
+		t.Errorf("expected no error without a limiter, got %v", err)
+	}
+}
+
+func TestLimitedTransport(t *testing.T) {
+	var requests int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer api.Close()
+
+	l := newAPIRequestLimiter(DefaultAPIRequestRate, DefaultAPIRequestBurst, time.Minute, logrus.NewEntry(logrus.New()))
+	client := &http.Client{Transport: l.transport(nil)}
+
+	get := func(ctx context.Context) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, api.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client.Do(req)
+	}
+
+	res, err := get(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	res.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := get(ctx); err == nil {
+		t.Error("expected a request held off past its deadline to fail")
+	}
+
+	start := time.Now()
+	res, err = get(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || time.Since(start) < 500*time.Millisecond {
+		t.Errorf("expected the request to be sent once the Retry-After passed, got %d after %v", res.StatusCode, time.Since(start))
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expected the held off requests not to reach the API, got %d requests", n)
+	}
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAPIRecordMaxBytes is the default size an API recording grows to before it is rotated
+	DefaultAPIRecordMaxBytes = 10 << 20
+
+	// maxRecordedBodyBytes is how much of each request and response body is kept
+	maxRecordedBodyBytes = 4 << 10
+
+	redactedValue = "***redacted***"
+)
+
+// sensitiveBodyKeys are the JSON keys whose values never reach a recording
+var sensitiveBodyKeys = []string{"password", "token", "secret", "api_key", "user_data", "ssh_key"}
+
+// apiExchange is a single recorded Vultr API request and its response
+type apiExchange struct {
+	Time         time.Time       `json:"time"`
+	Method       string          `json:"method"`
+	Path         string          `json:"path"`
+	Status       int             `json:"status,omitempty"`
+	DurationMS   int64           `json:"duration_ms"`
+	Error        string          `json:"error,omitempty"`
+	RequestBody  json.RawMessage `json:"request_body,omitempty"`
+	ResponseBody json.RawMessage `json:"response_body,omitempty"`
+}
+
+// apiRecorder is an http.RoundTripper which writes sanitized API exchanges as JSON lines
+// to a file, so users can attach an exact trace to bug reports. Once the file reaches
+// maxBytes it is rotated to path.1, keeping the recording bounded to twice maxBytes.
+type apiRecorder struct {
+	next     http.RoundTripper
+	path     string
+	maxBytes int64
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newAPIRecorder(next http.RoundTripper, path string, maxBytes int64) (*apiRecorder, error) {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	r := &apiRecorder{next: next, path: path, maxBytes: maxBytes}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *apiRecorder) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.file, r.size = f, info.Size()
+	return nil
+}
+
+// RoundTrip performs the request and records the exchange
+func (r *apiRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	exchange := apiExchange{
+		Time:   time.Now(),
+		Method: req.Method,
+		Path:   req.URL.Path,
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(buf.Bytes()))
+		exchange.RequestBody = sanitizeBody(bytes.NewReader(buf.Bytes()))
+	}
+
+	resp, err := r.next.RoundTrip(req)
+	exchange.DurationMS = time.Since(exchange.Time).Milliseconds()
+
+	if err != nil {
+		exchange.Error = err.Error()
+	} else {
+		exchange.Status = resp.StatusCode
+
+		var buf bytes.Buffer
+		if _, readErr := buf.ReadFrom(resp.Body); readErr == nil {
+			resp.Body.Close()
+			resp.Body = io.NopCloser(&buf)
+			exchange.ResponseBody = sanitizeBody(bytes.NewReader(buf.Bytes()))
+		}
+	}
+
+	r.write(&exchange)
+
+	return resp, err
+}
+
+// write appends the exchange, rotating the file once it is full. Recording is best
+// effort and never fails the API call.
+func (r *apiRecorder) write(exchange *apiExchange) {
+	line, err := json.Marshal(exchange)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return
+	}
+
+	if r.size+int64(len(line)) > r.maxBytes && r.size > 0 {
+		r.file.Close()
+		r.file = nil
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return
+		}
+		if err := r.open(); err != nil {
+			return
+		}
+	}
+
+	n, _ := r.file.Write(line)
+	r.size += int64(n)
+}
+
+// sanitizeBody returns the JSON body with sensitive values redacted, truncated to
+// maxRecordedBodyBytes. Bodies which are not JSON are recorded by size only.
+func sanitizeBody(body io.Reader) json.RawMessage {
+	data, err := io.ReadAll(body)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return summarizeBody(len(data), "non JSON body")
+	}
+
+	redacted, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return nil
+	}
+
+	if len(redacted) > maxRecordedBodyBytes {
+		return summarizeBody(len(redacted), "truncated: "+string(redacted[:maxRecordedBodyBytes]))
+	}
+
+	return redacted
+}
+
+func summarizeBody(size int, note string) json.RawMessage {
+	summary, _ := json.Marshal(map[string]interface{}{"bytes": size, "note": note})
+	return summary
+}
+
+func redactValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if isSensitiveKey(k) {
+				t[k] = redactedValue
+				continue
+			}
+			t[k] = redactValue(val)
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = redactValue(t[i])
+		}
+	}
+
+	return v
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveBodyKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package driver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAPIRecorder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"instance":{"id":"abc","default_password":"hunter2"}}`)) //nolint:errcheck
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "api.jsonl")
+	recorder, err := newAPIRecorder(nil, path, DefaultAPIRecordMaxBytes)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	client := &http.Client{Transport: recorder}
+
+	resp, err := client.Post(server.URL+"/v2/blocks", "application/json", strings.NewReader(`{"label":"pvc","api_key":"abc123"}`))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	resp.Body.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if strings.Contains(string(data), "hunter2") || strings.Contains(string(data), "abc123") {
+		t.Errorf("expected secrets to be redacted, got %s", data)
+	}
+
+	var exchange apiExchange
+	if err := json.Unmarshal(data, &exchange); err != nil {
+		t.Fatalf("expected a JSON line, got %s: %v", data, err)
+	}
+
+	if exchange.Method != http.MethodPost || exchange.Path != "/v2/blocks" || exchange.Status != http.StatusAccepted {
+		t.Errorf("unexpected exchange %+v", exchange)
+	}
+
+	if !strings.Contains(string(exchange.RequestBody), `"label":"pvc"`) {
+		t.Errorf("expected the request body to be kept, got %s", exchange.RequestBody)
+	}
+}
+
+func TestAPIRecorderRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.jsonl")
+	recorder, err := newAPIRecorder(nil, path, 100)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		recorder.write(&apiExchange{Method: http.MethodGet, Path: "/v2/blocks"})
+	}
+
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("expected the recording to be rotated, got %v", err)
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Size() > 100 {
+		t.Errorf("expected the recording to stay within its bound, got %v, %v", info, err)
+	}
+}
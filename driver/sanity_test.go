@@ -0,0 +1,417 @@
+package driver
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/vultr/govultr/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+
+	"github.com/vultr/vultr-csi/internal/fakevultr"
+)
+
+const (
+	sanityNodeID      = "00000000-0000-4000-8000-00000000abcd"
+	sanityOtherNodeID = "00000000-0000-4000-8000-00000000dcba"
+)
+
+// sanityDriver is the driver serving its gRPC services on a unix socket, the way the
+// sidecars and csi-sanity reach it, backed by the fake Vultr API over HTTP
+type sanityDriver struct {
+	identity   csi.IdentityClient
+	controller csi.ControllerClient
+	node       csi.NodeClient
+
+	address string
+	dir     string
+}
+
+func newSanityDriver(t *testing.T) *sanityDriver {
+	t.Helper()
+
+	api := fakevultr.New()
+	api.AddPlan("vc2-1c-1gb", 1)
+	api.AddRegion("ewr", "block_storage_high_perf", "block_storage_storage_opt")
+	api.AddInstance(sanityNodeID, "ewr", "sanity-node", "vc2-1c-1gb")
+	api.AddInstance(sanityOtherNodeID, "ewr", "sanity-other-node", "vc2-1c-1gb")
+
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+
+	client := govultr.NewClient(srv.Client())
+	if err := client.SetBaseURL(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	client.SetRetryLimit(0)
+
+	// every device the node waits for is found by its serial in the test directory
+	dir := t.TempDir()
+	oldSysBlock, oldDev := sysBlockPath, devPath
+	sysBlockPath, devPath = filepath.Join(dir, "sys"), filepath.Join(dir, "dev")
+	t.Cleanup(func() { sysBlockPath, devPath = oldSysBlock, oldDev })
+
+	fe := &fakeExec{
+		exitCodes: map[string]int{"blkid": 2},
+		outputs: map[string]string{
+			"blockdev": "0",
+			"dumpe2fs": "Block count: 1\nBlock size: 4096\n",
+		},
+	}
+
+	d := &VultrDriver{
+		name:         "block.csi.vultr.com",
+		version:      "sanity",
+		nodeID:       sanityNodeID,
+		region:       "ewr",
+		client:       client,
+		vfs:          &vfsServiceHandler{client: client},
+		isController: true,
+		log:          logrus.New().WithField("test", "sanity"),
+
+		mounter: &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil), Exec: fe},
+		resizer: mount.NewResizeFs(fe),
+		exec:    fe,
+
+		volumeLabelMaxLength: DefaultVolumeLabelMaxLength,
+		targetDirMode:        mkDirMode,
+
+		attachTimeout: DefaultAttachTimeout,
+		detachTimeout: DefaultDetachTimeout,
+
+		// csi-sanity checks what the spec mandates, which strict mode enforces
+		strictSpec: true,
+	}
+
+	socket := filepath.Join(dir, "csi.sock")
+	server := NewNonBlockingGRPCServer()
+	server.Start("unix://"+socket, NewVultrIdentityServer(d), NewVultrControllerServer(d), NewVultrNodeDriver(d))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, "unix://"+socket, //nolint:staticcheck
+		grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock()) //nolint:staticcheck
+	if err != nil {
+		t.Fatalf("cannot connect to the driver: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		server.ForceStop()
+	})
+
+	return &sanityDriver{
+		identity:   csi.NewIdentityClient(conn),
+		controller: csi.NewControllerClient(conn),
+		node:       csi.NewNodeClient(conn),
+		address:    "unix://" + socket,
+		dir:        dir,
+	}
+}
+
+// addDevice makes the node find the device of the volume with the mount ID
+func (s *sanityDriver) addDevice(t *testing.T, name, mountID string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Join(sysBlockPath, name), mkDirMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sysBlockPath, name, "serial"), []byte(mountID[:virtioSerialLength]), mkFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(devPath, mkDirMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(devPath, name), nil, mkFileMode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sanityMountCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsTypeExt4}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func sanityCreateRequest(name string, size int64) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:               name,
+		Parameters:         map[string]string{blockTypeParam: blockTypeNvme},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: size},
+		VolumeCapabilities: []*csi.VolumeCapability{sanityMountCapability()},
+	}
+}
+
+func expectCode(t *testing.T, rpc string, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Fatalf("%s: expected %v, got %v", rpc, code, err)
+	}
+}
+
+func TestSanityIdentity(t *testing.T) {
+	s := newSanityDriver(t)
+	ctx := context.Background()
+
+	info, err := s.identity.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if err != nil {
+		t.Fatalf("GetPluginInfo: %v", err)
+	}
+	if info.Name == "" || info.VendorVersion == "" {
+		t.Errorf("GetPluginInfo: expected a name and version, got %+v", info)
+	}
+
+	probe, err := s.identity.Probe(ctx, &csi.ProbeRequest{})
+	if err != nil {
+		t.Fatalf("Probe: %v", err)
+	}
+	if probe.Ready != nil && !probe.Ready.Value {
+		t.Error("Probe: expected the plugin to be ready")
+	}
+
+	if _, err := s.identity.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{}); err != nil {
+		t.Errorf("GetPluginCapabilities: %v", err)
+	}
+}
+
+func TestSanityControllerIdempotency(t *testing.T) {
+	s := newSanityDriver(t)
+	ctx := context.Background()
+
+	first, err := s.controller.CreateVolume(ctx, sanityCreateRequest("sanity-volume", 10*giB))
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+
+	again, err := s.controller.CreateVolume(ctx, sanityCreateRequest("sanity-volume", 10*giB))
+	if err != nil {
+		t.Fatalf("CreateVolume again: %v", err)
+	}
+	if again.Volume.VolumeId != first.Volume.VolumeId {
+		t.Errorf("CreateVolume again: expected volume %s, got %s", first.Volume.VolumeId, again.Volume.VolumeId)
+	}
+
+	_, err = s.controller.CreateVolume(ctx, sanityCreateRequest("sanity-volume", 20*giB))
+	expectCode(t, "CreateVolume with another size", err, codes.AlreadyExists)
+
+	volumeID := first.Volume.VolumeId
+
+	_, err = s.controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "00000000-0000-4000-8000-999999999999",
+		VolumeCapabilities: []*csi.VolumeCapability{sanityMountCapability()},
+	})
+	expectCode(t, "ValidateVolumeCapabilities of a missing volume", err, codes.NotFound)
+
+	_, err = s.controller.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "00000000-0000-4000-8000-999999999999"})
+	expectCode(t, "ControllerGetVolume of a missing volume", err, codes.NotFound)
+
+	publish := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           sanityNodeID,
+		VolumeCapability: sanityMountCapability(),
+	}
+
+	published, err := s.controller.ControllerPublishVolume(ctx, publish)
+	if err != nil {
+		t.Fatalf("ControllerPublishVolume: %v", err)
+	}
+
+	republished, err := s.controller.ControllerPublishVolume(ctx, publish)
+	if err != nil {
+		t.Fatalf("ControllerPublishVolume again: %v", err)
+	}
+	if !reflect.DeepEqual(published.PublishContext, republished.PublishContext) {
+		t.Errorf("ControllerPublishVolume again: expected %v, got %v", published.PublishContext, republished.PublishContext)
+	}
+
+	_, err = s.controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           sanityOtherNodeID,
+		VolumeCapability: sanityMountCapability(),
+	})
+	expectCode(t, "ControllerPublishVolume to a second node", err, codes.FailedPrecondition)
+
+	_, err = s.controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           "00000000-0000-4000-8000-999999999999",
+		VolumeCapability: sanityMountCapability(),
+	})
+	expectCode(t, "ControllerPublishVolume to a missing node", err, codes.NotFound)
+
+	unpublish := &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: sanityNodeID}
+	for _, rpc := range []string{"ControllerUnpublishVolume", "ControllerUnpublishVolume again"} {
+		if _, err := s.controller.ControllerUnpublishVolume(ctx, unpublish); err != nil {
+			t.Fatalf("%s: %v", rpc, err)
+		}
+	}
+
+	for _, rpc := range []string{"DeleteVolume", "DeleteVolume again"} {
+		if _, err := s.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+			t.Fatalf("%s: %v", rpc, err)
+		}
+	}
+}
+
+func TestSanityListVolumes(t *testing.T) {
+	s := newSanityDriver(t)
+	ctx := context.Background()
+
+	created := map[string]bool{}
+	for _, name := range []string{"sanity-a", "sanity-b"} {
+		res, err := s.controller.CreateVolume(ctx, sanityCreateRequest(name, 10*giB))
+		if err != nil {
+			t.Fatalf("CreateVolume: %v", err)
+		}
+		created[res.Volume.VolumeId] = true
+	}
+
+	res, err := s.controller.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("ListVolumes: %v", err)
+	}
+
+	listed := map[string]bool{}
+	for _, e := range res.Entries {
+		listed[e.Volume.VolumeId] = true
+	}
+	if !reflect.DeepEqual(listed, created) {
+		t.Errorf("ListVolumes: expected %v, got %v", created, listed)
+	}
+
+	// pages of max_entries chained by their next_token list every volume once
+	paged := map[string]bool{}
+	req := &csi.ListVolumesRequest{MaxEntries: 1}
+	for {
+		res, err := s.controller.ListVolumes(ctx, req)
+		if err != nil {
+			t.Fatalf("ListVolumes: %v", err)
+		}
+		if len(res.Entries) > 1 {
+			t.Fatalf("ListVolumes: expected at most 1 entry, got %d", len(res.Entries))
+		}
+		for _, e := range res.Entries {
+			if paged[e.Volume.VolumeId] {
+				t.Errorf("ListVolumes: volume %s listed twice", e.Volume.VolumeId)
+			}
+			paged[e.Volume.VolumeId] = true
+		}
+
+		if res.NextToken == "" {
+			break
+		}
+		req.StartingToken = res.NextToken
+	}
+	if !reflect.DeepEqual(paged, created) {
+		t.Errorf("ListVolumes: expected pages of %v, got %v", created, paged)
+	}
+
+	if _, err := s.controller.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: "invalid"}); status.Code(err) != codes.Aborted {
+		t.Errorf("ListVolumes: expected Aborted for an invalid starting token, got %v", err)
+	}
+}
+
+func TestSanityGetCapacity(t *testing.T) {
+	s := newSanityDriver(t)
+	ctx := context.Background()
+
+	req := &csi.GetCapacityRequest{
+		VolumeCapabilities: []*csi.VolumeCapability{sanityMountCapability()},
+		Parameters:         map[string]string{blockTypeParam: blockTypeNvme},
+		AccessibleTopology: &csi.Topology{Segments: map[string]string{topologyRegionKey: "ewr"}},
+	}
+	res, err := s.controller.GetCapacity(ctx, req)
+	if err != nil {
+		t.Fatalf("GetCapacity: %v", err)
+	}
+	if res.AvailableCapacity == 0 {
+		t.Error("GetCapacity: expected capacity in a region offering the storage")
+	}
+
+	req.AccessibleTopology.Segments[topologyRegionKey] = "sao"
+	if res, err := s.controller.GetCapacity(ctx, req); err != nil || res.AvailableCapacity != 0 {
+		t.Errorf("GetCapacity: expected no capacity in an unknown region, got %v, %v", res, err)
+	}
+}
+
+func TestSanityNodeIdempotency(t *testing.T) {
+	s := newSanityDriver(t)
+	ctx := context.Background()
+
+	created, err := s.controller.CreateVolume(ctx, sanityCreateRequest("sanity-node-volume", 10*giB))
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+	volumeID := created.Volume.VolumeId
+
+	published, err := s.controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           sanityNodeID,
+		VolumeCapability: sanityMountCapability(),
+	})
+	if err != nil {
+		t.Fatalf("ControllerPublishVolume: %v", err)
+	}
+	s.addDevice(t, "vdb", volumeID)
+
+	staging := filepath.Join(s.dir, "staging")
+	target := filepath.Join(s.dir, "target")
+
+	stage := &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		PublishContext:    published.PublishContext,
+		StagingTargetPath: staging,
+		VolumeCapability:  sanityMountCapability(),
+		VolumeContext:     created.Volume.VolumeContext,
+	}
+	for _, rpc := range []string{"NodeStageVolume", "NodeStageVolume again"} {
+		if _, err := s.node.NodeStageVolume(ctx, stage); err != nil {
+			t.Fatalf("%s: %v", rpc, err)
+		}
+	}
+
+	publish := &csi.NodePublishVolumeRequest{
+		VolumeId:          volumeID,
+		PublishContext:    published.PublishContext,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  sanityMountCapability(),
+		VolumeContext:     created.Volume.VolumeContext,
+	}
+	for _, rpc := range []string{"NodePublishVolume", "NodePublishVolume again"} {
+		if _, err := s.node.NodePublishVolume(ctx, publish); err != nil {
+			t.Fatalf("%s: %v", rpc, err)
+		}
+	}
+
+	for _, rpc := range []string{"NodeUnpublishVolume", "NodeUnpublishVolume again"} {
+		if _, err := s.node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: target}); err != nil {
+			t.Fatalf("%s: %v", rpc, err)
+		}
+	}
+
+	unstage := &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: staging}
+	for _, rpc := range []string{"NodeUnstageVolume", "NodeUnstageVolume again"} {
+		if _, err := s.node.NodeUnstageVolume(ctx, unstage); err != nil {
+			t.Fatalf("%s: %v", rpc, err)
+		}
+	}
+
+	info, err := s.node.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatalf("NodeGetInfo: %v", err)
+	}
+	if info.NodeId != sanityNodeID {
+		t.Errorf("NodeGetInfo: expected node %s, got %s", sanityNodeID, info.NodeId)
+	}
+}
@@ -16,15 +16,27 @@ package driver
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"net/url"
 	"os"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/proto" //nolint:staticcheck // the CSI messages are generated against the v1 API
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 // NonBlockingGRPCServer defines Non blocking GRPC server interfaces
@@ -37,17 +49,30 @@ type NonBlockingGRPCServer interface {
 	Stop()
 	// Stops the service forcefully
 	ForceStop()
+	// Reports whether the service accepts connections
+	Serving() bool
 }
 
-// NewNonBlockingGRPCServer provides the non-blocking GRPC server
-func NewNonBlockingGRPCServer() NonBlockingGRPCServer {
-	return &nonBlockingGRPCServer{}
+// NewNonBlockingGRPCServer provides the non-blocking GRPC server, running the
+// interceptors within GRPCLogger
+func NewNonBlockingGRPCServer(interceptors ...grpc.UnaryServerInterceptor) NonBlockingGRPCServer {
+	return &nonBlockingGRPCServer{interceptors: interceptors}
 }
 
 // NonBlocking server
 type nonBlockingGRPCServer struct {
-	wg     sync.WaitGroup
-	server *grpc.Server
+	wg           sync.WaitGroup
+	serving      atomic.Bool
+	interceptors []grpc.UnaryServerInterceptor
+	options      []grpc.ServerOption
+
+	// socketMode and socketOwner are set on the unix socket once listening, when set
+	socketMode  os.FileMode
+	socketOwner *dirOwner
+
+	mu      sync.Mutex
+	server  *grpc.Server
+	stopped bool
 }
 
 func (n *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
@@ -60,17 +85,35 @@ func (n *nonBlockingGRPCServer) Wait() {
 }
 
 func (n *nonBlockingGRPCServer) Stop() {
-	n.server.GracefulStop()
+	if server := n.stop(); server != nil {
+		server.GracefulStop()
+	}
 }
 
 func (n *nonBlockingGRPCServer) ForceStop() {
-	n.server.Stop()
+	if server := n.stop(); server != nil {
+		server.Stop()
+	}
+}
+
+// stop keeps a server which is not serving yet from starting, returning the server once it is
+func (n *nonBlockingGRPCServer) stop() *grpc.Server {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.stopped = true
+	return n.server
+}
+
+func (n *nonBlockingGRPCServer) Serving() bool {
+	return n.serving.Load()
 }
 
 func (n *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(GRPCLogger),
+		grpc.ChainUnaryInterceptor(append([]grpc.UnaryServerInterceptor{GRPCLogger}, n.interceptors...)...),
 	}
+	opts = append(opts, n.options...)
 
 	serveURL, err := url.Parse(endpoint)
 	if err != nil {
@@ -80,7 +123,7 @@ func (n *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 	var addr string
 	if serveURL.Scheme == "unix" {
 		addr = serveURL.Path
-		if errRemove := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		if errRemove := os.Remove(addr); errRemove != nil && !os.IsNotExist(errRemove) {
 			log.Fatalf("Failed to remove %s, error: %s", addr, errRemove.Error())
 		}
 	} else if serveURL.Scheme == "tcp" {
@@ -95,8 +138,23 @@ func (n *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
+	if serveURL.Scheme == "unix" {
+		if err := n.setSocketPermissions(addr); err != nil {
+			log.Fatalf("Failed to set the permissions of %s: %v", addr, err)
+		}
+	}
+
 	server := grpc.NewServer(opts...)
+
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		listener.Close() //nolint:errcheck
+		n.wg.Done()
+		return
+	}
 	n.server = server
+	n.mu.Unlock()
 
 	if ids != nil {
 		csi.RegisterIdentityServer(server, ids)
@@ -113,25 +171,210 @@ func (n *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 		"address": addr,
 	}).Infof("Listening for connections on address: %#v", listener.Addr())
 
-	if err := server.Serve(listener); err != nil {
+	n.serving.Store(true)
+	err = server.Serve(listener)
+	n.serving.Store(false)
+	if err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
 
 	n.wg.Done()
 }
 
-// GRPCLogger provides better error handling for gRPC calls
-func GRPCLogger(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+// setSocketPermissions gives the socket its mode and ownership, when they are set
+func (n *nonBlockingGRPCServer) setSocketPermissions(path string) error {
+	if n.socketMode != 0 {
+		if err := os.Chmod(path, n.socketMode); err != nil {
+			return err
+		}
+	}
+
+	if n.socketOwner != nil {
+		if err := os.Chown(path, n.socketOwner.uid, n.socketOwner.gid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// grpcServerOptions returns the options of the gRPC server the flags set, none by default
+func (d *VultrDriver) grpcServerOptions() []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if d.grpcMaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(d.grpcMaxConcurrentStreams))
+	}
+
+	ka := d.grpcKeepalive
+	if ka.time > 0 || ka.timeout > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{Time: ka.time, Timeout: ka.timeout}))
+	}
+	if ka.minTime > 0 || ka.permitWithoutStream {
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             ka.minTime,
+			PermitWithoutStream: ka.permitWithoutStream,
+		}))
+	}
+
+	return opts
+}
+
+// validateGRPCServer checks the keepalive and socket settings of the gRPC server
+func (d *VultrDriver) validateGRPCServer() error {
+	ka := d.grpcKeepalive
+	if ka.time < 0 || ka.timeout < 0 || ka.minTime < 0 {
+		return fmt.Errorf("gRPC keepalive durations must not be negative")
+	}
+
+	if d.socketMode&^os.ModePerm != 0 {
+		return fmt.Errorf("socket mode %#o must be permission bits", d.socketMode)
+	}
+
+	if d.socketMode != 0 || d.socketOwner != nil {
+		if endpoint, err := url.Parse(d.endpoint); err != nil || endpoint.Scheme != "unix" {
+			return fmt.Errorf("socket permissions only apply to unix endpoints, not %q", d.endpoint)
+		}
+	}
+
+	return nil
+}
+
+// requestIDKey is the incoming metadata key a caller may set to provide its own request ID
+const requestIDKey = "x-request-id"
+
+// redactedSecret replaces secret values in logged requests
+const redactedSecret = "***stripped***"
+
+type requestLoggerKey struct{}
+
+// GRPCLogger logs every gRPC call uniformly with a request ID, its duration and status
+// code, redacts secrets from the logged request and turns handler panics into
+// codes.Internal errors. Errors caused by the deadline of the RPC or a timed out Vultr
+// API request are reported as codes.DeadlineExceeded, and other Vultr API errors with the
+// code their HTTP status maps to. Legacy volume handles are converted
+// to the volume IDs they name before the handler sees them. Identical errors repeating
+// for a volume are summarized. Errors carry the request ID as a RequestInfo status
+// detail, so the errors the sidecars log can be matched with the driver logs of the call.
+func GRPCLogger(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) { //nolint:lll
+	id := requestID(ctx)
 	logger := log.WithFields(log.Fields{
-		"GRPC.call":    info.FullMethod,
-		"GRPC.request": fmt.Sprintf("%+v", req),
+		"GRPC.call":       info.FullMethod,
+		"GRPC.request_id": id,
 	})
+	normalizeVolumeHandles(req, logger)
 
-	resp, err := handler(ctx, req)
-	if err != nil {
-		logger.Errorf("GRPC error: %v", err)
-	} else {
-		logger.Infof("GRPC response: %+v", resp)
+	// the handlers log through the logger of the call, which names the volume it is about
+	volumeID := requestVolumeID(req)
+	if volumeID != "" {
+		logger = logger.WithField("volume_id", volumeID)
+	}
+	ctx = context.WithValue(ctx, requestLoggerKey{}, logger)
+
+	defer inflightRPCs.start(info.FullMethod, volumeID)()
+
+	logger.WithField("GRPC.request", fmt.Sprintf("%+v", redactSecrets(req))).Info("GRPC request")
+
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			logger.WithField("GRPC.stack", string(debug.Stack())).Errorf("GRPC panic: %v", r)
+			resp, err = nil, status.Errorf(codes.Internal, "%s panicked: %v", info.FullMethod, r)
+		}
+		if err != nil {
+			err = withRequestInfo(apiErrorStatus(deadlineStatus(ctx, err)), id)
+		}
+
+		logger = logger.WithFields(log.Fields{
+			"GRPC.code":     status.Code(err).String(),
+			"GRPC.duration": time.Since(start).String(),
+		})
+
+		volumeOperations.record(info.FullMethod, volumeID, resp, err)
+		if err == nil {
+			repeatedFailures.succeeded(info.FullMethod, volumeID)
+			logger.Infof("GRPC response: %+v", resp)
+			return
+		}
+
+		switch logged, suppressed := repeatedFailures.failed(info.FullMethod, volumeID, err); {
+		case !logged:
+			logger.Debugf("GRPC error: %v", err)
+		case suppressed > 0:
+			logger.WithField("GRPC.repeated", suppressed).Errorf("GRPC error: %v (repeated %d times in the last %s)",
+				err, suppressed, repeatedFailures.interval)
+		default:
+			logger.Errorf("GRPC error: %v", err)
+		}
+	}()
+
+	return handler(ctx, req)
+}
+
+// withRequestInfo returns err as a status carrying the request ID in its details,
+// keeping its code, message and any details it already has
+func withRequestInfo(err error, id string) error {
+	st := status.Convert(err)
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.RequestInfo); ok && info.GetRequestId() == id {
+			return err
+		}
+	}
+
+	withInfo, detailErr := st.WithDetails(&errdetails.RequestInfo{RequestId: id})
+	if detailErr != nil {
+		return err
+	}
+	return withInfo.Err()
+}
+
+// requestLogger returns the logger of the gRPC call in ctx, carrying its request ID,
+// or fallback outside of a call
+func requestLogger(ctx context.Context, fallback *log.Entry) *log.Entry {
+	if logger, ok := ctx.Value(requestLoggerKey{}).(*log.Entry); ok {
+		return logger.WithFields(fallback.Data)
+	}
+	return fallback
+}
+
+// requestID returns the caller's request ID or generates one
+func requestID(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(requestIDKey); len(ids) > 0 && ids[0] != "" {
+			return ids[0]
+		}
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
 	}
-	return resp, err
+	return hex.EncodeToString(b)
+}
+
+// redactSecrets returns a copy of a CSI request with the values of its secrets field
+// replaced, or the request itself when it carries no secrets
+func redactSecrets(req interface{}) interface{} {
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return req
+	}
+
+	field := proto.MessageReflect(msg).Descriptor().Fields().ByName("secrets")
+	if field == nil || !field.IsMap() || !proto.MessageReflect(msg).Has(field) {
+		return req
+	}
+
+	clone := proto.Clone(msg)
+	secrets := proto.MessageReflect(clone).Mutable(field).Map()
+
+	var keys []protoreflect.MapKey
+	secrets.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+		keys = append(keys, k)
+		return true
+	})
+	for _, k := range keys {
+		secrets.Set(k, protoreflect.ValueOfString(redactedSecret))
+	}
+
+	return clone
 }
@@ -0,0 +1,166 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCLoggerRecoversPanics(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+
+	_, err := GRPCLogger(context.Background(), &csi.NodeStageVolumeRequest{}, info, func(context.Context, interface{}) (interface{}, error) {
+		panic("boom")
+	})
+
+	if status.Code(err) != codes.Internal {
+		t.Errorf("expected Internal after a panic, got %v", err)
+	}
+}
+
+func TestGRPCLoggerAttachesRequestInfo(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ControllerPublishVolume"}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDKey, "abc123"))
+
+	_, err := GRPCLogger(ctx, &csi.ControllerPublishVolumeRequest{}, info, func(context.Context, interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "volume not found")
+	})
+
+	st := status.Convert(err)
+	if st.Code() != codes.NotFound || st.Message() != "volume not found" {
+		t.Errorf("expected the handler's status to be kept, got %v", err)
+	}
+
+	details := st.Details()
+	if len(details) != 1 {
+		t.Fatalf("expected 1 status detail, got %v", details)
+	}
+	if requestInfo, ok := details[0].(*errdetails.RequestInfo); !ok || requestInfo.GetRequestId() != "abc123" {
+		t.Errorf("expected the request ID in the status details, got %v", details[0])
+	}
+
+	if err := withRequestInfo(err, "abc123"); len(status.Convert(err).Details()) != 1 {
+		t.Errorf("expected the request ID to be attached once, got %v", status.Convert(err).Details())
+	}
+}
+
+func TestGRPCLoggerRequestLogger(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDKey, "abc123"))
+
+	var fields logrus.Fields
+	req := &csi.NodeStageVolumeRequest{VolumeId: "vol-1"}
+	_, err := GRPCLogger(ctx, req, info, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		fields = requestLogger(ctx, logrus.NewEntry(logrus.New()).WithField("host_id", "node-1")).Data
+		return &csi.NodeStageVolumeResponse{}, nil
+	})
+	if err != nil {
+		t.Fatalf("got error, expected no error: %v", err)
+	}
+
+	for key, value := range map[string]string{"GRPC.request_id": "abc123", "volume_id": "vol-1", "host_id": "node-1"} {
+		if fields[key] != value {
+			t.Errorf("expected the handler's logger to have %s=%s, got %v", key, value, fields)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIDKey, "abc123"))
+	if id := requestID(ctx); id != "abc123" {
+		t.Errorf("expected the caller's request ID, got %s", id)
+	}
+
+	if a, b := requestID(context.Background()), requestID(context.Background()); a == "" || a == b {
+		t.Errorf("expected distinct generated request IDs, got %q and %q", a, b)
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		Secrets:  map[string]string{"api-key": "hunter2"},
+	}
+
+	redacted, ok := redactSecrets(req).(*csi.NodeStageVolumeRequest)
+	if !ok {
+		t.Fatalf("expected a NodeStageVolumeRequest, got %T", redactSecrets(req))
+	}
+
+	if redacted.Secrets["api-key"] != redactedSecret || strings.Contains(redacted.String(), "hunter2") {
+		t.Errorf("expected the secret to be redacted, got %v", redacted)
+	}
+
+	if req.Secrets["api-key"] != "hunter2" {
+		t.Errorf("expected the original request to be left alone, got %v", req.Secrets)
+	}
+
+	if r := redactSecrets(&csi.ProbeRequest{}); r == nil {
+		t.Error("expected requests without secrets to pass through")
+	}
+}
+
+func TestSocketPermissions(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "csi.sock")
+	server := &nonBlockingGRPCServer{socketMode: 0660, socketOwner: &dirOwner{uid: -1, gid: os.Getgid()}}
+	server.Start("unix://"+socket, &csi.UnimplementedIdentityServer{}, nil, nil)
+	defer server.ForceStop()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !server.Serving() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the server to be serving")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("expected the socket mode to be 0660, got %#o", info.Mode().Perm())
+	}
+}
+
+func TestValidateGRPCServer(t *testing.T) {
+	tests := []struct {
+		name   string
+		driver VultrDriver
+		valid  bool
+	}{
+		{"defaults", VultrDriver{endpoint: "tcp://127.0.0.1:10000"}, true},
+		{"keepalive", VultrDriver{grpcKeepalive: grpcKeepalive{time: time.Minute, minTime: 10 * time.Second}}, true},
+		{"negative keepalive", VultrDriver{grpcKeepalive: grpcKeepalive{timeout: -time.Second}}, false},
+		{"socket mode", VultrDriver{endpoint: "unix:///csi/csi.sock", socketMode: 0660}, true},
+		{"socket mode with special bits", VultrDriver{endpoint: "unix:///csi/csi.sock", socketMode: os.ModeSetuid | 0660}, false},
+		{"socket owner of a tcp endpoint", VultrDriver{endpoint: "tcp://127.0.0.1:10000", socketOwner: &dirOwner{uid: 1000, gid: -1}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.driver.validateGRPCServer(); (err == nil) != tt.valid {
+				t.Errorf("expected valid %t, got %v", tt.valid, err)
+			}
+		})
+	}
+
+	d := &VultrDriver{grpcMaxConcurrentStreams: 8, grpcKeepalive: grpcKeepalive{permitWithoutStream: true}}
+	if opts := d.grpcServerOptions(); len(opts) != 2 {
+		t.Errorf("expected the stream bound and the enforcement policy, got %d options", len(opts))
+	}
+	if opts := (&VultrDriver{}).grpcServerOptions(); len(opts) != 0 {
+		t.Errorf("expected no options by default, got %d", len(opts))
+	}
+}
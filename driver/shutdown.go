@@ -0,0 +1,206 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// taints marking a node whose instance is shut down or reclaimed, set by the node
+	// lifecycle controllers or an operator
+	taintOutOfService = "node.kubernetes.io/out-of-service"
+	taintShutdown     = "node.cloudprovider.kubernetes.io/shutdown"
+
+	// vultrProviderIDPrefix starts the providerID the Vultr cloud controller gives nodes
+	vultrProviderIDPrefix = "vultr://"
+)
+
+var shutdownDetaches = metrics.newCounter("shutdown_detaches_total",
+	"Number of volumes detached from nodes tainted as shut down", "result")
+
+// kubeNodeList is the part of a Kubernetes node list the watcher reads
+type kubeNodeList struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Spec struct {
+			ProviderID string `json:"providerID"`
+			Taints     []struct {
+				Key string `json:"key"`
+			} `json:"taints"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// shutdownWatcher detaches volumes from instances whose Kubernetes node is tainted as
+// shut down. Left to Kubernetes, the volumes of a reclaimed node stay attached until its
+// pods are force deleted and the attach detach controller gives up on the node, which
+// holds back the StatefulSet replicas waiting to attach them elsewhere.
+type shutdownWatcher struct {
+	controller *VultrControllerServer
+	kube       kubeAPI
+	interval   time.Duration
+	log        *logrus.Entry
+
+	// handled are the instances whose volumes were all detached, until their taint goes
+	handled map[string]bool
+}
+
+// newInClusterShutdownWatcher returns a shutdownWatcher reaching the Kubernetes API with
+// the service account of the controller pod
+func newInClusterShutdownWatcher(c *VultrControllerServer, interval time.Duration) (*shutdownWatcher, error) {
+	kube, err := newInClusterKubeAPI(interval)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shutdownWatcher{
+		controller: c,
+		kube:       kube,
+		interval:   interval,
+		log:        c.Driver.log.WithField("loop", "shutdown_detach"),
+		handled:    make(map[string]bool),
+	}, nil
+}
+
+// run checks the nodes every interval until ctx is done
+func (w *shutdownWatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check detaches the volumes of the instances tainted as shut down which are not handled yet
+func (w *shutdownWatcher) check(ctx context.Context) {
+	if err := w.controller.Driver.checkAPI("shutdown detach"); err != nil {
+		w.log.Infof("skipping this pass: %v", err)
+		return
+	}
+
+	instances, err := w.shutdownInstances(ctx)
+	if err != nil {
+		w.log.Warnf("cannot list nodes: %v", err)
+		return
+	}
+
+	for id := range w.handled {
+		if !instances[id] {
+			delete(w.handled, id)
+		}
+	}
+
+	for id := range instances {
+		if !w.handled[id] {
+			w.handled[id] = w.detachInstance(ctx, id)
+		}
+	}
+}
+
+// shutdownInstances returns the Vultr instances of the nodes tainted as shut down
+func (w *shutdownWatcher) shutdownInstances(ctx context.Context) (map[string]bool, error) {
+	var nodes kubeNodeList
+	if err := w.kube.get(ctx, "/api/v1/nodes", &nodes); err != nil {
+		return nil, err
+	}
+
+	instances := make(map[string]bool)
+	for _, node := range nodes.Items {
+		id := strings.TrimPrefix(node.Spec.ProviderID, vultrProviderIDPrefix)
+		if id == node.Spec.ProviderID || id == "" {
+			continue
+		}
+
+		for _, taint := range node.Spec.Taints {
+			if taint.Key == taintOutOfService || taint.Key == taintShutdown {
+				instances[id] = true
+			}
+		}
+	}
+
+	return instances, nil
+}
+
+// detachInstance detaches every volume attached to the instance, reporting whether none
+// is left attached. Volumes busy with another operation are left for the next check.
+func (w *shutdownWatcher) detachInstance(ctx context.Context, instanceID string) bool {
+	c := w.controller
+	log := w.log.WithField("node_id", instanceID)
+
+	volumes, err := c.backends.list(ctx)
+	if err != nil {
+		log.Warnf("cannot list volumes: %v", err)
+		return false
+	}
+
+	done := true
+	for i := range volumes {
+		vol := &volumes[i]
+		if !vol.isAttachedTo(instanceID) {
+			continue
+		}
+
+		if err := w.detachVolume(ctx, vol, instanceID); err != nil {
+			log.WithField("volume_id", vol.ID).Warnf("cannot detach volume from shut down node: %v", err)
+			shutdownDetaches.add(1, "failed")
+			done = false
+			continue
+		}
+
+		log.WithField("volume_id", vol.ID).Info("detached volume from shut down node")
+		shutdownDetaches.add(1, "detached")
+	}
+
+	return done
+}
+
+func (w *shutdownWatcher) detachVolume(ctx context.Context, vol *backendVolume, instanceID string) error {
+	c := w.controller
+
+	unlock, err := c.locks.acquireAttachment(vol.ID, instanceID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	backend, ok := c.backends.backends[vol.StorageType]
+	if !ok {
+		return fmt.Errorf("no backend for storage type %q", vol.StorageType)
+	}
+
+	defer c.volumes.invalidate()
+
+	if err := backend.Detach(ctx, vol.ID, instanceID); err != nil && !errors.Is(err, errNotAttached) {
+		return err
+	}
+	c.attachments.detached(vol.ID, instanceID)
+
+	return nil
+}
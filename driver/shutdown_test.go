@@ -0,0 +1,68 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShutdownWatcher(t *testing.T) {
+	taint := taintOutOfService
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/nodes" || r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unexpected request", http.StatusForbidden)
+			return
+		}
+
+		w.Write([]byte(`{"items":[ ` + //nolint:errcheck
+			`{"metadata":{"name":"reclaimed"},"spec":{"providerID":"vultr://245bb2fe-b55c-44a0-9a1e-ab80e4b5f088",` +
+			`"taints":[{"key":"` + taint + `","effect":"NoExecute"}]}},` +
+			`{"metadata":{"name":"healthy"},"spec":{"providerID":"vultr://b9d23eb3-1880-4746-acc7-f1ef56565320"}},` +
+			`{"metadata":{"name":"elsewhere"},"spec":{"providerID":"aws:///i-123","taints":[{"key":"` + taint + `"}]}}]}`))
+	}))
+	defer api.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := NewFakeVultrControllerServer("shutdown watcher")
+	w := &shutdownWatcher{
+		controller: controller,
+		kube:       kubeAPI{client: api.Client(), apiURL: api.URL, tokenFile: tokenFile},
+		log:        controller.Driver.log,
+		handled:    make(map[string]bool),
+	}
+
+	instances, err := w.shutdownInstances(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(instances) != 1 || !instances["245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"] {
+		t.Fatalf("expected only the tainted Vultr instance, got %v", instances)
+	}
+
+	w.check(context.Background())
+
+	detached := controller.Driver.client.BlockStorage.(*fakeBS).detached
+	if !detached["c56c7b6e-15c2-445e-9a5d-1063ab5828ec"] {
+		t.Error("expected the volume of the shut down node to be detached")
+	}
+	if detached["bda4f333-bfd7-477b-84c2-e4df0ec9e5bf"] {
+		t.Error("expected the volume of the healthy node to stay attached")
+	}
+	if !w.handled["245bb2fe-b55c-44a0-9a1e-ab80e4b5f088"] {
+		t.Error("expected the shut down node to be handled")
+	}
+
+	// the node is handled again should it be tainted again once back
+	taint = "node.kubernetes.io/unschedulable"
+	w.check(context.Background())
+	if len(w.handled) != 0 {
+		t.Errorf("expected the untainted node to be forgotten, got %v", w.handled)
+	}
+}
@@ -0,0 +1,63 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestSimulatedAPI(t *testing.T) {
+	d, err := NewDriver("", "", DefaultDriverName, "test", "", "", WithSimulatedAPI(true))
+	if err != nil {
+		t.Fatalf("expected a simulating driver to need no token, got %v", err)
+	}
+	if !d.isController || d.nodeID != simulatedNodeID || d.region != simulatedRegion {
+		t.Fatalf("expected a simulated controller instance, got controller %t, instance %s in %s", d.isController, d.nodeID, d.region)
+	}
+	if err := d.CheckAPIAccess(context.Background()); err != nil {
+		t.Fatalf("expected the simulated API to pass the startup check, got %v", err)
+	}
+
+	ctx := context.Background()
+	controller := NewVultrControllerServer(d)
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	created, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-simulated",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 10 * giB},
+		Parameters:         map[string]string{"block_type": "high_perf"},
+		VolumeCapabilities: []*csi.VolumeCapability{capability},
+	})
+	if err != nil {
+		t.Fatalf("expected the simulated create to succeed, got %v", err)
+	}
+	volumeID := created.GetVolume().GetVolumeId()
+
+	if _, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           "any-node",
+		VolumeCapability: capability,
+		VolumeContext:    created.GetVolume().GetVolumeContext(),
+	}); err != nil {
+		t.Fatalf("expected the volume to attach to any node, got %v", err)
+	}
+
+	if _, err := controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   "any-node",
+	}); err != nil {
+		t.Fatalf("expected the volume to detach, got %v", err)
+	}
+
+	if _, err := controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+		t.Fatalf("expected the simulated delete to succeed, got %v", err)
+	}
+
+	if _, err := NewDriver("", "", DefaultDriverName, "test", "", "", WithSimulatedAPI(true), WithDryRun(true)); err == nil {
+		t.Error("expected dry run and simulation to be refused together")
+	}
+}
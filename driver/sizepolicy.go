@@ -0,0 +1,109 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// anyNamespace is the namespace size policy entry applying to namespaces without their own
+	anyNamespace = "*"
+
+	// maxVolumeSizeGB keeps sizes in GB from overflowing once converted to bytes
+	maxVolumeSizeGB = 1 << 32
+)
+
+// WithNamespaceMaxVolumeSize caps the size of the volumes created for the claims of each
+// namespace, from a policy of comma separated namespace=GB entries where * applies to
+// the namespaces without an entry. ResourceQuota only caps the total of a namespace.
+func WithNamespaceMaxVolumeSize(policy string) Option {
+	return func(d *VultrDriver) {
+		d.namespaceSizePolicy = policy
+	}
+}
+
+// parseNamespaceSizePolicy returns the maximum size in bytes of each namespace of the policy
+func parseNamespaceSizePolicy(policy string) (map[string]int64, error) {
+	if strings.TrimSpace(policy) == "" {
+		return nil, nil
+	}
+
+	limits := make(map[string]int64)
+	for _, entry := range strings.Split(policy, ",") {
+		namespace, size, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		namespace = strings.TrimSpace(namespace)
+		if !ok || namespace == "" {
+			return nil, fmt.Errorf("namespace volume size policy entry %q is not namespace=GB", entry)
+		}
+		if _, ok := limits[namespace]; ok {
+			return nil, fmt.Errorf("namespace volume size policy names %q twice", namespace)
+		}
+
+		gb, err := parseVolumeSizeGB(size)
+		if err != nil {
+			return nil, fmt.Errorf("namespace volume size policy entry %q: %w", entry, err)
+		}
+		limits[namespace] = gb * giB
+	}
+	return limits, nil
+}
+
+// parseVolumeSizeGB parses a positive whole number of GB
+func parseVolumeSizeGB(value string) (int64, error) {
+	gb, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || gb <= 0 || gb > maxVolumeSizeGB {
+		return 0, fmt.Errorf("size must be a whole number of GB between 1 and %d, got %q", maxVolumeSizeGB, value)
+	}
+	return gb, nil
+}
+
+// checkVolumeSizePolicy refuses a CreateVolume requiring more than the maximum size of
+// its StorageClass or of the namespace of its claim, the smaller of the two applying.
+// The namespace is only known when the provisioner runs with --extra-create-metadata.
+func (d *VultrDriver) checkVolumeSizePolicy(capRange *csi.CapacityRange, params map[string]string) error {
+	required := capRange.GetRequiredBytes()
+	if required <= 0 {
+		return nil
+	}
+	// volumes are provisioned in whole GB
+	required = (required + giB - 1) / giB * giB
+
+	if value := params[maxVolumeSizeParam]; value != "" {
+		// normalizeParameters validated the parameter
+		gb, _ := strconv.ParseInt(value, 10, 64)
+		if required > gb*giB {
+			return status.Errorf(codes.InvalidArgument, "CreateVolume %dGB exceeds the %dGB maximum volume size of the StorageClass",
+				required/giB, gb)
+		}
+	}
+
+	namespace := params[pvcNamespaceParam]
+	limit, ok := d.namespaceMaxVolumeBytes[namespace]
+	if !ok {
+		limit, ok = d.namespaceMaxVolumeBytes[anyNamespace]
+	}
+	if ok && required > limit {
+		return status.Errorf(codes.InvalidArgument, "CreateVolume %dGB exceeds the %dGB maximum volume size of namespace %q",
+			required/giB, limit/giB, namespace)
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseNamespaceSizePolicy(t *testing.T) {
+	limits, err := parseNamespaceSizePolicy(" dev=50, *=500 ")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if limits["dev"] != 50*giB || limits[anyNamespace] != 500*giB || len(limits) != 2 {
+		t.Errorf("expected dev and default limits, got %v", limits)
+	}
+
+	for _, policy := range []string{"dev", "=50", "dev=0", "dev=1.5", "dev=50,dev=60"} {
+		if _, err := parseNamespaceSizePolicy(policy); err == nil {
+			t.Errorf("expected policy %q to be refused", policy)
+		}
+	}
+}
+
+func TestCheckVolumeSizePolicy(t *testing.T) {
+	d := &VultrDriver{namespaceMaxVolumeBytes: map[string]int64{"dev": 50 * giB, anyNamespace: 500 * giB}}
+
+	tests := []struct {
+		name     string
+		required int64
+		params   map[string]string
+		code     codes.Code
+	}{
+		{"within the namespace maximum", 50 * giB, map[string]string{pvcNamespaceParam: "dev"}, codes.OK},
+		{"over the namespace maximum once rounded", 50*giB + 1, map[string]string{pvcNamespaceParam: "dev"}, codes.InvalidArgument},
+		{"default for other namespaces", 600 * giB, map[string]string{pvcNamespaceParam: "prod"}, codes.InvalidArgument},
+		{"default without the claim metadata", 100 * giB, nil, codes.OK},
+		{"storage class maximum", 100 * giB, map[string]string{pvcNamespaceParam: "prod", maxVolumeSizeParam: "80"}, codes.InvalidArgument},
+		{"no size required", 0, map[string]string{pvcNamespaceParam: "dev", maxVolumeSizeParam: "1"}, codes.OK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := d.checkVolumeSizePolicy(&csi.CapacityRange{RequiredBytes: test.required}, test.params)
+			if status.Code(err) != test.code {
+				t.Errorf("expected %v, got %v", test.code, err)
+			}
+		})
+	}
+}
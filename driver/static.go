@@ -0,0 +1,53 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// validatePublishedVolume checks the volume a PersistentVolume references against what its
+// attributes declare, which for a PersistentVolume created by hand around an existing
+// Vultr volume nothing checked before: its storage and block type, and that it holds at
+// least the size_gb it declares. Provisioned volumes declare what they were created with.
+func validatePublishedVolume(rpc string, vol *backendVolume, volCtx map[string]string) error {
+	if storageType := volCtx[volumeContextStorageType]; storageType != "" && storageType != vol.StorageType {
+		return status.Errorf(codes.FailedPrecondition, "%s volume %s is a %s volume, its PersistentVolume declares %s",
+			rpc, vol.ID, vol.StorageType, storageType)
+	}
+
+	if blockType := volCtx[volumeContextBlockType]; blockType != "" && vol.BlockType != "" && blockType != vol.BlockType {
+		return status.Errorf(codes.FailedPrecondition, "%s volume %s is of block type %s, its PersistentVolume declares %s",
+			rpc, vol.ID, vol.BlockType, blockType)
+	}
+
+	if v := volCtx[volumeContextSizeGB]; v != "" {
+		sizeGB, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || sizeGB < 0 {
+			return status.Errorf(codes.InvalidArgument, "%s volume attribute %s must be a number of GB, got %q",
+				rpc, volumeContextSizeGB, v)
+		}
+
+		// a volume whose size Vultr does not report is not held against the declared one
+		if vol.SizeBytes > 0 && vol.SizeBytes < sizeGB*giB {
+			return status.Errorf(codes.FailedPrecondition, "%s volume %s is %dGB, smaller than the %dGB its PersistentVolume declares",
+				rpc, vol.ID, vol.SizeBytes/giB, sizeGB)
+		}
+	}
+
+	return nil
+}
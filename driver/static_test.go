@@ -0,0 +1,67 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidatePublishedVolume(t *testing.T) {
+	vol := &backendVolume{ID: "vol-1", StorageType: storageTypeBlock, BlockType: blockTypeNvme, SizeBytes: 10 * giB}
+
+	tests := []struct {
+		name   string
+		volCtx map[string]string
+		code   codes.Code
+	}{
+		{"no attributes", nil, codes.OK},
+		{"provisioned", map[string]string{"storage_type": "block", "block_type": blockTypeNvme, "size_gb": "10"}, codes.OK},
+		{"expanded since", map[string]string{"size_gb": "5"}, codes.OK},
+		{"smaller than declared", map[string]string{"size_gb": "20"}, codes.FailedPrecondition},
+		{"invalid size", map[string]string{"size_gb": "10Gi"}, codes.InvalidArgument},
+		{"other storage type", map[string]string{"storage_type": "vfs"}, codes.FailedPrecondition},
+		{"other block type", map[string]string{"block_type": blockTypeHDD}, codes.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePublishedVolume("ControllerPublishVolume", vol, tt.volCtx)
+			if code := status.Code(err); code != tt.code {
+				t.Errorf("expected %v, got %v", tt.code, err)
+			}
+		})
+	}
+
+	unknown := &backendVolume{ID: "vol-2", StorageType: storageTypeBlock}
+	volCtx := map[string]string{"size_gb": "10", "block_type": blockTypeHDD}
+	if err := validatePublishedVolume("ControllerPublishVolume", unknown, volCtx); err != nil {
+		t.Errorf("expected what Vultr does not report not to be held against the volume, got %v", err)
+	}
+}
+
+func TestPublishStaticVolume(t *testing.T) {
+	controller := NewFakeVultrControllerServer("static volume")
+
+	publish := func(volCtx map[string]string) error {
+		_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+			NodeId:   "245bb2fe-b55c-44a0-9a1e-ab80e4b5f088",
+			VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+			VolumeContext: volCtx,
+		})
+		return err
+	}
+
+	if err := publish(map[string]string{"size_gb": "10"}); err != nil {
+		t.Errorf("expected a static volume of the declared size to be published, got %v", err)
+	}
+	if err := publish(map[string]string{"size_gb": "100"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected a static volume smaller than declared to fail with FailedPrecondition, got %v", err)
+	}
+}
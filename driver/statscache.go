@@ -0,0 +1,189 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"k8s.io/mount-utils"
+)
+
+// DefaultVolumeStatsCacheTTL is how long NodeGetVolumeStats answers from the statistics
+// it last measured of a volume path
+const DefaultVolumeStatsCacheTTL = 15 * time.Second
+
+var volumeStatsLookups = metrics.newCounter("volume_stats_cache_lookups_total",
+	"Number of volume statistics answered by the volume stats cache of the node, by whether the volume was measured", "result")
+
+// volumeStats is what the node measured of a published volume: the usage of its
+// filesystem, or the size of a raw block device
+type volumeStats struct {
+	usage      *volumeUsage
+	isBlock    bool
+	blockBytes int64
+}
+
+// volumeStatsCache holds the statistics of the volume paths of the node. kubelet polls
+// every volume, and each statfs of a slow virtiofs mount adds to the load of a node with
+// dozens of them, so a measurement is reused for the TTL and refreshed in the background
+// once half of it passed. A path whose mount turned out dead, such as a virtiofs mount
+// whose daemon went away, is never measured again until it is mounted again, as statfs
+// on it can hang.
+type volumeStatsCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*volumeStatsEntry
+}
+
+type volumeStatsEntry struct {
+	stats    *volumeStats
+	measured time.Time
+	fill     *volumeStatsFill
+	// dead is the error which found the mount dead, nil while it is not known to be
+	dead error
+}
+
+// volumeStatsFill is a measurement in flight
+type volumeStatsFill struct {
+	done  chan struct{}
+	stats *volumeStats
+	err   error
+}
+
+func newVolumeStatsCache(ttl time.Duration) *volumeStatsCache {
+	return &volumeStatsCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]*volumeStatsEntry),
+	}
+}
+
+// get returns the statistics of path, measured by measure unless a recent measurement
+// answers, and the error of a dead mount without measuring it
+func (c *volumeStatsCache) get(ctx context.Context, path string, measure func() (*volumeStats, error)) (*volumeStats, error) {
+	c.mu.Lock()
+	e, ok := c.entries[path]
+	if !ok {
+		e = &volumeStatsEntry{}
+		c.entries[path] = e
+	}
+
+	if e.dead != nil {
+		c.mu.Unlock()
+		volumeStatsLookups.add(1, "dead")
+		return nil, e.dead
+	}
+
+	if age := c.now().Sub(e.measured); e.stats != nil && age < c.ttl {
+		stats := e.stats
+		if age >= c.ttl/2 && e.fill == nil {
+			e.fill = &volumeStatsFill{done: make(chan struct{})}
+			go c.refresh(path, e, e.fill, measure)
+		}
+		c.mu.Unlock()
+		volumeStatsLookups.add(1, "hit")
+		return stats, nil
+	}
+
+	fill := e.fill
+	if fill == nil {
+		fill = &volumeStatsFill{done: make(chan struct{})}
+		e.fill = fill
+		go c.refresh(path, e, fill, measure)
+		volumeStatsLookups.add(1, "miss")
+	} else {
+		volumeStatsLookups.add(1, "shared")
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-fill.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return fill.stats, fill.err
+}
+
+// refresh measures path for fill, detached from the caller which started it so that a
+// hung statfs only holds up the callers waiting on it
+func (c *volumeStatsCache) refresh(path string, e *volumeStatsEntry, fill *volumeStatsFill, measure func() (*volumeStats, error)) {
+	fill.stats, fill.err = measure()
+
+	c.mu.Lock()
+	// an entry invalidated meanwhile belongs to a mount which is gone
+	if c.entries[path] == e {
+		switch {
+		case fill.err == nil:
+			e.stats, e.measured = fill.stats, c.now()
+		case isDeadMount(fill.err):
+			e.stats, e.dead = nil, fill.err
+		default:
+			e.stats = nil
+		}
+	}
+	if e.fill == fill {
+		e.fill = nil
+	}
+	c.mu.Unlock()
+
+	close(fill.done)
+}
+
+// deadMount returns the error which found the mount at path dead, nil while it is not known to be
+func (c *volumeStatsCache) deadMount(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[path]; ok {
+		return e.dead
+	}
+	return nil
+}
+
+// markDead remembers that the mount at path is dead, so that it is not measured again
+func (c *volumeStatsCache) markDead(path string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[path]
+	if !ok {
+		e = &volumeStatsEntry{}
+		c.entries[path] = e
+	}
+	e.stats, e.dead = nil, err
+}
+
+// invalidate forgets path, which was mounted, unmounted or resized
+func (c *volumeStatsCache) invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, path)
+}
+
+// isDeadMount reports whether err, or an error it wraps, tells of a mount whose backing
+// went away, such as ENOTCONN, ESTALE or EIO
+func isDeadMount(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if mount.IsCorruptedMnt(err) {
+			return true
+		}
+	}
+	return false
+}
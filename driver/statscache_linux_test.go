@@ -0,0 +1,54 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"k8s.io/mount-utils"
+)
+
+// deadMountHost fails statfs the way a virtiofs mount whose daemon went away does
+type deadMountHost struct {
+	*fakeHost
+	statfsCalls int
+}
+
+func (h *deadMountHost) statfs(path string) (*volumeUsage, error) {
+	h.statfsCalls++
+	return nil, &os.PathError{Op: "statfs", Path: path, Err: unix.ENOTCONN}
+}
+
+func TestVolumeStatsDeadMount(t *testing.T) {
+	target := t.TempDir()
+
+	mounter := newFakeMounter([]mount.MountPoint{{Path: target}})
+	node := NewVultrNodeDriver(&VultrDriver{log: logrus.NewEntry(logrus.New()), mounter: mounter})
+	host := &deadMountHost{fakeHost: &fakeHost{hostOS: node.host, mounter: mounter}}
+	node.host = host
+
+	req := &csi.NodeGetVolumeStatsRequest{VolumeId: "vfs-1", VolumePath: target}
+	for i := 0; i < 3; i++ {
+		res, err := node.NodeGetVolumeStats(context.Background(), req)
+		if err != nil {
+			t.Fatalf("NodeGetVolumeStats: %v", err)
+		}
+		if !res.VolumeCondition.GetAbnormal() || len(res.Usage) != 0 {
+			t.Fatalf("expected a dead mount to be abnormal without usage, got %+v", res)
+		}
+	}
+	if host.statfsCalls != 1 {
+		t.Errorf("expected a dead mount to be measured once, got %d statfs calls", host.statfsCalls)
+	}
+
+	node.volumeStats.invalidate(target)
+	if _, err := node.NodeGetVolumeStats(context.Background(), req); err != nil {
+		t.Fatalf("NodeGetVolumeStats: %v", err)
+	}
+	if host.statfsCalls != 2 {
+		t.Errorf("expected a path mounted again to be measured, got %d statfs calls", host.statfsCalls)
+	}
+}
@@ -0,0 +1,114 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVolumeStatsCache(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newVolumeStatsCache(10 * time.Second)
+	c.now = func() time.Time { return now }
+
+	var measured int32
+	measure := func() (*volumeStats, error) {
+		n := atomic.AddInt32(&measured, 1)
+		return &volumeStats{usage: &volumeUsage{UsedBytes: int64(n)}}, nil
+	}
+	get := func() int64 {
+		stats, err := c.get(context.Background(), "/target", measure)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		return stats.usage.UsedBytes
+	}
+
+	if used := get(); used != 1 {
+		t.Fatalf("expected the path to be measured, got %d", used)
+	}
+
+	now = now.Add(2 * time.Second)
+	if used := get(); used != 1 || atomic.LoadInt32(&measured) != 1 {
+		t.Errorf("expected a recent measurement to answer, got %d after %d measurements", used, atomic.LoadInt32(&measured))
+	}
+
+	// past half of the TTL the cached measurement answers while a new one is taken
+	now = now.Add(4 * time.Second)
+	if used := get(); used != 1 {
+		t.Errorf("expected the cached measurement to answer while refreshing, got %d", used)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&measured) == 2 })
+	waitFor(t, func() bool { return get() == 2 })
+
+	c.invalidate("/target")
+	if used := get(); used != 3 {
+		t.Errorf("expected an invalidated path to be measured again, got %d", used)
+	}
+
+	now = now.Add(time.Minute)
+	if used := get(); used != 4 {
+		t.Errorf("expected an expired measurement to be taken again, got %d", used)
+	}
+}
+
+func TestVolumeStatsCacheErrors(t *testing.T) {
+	c := newVolumeStatsCache(time.Minute)
+
+	failing := errors.New("permission denied")
+	calls := 0
+	measure := func() (*volumeStats, error) {
+		calls++
+		return nil, failing
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.get(context.Background(), "/target", measure); !errors.Is(err, failing) {
+			t.Fatalf("expected the error of the measurement, got %v", err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected failed measurements not to be cached, got %d calls", calls)
+	}
+
+	c.markDead("/target", failing)
+	if _, err := c.get(context.Background(), "/target", measure); !errors.Is(err, failing) || calls != 2 {
+		t.Errorf("expected a dead mount to fail without being measured, got %v after %d calls", err, calls)
+	}
+
+	c.invalidate("/target")
+	if err := c.deadMount("/target"); err != nil {
+		t.Errorf("expected a path mounted again to be forgotten as dead, got %v", err)
+	}
+}
+
+func TestVolumeStatsCacheCanceled(t *testing.T) {
+	c := newVolumeStatsCache(time.Minute)
+
+	release := make(chan struct{})
+	defer close(release)
+	hung := func() (*volumeStats, error) {
+		<-release
+		return &volumeStats{}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.get(ctx, "/target", hung); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a hung measurement to give way to the deadline of the caller, got %v", err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
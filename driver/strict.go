@@ -0,0 +1,222 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// coMetadataPrefix starts the parameters a container orchestrator adds on its own, such
+// as the PVC name and namespace the external provisioner passes with --extra-create-metadata
+const coMetadataPrefix = "csi.storage.k8s.io/"
+
+// storageTypeParameters are the canonical StorageClass parameters each storage type acts on
+var storageTypeParameters = map[string]map[string]bool{
+	storageTypeBlock: {
+		storageTypeParam:          true,
+		blockTypeParam:            true,
+		fsTypeParam:               true,
+		fsckParam:                 true,
+		fsckRepairParam:           true,
+		mkfsOptionsParam:          true,
+		reservedBlocksParam:       true,
+		encryptedParam:            true,
+		maxVolumeSizeParam:        true,
+		placementInstanceTagParam: true,
+		placementVPCParam:         true,
+		mountOptionsParam:         true,
+		wipePartitionsParam:       true,
+	},
+	storageTypeVFS: {
+		storageTypeParam:          true,
+		maxVolumeSizeParam:        true,
+		placementInstanceTagParam: true,
+		placementVPCParam:         true,
+		vfsTagsParam:              true,
+		vfsMountOptionsParam:      true,
+	},
+}
+
+// knownParameters are the canonical StorageClass parameters the driver acts on, for any
+// storage type
+var knownParameters = func() map[string]bool {
+	known := map[string]bool{}
+	for _, params := range storageTypeParameters {
+		for k := range params {
+			known[k] = true
+		}
+	}
+	return known
+}()
+
+// unknownParameters returns the sorted normalized parameters the driver does not act on
+func unknownParameters(params map[string]string) []string {
+	var unknown []string
+	for k := range params {
+		if !knownParameters[k] && !strings.HasPrefix(k, coMetadataPrefix) {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+
+	return unknown
+}
+
+// parameterViolations returns what is wrong with each normalized parameter the storage
+// type does not act on, sorted by parameter: unknown, with the known parameter it likely
+// misspells, or known for another storage type only
+func parameterViolations(storageType string, params map[string]string) []*errdetails.BadRequest_FieldViolation {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var violations []*errdetails.BadRequest_FieldViolation
+	for _, k := range keys {
+		if storageTypeParameters[storageType][k] || strings.HasPrefix(k, coMetadataPrefix) {
+			continue
+		}
+
+		description := fmt.Sprintf("parameter %q does not apply to %s volumes", k, storageType)
+		if !knownParameters[k] {
+			description = fmt.Sprintf("unknown parameter %q", k)
+			if known, ok := closestParameter(k); ok {
+				description += fmt.Sprintf(", did you mean %q?", known)
+			}
+		}
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: "parameters." + k, Description: description})
+	}
+	return violations
+}
+
+// closestParameter returns the known parameter k is a typo of, within two edits of it
+func closestParameter(k string) (string, bool) {
+	var closest string
+	best := 3
+	for known := range knownParameters {
+		if d := editDistance(k, known); d < best || (d == best && known < closest) {
+			closest, best = known, d
+		}
+	}
+	return closest, best <= 2
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// checkParameters fails with InvalidArgument when the normalized parameters hold one the
+// storage type does not act on, which would otherwise be ignored and the volume
+// provisioned without it. The error lists the parameters of the storage type, and
+// carries a BadRequest detail with a violation per parameter. StrictParameters=false
+// turns the check off, unless in strict mode.
+func (d *VultrDriver) checkParameters(rpc, storageType string, params map[string]string) error {
+	if !d.strictSpec && !d.features.enabled(featureStrictParameters) {
+		return nil
+	}
+
+	violations := parameterViolations(storageType, params)
+	if len(violations) == 0 {
+		return nil
+	}
+
+	descriptions := make([]string, 0, len(violations))
+	for _, v := range violations {
+		descriptions = append(descriptions, v.Description)
+	}
+	allowed := make([]string, 0, len(storageTypeParameters[storageType]))
+	for k := range storageTypeParameters[storageType] {
+		allowed = append(allowed, k)
+	}
+	sort.Strings(allowed)
+
+	st := status.Newf(codes.InvalidArgument, "%s %v: %s, %s volumes take the parameters %s",
+		rpc, errUnknownParameter, strings.Join(descriptions, "; "), storageType, strings.Join(allowed, ", "))
+
+	withInfo, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return st.Err()
+	}
+	return withInfo.Err()
+}
+
+// strictNodeCapability fails with InvalidArgument in strict mode when the node is asked
+// to stage or publish the volume with a capability its storage does not support, which
+// is otherwise left to the controller to have refused
+func (d *VultrDriver) strictNodeCapability(rpc string, capability *csi.VolumeCapability, volCtx map[string]string) error {
+	if !d.strictSpec {
+		return nil
+	}
+
+	storageType := volCtx[volumeContextStorageType]
+	if storageType == "" {
+		storageType = defaultStorageType
+	}
+
+	if !isValidCapability([]*csi.VolumeCapability{capability}, storageType) {
+		return status.Errorf(codes.InvalidArgument, "%s volume capability %v is not supported by %s volumes", rpc, capability, storageType)
+	}
+	return nil
+}
+
+// strictCapabilities fails with InvalidArgument in strict mode when the capabilities of a
+// single volume ask for both raw block and filesystem access, which cannot be provisioned
+// as one volume and is otherwise settled by whichever capability the node is given
+func (d *VultrDriver) strictCapabilities(rpc string, caps []*csi.VolumeCapability) error {
+	if !d.strictSpec || !mixedAccessTypes(caps) {
+		return nil
+	}
+
+	return status.Errorf(codes.InvalidArgument, "%s volume capabilities mix block and mount access types", rpc)
+}
+
+// mixedAccessTypes reports whether the capabilities ask for both raw block and filesystem access
+func mixedAccessTypes(caps []*csi.VolumeCapability) bool {
+	var block, mount bool
+	for _, capability := range caps {
+		switch capability.GetAccessType().(type) {
+		case *csi.VolumeCapability_Block:
+			block = true
+		case *csi.VolumeCapability_Mount:
+			mount = true
+		}
+	}
+	return block && mount
+}
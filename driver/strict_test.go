@@ -0,0 +1,182 @@
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnknownParameters(t *testing.T) {
+	params := map[string]string{
+		blockTypeParam:                  "high_perf",
+		"csi.storage.k8s.io/pvc/name":   "data",
+		"iops":                          "3000",
+		"zone":                          "a",
+		fsTypeParam:                     fsTypeExt4,
+		regionParam:                     "ewr",
+		placementInstanceTagParam:       "storage",
+		"csi.storage.k8s.io/pv/name":    "pvc-1",
+		"csi.storage.k8s.io/pvc/labels": "",
+	}
+
+	expected := []string{"iops", regionParam, "zone"}
+	if unknown := unknownParameters(params); !reflect.DeepEqual(unknown, expected) {
+		t.Errorf("expected %v, got %v", expected, unknown)
+	}
+}
+
+func TestStrictSpecController(t *testing.T) {
+	mount := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	tests := []struct {
+		name     string
+		params   map[string]string
+		caps     []*csi.VolumeCapability
+		lenient  codes.Code
+		strict   codes.Code
+		validate bool
+	}{
+		{"supported", map[string]string{"block_type": "high_perf"}, []*csi.VolumeCapability{mount}, codes.OK, codes.OK, true},
+		{"metadata", map[string]string{"block_type": "high_perf", "csi.storage.k8s.io/pvc/name": "data"},
+			[]*csi.VolumeCapability{mount}, codes.OK, codes.OK, true},
+		{"unknown parameter", map[string]string{"block_type": "high_perf", "iops": "3000"},
+			[]*csi.VolumeCapability{mount}, codes.OK, codes.InvalidArgument, false},
+		{"mixed access types", map[string]string{"block_type": "high_perf"},
+			[]*csi.VolumeCapability{mount, block}, codes.OK, codes.InvalidArgument, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, strict := range []bool{false, true} {
+				controller := NewFakeVultrControllerServer("strict spec")
+				controller.Driver.strictSpec = strict
+				// strict mode checks the parameters whatever the gate
+				controller.Driver.features = featureGates{featureStrictParameters: false}
+
+				expected := tt.lenient
+				if strict {
+					expected = tt.strict
+				}
+
+				_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+					Name:               "volume-test-name",
+					Parameters:         tt.params,
+					VolumeCapabilities: tt.caps,
+				})
+				if status.Code(err) != expected {
+					t.Errorf("strict %t: expected CreateVolume %v, got %v", strict, expected, err)
+				}
+
+				res, err := controller.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+					VolumeId:           "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+					Parameters:         tt.params,
+					VolumeCapabilities: tt.caps,
+				})
+				if err != nil {
+					t.Fatalf("strict %t: expected no error, got %v", strict, err)
+				}
+				if confirmed := res.Confirmed != nil; confirmed != (!strict || tt.validate) {
+					t.Errorf("strict %t: expected confirmed %t, got %v", strict, !strict || tt.validate, res)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckParameters(t *testing.T) {
+	controller := NewFakeVultrControllerServer("check parameters")
+	mount := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "volume-test-name",
+		Parameters:         map[string]string{"blok_type": "high_perf", "fstyp": fsTypeExt4, "iops": "3000", vfsTagsParam: "a"},
+		VolumeCapabilities: []*csi.VolumeCapability{mount},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+
+	var request *errdetails.BadRequest
+	for _, d := range status.Convert(err).Details() {
+		request, _ = d.(*errdetails.BadRequest)
+	}
+	expected := map[string]string{
+		"parameters.blok_type": `unknown parameter "blok_type", did you mean "block_type"?`,
+		"parameters.fstyp":     `unknown parameter "fstyp", did you mean "fs_type"?`,
+		"parameters.iops":      `unknown parameter "iops"`,
+		"parameters.tags":      `parameter "tags" does not apply to block volumes`,
+	}
+	violations := map[string]string{}
+	for _, v := range request.GetFieldViolations() {
+		violations[v.GetField()] = v.GetDescription()
+	}
+	if !reflect.DeepEqual(violations, expected) {
+		t.Errorf("expected violations %v, got %v", expected, violations)
+	}
+	if msg := status.Convert(err).Message(); !strings.Contains(msg, "block volumes take the parameters block_type, encrypted, fs_type") {
+		t.Errorf("expected the parameters of block volumes to be listed, got %s", msg)
+	}
+
+	vfsParams := map[string]string{vfsTagsParam: "a", maxVolumeSizeParam: "10"}
+	if violations := parameterViolations(storageTypeVFS, vfsParams); len(violations) != 0 {
+		t.Errorf("expected the parameters of vfs volumes to be accepted, got %v", violations)
+	}
+	if violations := parameterViolations(storageTypeVFS, map[string]string{fsTypeParam: fsTypeExt4}); len(violations) != 1 {
+		t.Errorf("expected block parameters to be refused for vfs volumes, got %v", violations)
+	}
+}
+
+func TestStrictSpecNode(t *testing.T) {
+	node := newFakeMountNode(&fakeExec{})
+	node.Driver.strictSpec = true
+
+	// block volumes attach to a single node
+	shared := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+
+	_, err := node.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		StagingTargetPath: t.TempDir(),
+		VolumeCapability:  shared,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected NodeStageVolume InvalidArgument, got %v", err)
+	}
+
+	_, err = node.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		StagingTargetPath: t.TempDir(),
+		TargetPath:        filepath.Join(t.TempDir(), "target"),
+		VolumeCapability:  shared,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected NodePublishVolume InvalidArgument, got %v", err)
+	}
+
+	_, err = node.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "c56c7b6e-15c2-445e-9a5d-1063ab5828ec",
+		VolumePath: filepath.Join(t.TempDir(), "missing"),
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NodeGetVolumeStats NotFound, got %v", err)
+	}
+}
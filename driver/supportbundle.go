@@ -0,0 +1,300 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	// supportBundleMaxFileBytes bounds each log and trace copied into a bundle, which keeps their end
+	supportBundleMaxFileBytes = 16 << 20
+
+	// supportBundleManifest is the file of a bundle listing what it holds and what could not be collected
+	supportBundleManifest = "bundle.json"
+)
+
+// mountInfoPath is the mount table a support bundle copies
+var mountInfoPath = "/proc/self/mountinfo"
+
+// sensitiveTextPatterns match credentials in logs and traces, the first group being
+// the part kept before the redacted value
+var sensitiveTextPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(bearer\s+)[^\s"',]+`),
+	regexp.MustCompile(`(?i)((?:token|secret|password|passphrase|api[_-]?key)["']?\s*[=:]\s*["']?)[^\s"',&]+`),
+}
+
+// SupportBundleOptions tells a support bundle where the driver keeps its state. Sources
+// left empty are skipped.
+type SupportBundleOptions struct {
+	// Version of the driver writing the bundle
+	Version string
+
+	// Endpoint is the CSI endpoint of the plugin, whose plugin info reports its configuration
+	Endpoint string
+
+	// AdminURL and AdminToken reach the admin API of the plugin
+	AdminURL   string
+	AdminToken string
+
+	// MetricsURL is the base URL the plugin serves its metrics on
+	MetricsURL string
+
+	// APIRecordFile is the recording of the Vultr API exchanges of the plugin
+	APIRecordFile string
+
+	// LogFiles are the driver logs to include
+	LogFiles []string
+
+	// Secrets are values redacted wherever they appear, such as the API token
+	Secrets []string
+}
+
+// supportBundleManifestFile is the document listing the contents of a bundle
+type supportBundleManifestFile struct {
+	Version   string    `json:"version"`
+	Hostname  string    `json:"hostname"`
+	CreatedAt time.Time `json:"created_at"`
+	Files     []string  `json:"files"`
+	Errors    []string  `json:"errors,omitempty"`
+}
+
+// supportBundle writes the sanitized files of a bundle to a tar archive
+type supportBundle struct {
+	tw       *tar.Writer
+	secrets  []string
+	manifest supportBundleManifestFile
+	err      error
+}
+
+// WriteSupportBundle writes a gzipped tar archive holding the configuration, debug state
+// and metrics of the plugin, the mount table and devices of the node, and the recent API
+// exchanges and logs of the driver, with credentials redacted. Sources which cannot be
+// collected are listed in the bundle manifest rather than failing the bundle.
+func WriteSupportBundle(ctx context.Context, w io.Writer, opts SupportBundleOptions) error {
+	gz := gzip.NewWriter(w)
+	b := &supportBundle{tw: tar.NewWriter(gz)}
+	for _, secret := range append([]string{opts.AdminToken}, opts.Secrets...) {
+		// short values would redact everything they happen to be part of
+		if len(secret) >= 4 {
+			b.secrets = append(b.secrets, secret)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	b.manifest = supportBundleManifestFile{Version: opts.Version, Hostname: hostname, CreatedAt: time.Now().UTC()}
+
+	if opts.Endpoint != "" {
+		b.collect("plugin-info.json", func() ([]byte, error) { return pluginInfo(ctx, opts.Endpoint) })
+	}
+	if opts.AdminURL != "" {
+		b.collect("volumes.json", func() ([]byte, error) {
+			return fetchBundleURL(ctx, strings.TrimSuffix(opts.AdminURL, "/")+AdminVolumesPath, opts.AdminToken)
+		})
+	}
+	if opts.MetricsURL != "" {
+		b.collect("metrics.txt", func() ([]byte, error) {
+			return fetchBundleURL(ctx, strings.TrimSuffix(opts.MetricsURL, "/")+MetricsPath, "")
+		})
+	}
+
+	b.collect("node/mountinfo.txt", func() ([]byte, error) { return os.ReadFile(mountInfoPath) })
+	b.collect("node/devices.txt", listBundleDevices)
+
+	if opts.APIRecordFile != "" {
+		// the rotated recording holds the exchanges older than the current one
+		if rotated := opts.APIRecordFile + ".1"; fileExists(rotated) {
+			b.collectFile("api/", rotated)
+		}
+		b.collectFile("api/", opts.APIRecordFile)
+	}
+
+	for _, path := range opts.LogFiles {
+		b.collectFile("logs/", path)
+	}
+
+	manifest, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	b.add(supportBundleManifest, manifest)
+
+	if b.err != nil {
+		return b.err
+	}
+	if err := b.tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// collect adds the file read by fn, recording in the manifest why it could not be read
+func (b *supportBundle) collect(name string, fn func() ([]byte, error)) {
+	data, err := fn()
+	if err != nil {
+		b.manifest.Errors = append(b.manifest.Errors, fmt.Sprintf("%s: %s", name, b.sanitize([]byte(err.Error()))))
+		return
+	}
+
+	b.manifest.Files = append(b.manifest.Files, name)
+	b.add(name, b.sanitize(data))
+}
+
+// collectFile adds the end of the file at path to the directory of the bundle
+func (b *supportBundle) collectFile(dir, path string) {
+	b.collect(dir+filepath.Base(path), func() ([]byte, error) { return readTail(path, supportBundleMaxFileBytes) })
+}
+
+func (b *supportBundle) add(name string, data []byte) {
+	if b.err != nil {
+		return
+	}
+
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: b.manifest.CreatedAt,
+	}
+	if b.err = b.tw.WriteHeader(header); b.err != nil {
+		return
+	}
+	_, b.err = b.tw.Write(data)
+}
+
+// sanitize redacts the secrets of the bundle and anything looking like a credential
+func (b *supportBundle) sanitize(data []byte) []byte {
+	for _, secret := range b.secrets {
+		data = bytes.ReplaceAll(data, []byte(secret), []byte(redactedValue))
+	}
+	for _, pattern := range sensitiveTextPatterns {
+		data = pattern.ReplaceAll(data, []byte("${1}"+redactedValue))
+	}
+	return data
+}
+
+// pluginInfo returns the plugin info of the plugin serving the CSI endpoint, whose
+// manifest reports its configuration
+func pluginInfo(ctx context.Context, endpoint string) ([]byte, error) {
+	conn, err := grpc.NewClient(endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, adminReadTimeout)
+	defer cancel()
+
+	info, err := csi.NewIdentityClient(conn).GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(info, "", "  ")
+}
+
+func fetchBundleURL(ctx context.Context, u, token string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, supportBundleMaxFileBytes))
+}
+
+// listBundleDevices lists the block devices of the node with their serial and size,
+// and the devices the volumes are linked by
+func listBundleDevices() ([]byte, error) {
+	entries, err := os.ReadDir(sysBlockPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "DEVICE\tSERIAL\tSIZE")
+	for _, e := range entries {
+		serial, _ := os.ReadFile(filepath.Join(sysBlockPath, e.Name(), "serial"))
+		// sizes are in 512 byte sectors whatever the block size of the device
+		sectors, _ := os.ReadFile(filepath.Join(sysBlockPath, e.Name(), "size"))
+		fmt.Fprintf(&buf, "%s\t%s\t%s\n", e.Name(), strings.TrimSpace(string(serial)), strings.TrimSpace(string(sectors)))
+	}
+
+	links, err := os.ReadDir(diskPath)
+	if err != nil {
+		fmt.Fprintf(&buf, "\ncannot list %s: %v\n", diskPath, err)
+		return buf.Bytes(), nil
+	}
+
+	fmt.Fprintf(&buf, "\nLINK\tDEVICE\n")
+	for _, l := range links {
+		device, err := filepath.EvalSymlinks(filepath.Join(diskPath, l.Name()))
+		if err != nil {
+			device = err.Error()
+		}
+		fmt.Fprintf(&buf, "%s\t%s\n", l.Name(), device)
+	}
+	return buf.Bytes(), nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// readTail returns the file, only its last max bytes when it is larger
+func readTail(path string, max int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > max {
+		if _, err := f.Seek(-max, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+	return io.ReadAll(f)
+}
@@ -0,0 +1,100 @@
+package driver
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readSupportBundle(t *testing.T, data []byte) map[string]string {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("expected a gzip archive, got %v", err)
+	}
+
+	files := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatalf("expected a tar archive, got %v", err)
+		}
+		content, _ := io.ReadAll(tr)
+		files[header.Name] = string(content)
+	}
+}
+
+func TestWriteSupportBundle(t *testing.T) {
+	dir := t.TempDir()
+
+	defer func(orig string) { mountInfoPath = orig }(mountInfoPath)
+	mountInfoPath = filepath.Join(dir, "mountinfo")
+	os.WriteFile(mountInfoPath, []byte("36 35 98:0 / /mnt/staging rw - ext4 /dev/vdb rw\n"), 0600) //nolint:errcheck
+
+	defer func(orig string) { sysBlockPath = orig }(sysBlockPath)
+	sysBlockPath = filepath.Join(dir, "block")
+	os.MkdirAll(filepath.Join(sysBlockPath, "vdb"), 0700)                                              //nolint:errcheck
+	os.WriteFile(filepath.Join(sysBlockPath, "vdb", "serial"), []byte("c56c7b6e15c2445e9a5d\n"), 0600) //nolint:errcheck
+
+	logFile := filepath.Join(dir, "driver.log")
+	os.WriteFile(logFile, []byte("level=info msg=starting token=s3cr3t-api-key\nAuthorization: Bearer abcdef\n"), 0600) //nolint:errcheck
+	recordFile := filepath.Join(dir, "api.jsonl")
+	os.WriteFile(recordFile, []byte(`{"method":"GET","path":"/v2/blocks"}`+"\n"), 0600) //nolint:errcheck
+
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer admin-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"volumes":[]}`)) //nolint:errcheck
+	}))
+	defer admin.Close()
+
+	var buf bytes.Buffer
+	err := WriteSupportBundle(context.Background(), &buf, SupportBundleOptions{
+		Version:       "v1.0.0",
+		AdminURL:      admin.URL,
+		AdminToken:    "admin-token",
+		APIRecordFile: recordFile,
+		LogFiles:      []string{logFile, filepath.Join(dir, "missing.log")},
+		Secrets:       []string{"s3cr3t-api-key"},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	files := readSupportBundle(t, buf.Bytes())
+	for _, name := range []string{"volumes.json", "node/mountinfo.txt", "node/devices.txt", "api/api.jsonl", "logs/driver.log"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("expected the bundle to hold %s, got %v", name, files)
+		}
+	}
+
+	log := files["logs/driver.log"]
+	if strings.Contains(log, "s3cr3t-api-key") || strings.Contains(log, "abcdef") {
+		t.Errorf("expected the credentials to be redacted, got %q", log)
+	}
+	if !strings.Contains(files["node/devices.txt"], "vdb\tc56c7b6e15c2445e9a5d") {
+		t.Errorf("expected the device to be listed, got %q", files["node/devices.txt"])
+	}
+
+	var manifest supportBundleManifestFile
+	if err := json.Unmarshal([]byte(files[supportBundleManifest]), &manifest); err != nil {
+		t.Fatalf("expected a manifest, got %v", err)
+	}
+	if manifest.Version != "v1.0.0" || len(manifest.Errors) != 1 || !strings.HasPrefix(manifest.Errors[0], "logs/missing.log: open ") {
+		t.Errorf("expected the missing log to be reported, got %+v", manifest)
+	}
+}
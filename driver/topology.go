@@ -0,0 +1,90 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// DefaultTopologyRegionKey is the authoritative topology key of the region unless
+// WithTopologyRegionKey sets another, which keeps the node affinity of existing
+// PersistentVolumes
+const DefaultTopologyRegionKey = topologyRegionKey
+
+// topologyStandardRegionKey is the well-known Kubernetes label of the region, which the
+// scheduler, cluster autoscaler and other integrations understand
+const topologyStandardRegionKey = "topology.kubernetes.io/region"
+
+// WithTopologyRegionKey sets the authoritative topology key of the region, region or
+// topology.kubernetes.io/region. Nodes report the region under both keys. Volumes are
+// only accessible under the authoritative key, and topology requirements are read from
+// it first, falling back to the other key.
+func WithTopologyRegionKey(key string) Option {
+	return func(d *VultrDriver) {
+		d.regionTopologyKey = key
+	}
+}
+
+// validateTopologyRegionKey refuses keys the driver does not report the region under
+func (d *VultrDriver) validateTopologyRegionKey() error {
+	switch d.regionTopologyKey {
+	case "", topologyRegionKey, topologyStandardRegionKey:
+		return nil
+	}
+	return fmt.Errorf("topology region key %q must be %s or %s", d.regionTopologyKey, topologyRegionKey, topologyStandardRegionKey)
+}
+
+// regionKeys returns the authoritative topology key of the region, then the other one
+func (d *VultrDriver) regionKeys() (string, string) {
+	if d.regionTopologyKey == topologyStandardRegionKey {
+		return topologyStandardRegionKey, topologyRegionKey
+	}
+	return topologyRegionKey, topologyStandardRegionKey
+}
+
+// topologyRegion returns the region of the segments under the authoritative key, else the other
+func (d *VultrDriver) topologyRegion(segments map[string]string) string {
+	authoritative, other := d.regionKeys()
+	if region := segments[authoritative]; region != "" {
+		return region
+	}
+	return segments[other]
+}
+
+// nodeTopology returns the topology of the node, with the region under both keys so that
+// volumes provisioned under either are accessible from it. Kubernetes labels the regions
+// of nodes in lower case, which the standard key follows so as not to collide with them.
+func (d *VultrDriver) nodeTopology() *csi.Topology {
+	return &csi.Topology{
+		Segments: map[string]string{
+			topologyRegionKey:         d.region,
+			topologyStandardRegionKey: strings.ToLower(d.region),
+		},
+	}
+}
+
+// volumeTopology returns the topology a volume is accessible from
+func (d *VultrDriver) volumeTopology(vol *backendVolume) []*csi.Topology {
+	authoritative, _ := d.regionKeys()
+	return []*csi.Topology{
+		{
+			Segments: map[string]string{
+				authoritative: vol.Region,
+			},
+		},
+	}
+}
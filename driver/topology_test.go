@@ -0,0 +1,74 @@
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestTopologyRegionKey(t *testing.T) {
+	segments := func(region string, keys ...string) map[string]string {
+		s := map[string]string{}
+		for _, key := range keys {
+			s[key] = region
+		}
+		return s
+	}
+
+	tests := []struct {
+		key string
+		// volume is the key volumes are accessible under
+		volume string
+		// read is the region read from segments holding lax under region and sjc under the standard key
+		read string
+	}{
+		{"", topologyRegionKey, "lax"},
+		{topologyRegionKey, topologyRegionKey, "lax"},
+		{topologyStandardRegionKey, topologyStandardRegionKey, "sjc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			d := &VultrDriver{region: "EWR", regionTopologyKey: tt.key}
+			if err := d.validateTopologyRegionKey(); err != nil {
+				t.Fatal(err)
+			}
+
+			node := NewVultrNodeDriver(d)
+			info, err := node.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := map[string]string{topologyRegionKey: "EWR", topologyStandardRegionKey: "ewr"}
+			if !reflect.DeepEqual(info.AccessibleTopology.Segments, expected) {
+				t.Errorf("expected the node region under both keys, got %v", info.AccessibleTopology.Segments)
+			}
+
+			topology := d.volumeTopology(&backendVolume{Region: "ewr"})
+			if len(topology) != 1 || !reflect.DeepEqual(topology[0].Segments, segments("ewr", tt.volume)) {
+				t.Errorf("expected volumes accessible under %s, got %v", tt.volume, topology)
+			}
+
+			both := map[string]string{topologyRegionKey: "lax", topologyStandardRegionKey: "sjc"}
+			if region := d.topologyRegion(both); region != tt.read {
+				t.Errorf("expected %s from the authoritative key, got %s", tt.read, region)
+			}
+			for _, key := range []string{topologyRegionKey, topologyStandardRegionKey} {
+				if region := d.topologyRegion(segments("ord", key)); region != "ord" {
+					t.Errorf("expected the region under %s alone to be read, got %q", key, region)
+				}
+			}
+
+			req := &csi.TopologyRequirement{Requisite: []*csi.Topology{{Segments: segments("ord", topologyStandardRegionKey)}}}
+			if region, err := provisioningRegion(req, "ewr", nil, nil, d.topologyRegion); err != nil || region != "ord" {
+				t.Errorf("expected requirements under the standard key to be honored, got %q, %v", region, err)
+			}
+		})
+	}
+
+	if err := (&VultrDriver{regionTopologyKey: "topology.kubernetes.io/zone"}).validateTopologyRegionKey(); err == nil {
+		t.Errorf("expected an unknown topology key to be refused")
+	}
+}
@@ -0,0 +1,452 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// tracingPath is where an OTLP/HTTP collector takes spans, when the endpoint names no path
+	tracingPath = "/v1/traces"
+	// traceparentKey is the incoming metadata key carrying the W3C trace context of the caller
+	traceparentKey = "traceparent"
+
+	tracingQueueSize     = 2048
+	tracingBatchSize     = 256
+	tracingFlushInterval = 5 * time.Second
+	tracingTimeout       = 10 * time.Second
+)
+
+// The OTLP kinds of the spans
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// spanStatusError is the OTLP status code of a failed span
+const spanStatusError = 2
+
+var tracingSpans = metrics.newCounter("tracing_spans_total",
+	"Number of trace spans sent to the OTLP collector, by result", "result")
+
+// WithTracing exports a span for each gRPC RPC, with child spans for its Vultr API
+// requests, device waits, mounts and the commands the node runs, to the OTLP/HTTP
+// collector at endpoint. Tracing is disabled when endpoint is empty.
+func WithTracing(endpoint string) Option {
+	return func(d *VultrDriver) {
+		d.tracingEndpoint = endpoint
+	}
+}
+
+// spanAttrs are the attributes of a span, string, int, int64 or bool values
+type spanAttrs map[string]interface{}
+
+// span is an operation of a trace. The methods of a nil span, that of a disabled
+// tracer, do nothing.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	attrs    spanAttrs
+
+	mu    sync.Mutex
+	ended bool
+}
+
+type spanKey struct{}
+
+// tracer records the spans of the driver and sends them to the OTLP collector in
+// batches. A collector which is down or too slow loses spans rather than holding up the
+// RPCs.
+type tracer struct {
+	url     string
+	service string
+	client  *http.Client
+	log     *logrus.Entry
+
+	mu      sync.Mutex
+	pending []otlpSpan
+	// full wakes the export loop once a batch of spans is pending
+	full chan struct{}
+}
+
+func newTracer(d *VultrDriver) (*tracer, error) {
+	u, err := url.Parse(d.tracingEndpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("tracing endpoint %q must be an absolute http or https URL", d.tracingEndpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = tracingPath
+	}
+
+	return &tracer{
+		url:     u.String(),
+		service: d.name,
+		client:  &http.Client{Timeout: tracingTimeout},
+		log:     d.log.WithField("loop", "tracing"),
+		full:    make(chan struct{}, 1),
+	}, nil
+}
+
+// start begins a span, the child of the span in ctx, and returns ctx carrying it
+func (t *tracer) start(ctx context.Context, name string, kind int, attrs spanAttrs) (context.Context, *span) {
+	return t.startAt(ctx, name, kind, attrs, time.Now())
+}
+
+func (t *tracer) startAt(ctx context.Context, name string, kind int, attrs spanAttrs, start time.Time) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &span{tracer: t, name: name, kind: kind, start: start, attrs: attrs}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else if _, err := rand.Read(s.traceID[:]); err != nil {
+		return ctx, nil
+	}
+	if _, err := rand.Read(s.spanID[:]); err != nil {
+		return ctx, nil
+	}
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// trace runs fn within a span named name
+func (t *tracer) trace(ctx context.Context, name string, attrs spanAttrs, fn func(context.Context) error) error {
+	ctx, s := t.start(ctx, name, spanKindInternal, attrs)
+	err := fn(ctx)
+	s.end(err)
+	return err
+}
+
+// end completes the span, failed with err unless it is nil
+func (s *span) end(err error) {
+	if s == nil || s.tracer == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.tracer.record(s, time.Now(), err)
+}
+
+// set adds an attribute to the span
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = spanAttrs{}
+	}
+	s.attrs[key] = value
+}
+
+// logFields are the fields tying the log lines of the span to its trace
+func (s *span) logFields() logrus.Fields {
+	return logrus.Fields{
+		"trace_id": hex.EncodeToString(s.traceID[:]),
+		"span_id":  hex.EncodeToString(s.spanID[:]),
+	}
+}
+
+// remoteParent returns ctx carrying the span of the caller named by the traceparent of
+// the incoming metadata, for the RPC span to join the trace of the caller
+func remoteParent(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	values := md.Get(traceparentKey)
+	if len(values) == 0 {
+		return ctx
+	}
+
+	// version-traceid-parentid-flags, see https://www.w3.org/TR/trace-context/
+	parts := strings.Split(values[0], "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	parent := &span{}
+	if _, err := hex.Decode(parent.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(parent.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	if parent.traceID == [16]byte{} || parent.spanID == [8]byte{} {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, parent)
+}
+
+// intercept is a gRPC interceptor tracing each RPC, whose handler logs with the IDs of
+// its trace
+func (t *tracer) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) { //nolint:lll
+	service, method, _ := strings.Cut(strings.TrimPrefix(info.FullMethod, "/"), "/")
+	ctx, s := t.start(remoteParent(ctx), info.FullMethod, spanKindServer, spanAttrs{
+		"rpc.system":  "grpc",
+		"rpc.service": service,
+		"rpc.method":  method,
+	})
+	if s == nil {
+		return handler(ctx, req)
+	}
+	if id := callRequestID(ctx); id != "" {
+		s.set("csi.request_id", id)
+	}
+	if volumeID := requestVolumeID(req); volumeID != "" {
+		s.set("csi.volume_id", volumeID)
+	}
+	if logger, ok := ctx.Value(requestLoggerKey{}).(*logrus.Entry); ok {
+		ctx = context.WithValue(ctx, requestLoggerKey{}, logger.WithFields(s.logFields()))
+	}
+
+	resp, err := handler(ctx, req)
+	s.set("rpc.grpc.status_code", int(status.Code(err)))
+	s.end(err)
+	return resp, err
+}
+
+// OnRequestCompleted implements APIRequestHook, recording the request as a span of the
+// RPC which made it
+func (t *tracer) OnRequestCompleted(ctx context.Context, req APIRequest) {
+	_, s := t.startAt(ctx, "Vultr API "+req.Method, spanKindClient, spanAttrs{
+		"http.request.method": req.Method,
+		"url.path":            req.Path,
+	}, time.Now().Add(-req.Duration))
+	if s == nil {
+		return
+	}
+	if req.RequestID != "" {
+		s.set("vultr.request_id", req.RequestID)
+	}
+
+	var err error
+	if req.StatusCode == 0 {
+		err = fmt.Errorf("no response")
+	} else {
+		s.set("http.response.status_code", req.StatusCode)
+		if req.StatusCode >= http.StatusBadRequest {
+			err = fmt.Errorf("%d %s", req.StatusCode, http.StatusText(req.StatusCode))
+		}
+	}
+	s.end(err)
+}
+
+// record queues the ended span for export, dropping it when the collector is too far behind
+func (t *tracer) record(s *span, end time.Time, err error) {
+	exported := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		exported.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if err != nil {
+		exported.Status = &otlpStatus{Code: spanStatusError, Message: err.Error()}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) >= tracingQueueSize {
+		tracingSpans.add(1, "dropped")
+		return
+	}
+	t.pending = append(t.pending, exported)
+	if len(t.pending) >= tracingBatchSize {
+		select {
+		case t.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run exports the pending spans every tracingFlushInterval, or once a batch is pending,
+// until ctx is done
+func (t *tracer) run(ctx context.Context) {
+	ticker := time.NewTicker(tracingFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-t.full:
+		}
+		t.flush(ctx)
+	}
+}
+
+// flush exports the pending spans, in batches
+func (t *tracer) flush(ctx context.Context) {
+	for {
+		t.mu.Lock()
+		n := min(len(t.pending), tracingBatchSize)
+		batch := t.pending[:n:n]
+		t.pending = t.pending[n:]
+		t.mu.Unlock()
+
+		if n == 0 {
+			return
+		}
+		if err := t.export(ctx, batch); err != nil {
+			tracingSpans.add(float64(n), "failed")
+			t.log.Warnf("cannot export %d spans: %v", n, err)
+			return
+		}
+		tracingSpans.add(float64(n), "exported")
+	}
+}
+
+// export POSTs the spans to the collector
+func (t *tracer) export(ctx context.Context, spans []otlpSpan) error {
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes(spanAttrs{"service.name": t.service})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/vultr/vultr-csi/driver"},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of spans, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func otlpAttributes(attrs spanAttrs) []otlpAttribute {
+	list := make([]otlpAttribute, 0, len(attrs))
+	for key, value := range attrs {
+		var v otlpValue
+		switch t := value.(type) {
+		case string:
+			v.StringValue = &t
+		case int:
+			i := strconv.Itoa(t)
+			v.IntValue = &i
+		case int64:
+			i := strconv.FormatInt(t, 10)
+			v.IntValue = &i
+		case bool:
+			v.BoolValue = &t
+		default:
+			s := fmt.Sprint(t)
+			v.StringValue = &s
+		}
+		list = append(list, otlpAttribute{Key: key, Value: v})
+	}
+	return list
+}
@@ -0,0 +1,135 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestNewTracer(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		url      string
+		wantErr  bool
+	}{
+		{endpoint: "http://collector:4318", url: "http://collector:4318/v1/traces"},
+		{endpoint: "https://collector:4318/", url: "https://collector:4318/v1/traces"},
+		{endpoint: "http://collector:4318/otlp/v1/traces", url: "http://collector:4318/otlp/v1/traces"},
+		{endpoint: "collector:4318", wantErr: true},
+		{endpoint: "ftp://collector", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		tr, err := newTracer(&VultrDriver{tracingEndpoint: tt.endpoint, log: logrus.NewEntry(logrus.New())})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.endpoint)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", tt.endpoint, err)
+			continue
+		}
+		if tr.url != tt.url {
+			t.Errorf("%s: expected spans to be sent to %s, got %s", tt.endpoint, tt.url, tr.url)
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	var mu sync.Mutex
+	var exported []otlpSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var traces otlpTraces
+		if err := json.NewDecoder(r.Body).Decode(&traces); err != nil {
+			t.Errorf("cannot decode the exported spans: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range traces.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				exported = append(exported, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	tr, err := newTracer(&VultrDriver{tracingEndpoint: collector.URL, name: "block.csi.vultr.com", log: logrus.NewEntry(logrus.New())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const remoteTrace, remoteSpan = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(traceparentKey, "00-"+remoteTrace+"-"+remoteSpan+"-01"))
+	ctx = context.WithValue(ctx, requestLoggerKey{}, logrus.NewEntry(logrus.New()))
+
+	var logged logrus.Fields
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+	_, err = tr.intercept(ctx, nil, info, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		logged = requestLogger(ctx, logrus.NewEntry(logrus.New())).Data
+		tr.OnRequestCompleted(ctx, APIRequest{Method: http.MethodGet, Path: "/v2/blocks/vol-1", StatusCode: http.StatusOK, RequestID: "vultr-1",
+			Duration: 20 * time.Millisecond})
+		return nil, tr.trace(ctx, "format_and_mount", spanAttrs{"fs_type": "ext4"}, func(context.Context) error {
+			return errors.New("mount failed")
+		})
+	})
+	if err == nil {
+		t.Fatal("expected the error of the handler")
+	}
+	tr.flush(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(exported) != 3 {
+		t.Fatalf("expected the RPC, API and mount spans, got %+v", exported)
+	}
+	byName := make(map[string]otlpSpan)
+	for _, s := range exported {
+		if s.TraceID != remoteTrace {
+			t.Errorf("expected span %s to join the trace of the caller, got trace %s", s.Name, s.TraceID)
+		}
+		byName[s.Name] = s
+	}
+
+	rpc := byName["/csi.v1.Node/NodeStageVolume"]
+	if rpc.ParentSpanID != remoteSpan || rpc.Kind != spanKindServer || rpc.Status == nil || rpc.Status.Code != spanStatusError {
+		t.Errorf("expected a failed server span under the caller's span, got %+v", rpc)
+	}
+	if logged["trace_id"] != remoteTrace || logged["span_id"] != rpc.SpanID {
+		t.Errorf("expected the handler to log with the IDs of its span, got %v", logged)
+	}
+
+	api := byName["Vultr API GET"]
+	if api.ParentSpanID != rpc.SpanID || api.Kind != spanKindClient || api.Status != nil {
+		t.Errorf("expected a successful client span under the RPC span, got %+v", api)
+	}
+	mount := byName["format_and_mount"]
+	if mount.ParentSpanID != rpc.SpanID || mount.Status == nil || mount.Status.Message != "mount failed" {
+		t.Errorf("expected a failed mount span under the RPC span, got %+v", mount)
+	}
+}
+
+func TestDisabledTracer(t *testing.T) {
+	var tr *tracer
+	ctx, s := tr.start(context.Background(), "noop", spanKindInternal, nil)
+	if s != nil || ctx.Value(spanKey{}) != nil {
+		t.Fatal("expected no span from a disabled tracer")
+	}
+	s.set("key", "value")
+	s.end(nil)
+
+	called := false
+	if err := tr.trace(ctx, "noop", nil, func(context.Context) error { called = true; return nil }); err != nil || !called {
+		t.Errorf("expected the func to run untraced, got %v", err)
+	}
+}
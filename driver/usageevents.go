@@ -0,0 +1,193 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// usageEventReason is the reason of the events posted on claims whose volume is nearly full
+	usageEventReason = "VolumeUsageHigh"
+
+	// usageEventRepeat is how often the event is posted again while the volume stays above the threshold
+	usageEventRepeat = time.Hour
+
+	// usageClaimsRefresh is how often an unknown volume may have the claims listed again
+	usageClaimsRefresh = time.Minute
+
+	// usageEventTimeout bounds looking up the claim and posting its event
+	usageEventTimeout = 10 * time.Second
+)
+
+var usageEventsPosted = metrics.newCounter("volume_usage_events_total",
+	"Number of Kubernetes events posted on claims whose volume usage crossed the threshold, by result", "result")
+
+// usageWatcher posts a Warning event on the PersistentVolumeClaim of a volume whose bytes
+// or inodes NodeGetVolumeStats found used above the threshold, so that users see the
+// volume filling up before their pods fail with ENOSPC. The event is posted when the
+// usage crosses the threshold and again every usageEventRepeat while it stays above,
+// in the background so that kubelet's poll is not held up by the Kubernetes API.
+type usageWatcher struct {
+	kube       kubeAPI
+	driverName string
+	host       string
+	// threshold is the percentage of bytes or inodes used above which the event is posted
+	threshold float64
+	log       *logrus.Entry
+	now       func() time.Time
+
+	mu sync.Mutex
+	// posted are when the event of each volume above the threshold was last posted
+	posted map[string]time.Time
+	claims map[string]kubeClaim
+	// listed is when the claims were last listed
+	listed time.Time
+}
+
+// newInClusterUsageWatcher returns a usageWatcher reaching the Kubernetes API with the
+// service account of the node pod
+func newInClusterUsageWatcher(d *VultrDriver) (*usageWatcher, error) {
+	kube, err := newInClusterKubeAPI(usageEventTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return newUsageWatcher(d, kube), nil
+}
+
+func newUsageWatcher(d *VultrDriver, kube kubeAPI) *usageWatcher {
+	return &usageWatcher{
+		kube:       kube,
+		driverName: d.name,
+		host:       d.nodeID,
+		threshold:  d.usageEventThreshold,
+		log:        d.log.WithField("loop", "usage_events"),
+		now:        time.Now,
+		posted:     make(map[string]time.Time),
+		claims:     make(map[string]kubeClaim),
+	}
+}
+
+// observe checks the usage measured of the volume against the threshold, posting the
+// event on its claim when due
+func (w *usageWatcher) observe(volumeID string, usage *volumeUsage) {
+	message := w.breach(volumeID, usage)
+	if message == "" {
+		w.mu.Lock()
+		delete(w.posted, volumeID)
+		w.mu.Unlock()
+		return
+	}
+
+	w.mu.Lock()
+	if last, ok := w.posted[volumeID]; ok && w.now().Sub(last) < usageEventRepeat {
+		w.mu.Unlock()
+		return
+	}
+	w.posted[volumeID] = w.now()
+	w.mu.Unlock()
+
+	go w.post(volumeID, message)
+}
+
+// breach describes how the usage of the volume is above the threshold, empty when it is not
+func (w *usageWatcher) breach(volumeID string, usage *volumeUsage) string {
+	if usage.TotalBytes > 0 {
+		if pct := percentOf(usage.UsedBytes, usage.TotalBytes); pct >= w.threshold {
+			return fmt.Sprintf("volume %s is %.0f%% full, %d of %d bytes used", volumeID, pct, usage.UsedBytes, usage.TotalBytes)
+		}
+	}
+
+	if usage.TotalInodes > 0 {
+		if pct := percentOf(usage.UsedInodes, usage.TotalInodes); pct >= w.threshold {
+			return fmt.Sprintf("volume %s has %.0f%% of its inodes used, %d of %d", volumeID, pct, usage.UsedInodes, usage.TotalInodes)
+		}
+	}
+
+	return ""
+}
+
+func percentOf(used, total int64) float64 {
+	return float64(used) * 100 / float64(total)
+}
+
+// post posts the event on the claim of the volume. A volume without a claim, such as an
+// inline volume, has nothing to post on.
+func (w *usageWatcher) post(volumeID, message string) {
+	ctx, cancel := context.WithTimeout(context.Background(), usageEventTimeout)
+	defer cancel()
+
+	log := w.log.WithField("volume_id", volumeID)
+
+	claim, ok, err := w.claimOf(ctx, volumeID)
+	if err != nil {
+		log.Warnf("cannot list persistent volumes: %v", err)
+		w.forget(volumeID)
+		usageEventsPosted.add(1, "failed")
+		return
+	}
+	if !ok {
+		log.Debug("volume usage is above the threshold but no claim is bound to the volume")
+		return
+	}
+
+	if err := w.kube.warnClaim(ctx, claim, usageEventReason, message, w.driverName, w.host); err != nil {
+		log.Warnf("cannot post volume usage event: %v", err)
+		w.forget(volumeID)
+		usageEventsPosted.add(1, "failed")
+		return
+	}
+
+	log.WithField("claim", claim.Namespace+"/"+claim.Name).Info(message)
+	usageEventsPosted.add(1, "posted")
+}
+
+// forget lets the next observation of the volume post its event again
+func (w *usageWatcher) forget(volumeID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.posted, volumeID)
+}
+
+// claimOf returns the claim bound to the volume, listing the claims again when the volume
+// is not among those last listed and they were not listed within usageClaimsRefresh
+func (w *usageWatcher) claimOf(ctx context.Context, volumeID string) (kubeClaim, bool, error) {
+	w.mu.Lock()
+	claim, ok := w.claims[volumeID]
+	stale := w.now().Sub(w.listed) >= usageClaimsRefresh
+	w.mu.Unlock()
+
+	if ok || !stale {
+		return claim, ok, nil
+	}
+
+	claims, err := w.kube.boundClaims(ctx, w.driverName)
+	if err != nil {
+		return kubeClaim{}, false, err
+	}
+
+	w.mu.Lock()
+	w.claims, w.listed = claims, w.now()
+	w.mu.Unlock()
+
+	claim, ok = claims[volumeID]
+	return claim, ok, nil
+}
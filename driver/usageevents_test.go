@@ -0,0 +1,82 @@
+package driver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestUsageWatcher(t *testing.T) {
+	events := make(chan kubeEvent, 10)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/persistentvolumes":
+			w.Write([]byte(`{"items":[` + //nolint:errcheck
+				`{"spec":{"csi":{"driver":"block.csi.vultr.com","volumeHandle":"full"},` +
+				`"claimRef":{"namespace":"app","name":"data"}},"status":{"phase":"Bound"}}]}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/namespaces/app/persistentvolumeclaims/data":
+			w.Write([]byte(`{"metadata":{"uid":"claim-uid"}}`)) //nolint:errcheck
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1/namespaces/app/events":
+			var event kubeEvent
+			if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			events <- event
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`)) //nolint:errcheck
+		default:
+			http.Error(w, "unexpected request", http.StatusForbidden)
+		}
+	}))
+	defer api.Close()
+
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	d := &VultrDriver{name: "block.csi.vultr.com", nodeID: "node-1", usageEventThreshold: 90, log: logrus.NewEntry(logrus.New())}
+	w := newUsageWatcher(d, kubeAPI{client: api.Client(), apiURL: api.URL})
+	w.now = func() time.Time { return now }
+
+	full := &volumeUsage{TotalBytes: 100, UsedBytes: 95, TotalInodes: 100, UsedInodes: 1}
+	w.observe("full", full)
+
+	select {
+	case event := <-events:
+		if event.Reason != usageEventReason || event.Type != "Warning" || event.InvolvedObject.UID != "claim-uid" {
+			t.Errorf("expected a warning on the claim, got %+v", event)
+		}
+		if !strings.Contains(event.Message, "95% full") || event.Source.Host != "node-1" {
+			t.Errorf("expected the usage of the volume from the node, got %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an event to be posted")
+	}
+
+	w.observe("full", full)
+	now = now.Add(usageEventRepeat / 2)
+	w.observe("full", full)
+	w.observe("full", &volumeUsage{TotalBytes: 100, UsedBytes: 10})
+	w.observe("full", &volumeUsage{TotalBytes: 100, UsedBytes: 10, TotalInodes: 10, UsedInodes: 9})
+
+	select {
+	case event := <-events:
+		if !strings.Contains(event.Message, "inodes") {
+			t.Errorf("expected the inodes to be reported, got %q", event.Message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an event once the volume crossed the threshold again")
+	}
+
+	// a volume without a claim has no event posted
+	w.observe("inline", full)
+
+	select {
+	case event := <-events:
+		t.Errorf("expected no other event, got %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+const (
+	govultrModule = "github.com/vultr/govultr/v3"
+	csiSpecModule = "github.com/container-storage-interface/spec"
+
+	// unknownVersion stands for versions the build does not record
+	unknownVersion = "unknown"
+)
+
+// VersionInfo is the build of the driver and of the libraries it speaks to Vultr and
+// the container orchestrator with
+type VersionInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Govultr string `json:"govultr_version"`
+	CSISpec string `json:"csi_spec_version"`
+	Go      string `json:"go_version"`
+}
+
+// NewVersionInfo returns the version info of the build, whose version and commit are set
+// at compilation and whose library versions come from the modules built in
+func NewVersionInfo(version, commit string) VersionInfo {
+	if commit == "" {
+		commit = unknownVersion
+	}
+	return VersionInfo{
+		Version: version,
+		Commit:  commit,
+		Govultr: moduleVersion(govultrModule),
+		CSISpec: moduleVersion(csiSpecModule),
+		Go:      runtime.Version(),
+	}
+}
+
+func (v VersionInfo) String() string {
+	return fmt.Sprintf("csi-vultr %s\ncommit: %s\ngovultr: %s\ncsi spec: %s\ngo: %s",
+		v.Version, v.Commit, v.Govultr, v.CSISpec, v.Go)
+}
+
+// WithCommit sets the commit the driver was built from, reported by GetPluginInfo
+func WithCommit(commit string) Option {
+	return func(d *VultrDriver) {
+		d.commit = commit
+	}
+}
+
+// moduleVersion returns the version of the module built into the binary, without its v prefix
+func moduleVersion(path string) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return unknownVersion
+	}
+
+	for _, dep := range info.Deps {
+		if dep.Path != path {
+			continue
+		}
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		return strings.TrimPrefix(dep.Version, "v")
+	}
+	return unknownVersion
+}
+
+// userAgent is the User-Agent the driver sends to the Vultr API, naming the driver and
+// govultr versions and the custom agent of the deployment
+func userAgent(version, custom string) string {
+	agent := "csi-vultr/" + version
+	if custom != "" {
+		agent += "/" + custom
+	}
+	return agent + " govultr/" + moduleVersion(govultrModule)
+}
@@ -0,0 +1,24 @@
+package driver
+
+import "testing"
+
+func TestUserAgent(t *testing.T) {
+	govultr := moduleVersion(govultrModule)
+	if govultr == unknownVersion {
+		t.Fatalf("expected the govultr version to be recorded in the build")
+	}
+
+	tests := []struct {
+		custom   string
+		expected string
+	}{
+		{"", "csi-vultr/1.2.3 govultr/" + govultr},
+		{"cluster-a", "csi-vultr/1.2.3/cluster-a govultr/" + govultr},
+	}
+
+	for _, tt := range tests {
+		if agent := userAgent("1.2.3", tt.custom); agent != tt.expected {
+			t.Errorf("expected user agent %q, got %q", tt.expected, agent)
+		}
+	}
+}
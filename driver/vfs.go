@@ -0,0 +1,184 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/vultr/govultr/v3"
+)
+
+// vfsService is the Vultr File System (virtiofs) storage API. govultr does not cover it
+// yet, so vfsServiceHandler calls the endpoints through the govultr client, keeping its
+// authentication, retries and request callbacks.
+type vfsService interface {
+	Create(ctx context.Context, vfsReq *vfsCreate) (*vfsStorage, error)
+	Get(ctx context.Context, vfsID string) (*vfsStorage, error)
+	Update(ctx context.Context, vfsID string, vfsReq *vfsUpdate) error
+	Delete(ctx context.Context, vfsID string) error
+	List(ctx context.Context, options *govultr.ListOptions) ([]vfsStorage, *govultr.Meta, error)
+
+	Attach(ctx context.Context, vfsID, instanceID string) (*vfsAttachment, error)
+	Detach(ctx context.Context, vfsID, instanceID string) error
+	ListAttachments(ctx context.Context, vfsID string) ([]vfsAttachment, error)
+}
+
+// vfsStorage is a Vultr File System volume
+type vfsStorage struct {
+	ID          string   `json:"id"`
+	Region      string   `json:"region"`
+	Status      string   `json:"status"`
+	Label       string   `json:"label"`
+	Tags        []string `json:"tags"`
+	DiskType    string   `json:"disk_type"`
+	StorageSize vfsSize  `json:"storage_size"`
+}
+
+type vfsSize struct {
+	SizeGB int `json:"gb"`
+}
+
+type vfsCreate struct {
+	Region      string   `json:"region"`
+	Label       string   `json:"label"`
+	StorageSize vfsSize  `json:"storage_size"`
+	DiskType    string   `json:"disk_type,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+type vfsUpdate struct {
+	Label       string   `json:"label,omitempty"`
+	StorageSize *vfsSize `json:"storage_size,omitempty"`
+	// Tags replace the tags of the volume when set, an empty list clearing them
+	Tags *[]string `json:"tags,omitempty"`
+}
+
+// vfsAttachment is a VFS volume attached to an instance, mounted by the instance with
+// its mount tag
+type vfsAttachment struct {
+	State    string      `json:"state"`
+	VFSID    string      `json:"vfs_id"`
+	TargetID string      `json:"target_id"`
+	MountTag vfsMountTag `json:"mount_tag"`
+}
+
+// vfsMountTag is the virtiofs tag of an attachment, which the API returns as a number
+type vfsMountTag string
+
+func (t *vfsMountTag) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "null" {
+		s = ""
+	}
+	*t = vfsMountTag(s)
+	return nil
+}
+
+type vfsListBase struct {
+	VFS  []vfsStorage  `json:"vfs"`
+	Meta *govultr.Meta `json:"meta"`
+}
+
+type vfsAttachmentsBase struct {
+	Attachments []vfsAttachment `json:"attachments"`
+}
+
+// vfsServiceHandler implements vfsService with the govultr client
+type vfsServiceHandler struct {
+	client *govultr.Client
+}
+
+func (v *vfsServiceHandler) do(ctx context.Context, method, uri string, body, data interface{}) error {
+	req, err := v.client.NewRequest(ctx, method, uri, body)
+	if err != nil {
+		return err
+	}
+
+	_, err = v.client.DoWithContext(ctx, req, data) //nolint:bodyclose
+	return err
+}
+
+func (v *vfsServiceHandler) Create(ctx context.Context, vfsReq *vfsCreate) (*vfsStorage, error) {
+	vfs := new(vfsStorage)
+	if err := v.do(ctx, http.MethodPost, "/v2/vfs", vfsReq, vfs); err != nil {
+		return nil, err
+	}
+	return vfs, nil
+}
+
+func (v *vfsServiceHandler) Get(ctx context.Context, vfsID string) (*vfsStorage, error) {
+	vfs := new(vfsStorage)
+	if err := v.do(ctx, http.MethodGet, "/v2/vfs/"+url.PathEscape(vfsID), nil, vfs); err != nil {
+		return nil, err
+	}
+	return vfs, nil
+}
+
+func (v *vfsServiceHandler) Update(ctx context.Context, vfsID string, vfsReq *vfsUpdate) error {
+	return v.do(ctx, http.MethodPut, "/v2/vfs/"+url.PathEscape(vfsID), vfsReq, nil)
+}
+
+func (v *vfsServiceHandler) Delete(ctx context.Context, vfsID string) error {
+	return v.do(ctx, http.MethodDelete, "/v2/vfs/"+url.PathEscape(vfsID), nil, nil)
+}
+
+func (v *vfsServiceHandler) List(ctx context.Context, options *govultr.ListOptions) ([]vfsStorage, *govultr.Meta, error) {
+	query := url.Values{}
+	if options != nil {
+		if options.PerPage > 0 {
+			query.Set("per_page", strconv.Itoa(options.PerPage))
+		}
+		if options.Cursor != "" {
+			query.Set("cursor", options.Cursor)
+		}
+	}
+
+	uri := "/v2/vfs"
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+
+	list := new(vfsListBase)
+	if err := v.do(ctx, http.MethodGet, uri, nil, list); err != nil {
+		return nil, nil, err
+	}
+	return list.VFS, list.Meta, nil
+}
+
+func (v *vfsServiceHandler) Attach(ctx context.Context, vfsID, instanceID string) (*vfsAttachment, error) {
+	attachment := new(vfsAttachment)
+	uri := fmt.Sprintf("/v2/vfs/%s/attachments/%s", url.PathEscape(vfsID), url.PathEscape(instanceID))
+	if err := v.do(ctx, http.MethodPut, uri, nil, attachment); err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
+func (v *vfsServiceHandler) Detach(ctx context.Context, vfsID, instanceID string) error {
+	uri := fmt.Sprintf("/v2/vfs/%s/attachments/%s", url.PathEscape(vfsID), url.PathEscape(instanceID))
+	return v.do(ctx, http.MethodDelete, uri, nil, nil)
+}
+
+func (v *vfsServiceHandler) ListAttachments(ctx context.Context, vfsID string) ([]vfsAttachment, error) {
+	list := new(vfsAttachmentsBase)
+	if err := v.do(ctx, http.MethodGet, fmt.Sprintf("/v2/vfs/%s/attachments", url.PathEscape(vfsID)), nil, list); err != nil {
+		return nil, err
+	}
+	return list.Attachments, nil
+}
@@ -0,0 +1,301 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// vfsProbeTimeout bounds the probe of a virtiofs mount, a hung mount being left for the
+// next round rather than holding the others up
+const vfsProbeTimeout = 10 * time.Second
+
+var (
+	vfsDeadMounts = metrics.newGauge("vfs_dead_mounts",
+		"Number of staged vfs volumes whose virtiofs mount is dead and was not remounted yet")
+	vfsRemounts = metrics.newCounter("vfs_remounts_total",
+		"Remounts of dead virtiofs mounts by the node, by result: remounted, failed or busy", "result")
+)
+
+// WithVFSMountMonitor has the node plugin probe the virtiofs mount of each staged vfs
+// volume every interval, and mount those found dead again. 0 disables.
+func WithVFSMountMonitor(interval time.Duration) Option {
+	return func(d *VultrDriver) {
+		d.vfsMonitorInterval = interval
+	}
+}
+
+// deadVFSMount is the record of a virtiofs mount the monitor found dead
+type deadVFSMount struct {
+	// Since is when the mount was first found dead
+	Since time.Time
+	// Err is the error the probe of the mount failed with
+	Err error
+	// Pending is why the mount was not mounted again yet
+	Pending string
+	// Unmounted is set once a remount which failed may have unmounted the volume, whose
+	// staging path then is no mount left to probe
+	Unmounted bool
+}
+
+// deadVFSMounts tracks the staged vfs volumes whose virtiofs mount is dead
+type deadVFSMounts struct {
+	mu     sync.Mutex
+	mounts map[string]deadVFSMount
+}
+
+func newDeadVFSMounts() *deadVFSMounts {
+	return &deadVFSMounts{mounts: make(map[string]deadVFSMount)}
+}
+
+// mark records the mount of the volume as dead, keeping when it was first found so
+func (t *deadVFSMounts) mark(volumeID string, dead deadVFSMount) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if m, ok := t.mounts[volumeID]; ok {
+		dead.Since = m.Since
+		dead.Unmounted = dead.Unmounted || m.Unmounted
+	}
+	t.mounts[volumeID] = dead
+	vfsDeadMounts.set(float64(len(t.mounts)))
+}
+
+func (t *deadVFSMounts) clear(volumeID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.mounts, volumeID)
+	vfsDeadMounts.set(float64(len(t.mounts)))
+}
+
+func (t *deadVFSMounts) get(volumeID string) (deadVFSMount, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m, ok := t.mounts[volumeID]
+	return m, ok
+}
+
+// prune forgets the volumes which are no longer staged
+func (t *deadVFSMounts) prune(staged map[string]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for volumeID := range t.mounts {
+		if !staged[volumeID] {
+			delete(t.mounts, volumeID)
+		}
+	}
+	vfsDeadMounts.set(float64(len(t.mounts)))
+}
+
+// vfsMountMonitor mounts again the virtiofs mounts of the staged vfs volumes which went
+// dead, as they do with ENOTCONN after a hiccup of virtiofsd on the host, leaving the
+// pods with a filesystem they cannot use until the volume is staged again. A dead mount
+// is not touched while processes still have files open under it, nor while an RPC holds
+// the volume.
+type vfsMountMonitor struct {
+	node     *VultrNodeServer
+	interval time.Duration
+	log      *logrus.Entry
+	now      func() time.Time
+}
+
+func newVFSMountMonitor(n *VultrNodeServer) *vfsMountMonitor {
+	return &vfsMountMonitor{
+		node:     n,
+		interval: n.Driver.vfsMonitorInterval,
+		log:      n.Driver.log.WithField("loop", "vfs_mount_monitor"),
+		now:      time.Now,
+	}
+}
+
+// run checks the staged vfs volumes every interval until ctx is done
+func (m *vfsMountMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check probes the virtiofs mount of each staged vfs volume, and mounts those found dead
+// again
+func (m *vfsMountMonitor) check(ctx context.Context) {
+	staged := make(map[string]bool)
+	for _, v := range m.node.staged.list() {
+		if v.FsType != fsTypeVirtiofs {
+			continue
+		}
+		staged[v.VolumeID] = true
+		log := m.log.WithFields(logrus.Fields{"volume_id": v.VolumeID, "staging_path": v.StagingPath})
+
+		if dead, ok := m.node.deadVFS.get(v.VolumeID); ok && dead.Unmounted {
+			m.remount(v, dead.Err, log)
+			continue
+		}
+
+		err := m.probe(ctx, v.StagingPath)
+		switch {
+		case err == nil:
+			m.node.deadVFS.clear(v.VolumeID)
+			continue
+		case !isDeadMount(err):
+			log.Debugf("cannot probe the virtiofs mount: %v", err)
+			continue
+		}
+
+		log.Warnf("virtiofs mount is dead: %v", err)
+		m.remount(v, err, log)
+	}
+
+	m.node.deadVFS.prune(staged)
+}
+
+// probe returns the error of the statfs of the mount at path
+func (m *vfsMountMonitor) probe(ctx context.Context, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, vfsProbeTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.node.host.statfs(path)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("statfs of %s did not return: %w", path, ctx.Err())
+	}
+}
+
+// remount lazily unmounts the publish targets and the staging path of the volume, mounts
+// its virtiofs tag again at the staging path with the options of its stage and binds the
+// targets to it again with the options their bind mount had, so the new mount reaches the
+// pods as the one it replaces did
+func (m *vfsMountMonitor) remount(v stagedVolume, dead error, log *logrus.Entry) {
+	n := m.node
+	pending := func(format string, args ...interface{}) {
+		n.deadVFS.mark(v.VolumeID, deadVFSMount{Since: m.now(), Err: dead, Pending: fmt.Sprintf(format, args...)})
+	}
+
+	unlock, err := n.locks.acquire(v.VolumeID)
+	if err != nil {
+		// the mount is looked at again next round
+		pending("an operation of the volume is in progress")
+		return
+	}
+	defer unlock()
+
+	targets := n.staged.publishes(v.VolumeID)
+	paths := []string{v.StagingPath}
+	for target := range targets {
+		paths = append(paths, target)
+	}
+
+	open, err := n.host.openFilesUnder(paths)
+	switch {
+	case errors.Is(err, errors.ErrUnsupported):
+		pending("the node cannot tell whether its files are in use")
+		return
+	case err != nil:
+		pending("its open files cannot be counted: %v", err)
+		return
+	case open > 0:
+		log.WithField("open_files", open).Info("virtiofs mount left dead while processes have files open under it")
+		pending("%d files are open under it", open)
+		vfsRemounts.add(1, "busy")
+		return
+	}
+
+	defer func() {
+		for _, path := range paths {
+			n.volumeStats.invalidate(path)
+		}
+	}()
+
+	if err := m.mountAgain(v, targets); err != nil {
+		log.Errorf("cannot mount the dead virtiofs mount again: %v", err)
+		n.deadVFS.mark(v.VolumeID, deadVFSMount{
+			Since: m.now(), Err: dead, Pending: fmt.Sprintf("mounting it again failed: %v", err), Unmounted: true,
+		})
+		vfsRemounts.add(1, "failed")
+		return
+	}
+
+	log.WithField("mount_tag", v.Device).Info("dead virtiofs mount mounted again")
+	n.deadVFS.clear(v.VolumeID)
+	vfsRemounts.add(1, "remounted")
+}
+
+func (m *vfsMountMonitor) mountAgain(v stagedVolume, targets map[string]bool) error {
+	mounter := m.node.Driver.mounter
+
+	mountPoints, err := mounter.List()
+	if err != nil {
+		return fmt.Errorf("cannot list the mounts: %w", err)
+	}
+	bindFlags := make(map[string][]string)
+	for _, mp := range mountPoints {
+		bindFlags[mp.Path] = mp.Opts
+	}
+
+	for target := range targets {
+		if err := m.unmount(target); err != nil {
+			return fmt.Errorf("cannot unmount target %s: %w", target, err)
+		}
+	}
+	if err := m.unmount(v.StagingPath); err != nil {
+		return fmt.Errorf("cannot unmount staging path %s: %w", v.StagingPath, err)
+	}
+
+	if err := mounter.Mount(v.Device, v.StagingPath, fsTypeVirtiofs, v.MountOptions); err != nil {
+		return fmt.Errorf("cannot mount tag %s at %s: %w", v.Device, v.StagingPath, err)
+	}
+
+	for target, readOnly := range targets {
+		options, _ := publishMountOptions(bindFlags[target], readOnly)
+		if err := mounter.Mount(v.StagingPath, target, "", options); err != nil {
+			return fmt.Errorf("cannot bind mount target %s: %w", target, err)
+		}
+	}
+
+	return nil
+}
+
+// unmount detaches the mount at path unless a remount which failed already did, a dead
+// mount failing the check of the mount point rather than reporting it mounted. The mount
+// is detached lazily, as a plain unmount of a dead virtiofs mount may hang on virtiofsd.
+func (m *vfsMountMonitor) unmount(path string) error {
+	if notMnt, err := m.node.Driver.mounter.IsLikelyNotMountPoint(path); err == nil && notMnt {
+		return nil
+	}
+	return m.node.host.lazyUnmount(path)
+}
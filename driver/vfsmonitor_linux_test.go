@@ -0,0 +1,180 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/mount-utils"
+)
+
+// vfsHost fails the statfs of the dead mounts, reports the files open under them and
+// detaches mounts from the fake mounter
+type vfsHost struct {
+	hostOS
+	fake      *mount.FakeMounter
+	dead      map[string]error
+	openFiles int
+	detached  []string
+}
+
+func (h *vfsHost) statfs(path string) (*volumeUsage, error) {
+	if err := h.dead[path]; err != nil {
+		return nil, err
+	}
+	return &volumeUsage{TotalBytes: 10 * giB}, nil
+}
+
+func (h *vfsHost) openFilesUnder([]string) (int, error) {
+	return h.openFiles, nil
+}
+
+func (h *vfsHost) lazyUnmount(target string) error {
+	h.detached = append(h.detached, target)
+	return h.fake.Unmount(target)
+}
+
+func TestVFSMountMonitor(t *testing.T) {
+	mounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "vfs-tag", Path: "/staging/vfs-1", Type: fsTypeVirtiofs, Opts: []string{"noatime"}},
+		{Device: "/staging/vfs-1", Path: "/pods/writer", Opts: []string{"bind", "nosuid"}},
+		{Device: "/staging/vfs-1", Path: "/pods/reader", Opts: []string{"bind", "ro"}},
+	})
+	fe := &fakeExec{}
+	node := NewVultrNodeDriver(&VultrDriver{
+		log:                logrus.NewEntry(logrus.New()),
+		mounter:            &mount.SafeFormatAndMount{Interface: mounter, Exec: fe},
+		exec:               fe,
+		vfsMonitorInterval: time.Minute,
+	})
+	dead := &os.PathError{Op: "statfs", Path: "/staging/vfs-1", Err: syscall.ENOTCONN}
+	host := &vfsHost{hostOS: node.host, fake: mounter, dead: map[string]error{"/staging/vfs-1": dead}, openFiles: 2}
+	node.host = host
+
+	node.staged.stage("vfs-1", "/staging/vfs-1", "vfs-tag", fsTypeVirtiofs)
+	node.staged.setMountOptions("vfs-1", []string{"noatime"})
+	node.staged.publish("vfs-1", "/pods/writer", false)
+	node.staged.publish("vfs-1", "/pods/reader", true)
+	node.staged.stage("vfs-2", "/staging/vfs-2", "other-tag", fsTypeVirtiofs)
+	node.staged.stage("vol-1", "/staging/vol-1", "/dev/vdb", fsTypeExt4)
+
+	monitor := newVFSMountMonitor(node)
+	found := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	monitor.now = func() time.Time { return found }
+
+	// the files open under the dead mount hold it back
+	monitor.check(context.Background())
+	if log := mounter.GetLog(); len(log) != 0 {
+		t.Fatalf("expected a mount with open files not to be touched, got %v", log)
+	}
+	condition := node.abnormalCondition("vfs-1", "/pods/writer")
+	if condition == nil || !strings.Contains(condition.Message, found.Format(time.RFC3339)) ||
+		!strings.Contains(condition.Message, "2 files are open") {
+		t.Errorf("expected the dead mount in the condition of the volume, got %+v", condition)
+	}
+	if got := vfsDeadMounts.get(nil).value; got != 1 {
+		t.Errorf("expected 1 dead mount, got %v", got)
+	}
+
+	// nor is it touched while an RPC holds the volume
+	host.openFiles = 0
+	unlock, err := node.locks.acquire("vfs-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitor.now = func() time.Time { return found.Add(time.Minute) }
+	monitor.check(context.Background())
+	unlock()
+	if log := mounter.GetLog(); len(log) != 0 {
+		t.Fatalf("expected a volume held by an RPC not to be touched, got %v", log)
+	}
+	if m, _ := node.deadVFS.get("vfs-1"); !m.Since.Equal(found) {
+		t.Errorf("expected the mount dead since it was first found so, got %v", m.Since)
+	}
+
+	monitor.check(context.Background())
+	if _, ok := node.deadVFS.get("vfs-1"); ok {
+		t.Error("expected the remounted volume to be forgotten")
+	}
+
+	// the targets are detached before the staging path they are bound to
+	if len(host.detached) != 3 || host.detached[2] != "/staging/vfs-1" {
+		t.Fatalf("expected the targets then the staging path detached, got %v", host.detached)
+	}
+	detached := map[string]bool{}
+	for _, path := range host.detached {
+		detached[path] = true
+	}
+	if !reflect.DeepEqual(detached, map[string]bool{"/staging/vfs-1": true, "/pods/writer": true, "/pods/reader": true}) {
+		t.Errorf("expected the staging path and targets detached, got %v", detached)
+	}
+
+	mounts := map[string]mount.MountPoint{}
+	for _, mp := range mounter.MountPoints {
+		mounts[mp.Path] = mp
+	}
+	if mp := mounts["/staging/vfs-1"]; mp.Device != "vfs-tag" || mp.Type != fsTypeVirtiofs || !hasOption(mp.Opts, "noatime") {
+		t.Errorf("expected the tag mounted again with the options of its stage, got %+v", mp)
+	}
+	if mp := mounts["/pods/writer"]; mp.Device != "vfs-tag" || !hasOption(mp.Opts, "nosuid") || hasOption(mp.Opts, "ro") {
+		t.Errorf("expected the writable target bound again with its options, got %+v", mp)
+	}
+	if mp := mounts["/pods/reader"]; mp.Device != "vfs-tag" || !hasOption(mp.Opts, "ro") {
+		t.Errorf("expected the read-only target bound again read-only, got %+v", mp)
+	}
+
+	node.staged.unstage("vfs-1")
+	node.deadVFS.mark("vfs-1", deadVFSMount{Since: found, Err: dead})
+	monitor.check(context.Background())
+	if _, ok := node.deadVFS.get("vfs-1"); ok {
+		t.Error("expected the dead mount of an unstaged volume to be forgotten")
+	}
+}
+
+func TestVFSMountMonitorFailedRemount(t *testing.T) {
+	mounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "vfs-tag", Path: "/staging/vfs-1", Type: fsTypeVirtiofs}})
+	fe := &fakeExec{}
+	node := NewVultrNodeDriver(&VultrDriver{
+		log:     logrus.NewEntry(logrus.New()),
+		mounter: &mount.SafeFormatAndMount{Interface: &failingMounter{FakeMounter: mounter}, Exec: fe},
+		exec:    fe,
+	})
+	host := &vfsHost{hostOS: node.host, fake: mounter, dead: map[string]error{
+		"/staging/vfs-1": &os.PathError{Op: "statfs", Path: "/staging/vfs-1", Err: syscall.ENOTCONN},
+	}}
+	node.host = host
+	node.staged.stage("vfs-1", "/staging/vfs-1", "vfs-tag", fsTypeVirtiofs)
+
+	monitor := newVFSMountMonitor(node)
+	monitor.check(context.Background())
+	m, ok := node.deadVFS.get("vfs-1")
+	if !ok || !m.Unmounted || !strings.Contains(m.Pending, "virtiofsd is gone") {
+		t.Fatalf("expected the failed remount recorded, got %+v", m)
+	}
+
+	// the empty staging path the failure left answers statfs, but is mounted again
+	host.dead = nil
+	node.Driver.mounter = &mount.SafeFormatAndMount{Interface: mounter, Exec: fe}
+	monitor.check(context.Background())
+	if _, ok := node.deadVFS.get("vfs-1"); ok {
+		t.Error("expected the volume mounted again on the next round")
+	}
+	if len(mounter.MountPoints) != 1 || mounter.MountPoints[0].Device != "vfs-tag" {
+		t.Errorf("expected the tag mounted again, got %+v", mounter.MountPoints)
+	}
+}
+
+// failingMounter unmounts but fails every mount
+type failingMounter struct {
+	*mount.FakeMounter
+}
+
+func (m *failingMounter) Mount(string, string, string, []string) error {
+	return errors.New("virtiofsd is gone")
+}
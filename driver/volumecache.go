@@ -0,0 +1,239 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/vultr/vultr-csi/internal/volumes"
+)
+
+const (
+	// volumeCacheTTL is how long a listing of the account's volumes is reused
+	volumeCacheTTL = 30 * time.Second
+
+	// volumeCacheFillTimeout bounds each listing of the volumes
+	volumeCacheFillTimeout = 2 * time.Minute
+)
+
+var (
+	volumeCacheLists = metrics.newCounter("volume_cache_lists_total",
+		"Number of volume listings answered by the volume cache, by whether the Vultr API was called", "result")
+	volumeCacheLookups = metrics.newCounter("volume_cache_lookups_total",
+		"Number of volume lookups answered by the volume cache, by whether the Vultr API was called", "result")
+)
+
+// volumeCache holds the account's volumes. After a controller restart the sidecars
+// replay every pending RPC at once, and without it each CreateVolume and ListVolumes
+// would list every volume in the account. Concurrent callers share a single listing,
+// which is reused until it expires or the controller changes a volume. The volumes
+// looked up by ID for the RPCs only reading them are held the same way.
+type volumeCache struct {
+	backends *backendRegistry
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	volumes []backendVolume
+	valid   bool
+	fetched time.Time
+	fill    *volumeCacheFill
+	byID    map[string]cachedVolume
+	// generation counts invalidations, so a listing started before one is not stored
+	generation int
+}
+
+// cachedVolume is a volume looked up by ID
+type cachedVolume struct {
+	backend storageBackend
+	volume  backendVolume
+	fetched time.Time
+}
+
+// volumeCacheFill is a listing in flight
+type volumeCacheFill struct {
+	done    chan struct{}
+	volumes []backendVolume
+	err     error
+}
+
+func newVolumeCache(backends *backendRegistry, ttl time.Duration) *volumeCache {
+	return &volumeCache{
+		backends: backends,
+		ttl:      ttl,
+		now:      time.Now,
+		byID:     map[string]cachedVolume{},
+	}
+}
+
+// list returns every volume of every backend
+func (c *volumeCache) list(ctx context.Context) ([]backendVolume, error) {
+	c.mu.Lock()
+	if c.valid && c.now().Sub(c.fetched) < c.ttl {
+		list := append([]backendVolume(nil), c.volumes...)
+		c.mu.Unlock()
+		volumeCacheLists.add(1, "hit")
+		return list, nil
+	}
+
+	fill := c.fill
+	if fill == nil {
+		fill = &volumeCacheFill{done: make(chan struct{})}
+		c.fill = fill
+		go c.refresh(fill, c.generation)
+		volumeCacheLists.add(1, "miss")
+	} else {
+		volumeCacheLists.add(1, "shared")
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-fill.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if fill.err != nil {
+		return nil, fill.err
+	}
+	return append([]backendVolume(nil), fill.volumes...), nil
+}
+
+// refresh lists the volumes for fill, detached from the context of the caller which
+// started it so the callers sharing it are not failed by that caller going away
+func (c *volumeCache) refresh(fill *volumeCacheFill, generation int) {
+	ctx, cancel := context.WithTimeout(context.Background(), volumeCacheFillTimeout)
+	defer cancel()
+
+	fill.volumes, fill.err = c.backends.list(ctx)
+
+	c.mu.Lock()
+	if fill.err == nil && generation == c.generation {
+		c.volumes, c.valid = fill.volumes, true
+		c.fetched = c.now()
+	}
+	if c.fill == fill {
+		c.fill = nil
+	}
+	c.mu.Unlock()
+
+	close(fill.done)
+}
+
+// get returns the volume and the backend owning it, from the cached listing or lookup
+// when fresh. It is for the RPCs which only read the volume: those changing it look it
+// up in the backends, as the attachments of a cached volume may be up to ttl old.
+func (c *volumeCache) get(ctx context.Context, volumeID string) (storageBackend, *backendVolume, error) {
+	c.mu.Lock()
+	if backend, vol, ok := c.cached(volumeID); ok {
+		c.mu.Unlock()
+		volumeCacheLookups.add(1, "hit")
+		return backend, vol, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+	volumeCacheLookups.add(1, "miss")
+
+	backend, vol, err := c.backends.get(ctx, volumeID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+	if generation == c.generation {
+		c.byID[volumeID] = cachedVolume{backend: backend, volume: *vol, fetched: c.now()}
+	}
+	c.mu.Unlock()
+
+	return backend, vol, nil
+}
+
+// cached returns a copy of the fresh volume, c.mu held
+func (c *volumeCache) cached(volumeID string) (storageBackend, *backendVolume, bool) {
+	now := c.now()
+
+	if entry, ok := c.byID[volumeID]; ok && now.Sub(entry.fetched) < c.ttl {
+		vol := entry.volume
+		return entry.backend, &vol, true
+	}
+
+	if !c.valid || now.Sub(c.fetched) >= c.ttl {
+		return nil, nil, false
+	}
+	for i := range c.volumes {
+		if c.volumes[i].ID != volumeID {
+			continue
+		}
+		backend, ok := c.backends.backends[c.volumes[i].StorageType]
+		if !ok {
+			return nil, nil, false
+		}
+		vol := c.volumes[i]
+		return backend, &vol, true
+	}
+	return nil, nil, false
+}
+
+// query returns the volumes of every backend matched by filter
+func (c *volumeCache) query(ctx context.Context, filter volumes.Filter) ([]backendVolume, error) {
+	list, err := c.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return volumes.Select(list, filter, backendVolumeFields), nil
+}
+
+// findLabel returns the volume of the storage type with the label, nil when there is none
+func (c *volumeCache) findLabel(ctx context.Context, storageType, label string) (*backendVolume, error) {
+	found, err := c.query(ctx, volumes.Filter{Label: label, StorageType: storageType})
+	if err != nil || len(found) == 0 {
+		return nil, err
+	}
+	return &found[0], nil
+}
+
+// invalidate drops the cached volumes after the controller changed one, so the next
+// listing and lookup see the change
+func (c *volumeCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// callers from now on must not share a listing which may predate the change
+	c.volumes, c.valid, c.fill = nil, false, nil
+	c.byID = map[string]cachedVolume{}
+	c.generation++
+}
+
+// warmVolumeCache lists the volumes as the controller starts, so the RPCs the sidecars
+// replay share that listing instead of each making their own
+func (c *VultrControllerServer) warmVolumeCache() {
+	ctx, cancel := context.WithTimeout(context.Background(), volumeCacheFillTimeout)
+	defer cancel()
+
+	start := time.Now()
+	list, err := c.volumes.list(ctx)
+	if err != nil {
+		c.Driver.log.Warnf("cannot warm the volume cache: %v", err)
+		return
+	}
+
+	c.Driver.log.WithFields(logrus.Fields{
+		"volumes":  len(list),
+		"duration": time.Since(start).Round(time.Millisecond),
+	}).Info("volume cache warmed")
+}
@@ -0,0 +1,164 @@
+package driver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listingBackend counts the listings of its volumes, which block until release is closed
+type listingBackend struct {
+	storageBackend
+	lists   int32
+	gets    int32
+	release chan struct{}
+}
+
+func (b *listingBackend) Get(_ context.Context, volumeID string) (*backendVolume, error) {
+	atomic.AddInt32(&b.gets, 1)
+	if volumeID != "vol-1" {
+		return nil, errVolumeNotFound
+	}
+	return &backendVolume{ID: "vol-1", Label: "pvc-1", StorageType: storageTypeBlock}, nil
+}
+
+func (b *listingBackend) List(context.Context) ([]backendVolume, error) {
+	atomic.AddInt32(&b.lists, 1)
+	<-b.release
+	return []backendVolume{{ID: "vol-1", Label: "pvc-1", StorageType: storageTypeBlock}}, nil
+}
+
+func newListingCache() (*volumeCache, *listingBackend) {
+	backend := &listingBackend{release: make(chan struct{})}
+	registry := &backendRegistry{backends: map[string]storageBackend{storageTypeBlock: backend}}
+	return newVolumeCache(registry, volumeCacheTTL), backend
+}
+
+func TestVolumeCacheSharesListing(t *testing.T) {
+	cache, backend := newListingCache()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if vol, err := cache.findLabel(context.Background(), storageTypeBlock, "pvc-1"); err != nil || vol == nil {
+				t.Errorf("expected the volume, got %v, %v", vol, err)
+			}
+		}()
+	}
+
+	// let the callers pile up on the listing in flight
+	time.Sleep(50 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&backend.lists); n != 1 {
+		t.Errorf("expected the callers to share 1 listing, got %d", n)
+	}
+
+	if _, err := cache.list(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if n := atomic.LoadInt32(&backend.lists); n != 1 {
+		t.Errorf("expected the cached listing to be reused, got %d listings", n)
+	}
+}
+
+func TestVolumeCacheExpiry(t *testing.T) {
+	cache, backend := newListingCache()
+	close(backend.release)
+
+	now := time.Unix(0, 0)
+	cache.now = func() time.Time { return now }
+
+	if vol, _ := cache.findLabel(context.Background(), storageTypeVFS, "pvc-1"); vol != nil {
+		t.Errorf("expected no vfs volume, got %v", vol)
+	}
+
+	now = now.Add(volumeCacheTTL)
+	if _, err := cache.list(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if n := atomic.LoadInt32(&backend.lists); n != 2 {
+		t.Errorf("expected the expired listing to be refreshed, got %d listings", n)
+	}
+
+	cache.invalidate()
+	if _, err := cache.list(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if n := atomic.LoadInt32(&backend.lists); n != 3 {
+		t.Errorf("expected the invalidated listing to be refreshed, got %d listings", n)
+	}
+}
+
+func TestVolumeCacheInvalidateDuringListing(t *testing.T) {
+	cache, backend := newListingCache()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.list(context.Background()) //nolint:errcheck
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cache.invalidate()
+	close(backend.release)
+	<-done
+
+	if _, err := cache.list(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if n := atomic.LoadInt32(&backend.lists); n != 2 {
+		t.Errorf("expected the listing started before the change not to be reused, got %d listings", n)
+	}
+}
+
+func TestVolumeCacheLookup(t *testing.T) {
+	cache, backend := newListingCache()
+	close(backend.release)
+
+	now := time.Unix(0, 0)
+	cache.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if b, vol, err := cache.get(ctx, "vol-1"); err != nil || b != backend || vol.Label != "pvc-1" {
+			t.Fatalf("expected the volume of the block backend, got %v, %v, %v", b, vol, err)
+		}
+	}
+	if n := atomic.LoadInt32(&backend.gets); n != 1 {
+		t.Errorf("expected the volume to be looked up once, got %d lookups", n)
+	}
+
+	if _, _, err := cache.get(ctx, "vol-2"); err != errVolumeNotFound {
+		t.Errorf("expected errVolumeNotFound, got %v", err)
+	}
+	if _, _, err := cache.get(ctx, "vol-2"); err != errVolumeNotFound {
+		t.Errorf("expected errVolumeNotFound, got %v", err)
+	}
+	if n := atomic.LoadInt32(&backend.gets); n != 3 {
+		t.Errorf("expected missing volumes not to be cached, got %d lookups", n)
+	}
+
+	cache.invalidate()
+	cache.get(ctx, "vol-1") //nolint:errcheck
+	if n := atomic.LoadInt32(&backend.gets); n != 4 {
+		t.Errorf("expected the changed volume to be looked up again, got %d lookups", n)
+	}
+
+	// a fresh listing answers the lookups
+	now = now.Add(volumeCacheTTL)
+	if _, err := cache.list(ctx); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if b, vol, err := cache.get(ctx, "vol-1"); err != nil || b != backend || vol.ID != "vol-1" {
+		t.Errorf("expected the listed volume, got %v, %v, %v", b, vol, err)
+	}
+	if n := atomic.LoadInt32(&backend.gets); n != 4 {
+		t.Errorf("expected the listed volume not to be looked up, got %d lookups", n)
+	}
+}
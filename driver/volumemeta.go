@@ -0,0 +1,109 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/vultr/vultr-csi/internal/volumes"
+)
+
+// The parameters external-provisioner adds to CreateVolume when run with --extra-create-metadata
+const (
+	pvcNameParam      = coMetadataPrefix + "pvc/name"
+	pvcNamespaceParam = coMetadataPrefix + "pvc/namespace"
+	pvNameParam       = coMetadataPrefix + "pv/name"
+)
+
+// metadataTagPrefix starts the tags the driver identifies the cluster and the Kubernetes
+// objects of a volume with, which modifying the tags of the volume keeps
+const metadataTagPrefix = "kubernetes-"
+
+// WithClusterID names the cluster the driver provisions volumes for. Volume labels start
+// with it and VFS volumes are tagged with it, so the volumes of each cluster sharing a
+// Vultr account can be told apart.
+func WithClusterID(id string) Option {
+	return func(d *VultrDriver) {
+		d.clusterID = id
+	}
+}
+
+// validateClusterID reports a cluster ID which cannot go into labels and tags
+func validateClusterID(id string) error {
+	if strings.ContainsAny(id, ", \t\n") {
+		return fmt.Errorf("cluster ID %q must not contain commas or spaces", id)
+	}
+	return nil
+}
+
+// clusterVolumeName returns the CSI volume name prefixed with the cluster ID when one is set
+func (d *VultrDriver) clusterVolumeName(name string) string {
+	if d.clusterID == "" {
+		return name
+	}
+	return d.clusterID + "-" + name
+}
+
+// inlineVolumePrefix starts the name in the label of the inline volumes of pods, which
+// no PersistentVolume references
+const inlineVolumePrefix = "inline-"
+
+// clusterVolumes selects the volumes labelled with the cluster ID, leaving out those
+// created before it was set and the inline volumes of pods
+func (d *VultrDriver) clusterVolumes() volumes.Filter {
+	return volumes.Filter{
+		LabelPrefix:        d.volumeLabelPrefix + d.clusterVolumeName(""),
+		ExcludeLabelPrefix: d.volumeLabelPrefix + d.clusterVolumeName(inlineVolumePrefix),
+	}
+}
+
+// newVolumeLabel returns the label a new volume gets for the CSI volume name
+func (d *VultrDriver) newVolumeLabel(name string) string {
+	return d.volumeLabel(d.clusterVolumeName(name))
+}
+
+// inlineVolumeLabel returns the label of the inline volume kubelet names name
+func (d *VultrDriver) inlineVolumeLabel(name string) string {
+	return d.volumeLabel(d.clusterVolumeName(inlineVolumePrefix + name))
+}
+
+// findVolumeByName returns the volume of the storage type created for the CSI volume
+// name, nil when there is none. Volumes created before the cluster ID was set have a
+// label without it, so a retry still finds them.
+func (c *VultrControllerServer) findVolumeByName(ctx context.Context, storageType, name string) (*backendVolume, error) {
+	existing, err := c.volumes.findLabel(ctx, storageType, c.Driver.newVolumeLabel(name))
+	if err != nil || existing != nil || c.Driver.clusterID == "" {
+		return existing, err
+	}
+
+	return c.volumes.findLabel(ctx, storageType, c.Driver.volumeLabel(name))
+}
+
+// metadataTags returns the tags identifying the cluster and the Kubernetes objects a
+// volume is provisioned for, from the cluster ID and the CreateVolume metadata parameters
+func (d *VultrDriver) metadataTags(params map[string]string) []string {
+	var tags []string
+	if d.clusterID != "" {
+		tags = append(tags, metadataTagPrefix+"cluster:"+d.clusterID)
+	}
+	if name, namespace := params[pvcNameParam], params[pvcNamespaceParam]; name != "" && namespace != "" {
+		tags = append(tags, metadataTagPrefix+"pvc:"+namespace+"/"+name)
+	}
+	if name := params[pvNameParam]; name != "" {
+		tags = append(tags, metadataTagPrefix+"pv:"+name)
+	}
+	return tags
+}
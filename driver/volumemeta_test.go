@@ -0,0 +1,60 @@
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestCreateVolumeClusterMetadata(t *testing.T) {
+	controller, vfs := newFakeVFSControllerServer("create volume cluster metadata")
+	controller.Driver.clusterID = "prod"
+
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "pvc-1",
+		Parameters: map[string]string{
+			"storage_type":    "vfs",
+			"tags":            "team-a",
+			pvcNameParam:      "data",
+			pvcNamespaceParam: "app",
+			pvNameParam:       "pvc-1",
+		},
+		VolumeCapabilities: capabilities,
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if len(vfs.created) != 1 {
+		t.Fatalf("expected a volume to be created, got %+v", vfs.created)
+	}
+	if label := vfs.created[0].Label; label != "prod-pvc-1" {
+		t.Errorf("expected the label to start with the cluster ID, got %s", label)
+	}
+	expected := []string{"team-a", "kubernetes-cluster:prod", "kubernetes-pvc:app/data", "kubernetes-pv:pvc-1"}
+	if tags := vfs.created[0].Tags; !reflect.DeepEqual(tags, expected) {
+		t.Errorf("expected tags %v, got %v", expected, tags)
+	}
+
+	// a volume created before the cluster ID was set is found by its older label
+	res, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "test-bs",
+		Parameters:         map[string]string{"block_type": "high_perf"},
+		VolumeCapabilities: capabilities,
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if res.Volume.VolumeId != "c56c7b6e-15c2-445e-9a5d-1063ab5828ec" {
+		t.Errorf("expected the volume with the label without the cluster ID, got %s", res.Volume.VolumeId)
+	}
+}
@@ -0,0 +1,398 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// volumeStatusAnnotation is the PVC annotation, prefixed by the driver name, holding
+	// the status document the controller publishes for the volume
+	volumeStatusAnnotation = "status"
+	// nodeStatusAnnotationPrefix starts the PVC annotation, prefixed by the driver name and
+	// followed by the node ID, holding the status document a node publishes for the volume
+	nodeStatusAnnotationPrefix = "node-"
+
+	// operationLogSize is how many operations are kept for each volume
+	operationLogSize = 5
+	// operationLogRetention is how long the operations of a volume are kept after its last one
+	operationLogRetention = 24 * time.Hour
+)
+
+// volumeOperations records the operations GRPCLogger serves on each volume, for the
+// status documents published to their claims
+var volumeOperations = newOperationLog(operationLogSize, operationLogRetention)
+
+// loggedOperations are the RPCs changing a volume, leaving out the reads kubelet and the
+// sidecars poll with
+var loggedOperations = map[string]bool{
+	"CreateVolume":              true,
+	"DeleteVolume":              true,
+	"ControllerPublishVolume":   true,
+	"ControllerUnpublishVolume": true,
+	"ControllerExpandVolume":    true,
+	"NodeStageVolume":           true,
+	"NodeUnstageVolume":         true,
+	"NodePublishVolume":         true,
+	"NodeUnpublishVolume":       true,
+	"NodeExpandVolume":          true,
+}
+
+// volumeOperation is an operation of the driver on a volume
+type volumeOperation struct {
+	Operation string    `json:"operation"`
+	Code      string    `json:"code"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+type operationLog struct {
+	size      int
+	retention time.Duration
+	now       func() time.Time
+
+	mu         sync.Mutex
+	operations map[string][]volumeOperation
+}
+
+func newOperationLog(size int, retention time.Duration) *operationLog {
+	return &operationLog{
+		size:       size,
+		retention:  retention,
+		now:        time.Now,
+		operations: make(map[string][]volumeOperation),
+	}
+}
+
+// record logs the outcome of the RPC on the volume when it changes the volume. The ID of
+// a created volume is only known from the response.
+func (o *operationLog) record(fullMethod, volumeID string, resp interface{}, err error) {
+	method := path.Base(fullMethod)
+	if !loggedOperations[method] {
+		return
+	}
+	if created, ok := resp.(*csi.CreateVolumeResponse); ok && volumeID == "" {
+		volumeID = created.GetVolume().GetVolumeId()
+	}
+	if volumeID == "" {
+		return
+	}
+
+	op := volumeOperation{Operation: method, Code: status.Code(err).String()}
+	if err != nil {
+		op.Error = status.Convert(err).Message()
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := o.now()
+	op.Time = now
+	for id, ops := range o.operations {
+		if now.Sub(ops[len(ops)-1].Time) > o.retention {
+			delete(o.operations, id)
+		}
+	}
+
+	ops := append(o.operations[volumeID], op)
+	if len(ops) > o.size {
+		ops = ops[len(ops)-o.size:]
+	}
+	o.operations[volumeID] = ops
+}
+
+// get returns the last node or controller operations on the volume, the latest last
+func (o *operationLog) get(volumeID string, node bool) []volumeOperation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	ops := []volumeOperation{}
+	for _, op := range o.operations[volumeID] {
+		if strings.HasPrefix(op.Operation, "Node") == node {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// volumeIDs returns the volumes with operations logged
+func (o *operationLog) volumeIDs() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	ids := make([]string, 0, len(o.operations))
+	for id := range o.operations {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// volumeStatusCondition is the health of a volume as the controller or a node sees it
+type volumeStatusCondition struct {
+	Abnormal bool   `json:"abnormal"`
+	Message  string `json:"message"`
+}
+
+// volumeStatus is the document the controller publishes to the claim of a volume
+type volumeStatus struct {
+	VolumeID       string                `json:"volume_id"`
+	StorageType    string                `json:"storage_type"`
+	Region         string                `json:"region"`
+	Status         string                `json:"status"`
+	CapacityBytes  int64                 `json:"capacity_bytes"`
+	AttachedTo     []string              `json:"attached_to"`
+	Condition      volumeStatusCondition `json:"condition"`
+	LastOperations []volumeOperation     `json:"last_operations"`
+}
+
+// nodeVolumeStatus is the document a node publishes to the claim of a volume it staged
+type nodeVolumeStatus struct {
+	NodeID         string                `json:"node_id"`
+	StagedAt       time.Time             `json:"staged_at"`
+	Targets        []string              `json:"targets"`
+	Condition      volumeStatusCondition `json:"condition"`
+	Usage          *volumeUsage          `json:"usage,omitempty"`
+	LastOperations []volumeOperation     `json:"last_operations"`
+}
+
+// volumeUsage is the filesystem usage of a staged volume
+type volumeUsage struct {
+	TotalBytes     int64 `json:"total_bytes"`
+	UsedBytes      int64 `json:"used_bytes"`
+	AvailableBytes int64 `json:"available_bytes"`
+	TotalInodes    int64 `json:"total_inodes"`
+	UsedInodes     int64 `json:"used_inodes"`
+}
+
+// volumeStatusPublisher keeps an annotation of the claims of the driver's volumes set to
+// a status document, so that application teams can read how their volumes fare with
+// access to their own namespace only. Documents are only patched when they change, and
+// the annotation is removed from claims whose volume no longer has a document.
+type volumeStatusPublisher struct {
+	kube       kubeAPI
+	driverName string
+	annotation string
+	interval   time.Duration
+	log        *logrus.Entry
+
+	// documents returns the status documents to publish, by volume ID
+	documents func(ctx context.Context) (map[string]interface{}, error)
+	// checkAPI holds each pass back while the driver holds off the Vultr API
+	checkAPI func(rpc string) error
+
+	// published are the documents last published, by volume ID
+	published map[string]publishedStatus
+}
+
+type publishedStatus struct {
+	claim    kubeClaim
+	document string
+}
+
+func newVolumeStatusPublisher(d *VultrDriver, annotation string, documents func(context.Context) (map[string]interface{}, error)) (*volumeStatusPublisher, error) { //nolint:lll
+	kube, err := newInClusterKubeAPI(d.volumeStatusInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	return &volumeStatusPublisher{
+		kube:       kube,
+		driverName: d.name,
+		annotation: d.name + "/" + annotation,
+		interval:   d.volumeStatusInterval,
+		log:        d.log.WithField("loop", "volume_status"),
+		documents:  documents,
+		checkAPI:   d.checkAPI,
+		published:  make(map[string]publishedStatus),
+	}, nil
+}
+
+// run publishes the documents every interval until ctx is done
+func (p *volumeStatusPublisher) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.publish(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *volumeStatusPublisher) publish(ctx context.Context) {
+	if p.checkAPI != nil {
+		if err := p.checkAPI("volume status"); err != nil {
+			p.log.Infof("skipping this pass: %v", err)
+			return
+		}
+	}
+
+	claims, err := p.kube.boundClaims(ctx, p.driverName)
+	if err != nil {
+		p.log.Warnf("cannot list persistent volumes: %v", err)
+		return
+	}
+
+	documents, err := p.documents(ctx)
+	if err != nil {
+		p.log.Warnf("cannot get volume status: %v", err)
+		return
+	}
+
+	for volumeID, doc := range documents {
+		claim, ok := claims[volumeID]
+		if !ok {
+			continue
+		}
+
+		b, err := json.Marshal(doc)
+		if err != nil {
+			p.log.WithField("volume_id", volumeID).Warnf("cannot encode volume status: %v", err)
+			continue
+		}
+
+		published := publishedStatus{claim: claim, document: string(b)}
+		if p.published[volumeID] == published {
+			continue
+		}
+
+		if err := p.annotate(ctx, claim, &published.document); err != nil {
+			p.log.WithField("volume_id", volumeID).Warnf("cannot publish volume status: %v", err)
+			continue
+		}
+		p.published[volumeID] = published
+	}
+
+	for volumeID, published := range p.published {
+		if _, ok := documents[volumeID]; ok {
+			continue
+		}
+
+		// a claim deleted along with its volume has nothing left to clean up
+		if _, ok := claims[volumeID]; ok {
+			if err := p.annotate(ctx, published.claim, nil); err != nil {
+				p.log.WithField("volume_id", volumeID).Warnf("cannot remove volume status: %v", err)
+				continue
+			}
+		}
+		delete(p.published, volumeID)
+	}
+}
+
+// annotate sets the annotation of the claim to document, removing it when nil
+func (p *volumeStatusPublisher) annotate(ctx context.Context, claim kubeClaim, document *string) error {
+	return p.kube.mergePatch(ctx, claim.path(), map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]*string{p.annotation: document},
+		},
+	})
+}
+
+// volumeStatusDocuments returns the status documents of the volumes of the controller
+func (c *VultrControllerServer) volumeStatusDocuments(ctx context.Context) (map[string]interface{}, error) {
+	volumes, err := c.backends.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	documents := make(map[string]interface{}, len(volumes))
+	for i := range volumes {
+		vol := &volumes[i]
+		condition := c.volumeCondition(vol)
+
+		documents[vol.ID] = volumeStatus{
+			VolumeID:       vol.ID,
+			StorageType:    vol.StorageType,
+			Region:         vol.Region,
+			Status:         vol.Status,
+			CapacityBytes:  vol.SizeBytes,
+			AttachedTo:     append([]string{}, vol.AttachedTo...),
+			Condition:      volumeStatusCondition{Abnormal: condition.Abnormal, Message: condition.Message},
+			LastOperations: volumeOperations.get(vol.ID, false),
+		}
+	}
+	return documents, nil
+}
+
+// volumeStatusDocuments returns the status documents of the volumes staged by the node,
+// along with those the node failed to stage or publish
+func (n *VultrNodeServer) volumeStatusDocuments(context.Context) (map[string]interface{}, error) {
+	staged := n.staged.list()
+
+	documents := make(map[string]interface{}, len(staged))
+	for i := range staged {
+		s := staged[i]
+		doc := nodeVolumeStatus{
+			NodeID:         n.Driver.nodeID,
+			StagedAt:       s.StagedAt,
+			Targets:        s.Targets,
+			Condition:      volumeStatusCondition{Message: "volume is healthy"},
+			LastOperations: volumeOperations.get(s.VolumeID, true),
+		}
+
+		switch {
+		case s.FsType == "":
+			// raw block volumes are published straight from their device, never mounted at stage
+			if _, err := os.Stat(s.Device); err != nil {
+				doc.Condition = volumeStatusCondition{Abnormal: true, Message: fmt.Sprintf("device %s of the volume is gone: %v", s.Device, err)}
+			}
+		default:
+			if condition := n.abnormalCondition(s.VolumeID, s.StagingPath); condition != nil {
+				doc.Condition = volumeStatusCondition{Abnormal: true, Message: condition.Message}
+				break
+			}
+			if usage, err := n.host.statfs(s.StagingPath); err == nil {
+				doc.Usage = usage
+			}
+		}
+
+		documents[s.VolumeID] = doc
+	}
+
+	for _, volumeID := range volumeOperations.volumeIDs() {
+		if _, ok := documents[volumeID]; ok {
+			continue
+		}
+
+		ops := volumeOperations.get(volumeID, true)
+		if len(ops) == 0 || ops[len(ops)-1].Error == "" {
+			continue
+		}
+
+		documents[volumeID] = nodeVolumeStatus{
+			NodeID:         n.Driver.nodeID,
+			Targets:        []string{},
+			Condition:      volumeStatusCondition{Abnormal: true, Message: "last operation failed: " + ops[len(ops)-1].Error},
+			LastOperations: ops,
+		}
+	}
+
+	return documents, nil
+}
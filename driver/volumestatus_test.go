@@ -0,0 +1,176 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOperationLog(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	log := newOperationLog(2, time.Hour)
+	log.now = func() time.Time { return now }
+
+	log.record("/csi.v1.Controller/CreateVolume", "", &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "vol"}}, nil)
+	log.record("/csi.v1.Controller/ControllerGetVolume", "vol", nil, nil)
+	log.record("/csi.v1.Node/NodeStageVolume", "vol", nil, status.Error(codes.Internal, "mount failed"))
+	log.record("/csi.v1.Controller/ControllerPublishVolume", "vol", nil, nil)
+	log.record("/csi.v1.Controller/ControllerExpandVolume", "vol", nil, nil)
+
+	expected := []volumeOperation{
+		{Operation: "ControllerPublishVolume", Code: "OK", Time: now},
+		{Operation: "ControllerExpandVolume", Code: "OK", Time: now},
+	}
+	if ops := log.get("vol", false); !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected the last controller operations, got %+v", ops)
+	}
+
+	log.record("/csi.v1.Node/NodeUnstageVolume", "vol", nil, status.Error(codes.Internal, "device busy"))
+	expected = []volumeOperation{{Operation: "NodeUnstageVolume", Code: "Internal", Error: "device busy", Time: now}}
+	if ops := log.get("vol", true); !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected the last node operations, got %+v", ops)
+	}
+
+	now = now.Add(2 * time.Hour)
+	log.record("/csi.v1.Controller/DeleteVolume", "other", nil, nil)
+	if ids := log.volumeIDs(); !reflect.DeepEqual(ids, []string{"other"}) {
+		t.Errorf("expected the operations of volumes idle past the retention to be dropped, got %v", ids)
+	}
+}
+
+func TestVolumeStatusPublisher(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		patches = map[string]string{}
+	)
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/persistentvolumes":
+			w.Write([]byte(`{"items":[` + //nolint:errcheck
+				`{"spec":{"csi":{"driver":"block.csi.vultr.com","volumeHandle":"bound"},` +
+				`"claimRef":{"namespace":"app","name":"data"}},"status":{"phase":"Bound"}},` +
+				`{"spec":{"csi":{"driver":"other.csi.io","volumeHandle":"foreign"},` +
+				`"claimRef":{"namespace":"app","name":"foreign"}},"status":{"phase":"Bound"}},` +
+				`{"spec":{"csi":{"driver":"block.csi.vultr.com","volumeHandle":"released"},` +
+				`"claimRef":{"namespace":"app","name":"gone"}},"status":{"phase":"Released"}}]}`))
+		case r.Method == http.MethodPatch && r.Header.Get("Content-Type") == "application/merge-patch+json":
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			patches[r.URL.Path] = string(body)
+			mu.Unlock()
+			w.Write([]byte(`{}`)) //nolint:errcheck
+		default:
+			http.Error(w, "unexpected request", http.StatusForbidden)
+		}
+	}))
+	defer api.Close()
+
+	documents := map[string]interface{}{
+		"bound":    volumeStatus{VolumeID: "bound", Status: "active"},
+		"foreign":  volumeStatus{VolumeID: "foreign"},
+		"released": volumeStatus{VolumeID: "released"},
+	}
+	var documentsErr error
+
+	controller := NewFakeVultrControllerServer("volume status")
+	p := &volumeStatusPublisher{
+		kube:       kubeAPI{client: api.Client(), apiURL: api.URL},
+		driverName: "block.csi.vultr.com",
+		annotation: "block.csi.vultr.com/status",
+		log:        controller.Driver.log,
+		documents: func(context.Context) (map[string]interface{}, error) {
+			return documents, documentsErr
+		},
+		published: make(map[string]publishedStatus),
+	}
+
+	const claimPath = "/api/v1/namespaces/app/persistentvolumeclaims/data"
+	published := func() map[string]*string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		patch, ok := patches[claimPath]
+		delete(patches, claimPath)
+		if !ok {
+			return nil
+		}
+		if len(patches) != 0 {
+			t.Errorf("expected only the bound claim of the driver to be patched, got %v", patches)
+		}
+
+		var decoded struct {
+			Metadata struct {
+				Annotations map[string]*string `json:"annotations"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal([]byte(patch), &decoded); err != nil {
+			t.Fatalf("cannot decode patch %s: %v", patch, err)
+		}
+		return decoded.Metadata.Annotations
+	}
+
+	p.publish(context.Background())
+	annotations := published()
+	if doc := annotations["block.csi.vultr.com/status"]; doc == nil || *doc != `{"volume_id":"bound","storage_type":"","region":"",`+
+		`"status":"active","capacity_bytes":0,"attached_to":null,"condition":{"abnormal":false,"message":""},"last_operations":null}` {
+		t.Errorf("expected the status document to be published, got %v", annotations)
+	}
+
+	p.publish(context.Background())
+	if annotations := published(); annotations != nil {
+		t.Errorf("expected an unchanged document not to be patched again, got %v", annotations)
+	}
+
+	documentsErr = errors.New("listing failed")
+	p.publish(context.Background())
+	if annotations := published(); annotations != nil {
+		t.Errorf("expected nothing to be patched when the documents are unknown, got %v", annotations)
+	}
+
+	documents, documentsErr = map[string]interface{}{}, nil
+	p.publish(context.Background())
+	annotations = published()
+	if doc, ok := annotations["block.csi.vultr.com/status"]; !ok || doc != nil {
+		t.Errorf("expected the annotation to be removed, got %v", annotations)
+	}
+	if len(p.published) != 0 {
+		t.Errorf("expected no published document left, got %v", p.published)
+	}
+}
+
+func TestNodeVolumeStatusDocuments(t *testing.T) {
+	node := newFakeMountNode(&fakeExec{})
+	node.Driver.nodeID = "node"
+	node.staged.stage("block", t.TempDir(), filepath.Join(t.TempDir(), "vdz"), "")
+
+	volumeOperations.record("/csi.v1.Node/NodeStageVolume", "failing", nil, status.Error(codes.Internal, "mount failed"))
+	volumeOperations.record("/csi.v1.Node/NodeUnstageVolume", "unstaged", nil, nil)
+
+	documents, err := node.volumeStatusDocuments(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if doc, ok := documents["block"].(nodeVolumeStatus); !ok || !doc.Condition.Abnormal || doc.Usage != nil {
+		t.Errorf("expected the raw block volume with no device to be abnormal, got %+v", documents["block"])
+	}
+	if doc, ok := documents["failing"].(nodeVolumeStatus); !ok || doc.Condition.Message != "last operation failed: mount failed" {
+		t.Errorf("expected the volume failing to stage to be reported, got %+v", documents["failing"])
+	}
+	if _, ok := documents["unstaged"]; ok {
+		t.Errorf("expected the unstaged volume not to be reported, got %+v", documents["unstaged"])
+	}
+}
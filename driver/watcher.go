@@ -0,0 +1,286 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// loopDetach is the name of the detach wait loop reported in metrics
+const loopDetach = "detach_wait"
+
+// watchListMin is how many volumes of a backend due for a poll are listed at once rather
+// than fetched one by one
+const watchListMin = 2
+
+var volumeWatchPolls = metrics.newCounter("volume_watch_polls_total",
+	"Number of Vultr API calls the volume watcher made, by whether it fetched one volume or listed them", "call")
+
+// volumeWatcher waits for volumes to reach a state, such as becoming active, attached or
+// detached. Rather than each RPC polling its own volume, the waits share one loop which
+// fetches each watched volume once per poll however many calls wait on it, and lists the
+// volumes of a backend when several are due, so draining a node with many attachments
+// costs one list per poll instead of one get per volume. The interval between the polls
+// of a volume doubles up to maxInterval, and goes back to interval when a wait joins it.
+type volumeWatcher struct {
+	interval    time.Duration
+	maxInterval time.Duration
+	log         *logrus.Entry
+	tracer      *tracer
+
+	mu      sync.Mutex
+	volumes map[string]*watchedVolume
+	polling bool
+	// wake interrupts the sleep of the loop when a volume is due sooner
+	wake chan struct{}
+}
+
+type watchedVolume struct {
+	backend  storageBackend
+	interval time.Duration
+	next     time.Time
+	waits    map[*volumeWait]struct{}
+}
+
+type volumeWait struct {
+	ready    func(*backendVolume) bool
+	deadline time.Time
+	// done receives the outcome of the wait, once
+	done chan error
+}
+
+func newVolumeWatcher(log *logrus.Entry, tracer *tracer) *volumeWatcher {
+	return &volumeWatcher{
+		interval:    volumeStatusCheckInterval * time.Second,
+		maxInterval: maxVolumeStatusCheckInterval,
+		log:         log,
+		tracer:      tracer,
+		volumes:     make(map[string]*watchedVolume),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// watch waits for ready to report true of the volume, and returns the channel receiving
+// nil then, errWaitTimeout when the volume is not ready once timeout passes, polling it
+// at least once, or the error of the poll, and the func giving up on the wait
+func (w *volumeWatcher) watch(backend storageBackend, volumeID string, timeout time.Duration, ready func(*backendVolume) bool) (<-chan error, func()) { //nolint:lll
+	now := time.Now()
+	wait := &volumeWait{ready: ready, deadline: now.Add(timeout), done: make(chan error, 1)}
+
+	w.mu.Lock()
+	v, ok := w.volumes[volumeID]
+	if !ok {
+		v = &watchedVolume{backend: backend, waits: make(map[*volumeWait]struct{})}
+		w.volumes[volumeID] = v
+	}
+	v.waits[wait] = struct{}{}
+	v.interval = w.interval
+	if next := now.Add(w.interval); !ok || next.Before(v.next) {
+		v.next = next
+	}
+	if !w.polling {
+		w.polling = true
+		go w.poll()
+	}
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+
+	return wait.done, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.drop(volumeID, wait)
+	}
+}
+
+// wait blocks until ready reports true of the volume, recording the wait as work of the
+// named loop and as a span of the trace in ctx, as watch does but ending with ctx
+func (w *volumeWatcher) wait(ctx context.Context, backend storageBackend, volumeID, loop string, timeout time.Duration, ready func(*backendVolume) bool) (err error) { //nolint:lll
+	done := trackLoopWork(loop)
+	_, span := w.tracer.start(ctx, loop, spanKindInternal, spanAttrs{"csi.volume_id": volumeID})
+	defer func() {
+		done(err)
+		span.end(err)
+	}()
+
+	result, stop := w.watch(backend, volumeID, timeout, ready)
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		stop()
+		return ctx.Err()
+	}
+}
+
+// drop removes the wait, and the volume once nothing waits on it
+func (w *volumeWatcher) drop(volumeID string, wait *volumeWait) {
+	v, ok := w.volumes[volumeID]
+	if !ok {
+		return
+	}
+
+	delete(v.waits, wait)
+	if len(v.waits) == 0 {
+		delete(w.volumes, volumeID)
+	}
+}
+
+// poll fetches the volumes as they are due, releasing their waits, and stops once
+// nothing is watched
+func (w *volumeWatcher) poll() {
+	timer := time.NewTimer(w.interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-w.wake:
+		}
+
+		w.mu.Lock()
+		if len(w.volumes) == 0 {
+			w.polling = false
+			w.mu.Unlock()
+			return
+		}
+
+		now := time.Now()
+		due := make(map[storageBackend][]string)
+		next := now.Add(w.maxInterval)
+		for id, v := range w.volumes {
+			if !v.next.After(now) {
+				due[v.backend] = append(due[v.backend], id)
+			} else if v.next.Before(next) {
+				next = v.next
+			}
+		}
+		w.mu.Unlock()
+
+		for backend, ids := range due {
+			w.fetch(backend, ids)
+		}
+
+		w.mu.Lock()
+		for _, v := range w.volumes {
+			if v.next.Before(next) {
+				next = v.next
+			}
+		}
+		w.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(next))
+	}
+}
+
+// fetch gets the volumes of the backend, in one list when there are several, and settles
+// their waits
+func (w *volumeWatcher) fetch(backend storageBackend, ids []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.interval*volumeStatusCheckRetries)
+	defer cancel()
+
+	listed := make(map[string]*backendVolume, len(ids))
+	if len(ids) >= watchListMin {
+		volumeWatchPolls.add(1, "list")
+		volumes, err := backend.List(ctx)
+		if err != nil {
+			w.log.Warnf("volume watch: cannot list volumes, getting them one by one: %v", err)
+		}
+		for i := range volumes {
+			listed[volumes[i].ID] = &volumes[i]
+		}
+	}
+
+	for _, id := range ids {
+		// the list can lag behind a volume created moments ago, which is then fetched
+		vol, ok := listed[id]
+		var err error
+		if !ok {
+			volumeWatchPolls.add(1, "get")
+			vol, err = backend.Get(ctx, id)
+		}
+		w.settle(id, vol, err)
+	}
+}
+
+// settle releases the waits on the volume whose state is ready, failed to be fetched or
+// ran out of time, and schedules the next poll of the others
+func (w *volumeWatcher) settle(volumeID string, vol *backendVolume, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	v, ok := w.volumes[volumeID]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	var deadline time.Time
+	for wait := range v.waits {
+		switch {
+		case err != nil:
+			wait.done <- err
+		case wait.ready(vol):
+			wait.done <- nil
+		case !now.Before(wait.deadline):
+			wait.done <- errWaitTimeout
+		default:
+			if deadline.IsZero() || wait.deadline.Before(deadline) {
+				deadline = wait.deadline
+			}
+			continue
+		}
+		delete(v.waits, wait)
+	}
+
+	if len(v.waits) == 0 {
+		delete(w.volumes, volumeID)
+		return
+	}
+
+	if v.interval *= 2; v.interval > w.maxInterval {
+		v.interval = w.maxInterval
+	}
+	// the volume is polled once more as the first of its waits runs out of time
+	v.next = now.Add(v.interval)
+	if deadline.Before(v.next) {
+		v.next = deadline
+	}
+}
+
+// waitDetached waits for the volume to be detached from the node, counting a volume which
+// no longer exists as detached
+func (c *VultrControllerServer) waitDetached(ctx context.Context, backend storageBackend, volumeID, nodeID string) error {
+	err := c.watcher.wait(ctx, backend, volumeID, loopDetach, c.Driver.detachTimeout, func(vol *backendVolume) bool {
+		return !vol.isAttachedTo(nodeID)
+	})
+	if errors.Is(err, errVolumeNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,169 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// listCountingBackend reports its volumes attached to node-1 until detachAfter lists or gets
+type listCountingBackend struct {
+	storageBackend
+
+	mu          sync.Mutex
+	lists       int
+	gets        int
+	detachAfter int
+	volumeIDs   []string
+}
+
+func (b *listCountingBackend) Get(_ context.Context, volumeID string) (*backendVolume, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.gets++
+	vol := &backendVolume{ID: volumeID}
+	if b.lists+b.gets < b.detachAfter {
+		vol.AttachedTo = []string{"node-1"}
+	}
+	return vol, nil
+}
+
+func (b *listCountingBackend) List(context.Context) ([]backendVolume, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lists++
+	volumes := make([]backendVolume, 0, len(b.volumeIDs))
+	for _, id := range b.volumeIDs {
+		vol := backendVolume{ID: id}
+		if b.lists+b.gets < b.detachAfter {
+			vol.AttachedTo = []string{"node-1"}
+		}
+		volumes = append(volumes, vol)
+	}
+
+	return volumes, nil
+}
+
+func newTestWatcher(interval time.Duration) *volumeWatcher {
+	w := newVolumeWatcher(logrus.NewEntry(logrus.New()), nil)
+	w.interval, w.maxInterval = interval, interval
+	return w
+}
+
+func TestVolumeWatcherCoalescesPolling(t *testing.T) {
+	backend := &listCountingBackend{detachAfter: 2}
+	for i := 0; i < 10; i++ {
+		backend.volumeIDs = append(backend.volumeIDs, fmt.Sprintf("volume-%d", i))
+	}
+
+	c := &VultrControllerServer{Driver: &VultrDriver{detachTimeout: time.Second}, watcher: newTestWatcher(10 * time.Millisecond)}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(backend.volumeIDs))
+	for _, id := range backend.volumeIDs {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			errs <- c.waitDetached(context.Background(), backend, id, "node-1")
+		}(id)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("expected every detach to complete, got %v", err)
+		}
+	}
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if backend.lists > 3 {
+		t.Errorf("expected the waits to share a few lists, got %d", backend.lists)
+	}
+}
+
+func TestVolumeWatcherTimeout(t *testing.T) {
+	backend := &listCountingBackend{detachAfter: 1 << 30, volumeIDs: []string{"volume-0"}}
+
+	c := &VultrControllerServer{Driver: &VultrDriver{detachTimeout: 50 * time.Millisecond}, watcher: newTestWatcher(10 * time.Millisecond)}
+	if err := c.waitDetached(context.Background(), backend, "volume-0", "node-1"); err != errWaitTimeout {
+		t.Errorf("expected errWaitTimeout, got %v", err)
+	}
+}
+
+func TestVolumeWatcherSharesGets(t *testing.T) {
+	backend := &listCountingBackend{detachAfter: 3}
+	w := newTestWatcher(10 * time.Millisecond)
+
+	// the waits on one volume share its gets, whatever state each waits for
+	detached := func(vol *backendVolume) bool { return !vol.isAttachedTo("node-1") }
+	results := make([]<-chan error, 5)
+	for i := range results {
+		results[i], _ = w.watch(backend, "volume-0", time.Second, detached)
+	}
+	attached, _ := w.watch(backend, "volume-0", time.Second, func(vol *backendVolume) bool { return vol.isAttachedTo("node-1") })
+
+	if err := <-attached; err != nil {
+		t.Errorf("expected the attached volume to be seen, got %v", err)
+	}
+	for _, result := range results {
+		if err := <-result; err != nil {
+			t.Errorf("expected the detach to be seen, got %v", err)
+		}
+	}
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if backend.gets > 3 || backend.lists != 0 {
+		t.Errorf("expected a single volume to be fetched once per poll, got %d gets and %d lists", backend.gets, backend.lists)
+	}
+}
+
+// notListedBackend lists no volumes, as Vultr may right after they were created, and
+// finds deleted the ones missing from volumeIDs
+type notListedBackend struct {
+	listCountingBackend
+}
+
+func (b *notListedBackend) List(ctx context.Context) ([]backendVolume, error) {
+	_, err := b.listCountingBackend.List(ctx)
+	return nil, err
+}
+
+func (b *notListedBackend) Get(ctx context.Context, volumeID string) (*backendVolume, error) {
+	for _, id := range b.volumeIDs {
+		if id == volumeID {
+			return b.listCountingBackend.Get(ctx, volumeID)
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errVolumeNotFound, volumeID)
+}
+
+func TestVolumeWatcherNotListed(t *testing.T) {
+	backend := &notListedBackend{listCountingBackend{detachAfter: 1, volumeIDs: []string{"volume-0"}}}
+	c := &VultrControllerServer{Driver: &VultrDriver{detachTimeout: time.Second}, watcher: newTestWatcher(10 * time.Millisecond)}
+
+	errs := make(chan error, 2)
+	for _, id := range []string{"volume-0", "deleted"} {
+		go func(id string) { errs <- c.waitDetached(context.Background(), backend, id, "node-1") }(id)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("expected the volumes missing from the list to be fetched, got %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	never := func(*backendVolume) bool { return false }
+	if err := c.watcher.wait(ctx, backend, "volume-0", loopAttach, time.Minute, never); err != context.Canceled {
+		t.Errorf("expected the wait to end with its context, got %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// webhookSignatureHeader carries the timestamp and HMAC-SHA256 signature of an event
+	webhookSignatureHeader = "X-Vultr-CSI-Signature"
+
+	webhookQueueSize = 256
+	webhookTimeout   = 10 * time.Second
+	webhookAttempts  = 3
+	webhookBackoff   = time.Second
+)
+
+// The types of the volume events POSTed to the webhook
+const (
+	eventCreated     = "created"
+	eventAttached    = "attached"
+	eventExpanded    = "expanded"
+	eventSnapshotted = "snapshotted"
+	eventDeleted     = "deleted"
+	eventFailed      = "failed"
+	// eventForceDetached reports a detach ControllerUnpublishVolume forced as it was stuck
+	eventForceDetached = "force_detached"
+)
+
+// webhookEventTypes are the event types of the RPCs reported to the webhook
+var webhookEventTypes = map[string]string{
+	"CreateVolume":            eventCreated,
+	"ControllerPublishVolume": eventAttached,
+	"ControllerExpandVolume":  eventExpanded,
+	"CreateSnapshot":          eventSnapshotted,
+	"DeleteVolume":            eventDeleted,
+}
+
+var webhookEvents = metrics.newCounter("webhook_events_total",
+	"Number of volume events sent to the webhook, by result", "result")
+
+// WithEventWebhook makes the controller POST a JSON event to the URL whenever it creates,
+// attaches, expands, snapshots or deletes a volume, or fails to, so external inventory
+// and billing systems stay in sync. Events are signed with the secret when one is set.
+func WithEventWebhook(webhookURL, secret string) Option {
+	return func(d *VultrDriver) {
+		d.webhookURL = webhookURL
+		d.webhookSecret = secret
+	}
+}
+
+// volumeEvent is the JSON document POSTed to the webhook
+type volumeEvent struct {
+	Type          string    `json:"type"`
+	Operation     string    `json:"operation"`
+	ClusterID     string    `json:"cluster_id,omitempty"`
+	VolumeID      string    `json:"volume_id,omitempty"`
+	VolumeName    string    `json:"volume_name,omitempty"`
+	Claim         string    `json:"claim,omitempty"`
+	NodeID        string    `json:"node_id,omitempty"`
+	SnapshotID    string    `json:"snapshot_id,omitempty"`
+	CapacityBytes int64     `json:"capacity_bytes,omitempty"`
+	Code          string    `json:"code,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	Time          time.Time `json:"time"`
+}
+
+// eventWebhook queues the volume events of the controller RPCs and delivers them to the
+// webhook in order. A full queue drops events rather than holding up the RPCs, and a
+// failure repeating while the sidecars retry is only reported the first time.
+type eventWebhook struct {
+	url       string
+	secret    []byte
+	clusterID string
+	client    *http.Client
+	log       *logrus.Entry
+	now       func() time.Time
+	backoff   time.Duration
+
+	queue chan volumeEvent
+
+	mu       sync.Mutex
+	failures map[string]string
+}
+
+func newEventWebhook(d *VultrDriver) (*eventWebhook, error) {
+	u, err := url.Parse(d.webhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("event webhook URL %q must be an absolute http or https URL", d.webhookURL)
+	}
+	if !d.isController {
+		return nil, fmt.Errorf("an API token is required to send volume events")
+	}
+
+	return &eventWebhook{
+		url:       d.webhookURL,
+		secret:    []byte(d.webhookSecret),
+		clusterID: d.clusterID,
+		client:    &http.Client{Timeout: webhookTimeout},
+		log:       d.log.WithField("loop", "event_webhook"),
+		now:       time.Now,
+		backoff:   webhookBackoff,
+		queue:     make(chan volumeEvent, webhookQueueSize),
+		failures:  make(map[string]string),
+	}, nil
+}
+
+// intercept is a gRPC interceptor queueing the event of each RPC it serves
+func (w *eventWebhook) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) { //nolint:lll
+	resp, err := handler(ctx, req)
+	if event, ok := w.event(path.Base(info.FullMethod), req, resp, err); ok {
+		w.emit(event)
+	}
+	return resp, err
+}
+
+// event returns the event of the RPC, false when it is not reported
+func (w *eventWebhook) event(method string, req, resp interface{}, err error) (volumeEvent, bool) {
+	eventType, ok := webhookEventTypes[method]
+	if !ok {
+		return volumeEvent{}, false
+	}
+
+	event := volumeEvent{Type: eventType, Operation: method, ClusterID: w.clusterID, VolumeID: requestVolumeID(req)}
+	switch r := req.(type) {
+	case *csi.CreateVolumeRequest:
+		event.VolumeName = r.GetName()
+		if name, namespace := r.GetParameters()[pvcNameParam], r.GetParameters()[pvcNamespaceParam]; name != "" && namespace != "" {
+			event.Claim = namespace + "/" + name
+		}
+	case *csi.ControllerPublishVolumeRequest:
+		event.NodeID = r.GetNodeId()
+	case *csi.CreateSnapshotRequest:
+		event.VolumeID = r.GetSourceVolumeId()
+	}
+
+	// failures repeating for an operation on a volume are only sent once
+	failureKey := method + "/" + event.VolumeID + "/" + event.VolumeName
+	if err != nil {
+		st := status.Convert(err)
+		event.Type, event.Code, event.Error = eventFailed, st.Code().String(), st.Message()
+		return event, w.newFailure(failureKey, event.Error)
+	}
+	w.newFailure(failureKey, "")
+
+	switch r := resp.(type) {
+	case *csi.CreateVolumeResponse:
+		event.VolumeID = r.GetVolume().GetVolumeId()
+		event.CapacityBytes = r.GetVolume().GetCapacityBytes()
+	case *csi.ControllerExpandVolumeResponse:
+		event.CapacityBytes = r.GetCapacityBytes()
+	case *csi.CreateSnapshotResponse:
+		event.SnapshotID = r.GetSnapshot().GetSnapshotId()
+		event.CapacityBytes = r.GetSnapshot().GetSizeBytes()
+	}
+	return event, true
+}
+
+// newFailure records the failure of the operation, an empty one for a success, and
+// reports whether it differs from the last one
+func (w *eventWebhook) newFailure(key, failure string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if failure == "" {
+		delete(w.failures, key)
+		return true
+	}
+	if w.failures[key] == failure {
+		return false
+	}
+	// volumes deleted while failing leave their failures behind, so the map is bounded
+	if len(w.failures) >= webhookQueueSize {
+		w.failures = make(map[string]string)
+	}
+	w.failures[key] = failure
+	return true
+}
+
+// emit queues the event, dropping it when the webhook is too far behind
+func (w *eventWebhook) emit(event volumeEvent) {
+	event.Time = w.now().UTC()
+
+	select {
+	case w.queue <- event:
+	default:
+		webhookEvents.add(1, "dropped")
+		w.log.WithFields(logrus.Fields{
+			"type":      event.Type,
+			"volume_id": event.VolumeID,
+		}).Warn("event webhook queue is full, dropping event")
+	}
+}
+
+// run delivers the queued events until ctx is done
+func (w *eventWebhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-w.queue:
+			w.deliver(ctx, event)
+		}
+	}
+}
+
+// deliver POSTs the event, retrying failed attempts with a growing backoff
+func (w *eventWebhook) deliver(ctx context.Context, event volumeEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		w.log.Errorf("cannot encode event: %v", err)
+		return
+	}
+
+	log := w.log.WithFields(logrus.Fields{
+		"type":      event.Type,
+		"volume_id": event.VolumeID,
+	})
+
+	backoff := w.backoff
+	for attempt := 1; ; attempt++ {
+		err = w.post(ctx, body)
+		if err == nil {
+			webhookEvents.add(1, "delivered")
+			return
+		}
+		if attempt == webhookAttempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	webhookEvents.add(1, "failed")
+	log.Warnf("cannot deliver event after %d attempts: %v", webhookAttempts, err)
+}
+
+func (w *eventWebhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		req.Header.Set(webhookSignatureHeader, w.signature(w.now(), body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// signature returns the signature header of the body sent at t, t=<unix seconds>,v1=<hex>
+// where the HMAC-SHA256 is computed over "<unix seconds>.<body>", so receivers can also
+// refuse replayed events
+func (w *eventWebhook) signature(t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write([]byte(ts + ".")) //nolint:errcheck
+	mac.Write(body)             //nolint:errcheck
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,128 @@
+package driver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestEventWebhook(t *testing.T, webhookURL string) *eventWebhook {
+	w, err := newEventWebhook(&VultrDriver{
+		log:           logrus.NewEntry(logrus.New()),
+		isController:  true,
+		clusterID:     "prod",
+		webhookURL:    webhookURL,
+		webhookSecret: "secret",
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	w.backoff = time.Millisecond
+	return w
+}
+
+func TestEventWebhookEvents(t *testing.T) {
+	w := newTestEventWebhook(t, "https://cmdb.example.com/events")
+
+	req := &csi.CreateVolumeRequest{
+		Name:       "pvc-1",
+		Parameters: map[string]string{pvcNameParam: "data", pvcNamespaceParam: "db"},
+	}
+	failure := status.Error(codes.ResourceExhausted, "quota exceeded")
+
+	event, ok := w.event("CreateVolume", req, nil, failure)
+	if !ok || event.Type != eventFailed || event.Code != codes.ResourceExhausted.String() {
+		t.Errorf("expected a failed event, got %+v, %v", event, ok)
+	}
+	if _, ok := w.event("CreateVolume", req, nil, failure); ok {
+		t.Error("expected the repeated failure not to be sent")
+	}
+
+	resp := &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "c56c7b6e-15c2-445e-9a5d-1063ab5828ec", CapacityBytes: 10 * giB}}
+	event, ok = w.event("CreateVolume", req, resp, nil)
+	if !ok {
+		t.Fatal("expected the created volume to be sent")
+	}
+	expected := volumeEvent{
+		Type: eventCreated, Operation: "CreateVolume", ClusterID: "prod", VolumeID: resp.Volume.VolumeId,
+		VolumeName: "pvc-1", Claim: "db/data", CapacityBytes: 10 * giB,
+	}
+	if event != expected {
+		t.Errorf("expected %+v, got %+v", expected, event)
+	}
+
+	if _, ok := w.event("CreateVolume", req, nil, failure); !ok {
+		t.Error("expected a failure after a success to be sent")
+	}
+	if _, ok := w.event("ControllerGetVolume", &csi.ControllerGetVolumeRequest{}, nil, nil); ok {
+		t.Error("expected reads not to be sent")
+	}
+}
+
+func TestEventWebhookDeliver(t *testing.T) {
+	var attempts atomic.Int32
+	received := make(chan volumeEvent, 1)
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		signature := r.Header.Get(webhookSignatureHeader)
+		ts, sig, _ := strings.Cut(strings.TrimPrefix(signature, "t="), ",v1=")
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(ts + "." + string(body))) //nolint:errcheck
+		if !hmac.Equal([]byte(sig), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+
+		var event volumeEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- event
+	}))
+	defer api.Close()
+
+	w := newTestEventWebhook(t, api.URL)
+	w.deliver(context.Background(), volumeEvent{Type: eventDeleted, Operation: "DeleteVolume", VolumeID: "vol"})
+
+	select {
+	case event := <-received:
+		if event.Type != eventDeleted || event.VolumeID != "vol" {
+			t.Errorf("expected the deleted event, got %+v", event)
+		}
+	default:
+		t.Fatal("expected the event to be delivered after a retry")
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts.Load())
+	}
+}
+
+func TestNewEventWebhookInvalidURL(t *testing.T) {
+	for _, webhookURL := range []string{"cmdb.example.com/events", "ftp://cmdb.example.com", "https://"} {
+		if _, err := newEventWebhook(&VultrDriver{isController: true, webhookURL: webhookURL}); err == nil {
+			t.Errorf("expected %q to be refused", webhookURL)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+// Package e2e runs the volume lifecycle through the gRPC services of the driver, the way
+// the sidecars drive it, against the fake Vultr API or, opted in through the environment,
+// the real one.
+package e2e
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/vultr/vultr-csi/driver"
+	"github.com/vultr/vultr-csi/internal/fakevultr"
+)
+
+const (
+	giB = 1 << 30
+
+	fakeNodeID = "00000000-0000-4000-8000-00000000e2e0"
+	fakeRegion = "ewr"
+
+	// fakeAttachTimeout keeps the attach timeout injected against the fake API short
+	fakeAttachTimeout = 2 * time.Second
+
+	// the environment running the suite against the real Vultr API, on the node the
+	// volumes are attached to
+	envAPIKey    = "VULTR_E2E_API_KEY"
+	envAPIURL    = "VULTR_E2E_API_URL"
+	envNodeID    = "VULTR_E2E_NODE_ID"
+	envRegion    = "VULTR_E2E_REGION"
+	envNodeSteps = "VULTR_E2E_NODE_STEPS"
+)
+
+// e2eDriver is the driver serving its gRPC services on a unix socket, backed by the
+// fake Vultr API unless real credentials are set
+type e2eDriver struct {
+	identity   csi.IdentityClient
+	controller csi.ControllerClient
+	node       csi.NodeClient
+
+	// api is the fake Vultr API, nil against the real one
+	api *fakevultr.API
+
+	nodeID string
+	dir    string
+}
+
+func newE2EDriver(t *testing.T) *e2eDriver {
+	t.Helper()
+
+	e := &e2eDriver{dir: t.TempDir()}
+
+	token, apiURL := os.Getenv(envAPIKey), os.Getenv(envAPIURL)
+	region := os.Getenv(envRegion)
+	attachTimeout := driver.DefaultAttachTimeout
+
+	if token != "" {
+		e.nodeID = os.Getenv(envNodeID)
+		if e.nodeID == "" || region == "" {
+			t.Fatalf("%s and %s are required with %s", envNodeID, envRegion, envAPIKey)
+		}
+	} else {
+		e.api = fakevultr.New()
+		e.api.AddPlan("vc2-1c-1gb", 1)
+		e.api.AddRegion(fakeRegion, "block_storage_high_perf", "block_storage_storage_opt")
+		e.api.AddInstance(fakeNodeID, fakeRegion, "e2e-node", "vc2-1c-1gb")
+
+		srv := httptest.NewServer(e.api)
+		t.Cleanup(srv.Close)
+
+		token, apiURL = "e2e", srv.URL
+		e.nodeID, region = fakeNodeID, fakeRegion
+		attachTimeout = fakeAttachTimeout
+	}
+
+	socket := "unix://" + filepath.Join(e.dir, "csi.sock")
+	d, err := driver.NewDriver(socket, token, driver.DefaultDriverName, "e2e", "", apiURL,
+		driver.WithInstanceIdentity(e.nodeID, region),
+		driver.WithAttachTimeouts(attachTimeout, driver.DefaultDetachTimeout),
+		driver.WithAPIPacing(driver.DefaultAPIRateLimit, 0),
+	)
+	if err != nil {
+		t.Fatalf("cannot create the driver: %v", err)
+	}
+	if err := d.CheckAPIAccess(context.Background()); err != nil {
+		t.Fatalf("the API token does not pass the startup check: %v", err)
+	}
+
+	server := driver.NewNonBlockingGRPCServer()
+	server.Start(socket, driver.NewVultrIdentityServer(d), driver.NewVultrControllerServer(d), driver.NewVultrNodeDriver(d))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, socket, //nolint:staticcheck
+		grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock()) //nolint:staticcheck
+	if err != nil {
+		t.Fatalf("cannot connect to the driver: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		server.ForceStop()
+	})
+
+	e.identity = csi.NewIdentityClient(conn)
+	e.controller = csi.NewControllerClient(conn)
+	e.node = csi.NewNodeClient(conn)
+	return e
+}
+
+// nodeSteps reports whether the node RPCs can run, which stage the volume on the disks of
+// the machine running the suite and so only make sense as root on the node it attaches to
+func (e *e2eDriver) nodeSteps(t *testing.T) bool {
+	t.Helper()
+
+	if e.api != nil || os.Getenv(envNodeSteps) != "true" {
+		t.Logf("skipping the node steps, set %s=true to run them as root on node %s", envNodeSteps, e.nodeID)
+		return false
+	}
+	if os.Geteuid() != 0 {
+		t.Fatalf("%s requires running as root", envNodeSteps)
+	}
+	return true
+}
+
+// createVolume creates a volume deleted when the test ends, whatever state it is left in
+func (e *e2eDriver) createVolume(t *testing.T, name string, size int64) *csi.Volume {
+	t.Helper()
+	ctx := context.Background()
+
+	res, err := e.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               name,
+		Parameters:         map[string]string{"block_type": "high_perf"},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: size},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+
+	volumeID := res.Volume.VolumeId
+	t.Cleanup(func() {
+		if _, err := e.controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: volumeID,
+			NodeId:   e.nodeID,
+		}); err != nil {
+			t.Errorf("cleanup ControllerUnpublishVolume %s: %v", volumeID, err)
+		}
+		if _, err := e.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+			t.Errorf("cleanup DeleteVolume %s: %v", volumeID, err)
+		}
+	})
+	return res.Volume
+}
+
+func mountCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+// volumeName is unique to the test, the real API possibly holding volumes of earlier runs
+func volumeName(t *testing.T) string {
+	return strings.ToLower(strings.ReplaceAll(t.Name(), "/", "-")) + "-" + time.Now().UTC().Format("20060102150405")
+}
+
+func TestVolumeLifecycle(t *testing.T) {
+	e := newE2EDriver(t)
+	ctx := context.Background()
+
+	volume := e.createVolume(t, volumeName(t), 10*giB)
+	volumeID := volume.VolumeId
+
+	published, err := e.controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           e.nodeID,
+		VolumeCapability: mountCapability(),
+		VolumeContext:    volume.VolumeContext,
+	})
+	if err != nil {
+		t.Fatalf("ControllerPublishVolume: %v", err)
+	}
+
+	staging := filepath.Join(e.dir, "staging")
+	target := filepath.Join(e.dir, "target")
+	data := []byte("written before the expansion\n")
+
+	nodeSteps := e.nodeSteps(t)
+	if nodeSteps {
+		if _, err := e.node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          volumeID,
+			PublishContext:    published.PublishContext,
+			StagingTargetPath: staging,
+			VolumeCapability:  mountCapability(),
+			VolumeContext:     volume.VolumeContext,
+		}); err != nil {
+			t.Fatalf("NodeStageVolume: %v", err)
+		}
+
+		if _, err := e.node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:          volumeID,
+			PublishContext:    published.PublishContext,
+			StagingTargetPath: staging,
+			TargetPath:        target,
+			VolumeCapability:  mountCapability(),
+			VolumeContext:     volume.VolumeContext,
+		}); err != nil {
+			t.Fatalf("NodePublishVolume: %v", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(target, "data"), data, 0600); err != nil {
+			t.Fatalf("cannot write to the volume: %v", err)
+		}
+	}
+
+	expanded, err := e.controller.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:         volumeID,
+		CapacityRange:    &csi.CapacityRange{RequiredBytes: 20 * giB},
+		VolumeCapability: mountCapability(),
+	})
+	if err != nil {
+		t.Fatalf("ControllerExpandVolume: %v", err)
+	}
+	if expanded.CapacityBytes < 20*giB {
+		t.Errorf("ControllerExpandVolume: expected at least %d bytes, got %d", int64(20*giB), expanded.CapacityBytes)
+	}
+
+	got, err := e.controller.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+	if err != nil {
+		t.Fatalf("ControllerGetVolume: %v", err)
+	}
+	if got.Volume.CapacityBytes != expanded.CapacityBytes {
+		t.Errorf("ControllerGetVolume: expected %d bytes, got %d", expanded.CapacityBytes, got.Volume.CapacityBytes)
+	}
+
+	if nodeSteps {
+		if expanded.NodeExpansionRequired {
+			if _, err := e.node.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{
+				VolumeId:          volumeID,
+				VolumePath:        target,
+				StagingTargetPath: staging,
+				CapacityRange:     &csi.CapacityRange{RequiredBytes: 20 * giB},
+				VolumeCapability:  mountCapability(),
+			}); err != nil {
+				t.Fatalf("NodeExpandVolume: %v", err)
+			}
+		}
+
+		stats, err := e.node.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: volumeID, VolumePath: target})
+		if err != nil {
+			t.Fatalf("NodeGetVolumeStats: %v", err)
+		}
+		for _, usage := range stats.Usage {
+			// the filesystem keeps some of the disk to itself
+			if usage.Unit == csi.VolumeUsage_BYTES && usage.Total <= 10*giB {
+				t.Errorf("NodeGetVolumeStats: expected the filesystem to grow past 10GB, got %d bytes", usage.Total)
+			}
+		}
+
+		read, err := os.ReadFile(filepath.Join(target, "data"))
+		if err != nil {
+			t.Fatalf("cannot read back from the volume: %v", err)
+		}
+		if string(read) != string(data) {
+			t.Errorf("expected the volume to hold %q after the expansion, got %q", data, read)
+		}
+
+		if _, err := e.node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: target}); err != nil {
+			t.Fatalf("NodeUnpublishVolume: %v", err)
+		}
+		if _, err := e.node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: staging}); err != nil {
+			t.Fatalf("NodeUnstageVolume: %v", err)
+		}
+	}
+
+	if _, err := e.controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   e.nodeID,
+	}); err != nil {
+		t.Fatalf("ControllerUnpublishVolume: %v", err)
+	}
+
+	if _, err := e.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+		t.Fatalf("DeleteVolume: %v", err)
+	}
+
+	_, err = e.controller.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("ControllerGetVolume of the deleted volume: expected NotFound, got %v", err)
+	}
+}
+
+// TestAttachTimeout holds the attachment on the Vultr side past the attach timeout, which
+// the driver must report rather than publish the volume, and completes it on the retry
+// once the attachment goes through
+func TestAttachTimeout(t *testing.T) {
+	e := newE2EDriver(t)
+	if e.api == nil {
+		t.Skip("attach timeouts are only injected against the fake Vultr API")
+	}
+	ctx := context.Background()
+
+	volume := e.createVolume(t, volumeName(t), 10*giB)
+	publish := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volume.VolumeId,
+		NodeId:           e.nodeID,
+		VolumeCapability: mountCapability(),
+		VolumeContext:    volume.VolumeContext,
+	}
+
+	e.api.HoldAttachments()
+	_, err := e.controller.ControllerPublishVolume(ctx, publish)
+	if status.Code(err) != codes.Internal || !strings.Contains(err.Error(), "not attached to node after") {
+		t.Fatalf("ControllerPublishVolume of a held attachment: expected an attach timeout, got %v", err)
+	}
+
+	e.api.ReleaseAttachments()
+	published, err := e.controller.ControllerPublishVolume(ctx, publish)
+	if err != nil {
+		t.Fatalf("ControllerPublishVolume retried: %v", err)
+	}
+	if len(published.PublishContext) == 0 {
+		t.Error("ControllerPublishVolume retried: expected a publish context")
+	}
+}
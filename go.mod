@@ -11,7 +11,9 @@ require (
 	golang.org/x/oauth2 v0.20.0
 	golang.org/x/sync v0.6.0
 	golang.org/x/sys v0.21.0
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240318140521-94a12d6c2237
 	google.golang.org/grpc v1.64.0
+	google.golang.org/protobuf v1.33.0
 	k8s.io/mount-utils v0.29.2
 	k8s.io/utils v0.0.0-20230726121419-3b25d923346b
 )
@@ -24,7 +26,5 @@ require (
 	github.com/moby/sys/mountinfo v0.6.2 // indirect
 	golang.org/x/net v0.23.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
-	google.golang.org/genproto/googleapis/rpc v0.0.0-20240318140521-94a12d6c2237 // indirect
-	google.golang.org/protobuf v1.33.0 // indirect
 	k8s.io/klog/v2 v2.110.1 // indirect
 )
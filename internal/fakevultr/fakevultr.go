@@ -0,0 +1,450 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fakevultr is an in memory implementation of the parts of the Vultr API the
+// driver calls: the account, block storage, VFS storage, instances and plans. It serves the API over
+// HTTP so the driver is exercised through the real govultr client, without credentials.
+package fakevultr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/vultr/govultr/v3"
+)
+
+// vfs mirrors the Vultr File System volume the driver decodes
+type vfs struct {
+	ID          string   `json:"id"`
+	Region      string   `json:"region"`
+	Status      string   `json:"status"`
+	Label       string   `json:"label"`
+	Tags        []string `json:"tags"`
+	DiskType    string   `json:"disk_type"`
+	StorageSize vfsSize  `json:"storage_size"`
+}
+
+type vfsSize struct {
+	SizeGB int `json:"gb"`
+}
+
+// vfsUpdate is a VFS volume update, whose tags replace those of the volume when set
+type vfsUpdate struct {
+	Label       string    `json:"label"`
+	StorageSize *vfsSize  `json:"storage_size"`
+	Tags        *[]string `json:"tags"`
+}
+
+type vfsAttachment struct {
+	State    string `json:"state"`
+	VFSID    string `json:"vfs_id"`
+	TargetID string `json:"target_id"`
+	MountTag int    `json:"mount_tag"`
+}
+
+// API is a fake Vultr API. Volumes become active and attachments complete as soon as
+// they are requested, unless block storage attachments are held.
+type API struct {
+	mu sync.Mutex
+
+	ids         int
+	account     govultr.Account
+	blocks      map[string]*govultr.BlockStorage
+	holdAttach  bool
+	pending     map[string]string
+	vfs         map[string]*vfs
+	attachments map[string][]vfsAttachment
+	instances   map[string]*govultr.Instance
+	// autoInstances makes up the instances looked up without being added
+	autoInstances bool
+	plans         []govultr.Plan
+	regions       []govultr.Region
+}
+
+// New returns an empty fake Vultr API
+func New() *API {
+	return &API{
+		account:     govultr.Account{Name: "fakevultr", Email: "fakevultr@example.com"},
+		blocks:      make(map[string]*govultr.BlockStorage),
+		pending:     make(map[string]string),
+		vfs:         make(map[string]*vfs),
+		attachments: make(map[string][]vfsAttachment),
+		instances:   make(map[string]*govultr.Instance),
+	}
+}
+
+// AddInstance registers an instance volumes can be attached to
+func (a *API) AddInstance(id, region, label, plan string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.instances[id] = &govultr.Instance{
+		ID:     id,
+		Region: region,
+		Label:  label,
+		Plan:   plan,
+		Status: "active",
+	}
+}
+
+// AutoInstances makes every instance looked up or attached to exist, as an active
+// instance in no region unless it was added, so volumes can be attached to any node
+func (a *API) AutoInstances() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.autoInstances = true
+}
+
+// instance returns the instance, made up when instances are
+func (a *API) instance(id string) (*govultr.Instance, bool) {
+	if instance, ok := a.instances[id]; ok || !a.autoInstances {
+		return instance, ok
+	}
+
+	instance := &govultr.Instance{ID: id, Status: "active"}
+	a.instances[id] = instance
+	return instance, true
+}
+
+// SetACL restricts the user of the API token to the permissions, as for a sub-account
+func (a *API) SetACL(acls ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.account.ACL = acls
+}
+
+// AddPlan registers an instance plan with its number of local disks
+func (a *API) AddPlan(id string, diskCount int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.plans = append(a.plans, govultr.Plan{ID: id, DiskCount: diskCount})
+}
+
+// AddRegion registers a region with the options it offers, such as block_storage_high_perf
+func (a *API) AddRegion(id string, options ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.regions = append(a.regions, govultr.Region{ID: id, Options: options})
+}
+
+// HoldAttachments accepts the block storage attachments requested from now on without
+// completing them, the way an attachment stuck on the Vultr side looks to the driver
+func (a *API) HoldAttachments() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.holdAttach = true
+}
+
+// ReleaseAttachments completes the held block storage attachments and stops holding
+// the attachments requested after
+func (a *API) ReleaseAttachments() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.holdAttach = false
+	for id, instanceID := range a.pending {
+		if block, ok := a.blocks[id]; ok {
+			block.AttachedToInstance = instanceID
+		}
+		delete(a.pending, id)
+	}
+}
+
+// ServeHTTP routes a Vultr API request
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "v2" {
+		writeError(w, http.StatusNotFound, "Invalid API path")
+		return
+	}
+
+	switch parts[1] {
+	case "account":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"account": a.account})
+	case "blocks":
+		a.serveBlocks(w, r, parts[2:])
+	case "vfs":
+		a.serveVFS(w, r, parts[2:])
+	case "instances":
+		a.serveInstances(w, r, parts[2:])
+	case "plans":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"plans": a.plans, "meta": listMeta(len(a.plans))})
+	case "regions":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"regions": a.regions, "meta": listMeta(len(a.regions))})
+	default:
+		writeError(w, http.StatusNotFound, "Invalid API path")
+	}
+}
+
+func (a *API) serveBlocks(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			list := make([]govultr.BlockStorage, 0, len(a.blocks))
+			for _, id := range sortedKeys(a.blocks) {
+				list = append(list, *a.blocks[id])
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"blocks": list, "meta": listMeta(len(list))})
+		case http.MethodPost:
+			var req govultr.BlockStorageCreate
+			if !readJSON(w, r, &req) {
+				return
+			}
+			id := a.newID()
+			block := &govultr.BlockStorage{
+				ID:        id,
+				Status:    "active",
+				SizeGB:    req.SizeGB,
+				Region:    req.Region,
+				Label:     req.Label,
+				MountID:   id,
+				BlockType: req.BlockType,
+			}
+			a.blocks[id] = block
+			writeJSON(w, http.StatusCreated, map[string]interface{}{"block": block})
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Invalid method")
+		}
+		return
+	}
+
+	block, ok := a.blocks[parts[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Invalid block storage ID")
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"block": block})
+	case len(parts) == 1 && r.Method == http.MethodPatch:
+		var req govultr.BlockStorageUpdate
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.SizeGB > 0 {
+			block.SizeGB = req.SizeGB
+		}
+		if req.Label != "" {
+			block.Label = req.Label
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if block.AttachedToInstance != "" {
+			writeError(w, http.StatusBadRequest, "Block storage volume is attached to a server")
+			return
+		}
+		delete(a.pending, block.ID)
+		delete(a.blocks, block.ID)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "attach" && r.Method == http.MethodPost:
+		var req govultr.BlockStorageAttach
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if _, ok := a.instance(req.InstanceID); !ok {
+			writeError(w, http.StatusNotFound, "Invalid instance ID")
+			return
+		}
+		if block.AttachedToInstance != "" {
+			writeError(w, http.StatusBadRequest, "Block storage volume is already attached to a server")
+			return
+		}
+		if instanceID, ok := a.pending[block.ID]; ok && instanceID != req.InstanceID {
+			writeError(w, http.StatusBadRequest, "Block storage volume is already attached to a server")
+			return
+		}
+		if a.holdAttach {
+			a.pending[block.ID] = req.InstanceID
+		} else {
+			delete(a.pending, block.ID)
+			block.AttachedToInstance = req.InstanceID
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "detach" && r.Method == http.MethodPost:
+		if _, ok := a.pending[block.ID]; ok {
+			delete(a.pending, block.ID)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if block.AttachedToInstance == "" {
+			writeError(w, http.StatusBadRequest, "Block storage volume is not currently attached to a server")
+			return
+		}
+		block.AttachedToInstance = ""
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Invalid method")
+	}
+}
+
+func (a *API) serveVFS(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			list := make([]vfs, 0, len(a.vfs))
+			for _, id := range sortedKeys(a.vfs) {
+				list = append(list, *a.vfs[id])
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"vfs": list, "meta": listMeta(len(list))})
+		case http.MethodPost:
+			var req vfs
+			if !readJSON(w, r, &req) {
+				return
+			}
+			req.ID = a.newID()
+			req.Status = "active"
+			a.vfs[req.ID] = &req
+			writeJSON(w, http.StatusCreated, &req)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Invalid method")
+		}
+		return
+	}
+
+	volume, ok := a.vfs[parts[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, volume)
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		var req vfsUpdate
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.StorageSize != nil && req.StorageSize.SizeGB > 0 {
+			volume.StorageSize = *req.StorageSize
+		}
+		if req.Label != "" {
+			volume.Label = req.Label
+		}
+		if req.Tags != nil {
+			volume.Tags = *req.Tags
+		}
+		writeJSON(w, http.StatusOK, volume)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if len(a.attachments[volume.ID]) > 0 {
+			writeError(w, http.StatusBadRequest, "Virtual file system is attached to an instance")
+			return
+		}
+		delete(a.vfs, volume.ID)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "attachments" && r.Method == http.MethodGet:
+		attachments := append([]vfsAttachment{}, a.attachments[volume.ID]...)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"attachments": attachments})
+	case len(parts) == 3 && parts[1] == "attachments" && r.Method == http.MethodPut:
+		a.attachVFS(w, volume.ID, parts[2])
+	case len(parts) == 3 && parts[1] == "attachments" && r.Method == http.MethodDelete:
+		kept := a.attachments[volume.ID][:0]
+		for _, at := range a.attachments[volume.ID] {
+			if at.TargetID != parts[2] {
+				kept = append(kept, at)
+			}
+		}
+		a.attachments[volume.ID] = kept
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Invalid method")
+	}
+}
+
+func (a *API) attachVFS(w http.ResponseWriter, vfsID, instanceID string) {
+	if _, ok := a.instance(instanceID); !ok {
+		writeError(w, http.StatusNotFound, "Invalid instance ID")
+		return
+	}
+
+	for _, at := range a.attachments[vfsID] {
+		if at.TargetID == instanceID {
+			writeJSON(w, http.StatusOK, at)
+			return
+		}
+	}
+
+	at := vfsAttachment{
+		State:    "ATTACHED",
+		VFSID:    vfsID,
+		TargetID: instanceID,
+		MountTag: len(a.attachments[vfsID]) + 1,
+	}
+	a.attachments[vfsID] = append(a.attachments[vfsID], at)
+	writeJSON(w, http.StatusOK, at)
+}
+
+func (a *API) serveInstances(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) != 1 || r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Invalid method")
+		return
+	}
+
+	instance, ok := a.instance(parts[0])
+	if !ok {
+		writeError(w, http.StatusNotFound, "Invalid instance ID")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"instance": instance})
+}
+
+// newID returns a unique ID shaped like the UUIDs Vultr assigns
+func (a *API) newID() string {
+	a.ids++
+	return fmt.Sprintf("00000000-0000-4000-8000-%012d", a.ids)
+}
+
+func listMeta(total int) *govultr.Meta {
+	return &govultr.Meta{Total: total, Links: &govultr.Links{}}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v) //nolint:errcheck
+}
+
+// writeError replies with an error shaped like the Vultr API's
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]interface{}{"error": msg, "status": code})
+}
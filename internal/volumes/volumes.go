@@ -0,0 +1,110 @@
+/*
+Copyright 2020 Vultr Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package volumes lists the volumes of the Vultr account for the driver. It follows the
+// cursors of the paginated govultr list calls and selects the volumes of a listing by
+// label and storage type, so the features reading the listing share the same logic. The
+// other paginated listings of the driver, such as regions and plans, follow their
+// cursors with it too.
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/vultr/govultr/v3"
+)
+
+// Lister returns the page of volumes at the cursor of options, converted to T, and the
+// meta of the page holding the cursor of the next one
+type Lister[T any] func(ctx context.Context, options *govultr.ListOptions) ([]T, *govultr.Meta, error)
+
+// All returns the volumes of every page of list, in the order Vultr returns them
+func All[T any](ctx context.Context, list Lister[T]) ([]T, error) {
+	var all []T
+	err := Walk(ctx, &govultr.ListOptions{}, list, func(page []T) bool {
+		all = append(all, page...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// Walk passes the pages of list to visit in order, starting from options, such as those
+// filtering by tag, until visit returns false or the last page is visited
+func Walk[T any](ctx context.Context, options *govultr.ListOptions, list Lister[T], visit func(page []T) bool) error {
+	for {
+		page, meta, err := list(ctx, options)
+		if err != nil {
+			return err
+		}
+		if !visit(page) {
+			return nil
+		}
+
+		next := nextCursor(meta)
+		if next == "" {
+			return nil
+		}
+		// a cursor pointing back at its own page would list it forever
+		if next == options.Cursor {
+			return fmt.Errorf("the listing returned its cursor %q as the next page", next)
+		}
+		options.Cursor = next
+	}
+}
+
+func nextCursor(meta *govultr.Meta) string {
+	if meta == nil || meta.Links == nil {
+		return ""
+	}
+	return meta.Links.Next
+}
+
+// Filter selects volumes of a listing. Its empty fields select every volume.
+type Filter struct {
+	// LabelPrefix selects the volumes whose label starts with it, such as the prefix of
+	// the labels of a cluster
+	LabelPrefix string
+	// ExcludeLabelPrefix leaves out the volumes whose label starts with it
+	ExcludeLabelPrefix string
+	// Label selects the volume with exactly this label
+	Label string
+	// StorageType selects the volumes of one storage type
+	StorageType string
+}
+
+// Match reports whether a volume with the label and storage type is selected
+func (f Filter) Match(label, storageType string) bool {
+	return strings.HasPrefix(label, f.LabelPrefix) &&
+		(f.ExcludeLabelPrefix == "" || !strings.HasPrefix(label, f.ExcludeLabelPrefix)) &&
+		(f.Label == "" || label == f.Label) &&
+		(f.StorageType == "" || storageType == f.StorageType)
+}
+
+// Fields returns the label and storage type of a volume of type T
+type Fields[T any] func(v *T) (label, storageType string)
+
+// Select returns the volumes of list matched by f, keeping their order
+func Select[T any](list []T, f Filter, fields Fields[T]) []T {
+	var selected []T
+	for i := range list {
+		if f.Match(fields(&list[i])) {
+			selected = append(selected, list[i])
+		}
+	}
+	return selected
+}
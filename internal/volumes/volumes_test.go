@@ -0,0 +1,103 @@
+package volumes
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/vultr/govultr/v3"
+)
+
+func TestAll(t *testing.T) {
+	pages := map[string][]string{"": {"a", "b"}, "page-2": {"c"}, "page-3": {"d"}}
+	next := map[string]string{"": "page-2", "page-2": "page-3"}
+
+	var cursors []string
+	all, err := All(context.Background(), func(_ context.Context, options *govultr.ListOptions) ([]string, *govultr.Meta, error) {
+		cursors = append(cursors, options.Cursor)
+		if next[options.Cursor] == "" {
+			// the last page may come without links at all
+			return pages[options.Cursor], nil, nil
+		}
+		return pages[options.Cursor], &govultr.Meta{Links: &govultr.Links{Next: next[options.Cursor]}}, nil
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(all, []string{"a", "b", "c", "d"}) {
+		t.Errorf("expected the volumes of every page in order, got %v", all)
+	}
+	if !reflect.DeepEqual(cursors, []string{"", "page-2", "page-3"}) {
+		t.Errorf("expected each page listed once from its cursor, got %v", cursors)
+	}
+
+	failure := errors.New("rate limited")
+	if _, err := All(context.Background(), func(_ context.Context, options *govultr.ListOptions) ([]string, *govultr.Meta, error) {
+		if options.Cursor != "" {
+			return nil, nil, failure
+		}
+		return []string{"a"}, &govultr.Meta{Links: &govultr.Links{Next: "page-2"}}, nil
+	}); !errors.Is(err, failure) {
+		t.Errorf("expected the error of a page, got %v", err)
+	}
+
+	if _, err := All(context.Background(), func(_ context.Context, _ *govultr.ListOptions) ([]string, *govultr.Meta, error) {
+		return []string{"a"}, &govultr.Meta{Links: &govultr.Links{Next: "page-2"}}, nil
+	}); err == nil {
+		t.Error("expected a cursor repeating its page to fail the listing")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	next := map[string]string{"": "page-2", "page-2": "page-3"}
+
+	var visited []string
+	err := Walk(context.Background(), &govultr.ListOptions{Tag: "db"}, func(_ context.Context, options *govultr.ListOptions) ([]string, *govultr.Meta, error) { //nolint:lll
+		if options.Tag != "db" {
+			t.Errorf("expected the options of the listing on every page, got %+v", options)
+		}
+		return []string{options.Cursor}, &govultr.Meta{Links: &govultr.Links{Next: next[options.Cursor]}}, nil
+	}, func(page []string) bool {
+		visited = append(visited, page...)
+		return page[0] != "page-2"
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(visited, []string{"", "page-2"}) {
+		t.Errorf("expected the pages up to the one ending the walk, got %v", visited)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	type volume struct{ label, storageType string }
+	list := []volume{
+		{"prod-pvc-1", "block"},
+		{"prod-pvc-2", "vfs"},
+		{"staging-pvc-1", "block"},
+		{"manual", "block"},
+		{"prod-inline-csi-1", "block"},
+	}
+	fields := func(v *volume) (label, storageType string) { return v.label, v.storageType }
+
+	tests := []struct {
+		filter Filter
+		want   []volume
+	}{
+		{filter: Filter{}, want: list},
+		{filter: Filter{LabelPrefix: "prod-"}, want: []volume{list[0], list[1], list[4]}},
+		{filter: Filter{LabelPrefix: "prod-", ExcludeLabelPrefix: "prod-inline-"}, want: list[:2]},
+		{filter: Filter{LabelPrefix: "prod-", StorageType: "block"}, want: []volume{list[0], list[4]}},
+		{filter: Filter{StorageType: "block"}, want: []volume{list[0], list[2], list[3], list[4]}},
+		{filter: Filter{Label: "manual", StorageType: "block"}, want: list[3:4]},
+		{filter: Filter{Label: "manual", StorageType: "vfs"}},
+		{filter: Filter{LabelPrefix: "prod-", Label: "manual"}},
+	}
+
+	for _, tt := range tests {
+		if got := Select(list, tt.filter, fields); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: expected %v, got %v", tt.filter, tt.want, got)
+		}
+	}
+}